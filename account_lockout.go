@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LockoutConfig controls per-account lockout after repeated failed logins.
+// It complements the per-IP RateLimiter, which doesn't stop a slow
+// distributed guess against one account.
+type LockoutConfig struct {
+	MaxFailures int
+	Duration    time.Duration
+}
+
+// loadLockoutConfig reads LOGIN_MAX_FAILURES and LOGIN_LOCKOUT_DURATION
+func loadLockoutConfig() LockoutConfig {
+	config := LockoutConfig{MaxFailures: 5, Duration: 15 * time.Minute}
+
+	if val := os.Getenv("LOGIN_MAX_FAILURES"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			config.MaxFailures = n
+		}
+	}
+
+	if val := os.Getenv("LOGIN_LOCKOUT_DURATION"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			config.Duration = d
+		}
+	}
+
+	return config
+}
+
+// AccountLockedError is returned when a login is refused because the
+// account is locked
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("account locked until %s", e.Until.Format("3:04 PM"))
+}
+
+// loginGuard tracks failed logins for one account table. Staff accounts
+// are keyed by username, parent accounts by id.
+type loginGuard struct {
+	table     string
+	keyColumn string
+}
+
+var (
+	userLogins   = loginGuard{table: "users", keyColumn: "username"}
+	parentLogins = loginGuard{table: "parents", keyColumn: "id"}
+)
+
+// checkLocked returns an AccountLockedError while the account is locked
+func (g loginGuard) checkLocked(key interface{}) error {
+	var until sql.NullTime
+	err := db.QueryRow(fmt.Sprintf(`
+		SELECT locked_until FROM %s WHERE %s = $1 AND locked_until > CURRENT_TIMESTAMP
+	`, g.table, g.keyColumn), key).Scan(&until)
+	if err != nil {
+		// Not locked, or an unknown account, which fails later with the
+		// usual invalid-credentials error
+		return nil
+	}
+	if until.Valid {
+		return &AccountLockedError{Until: until.Time}
+	}
+	return nil
+}
+
+// recordFailure counts a failed password or second-factor attempt, locking
+// the account once the limit is reached. Counting restarts after a lock
+// expires.
+func (g loginGuard) recordFailure(key interface{}) error {
+	config := loadLockoutConfig()
+	attempts := `CASE WHEN locked_until IS NOT NULL AND locked_until <= CURRENT_TIMESTAMP
+		THEN 1 ELSE COALESCE(failed_login_attempts, 0) + 1 END`
+
+	var until sql.NullTime
+	err := db.QueryRow(fmt.Sprintf(`
+		UPDATE %[1]s SET
+			failed_login_attempts = %[3]s,
+			last_failed_login = CURRENT_TIMESTAMP,
+			locked_until = CASE WHEN %[3]s >= $2
+				THEN CURRENT_TIMESTAMP + make_interval(secs => $3) ELSE NULL END
+		WHERE %[2]s = $1
+		RETURNING locked_until
+	`, g.table, g.keyColumn, attempts), key, config.MaxFailures, config.Duration.Seconds()).Scan(&until)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to record login failure for %s %v: %v", g.table, key, err)
+		return nil
+	}
+
+	if until.Valid {
+		log.Printf("SECURITY: %s %v locked after %d failed logins", g.table, key, config.MaxFailures)
+		return &AccountLockedError{Until: until.Time}
+	}
+	return nil
+}
+
+// recordSuccess clears the failure count after a complete login
+func (g loginGuard) recordSuccess(key interface{}) {
+	if err := g.unlock(key); err != nil {
+		log.Printf("Failed to reset login failures for %s %v: %v", g.table, key, err)
+	}
+}
+
+// unlock lifts a lockout early; used by administrators
+func (g loginGuard) unlock(key interface{}) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		UPDATE %s SET failed_login_attempts = 0, locked_until = NULL WHERE %s = $1
+	`, g.table, g.keyColumn), key)
+	return err
+}
+
+// lockedUsers returns the users currently locked out, with their unlock time
+func lockedUsers() (map[string]time.Time, error) {
+	rows, err := db.Query(`
+		SELECT username, locked_until FROM users WHERE locked_until > CURRENT_TIMESTAMP
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locked := make(map[string]time.Time)
+	for rows.Next() {
+		var username string
+		var until time.Time
+		if err := rows.Scan(&username, &until); err != nil {
+			return nil, err
+		}
+		locked[username] = until
+	}
+	return locked, rows.Err()
+}
@@ -722,7 +722,7 @@ func (ae *AnalyticsEngine) generateRecommendations(analytics *FleetAnalytics) []
 // Analytics API Handler
 func AnalyticsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermAnalyticsView) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -55,7 +55,7 @@ func apiDriversHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Only managers can view all drivers
-	if user.Role != "manager" {
+	if !hasPermission(user, PermDriversView) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -70,7 +70,7 @@ func apiDriversHandler(w http.ResponseWriter, r *http.Request) {
 	// Filter only drivers
 	var drivers []User
 	for _, u := range users {
-		if u.Role == "driver" {
+		if u.Role == RoleDriver {
 			drivers = append(drivers, u)
 		}
 	}
@@ -145,7 +145,7 @@ func apiECSEStudentsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Only managers can view ECSE students
-	if user.Role != "manager" {
+	if !hasPermission(user, PermECSEView) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The district assignment planner gives every route at most one crew, a
+// driver with the one bus they drive, and may give a crew several routes
+// as long as their runs in the planned period, or in both periods when
+// planning the whole day, don't overlap. Hard rules
+// (credentials, seats, maintenance holds, double-booking) decide which
+// crews may run a route; soft scores rank the crews that may. The search
+// is exhaustive only up to planSearchLimit partial plans, so a large
+// district can get a plan that isn't the best one, and the plan says so.
+
+const (
+	// planCoverageWeight makes one more covered route worth more than any
+	// mix of soft scores, so the plan covers as many routes as it can first
+	planCoverageWeight = 1000000
+
+	// planSearchLimit caps how many partial plans the search visits before
+	// settling for the best one found
+	planSearchLimit = 50000
+
+	planHistoryDays       = 90 // how far back driving history counts
+	planTurnaroundMinutes = 10 // gap a crew needs between two runs
+	planRideBufferMinutes = 30 // last pickup to school, or school to first dropoff
+)
+
+// errPlanStale is returned when route assignments changed after the plan
+// was made, so applying it would overwrite someone else's work
+var errPlanStale = errors.New("route assignments changed since the plan was made")
+
+// errPlanPeriod refuses to apply a plan made for one period. Assignments
+// cover the whole day, so such a plan never checked the other period's runs.
+var errPlanPeriod = errors.New("only a whole-day plan can be applied")
+
+// timeWindow is when a route runs in one period, in minutes after midnight
+type timeWindow struct {
+	Start, End int
+	Known      bool
+}
+
+func (w timeWindow) String() string {
+	if !w.Known {
+		return "times unknown"
+	}
+	return fmt.Sprintf("%d:%02d-%d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// clashes reports whether one crew couldn't run both windows. A window we
+// know nothing about clashes with everything.
+func (w timeWindow) clashes(other timeWindow) bool {
+	if !w.Known || !other.Known {
+		return true
+	}
+	return w.Start < other.End+planTurnaroundMinutes && other.Start < w.End+planTurnaroundMinutes
+}
+
+// newTimeWindow builds a window from minute offsets, leaving it unknown if
+// either end is missing or they're the wrong way round
+func newTimeWindow(start, end sql.NullFloat64, startPad, endPad int) timeWindow {
+	if !start.Valid || !end.Valid || end.Float64 < start.Float64 {
+		return timeWindow{}
+	}
+	return timeWindow{Start: int(start.Float64) - startPad, End: int(end.Float64) + endPad, Known: true}
+}
+
+type planRoute struct {
+	RouteID      string `db:"route_id"`
+	RouteName    string `db:"route_name"`
+	NeedsLift    bool   `db:"needs_wheelchair_lift"`
+	Riders       int
+	SpecialNeeds bool
+	Morning      timeWindow
+	Afternoon    timeWindow
+}
+
+// clashes reports whether one crew couldn't run both routes in the period,
+// which is "morning", "afternoon", or "" for both
+func (r planRoute) clashes(other planRoute, period string) bool {
+	switch period {
+	case "morning":
+		return r.Morning.clashes(other.Morning)
+	case "afternoon":
+		return r.Afternoon.clashes(other.Afternoon)
+	}
+	return r.Morning.clashes(other.Morning) || r.Afternoon.clashes(other.Afternoon)
+}
+
+// validPlanPeriod reports whether a period can be planned; "" is the whole day
+func validPlanPeriod(period string) bool {
+	return period == "" || period == "morning" || period == "afternoon"
+}
+
+type planBus struct {
+	BusID          string         `db:"bus_id"`
+	Status         string         `db:"status"`
+	Capacity       sql.NullInt64  `db:"capacity"`
+	OilStatus      sql.NullString `db:"oil_status"`
+	TireStatus     sql.NullString `db:"tire_status"`
+	WheelchairLift bool           `db:"wheelchair_lift"`
+}
+
+// needsCDL matches busNeedsCDL: an unrecorded capacity is assumed large
+func (b planBus) needsCDL() bool {
+	return !b.Capacity.Valid || b.Capacity.Int64 > cdlCapacityThreshold
+}
+
+// hold says why the bus can't go on any route, or "" if it can
+func (b planBus) hold() string {
+	switch {
+	case b.Status == "maintenance":
+		return "Bus is in for maintenance"
+	case b.Status != "active":
+		return "Bus is " + strings.ReplaceAll(b.Status, "_", " ")
+	case b.OilStatus.String == "overdue":
+		return "Oil change is overdue"
+	case b.TireStatus.String == "overdue":
+		return "Tire service is overdue"
+	}
+	return ""
+}
+
+// PlanAssignment is one route_assignments row, current or proposed
+type PlanAssignment struct {
+	Driver  string `db:"driver"`
+	BusID   string `db:"bus_id"`
+	RouteID string `db:"route_id"`
+}
+
+type planKey struct {
+	Driver  string `db:"driver"`
+	RouteID string `db:"route_id"`
+}
+
+// assignmentProblem is everything the planner weighs, loaded up front so
+// the search itself never touches the database
+type assignmentProblem struct {
+	Routes      []planRoute
+	Drivers     []string
+	Buses       []planBus
+	Credentials map[string]map[string]*DriverCredential
+	Current     []PlanAssignment
+	DaysDriven  map[planKey]int
+	Preferences map[planKey]int
+	Today       time.Time
+	Period      string // "morning", "afternoon", or "" for the whole day
+}
+
+// sqlxQueryer is satisfied by both db and a transaction
+type sqlxQueryer interface {
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+func loadCurrentAssignments(q sqlxQueryer) ([]PlanAssignment, error) {
+	var current []PlanAssignment
+	err := q.Select(&current, `
+		SELECT driver, bus_id, route_id FROM route_assignments
+		ORDER BY route_id, driver, bus_id
+	`)
+	return current, err
+}
+
+func loadAssignmentProblem(period string) (*assignmentProblem, error) {
+	p := &assignmentProblem{
+		DaysDriven:  map[planKey]int{},
+		Preferences: map[planKey]int{},
+		Today:       time.Now(),
+		Period:      period,
+	}
+
+	if err := db.Select(&p.Routes, `
+		SELECT route_id, route_name, needs_wheelchair_lift FROM routes
+		ORDER BY route_name, route_id
+	`); err != nil {
+		return nil, fmt.Errorf("failed to load routes: %w", err)
+	}
+
+	// Riders and their stop times give each route's size and, failing any
+	// driving history, when it runs
+	var ridership []struct {
+		RouteID      string          `db:"route_id"`
+		Riders       int             `db:"riders"`
+		FirstPickup  sql.NullFloat64 `db:"first_pickup"`
+		LastPickup   sql.NullFloat64 `db:"last_pickup"`
+		FirstDropoff sql.NullFloat64 `db:"first_dropoff"`
+		LastDropoff  sql.NullFloat64 `db:"last_dropoff"`
+	}
+	if err := db.Select(&ridership, `
+		SELECT route_id, COUNT(*) AS riders,
+		       MIN(EXTRACT(EPOCH FROM pickup_time)) / 60 AS first_pickup,
+		       MAX(EXTRACT(EPOCH FROM pickup_time)) / 60 AS last_pickup,
+		       MIN(EXTRACT(EPOCH FROM dropoff_time)) / 60 AS first_dropoff,
+		       MAX(EXTRACT(EPOCH FROM dropoff_time)) / 60 AS last_dropoff
+		FROM students
+		WHERE active = true AND route_id IS NOT NULL
+		GROUP BY route_id
+	`); err != nil {
+		return nil, fmt.Errorf("failed to load ridership: %w", err)
+	}
+
+	var logged []struct {
+		RouteID string          `db:"route_id"`
+		Period  string          `db:"period"`
+		Departs sql.NullFloat64 `db:"departs"`
+		Arrives sql.NullFloat64 `db:"arrives"`
+	}
+	if err := db.Select(&logged, `
+		SELECT route_id, period,
+		       AVG(EXTRACT(EPOCH FROM departure_time)) / 60 AS departs,
+		       AVG(EXTRACT(EPOCH FROM arrival_time)) / 60 AS arrives
+		FROM driver_logs
+		WHERE date >= CURRENT_DATE - $1::int
+		  AND departure_time IS NOT NULL AND arrival_time IS NOT NULL
+		GROUP BY route_id, period
+	`, planHistoryDays); err != nil {
+		return nil, fmt.Errorf("failed to load route times: %w", err)
+	}
+
+	var specialNeeds []string
+	if err := db.Select(&specialNeeds, `
+		SELECT DISTINCT r.route_id FROM ecse_students e
+		JOIN routes r ON e.bus_route IN (r.route_id, r.route_name)
+		WHERE e.transportation_required = true
+	`); err != nil {
+		return nil, fmt.Errorf("failed to load special needs riders: %w", err)
+	}
+
+	index := make(map[string]int, len(p.Routes))
+	for i, route := range p.Routes {
+		index[route.RouteID] = i
+	}
+	for _, row := range ridership {
+		if i, ok := index[row.RouteID]; ok {
+			route := &p.Routes[i]
+			route.Riders = row.Riders
+			route.Morning = newTimeWindow(row.FirstPickup, row.LastPickup, 0, planRideBufferMinutes)
+			route.Afternoon = newTimeWindow(row.FirstDropoff, row.LastDropoff, planRideBufferMinutes, 0)
+		}
+	}
+	// What drivers actually logged beats what the stop times suggest
+	for _, row := range logged {
+		i, ok := index[row.RouteID]
+		if !ok {
+			continue
+		}
+		window := newTimeWindow(row.Departs, row.Arrives, 0, 0)
+		if !window.Known {
+			continue
+		}
+		if row.Period == "morning" {
+			p.Routes[i].Morning = window
+		} else if row.Period == "afternoon" {
+			p.Routes[i].Afternoon = window
+		}
+	}
+	for _, routeID := range specialNeeds {
+		if i, ok := index[routeID]; ok {
+			p.Routes[i].SpecialNeeds = true
+		}
+	}
+
+	if err := db.Select(&p.Drivers, `
+		SELECT username FROM users
+		WHERE role = $1 AND status = 'active'
+		ORDER BY username
+	`, RoleDriver); err != nil {
+		return nil, fmt.Errorf("failed to load drivers: %w", err)
+	}
+	credentials, err := getAllDriverCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %w", err)
+	}
+	p.Credentials = credentials
+
+	if err := db.Select(&p.Buses, `
+		SELECT bus_id, status, capacity, oil_status, tire_status, wheelchair_lift
+		FROM buses ORDER BY bus_id
+	`); err != nil {
+		return nil, fmt.Errorf("failed to load buses: %w", err)
+	}
+
+	if p.Current, err = loadCurrentAssignments(db); err != nil {
+		return nil, fmt.Errorf("failed to load assignments: %w", err)
+	}
+
+	var history []struct {
+		planKey
+		Days int `db:"days"`
+	}
+	if err := db.Select(&history, `
+		SELECT driver, route_id, COUNT(DISTINCT date) AS days
+		FROM driver_logs
+		WHERE date >= CURRENT_DATE - $1::int
+		GROUP BY driver, route_id
+	`, planHistoryDays); err != nil {
+		return nil, fmt.Errorf("failed to load driving history: %w", err)
+	}
+	for _, h := range history {
+		p.DaysDriven[h.planKey] = h.Days
+	}
+
+	var preferences []struct {
+		planKey
+		Preference int `db:"preference"`
+	}
+	if err := db.Select(&preferences, `
+		SELECT username AS driver, route_id, preference FROM driver_route_preferences
+	`); err != nil {
+		return nil, fmt.Errorf("failed to load route preferences: %w", err)
+	}
+	for _, pref := range preferences {
+		p.Preferences[pref.planKey] = pref.Preference
+	}
+
+	return p, nil
+}
+
+// runsNow reports whether any current assignment of the route matches
+func (p *assignmentProblem) runsNow(routeID string, match func(PlanAssignment) bool) bool {
+	for _, a := range p.Current {
+		if a.RouteID == routeID && match(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// driverFit scores a driver on a route. ok is false when they can't
+// legally drive it at all, and cdlOK when they can't take a bus that
+// needs a CDL on it.
+func (p *assignmentProblem) driverFit(driver string, route planRoute) (score int, reasons []string, ok, cdlOK bool) {
+	credentials := p.Credentials[driver]
+	blocking, _ := splitConflicts(evaluateDriverQualifications(credentials, false, route.SpecialNeeds, p.Today))
+	if len(blocking) > 0 {
+		return 0, nil, false, false
+	}
+	blocking, _ = splitConflicts(evaluateDriverQualifications(credentials, true, route.SpecialNeeds, p.Today))
+	cdlOK = len(blocking) == 0
+
+	if p.runsNow(route.RouteID, func(a PlanAssignment) bool { return a.Driver == driver }) {
+		score += 40
+		reasons = append(reasons, "Drives this route now")
+	}
+	if days := p.DaysDriven[planKey{driver, route.RouteID}]; days > 0 {
+		score += min(2*days, 30)
+		reasons = append(reasons, fmt.Sprintf("Drove it on %d days in the last %d", days, planHistoryDays))
+	}
+	switch p.Preferences[planKey{driver, route.RouteID}] {
+	case 1:
+		score += 25
+		reasons = append(reasons, "Prefers this route")
+	case -1:
+		score -= 25
+		reasons = append(reasons, "Asked not to drive this route")
+	}
+	expiring := 0
+	for _, c := range credentials {
+		if c.Status(p.Today) == CredentialExpiring {
+			expiring++
+		}
+	}
+	if expiring > 0 {
+		score -= 5 * expiring
+		reasons = append(reasons, fmt.Sprintf("%d credential(s) expiring soon", expiring))
+	}
+	return score, reasons, true, cdlOK
+}
+
+// busFit scores a bus on a route; ok is false when it can't seat the riders
+func (p *assignmentProblem) busFit(bus planBus, route planRoute) (score int, reasons []string, ok bool) {
+	if !bus.Capacity.Valid || int(bus.Capacity.Int64) < route.Riders {
+		return 0, nil, false
+	}
+
+	if p.runsNow(route.RouteID, func(a PlanAssignment) bool { return a.BusID == bus.BusID }) {
+		score += 15
+		reasons = append(reasons, "Bus runs this route now")
+	}
+	switch {
+	case route.NeedsLift && bus.WheelchairLift:
+		score += 50
+		reasons = append(reasons, "Has the wheelchair lift this route needs")
+	case route.NeedsLift:
+		score -= 50
+		reasons = append(reasons, "No wheelchair lift, which this route needs")
+	case bus.WheelchairLift:
+		// Keep lift buses free for the routes that need them
+		score -= 10
+	}
+	spare := int(bus.Capacity.Int64) - route.Riders
+	score -= min(spare/5, 10)
+	reasons = append(reasons, fmt.Sprintf("%d of %d seats filled", route.Riders, bus.Capacity.Int64))
+	if bus.OilStatus.String == "due_soon" {
+		score -= 5
+		reasons = append(reasons, "Oil change due soon")
+	}
+	if bus.TireStatus.String == "due_soon" {
+		score -= 5
+		reasons = append(reasons, "Tire service due soon")
+	}
+	return score, reasons, true
+}
+
+// planCandidate is a driver and bus, by index, that could legally run a route
+type planCandidate struct {
+	driver, bus int
+	score       int
+}
+
+// candidates lists every crew that may run the route, best first
+func (p *assignmentProblem) candidates(r int) []planCandidate {
+	route := p.Routes[r]
+	type driverScore struct {
+		score int
+		cdlOK bool
+	}
+	drivers := make(map[int]driverScore)
+	for d, driver := range p.Drivers {
+		if score, _, ok, cdlOK := p.driverFit(driver, route); ok {
+			drivers[d] = driverScore{score, cdlOK}
+		}
+	}
+
+	var candidates []planCandidate
+	for b, bus := range p.Buses {
+		if bus.hold() != "" {
+			continue
+		}
+		busScore, _, ok := p.busFit(bus, route)
+		if !ok {
+			continue
+		}
+		for d := range p.Drivers {
+			fit, ok := drivers[d]
+			if !ok || (bus.needsCDL() && !fit.cdlOK) {
+				continue
+			}
+			candidates = append(candidates, planCandidate{driver: d, bus: b, score: fit.score + busScore})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	return candidates
+}
+
+// crewState tracks which bus each driver has and which routes each crew
+// runs while a plan is being built
+type crewState struct {
+	problem      *assignmentProblem
+	busOf        []int // by driver, -1 while they have no route
+	driverOf     []int // by bus
+	driverRoutes [][]int
+}
+
+func newCrewState(p *assignmentProblem) *crewState {
+	s := &crewState{
+		problem:      p,
+		busOf:        make([]int, len(p.Drivers)),
+		driverOf:     make([]int, len(p.Buses)),
+		driverRoutes: make([][]int, len(p.Drivers)),
+	}
+	for i := range s.busOf {
+		s.busOf[i] = -1
+	}
+	for i := range s.driverOf {
+		s.driverOf[i] = -1
+	}
+	return s
+}
+
+// fits reports whether the crew can take the route without a driver
+// changing buses, a bus changing drivers, or two runs overlapping
+func (s *crewState) fits(c planCandidate, r int) bool {
+	if s.busOf[c.driver] != -1 && s.busOf[c.driver] != c.bus {
+		return false
+	}
+	if s.driverOf[c.bus] != -1 && s.driverOf[c.bus] != c.driver {
+		return false
+	}
+	for _, other := range s.driverRoutes[c.driver] {
+		if s.problem.Routes[r].clashes(s.problem.Routes[other], s.problem.Period) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *crewState) place(c planCandidate, r int) {
+	s.busOf[c.driver] = c.bus
+	s.driverOf[c.bus] = c.driver
+	s.driverRoutes[c.driver] = append(s.driverRoutes[c.driver], r)
+}
+
+// unplace undoes the most recent place for the driver
+func (s *crewState) unplace(c planCandidate) {
+	routes := s.driverRoutes[c.driver]
+	s.driverRoutes[c.driver] = routes[:len(routes)-1]
+	if len(routes) == 1 {
+		s.busOf[c.driver] = -1
+		s.driverOf[c.bus] = -1
+	}
+}
+
+// planSearch is a depth-first branch and bound over routes. Each route
+// either gets one of its candidates or stays uncovered; a branch is cut
+// when the most the routes left could add can't beat the best complete
+// plan found so far.
+type planSearch struct {
+	state      *crewState
+	order      []int
+	position   []int // index in order, by route
+	cliques    [][]int
+	candidates [][]planCandidate
+	choice     []int // candidate index by route, -1 for uncovered
+	best       []int
+	bestValue  int
+	nodes      int
+	exhausted  bool
+}
+
+// quickBound is what the routes left would add if each got its best crew
+// that still fits, even if that's the same crew every time
+func (s *planSearch) quickBound(depth int) int {
+	total := 0
+	for _, r := range s.order[depth:] {
+		for _, c := range s.candidates[r] {
+			if s.state.fits(c, r) {
+				total += planCoverageWeight + c.score
+				break
+			}
+		}
+	}
+	return total
+}
+
+// bound is the most the routes left could add. Routes in a clique all
+// clash with each other, so no driver can run two of them, and the best
+// matching of the clique's routes to distinct drivers is an upper bound
+// on what any plan gets from it. Buses are left out of the matching,
+// which keeps it a relaxation.
+func (s *planSearch) bound(depth int) int {
+	total := 0
+	for _, clique := range s.cliques {
+		var routes []int
+		for _, r := range clique {
+			if s.position[r] >= depth {
+				routes = append(routes, r)
+			}
+		}
+		if len(routes) == 0 {
+			continue
+		}
+
+		// Each route's best value with each driver, over crews that fit
+		column := map[int]int{}
+		weights := make([][]int, len(routes))
+		for i, r := range routes {
+			weights[i] = make([]int, 0, len(column))
+			for _, c := range s.candidates[r] {
+				j, seen := column[c.driver]
+				if !seen {
+					j = len(column)
+					column[c.driver] = j
+				}
+				for len(weights[i]) <= j {
+					weights[i] = append(weights[i], 0)
+				}
+				if weights[i][j] == 0 && s.state.fits(c, r) {
+					weights[i][j] = planCoverageWeight + c.score
+				}
+			}
+		}
+		total += maxWeightMatching(weights, len(column))
+	}
+	return total
+}
+
+func (s *planSearch) search(depth, value int) {
+	s.nodes++
+	if s.nodes > planSearchLimit {
+		s.exhausted = true
+		return
+	}
+	if depth == len(s.order) {
+		if value > s.bestValue {
+			s.bestValue = value
+			copy(s.best, s.choice)
+		}
+		return
+	}
+	if value+s.quickBound(depth) <= s.bestValue || value+s.bound(depth) <= s.bestValue {
+		return
+	}
+
+	r := s.order[depth]
+	for i, c := range s.candidates[r] {
+		if !s.state.fits(c, r) {
+			continue
+		}
+		s.state.place(c, r)
+		s.choice[r] = i
+		s.search(depth+1, value+planCoverageWeight+c.score)
+		s.state.unplace(c)
+		if s.exhausted {
+			break
+		}
+	}
+	s.choice[r] = -1
+	if !s.exhausted {
+		s.search(depth+1, value)
+	}
+}
+
+// PlanRow is one route in a proposed plan beside what it has now
+type PlanRow struct {
+	RouteID   string
+	RouteName string
+	Riders    int
+	Times     string
+	Current   []PlanAssignment
+	Driver    string // empty when the plan leaves the route uncovered
+	BusID     string
+	Reasons   []string
+	Change    string // unchanged, new, changed, removed or uncovered
+}
+
+// PlanHold is a bus the plan can't use
+type PlanHold struct {
+	BusID  string
+	Reason string
+}
+
+// AssignmentPlan is a proposed set of route assignments for the district
+// and how it differs from the current one
+type AssignmentPlan struct {
+	Rows    []PlanRow
+	Held    []PlanHold
+	Added   []PlanAssignment
+	Removed []PlanAssignment
+	Covered int
+	Score   int
+	// Optimal is false when the search hit its limit and Rows is the best
+	// plan it found rather than the best there is
+	Optimal bool
+	Period  string
+	// Token identifies the plan and the assignments it was compared with
+	Token       string
+	currentHash string
+}
+
+func hashAssignments(assignments ...[]PlanAssignment) string {
+	h := sha256.New()
+	for _, list := range assignments {
+		for _, a := range list {
+			fmt.Fprintf(h, "%s\x00%s\x00%s\n", a.Driver, a.BusID, a.RouteID)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// solveAssignmentPlan looks for the plan that covers the most routes and,
+// among those, scores best; Optimal reports whether it was sure to find it
+func solveAssignmentPlan(p *assignmentProblem) *AssignmentPlan {
+	search := &planSearch{
+		state:      newCrewState(p),
+		candidates: make([][]planCandidate, len(p.Routes)),
+		choice:     make([]int, len(p.Routes)),
+		best:       make([]int, len(p.Routes)),
+		bestValue:  -1,
+	}
+	for r := range p.Routes {
+		search.candidates[r] = p.candidates(r)
+		search.order = append(search.order, r)
+		search.choice[r] = -1
+		search.best[r] = -1
+	}
+	// Routes with the fewest options go first, so conflicts surface early
+	sort.SliceStable(search.order, func(i, j int) bool {
+		return len(search.candidates[search.order[i]]) < len(search.candidates[search.order[j]])
+	})
+	search.position = make([]int, len(p.Routes))
+	for i, r := range search.order {
+		search.position[r] = i
+	}
+	// Group routes that all clash with each other; when run times are
+	// unknown everything clashes and the whole district is one group
+	for _, r := range search.order {
+		placed := false
+		for i, clique := range search.cliques {
+			fits := true
+			for _, other := range clique {
+				if !p.Routes[r].clashes(p.Routes[other], p.Period) {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				search.cliques[i] = append(clique, r)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			search.cliques = append(search.cliques, []int{r})
+		}
+	}
+	search.search(0, 0)
+
+	plan := &AssignmentPlan{Optimal: !search.exhausted, Period: p.Period}
+	for _, bus := range p.Buses {
+		if reason := bus.hold(); reason != "" {
+			plan.Held = append(plan.Held, PlanHold{BusID: bus.BusID, Reason: reason})
+		}
+	}
+
+	for r, route := range p.Routes {
+		row := PlanRow{
+			RouteID:   route.RouteID,
+			RouteName: route.RouteName,
+			Riders:    route.Riders,
+			Times:     route.Morning.String() + " / " + route.Afternoon.String(),
+		}
+		for _, a := range p.Current {
+			if a.RouteID == route.RouteID {
+				row.Current = append(row.Current, a)
+			}
+		}
+
+		var proposed *PlanAssignment
+		if i := search.best[r]; i >= 0 {
+			c := search.candidates[r][i]
+			driver, bus := p.Drivers[c.driver], p.Buses[c.bus]
+			proposed = &PlanAssignment{Driver: driver, BusID: bus.BusID, RouteID: route.RouteID}
+			row.Driver, row.BusID = driver, bus.BusID
+			driverScore, driverReasons, _, _ := p.driverFit(driver, route)
+			busScore, busReasons, _ := p.busFit(bus, route)
+			row.Reasons = append(driverReasons, busReasons...)
+			plan.Covered++
+			plan.Score += driverScore + busScore
+		} else {
+			row.Reasons = []string{uncoveredReason(p, r, search.candidates[r])}
+		}
+
+		kept := false
+		for _, a := range row.Current {
+			if proposed != nil && a == *proposed {
+				kept = true
+			} else {
+				plan.Removed = append(plan.Removed, a)
+			}
+		}
+		if proposed != nil && !kept {
+			plan.Added = append(plan.Added, *proposed)
+		}
+		switch {
+		case proposed == nil && len(row.Current) == 0:
+			row.Change = "uncovered"
+		case proposed == nil:
+			row.Change = "removed"
+		case kept && len(row.Current) == 1:
+			row.Change = "unchanged"
+		case len(row.Current) == 0:
+			row.Change = "new"
+		default:
+			row.Change = "changed"
+		}
+		plan.Rows = append(plan.Rows, row)
+	}
+
+	plan.currentHash = hashAssignments(p.Current)
+	plan.Token = hashAssignments(p.Current, plan.Added, plan.Removed)
+	return plan
+}
+
+// maxWeightMatching returns the largest total weight of a matching between
+// rows and columns, where weights[i][j] is the value of pairing row i with
+// column j (missing or 0 means they can't pair) and rows may go unmatched.
+// It is the Hungarian algorithm on the square cost matrix.
+func maxWeightMatching(weights [][]int, columns int) int {
+	n := max(len(weights), columns)
+	if n == 0 {
+		return 0
+	}
+	top := 0
+	for _, row := range weights {
+		for _, w := range row {
+			top = max(top, w)
+		}
+	}
+	cost := func(i, j int) int {
+		if i < len(weights) && j < len(weights[i]) {
+			return top - weights[i][j]
+		}
+		return top
+	}
+
+	// Potentials and matching are 1-based; column 0 is the free column
+	// each row starts its augmenting path from
+	const inf = int(^uint(0) >> 2)
+	u := make([]int, n+1)
+	v := make([]int, n+1)
+	match := make([]int, n+1) // row matched to each column
+	way := make([]int, n+1)
+	for i := 1; i <= n; i++ {
+		match[0] = i
+		j0 := 0
+		minv := make([]int, n+1)
+		used := make([]bool, n+1)
+		for j := range minv {
+			minv[j] = inf
+		}
+		for match[j0] != 0 {
+			used[j0] = true
+			i0, delta, j1 := match[j0], inf, 0
+			for j := 1; j <= n; j++ {
+				if used[j] {
+					continue
+				}
+				if cur := cost(i0-1, j-1) - u[i0] - v[j]; cur < minv[j] {
+					minv[j], way[j] = cur, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[match[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			match[j0] = match[j1]
+			j0 = j1
+		}
+	}
+
+	total := 0
+	for j := 1; j <= n; j++ {
+		if i := match[j] - 1; i < len(weights) && j-1 < len(weights[i]) {
+			total += weights[i][j-1]
+		}
+	}
+	return total
+}
+
+// uncoveredReason explains why a route was left without a crew
+func uncoveredReason(p *assignmentProblem, r int, candidates []planCandidate) string {
+	route := p.Routes[r]
+	if len(candidates) > 0 {
+		return "Every crew that could run this route is needed on another one"
+	}
+	for _, driver := range p.Drivers {
+		if _, _, ok, _ := p.driverFit(driver, route); ok {
+			return fmt.Sprintf("No available bus can seat its %d riders with a driver qualified for it", route.Riders)
+		}
+	}
+	return "No driver holds the credentials this route needs"
+}
+
+// applyAssignmentPlan makes the plan's changes to route_assignments in one
+// transaction, refusing if anything changed since the plan was made
+func applyAssignmentPlan(plan *AssignmentPlan) error {
+	if plan.Period != "" {
+		return errPlanPeriod
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`LOCK TABLE route_assignments IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	current, err := loadCurrentAssignments(tx)
+	if err != nil {
+		return err
+	}
+	if hashAssignments(current) != plan.currentHash {
+		return errPlanStale
+	}
+
+	for _, a := range plan.Removed {
+		if _, err := tx.Exec(`
+			DELETE FROM route_assignments WHERE driver = $1 AND bus_id = $2 AND route_id = $3
+		`, a.Driver, a.BusID, a.RouteID); err != nil {
+			return err
+		}
+	}
+	for _, a := range plan.Added {
+		if _, err := tx.Exec(`
+			INSERT INTO route_assignments (driver, bus_id, route_id, assigned_date, created_at)
+			VALUES ($1, $2, $3, CURRENT_DATE, CURRENT_TIMESTAMP)
+		`, a.Driver, a.BusID, a.RouteID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Where an attendance entry was recorded
+const (
+	AttendanceSourceWeb    = "web"
+	AttendanceSourceMobile = "mobile"
+	AttendanceSourceRFID   = "rfid"
+)
+
+var attendanceStatuses = map[string]bool{
+	"present": true, "absent": true, "excused": true, "late": true,
+}
+
+// AttendanceEntry is one student's ride, or missed ride, for one period of
+// one day. There is at most one per student, date and period.
+type AttendanceEntry struct {
+	ID                int             `db:"id"`
+	StudentID         string          `db:"student_id"`
+	Date              time.Time       `db:"date"`
+	Period            string          `db:"period"`
+	RouteID           sql.NullString  `db:"route_id"`
+	Status            string          `db:"status"`
+	BoardedAt         sql.NullTime    `db:"boarded_at"`
+	BoardedStop       sql.NullString  `db:"boarded_stop"`
+	BoardedLatitude   sql.NullFloat64 `db:"boarded_latitude"`
+	BoardedLongitude  sql.NullFloat64 `db:"boarded_longitude"`
+	AlightedAt        sql.NullTime    `db:"alighted_at"`
+	AlightedStop      sql.NullString  `db:"alighted_stop"`
+	AlightedLatitude  sql.NullFloat64 `db:"alighted_latitude"`
+	AlightedLongitude sql.NullFloat64 `db:"alighted_longitude"`
+	Source            string          `db:"source"`
+	RecordedBy        sql.NullString  `db:"recorded_by"`
+	Notes             string          `db:"notes"`
+	DriverLogID       sql.NullInt64   `db:"driver_log_id"`
+	CreatedAt         time.Time       `db:"created_at"`
+	UpdatedAt         time.Time       `db:"updated_at"`
+}
+
+// driverLogRiders selects how many students rode on a driver_logs row
+const driverLogRiders = `(SELECT COUNT(*) FROM attendance_ledger al
+	WHERE al.driver_log_id = driver_logs.id AND al.status IN ('present', 'late')) AS riders`
+
+// attendancePeriodAt is the run a time of day falls in
+func attendancePeriodAt(t time.Time) string {
+	if t.Hour() < 12 {
+		return "morning"
+	}
+	return "afternoon"
+}
+
+// recordAttendance adds or updates a student's entry for the period. The
+// status, source and recorder are replaced; times, stops, coordinates and
+// notes the new entry leaves blank keep what was recorded before, so a
+// tap-on and a later tap-off build up one entry. Without a route the
+// student's current one is used.
+func recordAttendance(ex sqlx.Execer, e AttendanceEntry) error {
+	if !attendanceStatuses[e.Status] {
+		return fmt.Errorf("invalid attendance status %q", e.Status)
+	}
+	if e.Period != "morning" && e.Period != "afternoon" {
+		return fmt.Errorf("invalid period %q", e.Period)
+	}
+	_, err := ex.Exec(`
+		INSERT INTO attendance_ledger (
+			student_id, date, period, route_id, status,
+			boarded_at, boarded_stop, boarded_latitude, boarded_longitude,
+			alighted_at, alighted_stop, alighted_latitude, alighted_longitude,
+			source, recorded_by, notes, driver_log_id
+		) VALUES ($1, $2, $3, COALESCE($4, (SELECT route_id FROM students WHERE student_id = $1)), $5,
+			$6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (student_id, date, period) DO UPDATE SET
+			route_id = COALESCE(EXCLUDED.route_id, attendance_ledger.route_id),
+			status = EXCLUDED.status,
+			boarded_at = COALESCE(EXCLUDED.boarded_at, attendance_ledger.boarded_at),
+			boarded_stop = COALESCE(EXCLUDED.boarded_stop, attendance_ledger.boarded_stop),
+			boarded_latitude = COALESCE(EXCLUDED.boarded_latitude, attendance_ledger.boarded_latitude),
+			boarded_longitude = COALESCE(EXCLUDED.boarded_longitude, attendance_ledger.boarded_longitude),
+			alighted_at = COALESCE(EXCLUDED.alighted_at, attendance_ledger.alighted_at),
+			alighted_stop = COALESCE(EXCLUDED.alighted_stop, attendance_ledger.alighted_stop),
+			alighted_latitude = COALESCE(EXCLUDED.alighted_latitude, attendance_ledger.alighted_latitude),
+			alighted_longitude = COALESCE(EXCLUDED.alighted_longitude, attendance_ledger.alighted_longitude),
+			source = EXCLUDED.source,
+			recorded_by = EXCLUDED.recorded_by,
+			notes = CASE WHEN EXCLUDED.notes = '' THEN attendance_ledger.notes ELSE EXCLUDED.notes END,
+			driver_log_id = COALESCE(EXCLUDED.driver_log_id, attendance_ledger.driver_log_id),
+			updated_at = CURRENT_TIMESTAMP
+	`, e.StudentID, e.Date.Format("2006-01-02"), e.Period, e.RouteID, e.Status,
+		e.BoardedAt, e.BoardedStop, e.BoardedLatitude, e.BoardedLongitude,
+		e.AlightedAt, e.AlightedStop, e.AlightedLatitude, e.AlightedLongitude,
+		e.Source, e.RecordedBy, e.Notes, e.DriverLogID)
+	return err
+}
+
+// loadStudentAttendance returns a student's entries from the last days,
+// newest first
+func loadStudentAttendance(studentID string, days int) ([]AttendanceEntry, error) {
+	var entries []AttendanceEntry
+	err := db.Select(&entries, `
+		SELECT * FROM attendance_ledger
+		WHERE student_id = $1 AND date > CURRENT_DATE - $2::int
+		ORDER BY date DESC, period DESC
+	`, studentID, days)
+	return entries, err
+}
+
+// clockOn puts a HH:MM time on a date, or returns null for a blank or
+// unreadable time
+func clockOn(date time.Time, clock string) sql.NullTime {
+	t, err := time.ParseInLocation("15:04", clock, time.Local)
+	if err != nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{
+		Time:  time.Date(date.Year(), date.Month(), date.Day(), t.Hour(), t.Minute(), 0, 0, time.Local),
+		Valid: true,
+	}
+}
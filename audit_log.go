@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Common audit actions. Anything that isn't a plain create, update or
+// delete uses a descriptive verb of its own, such as "unlock".
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+	AuditImport = "import"
+)
+
+// auditLockKey serialises appends so each entry links to the one before
+const auditLockKey = 7305001
+
+// auditSkippedColumns never appear in an audit diff: secrets, and
+// bookkeeping columns that change on every write
+var auditSkippedColumns = map[string]bool{
+	"password":           true,
+	"totp_secret":        true,
+	"updated_at":         true,
+	"expiry_notified_on": true,
+}
+
+// AuditActor is who made a change and from where
+type AuditActor struct {
+	Username  string
+	IPAddress string
+}
+
+// auditActorFromRequest identifies the signed-in user making a request
+func auditActorFromRequest(r *http.Request) AuditActor {
+	actor := AuditActor{Username: "anonymous", IPAddress: getClientIP(r)}
+	if user := getUserFromSession(r); user != nil {
+		actor.Username = user.Username
+	}
+	return actor
+}
+
+// AuditChange is one field's value before and after a change
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// HasFrom and HasTo tell a missing value (created or deleted records)
+// apart from an empty or false one
+func (c AuditChange) HasFrom() bool { return c.From != nil }
+func (c AuditChange) HasTo() bool   { return c.To != nil }
+
+// AuditEntry is one row of the audit log
+type AuditEntry struct {
+	ID         int64          `db:"id"`
+	OccurredAt time.Time      `db:"occurred_at"`
+	Actor      string         `db:"actor"`
+	Action     string         `db:"action"`
+	EntityType string         `db:"entity_type"`
+	EntityID   string         `db:"entity_id"`
+	Changes    string         `db:"changes"`
+	IPAddress  sql.NullString `db:"ip_address"`
+	PrevHash   string         `db:"prev_hash"`
+	Hash       string         `db:"hash"`
+}
+
+// computeHash hashes the entry's content together with the previous
+// entry's hash. The JSON encoding fixes field order and escaping, so the
+// same row always produces the same hash.
+func (e AuditEntry) computeHash() string {
+	content, _ := json.Marshal([]interface{}{
+		e.ID,
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.Action,
+		e.EntityType,
+		e.EntityID,
+		e.Changes,
+		e.IPAddress.String,
+		e.PrevHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ChangeSet decodes the entry's field changes for display
+func (e AuditEntry) ChangeSet() map[string]AuditChange {
+	changes := make(map[string]AuditChange)
+	// UseNumber keeps mileages and IDs from printing as 1.25e+06
+	decoder := json.NewDecoder(strings.NewReader(e.Changes))
+	decoder.UseNumber()
+	decoder.Decode(&changes)
+	return changes
+}
+
+// auditSnapshot reads a record as a column → value map, for diffing
+// before and after a change. It returns nil if the record doesn't exist.
+func auditSnapshot(table, keyColumn string, key interface{}) map[string]interface{} {
+	rows, err := db.Queryx(fmt.Sprintf("SELECT * FROM %s WHERE %s = $1 LIMIT 1", table, keyColumn), key)
+	if err != nil {
+		log.Printf("Audit snapshot of %s %v failed: %v", table, key, err)
+		return nil
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil
+	}
+	snapshot := make(map[string]interface{})
+	if err := rows.MapScan(snapshot); err != nil {
+		log.Printf("Audit snapshot of %s %v failed: %v", table, key, err)
+		return nil
+	}
+	for column, value := range snapshot {
+		if b, ok := value.([]byte); ok {
+			snapshot[column] = string(b)
+		}
+	}
+	return snapshot
+}
+
+// diffSnapshots keeps the fields that differ between two snapshots. Either
+// side may be nil, for records that were created or deleted.
+func diffSnapshots(before, after map[string]interface{}) map[string]AuditChange {
+	changes := make(map[string]AuditChange)
+	for column, from := range before {
+		to, ok := after[column]
+		if auditSkippedColumns[column] || (ok && fmt.Sprint(from) == fmt.Sprint(to)) {
+			continue
+		}
+		changes[column] = AuditChange{From: from, To: to}
+	}
+	for column, to := range after {
+		if _, ok := before[column]; ok || auditSkippedColumns[column] || to == nil {
+			continue
+		}
+		changes[column] = AuditChange{To: to}
+	}
+	return changes
+}
+
+// recordAudit appends an entry to the audit log. before and after are
+// snapshots of the record, either of which may be nil. Errors are logged
+// rather than returned, since by now the change itself has been made.
+func recordAudit(actor AuditActor, action, entityType, entityID string, before, after map[string]interface{}) {
+	recordAuditChanges(actor, action, entityType, entityID, diffSnapshots(before, after))
+}
+
+// recordAuditChanges appends an entry whose changes have already been
+// worked out, for actions that aren't a simple record edit
+func recordAuditChanges(actor AuditActor, action, entityType, entityID string, changes map[string]AuditChange) {
+	if db == nil {
+		return
+	}
+	if err := appendAuditEntry(actor, action, entityType, entityID, changes); err != nil {
+		log.Printf("AUDIT: failed to record %s %s %s by %s: %v", action, entityType, entityID, actor.Username, err)
+	}
+}
+
+func appendAuditEntry(actor AuditActor, action, entityType, entityID string, changes map[string]AuditChange) error {
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	entry := AuditEntry{
+		// Postgres keeps microseconds, so truncate now or the hash won't
+		// match the stored row
+		OccurredAt: time.Now().UTC().Truncate(time.Microsecond),
+		Actor:      actor.Username,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Changes:    string(changesJSON),
+		IPAddress:  sql.NullString{String: truncateString(actor.IPAddress, 45), Valid: actor.IPAddress != ""},
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", auditLockKey); err != nil {
+		return err
+	}
+	err = tx.Get(&entry.PrevHash, "SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1")
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := tx.Get(&entry.ID, "SELECT nextval(pg_get_serial_sequence('audit_log', 'id'))"); err != nil {
+		return err
+	}
+	entry.Hash = entry.computeHash()
+
+	if _, err := tx.NamedExec(`
+		INSERT INTO audit_log (id, occurred_at, actor, action, entity_type, entity_id,
+			changes, ip_address, prev_hash, hash)
+		VALUES (:id, :occurred_at, :actor, :action, :entity_type, :entity_id,
+			:changes, :ip_address, :prev_hash, :hash)
+	`, entry); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AuditVerification is the result of checking the hash chain
+type AuditVerification struct {
+	Checked  int
+	Valid    bool
+	BrokenAt int64 // first entry that doesn't match, when not Valid
+	Reason   string
+}
+
+// verifyAuditChain recomputes every hash in order and reports the first
+// entry that was altered, or whose predecessor was removed
+func verifyAuditChain() (AuditVerification, error) {
+	result := AuditVerification{Valid: true}
+
+	rows, err := db.Queryx(`
+		SELECT id, occurred_at, actor, action, entity_type, entity_id, changes,
+		       ip_address, prev_hash, hash
+		FROM audit_log ORDER BY id
+	`)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	prevHash := ""
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.StructScan(&entry); err != nil {
+			return result, err
+		}
+		result.Checked++
+
+		switch {
+		case entry.PrevHash != prevHash:
+			result.Reason = "the entry before it is missing or was changed"
+		case entry.computeHash() != entry.Hash:
+			result.Reason = "its contents were changed after it was recorded"
+		default:
+			prevHash = entry.Hash
+			continue
+		}
+		result.Valid = false
+		result.BrokenAt = entry.ID
+		return result, nil
+	}
+	return result, rows.Err()
+}
+
+// AuditFilter narrows the audit log view
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	EntityType string
+	EntityID   string
+	Search     string // matched against the recorded changes
+	HidePII    bool   // search the changes as redactAuditPII shows them
+	From       string // YYYY-MM-DD
+	To         string // YYYY-MM-DD, inclusive
+	Page       int
+}
+
+const auditPageSize = 100
+
+// searchAuditLog returns one page of entries matching the filter, newest
+// first, and whether there are more
+func searchAuditLog(filter AuditFilter) ([]AuditEntry, bool, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Actor != "" {
+		add("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		add("action = $%d", filter.Action)
+	}
+	if filter.EntityType != "" {
+		add("entity_type = $%d", filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		add("entity_id = $%d", filter.EntityID)
+	}
+	if filter.Search != "" && filter.HidePII {
+		// Match what the viewer will see, not the hidden values
+		hidden := make([]string, 0, len(auditPIIFields))
+		for field := range auditPIIFields {
+			hidden = append(hidden, field)
+		}
+		args = append(args, pq.StringArray(hidden))
+		add(fmt.Sprintf(`CASE WHEN entity_type = 'student' THEN (
+			SELECT COALESCE(jsonb_object_agg(key, CASE WHEN key = ANY($%d)
+				THEN '{"from": "(hidden)", "to": "(hidden)"}'::jsonb ELSE value END), '{}')::text
+			FROM jsonb_each(changes::jsonb)
+		) ELSE changes END ILIKE '%%%%' || $%%d || '%%%%'`, len(args)), filter.Search)
+	} else if filter.Search != "" {
+		add("changes ILIKE '%%' || $%d || '%%'", filter.Search)
+	}
+	if filter.From != "" {
+		add("occurred_at >= $%d::date", filter.From)
+	}
+	if filter.To != "" {
+		add("occurred_at < $%d::date + 1", filter.To)
+	}
+
+	query := "SELECT * FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	page := filter.Page
+	if page < 1 {
+		page = 1
+	}
+	// Fetch one extra row to know whether there's another page
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d OFFSET %d", auditPageSize+1, (page-1)*auditPageSize)
+
+	var entries []AuditEntry
+	if err := db.Select(&entries, query, args...); err != nil {
+		return nil, false, err
+	}
+	more := len(entries) > auditPageSize
+	if more {
+		entries = entries[:auditPageSize]
+	}
+	return entries, more, nil
+}
+
+// auditPIIFields are student fields hidden from viewers without
+// students.view_pii, matching redactStudentPII
+var auditPIIFields = map[string]bool{
+	"locations":        true,
+	"phone_number":     true,
+	"alt_phone_number": true,
+	"guardian":         true,
+}
+
+// redactAuditPII masks student contact details in the recorded changes
+func redactAuditPII(entries []AuditEntry) {
+	for i, entry := range entries {
+		if entry.EntityType != "student" {
+			continue
+		}
+		changes := entry.ChangeSet()
+		for field := range changes {
+			if auditPIIFields[field] {
+				changes[field] = AuditChange{From: "(hidden)", To: "(hidden)"}
+			}
+		}
+		if redacted, err := json.Marshal(changes); err == nil {
+			entries[i].Changes = string(redacted)
+		}
+	}
+}
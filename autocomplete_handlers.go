@@ -107,7 +107,7 @@ func searchDriversHandler(w http.ResponseWriter, r *http.Request) {
 	queryLower := strings.ToLower(query)
 	
 	for _, driver := range drivers {
-		if driver.Role == "driver" && driver.Status == "active" &&
+		if driver.Role == RoleDriver && driver.Status == "active" &&
 		   strings.Contains(strings.ToLower(driver.Username), queryLower) {
 			
 			routes := assignmentMap[driver.Username]
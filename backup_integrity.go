@@ -0,0 +1,671 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Encrypted backups are the finished zip sealed with AES-256-GCM in 64 KiB
+// chunks. The manifest is sealed separately up front so backups can be
+// listed without decrypting the whole archive.
+//
+//	magic(8) | nonce prefix(8) | len(4) | sealed manifest |
+//	{ len(4) | final flag(1) | sealed chunk }...
+//
+// Each chunk's nonce is the prefix plus a counter and its flag byte is bound
+// as additional data, so reordering, truncation and tampering all fail to
+// decrypt.
+const (
+	backupEncMagic      = "FLEETBK1"
+	backupEncExt        = ".enc"
+	backupEncChunkSize  = 64 * 1024
+	backupManifestNonce = 0xFFFFFFFF
+	maxManifestSize     = 16 << 20
+)
+
+// ErrBackupKeyMissing is returned when an encrypted backup is opened without
+// BACKUP_ENCRYPTION_KEY
+var ErrBackupKeyMissing = errors.New("backup is encrypted but BACKUP_ENCRYPTION_KEY is not set")
+
+// loadBackupKey reads the AES-256 key from BACKUP_ENCRYPTION_KEY, given as
+// 64 hex characters or base64 of 32 bytes. An empty value disables encryption.
+func loadBackupKey() ([]byte, error) {
+	value := strings.TrimSpace(os.Getenv("BACKUP_ENCRYPTION_KEY"))
+	if value == "" {
+		return nil, nil
+	}
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("BACKUP_ENCRYPTION_KEY must be 32 bytes, hex or base64 encoded")
+}
+
+// backupArchive wraps the zip writer and hashes every entry as it is written
+type backupArchive struct {
+	zw     *zip.Writer
+	hashes map[string]hash.Hash
+}
+
+func newBackupArchive(w io.Writer) *backupArchive {
+	return &backupArchive{zw: zip.NewWriter(w), hashes: make(map[string]hash.Hash)}
+}
+
+func (a *backupArchive) Create(name string) (io.Writer, error) {
+	return a.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+}
+
+func (a *backupArchive) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	a.hashes[header.Name] = h
+	return io.MultiWriter(w, h), nil
+}
+
+// checksums returns the SHA-256 of every entry written so far
+func (a *backupArchive) checksums() map[string]string {
+	sums := make(map[string]string, len(a.hashes))
+	for name, h := range a.hashes {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// backupDigest folds the entry checksums into a single value for
+// BackupMetadata.Checksum
+func backupDigest(sums map[string]string) string {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s:%s\n", name, sums[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func backupNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+func newBackupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptBackupFile seals the zip at src into dst
+func encryptBackupFile(key []byte, src, dst string, manifest []byte) error {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+
+	writeBlock := func(data []byte) error {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		if _, err := out.Write(size[:]); err != nil {
+			return err
+		}
+		_, err := out.Write(data)
+		return err
+	}
+
+	if _, err := out.Write([]byte(backupEncMagic)); err != nil {
+		return err
+	}
+	if _, err := out.Write(prefix); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, backupNonce(prefix, backupManifestNonce), manifest, []byte(backupEncMagic+"manifest"))
+	if err := writeBlock(sealed); err != nil {
+		return err
+	}
+
+	buf := make([]byte, backupEncChunkSize)
+	remaining := info.Size()
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		remaining -= int64(n)
+
+		flag := byte(0)
+		if remaining <= 0 {
+			flag = 1
+		}
+		ct := aead.Seal(nil, backupNonce(prefix, counter), buf[:n], append([]byte(backupEncMagic), flag))
+		if err := writeBlock(append([]byte{flag}, ct...)); err != nil {
+			return err
+		}
+		if flag == 1 {
+			break
+		}
+	}
+
+	return out.Close()
+}
+
+// readEncryptedHeader reads the magic, nonce prefix and manifest
+func readEncryptedHeader(aead cipher.AEAD, r io.Reader) ([]byte, []byte, error) {
+	header := make([]byte, len(backupEncMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("truncated backup header: %v", err)
+	}
+	if string(header[:len(backupEncMagic)]) != backupEncMagic {
+		return nil, nil, errors.New("not an encrypted backup")
+	}
+	prefix := header[len(backupEncMagic):]
+
+	sealed, err := readEncryptedBlock(r, maxManifestSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := aead.Open(nil, backupNonce(prefix, backupManifestNonce), sealed, []byte(backupEncMagic+"manifest"))
+	if err != nil {
+		return nil, nil, errors.New("backup manifest failed authentication (wrong key or corrupted file)")
+	}
+	return prefix, manifest, nil
+}
+
+func readEncryptedBlock(r io.Reader, limit int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(size[:]))
+	if n > limit {
+		return nil, fmt.Errorf("encrypted block of %d bytes exceeds limit", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("truncated encrypted block: %v", err)
+	}
+	return data, nil
+}
+
+// decryptBackup returns the plaintext zip of an encrypted backup
+func decryptBackup(key []byte, path string) ([]byte, error) {
+	if key == nil {
+		return nil, ErrBackupKeyMissing
+	}
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefix, _, err := readEncryptedHeader(aead, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var plain bytes.Buffer
+	for counter := uint32(0); ; counter++ {
+		block, err := readEncryptedBlock(file, backupEncChunkSize+1+aead.Overhead())
+		if err == io.EOF {
+			return nil, errors.New("encrypted backup is truncated")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(block) == 0 {
+			return nil, errors.New("malformed encrypted chunk")
+		}
+
+		flag := block[0]
+		chunk, err := aead.Open(nil, backupNonce(prefix, counter), block[1:], append([]byte(backupEncMagic), flag))
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d failed authentication (wrong key or corrupted file)", counter)
+		}
+		plain.Write(chunk)
+
+		if flag == 1 {
+			break
+		}
+	}
+
+	if n, _ := file.Read(make([]byte, 1)); n > 0 {
+		return nil, errors.New("unexpected data after final encrypted chunk")
+	}
+	return plain.Bytes(), nil
+}
+
+// backupReader is an opened backup archive, decrypted if necessary
+type backupReader struct {
+	*zip.Reader
+	closer io.Closer
+}
+
+func (r *backupReader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// openArchive opens a plain or encrypted backup for reading. Encrypted
+// backups are decrypted in memory so no plaintext copy touches the disk.
+func (bm *BackupManager) openArchive(path string) (*backupReader, error) {
+	if !strings.HasSuffix(path, backupEncExt) {
+		rc, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		return &backupReader{Reader: &rc.Reader, closer: rc}, nil
+	}
+
+	plain, err := decryptBackup(bm.key, path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		return nil, err
+	}
+	return &backupReader{Reader: zr}, nil
+}
+
+// readManifest reads a backup's metadata without unpacking its tables
+func (bm *BackupManager) readManifest(path string) (BackupMetadata, error) {
+	if !strings.HasSuffix(path, backupEncExt) {
+		reader, err := bm.openArchive(path)
+		if err != nil {
+			return BackupMetadata{}, err
+		}
+		defer reader.Close()
+		return readBackupMetadata(reader.Reader, path)
+	}
+
+	if bm.key == nil {
+		return BackupMetadata{}, ErrBackupKeyMissing
+	}
+	aead, err := newBackupAEAD(bm.key)
+	if err != nil {
+		return BackupMetadata{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return BackupMetadata{}, err
+	}
+	defer file.Close()
+
+	_, manifest, err := readEncryptedHeader(aead, file)
+	if err != nil {
+		return BackupMetadata{}, err
+	}
+	var metadata BackupMetadata
+	if err := json.Unmarshal(manifest, &metadata); err != nil {
+		return BackupMetadata{}, fmt.Errorf("failed to read backup metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// BackupVerifyReport is the result of checking a backup's integrity
+type BackupVerifyReport struct {
+	Backup    string   `json:"backup"`
+	Type      string   `json:"type"`
+	Encrypted bool     `json:"encrypted"`
+	Valid     bool     `json:"valid"`
+	Checked   int      `json:"checked"`
+	Chain     []string `json:"chain,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// VerifyBackup decrypts the backup if needed, recomputes every entry's
+// checksum against the manifest and checks that its chain is complete
+func (bm *BackupManager) VerifyBackup(backupFile string) (*BackupVerifyReport, error) {
+	report := &BackupVerifyReport{
+		Backup:    filepath.Base(backupFile),
+		Encrypted: strings.HasSuffix(backupFile, backupEncExt),
+	}
+	if _, err := os.Stat(backupFile); err != nil {
+		return nil, err
+	}
+
+	reader, err := bm.openArchive(backupFile)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report, nil
+	}
+	defer reader.Close()
+
+	metadata, err := readBackupMetadata(reader.Reader, backupFile)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report, nil
+	}
+	report.Type = metadata.Type
+
+	checked, problems := verifyArchiveChecksums(reader.Reader, metadata)
+	report.Checked = checked
+	if metadata.Checksums == nil {
+		report.Warnings = append(report.Warnings, "backup predates checksums; contents were not verified")
+	}
+	report.Errors = append(report.Errors, problems...)
+
+	chain, err := bm.backupChain(backupFile)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, b := range chain {
+		report.Chain = append(report.Chain, b.Name)
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report, nil
+}
+
+// verifyArchiveChecksums compares each entry against the manifest. It returns
+// the number of entries checked and a description of every problem.
+func verifyArchiveChecksums(reader *zip.Reader, metadata BackupMetadata) (int, []string) {
+	if metadata.Checksums == nil {
+		return 0, nil
+	}
+
+	var problems []string
+	seen := make(map[string]bool)
+	for _, file := range reader.File {
+		if file.Name == backupMetadataFile {
+			continue
+		}
+		want, ok := metadata.Checksums[file.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not listed in manifest", file.Name))
+			continue
+		}
+		seen[file.Name] = true
+
+		rc, err := file.Open()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Name, err))
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Name, err))
+			continue
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != want {
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", file.Name))
+		}
+	}
+
+	for name := range metadata.Checksums {
+		if !seen[name] {
+			problems = append(problems, fmt.Sprintf("%s: missing from archive", name))
+		}
+	}
+	if metadata.Checksum != "" && backupDigest(metadata.Checksums) != metadata.Checksum {
+		problems = append(problems, "manifest checksum list has been altered")
+	}
+
+	sort.Strings(problems)
+	return len(seen), problems
+}
+
+// verifyChain checks every backup in a chain before it is replayed
+func (bm *BackupManager) verifyChain(chain []BackupInfo) error {
+	for _, b := range chain {
+		reader, err := bm.openArchive(b.Path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", b.Name, err)
+		}
+		_, problems := verifyArchiveChecksums(reader.Reader, b.Metadata)
+		reader.Close()
+		if len(problems) > 0 {
+			return fmt.Errorf("%s failed verification: %s", b.Name, strings.Join(problems, "; "))
+		}
+	}
+	return nil
+}
+
+// RestoreTableReport describes one table in a dry-run restore
+type RestoreTableReport struct {
+	Table            string   `json:"table"`
+	LiveTableMissing bool     `json:"live_table_missing,omitempty"`
+	LiveRows         int64    `json:"live_rows"`
+	RestoredRows     int64    `json:"restored_rows"`
+	MissingInLive    []string `json:"missing_in_live,omitempty"`   // backup columns the live table lacks
+	MissingInBackup  []string `json:"missing_in_backup,omitempty"` // live columns the backup doesn't set
+}
+
+// DryRunReport is the outcome of restoring a backup into a scratch schema
+type DryRunReport struct {
+	Backup string               `json:"backup"`
+	Chain  []string             `json:"chain"`
+	OK     bool                 `json:"ok"`
+	Tables []RestoreTableReport `json:"tables"`
+	Errors []string             `json:"errors,omitempty"`
+}
+
+// DryRunRestore replays a backup chain into a throwaway schema shaped like
+// the live tables, then reports row counts and column differences. The
+// transaction is always rolled back, so production data is never touched.
+func (bm *BackupManager) DryRunRestore(backupFile string) (*DryRunReport, error) {
+	report := &DryRunReport{Backup: filepath.Base(backupFile)}
+
+	chain, err := bm.backupChain(backupFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range chain {
+		report.Chain = append(report.Chain, b.Name)
+	}
+	if err := bm.verifyChain(chain); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report, nil
+	}
+
+	tx, err := bm.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var liveSchema string
+	if err := tx.QueryRow("SELECT current_schema()").Scan(&liveSchema); err != nil {
+		return nil, err
+	}
+
+	tables, err := bm.compareBackupSchema(tx, liveSchema, chain)
+	if err != nil {
+		return nil, err
+	}
+	report.Tables = tables
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	scratch := pq.QuoteIdentifier("restore_dryrun_" + hex.EncodeToString(suffix))
+	if _, err := tx.Exec("CREATE SCHEMA " + scratch); err != nil {
+		return nil, fmt.Errorf("failed to create scratch schema: %v", err)
+	}
+
+	// Copy the live table definitions (without foreign keys) so the replay
+	// hits the same columns, types and constraints as a real restore
+	for _, t := range tables {
+		quoted := pq.QuoteIdentifier(t.Table)
+		var stmt string
+		if t.LiveTableMissing {
+			cols := make([]string, len(t.MissingInLive))
+			for i, col := range t.MissingInLive {
+				cols[i] = pq.QuoteIdentifier(col) + " TEXT"
+			}
+			stmt = fmt.Sprintf("CREATE TABLE %s.%s (%s)", scratch, quoted, strings.Join(cols, ", "))
+		} else {
+			stmt = fmt.Sprintf("CREATE TABLE %s.%s (LIKE %s.%s INCLUDING DEFAULTS INCLUDING CONSTRAINTS INCLUDING INDEXES)",
+				scratch, quoted, pq.QuoteIdentifier(liveSchema), quoted)
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to prepare scratch table %s: %v", t.Table, err)
+		}
+	}
+
+	if _, err := tx.Exec("SET LOCAL search_path TO " + scratch); err != nil {
+		return nil, err
+	}
+
+	restored := make(map[string][]string)
+	for i, b := range chain {
+		if err := bm.applyBackup(tx, b, i == 0, restored); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", b.Name, err))
+			return report, nil
+		}
+	}
+
+	for i := range report.Tables {
+		t := &report.Tables[i]
+		if err := tx.QueryRow("SELECT COUNT(*) FROM " + pq.QuoteIdentifier(t.Table)).Scan(&t.RestoredRows); err != nil {
+			return nil, err
+		}
+	}
+
+	report.OK = true
+	for _, t := range report.Tables {
+		if t.LiveTableMissing || len(t.MissingInLive) > 0 {
+			report.OK = false
+		}
+	}
+	return report, nil
+}
+
+// compareBackupSchema lines up the columns stored in a chain's backups with
+// the live tables and counts the live rows
+func (bm *BackupManager) compareBackupSchema(tx *sql.Tx, liveSchema string, chain []BackupInfo) ([]RestoreTableReport, error) {
+	var order []string
+	backupCols := make(map[string]map[string]bool)
+
+	for _, b := range chain {
+		reader, err := bm.openArchive(b.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name, err)
+		}
+		for _, table := range b.Metadata.Tables {
+			if backupCols[table] == nil {
+				backupCols[table] = make(map[string]bool)
+				order = append(order, table)
+			}
+			var records []map[string]json.RawMessage
+			if err := readZipJSON(reader.Reader, fmt.Sprintf("database/%s.json", table), &records); err != nil && !errors.Is(err, os.ErrNotExist) {
+				reader.Close()
+				return nil, fmt.Errorf("%s: table %s: %v", b.Name, table, err)
+			}
+			for _, record := range records {
+				for col := range record {
+					backupCols[table][col] = true
+				}
+			}
+		}
+		reader.Close()
+	}
+
+	var reports []RestoreTableReport
+	for _, table := range order {
+		t := RestoreTableReport{Table: table}
+
+		rows, err := tx.Query(`
+			SELECT column_name FROM information_schema.columns
+			WHERE table_schema = $1 AND table_name = $2
+		`, liveSchema, table)
+		if err != nil {
+			return nil, err
+		}
+		live := make(map[string]bool)
+		for rows.Next() {
+			var col string
+			if err := rows.Scan(&col); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			live[col] = true
+		}
+		rows.Close()
+
+		for col := range backupCols[table] {
+			if !live[col] {
+				t.MissingInLive = append(t.MissingInLive, col)
+			}
+		}
+		for col := range live {
+			if !backupCols[table][col] {
+				t.MissingInBackup = append(t.MissingInBackup, col)
+			}
+		}
+		sort.Strings(t.MissingInLive)
+		sort.Strings(t.MissingInBackup)
+
+		if len(live) == 0 {
+			t.LiveTableMissing = true
+			t.MissingInBackup = nil
+		} else {
+			query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", pq.QuoteIdentifier(liveSchema), pq.QuoteIdentifier(table))
+			if err := tx.QueryRow(query).Scan(&t.LiveRows); err != nil {
+				return nil, err
+			}
+		}
+		reports = append(reports, t)
+	}
+	return reports, nil
+}
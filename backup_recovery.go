@@ -2,324 +2,960 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/xuri/excelize/v2"
 )
 
 // BackupManager handles system backups
 type BackupManager struct {
 	db         *sql.DB
 	backupPath string
+	key        []byte // AES-256 key from BACKUP_ENCRYPTION_KEY; nil disables encryption
+	keyErr     error
+}
+
+// Backup types
+const (
+	BackupTypeFull        = "full"
+	BackupTypeIncremental = "incremental"
+)
+
+// How a table was captured in a backup
+const (
+	tableModeFull      = "full"      // every row; replaces the table on restore
+	tableModeTimestamp = "timestamp" // rows created/updated since the parent
+	tableModeDiff      = "diff"      // rows whose content hash changed since the parent
+)
+
+// incrementalOverlap re-reads a little before the parent's snapshot so rows
+// from transactions still open at that moment aren't missed. Replaying a row
+// twice is harmless because restores upsert.
+const incrementalOverlap = 5 * time.Minute
+
+const backupMetadataFile = "backup_metadata.json"
+
+// backupTables lists the tables included in backups, parents before children
+var backupTables = []string{
+	"roles", "role_permissions", "users", "user_recovery_codes",
+	"buses", "vehicles", "routes", "students", "geocoded_addresses",
+	"route_assignments", "driver_route_preferences", "gps_tracking_sessions",
+	"maintenance_records", "fuel_records",
+	"driver_logs", "attendance_ledger", "monthly_mileage_reports", "service_records",
+	"ecse_data", "audit_log", "driver_credentials", "driver_credential_documents",
+	"calendar_days", "rfid_readers", "student_cards", "rfid_scans", "ridership_alerts",
+	"parts", "part_fitments", "stock_locations", "part_stock",
+	"work_orders", "work_order_lines", "work_order_events", "part_movements",
+	"pm_programs", "pm_services",
+	"fuel_card_providers", "fuel_cards", "fuel_card_imports", "fuel_card_transactions",
+	"geofences", "geofence_rules", "gps_devices",
+	"scheduled_exports", "scheduled_export_runs",
+}
+
+// appendOnlyTables refuse updates and deletes, so a restore only adds the
+// rows that are missing. Entries written since the backup stay, which for
+// the audit log is what we want anyway.
+var appendOnlyTables = map[string]bool{
+	"audit_log": true,
 }
 
-// BackupMetadata contains backup information
+// BackupMetadata contains backup information. Incremental backups name their
+// parent and the full backup their chain starts from.
 type BackupMetadata struct {
-	Timestamp   time.Time              `json:"timestamp"`
-	Version     string                 `json:"version"`
-	Type        string                 `json:"type"`
-	Tables      []string               `json:"tables"`
-	RecordCount map[string]int         `json:"record_count"`
-	Size        int64                  `json:"size"`
-	Checksum    string                 `json:"checksum"`
+	ID           string              `json:"id"`
+	Timestamp    time.Time           `json:"timestamp"`
+	Version      string              `json:"version"`
+	Type         string              `json:"type"`
+	Tables       []string            `json:"tables"`
+	RecordCount  map[string]int      `json:"record_count"`
+	Size         int64               `json:"size"`
+	Checksum     string              `json:"checksum"`
+	BaseBackup   string              `json:"base_backup,omitempty"`
+	ParentBackup string              `json:"parent_backup,omitempty"`
+	Since        *time.Time          `json:"since,omitempty"`
+	TableModes   map[string]string   `json:"table_modes,omitempty"`
+	PrimaryKeys  map[string][]string `json:"primary_keys,omitempty"`
+	DeletedCount map[string]int      `json:"deleted_count,omitempty"`
+	Checksums    map[string]string   `json:"checksums,omitempty"` // SHA-256 of each archive entry
+	Encrypted    bool                `json:"encrypted,omitempty"`
+}
+
+// BackupInfo is a backup file together with its manifest
+type BackupInfo struct {
+	Name     string         `json:"name"`
+	Path     string         `json:"-"`
+	Size     int64          `json:"size"`
+	Metadata BackupMetadata `json:"metadata"`
 }
 
 // NewBackupManager creates a new backup manager
 func NewBackupManager(db *sql.DB, backupPath string) *BackupManager {
+	key, err := loadBackupKey()
+	if err != nil {
+		log.Printf("Warning: %v; backups will fail until it is fixed", err)
+	}
 	return &BackupManager{
 		db:         db,
 		backupPath: backupPath,
+		key:        key,
+		keyErr:     err,
 	}
 }
 
 // CreateFullBackup creates a complete system backup
 func (bm *BackupManager) CreateFullBackup() (string, error) {
-	timestamp := time.Now().Format("20060102_150405")
-	backupName := fmt.Sprintf("fleet_backup_%s.zip", timestamp)
-	backupFile := filepath.Join(bm.backupPath, backupName)
-	
-	log.Printf("Starting full backup to %s", backupFile)
-	
-	// Create backup directory if it doesn't exist
+	return bm.createBackup(BackupTypeFull)
+}
+
+// CreateIncrementalBackup captures the rows changed since the most recent
+// backup. Tables with created_at/updated_at are queried by timestamp; the
+// rest are diffed against the row hashes stored in the parent backup.
+func (bm *BackupManager) CreateIncrementalBackup() (string, error) {
+	return bm.createBackup(BackupTypeIncremental)
+}
+
+func (bm *BackupManager) createBackup(backupType string) (string, error) {
+	// Never fall back to a plaintext backup when a key was meant to be set
+	if bm.keyErr != nil {
+		return "", bm.keyErr
+	}
 	if err := os.MkdirAll(bm.backupPath, 0755); err != nil {
 		return "", fmt.Errorf("failed to create backup directory: %v", err)
 	}
-	
-	// Create zip file
-	zipFile, err := os.Create(backupFile)
+
+	var parent *BackupInfo
+	if backupType == BackupTypeIncremental {
+		backups, err := bm.ListBackups()
+		if err != nil {
+			return "", err
+		}
+		if len(backups) == 0 {
+			return "", errors.New("no backup to chain an incremental backup from; create a full backup first")
+		}
+		parent = &backups[len(backups)-1]
+	}
+
+	// A read-only repeatable read transaction gives every table the same
+	// snapshot, and NOW() is the moment that snapshot was taken
+	tx, err := bm.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
-		return "", fmt.Errorf("failed to create backup file: %v", err)
+		return "", fmt.Errorf("failed to begin backup snapshot: %v", err)
+	}
+	defer tx.Rollback()
+
+	var snapshot time.Time
+	if err := tx.QueryRow("SELECT NOW()").Scan(&snapshot); err != nil {
+		return "", fmt.Errorf("failed to read snapshot time: %v", err)
 	}
-	defer zipFile.Close()
-	
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-	
+
+	prefix := "fleet_backup"
+	if parent != nil {
+		prefix = "fleet_incremental"
+	}
+	backupName := fmt.Sprintf("%s_%s.zip", prefix, snapshot.Format("20060102_150405"))
+	if bm.key != nil {
+		backupName += backupEncExt
+	}
+	backupFile := filepath.Join(bm.backupPath, backupName)
+
+	log.Printf("Starting %s backup to %s", backupType, backupFile)
+
 	metadata := BackupMetadata{
-		Timestamp:   time.Now(),
-		Version:     "1.0",
-		Type:        "full",
-		Tables:      []string{},
-		RecordCount: make(map[string]int),
-	}
-	
-	// Backup database tables
-	tables := []string{
-		"users", "buses", "vehicles", "routes", "students",
-		"route_assignments", "maintenance_records", "fuel_records",
-		"driver_logs", "monthly_mileage_reports", "service_records",
-		"ecse_data",
-	}
-	
-	for _, table := range tables {
-		count, err := bm.backupTable(zipWriter, table)
+		ID:           backupID(backupName),
+		Timestamp:    snapshot,
+		Version:      "2.0",
+		Type:         backupType,
+		Tables:       []string{},
+		RecordCount:  make(map[string]int),
+		TableModes:   make(map[string]string),
+		PrimaryKeys:  make(map[string][]string),
+		DeletedCount: make(map[string]int),
+		Encrypted:    bm.key != nil,
+	}
+
+	var parentReader *backupReader
+	if parent != nil {
+		metadata.ParentBackup = parent.Name
+		metadata.BaseBackup = parent.Metadata.BaseBackup
+		if parent.Metadata.Type != BackupTypeIncremental {
+			metadata.BaseBackup = parent.Name
+		}
+		since := parent.Metadata.Timestamp.Add(-incrementalOverlap)
+		metadata.Since = &since
+
+		parentReader, err = bm.openArchive(parent.Path)
 		if err != nil {
+			return "", fmt.Errorf("failed to open parent backup %s: %v", parent.Name, err)
+		}
+		defer parentReader.Close()
+	}
+
+	// Write to a temp file so a failed backup never looks like a valid one
+	tmpFile := backupFile + ".tmp"
+	zipFile, err := os.Create(tmpFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer os.Remove(tmpFile)
+
+	archive := newBackupArchive(zipFile)
+
+	for _, table := range backupTables {
+		var parentState map[string]string
+		if parentReader != nil {
+			parentState = readBackupState(parentReader.Reader, table)
+		}
+
+		// A failed query aborts the transaction, so each table gets a
+		// savepoint to keep one bad table from sinking the rest
+		if _, err := tx.Exec("SAVEPOINT backup_table"); err != nil {
+			return "", fmt.Errorf("failed to create savepoint: %v", err)
+		}
+		if err := bm.backupTable(tx, archive, table, &metadata, parentState); err != nil {
 			log.Printf("Warning: Failed to backup table %s: %v", table, err)
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT backup_table"); err != nil {
+				return "", fmt.Errorf("failed to roll back savepoint: %v", err)
+			}
 			continue
 		}
+		tx.Exec("RELEASE SAVEPOINT backup_table")
 		metadata.Tables = append(metadata.Tables, table)
-		metadata.RecordCount[table] = count
-	}
-	
-	// Backup configuration files
-	configFiles := []string{
-		".env",
-		"sessions.json",
 	}
-	
-	for _, file := range configFiles {
-		if err := bm.addFileToZip(zipWriter, file); err != nil {
-			log.Printf("Warning: Failed to backup file %s: %v", file, err)
+
+	// Configuration files only go in full backups
+	if parent == nil {
+		configFiles := []string{
+			".env",
+			"sessions.json",
+		}
+
+		for _, file := range configFiles {
+			if err := bm.addFileToZip(archive, file); err != nil {
+				log.Printf("Warning: Failed to backup file %s: %v", file, err)
+			}
 		}
 	}
-	
-	// Add metadata
+
+	// The manifest lists a checksum for everything written before it
+	metadata.Checksums = archive.checksums()
+	metadata.Checksum = backupDigest(metadata.Checksums)
+
 	metadataJSON, _ := json.MarshalIndent(metadata, "", "  ")
-	metadataWriter, err := zipWriter.Create("backup_metadata.json")
+	metadataWriter, err := archive.zw.Create(backupMetadataFile)
 	if err == nil {
-		metadataWriter.Write(metadataJSON)
+		_, err = metadataWriter.Write(metadataJSON)
+	}
+	if err != nil {
+		zipFile.Close()
+		return "", fmt.Errorf("failed to write backup metadata: %v", err)
+	}
+
+	if err := archive.zw.Close(); err != nil {
+		zipFile.Close()
+		return "", fmt.Errorf("failed to finalize backup: %v", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to finalize backup: %v", err)
+	}
+
+	if bm.key != nil {
+		encFile := backupFile + ".part"
+		defer os.Remove(encFile)
+		if err := encryptBackupFile(bm.key, tmpFile, encFile, metadataJSON); err != nil {
+			return "", fmt.Errorf("failed to encrypt backup: %v", err)
+		}
+		tmpFile = encFile
 	}
-	
+	if err := os.Rename(tmpFile, backupFile); err != nil {
+		return "", fmt.Errorf("failed to finalize backup: %v", err)
+	}
+
 	log.Printf("Backup completed: %s", backupFile)
 	return backupFile, nil
 }
 
-// backupTable backs up a single database table
-func (bm *BackupManager) backupTable(zipWriter *zip.Writer, tableName string) (int, error) {
-	// Create file in zip
-	writer, err := zipWriter.Create(fmt.Sprintf("database/%s.json", tableName))
+// backupTable writes one table into the archive. Alongside the rows it
+// stores the table's state (primary key -> row hash), which the next
+// incremental backup diffs against to find changes and deletions.
+func (bm *BackupManager) backupTable(tx *sql.Tx, archive *backupArchive, tableName string, metadata *BackupMetadata, parentState map[string]string) error {
+	pk, err := tablePrimaryKey(tx, tableName)
+	if err != nil {
+		return err
+	}
+	hasCreated, hasUpdated, err := tableTimestampColumns(tx, tableName)
+	if err != nil {
+		return err
+	}
+
+	// Pick how the table is captured. Without a primary key rows can't be
+	// matched up, and without parent state there is nothing to diff against.
+	// created_at alone says nothing about later edits, so only tables that
+	// track updated_at are read by timestamp.
+	mode := tableModeFull
+	if metadata.Type == BackupTypeIncremental && len(pk) > 0 && parentState != nil {
+		if hasUpdated {
+			mode = tableModeTimestamp
+		} else {
+			mode = tableModeDiff
+		}
+	}
+
+	quoted := pq.QuoteIdentifier(tableName)
+	query := "SELECT * FROM " + quoted
+	var args []interface{}
+	if mode == tableModeTimestamp {
+		var conds []string
+		if hasUpdated {
+			conds = append(conds, "updated_at > $1::timestamptz")
+		}
+		if hasCreated {
+			conds = append(conds, "created_at > $1::timestamptz")
+		}
+		query += " WHERE " + strings.Join(conds, " OR ")
+		args = append(args, *metadata.Since)
+	}
+
+	writer, err := archive.Create(fmt.Sprintf("database/%s.json", tableName))
 	if err != nil {
-		return 0, err
+		return err
 	}
-	
-	// Query all data from table
-	query := fmt.Sprintf("SELECT * FROM %s", tableName)
-	rows, err := bm.db.Query(query)
+	out := &jsonArrayWriter{w: writer}
+
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		return 0, err
+		return err
 	}
+
+	state := make(map[string]string)
+	err = scanRecords(rows, func(record map[string]interface{}) error {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if len(pk) > 0 {
+			sum := sha256.Sum256(data)
+			hash := hex.EncodeToString(sum[:])
+			key := backupRowKey(record, pk)
+			state[key] = hash
+			if mode == tableModeDiff && parentState[key] == hash {
+				return nil
+			}
+		}
+		return out.write(data)
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.close(); err != nil {
+		return err
+	}
+
+	// Timestamp mode only read the changed rows; the key set still has to
+	// cover the whole table to spot deletions
+	if mode == tableModeTimestamp {
+		state, err = tableKeyState(tx, tableName, pk)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(pk) > 0 {
+		if err := writeZipJSON(archive, fmt.Sprintf("state/%s.json", tableName), state); err != nil {
+			return err
+		}
+		metadata.PrimaryKeys[tableName] = pk
+	}
+
+	if mode != tableModeFull {
+		var deleted []string
+		for key := range parentState {
+			if _, ok := state[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+		sort.Strings(deleted)
+		if err := writeZipJSON(archive, fmt.Sprintf("deleted/%s.json", tableName), deleted); err != nil {
+			return err
+		}
+		metadata.DeletedCount[tableName] = len(deleted)
+	}
+
+	metadata.TableModes[tableName] = mode
+	metadata.RecordCount[tableName] = out.count
+	return nil
+}
+
+// tablePrimaryKey returns the primary key columns in key order
+func tablePrimaryKey(tx *sql.Tx, tableName string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT a.attname
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::regclass AND i.indisprimary
+		ORDER BY array_position(i.indkey::int2[], a.attnum)
+	`, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+	return cols, rows.Err()
+}
+
+func tableTimestampColumns(tx *sql.Tx, tableName string) (hasCreated, hasUpdated bool, err error) {
+	rows, err := tx.Query(`
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1
+		  AND column_name IN ('created_at', 'updated_at')
+	`, tableName)
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return false, false, err
+		}
+		hasCreated = hasCreated || col == "created_at"
+		hasUpdated = hasUpdated || col == "updated_at"
+	}
+	return hasCreated, hasUpdated, rows.Err()
+}
+
+// tableKeyState lists every primary key in the table. Hashes are left empty,
+// so a later diff-mode backup treats those rows as changed.
+func tableKeyState(tx *sql.Tx, tableName string, pk []string) (map[string]string, error) {
+	cols := make([]string, len(pk))
+	for i, col := range pk {
+		cols[i] = pq.QuoteIdentifier(col)
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), pq.QuoteIdentifier(tableName)))
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]string)
+	err = scanRecords(rows, func(record map[string]interface{}) error {
+		state[backupRowKey(record, pk)] = ""
+		return nil
+	})
+	return state, err
+}
+
+// scanRecords calls fn for every row as a column -> value map and closes rows
+func scanRecords(rows *sql.Rows, fn func(map[string]interface{}) error) error {
 	defer rows.Close()
-	
-	// Get column names
+
 	columns, err := rows.Columns()
 	if err != nil {
-		return 0, err
+		return err
 	}
-	
-	// Prepare data structures
-	count := 0
+
 	values := make([]interface{}, len(columns))
 	valuePtrs := make([]interface{}, len(columns))
 	for i := range values {
 		valuePtrs[i] = &values[i]
 	}
-	
-	// Write JSON array start
-	writer.Write([]byte("[\n"))
-	
-	// Process rows
-	first := true
+
 	for rows.Next() {
-		if !first {
-			writer.Write([]byte(",\n"))
-		}
-		first = false
-		
-		// Scan row
 		if err := rows.Scan(valuePtrs...); err != nil {
-			continue
+			return err
 		}
-		
-		// Convert to map
-		record := make(map[string]interface{})
+
+		record := make(map[string]interface{}, len(columns))
 		for i, col := range columns {
-			record[col] = values[i]
+			record[col] = normalizeBackupValue(values[i])
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// normalizeBackupValue turns the []byte lib/pq returns for numeric and
+// similar types into a string, so it isn't base64 encoded in JSON
+func normalizeBackupValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok && utf8.Valid(b) {
+		return string(b)
+	}
+	return v
+}
+
+// backupRowKey encodes a row's primary key values as a JSON array
+func backupRowKey(record map[string]interface{}, pk []string) string {
+	vals := make([]interface{}, len(pk))
+	for i, col := range pk {
+		vals[i] = record[col]
+	}
+	data, _ := json.Marshal(vals)
+	return string(data)
+}
+
+// jsonArrayWriter streams pre-encoded objects as a JSON array
+type jsonArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonArrayWriter) write(data []byte) error {
+	sep := ",\n"
+	if j.count == 0 {
+		sep = "[\n"
+	}
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	j.count++
+	_, err := j.w.Write(data)
+	return err
+}
+
+func (j *jsonArrayWriter) close() error {
+	end := "\n]"
+	if j.count == 0 {
+		end = "[]"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+func writeZipJSON(archive *backupArchive, name string, v interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// readZipJSON decodes a JSON file from an archive. Numbers are kept as
+// json.Number so large integer keys survive the round trip.
+func readZipJSON(reader *zip.Reader, name string, v interface{}) error {
+	for _, file := range reader.File {
+		if file.Name != name {
+			continue
 		}
-		
-		// Write JSON
-		jsonData, _ := json.Marshal(record)
-		writer.Write(jsonData)
-		count++
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		dec := json.NewDecoder(rc)
+		dec.UseNumber()
+		return dec.Decode(v)
+	}
+	return os.ErrNotExist
+}
+
+// readBackupState returns the table state stored in a backup, or nil when
+// the backup predates state tracking or doesn't include the table
+func readBackupState(reader *zip.Reader, tableName string) map[string]string {
+	var state map[string]string
+	if err := readZipJSON(reader, fmt.Sprintf("state/%s.json", tableName), &state); err != nil {
+		return nil
 	}
-	
-	// Write JSON array end
-	writer.Write([]byte("\n]"))
-	
-	return count, nil
+	return state
 }
 
 // addFileToZip adds a file to the zip archive
-func (bm *BackupManager) addFileToZip(zipWriter *zip.Writer, filename string) error {
+func (bm *BackupManager) addFileToZip(archive *backupArchive, filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	
+
 	// Get file info
 	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
-	
+
 	// Create zip header
 	header, err := zip.FileInfoHeader(info)
 	if err != nil {
 		return err
 	}
 	header.Name = filepath.Join("config", filename)
-	
+
 	// Create file in zip
-	writer, err := zipWriter.CreateHeader(header)
+	writer, err := archive.CreateHeader(header)
 	if err != nil {
 		return err
 	}
-	
+
 	// Copy file content
 	_, err = io.Copy(writer, file)
 	return err
 }
 
-// RestoreFromBackup restores system from a backup file
-func (bm *BackupManager) RestoreFromBackup(backupFile string) error {
-	log.Printf("Starting restore from %s", backupFile)
-	
-	// Open backup file
-	reader, err := zip.OpenReader(backupFile)
+// readBackupMetadata reads the manifest of a backup archive. Backups from
+// before manifests carried an ID are treated as full backups.
+func readBackupMetadata(reader *zip.Reader, backupFile string) (BackupMetadata, error) {
+	var metadata BackupMetadata
+	if err := readZipJSON(reader, backupMetadataFile, &metadata); err != nil {
+		return metadata, fmt.Errorf("failed to read backup metadata: %v", err)
+	}
+	if metadata.ID == "" {
+		metadata.ID = backupID(filepath.Base(backupFile))
+	}
+	if metadata.Type == "" {
+		metadata.Type = BackupTypeFull
+	}
+	return metadata, nil
+}
+
+// backupID is the backup's file name without its .zip/.zip.enc extension
+func backupID(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, backupEncExt), ".zip")
+}
+
+// isBackupFile reports whether name looks like a plain or encrypted backup
+func isBackupFile(name string) bool {
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".zip"+backupEncExt)
+}
+
+// ListBackups returns every readable backup, oldest first
+func (bm *BackupManager) ListBackups() ([]BackupInfo, error) {
+	files, err := os.ReadDir(bm.backupPath)
 	if err != nil {
-		return fmt.Errorf("failed to open backup file: %v", err)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	defer reader.Close()
-	
-	// Read metadata
-	var metadata BackupMetadata
-	for _, file := range reader.File {
-		if file.Name == "backup_metadata.json" {
-			rc, err := file.Open()
-			if err != nil {
-				continue
-			}
-			json.NewDecoder(rc).Decode(&metadata)
-			rc.Close()
+
+	var backups []BackupInfo
+	for _, file := range files {
+		if file.IsDir() || !isBackupFile(file.Name()) {
+			continue
+		}
+		path := filepath.Join(bm.backupPath, file.Name())
+		metadata, err := bm.readManifest(path)
+		if err != nil {
+			log.Printf("Warning: Skipping backup %s: %v", file.Name(), err)
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{
+			Name:     file.Name(),
+			Path:     path,
+			Size:     info.Size(),
+			Metadata: metadata,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Metadata.Timestamp.Before(backups[j].Metadata.Timestamp)
+	})
+	return backups, nil
+}
+
+// backupChain returns the backups to replay for backupFile, starting with
+// its base full backup
+func (bm *BackupManager) backupChain(backupFile string) ([]BackupInfo, error) {
+	var chain []BackupInfo
+	seen := make(map[string]bool)
+
+	path := backupFile
+	for {
+		name := filepath.Base(path)
+		if seen[name] {
+			return nil, fmt.Errorf("backup chain loops at %s", name)
+		}
+		seen[name] = true
+
+		metadata, err := bm.readManifest(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backup file %s: %v", name, err)
+		}
+
+		chain = append([]BackupInfo{{Name: name, Path: path, Metadata: metadata}}, chain...)
+		if metadata.Type != BackupTypeIncremental {
 			break
 		}
+		if metadata.ParentBackup == "" {
+			return nil, fmt.Errorf("incremental backup %s has no parent", name)
+		}
+		path = filepath.Join(filepath.Dir(backupFile), metadata.ParentBackup)
+	}
+
+	if base := chain[len(chain)-1].Metadata.BaseBackup; base != "" && base != chain[0].Name {
+		return nil, fmt.Errorf("backup chain starts at %s but %s expects base %s", chain[0].Name, filepath.Base(backupFile), base)
 	}
-	
+	return chain, nil
+}
+
+// RestoreFromBackup restores system from a backup file. For an incremental
+// backup the whole chain is replayed: its base full backup first, then each
+// incremental in order up to and including the one given.
+func (bm *BackupManager) RestoreFromBackup(backupFile string) error {
+	log.Printf("Starting restore from %s", backupFile)
+
+	chain, err := bm.backupChain(backupFile)
+	if err != nil {
+		return err
+	}
+	if err := bm.verifyChain(chain); err != nil {
+		return err
+	}
+
 	// Begin transaction
 	tx, err := bm.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
-	
-	// Restore tables
-	for _, file := range reader.File {
-		if filepath.Dir(file.Name) == "database" {
-			tableName := filepath.Base(file.Name)
-			tableName = tableName[:len(tableName)-5] // Remove .json
-			
-			if err := bm.restoreTable(tx, file, tableName); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("failed to restore table %s: %v", tableName, err)
-			}
+	defer tx.Rollback()
+
+	// Refuse backups whose columns the live schema can no longer hold
+	var liveSchema string
+	if err := tx.QueryRow("SELECT current_schema()").Scan(&liveSchema); err != nil {
+		return err
+	}
+	tables, err := bm.compareBackupSchema(tx, liveSchema, chain)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.LiveTableMissing {
+			return fmt.Errorf("schema mismatch: table %s no longer exists", t.Table)
+		}
+		if len(t.MissingInLive) > 0 {
+			return fmt.Errorf("schema mismatch: %s is missing columns %s", t.Table, strings.Join(t.MissingInLive, ", "))
+		}
+	}
+
+	restored := make(map[string][]string)
+	for i, backup := range chain {
+		if err := bm.applyBackup(tx, backup, i == 0, restored); err != nil {
+			return fmt.Errorf("failed to apply %s: %v", backup.Name, err)
 		}
 	}
-	
+
+	// Explicit ids were inserted, so move sequences past them
+	for table, pk := range restored {
+		if len(pk) != 1 {
+			continue
+		}
+		_, err := tx.Exec(fmt.Sprintf(`
+			SELECT setval(seq::regclass, COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)
+			FROM pg_get_serial_sequence($1, $2) AS seq
+			WHERE seq IS NOT NULL
+		`, pq.QuoteIdentifier(pk[0]), pq.QuoteIdentifier(table)), table, pk[0])
+		if err != nil {
+			return fmt.Errorf("failed to reset sequence for %s: %v", table, err)
+		}
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit restore: %v", err)
 	}
-	
-	log.Printf("Restore completed successfully")
+
+	log.Printf("Restore completed successfully (%d backup(s) replayed)", len(chain))
 	return nil
 }
 
-// restoreTable restores a single table from backup
-func (bm *BackupManager) restoreTable(tx *sql.Tx, file *zip.File, tableName string) error {
-	// Open file
-	rc, err := file.Open()
+// RestoreToPointInTime replays the newest backup chain taken at or before
+// the given time. Recovery points are the backup snapshots themselves.
+func (bm *BackupManager) RestoreToPointInTime(until time.Time) (string, error) {
+	backup, err := bm.BackupAt(until)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := bm.RestoreFromBackup(backup.Path); err != nil {
+		return "", err
+	}
+	return backup.Name, nil
+}
+
+// BackupAt returns the newest backup taken at or before the given time
+func (bm *BackupManager) BackupAt(until time.Time) (*BackupInfo, error) {
+	backups, err := bm.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !backups[i].Metadata.Timestamp.After(until) {
+			return &backups[i], nil
+		}
 	}
-	defer rc.Close()
-	
-	// Parse JSON
+	return nil, fmt.Errorf("no backup exists at or before %s", until.Format(time.RFC3339))
+}
+
+// applyBackup replays one backup of a chain. Full tables replace the current
+// contents; incremental tables upsert changed rows and delete removed keys.
+func (bm *BackupManager) applyBackup(tx *sql.Tx, backup BackupInfo, isBase bool, restored map[string][]string) error {
+	reader, err := bm.openArchive(backup.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer reader.Close()
+
+	tables := backup.Metadata.Tables
+
+	mode := func(table string) string {
+		if m := backup.Metadata.TableModes[table]; m != "" {
+			return m
+		}
+		return tableModeFull
+	}
+
+	// Clear full tables children first so foreign keys don't block the delete
+	for i := len(tables) - 1; i >= 0; i-- {
+		if mode(tables[i]) != tableModeFull || appendOnlyTables[tables[i]] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM " + pq.QuoteIdentifier(tables[i])); err != nil {
+			return fmt.Errorf("failed to clear table %s: %v", tables[i], err)
+		}
+	}
+
+	for _, table := range tables {
+		pk := backup.Metadata.PrimaryKeys[table]
+		upsert := !isBase && mode(table) != tableModeFull
+		if err := bm.restoreTable(tx, reader.Reader, table, pk, upsert); err != nil {
+			return fmt.Errorf("failed to restore table %s: %v", table, err)
+		}
+		if len(pk) > 0 {
+			restored[table] = pk
+		}
+	}
+
+	// Deletions run children first as well
+	for i := len(tables) - 1; i >= 0; i-- {
+		table := tables[i]
+		if mode(table) == tableModeFull || appendOnlyTables[table] {
+			continue
+		}
+		if err := bm.deleteRows(tx, reader.Reader, table, backup.Metadata.PrimaryKeys[table]); err != nil {
+			return fmt.Errorf("failed to delete rows from %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// restoreTable restores a single table from backup
+func (bm *BackupManager) restoreTable(tx *sql.Tx, reader *zip.Reader, tableName string, pk []string, upsert bool) error {
 	var records []map[string]interface{}
-	if err := json.NewDecoder(rc).Decode(&records); err != nil {
+	if err := readZipJSON(reader, fmt.Sprintf("database/%s.json", tableName), &records); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
-	
-	// Clear existing data
-	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", tableName)); err != nil {
-		log.Printf("Warning: Failed to clear table %s: %v", tableName, err)
+	if upsert && len(pk) == 0 {
+		return errors.New("incremental table has no primary key")
 	}
-	
+
+	quotedPK := make([]string, len(pk))
+	for i, col := range pk {
+		quotedPK[i] = pq.QuoteIdentifier(col)
+	}
+
 	// Insert records
 	for _, record := range records {
 		columns := make([]string, 0, len(record))
 		values := make([]interface{}, 0, len(record))
 		placeholders := make([]string, 0, len(record))
-		
+		updates := make([]string, 0, len(record))
+
 		i := 1
 		for col, val := range record {
-			columns = append(columns, col)
+			quoted := pq.QuoteIdentifier(col)
+			columns = append(columns, quoted)
 			values = append(values, val)
 			placeholders = append(placeholders, fmt.Sprintf("$%d", i))
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted))
 			i++
 		}
-		
+
 		query := fmt.Sprintf(
 			"INSERT INTO %s (%s) VALUES (%s)",
-			tableName,
+			pq.QuoteIdentifier(tableName),
 			strings.Join(columns, ", "),
 			strings.Join(placeholders, ", "),
 		)
-		
+		if appendOnlyTables[tableName] {
+			query += " ON CONFLICT DO NOTHING"
+		} else if upsert {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s",
+				strings.Join(quotedPK, ", "), strings.Join(updates, ", "))
+		}
+
 		if _, err := tx.Exec(query, values...); err != nil {
-			log.Printf("Warning: Failed to insert record into %s: %v", tableName, err)
+			return err
 		}
 	}
-	
+
 	return nil
 }
 
-// CreateIncrementalBackup creates a backup of changes since last full backup
-func (bm *BackupManager) CreateIncrementalBackup(sinceTime time.Time) (string, error) {
-	timestamp := time.Now().Format("20060102_150405")
-	backupName := fmt.Sprintf("fleet_incremental_%s.zip", timestamp)
-	backupFile := filepath.Join(bm.backupPath, backupName)
-	
-	log.Printf("Starting incremental backup since %s", sinceTime.Format(time.RFC3339))
-	
-	// This would backup only records modified since sinceTime
-	// Implementation depends on having updated_at columns
-	
-	return backupFile, nil
+// deleteRows removes the rows an incremental backup recorded as deleted
+func (bm *BackupManager) deleteRows(tx *sql.Tx, reader *zip.Reader, tableName string, pk []string) error {
+	var deleted []string
+	if err := readZipJSON(reader, fmt.Sprintf("deleted/%s.json", tableName), &deleted); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	if len(pk) == 0 {
+		return errors.New("deletions recorded for a table without a primary key")
+	}
+
+	conds := make([]string, len(pk))
+	for i, col := range pk {
+		conds[i] = fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(col), i+1)
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", pq.QuoteIdentifier(tableName), strings.Join(conds, " AND "))
+
+	for _, key := range deleted {
+		dec := json.NewDecoder(strings.NewReader(key))
+		dec.UseNumber()
+		var vals []interface{}
+		if err := dec.Decode(&vals); err != nil || len(vals) != len(pk) {
+			return fmt.Errorf("malformed deleted key %s", key)
+		}
+		if _, err := tx.Exec(query, vals...); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ScheduleAutomaticBackups sets up automatic backup schedule
@@ -330,56 +966,128 @@ func ScheduleAutomaticBackups(bm *BackupManager) {
 			now := time.Now()
 			next := time.Date(now.Year(), now.Month(), now.Day()+1, 2, 0, 0, 0, now.Location())
 			duration := next.Sub(now)
-			
+
 			time.Sleep(duration)
-			
+
 			if _, err := bm.CreateFullBackup(); err != nil {
 				log.Printf("Automatic backup failed: %v", err)
 			}
-			
+
 			// Clean old backups (keep last 7 days)
 			bm.CleanOldBackups(7 * 24 * time.Hour)
 		}
 	}()
+
+	// Incremental backups between the nightly full ones
+	interval := time.Hour
+	if v := os.Getenv("BACKUP_INCREMENTAL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("Invalid BACKUP_INCREMENTAL_INTERVAL %q, using %s", v, interval)
+		} else {
+			interval = d
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			backups, err := bm.ListBackups()
+			if err != nil {
+				log.Printf("Incremental backup failed: %v", err)
+				continue
+			}
+			if len(backups) == 0 {
+				_, err = bm.CreateFullBackup()
+			} else {
+				_, err = bm.CreateIncrementalBackup()
+			}
+			if err != nil {
+				log.Printf("Incremental backup failed: %v", err)
+			}
+		}
+	}()
 }
 
-// CleanOldBackups removes backups older than retention period
+// CleanOldBackups removes backups older than retention period. A backup is
+// kept while any retained backup still needs it to replay its chain.
 func (bm *BackupManager) CleanOldBackups(retention time.Duration) error {
-	files, err := os.ReadDir(bm.backupPath)
+	backups, err := bm.ListBackups()
 	if err != nil {
 		return err
 	}
-	
+
 	cutoff := time.Now().Add(-retention)
-	
-	for _, file := range files {
-		if file.IsDir() {
+
+	byName := make(map[string]BackupInfo, len(backups))
+	for _, b := range backups {
+		byName[b.Name] = b
+	}
+
+	needed := make(map[string]bool)
+	for _, b := range backups {
+		if b.Metadata.Timestamp.Before(cutoff) {
 			continue
 		}
-		
-		info, err := file.Info()
-		if err != nil {
+		for name := b.Name; name != "" && !needed[name]; name = byName[name].Metadata.ParentBackup {
+			needed[name] = true
+		}
+	}
+
+	for _, b := range backups {
+		if needed[b.Name] || !b.Metadata.Timestamp.Before(cutoff) {
 			continue
 		}
-		
-		if info.ModTime().Before(cutoff) {
-			backupFile := filepath.Join(bm.backupPath, file.Name())
-			if err := os.Remove(backupFile); err != nil {
-				log.Printf("Failed to remove old backup %s: %v", file.Name(), err)
-			} else {
-				log.Printf("Removed old backup: %s", file.Name())
-			}
+		if err := os.Remove(b.Path); err != nil {
+			log.Printf("Failed to remove old backup %s: %v", b.Name, err)
+		} else {
+			log.Printf("Removed old backup: %s", b.Name)
 		}
 	}
-	
+
 	return nil
 }
 
-// ExportData exports specific data in various formats
+// exportPath is where ExportData writes its files
+func exportPath() string {
+	if path := os.Getenv("EXPORT_PATH"); path != "" {
+		return path
+	}
+	return "./exports"
+}
+
+// ExportData exports specific data in various formats and returns the path
+// of the written file
 func ExportData(format string, tables []string) (string, error) {
+	if len(tables) == 0 {
+		return "", errors.New("no tables to export")
+	}
+	for _, table := range tables {
+		var exists bool
+		err := db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name = $1)
+		`, table).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("unknown table: %s", table)
+		}
+	}
+
+	if err := os.MkdirAll(exportPath(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create export directory: %v", err)
+	}
+
 	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("fleet_export_%s.%s", timestamp, format)
-	
+	filename := filepath.Join(exportPath(), fmt.Sprintf("fleet_export_%s.%s", timestamp, format))
+
 	switch format {
 	case "csv":
 		return exportToCSV(filename, tables)
@@ -392,23 +1100,171 @@ func ExportData(format string, tables []string) (string, error) {
 	}
 }
 
-// exportToCSV exports data to CSV format
+// readExportTable loads a table as a header row plus string cells
+func readExportTable(table string) ([]string, [][]string, error) {
+	rows, err := db.Query("SELECT * FROM " + pq.QuoteIdentifier(table))
+	if err != nil {
+		return nil, nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, nil, err
+	}
+
+	var data [][]string
+	err = scanRecords(rows, func(record map[string]interface{}) error {
+		row := make([]string, len(columns))
+		for i, col := range columns {
+			row[i] = exportCell(record[col])
+		}
+		data = append(data, row)
+		return nil
+	})
+	return columns, data, err
+}
+
+func exportCell(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case []byte:
+		return hex.EncodeToString(val)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// exportToCSV exports data to CSV format. A single table is written as a
+// plain CSV file; several tables become a zip with one CSV per table.
 func exportToCSV(filename string, tables []string) (string, error) {
-	// Implementation for CSV export
-	// This would create CSV files for each table
-	return filename, nil
+	if len(tables) == 1 {
+		file, err := os.Create(filename)
+		if err != nil {
+			return "", err
+		}
+		if err := writeExportCSV(file, tables[0]); err != nil {
+			file.Close()
+			os.Remove(filename)
+			return "", err
+		}
+		return filename, file.Close()
+	}
+
+	filename = strings.TrimSuffix(filename, ".csv") + ".zip"
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	zipWriter := zip.NewWriter(file)
+	for _, table := range tables {
+		w, err := zipWriter.Create(table + ".csv")
+		if err == nil {
+			err = writeExportCSV(w, table)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(filename)
+			return "", fmt.Errorf("failed to export %s: %v", table, err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		file.Close()
+		return "", err
+	}
+	return filename, file.Close()
 }
 
-// exportToExcel exports data to Excel format
+func writeExportCSV(w io.Writer, table string) error {
+	columns, data, err := readExportTable(table)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(columns)
+	writer.WriteAll(data)
+	return writer.Error()
+}
+
+// exportToExcel exports data to Excel format, one sheet per table
 func exportToExcel(filename string, tables []string) (string, error) {
-	// Implementation for Excel export
-	// This would require a library like excelize
+	f := excelize.NewFile()
+	defer f.Close()
+
+	headerStyle, dataStyle := createExcelStyles(f)
+
+	for i, table := range tables {
+		columns, data, err := readExportTable(table)
+		if err != nil {
+			return "", fmt.Errorf("failed to export %s: %v", table, err)
+		}
+
+		// Sheet names are limited to 31 characters
+		sheet := table
+		if len(sheet) > 31 {
+			sheet = sheet[:31]
+		}
+		if i == 0 {
+			f.SetSheetName("Sheet1", sheet)
+		} else if _, err := f.NewSheet(sheet); err != nil {
+			return "", err
+		}
+
+		for r, row := range append([][]string{columns}, data...) {
+			cell, _ := excelize.CoordinatesToCellName(1, r+1)
+			values := make([]interface{}, len(row))
+			for c, v := range row {
+				values[c] = v
+			}
+			if err := f.SetSheetRow(sheet, cell, &values); err != nil {
+				return "", err
+			}
+		}
+
+		if len(columns) > 0 {
+			lastCol, _ := excelize.ColumnNumberToName(len(columns))
+			f.SetCellStyle(sheet, "A1", lastCol+"1", headerStyle)
+			if len(data) > 0 {
+				f.SetCellStyle(sheet, "A2", fmt.Sprintf("%s%d", lastCol, len(data)+1), dataStyle)
+			}
+			f.SetColWidth(sheet, "A", lastCol, 15)
+		}
+	}
+
+	if err := f.SaveAs(filename); err != nil {
+		return "", err
+	}
 	return filename, nil
 }
 
-// exportToJSON exports data to JSON format
+// exportToJSON exports data to JSON format as an object keyed by table name
 func exportToJSON(filename string, tables []string) (string, error) {
-	// Implementation for JSON export
-	// Similar to backup but in a more readable format
+	export := make(map[string][]map[string]interface{}, len(tables))
+	for _, table := range tables {
+		rows, err := db.Query("SELECT * FROM " + pq.QuoteIdentifier(table))
+		if err != nil {
+			return "", fmt.Errorf("failed to export %s: %v", table, err)
+		}
+		records := []map[string]interface{}{}
+		err = scanRecords(rows, func(record map[string]interface{}) error {
+			records = append(records, record)
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to export %s: %v", table, err)
+		}
+		export[table] = records
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return "", err
+	}
 	return filename, nil
-}
\ No newline at end of file
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
@@ -88,7 +89,7 @@ type MonthlyBudgetTrend struct {
 // budgetDashboardHandler shows the budget overview
 func budgetDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermBudgetView) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -130,7 +131,7 @@ func budgetDashboardHandler(w http.ResponseWriter, r *http.Request) {
 // budgetCreateHandler creates a new budget
 func budgetCreateHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermBudgetEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -204,7 +205,7 @@ func budgetCreateHandler(w http.ResponseWriter, r *http.Request) {
 // budgetEditHandler edits budget allocations
 func budgetEditHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermBudgetEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -246,8 +247,14 @@ func budgetEditHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		before := auditSnapshot("budgets", "id", budgetID)
+
 		// Update budget status if requested
-		if status := r.FormValue("status"); status != "" {
+		if status := r.FormValue("status"); status != "" && status != budget.Status {
+			if !hasPermission(user, PermBudgetApprove) {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
 			err = updateBudgetStatus(budgetID, status)
 			if err != nil {
 				log.Printf("Error updating budget status: %v", err)
@@ -277,6 +284,7 @@ func budgetEditHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("Error updating budget allocated: %v", err)
 		}
+		recordAudit(auditActorFromRequest(r), AuditUpdate, "budget", strconv.Itoa(budgetID), before, auditSnapshot("budgets", "id", budgetID))
 
 		http.Redirect(w, r, "/budget", http.StatusFound)
 	}
@@ -338,6 +346,13 @@ func budgetExpenseHandler(w http.ResponseWriter, r *http.Request) {
 		SendError(w, ErrDatabase("Failed to record expense", err))
 		return
 	}
+	recordAuditChanges(auditActorFromRequest(r), "record_expense", "budget", strconv.Itoa(category.BudgetID), map[string]AuditChange{
+		"category_id":      {To: expense.CategoryID},
+		"amount":           {To: expense.Amount},
+		"description":      {To: expense.Description},
+		"vehicle_id":       {To: expense.VehicleID},
+		"transaction_date": {To: transDate.Format("2006-01-02")},
+	})
 
 	// Check for budget alerts
 	checkBudgetAlerts(category.BudgetID, expense.CategoryID)
@@ -350,7 +365,7 @@ func budgetExpenseHandler(w http.ResponseWriter, r *http.Request) {
 // budgetReportHandler generates budget reports
 func budgetReportHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermBudgetView) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -1050,6 +1065,9 @@ func linkFuelExpenseToBudget(fuelRecordID int) error {
 	return recordBudgetTransaction(transaction)
 }
 
+// linkMaintenanceExpenseToBudget posts a maintenance record's cost to the
+// maintenance budget. A record's cost grows as parts are charged to it,
+// so a record already posted gets an adjustment for the difference.
 func linkMaintenanceExpenseToBudget(maintenanceRecordID int) error {
 	// Get maintenance record details
 	var maintenance struct {
@@ -1060,7 +1078,8 @@ func linkMaintenanceExpenseToBudget(maintenanceRecordID int) error {
 	}
 	
 	err := db.QueryRow(`
-		SELECT vehicle_id, cost, service_date, service_type
+		SELECT COALESCE(vehicle_id, ''), COALESCE(cost, 0), COALESCE(service_date, date, created_at::date),
+			COALESCE(NULLIF(split_part(work_description, ':', 1), ''), 'Maintenance')
 		FROM maintenance_records
 		WHERE id = $1
 	`, maintenanceRecordID).Scan(&maintenance.VehicleID, &maintenance.Cost, 
@@ -1093,22 +1112,45 @@ func linkMaintenanceExpenseToBudget(maintenanceRecordID int) error {
 		return nil // No maintenance category
 	}
 
-	// Create budget transaction
+	// Only post what hasn't been posted already
 	refID := strconv.Itoa(maintenanceRecordID)
 	refType := "maintenance_record"
+
+	var posted float64
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM budget_transactions
+		WHERE reference_type = $1 AND reference_id = $2
+	`, refType, refID).Scan(&posted)
+	if err != nil {
+		return err
+	}
+	amount := math.Round((maintenance.Cost-posted)*100) / 100
+	if amount == 0 {
+		return nil
+	}
+	transactionType := "expense"
+	description := fmt.Sprintf("%s for vehicle %s", maintenance.Service, maintenance.VehicleID)
+	if posted != 0 {
+		transactionType = "adjustment"
+		description += " (revised cost)"
+	}
 	
 	transaction := BudgetTransaction{
 		BudgetID:        budget.ID,
 		CategoryID:      categoryID,
 		TransactionDate: maintenance.Date,
-		Amount:          maintenance.Cost,
-		TransactionType: "expense",
-		Description:     fmt.Sprintf("%s for vehicle %s", maintenance.Service, maintenance.VehicleID),
+		Amount:          amount,
+		TransactionType: transactionType,
+		Description:     description,
 		VehicleID:       &maintenance.VehicleID,
 		ReferenceID:     &refID,
 		ReferenceType:   &refType,
 		CreatedBy:       "system",
 	}
 
-	return recordBudgetTransaction(transaction)
-}
\ No newline at end of file
+	if err := recordBudgetTransaction(transaction); err != nil {
+		return err
+	}
+	checkBudgetAlerts(budget.ID, categoryID)
+	return nil
+}
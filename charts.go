@@ -426,8 +426,8 @@ func chartDataHandler(w http.ResponseWriter, r *http.Request) {
 	case "route-utilization":
 		chartData, err = GetRouteUtilizationChart()
 	case "driver-performance":
-		if user.Role != "manager" {
-			http.Error(w, "Manager access required", http.StatusForbidden)
+		if !hasPermission(user, PermDriversView) {
+			http.Error(w, "Access denied", http.StatusForbidden)
 			return
 		}
 		chartData, err = GetDriverPerformanceChart()
@@ -487,8 +487,8 @@ func availableChartsHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	// Add manager-only charts
-	if user.Role == "manager" {
+	// Driver comparisons need access to every driver's data
+	if hasPermission(user, PermDriversView) {
 		charts = append(charts, map[string]interface{}{
 			"id":          "driver-performance",
 			"name":        "Driver Performance",
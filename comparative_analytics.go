@@ -555,7 +555,7 @@ func (ta *TrendAnalysis) CalculateTrend() {
 // comparativeAnalyticsHandler handles requests for comparative analytics
 func comparativeAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermAnalyticsView) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -613,7 +613,7 @@ func comparativeAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
 // trendAnalysisHandler handles requests for trend analysis
 func trendAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermAnalyticsView) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+
+	"github.com/lib/pq"
 )
 
 // createParentTables creates all tables needed for parent portal functionality
@@ -80,6 +82,11 @@ func createParentTables(db *sql.DB) error {
 			created_by VARCHAR(100)
 		)`,
 		
+		// Account lockout after repeated failed logins
+		`ALTER TABLE parents ADD COLUMN IF NOT EXISTS failed_login_attempts INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE parents ADD COLUMN IF NOT EXISTS last_failed_login TIMESTAMP`,
+		`ALTER TABLE parents ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP`,
+		
 		// Temporary passwords for parent accounts
 		`CREATE TABLE IF NOT EXISTS temp_passwords (
 			parent_id INTEGER REFERENCES parents(id) ON DELETE CASCADE,
@@ -227,16 +234,49 @@ func getStudentDetails(studentID string) StudentDetail {
 	return detail
 }
 
+// getStudentAttendance returns one record per day with a ride recorded,
+// oldest first
 func getStudentAttendance(studentID string, days int) []AttendanceRecord {
-	// Mock attendance data - in production, this would query actual attendance records
 	records := []AttendanceRecord{}
-	
-	// Generate mock data for the last 'days' days
-	// In production, query the attendance table
-	
+	entries, err := loadStudentAttendance(studentID, days)
+	if err != nil {
+		log.Printf("Error loading attendance for student %s: %v", studentID, err)
+		return records
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if n := len(records); n == 0 || !records[n-1].Date.Equal(e.Date) {
+			records = append(records, AttendanceRecord{Date: e.Date})
+		}
+		day := &records[len(records)-1]
+		if e.Period == "morning" {
+			day.Morning = e.Status
+		} else {
+			day.Afternoon = e.Status
+		}
+	}
 	return records
 }
 
+// summarizeAttendance counts the days a student rode and the days they
+// were marked absent without riding
+func summarizeAttendance(records []AttendanceRecord) AttendanceSummary {
+	var summary AttendanceSummary
+	for _, day := range records {
+		switch day.Status() {
+		case "present":
+			summary.DaysPresent++
+		case "absent":
+			summary.DaysAbsent++
+		}
+	}
+	if total := summary.DaysPresent + summary.DaysAbsent; total > 0 {
+		summary.Rate = summary.DaysPresent * 100 / total
+	}
+	return summary
+}
+
 func getStudentNotifications(studentID string, limit int) []ParentNotification {
 	// Get notifications specific to this student
 	// In production, join with actual notification data
@@ -292,6 +332,107 @@ func getBusTrackingForStudent(studentID string) *BusTracking {
 	return &tracking
 }
 
+// parentNotice is a message for the parents of some students. Wants picks
+// the setting a parent must have on to get it; Kind is the notification
+// type used for email and text.
+type parentNotice struct {
+	StudentIDs []string
+	Type       string
+	Title      string
+	Message    string
+	Kind       string
+	Priority   string
+	Wants      func(NotificationSettings) bool
+}
+
+// notifyStudentParents tells a student's parents about their ride, if they
+// want attendance updates
+func notifyStudentParents(studentID, notifType, title, message string) {
+	notifyParents(parentNotice{
+		StudentIDs: []string{studentID},
+		Type:       notifType,
+		Title:      title,
+		Message:    message,
+		Kind:       NotifyStudentRidership,
+		Priority:   "medium",
+		Wants:      func(s NotificationSettings) bool { return s.Attendance },
+	})
+}
+
+// notifyParents puts a notice in the portal of each active parent of the
+// students who wants it, once per parent, and emails or texts it to those
+// who turned that on
+func notifyParents(notice parentNotice) {
+	if len(notice.StudentIDs) == 0 {
+		return
+	}
+	var parents []struct {
+		ID            int            `db:"id"`
+		Email         string         `db:"email"`
+		Phone         string         `db:"phone"`
+		Notifications bool           `db:"notifications"`
+		StudentID     sql.NullString `db:"student_id"`
+	}
+	err := db.Select(&parents, `
+		SELECT p.id, p.email, COALESCE(p.phone, '') AS phone,
+			COALESCE(p.notifications, true) AS notifications,
+			CASE WHEN COUNT(*) = 1 THEN MIN(ps.student_id) END AS student_id
+		FROM parents p
+		JOIN parent_students ps ON ps.parent_id = p.id
+		WHERE ps.student_id = ANY($1) AND p.active
+		GROUP BY p.id
+	`, pq.StringArray(notice.StudentIDs))
+	if err != nil {
+		log.Printf("Failed to load parents for %s notice: %v", notice.Type, err)
+		return
+	}
+
+	var recipients []Recipient
+	for _, parent := range parents {
+		settings := getParentNotificationSettings(parent.ID)
+		if !parent.Notifications || !notice.Wants(settings) {
+			continue
+		}
+		if _, err := db.Exec(`
+			INSERT INTO parent_notifications (id, parent_id, type, title, message, student_id)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, generateID("pnotif"), parent.ID, notice.Type, notice.Title, notice.Message, parent.StudentID); err != nil {
+			log.Printf("Failed to store notification for parent %d: %v", parent.ID, err)
+			continue
+		}
+		if settings.EmailEnabled || settings.SMSEnabled {
+			recipients = append(recipients, Recipient{
+				UserID: fmt.Sprintf("parent:%d", parent.ID),
+				Email:  parent.Email,
+				Phone:  parent.Phone,
+				Preferences: NotificationPreferences{
+					Email: settings.EmailEnabled,
+					SMS:   settings.SMSEnabled,
+				},
+			})
+		}
+	}
+
+	if len(recipients) == 0 || notificationSystem == nil {
+		return
+	}
+	data := map[string]interface{}{"event": notice.Type}
+	if len(notice.StudentIDs) == 1 {
+		data["student_id"] = notice.StudentIDs[0]
+	}
+	if err := notificationSystem.Send(Notification{
+		Type:       notice.Kind,
+		Priority:   notice.Priority,
+		Subject:    notice.Title,
+		Message:    notice.Message,
+		Data:       data,
+		Channels:   []string{"email", "sms"},
+		Recipients: recipients,
+	}); err != nil {
+		log.Printf("Failed to send %s notice to parents: %v", notice.Type, err)
+	}
+}
+
 func markParentNotificationRead(parentID int, notificationID string) error {
 	_, err := db.Exec(`
 		UPDATE parent_notifications 
@@ -14,8 +14,8 @@ func analyticsDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if session.Role != "manager" {
-		SendError(w, ErrForbidden("Manager access required"))
+	if !roleHasPermission(session.Role, PermAnalyticsView) {
+		SendError(w, ErrForbidden("Access denied"))
 		return
 	}
 
@@ -147,8 +147,8 @@ type MonthlyCount struct {
 // dashboardAnalyticsHandler returns comprehensive analytics data
 func dashboardAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := GetSession(r)
-	if err != nil || session.Role != "manager" {
-		SendError(w, ErrForbidden("Manager access required"))
+	if err != nil || !roleHasPermission(session.Role, PermDashboardView) {
+		SendError(w, ErrForbidden("Access denied"))
 		return
 	}
 
@@ -344,17 +344,10 @@ func getMileageMetrics() (*MileageMetrics, error) {
 		return nil, err
 	}
 
-	// Calculate average daily miles (only count weekdays as operational days)
-	operationalDays := 0
-	for d := 1; d <= now.Day(); d++ {
-		date := time.Date(now.Year(), now.Month(), d, 0, 0, 0, 0, now.Location())
-		weekday := date.Weekday()
-		// Count Monday through Friday as operational days
-		if weekday >= time.Monday && weekday <= time.Friday {
-			operationalDays++
-		}
-	}
-	
+	// Calculate average daily miles over the district's service days so far
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	operationalDays := serviceCalendarFor(monthStart, now).ServiceDays(monthStart, now, 0)
+
 	if operationalDays > 0 {
 		metrics.AverageDailyMiles = float64(metrics.TotalMileage) / float64(operationalDays)
 	} else {
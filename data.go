@@ -104,138 +104,54 @@ func updateVehicleMileageInTx(tx *sqlx.Tx, vehicleID string, mileage int) error
 	return nil
 }
 
+// updateMaintenanceStatusBasedOnMileageInTx sets a vehicle's oil and tire
+// status from the most pressing PM program in each category
 func updateMaintenanceStatusBasedOnMileageInTx(tx *sqlx.Tx, vehicleID string) error {
+	due, err := loadPMDueList(tx, vehicleID)
+	if err != nil {
+		return err
+	}
+	worst := map[string]string{"oil_change": PMStatusOK, "tire_service": PMStatusOK}
+	for _, d := range due {
+		if current, tracked := worst[d.Program.Category]; tracked && pmStatusRank[d.Status] > pmStatusRank[current] {
+			worst[d.Program.Category] = d.Status
+		}
+	}
+	columnStatus := map[string]string{PMStatusOK: "good", PMStatusDue: "due_soon", PMStatusOverdue: "overdue"}
+	oilStatus, tireStatus := columnStatus[worst["oil_change"]], columnStatus[worst["tire_service"]]
+
 	// Try to update buses table first
-	busQuery := `
-		UPDATE buses SET 
-			oil_status = CASE 
-				WHEN (current_mileage - COALESCE(last_oil_change, 0)) > 5000 THEN 'overdue'
-				WHEN (current_mileage - COALESCE(last_oil_change, 0)) > 4500 THEN 'due'
-				ELSE 'good'
-			END,
-			tire_status = CASE 
-				WHEN (current_mileage - COALESCE(last_tire_service, 0)) > 15000 THEN 'overdue'
-				WHEN (current_mileage - COALESCE(last_tire_service, 0)) > 12000 THEN 'due'
-				ELSE 'good'
-			END
-		WHERE bus_id = $1
-	`
-	result, err := tx.Exec(busQuery, vehicleID)
+	result, err := tx.Exec(`UPDATE buses SET oil_status = $2, tire_status = $3 WHERE bus_id = $1`, vehicleID, oilStatus, tireStatus)
 	if err != nil {
 		return fmt.Errorf("failed to update bus maintenance status: %w", err)
 	}
-	
+
 	// Check if any rows were affected
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
 		// No bus found, try vehicles table
-		vehicleQuery := `
-			UPDATE vehicles SET 
-				oil_status = CASE 
-					WHEN (current_mileage - COALESCE(last_oil_change, 0)) > 5000 THEN 'overdue'
-					WHEN (current_mileage - COALESCE(last_oil_change, 0)) > 4500 THEN 'due'
-					ELSE 'good'
-				END,
-				tire_status = CASE 
-					WHEN (current_mileage - COALESCE(last_tire_service, 0)) > 15000 THEN 'overdue'
-					WHEN (current_mileage - COALESCE(last_tire_service, 0)) > 12000 THEN 'due'
-					ELSE 'good'
-				END
-			WHERE vehicle_id = $1
-		`
-		_, err = tx.Exec(vehicleQuery, vehicleID)
+		_, err = tx.Exec(`UPDATE vehicles SET oil_status = $2, tire_status = $3 WHERE vehicle_id = $1`, vehicleID, oilStatus, tireStatus)
 		if err != nil {
 			return fmt.Errorf("failed to update vehicle maintenance status: %w", err)
 		}
 	}
-	
-	return nil
-}
 
-// Define maintenance schedules
-var maintenanceSchedules = []MaintenanceSchedule{
-	{
-		ItemName:      "Oil & Filter Change",
-		Interval:      5000,
-		WarningMiles:  500,
-		CriticalMiles: 1000,
-	},
-	{
-		ItemName:      "Tire Rotation",
-		Interval:      10000,
-		WarningMiles:  1000,
-		CriticalMiles: 2000,
-	},
-	{
-		ItemName:      "Air Filter",
-		Interval:      15000,
-		WarningMiles:  1000,
-		CriticalMiles: 3000,
-	},
-	{
-		ItemName:      "Brake Inspection",
-		Interval:      20000,
-		WarningMiles:  2000,
-		CriticalMiles: 5000,
-	},
+	return nil
 }
 
-// CheckMaintenanceDue checks if maintenance is due for a vehicle
+// CheckMaintenanceDue lists the PM programs due or overdue on a vehicle
 func checkMaintenanceDue(vehicleID string) ([]MaintenanceAlert, error) {
-	// Get current maintenance info
-	currentMileage, lastOilChange, lastTireService, err := getVehicleMaintenanceInfo(vehicleID)
+	due, err := loadPMDueList(db, vehicleID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get vehicle info: %w", err)
+		return nil, fmt.Errorf("failed to work out due services: %w", err)
 	}
 
-	var alerts []MaintenanceAlert
-
-	// Check oil change
-	oilMilesSince := currentMileage - lastOilChange
-	if oilMilesSince >= 5000 {
-		alert := MaintenanceAlert{
-			VehicleID:    vehicleID,
-			AlertType:    "maintenance",
-			ItemName:     "Oil & Filter Change",
-			Severity:     "overdue",
-			MilesOverdue: oilMilesSince - 5000,
-			Message:      fmt.Sprintf("Oil change overdue by %d miles", oilMilesSince-5000),
-		}
-		alerts = append(alerts, alert)
-	} else if oilMilesSince >= 4500 {
-		alert := MaintenanceAlert{
-			VehicleID: vehicleID,
-			AlertType: "maintenance",
-			ItemName:  "Oil & Filter Change",
-			Severity:  "due",
-			Message:   fmt.Sprintf("Oil change due in %d miles", 5000-oilMilesSince),
-		}
-		alerts = append(alerts, alert)
-	}
-
-	// Check tire service
-	tireMilesSince := currentMileage - lastTireService
-	if tireMilesSince >= 40000 {
-		alert := MaintenanceAlert{
-			VehicleID:    vehicleID,
-			AlertType:    "maintenance",
-			ItemName:     "Tire Service",
-			Severity:     "overdue",
-			MilesOverdue: tireMilesSince - 40000,
-			Message:      fmt.Sprintf("Tire service overdue by %d miles", tireMilesSince-40000),
-		}
-		alerts = append(alerts, alert)
-	} else if tireMilesSince >= 35000 {
-		alert := MaintenanceAlert{
-			VehicleID: vehicleID,
-			AlertType: "maintenance",
-			ItemName:  "Tire Service",
-			Severity:  "warning",
-			Message:   fmt.Sprintf("Tire service due in %d miles", 40000-tireMilesSince),
+	alerts := []MaintenanceAlert{}
+	for _, d := range due {
+		if d.Status != PMStatusOK {
+			alerts = append(alerts, d.Alert())
 		}
-		alerts = append(alerts, alert)
 	}
-
 	return alerts, nil
 }
 
@@ -282,38 +198,9 @@ func validateMileageEntry(vehicleID string, newMileage float64) MileageValidatio
 
 // UpdateMaintenanceStatusBasedOnMileage updates oil and tire status based on current mileage
 func updateMaintenanceStatusBasedOnMileage(vehicleID string) error {
-	// Get maintenance info
-	currentMileage, lastOilChange, lastTireService, err := getVehicleMaintenanceInfo(vehicleID)
-	if err != nil {
-		return fmt.Errorf("failed to get maintenance info: %w", err)
-	}
-
-	// Calculate miles since last service
-	oilMilesSince := currentMileage - lastOilChange
-	tireMilesSince := currentMileage - lastTireService
-
-	// Determine oil status
-	var oilStatus string
-	if oilMilesSince >= 5000 {
-		oilStatus = "overdue"
-	} else if oilMilesSince >= 4500 {
-		oilStatus = "needs_service"
-	} else {
-		oilStatus = "good"
-	}
-
-	// Determine tire status
-	var tireStatus string
-	if tireMilesSince >= 40000 {
-		tireStatus = "replace"
-	} else if tireMilesSince >= 35000 {
-		tireStatus = "worn"
-	} else {
-		tireStatus = "good"
-	}
-
-	// Update the status in the database
-	return updateVehicleMaintenanceStatus(vehicleID, oilStatus, tireStatus)
+	return withTransaction(func(tx *sqlx.Tx) error {
+		return updateMaintenanceStatusBasedOnMileageInTx(tx, vehicleID)
+	})
 }
 
 // Load functions for caching
@@ -771,7 +658,8 @@ func loadRoutesFromDB() ([]Route, error) {
 	var routes []Route
 	// FIXED: Select only columns that exist in the Route struct
 	err := db.Select(&routes, `
-		SELECT route_id, route_name, description, positions, created_at 
+		SELECT route_id, route_name, description, positions, created_at,
+		       needs_wheelchair_lift
 		FROM routes 
 		ORDER BY route_id
 	`)
@@ -909,42 +797,14 @@ func getStudentCount(includeInactive bool) (int, error) {
 
 func saveBusMaintenanceLog(busLog BusMaintenanceLog) error {
 	return withTransaction(func(tx *sqlx.Tx) error {
-		// Insert into the consolidated maintenance_records table
-		query := `
-			INSERT INTO maintenance_records (vehicle_id, service_date, work_description, mileage, cost, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-		`
-
-		// Combine category and notes for work_description
-		workDescription := busLog.Category
-		if busLog.Notes != "" {
-			workDescription = busLog.Category + ": " + busLog.Notes
-		}
-
-		_, err := tx.Exec(query, busLog.BusID, busLog.Date, workDescription, busLog.Mileage, busLog.Cost)
-		if err != nil {
+		if _, err := insertMaintenanceRecordInTx(tx, busLog.BusID, busLog.Date, busLog.Category, busLog.Notes, busLog.Mileage, busLog.Cost); err != nil {
 			return fmt.Errorf("failed to save bus maintenance log: %w", err)
 		}
-
-		// Update last service mileage if applicable
-		if busLog.Category == "oil_change" && busLog.Mileage > 0 {
-			if err := updateLastServiceMileageInTx(tx, busLog.BusID, "oil_change", busLog.Mileage); err != nil {
-				return fmt.Errorf("failed to update last oil change mileage: %w", err)
-			}
-		} else if busLog.Category == "tire_service" && busLog.Mileage > 0 {
-			if err := updateLastServiceMileageInTx(tx, busLog.BusID, "tire_service", busLog.Mileage); err != nil {
-				return fmt.Errorf("failed to update last tire service mileage: %w", err)
-			}
+		if err := recordPMServiceInTx(tx, busLog.BusID, "", busLog.Category, busLog.Date, busLog.Mileage, 0); err != nil {
+			return err
 		}
-
-		// Update vehicle status based on new mileage
-		if busLog.Mileage > 0 {
-			if err := updateVehicleMileageInTx(tx, busLog.BusID, busLog.Mileage); err != nil {
-				return fmt.Errorf("failed to update vehicle mileage: %w", err)
-			}
-			if err := updateMaintenanceStatusBasedOnMileageInTx(tx, busLog.BusID); err != nil {
-				return fmt.Errorf("failed to update maintenance status: %w", err)
-			}
+		if err := applyServiceMileageInTx(tx, busLog.BusID, busLog.Category, busLog.Mileage); err != nil {
+			return err
 		}
 
 		// Invalidate cache after successful transaction
@@ -956,42 +816,14 @@ func saveBusMaintenanceLog(busLog BusMaintenanceLog) error {
 
 func saveVehicleMaintenanceLog(vehicleLog VehicleMaintenanceLog) error {
 	return withTransaction(func(tx *sqlx.Tx) error {
-		// Insert into the consolidated maintenance_records table
-		query := `
-			INSERT INTO maintenance_records (vehicle_id, service_date, work_description, mileage, cost, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-		`
-
-		// Combine category and notes for work_description
-		workDescription := vehicleLog.Category
-		if vehicleLog.Notes != "" {
-			workDescription = vehicleLog.Category + ": " + vehicleLog.Notes
-		}
-
-		_, err := tx.Exec(query, vehicleLog.VehicleID, vehicleLog.Date, workDescription, vehicleLog.Mileage, vehicleLog.Cost)
-		if err != nil {
+		if _, err := insertMaintenanceRecordInTx(tx, vehicleLog.VehicleID, vehicleLog.Date, vehicleLog.Category, vehicleLog.Notes, vehicleLog.Mileage, vehicleLog.Cost); err != nil {
 			return fmt.Errorf("failed to save vehicle maintenance log: %w", err)
 		}
-
-		// Update last service mileage if applicable
-		if vehicleLog.Category == "oil_change" && vehicleLog.Mileage > 0 {
-			if err := updateLastServiceMileageInTx(tx, vehicleLog.VehicleID, "oil_change", vehicleLog.Mileage); err != nil {
-				return fmt.Errorf("failed to update last oil change mileage: %w", err)
-			}
-		} else if vehicleLog.Category == "tire_service" && vehicleLog.Mileage > 0 {
-			if err := updateLastServiceMileageInTx(tx, vehicleLog.VehicleID, "tire_service", vehicleLog.Mileage); err != nil {
-				return fmt.Errorf("failed to update last tire service mileage: %w", err)
-			}
+		if err := recordPMServiceInTx(tx, vehicleLog.VehicleID, "", vehicleLog.Category, vehicleLog.Date, vehicleLog.Mileage, 0); err != nil {
+			return err
 		}
-
-		// Update vehicle status based on new mileage
-		if vehicleLog.Mileage > 0 {
-			if err := updateVehicleMileageInTx(tx, vehicleLog.VehicleID, vehicleLog.Mileage); err != nil {
-				return fmt.Errorf("failed to update vehicle mileage: %w", err)
-			}
-			if err := updateMaintenanceStatusBasedOnMileageInTx(tx, vehicleLog.VehicleID); err != nil {
-				return fmt.Errorf("failed to update maintenance status: %w", err)
-			}
+		if err := applyServiceMileageInTx(tx, vehicleLog.VehicleID, vehicleLog.Category, vehicleLog.Mileage); err != nil {
+			return err
 		}
 
 		// Invalidate cache after successful transaction
@@ -1001,6 +833,48 @@ func saveVehicleMaintenanceLog(vehicleLog VehicleMaintenanceLog) error {
 	})
 }
 
+// insertMaintenanceRecordInTx adds a row to the consolidated
+// maintenance_records table and returns its id
+func insertMaintenanceRecordInTx(tx *sqlx.Tx, vehicleID, date, category, notes string, mileage int, cost float64) (int, error) {
+	// Combine category and notes for work_description
+	workDescription := category
+	if notes != "" {
+		workDescription = category + ": " + notes
+	}
+
+	var id int
+	err := tx.QueryRow(`
+		INSERT INTO maintenance_records (vehicle_id, service_date, work_description, mileage, cost, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		RETURNING id
+	`, vehicleID, date, workDescription, mileage, cost).Scan(&id)
+	return id, err
+}
+
+// applyServiceMileageInTx brings a vehicle's mileage, last oil change or
+// tire service, and maintenance status up to date after a service
+func applyServiceMileageInTx(tx *sqlx.Tx, vehicleID, category string, mileage int) error {
+	if mileage <= 0 {
+		return nil
+	}
+
+	// Update last service mileage if applicable
+	if category == "oil_change" || category == "tire_service" {
+		if err := updateLastServiceMileageInTx(tx, vehicleID, category, mileage); err != nil {
+			return fmt.Errorf("failed to update last %s mileage: %w", category, err)
+		}
+	}
+
+	// Update vehicle status based on new mileage
+	if err := updateVehicleMileageInTx(tx, vehicleID, mileage); err != nil {
+		return fmt.Errorf("failed to update vehicle mileage: %w", err)
+	}
+	if err := updateMaintenanceStatusBasedOnMileageInTx(tx, vehicleID); err != nil {
+		return fmt.Errorf("failed to update maintenance status: %w", err)
+	}
+	return nil
+}
+
 // loadMonthlyMileageReportsFromDB loads all monthly mileage reports from database
 func loadMonthlyMileageReportsFromDB() ([]MonthlyMileageReport, error) {
 	if db == nil {
@@ -1425,74 +1299,55 @@ func getMaintenanceRecordCount(vehicleID string) (int, error) {
 	return count, err
 }
 
-// loadServiceRecordsFromDB loads all service records from database
+// loadServiceRecordsFromDB loads all service records from database,
+// leaving out the sheets' header and blank rows
 func loadServiceRecordsFromDB() ([]ServiceRecord, error) {
-	if db == nil {
-		return nil, fmt.Errorf("database not initialized")
-	}
-
-	var records []ServiceRecord
-	query := `
-		SELECT id, unnamed_0, unnamed_1, unnamed_2, unnamed_3, unnamed_4, unnamed_5, 
-		       unnamed_6, unnamed_7, unnamed_8, unnamed_9, unnamed_10, unnamed_11, 
-		       unnamed_12, unnamed_13, created_at, updated_at, maintenance_date
-		FROM service_records 
-		ORDER BY 
-			COALESCE(maintenance_date, created_at) DESC,
-			id`
-
-	err := db.Select(&records, query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load service records: %w", err)
-	}
-
-	return records, nil
+	return loadServiceRecordsByFilters("", "", "", "")
 }
 
-// loadServiceRecordsByFilters loads filtered service records
-func loadServiceRecordsByFilters(vehicleFilter string, startDate, endDate string) ([]ServiceRecord, error) {
+// loadServiceRecordsByFilters loads filtered service records. status is
+// "needs_service", "unmapped" or "" for all.
+func loadServiceRecordsByFilters(vehicleFilter, status, startDate, endDate string) ([]ServiceRecord, error) {
 	if db == nil {
 		return nil, fmt.Errorf("database not initialized")
 	}
 
 	var records []ServiceRecord
-	var conditions []string
 	var args []interface{}
-
-	baseQuery := `
-		SELECT id, unnamed_0, unnamed_1, unnamed_2, unnamed_3, unnamed_4, unnamed_5, 
-		       unnamed_6, unnamed_7, unnamed_8, unnamed_9, unnamed_10, unnamed_11, 
-		       unnamed_12, unnamed_13, created_at, updated_at, maintenance_date
-		FROM service_records WHERE 1=1`
+	query := `SELECT ` + serviceRecordColumns + ` FROM service_records
+		WHERE normalize_status NOT IN ('header', 'blank')`
 
 	if vehicleFilter != "" {
-		// Search across multiple fields that might contain vehicle info
-		conditions = append(conditions, " AND (UPPER(unnamed_0) LIKE UPPER($"+fmt.Sprintf("%d", len(args)+1)+") OR UPPER(unnamed_1) LIKE UPPER($"+fmt.Sprintf("%d", len(args)+1)+") OR UPPER(unnamed_2) LIKE UPPER($"+fmt.Sprintf("%d", len(args)+1)+"))")
+		// Rows the normalizer couldn't map are still found by their raw cells
 		args = append(args, "%"+vehicleFilter+"%")
+		n := len(args)
+		query += fmt.Sprintf(` AND (vehicle_number ILIKE $%d OR vehicle_id ILIKE $%d OR vehicle_description ILIKE $%d
+			OR location ILIKE $%d OR unnamed_0 ILIKE $%d OR unnamed_1 ILIKE $%d OR unnamed_2 ILIKE $%d)`, n, n, n, n, n, n, n)
+	}
+
+	switch status {
+	case "needs_service":
+		query += ` AND needs_service`
+	case "unmapped":
+		query += ` AND normalize_status IN ('unmapped', 'pending')`
 	}
 
 	if startDate != "" {
-		conditions = append(conditions, " AND (maintenance_date >= $"+fmt.Sprintf("%d", len(args)+1)+" OR created_at >= $"+fmt.Sprintf("%d", len(args)+1)+")")
 		args = append(args, startDate)
+		query += fmt.Sprintf(` AND COALESCE(service_date, maintenance_date, created_at::date) >= $%d`, len(args))
 	}
 
 	if endDate != "" {
-		conditions = append(conditions, " AND (maintenance_date <= $"+fmt.Sprintf("%d", len(args)+1)+" OR created_at <= $"+fmt.Sprintf("%d", len(args)+1)+")")
 		args = append(args, endDate)
+		query += fmt.Sprintf(` AND COALESCE(service_date, maintenance_date, created_at::date) <= $%d`, len(args))
 	}
 
-	query := baseQuery
-	for _, condition := range conditions {
-		query += condition
-	}
-
-	query += ` ORDER BY 
-		COALESCE(maintenance_date, created_at) DESC,
-		id`
+	// Newest sheet first, each in its own row order
+	query += ` ORDER BY COALESCE(maintenance_date, created_at::date) DESC, id`
 
 	err := db.Select(&records, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load filtered service records: %w", err)
+		return nil, fmt.Errorf("failed to load service records: %w", err)
 	}
 
 	return records, nil
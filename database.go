@@ -69,6 +69,10 @@ func InitDB(dataSourceName string) error {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	if err := seedRoles(); err != nil {
+		log.Printf("Warning: Failed to seed roles: %v", err)
+	}
+
 	// Ensure admin user exists
 	log.Println("Ensuring admin user exists...")
 	if err := ensureAdminUser(); err != nil {
@@ -76,6 +80,11 @@ func InitDB(dataSourceName string) error {
 		// Don't fail startup, but log the warning
 	}
 
+	// Map any service sheet rows imported since the last start
+	if _, err := normalizeServiceRecords(false); err != nil {
+		log.Printf("Warning: Failed to normalize service records: %v", err)
+	}
+
 	// Create performance indexes
 	if err := createPerformanceIndexes(); err != nil {
 		log.Printf("Warning: Failed to create some performance indexes: %v", err)
@@ -332,7 +341,7 @@ func runMigrations() error {
 		`CREATE TABLE IF NOT EXISTS users (
 			username VARCHAR(50) PRIMARY KEY,
 			password VARCHAR(255) NOT NULL,
-			role VARCHAR(20) NOT NULL CHECK (role IN ('manager', 'driver')),
+			role VARCHAR(20) NOT NULL,
 			status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('active', 'pending')),
 			registration_date DATE NOT NULL DEFAULT CURRENT_DATE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -704,20 +713,59 @@ func runMigrations() error {
 			id SERIAL PRIMARY KEY,
 			name VARCHAR(100) NOT NULL,
 			export_type VARCHAR(50) NOT NULL,
-			schedule VARCHAR(20) NOT NULL CHECK (schedule IN ('daily', 'weekly', 'monthly')),
+			schedule VARCHAR(20) NOT NULL CHECK (schedule IN ('daily', 'weekly', 'monthly', 'cron')),
 			day_of_week INTEGER DEFAULT 0,
 			day_of_month INTEGER DEFAULT 1,
 			time VARCHAR(5) NOT NULL,
+			cron_expression VARCHAR(100),
+			timezone VARCHAR(64),
 			format VARCHAR(10) NOT NULL DEFAULT 'xlsx',
 			recipients TEXT,
 			enabled BOOLEAN DEFAULT TRUE,
-			last_run TIMESTAMP,
-			next_run TIMESTAMP NOT NULL,
+			last_run TIMESTAMPTZ,
+			next_run TIMESTAMPTZ NOT NULL,
 			created_by VARCHAR(50) REFERENCES users(username),
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
-		
+
+		// Cron/timezone support for scheduled exports. Run times become
+		// TIMESTAMPTZ so exports in different zones compare correctly.
+		`ALTER TABLE scheduled_exports ADD COLUMN IF NOT EXISTS cron_expression VARCHAR(100)`,
+		`ALTER TABLE scheduled_exports ADD COLUMN IF NOT EXISTS timezone VARCHAR(64)`,
+		`DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'scheduled_exports' AND column_name = 'next_run'
+				AND data_type = 'timestamp without time zone') THEN
+				ALTER TABLE scheduled_exports
+					ALTER COLUMN next_run TYPE TIMESTAMPTZ,
+					ALTER COLUMN last_run TYPE TIMESTAMPTZ;
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint
+				WHERE conname = 'scheduled_exports_schedule_check'
+				AND pg_get_constraintdef(oid) LIKE '%cron%') THEN
+				ALTER TABLE scheduled_exports DROP CONSTRAINT IF EXISTS scheduled_exports_schedule_check;
+				ALTER TABLE scheduled_exports ADD CONSTRAINT scheduled_exports_schedule_check
+					CHECK (schedule IN ('daily', 'weekly', 'monthly', 'cron'));
+			END IF;
+		END $$;`,
+
+		// Create scheduled export run history table
+		`CREATE TABLE IF NOT EXISTS scheduled_export_runs (
+			id SERIAL PRIMARY KEY,
+			export_id INTEGER NOT NULL REFERENCES scheduled_exports(id) ON DELETE CASCADE,
+			trigger VARCHAR(20) NOT NULL DEFAULT 'scheduled',
+			status VARCHAR(20) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'success', 'failed')),
+			filename VARCHAR(255),
+			size_bytes BIGINT DEFAULT 0,
+			recipients TEXT,
+			error TEXT,
+			started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			finished_at TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_export_runs_export ON scheduled_export_runs(export_id, started_at DESC)`,
+
 		// Create saved reports table
 		`CREATE TABLE IF NOT EXISTS saved_reports (
 			id SERIAL PRIMARY KEY,
@@ -812,6 +860,10 @@ func runMigrations() error {
 			error_message TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS provider VARCHAR(30)`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS provider_message_id VARCHAR(255)`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS recipient VARCHAR(255)`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS attempts INTEGER DEFAULT 1`,
 
 		// Create in_app_notifications table
 		`CREATE TABLE IF NOT EXISTS in_app_notifications (
@@ -832,6 +884,58 @@ func runMigrations() error {
 		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255)`,
 		`ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(20)`,
 
+		// Roles are named permission sets; users.role references them
+		`CREATE TABLE IF NOT EXISTS roles (
+			name VARCHAR(20) PRIMARY KEY,
+			display_name VARCHAR(100) NOT NULL,
+			description TEXT,
+			is_system BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS role_permissions (
+			role VARCHAR(20) NOT NULL REFERENCES roles(name) ON DELETE CASCADE ON UPDATE CASCADE,
+			permission VARCHAR(50) NOT NULL,
+			PRIMARY KEY (role, permission)
+		)`,
+		`INSERT INTO roles (name, display_name, is_system) VALUES
+			('manager', 'Manager', TRUE), ('driver', 'Driver', TRUE)
+			ON CONFLICT (name) DO NOTHING`,
+		`DO $$
+		BEGIN
+			ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'users_role_fkey') THEN
+				ALTER TABLE users ADD CONSTRAINT users_role_fkey
+					FOREIGN KEY (role) REFERENCES roles(name) ON UPDATE CASCADE;
+			END IF;
+		END $$;`,
+
+		// Two-factor authentication and account lockout
+		`ALTER TABLE roles ADD COLUMN IF NOT EXISTS require_2fa BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_login_attempts INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_failed_login TIMESTAMP`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS user_recovery_codes (
+			id SERIAL PRIMARY KEY,
+			username VARCHAR(50) NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+			code_hash CHAR(64) NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_recovery_codes_username ON user_recovery_codes(username)`,
+
+		// Database-backed sessions; token holds the SHA-256 of the session
+		// token, never the token itself
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip_address VARCHAR(45)`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions(username)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)`,
+
 		// Drop unique constraints on route_assignments to allow multiple routes per driver/bus
 		`ALTER TABLE route_assignments DROP CONSTRAINT IF EXISTS route_assignments_driver_route_id_key`,
 		`ALTER TABLE route_assignments DROP CONSTRAINT IF EXISTS route_assignments_bus_id_route_id_key`,
@@ -1038,6 +1142,571 @@ func runMigrations() error {
 			uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_emergency_attachments_alert ON emergency_attachments(alert_id)`,
+
+		// Audit log. Each entry's hash covers the previous entry's hash, so
+		// editing or deleting a row breaks the chain; the trigger stops the
+		// application doing either by accident.
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			occurred_at TIMESTAMPTZ NOT NULL,
+			actor VARCHAR(50) NOT NULL,
+			action VARCHAR(30) NOT NULL,
+			entity_type VARCHAR(50) NOT NULL,
+			entity_id VARCHAR(100) NOT NULL,
+			changes TEXT NOT NULL DEFAULT '{}',
+			ip_address VARCHAR(45),
+			prev_hash VARCHAR(64) NOT NULL,
+			hash CHAR(64) NOT NULL
+		)`,
+		// CHAR(64) padded the genesis entry's empty prev_hash with spaces,
+		// which broke its hash on read-back; the cast back to VARCHAR trims it
+		`ALTER TABLE audit_log ALTER COLUMN prev_hash TYPE VARCHAR(64)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity_type, entity_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_occurred_at ON audit_log(occurred_at)`,
+		`CREATE OR REPLACE FUNCTION audit_log_append_only()
+		RETURNS TRIGGER AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log`,
+		`CREATE TRIGGER audit_log_append_only
+		BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW
+		EXECUTE FUNCTION audit_log_append_only()`,
+
+		// Driver licences and certifications, one current record of each
+		// type per driver. Renewals overwrite; the audit log keeps history.
+		`CREATE TABLE IF NOT EXISTS driver_credentials (
+			id SERIAL PRIMARY KEY,
+			username VARCHAR(50) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+			credential_type VARCHAR(30) NOT NULL,
+			credential_number VARCHAR(50) NOT NULL DEFAULT '',
+			cdl_class CHAR(1),
+			endorsements VARCHAR(20) NOT NULL DEFAULT '',
+			issued_on DATE,
+			expires_on DATE,
+			notes TEXT NOT NULL DEFAULT '',
+			expiry_notified_on DATE,
+			updated_by VARCHAR(50),
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(username, credential_type)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_driver_credentials_expires_on ON driver_credentials(expires_on)`,
+
+		// Scanned certificates live in the database so they survive redeploys
+		`CREATE TABLE IF NOT EXISTS driver_credential_documents (
+			credential_id INTEGER PRIMARY KEY REFERENCES driver_credentials(id) ON DELETE CASCADE,
+			file_name VARCHAR(255) NOT NULL,
+			content_type VARCHAR(100) NOT NULL,
+			content BYTEA NOT NULL,
+			uploaded_by VARCHAR(50),
+			uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// What the district assignment planner weighs besides credentials
+		`ALTER TABLE buses ADD COLUMN IF NOT EXISTS wheelchair_lift BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE routes ADD COLUMN IF NOT EXISTS needs_wheelchair_lift BOOLEAN NOT NULL DEFAULT false`,
+		`CREATE TABLE IF NOT EXISTS driver_route_preferences (
+			username VARCHAR(50) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+			route_id VARCHAR(50) NOT NULL REFERENCES routes(route_id) ON DELETE CASCADE,
+			preference SMALLINT NOT NULL CHECK (preference IN (-1, 1)),
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (username, route_id)
+		)`,
+
+		// Where student addresses are, so routes can be optimized offline
+		`CREATE TABLE IF NOT EXISTS geocoded_addresses (
+			address_key VARCHAR(255) PRIMARY KEY,
+			address TEXT NOT NULL,
+			latitude DOUBLE PRECISION NOT NULL,
+			longitude DOUBLE PRECISION NOT NULL,
+			source VARCHAR(50) NOT NULL, -- manual, or the geocoder that found it
+			updated_by VARCHAR(50),
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// One attendance ledger for every way attendance is taken
+		`CREATE TABLE IF NOT EXISTS attendance_ledger (
+			id SERIAL PRIMARY KEY,
+			student_id VARCHAR(50) NOT NULL REFERENCES students(student_id) ON DELETE CASCADE,
+			date DATE NOT NULL,
+			period VARCHAR(20) NOT NULL CHECK (period IN ('morning', 'afternoon')),
+			route_id VARCHAR(50),
+			status VARCHAR(20) NOT NULL CHECK (status IN ('present', 'absent', 'excused', 'late')),
+			boarded_at TIMESTAMP,
+			boarded_stop VARCHAR(255),
+			boarded_latitude DOUBLE PRECISION,
+			boarded_longitude DOUBLE PRECISION,
+			alighted_at TIMESTAMP,
+			alighted_stop VARCHAR(255),
+			alighted_latitude DOUBLE PRECISION,
+			alighted_longitude DOUBLE PRECISION,
+			source VARCHAR(20) NOT NULL CHECK (source IN ('web', 'mobile', 'rfid')),
+			recorded_by VARCHAR(50),
+			notes TEXT NOT NULL DEFAULT '',
+			driver_log_id INTEGER REFERENCES driver_logs(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(student_id, date, period)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_attendance_ledger_date ON attendance_ledger(date, route_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_attendance_ledger_driver_log ON attendance_ledger(driver_log_id)`,
+
+		// Move attendance saved with driver logs into the ledger, once. The
+		// blobs are keyed by seat position, and only the students on the
+		// route now are known, so a log moves only when every position
+		// names exactly one student who was on file by the log's date and
+		// whose route or seat hasn't been changed since. The rest keep their
+		// blob and are marked unresolved for someone to enter by hand.
+		// Ledger rows an earlier, looser pass wrote for those logs are taken
+		// back unless they've been edited since.
+		`ALTER TABLE driver_logs ADD COLUMN IF NOT EXISTS attendance_migrated_at TIMESTAMP`,
+		`ALTER TABLE driver_logs ADD COLUMN IF NOT EXISTS attendance_unresolved BOOLEAN`,
+		`DO $$
+		BEGIN
+			CREATE TEMP TABLE attendance_blob ON COMMIT DROP AS
+			SELECT dl.id AS log_id, dl.date, dl.period, dl.route_id, dl.driver, dl.created_at,
+				dl.attendance_migrated_at AS migrated_at, a,
+				ARRAY(
+					SELECT s.student_id FROM students s
+					WHERE s.route_id = dl.route_id AND s.position_number::text = a->>'position'
+						AND s.created_at::date <= dl.date
+						AND NOT EXISTS (
+							SELECT 1 FROM audit_log al
+							WHERE al.entity_type = 'student' AND al.entity_id = s.student_id
+								AND al.occurred_at::date >= dl.date
+								AND (al.changes LIKE '%"position_number"%' OR al.changes LIKE '%"route_id"%'))
+				) AS matches
+			FROM driver_logs dl
+			CROSS JOIN LATERAL jsonb_array_elements(
+				CASE WHEN jsonb_typeof(dl.attendance) = 'array' THEN dl.attendance ELSE '[]'::jsonb END) a
+			WHERE dl.attendance_unresolved IS NULL;
+
+			CREATE TEMP TABLE attendance_unresolved_logs ON COMMIT DROP AS
+			SELECT log_id FROM attendance_blob WHERE cardinality(matches) <> 1
+			UNION
+			SELECT log_id FROM attendance_blob GROUP BY log_id
+			HAVING COUNT(*) <> COUNT(DISTINCT a->>'position');
+
+			DELETE FROM attendance_ledger al
+			USING driver_logs dl
+			WHERE al.driver_log_id = dl.id
+				AND dl.id IN (SELECT log_id FROM attendance_unresolved_logs)
+				AND al.created_at = dl.attendance_migrated_at
+				AND al.updated_at = al.created_at;
+
+			INSERT INTO attendance_ledger (student_id, date, period, route_id, status,
+				boarded_at, alighted_at, source, recorded_by, driver_log_id)
+			SELECT DISTINCT ON (b.matches[1], b.date, b.period)
+				b.matches[1], b.date, b.period, b.route_id,
+				CASE WHEN b.a->>'present' = 'true' THEN 'present' ELSE 'absent' END,
+				CASE WHEN b.period = 'morning' AND b.a->>'present' = 'true' AND b.a->>'pickup_time' ~ '^\d{1,2}:\d{2}$'
+					THEN b.date + (b.a->>'pickup_time')::time END,
+				CASE WHEN b.period = 'afternoon' AND b.a->>'present' = 'true' AND b.a->>'pickup_time' ~ '^\d{1,2}:\d{2}$'
+					THEN b.date + (b.a->>'pickup_time')::time END,
+				'web', b.driver, b.log_id
+			FROM attendance_blob b
+			WHERE b.migrated_at IS NULL
+				AND b.log_id NOT IN (SELECT log_id FROM attendance_unresolved_logs)
+			ORDER BY b.matches[1], b.date, b.period, b.created_at DESC
+			ON CONFLICT (student_id, date, period) DO NOTHING;
+
+			UPDATE driver_logs SET
+				attendance_unresolved = id IN (SELECT log_id FROM attendance_unresolved_logs),
+				attendance_migrated_at = CASE WHEN id IN (SELECT log_id FROM attendance_unresolved_logs)
+					THEN NULL ELSE COALESCE(attendance_migrated_at, CURRENT_TIMESTAMP) END
+			WHERE attendance_unresolved IS NULL AND jsonb_typeof(attendance) = 'array';
+		END $$`,
+
+		// The mobile app's table is folded in too; it had no period, so
+		// the time of day decides
+		`DO $$
+		BEGIN
+			IF to_regclass('student_attendance') IS NOT NULL THEN
+				INSERT INTO attendance_ledger (student_id, date, period, route_id, status,
+					boarded_at, alighted_at, source, recorded_by, notes)
+				SELECT sa.student_id, sa.attendance_date,
+					CASE WHEN COALESCE(sa.boarded_at, sa.dropped_at) >= TIME '12:00' THEN 'afternoon' ELSE 'morning' END,
+					s.route_id, sa.status,
+					sa.attendance_date + sa.boarded_at, sa.attendance_date + sa.dropped_at,
+					'mobile', sa.recorded_by, COALESCE(sa.notes, '')
+				FROM student_attendance sa
+				JOIN students s ON s.student_id = sa.student_id
+				ON CONFLICT (student_id, date, period) DO NOTHING;
+
+				ALTER TABLE student_attendance RENAME TO student_attendance_migrated;
+			END IF;
+		END $$`,
+
+		// Card readers on buses, the student cards they read, every scan
+		// as received, and the wrong-bus, wrong-stop and missed-scan alerts
+		// raised from them
+		`CREATE TABLE IF NOT EXISTS rfid_readers (
+			reader_id VARCHAR(50) PRIMARY KEY,
+			name VARCHAR(100) NOT NULL DEFAULT '',
+			bus_id VARCHAR(50) REFERENCES buses(bus_id) ON DELETE SET NULL,
+			key_hash VARCHAR(64) NOT NULL UNIQUE,
+			active BOOLEAN NOT NULL DEFAULT true,
+			last_seen_at TIMESTAMP,
+			created_by VARCHAR(50),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS student_cards (
+			card_uid VARCHAR(32) PRIMARY KEY,
+			student_id VARCHAR(50) NOT NULL REFERENCES students(student_id) ON DELETE CASCADE,
+			active BOOLEAN NOT NULL DEFAULT true,
+			issued_by VARCHAR(50),
+			issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_student_cards_student ON student_cards(student_id) WHERE active`,
+
+		`CREATE TABLE IF NOT EXISTS rfid_scans (
+			id SERIAL PRIMARY KEY,
+			reader_id VARCHAR(50) NOT NULL REFERENCES rfid_readers(reader_id) ON DELETE CASCADE,
+			card_uid VARCHAR(32) NOT NULL,
+			bus_id VARCHAR(50),
+			scanned_at TIMESTAMP NOT NULL,
+			latitude DOUBLE PRECISION,
+			longitude DOUBLE PRECISION,
+			student_id VARCHAR(50) REFERENCES students(student_id) ON DELETE SET NULL,
+			result VARCHAR(20) NOT NULL DEFAULT 'pending',
+			received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(reader_id, card_uid, scanned_at)
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_rfid_scans_scanned ON rfid_scans(scanned_at DESC)`,
+
+		`CREATE TABLE IF NOT EXISTS ridership_alerts (
+			id SERIAL PRIMARY KEY,
+			alert_type VARCHAR(20) NOT NULL CHECK (alert_type IN ('wrong_bus', 'wrong_stop', 'missed_scan')),
+			student_id VARCHAR(50) NOT NULL REFERENCES students(student_id) ON DELETE CASCADE,
+			date DATE NOT NULL,
+			period VARCHAR(20) NOT NULL CHECK (period IN ('morning', 'afternoon')),
+			bus_id VARCHAR(50),
+			route_id VARCHAR(50),
+			scan_id INTEGER REFERENCES rfid_scans(id) ON DELETE SET NULL,
+			message TEXT NOT NULL,
+			latitude DOUBLE PRECISION,
+			longitude DOUBLE PRECISION,
+			acknowledged_by VARCHAR(50),
+			acknowledged_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(alert_type, student_id, date, period)
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_ridership_alerts_open ON ridership_alerts(created_at DESC) WHERE acknowledged_at IS NULL`,
+
+		// School calendar. School 0 is the district calendar; other ids are
+		// school geofences, whose entries override the district's.
+		`CREATE TABLE IF NOT EXISTS calendar_days (
+			id SERIAL PRIMARY KEY,
+			school_id INTEGER NOT NULL DEFAULT 0,
+			date DATE NOT NULL,
+			day_type VARCHAR(20) NOT NULL CHECK (day_type IN ('school_day', 'no_school', 'early_release', 'late_start', 'closure')),
+			name VARCHAR(255) NOT NULL DEFAULT '',
+			shift_minutes INTEGER NOT NULL DEFAULT 0 CHECK (shift_minutes BETWEEN 0 AND 480),
+			source VARCHAR(20) NOT NULL DEFAULT 'manual',
+			ics_uid VARCHAR(255),
+			created_by VARCHAR(50),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(school_id, date)
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_calendar_days_date ON calendar_days(date)`,
+
+		`ALTER TABLE routes ADD COLUMN IF NOT EXISTS school_id INTEGER`,
+
+		// Maintenance work orders. A hold takes the vehicle out of service
+		// until the repair passes inspection; held_status is what it goes
+		// back to.
+		`CREATE TABLE IF NOT EXISTS work_orders (
+			id SERIAL PRIMARY KEY,
+			vehicle_id VARCHAR(50) NOT NULL,
+			title VARCHAR(255) NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			category VARCHAR(50) NOT NULL DEFAULT 'repair',
+			priority VARCHAR(20) NOT NULL DEFAULT 'normal' CHECK (priority IN ('low', 'normal', 'high', 'critical')),
+			status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'assigned', 'in_progress', 'awaiting_parts', 'completed', 'inspected', 'cancelled')),
+			source VARCHAR(20) NOT NULL DEFAULT 'manual' CHECK (source IN ('manual', 'issue', 'alert', 'inspection')),
+			issue_id INTEGER,
+			inspection_id INTEGER,
+			alert_item VARCHAR(100),
+			assigned_to VARCHAR(50),
+			vendor VARCHAR(100),
+			hold BOOLEAN NOT NULL DEFAULT false,
+			held_status VARCHAR(20),
+			mileage INTEGER,
+			maintenance_record_id INTEGER,
+			created_by VARCHAR(50),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			completed_by VARCHAR(50),
+			completed_at TIMESTAMP,
+			inspected_by VARCHAR(50),
+			inspected_at TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_work_orders_vehicle ON work_orders(vehicle_id, status)`,
+
+		`CREATE TABLE IF NOT EXISTS work_order_lines (
+			id SERIAL PRIMARY KEY,
+			work_order_id INTEGER NOT NULL REFERENCES work_orders(id) ON DELETE CASCADE,
+			line_type VARCHAR(10) NOT NULL CHECK (line_type IN ('labor', 'part')),
+			description VARCHAR(255) NOT NULL,
+			part_number VARCHAR(100) NOT NULL DEFAULT '',
+			quantity NUMERIC(10,2) NOT NULL CHECK (quantity > 0),
+			unit_cost NUMERIC(10,2) NOT NULL DEFAULT 0 CHECK (unit_cost >= 0),
+			added_by VARCHAR(50),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_work_order_lines_order ON work_order_lines(work_order_id)`,
+
+		`CREATE TABLE IF NOT EXISTS work_order_events (
+			id SERIAL PRIMARY KEY,
+			work_order_id INTEGER NOT NULL REFERENCES work_orders(id) ON DELETE CASCADE,
+			from_status VARCHAR(20),
+			to_status VARCHAR(20) NOT NULL,
+			actor VARCHAR(50) NOT NULL,
+			notes TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_work_order_events_order ON work_order_events(work_order_id)`,
+
+		// Parts catalog and stockroom. part_movements is the ledger;
+		// part_stock holds what it adds up to at each location.
+		`CREATE TABLE IF NOT EXISTS parts (
+			id SERIAL PRIMARY KEY,
+			part_number VARCHAR(100) NOT NULL UNIQUE,
+			name VARCHAR(255) NOT NULL,
+			vendor VARCHAR(100),
+			unit_cost NUMERIC(10,2) NOT NULL DEFAULT 0 CHECK (unit_cost >= 0),
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS part_fitments (
+			part_id INTEGER NOT NULL REFERENCES parts(id) ON DELETE CASCADE,
+			make VARCHAR(100) NOT NULL DEFAULT '',
+			model VARCHAR(100) NOT NULL DEFAULT '',
+			PRIMARY KEY (part_id, make, model)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS stock_locations (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL UNIQUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`INSERT INTO stock_locations (name) VALUES ('Main Shop') ON CONFLICT (name) DO NOTHING`,
+
+		`CREATE TABLE IF NOT EXISTS part_stock (
+			part_id INTEGER NOT NULL REFERENCES parts(id) ON DELETE CASCADE,
+			location_id INTEGER NOT NULL REFERENCES stock_locations(id) ON DELETE CASCADE,
+			on_hand NUMERIC(10,2) NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+			reorder_point NUMERIC(10,2) NOT NULL DEFAULT 0,
+			reorder_quantity NUMERIC(10,2) NOT NULL DEFAULT 0,
+			bin VARCHAR(50) NOT NULL DEFAULT '',
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (part_id, location_id)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS part_movements (
+			id SERIAL PRIMARY KEY,
+			part_id INTEGER NOT NULL REFERENCES parts(id),
+			location_id INTEGER NOT NULL REFERENCES stock_locations(id),
+			movement VARCHAR(20) NOT NULL CHECK (movement IN ('receive', 'consume', 'return', 'adjust', 'transfer')),
+			quantity NUMERIC(10,2) NOT NULL,
+			unit_cost NUMERIC(10,2) NOT NULL DEFAULT 0,
+			vehicle_id VARCHAR(50),
+			work_order_id INTEGER,
+			work_order_line_id INTEGER,
+			maintenance_record_id INTEGER,
+			notes TEXT NOT NULL DEFAULT '',
+			actor VARCHAR(50) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_part_movements_part ON part_movements(part_id, created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_part_movements_record ON part_movements(maintenance_record_id) WHERE maintenance_record_id IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_part_movements_work_order ON part_movements(work_order_id) WHERE work_order_id IS NOT NULL`,
+
+		// A part line drawn from the stockroom remembers where it came
+		// from, so removing it puts the part back
+		`ALTER TABLE work_order_lines ADD COLUMN IF NOT EXISTS part_id INTEGER REFERENCES parts(id)`,
+		`ALTER TABLE work_order_lines ADD COLUMN IF NOT EXISTS location_id INTEGER REFERENCES stock_locations(id)`,
+
+		// Preventive maintenance programs. Each one applies to a class of
+		// vehicle (and optionally a model) and falls due on whichever of its
+		// mileage, engine hours or calendar intervals comes first.
+		`CREATE TABLE IF NOT EXISTS pm_programs (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL UNIQUE,
+			description TEXT NOT NULL DEFAULT '',
+			vehicle_class VARCHAR(20) NOT NULL DEFAULT '' CHECK (vehicle_class IN ('', 'bus', 'vehicle')),
+			model_match VARCHAR(100) NOT NULL DEFAULT '',
+			category VARCHAR(50) NOT NULL DEFAULT 'inspection' CHECK (category IN ('oil_change', 'tire_service', 'inspection', 'repair', 'other')),
+			interval_miles INTEGER NOT NULL DEFAULT 0 CHECK (interval_miles >= 0),
+			interval_hours INTEGER NOT NULL DEFAULT 0 CHECK (interval_hours >= 0),
+			interval_days INTEGER NOT NULL DEFAULT 0 CHECK (interval_days >= 0),
+			warn_miles INTEGER NOT NULL DEFAULT 0 CHECK (warn_miles >= 0),
+			warn_hours INTEGER NOT NULL DEFAULT 0 CHECK (warn_hours >= 0),
+			warn_days INTEGER NOT NULL DEFAULT 0 CHECK (warn_days >= 0),
+			auto_work_order BOOLEAN NOT NULL DEFAULT false,
+			active BOOLEAN NOT NULL DEFAULT true,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			CHECK (interval_miles > 0 OR interval_hours > 0 OR interval_days > 0)
+		)`,
+
+		// Start from the intervals the app used to have built in; the
+		// calendar ones are there to be switched on
+		`INSERT INTO pm_programs (name, vehicle_class, category, interval_miles, warn_miles, interval_days, warn_days, active)
+		SELECT * FROM (VALUES
+			('Oil & Filter Change', '', 'oil_change', 5000, 500, 0, 0, true),
+			('Tire Service', '', 'tire_service', 40000, 5000, 0, 0, true),
+			('Annual State Inspection', 'bus', 'inspection', 0, 0, 365, 30, false),
+			('Brake Check', 'bus', 'inspection', 0, 0, 90, 14, false)
+		) AS v(name, vehicle_class, category, interval_miles, warn_miles, interval_days, warn_days, active)
+		WHERE NOT EXISTS (SELECT 1 FROM pm_programs)`,
+
+		// When each vehicle last had each program done
+		`CREATE TABLE IF NOT EXISTS pm_services (
+			vehicle_id VARCHAR(50) NOT NULL,
+			program_id INTEGER NOT NULL REFERENCES pm_programs(id) ON DELETE CASCADE,
+			last_miles INTEGER,
+			last_hours INTEGER,
+			last_date DATE,
+			work_order_id INTEGER,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (vehicle_id, program_id)
+		)`,
+
+		`ALTER TABLE buses ADD COLUMN IF NOT EXISTS engine_hours INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE vehicles ADD COLUMN IF NOT EXISTS engine_hours INTEGER NOT NULL DEFAULT 0`,
+
+		// Typed columns the service record normalizer fills from the raw
+		// unnamed_* cells, which stay as they were imported
+		`ALTER TABLE service_records
+			ADD COLUMN IF NOT EXISTS vehicle_number VARCHAR(50),
+			ADD COLUMN IF NOT EXISTS vehicle_description VARCHAR(255),
+			ADD COLUMN IF NOT EXISTS location VARCHAR(100),
+			ADD COLUMN IF NOT EXISTS vehicle_year INTEGER,
+			ADD COLUMN IF NOT EXISTS serviced_mileage INTEGER,
+			ADD COLUMN IF NOT EXISTS current_mileage INTEGER,
+			ADD COLUMN IF NOT EXISTS service_due_mileage INTEGER,
+			ADD COLUMN IF NOT EXISTS miles_to_service INTEGER,
+			ADD COLUMN IF NOT EXISTS service_interval INTEGER,
+			ADD COLUMN IF NOT EXISTS needs_service BOOLEAN,
+			ADD COLUMN IF NOT EXISTS service_date DATE,
+			ADD COLUMN IF NOT EXISTS sheet_id INTEGER,
+			ADD COLUMN IF NOT EXISTS layout TEXT,
+			ADD COLUMN IF NOT EXISTS normalize_status VARCHAR(20) NOT NULL DEFAULT 'pending'
+				CHECK (normalize_status IN ('pending', 'mapped', 'unmapped', 'header', 'blank')),
+			ADD COLUMN IF NOT EXISTS normalize_notes TEXT,
+			ADD COLUMN IF NOT EXISTS normalized_at TIMESTAMP`,
+		`CREATE INDEX IF NOT EXISTS idx_service_records_vehicle ON service_records(vehicle_id, service_date DESC)`,
+
+		// Fuel card statements. Each provider's mapping names the statement
+		// header for each field; "A + B" joins columns.
+		`CREATE TABLE IF NOT EXISTS fuel_card_providers (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL UNIQUE,
+			date_column VARCHAR(100) NOT NULL,
+			time_column VARCHAR(100) NOT NULL DEFAULT '',
+			card_column VARCHAR(100) NOT NULL DEFAULT '',
+			vehicle_column VARCHAR(100) NOT NULL DEFAULT '',
+			gallons_column VARCHAR(100) NOT NULL,
+			amount_column VARCHAR(100) NOT NULL DEFAULT '',
+			price_column VARCHAR(100) NOT NULL DEFAULT '',
+			odometer_column VARCHAR(100) NOT NULL DEFAULT '',
+			location_column VARCHAR(200) NOT NULL DEFAULT '',
+			driver_column VARCHAR(100) NOT NULL DEFAULT '',
+			reference_column VARCHAR(100) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			CHECK (card_column <> '' OR vehicle_column <> '')
+		)`,
+
+		// Starting mappings; statement layouts vary with how the account
+		// is set up, so these are meant to be edited
+		`INSERT INTO fuel_card_providers (name, date_column, time_column, card_column, vehicle_column,
+			gallons_column, amount_column, price_column, odometer_column, location_column, driver_column, reference_column)
+		SELECT * FROM (VALUES
+			('Generic CSV', 'Date', 'Time', 'Card Number', 'Vehicle', 'Gallons', 'Amount', 'Price', 'Odometer', 'Location', 'Driver', 'Transaction ID'),
+			('WEX', 'Transaction Date', 'Transaction Time', 'Card Number', 'Vehicle Description', 'Units', 'Net Cost', 'Unit Cost', 'Current Odometer', 'Merchant Name + Merchant City + Merchant State', 'Driver Last Name', 'Transaction Number'),
+			('Voyager', 'Transaction Date', 'Transaction Time', 'Card Number', 'Vehicle Number', 'Quantity', 'Total Amount', 'Unit Price', 'Odometer', 'Merchant Name + Merchant City + Merchant State', 'Driver ID', 'Reference Number'),
+			('Fuelman', 'Date', 'Time', 'Card', 'Vehicle ID', 'Gallons', 'Total', 'Price Per Gallon', 'Odometer', 'Site Name + City + State', 'Driver', 'Transaction ID')
+		) AS v(name, date_column, time_column, card_column, vehicle_column,
+			gallons_column, amount_column, price_column, odometer_column, location_column, driver_column, reference_column)
+		WHERE NOT EXISTS (SELECT 1 FROM fuel_card_providers)`,
+
+		// Which vehicle each card is issued to. Numbers are kept as digits;
+		// the last few are enough when that's all the office has.
+		`CREATE TABLE IF NOT EXISTS fuel_cards (
+			card_number VARCHAR(50) PRIMARY KEY,
+			vehicle_id VARCHAR(50) NOT NULL,
+			provider_id INTEGER REFERENCES fuel_card_providers(id) ON DELETE SET NULL,
+			notes TEXT NOT NULL DEFAULT '',
+			active BOOLEAN NOT NULL DEFAULT true,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS fuel_card_imports (
+			id SERIAL PRIMARY KEY,
+			provider_id INTEGER REFERENCES fuel_card_providers(id) ON DELETE SET NULL,
+			filename VARCHAR(255) NOT NULL DEFAULT '',
+			period_start DATE,
+			period_end DATE,
+			rows_read INTEGER NOT NULL DEFAULT 0,
+			imported INTEGER NOT NULL DEFAULT 0,
+			already_imported INTEGER NOT NULL DEFAULT 0,
+			skipped INTEGER NOT NULL DEFAULT 0,
+			flagged INTEGER NOT NULL DEFAULT 0,
+			imported_by VARCHAR(50),
+			imported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// One line of a statement. raw keeps the line as it came, by header.
+		`CREATE TABLE IF NOT EXISTS fuel_card_transactions (
+			id SERIAL PRIMARY KEY,
+			import_id INTEGER NOT NULL REFERENCES fuel_card_imports(id) ON DELETE CASCADE,
+			provider_id INTEGER,
+			reference VARCHAR(100) NOT NULL DEFAULT '',
+			card_number VARCHAR(50) NOT NULL DEFAULT '',
+			vehicle_number VARCHAR(50) NOT NULL DEFAULT '',
+			vehicle_id VARCHAR(50),
+			transacted_at TIMESTAMP NOT NULL,
+			has_time BOOLEAN NOT NULL DEFAULT false,
+			gallons NUMERIC(10,3) NOT NULL,
+			amount NUMERIC(10,2),
+			price_per_gallon NUMERIC(10,3),
+			odometer INTEGER,
+			location VARCHAR(255) NOT NULL DEFAULT '',
+			driver VARCHAR(100) NOT NULL DEFAULT '',
+			fuel_record_id INTEGER,
+			mpg NUMERIC(8,2),
+			flags TEXT[] NOT NULL DEFAULT '{}',
+			flag_notes TEXT NOT NULL DEFAULT '',
+			reviewed_by VARCHAR(50),
+			reviewed_at TIMESTAMP,
+			review_note TEXT NOT NULL DEFAULT '',
+			raw JSONB,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_fuel_card_transactions_vehicle ON fuel_card_transactions(vehicle_id, transacted_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_fuel_card_transactions_import ON fuel_card_transactions(import_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_fuel_card_transactions_reference ON fuel_card_transactions(provider_id, reference) WHERE reference <> ''`,
+
+		`ALTER TABLE buses ADD COLUMN IF NOT EXISTS tank_capacity NUMERIC(6,1)`,
+		`ALTER TABLE vehicles ADD COLUMN IF NOT EXISTS tank_capacity NUMERIC(6,1)`,
 	}
 
 	for i, migration := range migrations {
@@ -282,7 +282,7 @@ func dbHealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 // dbPoolMonitorHandler renders the database pool monitoring page
 func dbPoolMonitorHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -9,7 +9,7 @@ import (
 // debugDataHandler provides a debug endpoint to check database data
 func debugDataHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
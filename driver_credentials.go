@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Credential types a driver can hold
+const (
+	CredentialCDL          = "cdl"
+	CredentialMedicalCard  = "medical_card"
+	CredentialFirstAidCPR  = "first_aid_cpr"
+	CredentialSpecialNeeds = "special_needs_training"
+	CredentialDrugTest     = "drug_test"
+)
+
+// credentialExpiryWarningDays is how far ahead an expiry starts to warn
+const credentialExpiryWarningDays = 30
+
+// cdlCapacityThreshold: buses seating more than this need a CDL driver
+const cdlCapacityThreshold = 15
+
+// schoolBusEndorsements are the CDL endorsements required to drive a
+// school bus: P (passenger) and S (school bus)
+const schoolBusEndorsements = "PS"
+
+// CredentialType describes one kind of credential for the registry
+type CredentialType struct {
+	Name        string
+	Label       string
+	Description string
+}
+
+var credentialTypes = []CredentialType{
+	{CredentialCDL, "CDL", "Commercial driver's licence, with class and endorsements"},
+	{CredentialMedicalCard, "DOT Medical Card", "Medical examiner's certificate"},
+	{CredentialDrugTest, "Drug & Alcohol Test", "Most recent test; expiry is when the next one is due"},
+	{CredentialFirstAidCPR, "First Aid / CPR", "First aid and CPR certification"},
+	{CredentialSpecialNeeds, "Special Needs Training", "Training to transport students with disabilities"},
+}
+
+// credentialLabel returns the display name for a credential type
+func credentialLabel(credentialType string) string {
+	for _, t := range credentialTypes {
+		if t.Name == credentialType {
+			return t.Label
+		}
+	}
+	return credentialType
+}
+
+func isCredentialType(name string) bool {
+	for _, t := range credentialTypes {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DriverCredential is a driver's current record of one credential type
+type DriverCredential struct {
+	ID             int            `db:"id"`
+	Username       string         `db:"username"`
+	CredentialType string         `db:"credential_type"`
+	Number         string         `db:"credential_number"`
+	CDLClass       sql.NullString `db:"cdl_class"`
+	Endorsements   string         `db:"endorsements"`
+	IssuedOn       sql.NullTime   `db:"issued_on"`
+	ExpiresOn      sql.NullTime   `db:"expires_on"`
+	Notes          string         `db:"notes"`
+	UpdatedBy      sql.NullString `db:"updated_by"`
+	UpdatedAt      sql.NullTime   `db:"updated_at"`
+	DocumentName   sql.NullString `db:"document_name"`
+}
+
+// Credential statuses
+const (
+	CredentialMissing  = "missing"
+	CredentialExpired  = "expired"
+	CredentialExpiring = "expiring"
+	CredentialValid    = "valid"
+)
+
+// Status classifies the credential as of the given day. A credential
+// with no expiry date never expires.
+func (c *DriverCredential) Status(today time.Time) string {
+	if c == nil {
+		return CredentialMissing
+	}
+	if !c.ExpiresOn.Valid {
+		return CredentialValid
+	}
+	days := c.DaysLeft(today)
+	switch {
+	case days < 0:
+		return CredentialExpired
+	case days <= credentialExpiryWarningDays:
+		return CredentialExpiring
+	}
+	return CredentialValid
+}
+
+// DaysLeft is the number of days until the credential expires; negative
+// once it has. Expiry dates are inclusive, so it is 0 on the last valid day.
+func (c *DriverCredential) DaysLeft(today time.Time) int {
+	if c == nil || !c.ExpiresOn.Valid {
+		return 0
+	}
+	y, m, d := today.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	y, m, d = c.ExpiresOn.Time.Date()
+	end := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return int(end.Sub(start).Hours() / 24)
+}
+
+// HasEndorsement reports whether a CDL carries the endorsement letter
+func (c *DriverCredential) HasEndorsement(letter string) bool {
+	return c != nil && strings.Contains(strings.ToUpper(c.Endorsements), strings.ToUpper(letter))
+}
+
+// normalizeEndorsements keeps the distinct endorsement letters, in a
+// fixed order, so "s, p" and "PS" are stored alike
+func normalizeEndorsements(input string) string {
+	var letters []string
+	for _, letter := range []string{"H", "N", "P", "S", "T", "X"} {
+		if strings.Contains(strings.ToUpper(input), letter) {
+			letters = append(letters, letter)
+		}
+	}
+	return strings.Join(letters, "")
+}
+
+const driverCredentialColumns = `
+	c.id, c.username, c.credential_type, c.credential_number, c.cdl_class,
+	c.endorsements, c.issued_on, c.expires_on, c.notes, c.updated_by, c.updated_at,
+	d.file_name AS document_name`
+
+// getDriverCredentials returns a driver's credentials keyed by type
+func getDriverCredentials(username string) (map[string]*DriverCredential, error) {
+	var credentials []DriverCredential
+	err := db.Select(&credentials, `
+		SELECT `+driverCredentialColumns+`
+		FROM driver_credentials c
+		LEFT JOIN driver_credential_documents d ON d.credential_id = c.id
+		WHERE c.username = $1
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+
+	byType := make(map[string]*DriverCredential, len(credentials))
+	for i := range credentials {
+		byType[credentials[i].CredentialType] = &credentials[i]
+	}
+	return byType, nil
+}
+
+// getAllDriverCredentials returns every driver's credentials, keyed by
+// username and then type
+func getAllDriverCredentials() (map[string]map[string]*DriverCredential, error) {
+	var credentials []DriverCredential
+	err := db.Select(&credentials, `
+		SELECT `+driverCredentialColumns+`
+		FROM driver_credentials c
+		LEFT JOIN driver_credential_documents d ON d.credential_id = c.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	byDriver := make(map[string]map[string]*DriverCredential)
+	for i := range credentials {
+		c := &credentials[i]
+		if byDriver[c.Username] == nil {
+			byDriver[c.Username] = make(map[string]*DriverCredential)
+		}
+		byDriver[c.Username][c.CredentialType] = c
+	}
+	return byDriver, nil
+}
+
+// saveDriverCredential creates or replaces a driver's credential of one
+// type and returns its ID. Changing the expiry date re-arms the expiry
+// reminder.
+func saveDriverCredential(c DriverCredential, updatedBy string) (int, error) {
+	var id int
+	err := db.Get(&id, `
+		INSERT INTO driver_credentials (username, credential_type, credential_number, cdl_class,
+			endorsements, issued_on, expires_on, notes, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, CURRENT_TIMESTAMP)
+		ON CONFLICT (username, credential_type) DO UPDATE SET
+			credential_number = EXCLUDED.credential_number,
+			cdl_class = EXCLUDED.cdl_class,
+			endorsements = EXCLUDED.endorsements,
+			issued_on = EXCLUDED.issued_on,
+			expires_on = EXCLUDED.expires_on,
+			notes = EXCLUDED.notes,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = EXCLUDED.updated_at,
+			expiry_notified_on = CASE
+				WHEN driver_credentials.expires_on IS DISTINCT FROM EXCLUDED.expires_on THEN NULL
+				ELSE driver_credentials.expiry_notified_on
+			END
+		RETURNING id
+	`, c.Username, c.CredentialType, c.Number, c.CDLClass, c.Endorsements,
+		c.IssuedOn, c.ExpiresOn, c.Notes, updatedBy)
+	return id, err
+}
+
+// saveCredentialDocument stores the scanned certificate for a credential,
+// replacing any earlier one
+func saveCredentialDocument(credentialID int, fileName, contentType string, content []byte, uploadedBy string) error {
+	_, err := db.Exec(`
+		INSERT INTO driver_credential_documents (credential_id, file_name, content_type, content, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (credential_id) DO UPDATE SET
+			file_name = EXCLUDED.file_name,
+			content_type = EXCLUDED.content_type,
+			content = EXCLUDED.content,
+			uploaded_by = EXCLUDED.uploaded_by,
+			uploaded_at = CURRENT_TIMESTAMP
+	`, credentialID, fileName, contentType, content, uploadedBy)
+	return err
+}
+
+// routeHasSpecialNeedsStudents reports whether any ECSE student who needs
+// transport rides the route, matched by route ID or name
+func routeHasSpecialNeedsStudents(routeID string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, `
+		SELECT EXISTS(
+			SELECT 1 FROM ecse_students e
+			JOIN routes r ON e.bus_route IN (r.route_id, r.route_name)
+			WHERE r.route_id = $1 AND e.transportation_required = true
+		)
+	`, routeID)
+	return exists, err
+}
+
+// busNeedsCDL reports whether driving the bus takes a CDL. A bus whose
+// capacity isn't recorded is assumed to need one.
+func busNeedsCDL(busID string) (bool, error) {
+	var capacity sql.NullInt64
+	err := db.Get(&capacity, `SELECT capacity FROM buses WHERE bus_id = $1`, busID)
+	if err == sql.ErrNoRows {
+		// Fleet vehicles aren't in buses and are driven on a regular licence
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !capacity.Valid || capacity.Int64 > cdlCapacityThreshold, nil
+}
+
+// evaluateDriverQualifications checks a driver's credentials against what
+// the bus and route call for. Anything that would make the assignment
+// unlawful is an error; credentials about to lapse are warnings.
+func evaluateDriverQualifications(credentials map[string]*DriverCredential, needsCDL, specialNeeds bool, today time.Time) []RouteConflict {
+	var required, recommended []string
+	if needsCDL {
+		required = append(required, CredentialCDL, CredentialMedicalCard, CredentialDrugTest)
+	}
+	if specialNeeds {
+		required = append(required, CredentialSpecialNeeds)
+	}
+	recommended = append(recommended, CredentialFirstAidCPR)
+
+	var issues []RouteConflict
+	check := func(credentialType, severity string) {
+		c := credentials[credentialType]
+		label := credentialLabel(credentialType)
+		details := map[string]interface{}{"credential": credentialType}
+		if c != nil && c.ExpiresOn.Valid {
+			details["expires_on"] = c.ExpiresOn.Time.Format("2006-01-02")
+		}
+
+		switch c.Status(today) {
+		case CredentialMissing:
+			issues = append(issues, RouteConflict{
+				Type:        "credential_missing",
+				Description: fmt.Sprintf("Driver has no %s on file", label),
+				Severity:    severity,
+				Details:     details,
+			})
+		case CredentialExpired:
+			issues = append(issues, RouteConflict{
+				Type:        "credential_expired",
+				Description: fmt.Sprintf("Driver's %s expired on %s", label, c.ExpiresOn.Time.Format("Jan 2, 2006")),
+				Severity:    severity,
+				Details:     details,
+			})
+		case CredentialExpiring:
+			issues = append(issues, RouteConflict{
+				Type:        "credential_expiring",
+				Description: fmt.Sprintf("Driver's %s expires on %s", label, c.ExpiresOn.Time.Format("Jan 2, 2006")),
+				Severity:    "warning",
+				Details:     details,
+			})
+		}
+	}
+
+	for _, credentialType := range required {
+		check(credentialType, "error")
+	}
+	for _, credentialType := range recommended {
+		check(credentialType, "warning")
+	}
+
+	if cdl := credentials[CredentialCDL]; needsCDL && cdl.Status(today) != CredentialMissing {
+		for _, letter := range strings.Split(schoolBusEndorsements, "") {
+			if !cdl.HasEndorsement(letter) {
+				issues = append(issues, RouteConflict{
+					Type:        "endorsement_missing",
+					Description: fmt.Sprintf("Driver's CDL lacks the %s endorsement needed for a school bus", letter),
+					Severity:    "error",
+					Details:     map[string]interface{}{"endorsement": letter, "endorsements": cdl.Endorsements},
+				})
+			}
+		}
+	}
+
+	return issues
+}
+
+// splitConflicts separates blocking conflicts from warnings
+func splitConflicts(conflicts []RouteConflict) (blocking, warnings []RouteConflict) {
+	for _, c := range conflicts {
+		if c.Severity == "error" {
+			blocking = append(blocking, c)
+		} else {
+			warnings = append(warnings, c)
+		}
+	}
+	return blocking, warnings
+}
+
+// describeConflicts joins conflict descriptions into one message
+func describeConflicts(conflicts []RouteConflict) string {
+	descriptions := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		descriptions[i] = c.Description
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// driverQualificationProblems checks a driver against the bus and each
+// route, returning the problems that block the assignment and any
+// warnings. An error means the check couldn't be made and the assignment
+// must not go ahead.
+func driverQualificationProblems(driver, busID string, routeIDs ...string) (blocking, warnings []RouteConflict, err error) {
+	seen := make(map[string]bool)
+	for _, routeID := range routeIDs {
+		conflicts, err := checkDriverQualifications(driver, busID, routeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		routeBlocking, routeWarnings := splitConflicts(conflicts)
+		for _, c := range routeBlocking {
+			if !seen[c.Description] {
+				seen[c.Description] = true
+				blocking = append(blocking, c)
+			}
+		}
+		for _, c := range routeWarnings {
+			if !seen[c.Description] {
+				seen[c.Description] = true
+				warnings = append(warnings, c)
+			}
+		}
+	}
+	return blocking, warnings, nil
+}
+
+// CredentialExpiry is a credential due for an expiry reminder
+type CredentialExpiry struct {
+	ID             int       `db:"id"`
+	Username       string    `db:"username"`
+	CredentialType string    `db:"credential_type"`
+	ExpiresOn      time.Time `db:"expires_on"`
+}
+
+// getCredentialsDueForReminder returns credentials of active users that
+// expire within the warning window (or already have) and haven't been
+// reminded about in the last week
+func getCredentialsDueForReminder() ([]CredentialExpiry, error) {
+	var due []CredentialExpiry
+	err := db.Select(&due, `
+		SELECT c.id, c.username, c.credential_type, c.expires_on
+		FROM driver_credentials c
+		JOIN users u ON u.username = c.username
+		WHERE u.status = 'active'
+		AND c.expires_on IS NOT NULL
+		AND c.expires_on <= CURRENT_DATE + $1::int
+		AND (c.expiry_notified_on IS NULL OR c.expiry_notified_on <= CURRENT_DATE - 7)
+		ORDER BY c.expires_on
+	`, credentialExpiryWarningDays)
+	return due, err
+}
+
+func markCredentialReminded(id int) error {
+	_, err := db.Exec(`UPDATE driver_credentials SET expiry_notified_on = CURRENT_DATE WHERE id = $1`, id)
+	return err
+}
@@ -35,6 +35,7 @@ type ScoreCategory struct {
 	Weight   float64 `json:"weight"`
 	Grade    string  `json:"grade"`
 	Details  string  `json:"details"`
+	NoData   bool    `json:"no_data,omitempty"` // nothing to score; left out of the overall
 }
 
 // Achievement represents a driver achievement
@@ -58,6 +59,7 @@ type DriverStats struct {
 	SafetyViolations   int
 	RouteCompletions   int
 	StudentCount       int
+	ScheduledTrips     int
 }
 
 // ScorecardService handles driver scorecard generation
@@ -154,13 +156,17 @@ func (ss *ScorecardService) gatherDriverStats(driver string, startDate, endDate
 		log.Printf("Error getting student count: %v", err)
 	}
 
-	// Get attendance accuracy (simplified - counts students marked present)
+	// Get attendance accuracy: the share of trips with attendance taken,
+	// by any means, for the route and run
 	var totalAttendance, accurateAttendance int
 	err = ss.db.QueryRow(`
 		SELECT COUNT(*) as total,
-		       COUNT(CASE WHEN attendance IS NOT NULL THEN 1 END) as recorded
-		FROM driver_logs
-		WHERE driver = $1 AND date BETWEEN $2 AND $3
+		       COUNT(CASE WHEN EXISTS (
+		           SELECT 1 FROM attendance_ledger al
+		           WHERE al.route_id = dl.route_id AND al.date = dl.date AND al.period = dl.period
+		       ) THEN 1 END) as recorded
+		FROM driver_logs dl
+		WHERE dl.driver = $1 AND dl.date BETWEEN $2 AND $3
 	`, driver, startDate, endDate).Scan(&totalAttendance, &accurateAttendance)
 	if err == nil && totalAttendance > 0 {
 		stats.AttendanceAccuracy = float64(accurateAttendance) / float64(totalAttendance) * 100
@@ -207,6 +213,23 @@ func (ss *ScorecardService) gatherDriverStats(driver string, startDate, endDate
 	// Calculate route completions
 	stats.RouteCompletions = stats.OnTimeTrips
 
+	// Scheduled trips: a morning and an afternoon run on each day the
+	// driver's routes ran, up to today
+	var routes []string
+	err = ss.db.Select(&routes, `SELECT route_id FROM route_assignments WHERE driver = $1`, driver)
+	if err != nil {
+		log.Printf("Error getting driver routes: %v", err)
+	}
+	if until := time.Now(); len(routes) > 0 && !startDate.After(until) {
+		if endDate.Before(until) {
+			until = endDate
+		}
+		cal := serviceCalendarFor(startDate, until)
+		for _, route := range routes {
+			stats.ScheduledTrips += 2 * cal.RouteServiceDays(route, startDate, until)
+		}
+	}
+
 	return stats, nil
 }
 
@@ -310,16 +333,25 @@ func (ss *ScorecardService) calculateEfficiencyScore(stats *DriverStats) ScoreCa
 }
 
 func (ss *ScorecardService) calculateReliabilityScore(stats *DriverStats) ScoreCategory {
-	score := 100.0
+	// Without trips the school calendar says should have run there is
+	// nothing to measure against, which isn't the same as a perfect record
+	if stats.ScheduledTrips == 0 {
+		return ScoreCategory{
+			Name:     "Reliability",
+			MaxScore: 100,
+			Grade:    "N/A",
+			Details:  "No trips scheduled in this period",
+			NoData:   true,
+		}
+	}
 
-	// Calculate expected trips (rough estimate)
-	expectedTrips := 20 // Assume 20 trips per month minimum
-	if stats.TotalTrips < expectedTrips {
-		score = float64(stats.TotalTrips) / float64(expectedTrips) * 100
+	score := 100.0
+	if stats.TotalTrips < stats.ScheduledTrips {
+		score = float64(stats.TotalTrips) / float64(stats.ScheduledTrips) * 100
 	}
 
-	details := fmt.Sprintf("Trips completed: %d, Students managed: %d",
-		stats.TotalTrips, stats.StudentCount)
+	details := fmt.Sprintf("Trips completed: %d of %d scheduled, Students managed: %d",
+		stats.TotalTrips, stats.ScheduledTrips, stats.StudentCount)
 
 	return ScoreCategory{
 		Name:     "Reliability",
@@ -409,7 +441,7 @@ func (ss *ScorecardService) generateRecommendations(categories []ScoreCategory)
 	recommendations := []string{}
 
 	for _, cat := range categories {
-		if cat.Score < 70 {
+		if cat.Score < 70 && !cat.NoData {
 			switch cat.Name {
 			case "Safety":
 				recommendations = append(recommendations, "Focus on defensive driving techniques and safety protocols")
@@ -536,8 +568,8 @@ func driverScorecardHandler(w http.ResponseWriter, r *http.Request) {
 	// Get driver parameter
 	driver := r.URL.Query().Get("driver")
 	if driver == "" {
-		// Default to current user if driver
-		if user.Role == "driver" {
+		// Default to current user if they can only see their own
+		if !hasPermission(user, PermDriversView) {
 			driver = user.Username
 		} else {
 			http.Error(w, "Driver parameter required", http.StatusBadRequest)
@@ -546,7 +578,7 @@ func driverScorecardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check permissions
-	if user.Role == "driver" && driver != user.Username {
+	if driver != user.Username && !hasPermission(user, PermDriversView) {
 		http.Error(w, "Cannot view other driver scorecards", http.StatusForbidden)
 		return
 	}
@@ -583,7 +615,7 @@ func driverScorecardHandler(w http.ResponseWriter, r *http.Request) {
 // allDriverScorecardsHandler returns scorecards for all drivers (manager only)
 func allDriverScorecardsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDriversView) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ETA confidence levels
+const (
+	ETAConfidenceHigh   = "high"
+	ETAConfidenceMedium = "medium"
+	ETAConfidenceLow    = "low"
+)
+
+// ETA estimate sources, from most to least trusted
+const (
+	ETASourceHistorical = "historical"
+	ETASourceSchedule   = "schedule"
+	ETASourceSpeed      = "speed"
+)
+
+// StopETA is the predicted arrival at a single planned stop
+type StopETA struct {
+	StopNumber     int       `json:"stop_number"`
+	Name           string    `json:"name"`
+	Latitude       float64   `json:"latitude"`
+	Longitude      float64   `json:"longitude"`
+	ETA            time.Time `json:"eta"`
+	EarliestETA    time.Time `json:"earliest_eta"`
+	LatestETA      time.Time `json:"latest_eta"`
+	MinutesAway    int       `json:"minutes_away"`
+	DistanceMeters float64   `json:"distance_meters"` // along the planned path
+	Confidence     string    `json:"confidence"`
+	Source         string    `json:"source"`
+	Completed      bool      `json:"completed"`
+}
+
+// RouteETA holds per-stop predictions for a bus running a route
+type RouteETA struct {
+	RouteID         string       `json:"route_id"`
+	VehicleID       string       `json:"vehicle_id"`
+	Period          string       `json:"period"`
+	CurrentLocation *GPSLocation `json:"current_location,omitempty"`
+	NextStopIndex   int          `json:"next_stop_index"`
+	OffRouteMeters  float64      `json:"off_route_meters"`
+	Stops           []StopETA    `json:"stops"`
+	GeneratedAt     time.Time    `json:"generated_at"`
+}
+
+// NextStop returns the first stop the bus has not yet reached
+func (re *RouteETA) NextStop() *StopETA {
+	if re == nil || re.NextStopIndex < 0 || re.NextStopIndex >= len(re.Stops) {
+		return nil
+	}
+	return &re.Stops[re.NextStopIndex]
+}
+
+// StopsRemaining returns how many stops are still ahead of the bus
+func (re *RouteETA) StopsRemaining() int {
+	if re == nil || re.NextStopIndex < 0 {
+		return 0
+	}
+	return len(re.Stops) - re.NextStopIndex
+}
+
+// FindStop returns the prediction for a stop number
+func (re *RouteETA) FindStop(stopNumber int) *StopETA {
+	if re == nil {
+		return nil
+	}
+	for i := range re.Stops {
+		if re.Stops[i].StopNumber == stopNumber {
+			return &re.Stops[i]
+		}
+	}
+	return nil
+}
+
+// segmentStats summarizes historical travel times from one stop to the next
+type segmentStats struct {
+	Samples int
+	Median  time.Duration
+	Low     time.Duration // 15th percentile
+	High    time.Duration // 85th percentile
+}
+
+// ETAEngine predicts stop arrivals from the route plan and segment history
+type ETAEngine struct {
+	mu            sync.RWMutex
+	cache         map[string]cachedSegments
+	cacheTTL      time.Duration
+	historyDays   int
+	hourWindow    int     // +/- hours around the current time of day
+	defaultSpeed  float64 // km/h when nothing better is known
+	minSamples    int
+	arrivalRadius float64 // meters, used when a stop has no radius
+}
+
+type cachedSegments struct {
+	stats    []segmentStats
+	loadedAt time.Time
+}
+
+var etaEngine *ETAEngine
+
+// InitializeETAEngine sets up the route-based ETA engine
+func InitializeETAEngine() error {
+	etaEngine = NewETAEngine()
+
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	// Segment history queries filter gps_locations by route and time
+	if _, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_gps_locations_route_timestamp
+		ON gps_locations(route_id, timestamp)
+	`); err != nil {
+		return fmt.Errorf("failed to create ETA index: %w", err)
+	}
+
+	log.Println("ETA engine initialized")
+	return nil
+}
+
+// NewETAEngine creates an ETA engine with default tuning
+func NewETAEngine() *ETAEngine {
+	return &ETAEngine{
+		cache:         make(map[string]cachedSegments),
+		cacheTTL:      30 * time.Minute,
+		historyDays:   28,
+		hourWindow:    1,
+		defaultSpeed:  40, // ~25 mph
+		minSamples:    3,
+		arrivalRadius: 50,
+	}
+}
+
+// getETAEngine returns the shared engine, creating one lazily if needed
+func getETAEngine() *ETAEngine {
+	if etaEngine == nil {
+		etaEngine = NewETAEngine()
+	}
+	return etaEngine
+}
+
+// periodForTime maps a clock time to the driver_logs period
+func periodForTime(t time.Time) string {
+	if t.Hour() < 12 {
+		return "morning"
+	}
+	return "afternoon"
+}
+
+// CalculateVehicleETA predicts arrivals for a vehicle on its current route
+func (e *ETAEngine) CalculateVehicleETA(vehicleID, routeID string) (*RouteETA, error) {
+	location, err := e.latestLocation(vehicleID)
+	if err != nil {
+		return nil, err
+	}
+	if location == nil {
+		return nil, fmt.Errorf("no GPS position for vehicle %s", vehicleID)
+	}
+
+	if routeID == "" {
+		routeID = location.RouteID
+	}
+	if routeID == "" {
+		routeID = getVehicleRouteID(vehicleID)
+	}
+	if routeID == "" {
+		return nil, fmt.Errorf("vehicle %s is not assigned to a route", vehicleID)
+	}
+
+	return e.CalculateRouteETA(routeID, location)
+}
+
+// CalculateRouteETA projects a position onto a route plan and predicts each stop
+func (e *ETAEngine) CalculateRouteETA(routeID string, location *GPSLocation) (*RouteETA, error) {
+	stops, err := loadRoutePlan(routeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load route plan: %w", err)
+	}
+	if len(stops) == 0 {
+		return nil, fmt.Errorf("route %s has no planned stops", routeID)
+	}
+
+	now := time.Now()
+	if location.Timestamp.IsZero() {
+		location.Timestamp = now
+	}
+	period := periodForTime(now)
+
+	result := &RouteETA{
+		RouteID:         routeID,
+		VehicleID:       location.VehicleID,
+		Period:          period,
+		CurrentLocation: location,
+		GeneratedAt:     now,
+		Stops:           make([]StopETA, len(stops)),
+	}
+
+	// Find where the bus sits on the planned path
+	segIndex, fraction, offRoute := projectOntoRoute(stops, location.Latitude, location.Longitude)
+	result.OffRouteMeters = offRoute
+
+	// nextStop is the first stop still ahead of the bus
+	nextStop := segIndex + 1
+	result.NextStopIndex = nextStop
+
+	history := e.segmentHistory(routeID, period, now)
+
+	// Cumulative prediction: median plus low/high band
+	var elapsed, low, high time.Duration
+	var distance float64
+	confidence := ETAConfidenceHigh
+	source := ETASourceHistorical
+
+	// A bus off the planned path has to get back to it first; widen the
+	// late edge of the band by roughly a minute per kilometer off route
+	if offRoute > 200 {
+		high += time.Duration(offRoute/1000*60) * time.Second
+	}
+
+	for i, stop := range stops {
+		result.Stops[i] = StopETA{
+			StopNumber: stop.StopNumber,
+			Name:       stop.Name,
+			Latitude:   stop.Latitude,
+			Longitude:  stop.Longitude,
+		}
+
+		if i < nextStop {
+			result.Stops[i].Completed = true
+			continue
+		}
+
+		var legMedian, legLow, legHigh time.Duration
+		var legSource string
+		var legDistance float64
+
+		if i == nextStop {
+			// Partial leg from the bus to the next stop
+			legDistance = calculateDistance(location.Latitude, location.Longitude, stop.Latitude, stop.Longitude)
+			if i > 0 {
+				seg := e.segmentEstimate(stops, history, i-1, location.Speed)
+				remaining := 1 - math.Max(0, math.Min(1, fraction))
+				legMedian = scaleDuration(seg.median, remaining)
+				legLow = scaleDuration(seg.low, remaining)
+				legHigh = scaleDuration(seg.high, remaining)
+				legSource = seg.source
+			} else {
+				legMedian, legLow, legHigh = e.speedEstimate(legDistance, location.Speed)
+				legSource = ETASourceSpeed
+			}
+		} else {
+			seg := e.segmentEstimate(stops, history, i-1, 0)
+			legDistance = calculateDistance(stops[i-1].Latitude, stops[i-1].Longitude, stop.Latitude, stop.Longitude)
+			legMedian, legLow, legHigh = seg.median, seg.low, seg.high
+			legSource = seg.source
+		}
+
+		elapsed += legMedian
+		low += legLow
+		high += legHigh
+		distance += legDistance
+		source = weakerETASource(source, legSource)
+		confidence = etaConfidence(source, history, nextStop-1, i)
+		if offRoute > 200 {
+			confidence = ETAConfidenceLow
+		}
+
+		eta := location.Timestamp.Add(elapsed)
+		if eta.Before(now) {
+			eta = now
+		}
+		result.Stops[i].ETA = eta
+		result.Stops[i].EarliestETA = location.Timestamp.Add(low)
+		result.Stops[i].LatestETA = location.Timestamp.Add(high)
+		result.Stops[i].MinutesAway = int(math.Round(eta.Sub(now).Minutes()))
+		result.Stops[i].DistanceMeters = distance
+		result.Stops[i].Confidence = confidence
+		result.Stops[i].Source = source
+	}
+
+	return result, nil
+}
+
+// latestLocation prefers the live tracker and falls back to the SSE table
+func (e *ETAEngine) latestLocation(vehicleID string) (*GPSLocation, error) {
+	if gpsTracker != nil {
+		loc, err := gpsTracker.GetLatestLocation(vehicleID)
+		if err == nil && loc != nil {
+			return loc, nil
+		}
+	}
+
+	var loc GPSLocation
+	var routeID sql.NullString
+	err := db.QueryRow(`
+		SELECT vehicle_id, latitude, longitude, speed, heading, route_id, timestamp
+		FROM gps_tracking
+		WHERE vehicle_id = $1
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`, vehicleID).Scan(&loc.VehicleID, &loc.Latitude, &loc.Longitude,
+		&loc.Speed, &loc.Heading, &routeID, &loc.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	loc.RouteID = routeID.String
+	return &loc, nil
+}
+
+// legEstimate is a travel-time prediction for one stop-to-stop segment
+type legEstimate struct {
+	median time.Duration
+	low    time.Duration
+	high   time.Duration
+	source string
+}
+
+// segmentEstimate picks the best available prediction for segment i -> i+1
+func (e *ETAEngine) segmentEstimate(stops []RouteStop, history []segmentStats, i int, currentSpeed float64) legEstimate {
+	if i < len(history) && history[i].Samples >= e.minSamples {
+		h := history[i]
+		return legEstimate{median: h.Median, low: h.Low, high: h.High, source: ETASourceHistorical}
+	}
+
+	// Fall back to the planned timetable when both stops have times
+	from, to := stops[i], stops[i+1]
+	if !from.DepartureTime.IsZero() && !to.ArrivalTime.IsZero() {
+		planned := clockDiff(from.DepartureTime, to.ArrivalTime)
+		if planned > 0 {
+			return legEstimate{
+				median: planned,
+				low:    scaleDuration(planned, 0.8),
+				high:   scaleDuration(planned, 1.25),
+				source: ETASourceSchedule,
+			}
+		}
+	}
+
+	distance := calculateDistance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	median, low, high := e.speedEstimate(distance, currentSpeed)
+	return legEstimate{median: median, low: low, high: high, source: ETASourceSpeed}
+}
+
+// speedEstimate converts a distance into travel time using the bus speed
+func (e *ETAEngine) speedEstimate(distanceMeters, currentSpeed float64) (time.Duration, time.Duration, time.Duration) {
+	speed := currentSpeed
+	if speed < 8 {
+		speed = e.defaultSpeed
+	}
+	hours := (distanceMeters / 1000) / speed
+	median := time.Duration(hours * float64(time.Hour))
+	return median, scaleDuration(median, 0.7), scaleDuration(median, 1.5)
+}
+
+// segmentHistory returns cached per-segment stats for a route, period and hour
+func (e *ETAEngine) segmentHistory(routeID, period string, now time.Time) []segmentStats {
+	key := fmt.Sprintf("%s|%s|%d", routeID, period, now.Hour())
+
+	e.mu.RLock()
+	cached, ok := e.cache[key]
+	e.mu.RUnlock()
+	if ok && time.Since(cached.loadedAt) < e.cacheTTL {
+		return cached.stats
+	}
+
+	stats, err := e.loadSegmentHistory(routeID, period, now)
+	if err != nil {
+		log.Printf("ETA: failed to load segment history for route %s: %v", routeID, err)
+	}
+
+	e.mu.Lock()
+	e.cache[key] = cachedSegments{stats: stats, loadedAt: time.Now()}
+	e.mu.Unlock()
+
+	return stats
+}
+
+// InvalidateRoute drops cached history after a route plan changes
+func (e *ETAEngine) InvalidateRoute(routeID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prefix := routeID + "|"
+	for key := range e.cache {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			delete(e.cache, key)
+		}
+	}
+}
+
+// loadSegmentHistory measures stop-to-stop times from past gps_locations runs
+func (e *ETAEngine) loadSegmentHistory(routeID, period string, now time.Time) ([]segmentStats, error) {
+	stops, err := loadRoutePlan(routeID)
+	if err != nil || len(stops) < 2 {
+		return nil, err
+	}
+
+	startHour, endHour := 0, 12
+	if period == "afternoon" {
+		startHour, endHour = 12, 24
+	}
+
+	rows, err := db.Query(`
+		SELECT vehicle_id, latitude, longitude, timestamp
+		FROM gps_locations
+		WHERE route_id = $1
+		  AND timestamp > NOW() - ($2 * INTERVAL '1 day')
+		  AND timestamp::date < CURRENT_DATE
+		  AND EXTRACT(HOUR FROM timestamp) >= $3
+		  AND EXTRACT(HOUR FROM timestamp) < $4
+		ORDER BY vehicle_id, timestamp
+	`, routeID, e.historyDays, startHour, endHour)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Group points into runs: one vehicle on one day
+	type point struct {
+		lat, lng float64
+		at       time.Time
+	}
+	runs := make(map[string][]point)
+	for rows.Next() {
+		var vehicleID string
+		var p point
+		if err := rows.Scan(&vehicleID, &p.lat, &p.lng, &p.at); err != nil {
+			continue
+		}
+		runKey := vehicleID + "|" + p.at.Format(DateFormat)
+		runs[runKey] = append(runs[runKey], p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	all := make([][]time.Duration, len(stops)-1)
+	nearHour := make([][]time.Duration, len(stops)-1)
+
+	for _, points := range runs {
+		// First time the bus entered each stop's radius, in stop order
+		arrivals := make([]time.Time, len(stops))
+		next := 0
+		for _, p := range points {
+			for k := next; k < len(stops); k++ {
+				radius := stops[k].StopRadius
+				if radius <= 0 {
+					radius = e.arrivalRadius
+				}
+				if calculateDistance(p.lat, p.lng, stops[k].Latitude, stops[k].Longitude) <= radius {
+					arrivals[k] = p.at
+					next = k + 1
+					break
+				}
+			}
+			if next >= len(stops) {
+				break
+			}
+		}
+
+		for k := 0; k < len(stops)-1; k++ {
+			if arrivals[k].IsZero() || arrivals[k+1].IsZero() {
+				continue
+			}
+			d := arrivals[k+1].Sub(arrivals[k])
+			if d <= 0 || d > 2*time.Hour {
+				continue
+			}
+			all[k] = append(all[k], d)
+			if hourDistance(arrivals[k].Hour(), now.Hour()) <= e.hourWindow {
+				nearHour[k] = append(nearHour[k], d)
+			}
+		}
+	}
+
+	stats := make([]segmentStats, len(stops)-1)
+	for k := range stats {
+		// Prefer runs at this time of day; fall back to the whole period
+		samples := nearHour[k]
+		if len(samples) < e.minSamples {
+			samples = all[k]
+		}
+		stats[k] = summarizeDurations(samples)
+	}
+
+	return stats, nil
+}
+
+// summarizeDurations computes median and a 15/85 percentile band
+func summarizeDurations(samples []time.Duration) segmentStats {
+	if len(samples) == 0 {
+		return segmentStats{}
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return segmentStats{
+		Samples: len(sorted),
+		Median:  percentileDuration(sorted, 0.5),
+		Low:     percentileDuration(sorted, 0.15),
+		High:    percentileDuration(sorted, 0.85),
+	}
+}
+
+// percentileDuration returns the p-th percentile of a sorted slice
+func percentileDuration(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Round(p * float64(len(sorted)-1)))
+	return sorted[idx]
+}
+
+// projectOntoRoute finds the planned segment closest to a position.
+// It returns the index of the segment's first stop, how far along the
+// segment the position lies (0..1) and the distance off the path in meters.
+// A segment index of -1 means the bus has not yet reached the first stop.
+func projectOntoRoute(stops []RouteStop, lat, lng float64) (int, float64, float64) {
+	if len(stops) == 1 {
+		return -1, 0, calculateDistance(lat, lng, stops[0].Latitude, stops[0].Longitude)
+	}
+
+	bestSeg, bestFraction, bestDist := -1, 0.0, math.MaxFloat64
+	for i := 0; i < len(stops)-1; i++ {
+		fraction, dist := projectOntoSegment(
+			lat, lng,
+			stops[i].Latitude, stops[i].Longitude,
+			stops[i+1].Latitude, stops[i+1].Longitude,
+		)
+		if dist < bestDist {
+			bestSeg, bestFraction, bestDist = i, fraction, dist
+		}
+	}
+
+	// Closest to the start of the first segment: the bus is still approaching stop 1
+	if bestSeg == 0 && bestFraction <= 0 {
+		return -1, 0, bestDist
+	}
+
+	return bestSeg, bestFraction, bestDist
+}
+
+// projectOntoSegment projects a point onto segment A-B using a local planar
+// approximation, returning the clamped fraction along A-B and the distance
+func projectOntoSegment(lat, lng, aLat, aLng, bLat, bLng float64) (float64, float64) {
+	metersPerDegLat := 111320.0
+	metersPerDegLng := 111320.0 * math.Cos(aLat*math.Pi/180)
+
+	px := (lng - aLng) * metersPerDegLng
+	py := (lat - aLat) * metersPerDegLat
+	bx := (bLng - aLng) * metersPerDegLng
+	by := (bLat - aLat) * metersPerDegLat
+
+	lengthSq := bx*bx + by*by
+	if lengthSq == 0 {
+		return 0, math.Hypot(px, py)
+	}
+
+	t := (px*bx + py*by) / lengthSq
+	t = math.Max(0, math.Min(1, t))
+
+	dx := px - t*bx
+	dy := py - t*by
+	return t, math.Hypot(dx, dy)
+}
+
+// etaConfidence rates a prediction by its weakest source and sample depth.
+// Only the segments still ahead count: from the one the bus is on, first,
+// to the one ending at stopIndex.
+func etaConfidence(source string, history []segmentStats, first, stopIndex int) string {
+	switch source {
+	case ETASourceHistorical:
+		minSamples := math.MaxInt32
+		for k := max(first, 0); k < stopIndex && k < len(history); k++ {
+			if history[k].Samples < minSamples {
+				minSamples = history[k].Samples
+			}
+		}
+		if minSamples >= 10 {
+			return ETAConfidenceHigh
+		}
+		return ETAConfidenceMedium
+	case ETASourceSchedule:
+		return ETAConfidenceMedium
+	default:
+		return ETAConfidenceLow
+	}
+}
+
+// weakerETASource returns the less trusted of two estimate sources
+func weakerETASource(a, b string) string {
+	rank := map[string]int{ETASourceHistorical: 0, ETASourceSchedule: 1, ETASourceSpeed: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// clockDiff returns the time between two TIME-of-day values
+func clockDiff(from, to time.Time) time.Duration {
+	fromSecs := from.Hour()*3600 + from.Minute()*60 + from.Second()
+	toSecs := to.Hour()*3600 + to.Minute()*60 + to.Second()
+	return time.Duration(toSecs-fromSecs) * time.Second
+}
+
+func scaleDuration(d time.Duration, factor float64) time.Duration {
+	return time.Duration(float64(d) * factor)
+}
+
+func hourDistance(a, b int) int {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	if d > 12 {
+		d = 24 - d
+	}
+	return d
+}
+
+// getVehicleRouteID looks up the route currently assigned to a bus
+func getVehicleRouteID(vehicleID string) string {
+	var routeID string
+	err := db.QueryRow(`
+		SELECT route_id FROM route_assignments
+		WHERE bus_id = $1
+		ORDER BY assigned_date DESC
+		LIMIT 1
+	`, vehicleID).Scan(&routeID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("ETA: failed to look up route for vehicle %s: %v", vehicleID, err)
+	}
+	return routeID
+}
+
+// StudentStop returns the prediction for a student's planned stop, matched
+// by position number, or nil if the student has no stop on the route.
+func (re *RouteETA) StudentStop(studentID string) *StopETA {
+	if re == nil || len(re.Stops) == 0 {
+		return nil
+	}
+
+	var position sql.NullInt64
+	db.QueryRow(`SELECT position_number FROM students WHERE student_id = $1`, studentID).Scan(&position)
+	if !position.Valid {
+		return nil
+	}
+	return re.FindStop(int(position.Int64))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/csv"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/xuri/excelize/v2"
@@ -325,6 +326,9 @@ func generateMileageExport(format string) ([]byte, string, error) {
 
 	// Generate export
 	exportMileageData(mockWriter, nil, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), format)
+	if err := mockWriter.failure(); err != nil {
+		return nil, "", err
+	}
 
 	filename := fmt.Sprintf("mileage_report_%s.%s", now.Format("200601"), format)
 	return buf.Bytes(), filename, nil
@@ -335,6 +339,9 @@ func generateStudentExport(format string) ([]byte, string, error) {
 	mockWriter := &mockResponseWriter{Buffer: buf}
 
 	exportStudentData(mockWriter, nil, format)
+	if err := mockWriter.failure(); err != nil {
+		return nil, "", err
+	}
 
 	filename := fmt.Sprintf("student_roster_%s.%s", time.Now().Format("20060102"), format)
 	return buf.Bytes(), filename, nil
@@ -345,6 +352,9 @@ func generateVehicleExport(format string) ([]byte, string, error) {
 	mockWriter := &mockResponseWriter{Buffer: buf}
 
 	exportVehicleData(mockWriter, nil, format)
+	if err := mockWriter.failure(); err != nil {
+		return nil, "", err
+	}
 
 	filename := fmt.Sprintf("vehicle_fleet_%s.%s", time.Now().Format("20060102"), format)
 	return buf.Bytes(), filename, nil
@@ -359,6 +369,9 @@ func generateMaintenanceExport(format string) ([]byte, string, error) {
 	mockWriter := &mockResponseWriter{Buffer: buf}
 
 	exportMaintenanceData(mockWriter, nil, startDate.Format("2006-01-02"), now.Format("2006-01-02"), format)
+	if err := mockWriter.failure(); err != nil {
+		return nil, "", err
+	}
 
 	filename := fmt.Sprintf("maintenance_records_%s.%s", now.Format("20060102"), format)
 	return buf.Bytes(), filename, nil
@@ -368,6 +381,7 @@ func generateMaintenanceExport(format string) ([]byte, string, error) {
 type mockResponseWriter struct {
 	*bytes.Buffer
 	headers http.Header
+	status  int
 }
 
 func (m *mockResponseWriter) Header() http.Header {
@@ -377,7 +391,18 @@ func (m *mockResponseWriter) Header() http.Header {
 	return m.headers
 }
 
-func (m *mockResponseWriter) WriteHeader(statusCode int) {}
+func (m *mockResponseWriter) WriteHeader(statusCode int) {
+	m.status = statusCode
+}
+
+// failure reports an error response written by the export function, so the
+// JSON error body isn't mailed out as if it were the export file.
+func (m *mockResponseWriter) failure() error {
+	if m.status < http.StatusBadRequest {
+		return nil
+	}
+	return fmt.Errorf("export failed with status %d: %s", m.status, strings.TrimSpace(m.String()))
+}
 
 // Start the scheduled export job in main.go
 func startScheduledExportsJob() {
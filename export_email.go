@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EmailAttachment is a file attached to an outgoing email
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// ErrSMTPNotConfigured is returned when no SMTP host is set
+var ErrSMTPNotConfigured = errors.New("SMTP is not configured (set SMTP_HOST and SMTP_FROM_ADDRESS)")
+
+// parseEmailRecipients splits a comma or semicolon separated address list and
+// validates every entry.
+func parseEmailRecipients(list string) ([]string, error) {
+	fields := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n'
+	})
+
+	var recipients []string
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", field, err)
+		}
+		recipients = append(recipients, addr.Address)
+	}
+	return recipients, nil
+}
+
+// attachmentContentType picks a MIME type from the file extension
+func attachmentContentType(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".xlsx":
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case ".csv":
+		return "text/csv"
+	case ".pdf":
+		return "application/pdf"
+	}
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// buildMultipartEmail renders a multipart/mixed message with a plain text body
+// followed by base64 encoded attachments.
+func buildMultipartEmail(from mail.Address, to []string, subject, body string, attachments []EmailAttachment) ([]byte, error) {
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+
+	headers := []string{
+		"From: " + from.String(),
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mw.Boundary(),
+	}
+	// The multipart writer appends to msg, so headers have to go first
+	var head bytes.Buffer
+	for _, h := range headers {
+		head.WriteString(h + "\r\n")
+	}
+	head.WriteString("\r\n")
+
+	textPart, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(textPart)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = attachmentContentType(a.Filename)
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": a.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(part, a.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return append(head.Bytes(), msg.Bytes()...), nil
+}
+
+// writeBase64Lines writes data as base64 wrapped at 76 characters (RFC 2045)
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := w.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+// sendEmailWithAttachments delivers a multipart email through the configured
+// SMTP server. Authentication is skipped when no username is set so a local
+// relay or test server works without credentials.
+func sendEmailWithAttachments(cfg EmailConfig, to []string, subject, body string, attachments []EmailAttachment) error {
+	if cfg.SMTPHost == "" || cfg.FromAddress == "" {
+		return ErrSMTPNotConfigured
+	}
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+
+	from := mail.Address{Name: cfg.FromName, Address: cfg.FromAddress}
+	msg, err := buildMultipartEmail(from, to, subject, body, attachments)
+	if err != nil {
+		return fmt.Errorf("failed to build email: %v", err)
+	}
+
+	port := cfg.SMTPPort
+	if port == "" {
+		port = "25"
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.SMTPHost)
+	}
+
+	return smtp.SendMail(cfg.SMTPHost+":"+port, auth, cfg.FromAddress, to, msg)
+}
@@ -19,12 +19,12 @@ func FixSchemaIssues() error {
 			s.name as student_name,
 			'' as grade,
 			r.route_name,
-			COUNT(CASE WHEN sa.status = 'present' THEN 1 END) as days_present,
-			COUNT(CASE WHEN sa.status = 'absent' THEN 1 END) as days_absent,
-			COUNT(CASE WHEN sa.status = 'late' THEN 1 END) as days_late,
-			COUNT(sa.attendance_date) as total_days_recorded
+			COUNT(DISTINCT CASE WHEN al.status = 'present' THEN al.date END) as days_present,
+			COUNT(DISTINCT CASE WHEN al.status = 'absent' THEN al.date END) as days_absent,
+			COUNT(DISTINCT CASE WHEN al.status = 'late' THEN al.date END) as days_late,
+			COUNT(DISTINCT al.date) as total_days_recorded
 		FROM students s
-		LEFT JOIN student_attendance sa ON s.student_id = sa.student_id
+		LEFT JOIN attendance_ledger al ON s.student_id = al.student_id
 		LEFT JOIN routes r ON s.route_id = r.route_id
 		GROUP BY s.student_id, s.name, r.route_name`,
 
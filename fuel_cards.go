@@ -0,0 +1,966 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/xuri/excelize/v2"
+)
+
+// What reconciliation can find wrong with a card transaction
+const (
+	FuelFlagNoVehicle = "no_vehicle"
+	FuelFlagNoEntry   = "no_driver_entry"
+	FuelFlagOdometer  = "odometer"
+	FuelFlagCapacity  = "over_capacity"
+	FuelFlagLocation  = "impossible_location"
+	FuelFlagTime      = "impossible_time"
+	FuelFlagMPG       = "mpg_outlier"
+	FuelFlagDuplicate = "duplicate"
+)
+
+var fuelFlagLabels = map[string]string{
+	FuelFlagNoVehicle: "No vehicle",
+	FuelFlagNoEntry:   "No driver entry",
+	FuelFlagOdometer:  "Odometer",
+	FuelFlagCapacity:  "Over tank capacity",
+	FuelFlagLocation:  "Impossible location",
+	FuelFlagTime:      "Impossible time",
+	FuelFlagMPG:       "MPG outlier",
+	FuelFlagDuplicate: "Duplicate swipe",
+}
+
+// Reconciliation tolerances
+const (
+	fuelEntryGallonSlack  = 0.05 // share of the fill a driver's entry may differ by
+	fuelOdometerSlack     = 50   // miles between the statement and the driver's entry
+	fuelDuplicateWindow   = 30 * time.Minute
+	fuelMaxSpeedKmh       = 130 // anything faster between two fills can't be driven
+	fuelGPSWindow         = 15 * time.Minute
+	fuelGPSMaxDistanceKm  = 16
+	fuelMovingSpeedKmh    = 15
+	fuelMPGLowShare       = 0.6
+	fuelMPGHighShare      = 1.5
+	fuelMPGHistoryDays    = 180
+	fuelTankCapacitySlack = 1.02
+)
+
+// fuelCardError is an import or card change that can't be made, worded
+// for whoever tried it
+type fuelCardError string
+
+func (e fuelCardError) Error() string { return string(e) }
+
+// FuelCardProvider maps a card provider's statement headers to the fields
+// an import needs
+type FuelCardProvider struct {
+	ID              int       `db:"id"`
+	Name            string    `db:"name"`
+	DateColumn      string    `db:"date_column"`
+	TimeColumn      string    `db:"time_column"`
+	CardColumn      string    `db:"card_column"`
+	VehicleColumn   string    `db:"vehicle_column"`
+	GallonsColumn   string    `db:"gallons_column"`
+	AmountColumn    string    `db:"amount_column"`
+	PriceColumn     string    `db:"price_column"`
+	OdometerColumn  string    `db:"odometer_column"`
+	LocationColumn  string    `db:"location_column"`
+	DriverColumn    string    `db:"driver_column"`
+	ReferenceColumn string    `db:"reference_column"`
+	CreatedAt       time.Time `db:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
+
+func (p FuelCardProvider) mappings() map[string]string {
+	return map[string]string{
+		"date": p.DateColumn, "time": p.TimeColumn, "card": p.CardColumn, "vehicle": p.VehicleColumn,
+		"gallons": p.GallonsColumn, "amount": p.AmountColumn, "price": p.PriceColumn,
+		"odometer": p.OdometerColumn, "location": p.LocationColumn, "driver": p.DriverColumn,
+		"reference": p.ReferenceColumn,
+	}
+}
+
+// FuelCard is a card issued to a vehicle
+type FuelCard struct {
+	CardNumber string        `db:"card_number"`
+	VehicleID  string        `db:"vehicle_id"`
+	ProviderID sql.NullInt64 `db:"provider_id"`
+	Notes      string        `db:"notes"`
+	Active     bool          `db:"active"`
+	CreatedAt  time.Time     `db:"created_at"`
+}
+
+// FuelCardImport is one statement brought in
+type FuelCardImport struct {
+	ID              int            `db:"id"`
+	ProviderID      sql.NullInt64  `db:"provider_id"`
+	ProviderName    sql.NullString `db:"provider_name"`
+	Filename        string         `db:"filename"`
+	PeriodStart     sql.NullTime   `db:"period_start"`
+	PeriodEnd       sql.NullTime   `db:"period_end"`
+	RowsRead        int            `db:"rows_read"`
+	Imported        int            `db:"imported"`
+	AlreadyImported int            `db:"already_imported"`
+	Skipped         int            `db:"skipped"`
+	Flagged         int            `db:"flagged"`
+	ImportedBy      sql.NullString `db:"imported_by"`
+	ImportedAt      time.Time      `db:"imported_at"`
+}
+
+// FuelCardTransaction is one fill on a statement and what reconciling it
+// against the fleet's own records found
+type FuelCardTransaction struct {
+	ID             int             `db:"id"`
+	ImportID       int             `db:"import_id"`
+	ProviderID     sql.NullInt64   `db:"provider_id"`
+	Reference      string          `db:"reference"`
+	CardNumber     string          `db:"card_number"`
+	VehicleNumber  string          `db:"vehicle_number"`
+	VehicleID      sql.NullString  `db:"vehicle_id"`
+	TransactedAt   time.Time       `db:"transacted_at"`
+	HasTime        bool            `db:"has_time"`
+	Gallons        float64         `db:"gallons"`
+	Amount         sql.NullFloat64 `db:"amount"`
+	PricePerGallon sql.NullFloat64 `db:"price_per_gallon"`
+	Odometer       sql.NullInt64   `db:"odometer"`
+	Location       string          `db:"location"`
+	Driver         string          `db:"driver"`
+	FuelRecordID   sql.NullInt64   `db:"fuel_record_id"`
+	MPG            sql.NullFloat64 `db:"mpg"`
+	Flags          pq.StringArray  `db:"flags"`
+	FlagNotes      string          `db:"flag_notes"`
+	ReviewedBy     sql.NullString  `db:"reviewed_by"`
+	ReviewedAt     sql.NullTime    `db:"reviewed_at"`
+	ReviewNote     string          `db:"review_note"`
+	CreatedAt      time.Time       `db:"created_at"`
+
+	raw map[string]string
+}
+
+const fuelCardTransactionColumns = `id, import_id, provider_id, reference, card_number, vehicle_number,
+	vehicle_id, transacted_at, has_time, gallons, amount, price_per_gallon, odometer, location, driver,
+	fuel_record_id, mpg, flags, flag_notes, reviewed_by, reviewed_at, review_note, created_at`
+
+// FlagLabels names the transaction's flags for display
+func (t FuelCardTransaction) FlagLabels() []string {
+	labels := make([]string, 0, len(t.Flags))
+	for _, f := range t.Flags {
+		labels = append(labels, fuelFlagLabels[f])
+	}
+	return labels
+}
+
+// When is the transaction's date, with the time when the statement gave one
+func (t FuelCardTransaction) When() string {
+	if t.HasTime {
+		return t.TransactedAt.Format("Jan 2, 2006 3:04 PM")
+	}
+	return t.TransactedAt.Format("Jan 2, 2006")
+}
+
+// readStatementRows returns every row of a CSV or XLSX statement; an XLSX
+// statement is read from its first sheet
+func readStatementRows(file io.Reader, filename string) ([][]string, error) {
+	if strings.EqualFold(filepath.Ext(filename), ".xlsx") {
+		x, err := excelize.OpenReader(file)
+		if err != nil {
+			return nil, fuelCardError("That isn't a readable XLSX file")
+		}
+		defer x.Close()
+		sheets := x.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, fuelCardError("The workbook has no sheets")
+		}
+		return x.GetRows(sheets[0])
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fuelCardError("That isn't a readable CSV file: " + err.Error())
+		}
+		// The reader drops blank lines; keep them so row numbers match the file's lines
+		line, _ := reader.FieldPos(0)
+		for len(rows) < line-1 {
+			rows = append(rows, nil)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) > 0 && len(rows[0]) > 0 {
+		rows[0][0] = strings.TrimPrefix(rows[0][0], "\ufeff")
+	}
+	return rows, nil
+}
+
+func statementHeaderKey(label string) string {
+	return strings.Join(strings.Fields(nonAlnum.ReplaceAllString(strings.ToUpper(label), " ")), " ")
+}
+
+// statementLayout is where a provider's mapped columns sit in a statement
+type statementLayout struct {
+	HeaderRow int
+	Columns   map[string][]int
+	Headers   []string
+	Missing   []string // mapped headers the statement doesn't have
+}
+
+// locateColumns finds the provider's header row, which statements often
+// put below a few lines of account details
+func (p FuelCardProvider) locateColumns(rows [][]string) (statementLayout, error) {
+	for i := 0; i < len(rows) && i < 25; i++ {
+		index := map[string]int{}
+		for c, cell := range rows[i] {
+			if key := statementHeaderKey(cell); key != "" {
+				if _, seen := index[key]; !seen {
+					index[key] = c
+				}
+			}
+		}
+		layout := statementLayout{HeaderRow: i, Columns: map[string][]int{}, Headers: rows[i]}
+		for field, mapping := range p.mappings() {
+			if strings.TrimSpace(mapping) == "" {
+				continue
+			}
+			var cols []int
+			for _, part := range strings.Split(mapping, "+") {
+				if c, ok := index[statementHeaderKey(part)]; ok {
+					cols = append(cols, c)
+				}
+			}
+			if len(cols) == 0 {
+				layout.Missing = append(layout.Missing, strings.TrimSpace(mapping))
+				continue
+			}
+			layout.Columns[field] = cols
+		}
+		has := func(field string) bool { return len(layout.Columns[field]) > 0 }
+		if has("date") && has("gallons") && (has("card") || has("vehicle")) {
+			sort.Strings(layout.Missing)
+			return layout, nil
+		}
+	}
+
+	id := p.CardColumn
+	if id == "" {
+		id = p.VehicleColumn
+	} else if p.VehicleColumn != "" {
+		id += `" or "` + p.VehicleColumn
+	}
+	return statementLayout{}, fuelCardError(fmt.Sprintf(
+		`Couldn't find a %s header row with "%s", "%s" and "%s" columns. Check the statement or the provider's column mapping.`,
+		p.Name, p.DateColumn, p.GallonsColumn, id))
+}
+
+// value reads a field from a row, joining the cells of a combined mapping
+func (l statementLayout) value(row []string, field string) string {
+	var parts []string
+	for _, c := range l.Columns[field] {
+		if c < len(row) {
+			if v := strings.TrimSpace(row[c]); v != "" {
+				parts = append(parts, v)
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseStatementNumber reads an amount as statements print it: "$1,234.50",
+// or "(12.00)" for a credit
+func parseStatementNumber(cell string) (float64, bool) {
+	s := strings.TrimSpace(cell)
+	negative := strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")
+	s = strings.NewReplacer("(", "", ")", "", "$", "", ",", "", " ", "").Replace(s)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	if negative {
+		f = -f
+	}
+	return f, true
+}
+
+var (
+	statementDateTimeLayouts = []string{
+		"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04",
+		"1/2/2006 15:04:05", "1/2/2006 15:04", "1/2/2006 3:04:05 PM", "1/2/2006 3:04 PM",
+		"1/2/06 15:04", "1/2/06 3:04 PM",
+	}
+	statementDateLayouts = []string{"01-02-06", "1-2-2006", "01-02-2006", "2006/01/02"}
+	statementTimeLayouts = []string{"15:04:05", "15:04", "3:04:05 PM", "3:04 PM", "3:04PM"}
+)
+
+// parseStatementTime reads a transaction's date and, when the statement
+// has one, its time. The date cell may carry the time itself, and an XLSX
+// cell without a date format comes through as a spreadsheet serial number.
+func parseStatementTime(date, clock string) (when time.Time, hasTime bool, ok bool) {
+	date, clock = strings.TrimSpace(date), strings.ToUpper(strings.TrimSpace(clock))
+	if fields := strings.Fields(date); clock != "" && len(fields) > 0 {
+		date = fields[0]
+	}
+	for _, layout := range statementDateTimeLayouts {
+		// Midnight on the dot is a date cell exported with a time format
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t, t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0, true
+		}
+	}
+
+	var day time.Time
+	if serial, err := strconv.ParseFloat(date, 64); err == nil && serial > 20000 && serial < 80000 {
+		days, fraction := math.Modf(serial)
+		day = time.Date(1899, 12, 30, 0, 0, 0, 0, time.Local).AddDate(0, 0, int(days))
+		if fraction > 0 && clock == "" {
+			return day.Add(time.Duration(math.Round(fraction*86400)) * time.Second), true, true
+		}
+	} else if t, found := parseSheetDate(date); found {
+		day = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	} else {
+		for _, layout := range statementDateLayouts {
+			if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+				day = t
+				break
+			}
+		}
+		if day.IsZero() {
+			return time.Time{}, false, false
+		}
+	}
+
+	for _, layout := range statementTimeLayouts {
+		if c, err := time.Parse(layout, clock); err == nil {
+			return time.Date(day.Year(), day.Month(), day.Day(), c.Hour(), c.Minute(), c.Second(), 0, time.Local), true, true
+		}
+	}
+	// Some statements print the time as HHMM
+	if n, err := strconv.Atoi(clock); err == nil && len(clock) >= 3 && len(clock) <= 4 && n/100 < 24 && n%100 < 60 {
+		return time.Date(day.Year(), day.Month(), day.Day(), n/100, n%100, 0, 0, time.Local), true, true
+	}
+	return day, false, true
+}
+
+// fuelCardKey keeps a card number's digits and mask characters, so
+// "xxxx-xxxx-1234" reads as XXXXXXXX1234
+func fuelCardKey(card string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(card) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == 'X' || r == '*':
+			b.WriteRune('X')
+		}
+	}
+	return b.String()
+}
+
+// matchFuelCard finds the vehicle a statement's card number belongs to.
+// Statements usually mask all but the last digits, and the office may only
+// have recorded those, so the trailing digits decide when they're unique.
+func matchFuelCard(cards map[string]string, card string) (string, bool) {
+	key := fuelCardKey(card)
+	if key == "" {
+		return "", false
+	}
+	if vehicleID, ok := cards[key]; ok {
+		return vehicleID, true
+	}
+	digits := key[strings.LastIndex(key, "X")+1:]
+	if len(digits) < 4 {
+		return "", false
+	}
+	found := map[string]bool{}
+	for k, vehicleID := range cards {
+		if strings.HasSuffix(k, digits) || (len(k) >= 4 && strings.HasSuffix(digits, k)) {
+			found[vehicleID] = true
+		}
+	}
+	if len(found) == 1 {
+		for vehicleID := range found {
+			return vehicleID, true
+		}
+	}
+	return "", false
+}
+
+// parseStatement reads the fuel lines below the header. Lines without fuel
+// on them, such as car washes and credits, are skipped with the reason.
+func (p FuelCardProvider) parseStatement(rows [][]string, layout statementLayout) ([]FuelCardTransaction, []string) {
+	var txns []FuelCardTransaction
+	var skipped []string
+	for i := layout.HeaderRow + 1; i < len(rows); i++ {
+		row := rows[i]
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		line := i + 1
+		when, hasTime, ok := parseStatementTime(layout.value(row, "date"), layout.value(row, "time"))
+		if !ok {
+			skipped = append(skipped, fmt.Sprintf("line %d: couldn't read the date %q", line, layout.value(row, "date")))
+			continue
+		}
+		gallons, ok := parseStatementNumber(layout.value(row, "gallons"))
+		if !ok || gallons <= 0 {
+			skipped = append(skipped, fmt.Sprintf("line %d: no fuel on this line", line))
+			continue
+		}
+
+		t := FuelCardTransaction{
+			ProviderID:    sql.NullInt64{Int64: int64(p.ID), Valid: true},
+			Reference:     truncateString(layout.value(row, "reference"), 100),
+			CardNumber:    truncateString(fuelCardKey(layout.value(row, "card")), 50),
+			VehicleNumber: truncateString(layout.value(row, "vehicle"), 50),
+			TransactedAt:  when,
+			HasTime:       hasTime,
+			Gallons:       math.Round(gallons*1000) / 1000,
+			Location:      truncateString(layout.value(row, "location"), 255),
+			Driver:        truncateString(layout.value(row, "driver"), 100),
+			raw:           map[string]string{},
+		}
+		if amount, ok := parseStatementNumber(layout.value(row, "amount")); ok {
+			t.Amount = sql.NullFloat64{Float64: amount, Valid: true}
+		}
+		if price, ok := parseStatementNumber(layout.value(row, "price")); ok && price > 0 {
+			t.PricePerGallon = sql.NullFloat64{Float64: price, Valid: true}
+		} else if t.Amount.Valid {
+			t.PricePerGallon = sql.NullFloat64{Float64: math.Round(t.Amount.Float64/gallons*1000) / 1000, Valid: true}
+		}
+		if !t.Amount.Valid && t.PricePerGallon.Valid {
+			t.Amount = sql.NullFloat64{Float64: math.Round(t.PricePerGallon.Float64*gallons*100) / 100, Valid: true}
+		}
+		if odometer, ok := parseStatementNumber(layout.value(row, "odometer")); ok && odometer > 0 {
+			t.Odometer = sql.NullInt64{Int64: int64(odometer), Valid: true}
+		}
+		for c, header := range layout.Headers {
+			if c < len(row) && strings.TrimSpace(header) != "" && strings.TrimSpace(row[c]) != "" {
+				t.raw[header] = row[c]
+			}
+		}
+		txns = append(txns, t)
+	}
+	return txns, skipped
+}
+
+// FuelCardImportResult is what an import did, for the page to report
+type FuelCardImportResult struct {
+	Import  FuelCardImport
+	Skipped []string
+	Missing []string
+}
+
+// importFuelCardStatement saves a statement's fuel lines and reconciles
+// them. Lines already brought in by an earlier import of the same
+// statement are left alone, so overlapping statements are safe to import.
+func importFuelCardStatement(p FuelCardProvider, rows [][]string, filename, username string) (*FuelCardImportResult, error) {
+	layout, err := p.locateColumns(rows)
+	if err != nil {
+		return nil, err
+	}
+	txns, skipped := p.parseStatement(rows, layout)
+	if len(txns) == 0 {
+		return nil, fuelCardError("The statement has no fuel lines")
+	}
+
+	result := &FuelCardImportResult{Skipped: skipped, Missing: layout.Missing}
+	imp := &result.Import
+	imp.Filename = truncateString(filename, 255)
+	imp.RowsRead = len(txns) + len(skipped)
+	imp.Skipped = len(skipped)
+	start, end := txns[0].TransactedAt, txns[0].TransactedAt
+	for _, t := range txns {
+		if t.TransactedAt.Before(start) {
+			start = t.TransactedAt
+		}
+		if t.TransactedAt.After(end) {
+			end = t.TransactedAt
+		}
+	}
+	imp.PeriodStart = sql.NullTime{Time: start, Valid: true}
+	imp.PeriodEnd = sql.NullTime{Time: end, Valid: true}
+
+	var ids []int
+	err = withTransaction(func(tx *sqlx.Tx) error {
+		err := tx.Get(&imp.ID, `
+			INSERT INTO fuel_card_imports (provider_id, filename, period_start, period_end, rows_read, skipped, imported_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id
+		`, p.ID, imp.Filename, start.Format("2006-01-02"), end.Format("2006-01-02"), imp.RowsRead, imp.Skipped, username)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range txns {
+			var seen bool
+			if t.Reference != "" {
+				err = tx.Get(&seen, `
+					SELECT EXISTS (SELECT 1 FROM fuel_card_transactions WHERE provider_id = $1 AND reference = $2)
+				`, p.ID, t.Reference)
+			} else {
+				err = tx.Get(&seen, `
+					SELECT EXISTS (SELECT 1 FROM fuel_card_transactions
+						WHERE provider_id = $1 AND reference = '' AND card_number = $2 AND vehicle_number = $3
+							AND transacted_at = $4 AND gallons = $5)
+				`, p.ID, t.CardNumber, t.VehicleNumber, t.TransactedAt, t.Gallons)
+			}
+			if err != nil {
+				return err
+			}
+			if seen {
+				imp.AlreadyImported++
+				continue
+			}
+
+			raw, _ := json.Marshal(t.raw)
+			var id int
+			err = tx.Get(&id, `
+				INSERT INTO fuel_card_transactions (import_id, provider_id, reference, card_number, vehicle_number,
+					transacted_at, has_time, gallons, amount, price_per_gallon, odometer, location, driver, raw)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+				RETURNING id
+			`, imp.ID, p.ID, t.Reference, t.CardNumber, t.VehicleNumber, t.TransactedAt, t.HasTime,
+				t.Gallons, t.Amount, t.PricePerGallon, t.Odometer, t.Location, t.Driver, string(raw))
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		imp.Imported = len(ids)
+		_, err = tx.Exec(`UPDATE fuel_card_imports SET imported = $2, already_imported = $3 WHERE id = $1`,
+			imp.ID, imp.Imported, imp.AlreadyImported)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save statement: %w", err)
+	}
+
+	if err := reconcileFuelCardImport(imp.ID); err != nil {
+		return result, err
+	}
+	if err := db.Get(&imp.Flagged, `SELECT flagged FROM fuel_card_imports WHERE id = $1`, imp.ID); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// fuelEntry is a driver's own fuel record, as reconciliation needs it
+type fuelEntry struct {
+	ID       int           `db:"id"`
+	Date     time.Time     `db:"date"`
+	Gallons  float64       `db:"gallons"`
+	Odometer sql.NullInt64 `db:"odometer"`
+}
+
+// gpsFix is the vehicle's position nearest a transaction
+type gpsFix struct {
+	Latitude  float64   `db:"latitude"`
+	Longitude float64   `db:"longitude"`
+	Speed     float64   `db:"speed"`
+	Timestamp time.Time `db:"timestamp"`
+}
+
+// reconcileFuelCardImport matches an import's lines to vehicles and to
+// drivers' fuel entries and flags anything that doesn't add up. It can be
+// run again once cards are assigned or drivers catch up on their entries.
+func reconcileFuelCardImport(importID int) error {
+	var txns []FuelCardTransaction
+	if err := db.Select(&txns, `SELECT `+fuelCardTransactionColumns+`
+		FROM fuel_card_transactions WHERE import_id = $1 ORDER BY transacted_at, id`, importID); err != nil {
+		return fmt.Errorf("failed to load transactions: %w", err)
+	}
+
+	var cardList []FuelCard
+	if err := db.Select(&cardList, `SELECT * FROM fuel_cards WHERE active`); err != nil {
+		return fmt.Errorf("failed to load fuel cards: %w", err)
+	}
+	cards := map[string]string{}
+	for _, c := range cardList {
+		cards[c.CardNumber] = c.VehicleID
+	}
+	units, err := loadFleetUnits()
+	if err != nil {
+		return err
+	}
+
+	var tankList []struct {
+		VehicleID string  `db:"vehicle_id"`
+		Capacity  float64 `db:"tank_capacity"`
+	}
+	if err := db.Select(&tankList, `
+		SELECT bus_id AS vehicle_id, tank_capacity FROM buses WHERE tank_capacity > 0
+		UNION ALL
+		SELECT vehicle_id, tank_capacity FROM vehicles WHERE tank_capacity > 0`); err != nil {
+		return fmt.Errorf("failed to load tank capacities: %w", err)
+	}
+	tanks := map[string]float64{}
+	for _, t := range tankList {
+		tanks[t.VehicleID] = t.Capacity
+	}
+
+	// Stations are placed from the local geocoding table; a location that
+	// can't be placed is only compared by name
+	var locations []string
+	for _, t := range txns {
+		if t.Location != "" {
+			locations = append(locations, t.Location)
+		}
+	}
+	places, err := geocodeAddresses(locations)
+	if err != nil {
+		log.Printf("Failed to geocode fuel stations: %v", err)
+		places = map[string]GeoPoint{}
+	}
+	place := func(location string) (GeoPoint, bool) {
+		p, ok := places[normalizeAddress(location)]
+		return p, ok && location != ""
+	}
+
+	// A vehicle's usual MPG is taken once per import, over the months
+	// before the statement
+	usualMPG := map[string]*FuelEfficiency{}
+	usual := func(vehicleID string, before time.Time) *FuelEfficiency {
+		if e, ok := usualMPG[vehicleID]; ok {
+			return e
+		}
+		e, err := GetVehicleFuelEfficiency(vehicleID,
+			before.AddDate(0, 0, -fuelMPGHistoryDays).Format("2006-01-02"), before.AddDate(0, 0, -1).Format("2006-01-02"))
+		if err != nil {
+			log.Printf("Failed to get fuel efficiency for %s: %v", vehicleID, err)
+		}
+		usualMPG[vehicleID] = e
+		return e
+	}
+
+	return withTransaction(func(tx *sqlx.Tx) error {
+		for _, t := range txns {
+			var flags []string
+			var notes []string
+			flag := func(code, format string, args ...interface{}) {
+				flags = append(flags, code)
+				notes = append(notes, fmt.Sprintf(format, args...))
+			}
+			date := t.TransactedAt.Format("2006-01-02")
+
+			var vehicleID string
+			if t.CardNumber != "" {
+				vehicleID, _ = matchFuelCard(cards, t.CardNumber)
+			}
+			if vehicleID == "" && t.VehicleNumber != "" {
+				vehicleID, _ = matchFleetUnit(units, t.VehicleNumber, "")
+			}
+			var entry *fuelEntry
+			var mpg sql.NullFloat64
+
+			if vehicleID == "" {
+				switch {
+				case t.CardNumber != "":
+					flag(FuelFlagNoVehicle, "card %s isn't assigned to a vehicle", t.CardNumber)
+				default:
+					flag(FuelFlagNoVehicle, "vehicle %q isn't in the fleet", t.VehicleNumber)
+				}
+			} else {
+				// The driver's entry for the same fill: same vehicle, within a
+				// day, near enough the same gallons, not already claimed
+				var entries []fuelEntry
+				err := tx.Select(&entries, `
+					SELECT f.id, f.date, f.gallons, f.odometer FROM fuel_records f
+					WHERE f.vehicle_id = $1 AND f.date BETWEEN $2::date - 1 AND $2::date + 1
+						AND NOT EXISTS (SELECT 1 FROM fuel_card_transactions c WHERE c.fuel_record_id = f.id AND c.id <> $3)
+				`, vehicleID, date, t.ID)
+				if err != nil {
+					return err
+				}
+				best := math.MaxFloat64
+				for i, e := range entries {
+					diff := math.Abs(e.Gallons - t.Gallons)
+					if diff > math.Max(0.5, t.Gallons*fuelEntryGallonSlack) {
+						continue
+					}
+					score := diff + math.Abs(e.Date.Sub(t.TransactedAt.Truncate(24*time.Hour)).Hours())/24
+					if score < best {
+						best, entry = score, &entries[i]
+					}
+				}
+				if entry == nil {
+					flag(FuelFlagNoEntry, "no driver fuel entry for %.1f gal on %s", t.Gallons, date)
+				} else if t.Odometer.Valid && entry.Odometer.Valid && absInt64(t.Odometer.Int64-entry.Odometer.Int64) > fuelOdometerSlack {
+					flag(FuelFlagOdometer, "statement odometer %d, driver entered %d", t.Odometer.Int64, entry.Odometer.Int64)
+				}
+
+				reading := t.Odometer
+				if !reading.Valid && entry != nil {
+					reading = entry.Odometer
+				}
+				if reading.Valid {
+					entryID := 0
+					if entry != nil {
+						entryID = entry.ID
+					}
+					var previous sql.NullInt64
+					err := tx.Get(&previous, `
+						SELECT MAX(odometer) FROM (
+							SELECT odometer FROM fuel_records WHERE vehicle_id = $1 AND date < $2::date AND id <> $4
+							UNION ALL
+							SELECT odometer FROM fuel_card_transactions
+							WHERE vehicle_id = $1 AND transacted_at < $3 AND id <> $5 AND odometer IS NOT NULL
+						) readings
+					`, vehicleID, date, t.TransactedAt, entryID, t.ID)
+					if err != nil {
+						return err
+					}
+					if previous.Valid && reading.Int64 < previous.Int64 {
+						flag(FuelFlagOdometer, "odometer %d is below the last reading of %d", reading.Int64, previous.Int64)
+					} else if previous.Valid && reading.Int64 > previous.Int64 {
+						mpg = sql.NullFloat64{Float64: math.Round(float64(reading.Int64-previous.Int64)/t.Gallons*100) / 100, Valid: true}
+						if e := usual(vehicleID, t.TransactedAt); e != nil && e.FillupCount >= 3 && e.AverageMPG > 0 &&
+							(mpg.Float64 < e.AverageMPG*fuelMPGLowShare || mpg.Float64 > e.AverageMPG*fuelMPGHighShare) {
+							flag(FuelFlagMPG, "%.1f MPG against a usual %.1f", mpg.Float64, e.AverageMPG)
+						}
+					}
+				}
+
+				if capacity := tanks[vehicleID]; capacity > 0 && t.Gallons > capacity*fuelTankCapacitySlack {
+					flag(FuelFlagCapacity, "%.1f gal into a %.0f gal tank", t.Gallons, capacity)
+				}
+			}
+
+			// Other swipes on the same card, or by the same vehicle, around
+			// the same time
+			var nearby []FuelCardTransaction
+			err := tx.Select(&nearby, `SELECT `+fuelCardTransactionColumns+` FROM fuel_card_transactions
+				WHERE id <> $1 AND ((card_number = $2 AND $2 <> '') OR vehicle_id = $3)
+					AND transacted_at BETWEEN $4::timestamp - interval '1 day' AND $4::timestamp + interval '1 day'
+				ORDER BY transacted_at, id`, t.ID, t.CardNumber, vehicleID, t.TransactedAt)
+			if err != nil {
+				return err
+			}
+			duplicate, impossible := false, false
+			for _, other := range nearby {
+				earlier := other.TransactedAt.Before(t.TransactedAt) || (other.TransactedAt.Equal(t.TransactedAt) && other.ID < t.ID)
+				if !earlier {
+					continue
+				}
+				gap := t.TransactedAt.Sub(other.TransactedAt)
+				sameDay := other.TransactedAt.Format("2006-01-02") == date
+				if !duplicate && ((t.HasTime && other.HasTime && gap <= fuelDuplicateWindow) ||
+					(!(t.HasTime && other.HasTime) && sameDay && math.Abs(other.Gallons-t.Gallons) < 0.01)) {
+					duplicate = true
+					if t.HasTime && other.HasTime {
+						flag(FuelFlagDuplicate, "second swipe %d min after #%d", int(gap.Minutes()), other.ID)
+					} else {
+						flag(FuelFlagDuplicate, "same %.1f gal as #%d that day", t.Gallons, other.ID)
+					}
+				}
+				if impossible || !t.HasTime || !other.HasTime || gap > 3*time.Hour ||
+					normalizeAddress(other.Location) == normalizeAddress(t.Location) || other.Location == "" || t.Location == "" {
+					continue
+				}
+				here, ok1 := place(t.Location)
+				there, ok2 := place(other.Location)
+				switch {
+				case ok1 && ok2:
+					km := calculateDistance(there.Latitude, there.Longitude, here.Latitude, here.Longitude) / 1000
+					if km/math.Max(gap.Hours(), 1.0/60) > fuelMaxSpeedKmh {
+						impossible = true
+						flag(FuelFlagLocation, "%.0f mi from #%d at %s only %d min earlier", km/1.609, other.ID, other.Location, int(gap.Minutes()))
+					}
+				case gap <= 10*time.Minute:
+					impossible = true
+					flag(FuelFlagLocation, "#%d was at %s only %d min earlier", other.ID, other.Location, int(gap.Minutes()))
+				}
+			}
+
+			if t.TransactedAt.After(time.Now()) {
+				flag(FuelFlagTime, "dated in the future")
+			}
+			if vehicleID != "" && t.HasTime {
+				var fix gpsFix
+				err := tx.Get(&fix, `
+					SELECT latitude, longitude, speed, timestamp FROM gps_locations
+					WHERE vehicle_id = $1 AND timestamp BETWEEN $2::timestamp - $3::int * interval '1 second' AND $2::timestamp + $3::int * interval '1 second'
+					ORDER BY ABS(EXTRACT(EPOCH FROM timestamp - $2::timestamp)) LIMIT 1
+				`, vehicleID, t.TransactedAt, int(fuelGPSWindow.Seconds()))
+				switch {
+				case err == sql.ErrNoRows:
+				case err != nil:
+					return err
+				default:
+					if station, ok := place(t.Location); ok && !impossible {
+						if km := calculateDistance(fix.Latitude, fix.Longitude, station.Latitude, station.Longitude) / 1000; km > fuelGPSMaxDistanceKm {
+							flag(FuelFlagLocation, "GPS had the vehicle %.0f mi from the station at %s", km/1.609, fix.Timestamp.Format("3:04 PM"))
+						}
+					}
+					if gap := fix.Timestamp.Sub(t.TransactedAt); gap > -2*time.Minute && gap < 2*time.Minute && fix.Speed > fuelMovingSpeedKmh {
+						flag(FuelFlagTime, "GPS had the vehicle moving at %.0f mph", fix.Speed/1.609)
+					}
+				}
+			}
+
+			var entryID sql.NullInt64
+			if entry != nil {
+				entryID = sql.NullInt64{Int64: int64(entry.ID), Valid: true}
+			}
+			// flags is never nil, as the column is NOT NULL
+			_, err = tx.Exec(`
+				UPDATE fuel_card_transactions SET vehicle_id = $2, fuel_record_id = $3, mpg = $4, flags = $5, flag_notes = $6
+				WHERE id = $1
+			`, t.ID, sql.NullString{String: vehicleID, Valid: vehicleID != ""}, entryID, mpg,
+				pq.StringArray(append([]string{}, flags...)), strings.Join(notes, "; "))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`
+			UPDATE fuel_card_imports SET flagged = (
+				SELECT COUNT(*) FROM fuel_card_transactions WHERE import_id = $1 AND cardinality(flags) > 0
+			) WHERE id = $1
+		`, importID)
+		return err
+	})
+}
+
+func absInt64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// unmatchedFuelEntries are drivers' fuel entries over an import's period,
+// for the vehicles on it, that no card transaction accounts for
+func unmatchedFuelEntries(imp FuelCardImport) ([]FuelRecord, error) {
+	var records []FuelRecord
+	if !imp.PeriodStart.Valid {
+		return records, nil
+	}
+	err := db.Select(&records, `
+		SELECT f.id, f.vehicle_id, to_char(f.date, 'YYYY-MM-DD') AS date, f.gallons, f.cost, f.price_per_gallon, f.odometer, f.location, f.driver
+		FROM fuel_records f
+		WHERE f.date BETWEEN $2 AND $3
+			AND f.vehicle_id IN (SELECT vehicle_id FROM fuel_card_transactions WHERE import_id = $1 AND vehicle_id IS NOT NULL)
+			AND NOT EXISTS (SELECT 1 FROM fuel_card_transactions c WHERE c.fuel_record_id = f.id)
+		ORDER BY f.date, f.vehicle_id
+	`, imp.ID, imp.PeriodStart.Time.Format("2006-01-02"), imp.PeriodEnd.Time.Format("2006-01-02"))
+	return records, err
+}
+
+// saveFuelCardProvider creates or updates a provider's column mapping
+func saveFuelCardProvider(p FuelCardProvider) (int, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	switch {
+	case p.Name == "":
+		return 0, fuelCardError("A provider needs a name")
+	case strings.TrimSpace(p.DateColumn) == "" || strings.TrimSpace(p.GallonsColumn) == "":
+		return 0, fuelCardError("Map at least the date and gallons columns")
+	case strings.TrimSpace(p.CardColumn) == "" && strings.TrimSpace(p.VehicleColumn) == "":
+		return 0, fuelCardError("Map the card number or vehicle number column, so lines can be matched to vehicles")
+	}
+
+	var err error
+	if p.ID == 0 {
+		err = db.Get(&p.ID, `
+			INSERT INTO fuel_card_providers (name, date_column, time_column, card_column, vehicle_column, gallons_column,
+				amount_column, price_column, odometer_column, location_column, driver_column, reference_column)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			RETURNING id
+		`, p.Name, p.DateColumn, p.TimeColumn, p.CardColumn, p.VehicleColumn, p.GallonsColumn,
+			p.AmountColumn, p.PriceColumn, p.OdometerColumn, p.LocationColumn, p.DriverColumn, p.ReferenceColumn)
+	} else {
+		var result sql.Result
+		result, err = db.Exec(`
+			UPDATE fuel_card_providers SET name = $2, date_column = $3, time_column = $4, card_column = $5,
+				vehicle_column = $6, gallons_column = $7, amount_column = $8, price_column = $9,
+				odometer_column = $10, location_column = $11, driver_column = $12, reference_column = $13,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, p.ID, p.Name, p.DateColumn, p.TimeColumn, p.CardColumn, p.VehicleColumn, p.GallonsColumn,
+			p.AmountColumn, p.PriceColumn, p.OdometerColumn, p.LocationColumn, p.DriverColumn, p.ReferenceColumn)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				return 0, sql.ErrNoRows
+			}
+		}
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
+			return 0, fuelCardError("There's already a provider called " + p.Name)
+		}
+		return 0, err
+	}
+	return p.ID, nil
+}
+
+// saveFuelCard issues a card to a vehicle, or moves it to another one
+func saveFuelCard(card FuelCard) (string, error) {
+	card.CardNumber = fuelCardKey(card.CardNumber)
+	if strings.Contains(card.CardNumber, "X") || len(card.CardNumber) < 4 {
+		return "", fuelCardError("Enter the card number, or at least its last four digits, without masking")
+	}
+	var exists bool
+	if err := db.Get(&exists, `
+		SELECT EXISTS (SELECT 1 FROM buses WHERE bus_id = $1 UNION ALL SELECT 1 FROM vehicles WHERE vehicle_id = $1)
+	`, card.VehicleID); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fuelCardError("Unknown vehicle " + card.VehicleID)
+	}
+	_, err := db.Exec(`
+		INSERT INTO fuel_cards (card_number, vehicle_id, provider_id, notes, active)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (card_number) DO UPDATE SET
+			vehicle_id = EXCLUDED.vehicle_id, provider_id = EXCLUDED.provider_id,
+			notes = EXCLUDED.notes, active = EXCLUDED.active
+	`, card.CardNumber, card.VehicleID, card.ProviderID, card.Notes, card.Active)
+	return card.CardNumber, err
+}
+
+// setTankCapacity records how many gallons a vehicle's tank holds; zero
+// clears it. It returns the previous capacity and the vehicle's class.
+func setTankCapacity(vehicleID string, gallons float64) (float64, string, error) {
+	var current struct {
+		Capacity sql.NullFloat64 `db:"tank_capacity"`
+		Class    string          `db:"class"`
+	}
+	capacity := sql.NullFloat64{Float64: gallons, Valid: gallons > 0}
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		err := tx.Get(&current, `
+			SELECT tank_capacity, 'bus' AS class FROM buses WHERE bus_id = $1
+			UNION ALL
+			SELECT tank_capacity, 'vehicle' FROM vehicles WHERE vehicle_id = $1
+			LIMIT 1
+		`, vehicleID)
+		if err != nil {
+			return err
+		}
+		if current.Class == "bus" {
+			_, err = tx.Exec(`UPDATE buses SET tank_capacity = $2 WHERE bus_id = $1`, vehicleID, capacity)
+		} else {
+			_, err = tx.Exec(`UPDATE vehicles SET tank_capacity = $2 WHERE vehicle_id = $1`, vehicleID, capacity)
+		}
+		return err
+	})
+	if err == nil {
+		invalidateFleetCaches()
+	}
+	return current.Capacity.Float64, current.Class, err
+}
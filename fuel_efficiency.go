@@ -444,7 +444,7 @@ func vehicleFuelEfficiencyHandler(w http.ResponseWriter, r *http.Request) {
 // fleetFuelSummaryHandler returns fuel summary for the fleet
 func fleetFuelSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermFuelView) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Geocoder turns a street address into coordinates. Implementations work
+// offline: student addresses don't leave the district's systems.
+type Geocoder interface {
+	Name() string
+	// Geocode returns ok=false when the address isn't known
+	Geocode(address string) (point GeoPoint, ok bool, err error)
+}
+
+// addressAbbreviations shortens common street words so "12 North Main
+// Street" and "12 N Main St." land on the same key
+var addressAbbreviations = map[string]string{
+	"STREET": "ST", "AVENUE": "AVE", "ROAD": "RD", "DRIVE": "DR",
+	"LANE": "LN", "COURT": "CT", "BOULEVARD": "BLVD", "PLACE": "PL",
+	"CIRCLE": "CIR", "HIGHWAY": "HWY", "PARKWAY": "PKWY", "TERRACE": "TER",
+	"NORTH": "N", "SOUTH": "S", "EAST": "E", "WEST": "W",
+	"APARTMENT": "APT", "SUITE": "STE",
+}
+
+// normalizeAddress is the lookup key for an address: upper case, without
+// punctuation, with street words abbreviated
+func normalizeAddress(address string) string {
+	words := strings.FieldsFunc(strings.ToUpper(address), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		if short, ok := addressAbbreviations[w]; ok {
+			words[i] = short
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// AddressFileGeocoder looks addresses up in a CSV of address points, such
+// as a county GIS export, with address, latitude and longitude columns
+type AddressFileGeocoder struct {
+	path   string
+	once   sync.Once
+	points map[string]GeoPoint
+	err    error
+}
+
+func NewAddressFileGeocoder(path string) *AddressFileGeocoder {
+	return &AddressFileGeocoder{path: path}
+}
+
+func (g *AddressFileGeocoder) Name() string { return "address_file" }
+
+func (g *AddressFileGeocoder) Geocode(address string) (GeoPoint, bool, error) {
+	g.once.Do(g.load)
+	if g.err != nil {
+		return GeoPoint{}, false, g.err
+	}
+	point, ok := g.points[normalizeAddress(address)]
+	return point, ok, nil
+}
+
+func (g *AddressFileGeocoder) load() {
+	f, err := os.Open(g.path)
+	if err != nil {
+		g.err = err
+		return
+	}
+	defer f.Close()
+
+	g.points = make(map[string]GeoPoint)
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			g.err = fmt.Errorf("%s line %d: %w", g.path, line, err)
+			return
+		}
+		if len(record) < 3 {
+			continue
+		}
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		lng, lngErr := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if latErr != nil || lngErr != nil {
+			// Header rows and blank coordinates
+			continue
+		}
+		g.points[normalizeAddress(record[0])] = GeoPoint{Latitude: lat, Longitude: lng}
+	}
+	log.Printf("Loaded %d address points from %s", len(g.points), g.path)
+}
+
+// offlineGeocoders are consulted, in order, for addresses the local table
+// doesn't have yet
+func offlineGeocoders() []Geocoder {
+	var geocoders []Geocoder
+	if path := os.Getenv("GEOCODER_ADDRESS_FILE"); path != "" {
+		geocoders = append(geocoders, addressFileGeocoder(path))
+	}
+	return geocoders
+}
+
+var (
+	addressFileGeocodersMu sync.Mutex
+	addressFileGeocoders   = map[string]*AddressFileGeocoder{}
+)
+
+// addressFileGeocoder shares one loaded file per path
+func addressFileGeocoder(path string) *AddressFileGeocoder {
+	addressFileGeocodersMu.Lock()
+	defer addressFileGeocodersMu.Unlock()
+	g, ok := addressFileGeocoders[path]
+	if !ok {
+		g = NewAddressFileGeocoder(path)
+		addressFileGeocoders[path] = g
+	}
+	return g
+}
+
+// geocodeAddresses locates each address, by its normalized key, from the
+// local table first and then the offline geocoders. Provider hits are
+// saved to the table so the next lookup is local.
+func geocodeAddresses(addresses []string) (map[string]GeoPoint, error) {
+	found := make(map[string]GeoPoint)
+	keys := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if key := normalizeAddress(address); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return found, nil
+	}
+
+	var known []struct {
+		Key       string  `db:"address_key"`
+		Latitude  float64 `db:"latitude"`
+		Longitude float64 `db:"longitude"`
+	}
+	if err := db.Select(&known, `
+		SELECT address_key, latitude, longitude FROM geocoded_addresses
+		WHERE address_key = ANY($1)
+	`, pq.StringArray(keys)); err != nil {
+		return nil, err
+	}
+	for _, k := range known {
+		found[k.Key] = GeoPoint{Latitude: k.Latitude, Longitude: k.Longitude}
+	}
+
+	geocoders := offlineGeocoders()
+	for _, address := range addresses {
+		key := normalizeAddress(address)
+		if key == "" {
+			continue
+		}
+		if _, ok := found[key]; ok {
+			continue
+		}
+		for _, g := range geocoders {
+			point, ok, err := g.Geocode(address)
+			if err != nil {
+				log.Printf("Geocoder %s failed: %v", g.Name(), err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			found[key] = point
+			if err := saveGeocodedAddress(address, point, g.Name(), ""); err != nil {
+				log.Printf("Failed to cache geocoded address: %v", err)
+			}
+			break
+		}
+	}
+	return found, nil
+}
+
+// saveGeocodedAddress records where an address is, replacing what was there
+func saveGeocodedAddress(address string, point GeoPoint, source, updatedBy string) error {
+	_, err := db.Exec(`
+		INSERT INTO geocoded_addresses (address_key, address, latitude, longitude, source, updated_by)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+		ON CONFLICT (address_key) DO UPDATE SET
+			address = EXCLUDED.address, latitude = EXCLUDED.latitude,
+			longitude = EXCLUDED.longitude, source = EXCLUDED.source,
+			updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP
+	`, normalizeAddress(address), strings.TrimSpace(address), point.Latitude, point.Longitude, source, updatedBy)
+	return err
+}
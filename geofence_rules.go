@@ -0,0 +1,764 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Geofence shapes
+const (
+	GeofenceShapeCircle   = "circle"
+	GeofenceShapePolygon  = "polygon"
+	GeofenceShapeCorridor = "corridor"
+)
+
+// Geofence rule types
+const (
+	GeofenceRuleMaxDwell     = "max_dwell"
+	GeofenceRuleSpeedLimit   = "speed_limit"
+	GeofenceRuleAllowedHours = "allowed_hours"
+)
+
+// NotifyGeofenceViolation is the notification type for geofence rule breaches
+const NotifyGeofenceViolation = "geofence_violation"
+
+// GeoPoint is a latitude/longitude pair
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Geofence is a zone vehicles are checked against
+type Geofence struct {
+	ID              int            `json:"id"`
+	Name            string         `json:"name"`
+	Type            string         `json:"type"`  // school, stop, depot, zone, route
+	Shape           string         `json:"shape"` // circle, polygon, corridor
+	CenterLatitude  float64        `json:"center_latitude,omitempty"`
+	CenterLongitude float64        `json:"center_longitude,omitempty"`
+	RadiusMeters    float64        `json:"radius_meters,omitempty"`
+	Points          []GeoPoint     `json:"points,omitempty"` // polygon ring or corridor path
+	RouteID         string         `json:"route_id,omitempty"`
+	CorridorWidth   float64        `json:"corridor_width_meters,omitempty"`
+	Rules           []GeofenceRule `json:"rules"`
+	Active          bool           `json:"active"`
+}
+
+// GeofenceRule is a constraint applied while a vehicle is inside a zone
+type GeofenceRule struct {
+	ID              int     `json:"id"`
+	GeofenceID      int     `json:"geofence_id"`
+	RuleType        string  `json:"rule_type"`
+	MaxDwellMinutes int     `json:"max_dwell_minutes,omitempty"`
+	SpeedLimitKmh   float64 `json:"speed_limit_kmh,omitempty"`
+	AllowedStart    string  `json:"allowed_start,omitempty"` // "06:00"
+	AllowedEnd      string  `json:"allowed_end,omitempty"`   // "18:00"
+	AllowedDays     string  `json:"allowed_days,omitempty"`  // "1,2,3,4,5" (0 = Sunday)
+	Severity        string  `json:"severity"`
+	Notify          bool    `json:"notify"`
+	Active          bool    `json:"active"`
+}
+
+// GeofenceViolation describes a broken rule
+type GeofenceViolation struct {
+	Geofence  *Geofence
+	Rule      GeofenceRule
+	VehicleID string
+	Location  *GPSLocation
+	Message   string
+	Details   map[string]interface{}
+}
+
+// geofencePresence tracks one vehicle's visit to one zone. EnteredAt and
+// LastSeen are fix times from the device; ReceivedAt is when the server got
+// the latest fix, and is only used to measure time since then.
+type geofencePresence struct {
+	EnteredAt     time.Time
+	LastSeen      time.Time
+	ReceivedAt    time.Time
+	Location      *GPSLocation      // latest fix inside the zone
+	ViolatedRules map[int]time.Time // rule ID -> last violation
+}
+
+// GeofenceMonitor evaluates zones and rules for incoming positions
+type GeofenceMonitor struct {
+	mu             sync.Mutex
+	geofences      []*Geofence
+	loadedAt       time.Time
+	reloadInterval time.Duration
+	presence       map[string]map[int]*geofencePresence // vehicleID -> geofenceID -> visit
+	repeatInterval time.Duration                        // re-alert interval for ongoing speed violations
+	presenceTTL    time.Duration                        // how long a visit lasts without a fix
+}
+
+var geofenceMonitor = &GeofenceMonitor{
+	reloadInterval: time.Minute,
+	presence:       make(map[string]map[int]*geofencePresence),
+	repeatInterval: 5 * time.Minute,
+	presenceTTL:    30 * time.Minute,
+}
+
+// Contains reports whether a coordinate is inside the geofence
+func (g *Geofence) Contains(lat, lng float64) bool {
+	switch g.Shape {
+	case GeofenceShapePolygon:
+		return pointInPolygon(lat, lng, g.Points)
+	case GeofenceShapeCorridor:
+		return distanceToPath(lat, lng, g.Points) <= g.CorridorWidth/2
+	default:
+		return calculateDistance(lat, lng, g.CenterLatitude, g.CenterLongitude) <= g.RadiusMeters
+	}
+}
+
+// Validate checks that the geofence has the geometry its shape requires
+func (g *Geofence) Validate() error {
+	if g.Name == "" || g.Type == "" {
+		return fmt.Errorf("name and type are required")
+	}
+	switch g.Shape {
+	case GeofenceShapeCircle:
+		if g.RadiusMeters <= 0 {
+			return fmt.Errorf("radius must be positive")
+		}
+	case GeofenceShapePolygon:
+		if len(g.Points) < 3 {
+			return fmt.Errorf("polygon needs at least 3 points")
+		}
+	case GeofenceShapeCorridor:
+		if g.CorridorWidth <= 0 {
+			return fmt.Errorf("corridor width must be positive")
+		}
+		if len(g.Points) < 2 && g.RouteID == "" {
+			return fmt.Errorf("corridor needs a path or a route_id")
+		}
+	default:
+		return fmt.Errorf("unknown shape: %s", g.Shape)
+	}
+	for _, rule := range g.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that a rule has the settings its type requires
+func (r GeofenceRule) Validate() error {
+	switch r.RuleType {
+	case GeofenceRuleMaxDwell:
+		if r.MaxDwellMinutes <= 0 {
+			return fmt.Errorf("max_dwell rule needs max_dwell_minutes")
+		}
+	case GeofenceRuleSpeedLimit:
+		if r.SpeedLimitKmh <= 0 {
+			return fmt.Errorf("speed_limit rule needs speed_limit_kmh")
+		}
+	case GeofenceRuleAllowedHours:
+		if _, err := parseClock(r.AllowedStart); err != nil {
+			return fmt.Errorf("allowed_hours rule needs a valid allowed_start")
+		}
+		if _, err := parseClock(r.AllowedEnd); err != nil {
+			return fmt.Errorf("allowed_hours rule needs a valid allowed_end")
+		}
+	default:
+		return fmt.Errorf("unknown rule type: %s", r.RuleType)
+	}
+	return nil
+}
+
+// allows reports whether a time is inside the rule's allowed window
+func (r GeofenceRule) allows(t time.Time) bool {
+	if r.AllowedDays != "" {
+		dayAllowed := false
+		for _, d := range strings.Split(r.AllowedDays, ",") {
+			if day, err := strconv.Atoi(strings.TrimSpace(d)); err == nil && time.Weekday(day) == t.Weekday() {
+				dayAllowed = true
+				break
+			}
+		}
+		if !dayAllowed {
+			return false
+		}
+	}
+
+	start, err1 := parseClock(r.AllowedStart)
+	end, err2 := parseClock(r.AllowedEnd)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	now := t.Hour()*60 + t.Minute()
+
+	// Overnight windows such as 22:00-05:00
+	if start > end {
+		return now >= start || now < end
+	}
+	return now >= start && now < end
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// pointInPolygon uses ray casting against the polygon ring
+func pointInPolygon(lat, lng float64, ring []GeoPoint) bool {
+	if len(ring) < 3 {
+		return false
+	}
+	inside := false
+	j := len(ring) - 1
+	for i := 0; i < len(ring); i++ {
+		pi, pj := ring[i], ring[j]
+		if (pi.Latitude > lat) != (pj.Latitude > lat) {
+			crossLng := (pj.Longitude-pi.Longitude)*(lat-pi.Latitude)/(pj.Latitude-pi.Latitude) + pi.Longitude
+			if lng < crossLng {
+				inside = !inside
+			}
+		}
+		j = i
+	}
+	return inside
+}
+
+// distanceToPath returns the distance in meters from a point to a polyline
+func distanceToPath(lat, lng float64, path []GeoPoint) float64 {
+	if len(path) == 0 {
+		return math.MaxFloat64
+	}
+	if len(path) == 1 {
+		return calculateDistance(lat, lng, path[0].Latitude, path[0].Longitude)
+	}
+	best := math.MaxFloat64
+	for i := 0; i < len(path)-1; i++ {
+		_, d := projectOntoSegment(lat, lng,
+			path[i].Latitude, path[i].Longitude,
+			path[i+1].Latitude, path[i+1].Longitude)
+		if d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// routeCorridorPath builds a corridor path from a route's planned stops
+func routeCorridorPath(routeID string) ([]GeoPoint, error) {
+	stops, err := loadRoutePlan(routeID)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]GeoPoint, 0, len(stops))
+	for _, stop := range stops {
+		path = append(path, GeoPoint{Latitude: stop.Latitude, Longitude: stop.Longitude})
+	}
+	return path, nil
+}
+
+// refreshRouteCorridors rebuilds corridor paths after a route plan changes
+func refreshRouteCorridors(routeID string) error {
+	path, err := routeCorridorPath(routeID)
+	if err != nil {
+		return err
+	}
+	pathJSON, _ := json.Marshal(path)
+	if _, err := db.Exec(`
+		UPDATE geofences SET points = $1
+		WHERE shape = 'corridor' AND route_id = $2
+	`, pathJSON, routeID); err != nil {
+		return err
+	}
+	geofenceMonitor.Invalidate()
+	return nil
+}
+
+// createGeofenceRuleTables extends geofences with shapes and adds rules
+func createGeofenceRuleTables() []string {
+	return []string{
+		`ALTER TABLE geofences ADD COLUMN IF NOT EXISTS shape VARCHAR(20) DEFAULT 'circle'`,
+		`ALTER TABLE geofences ADD COLUMN IF NOT EXISTS points JSONB`,
+		`ALTER TABLE geofences ADD COLUMN IF NOT EXISTS route_id VARCHAR(50) REFERENCES routes(route_id) ON DELETE CASCADE`,
+		`ALTER TABLE geofences ADD COLUMN IF NOT EXISTS corridor_width_meters DOUBLE PRECISION`,
+		`ALTER TABLE geofences ALTER COLUMN center_latitude DROP NOT NULL`,
+		`ALTER TABLE geofences ALTER COLUMN center_longitude DROP NOT NULL`,
+		`ALTER TABLE geofences ALTER COLUMN radius_meters DROP NOT NULL`,
+
+		`CREATE TABLE IF NOT EXISTS geofence_rules (
+			id SERIAL PRIMARY KEY,
+			geofence_id INTEGER NOT NULL REFERENCES geofences(id) ON DELETE CASCADE,
+			rule_type VARCHAR(30) NOT NULL, -- max_dwell, speed_limit, allowed_hours
+			max_dwell_minutes INTEGER,
+			speed_limit_kmh DOUBLE PRECISION,
+			allowed_start VARCHAR(5),
+			allowed_end VARCHAR(5),
+			allowed_days VARCHAR(20),
+			severity VARCHAR(20) DEFAULT 'medium',
+			notify BOOLEAN DEFAULT true,
+			active BOOLEAN DEFAULT true,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_geofence_rules_geofence
+		 ON geofence_rules(geofence_id) WHERE active = true`,
+
+		// Violations are stored alongside enter/exit events
+		`ALTER TABLE geofence_events ADD COLUMN IF NOT EXISTS rule_id INTEGER REFERENCES geofence_rules(id) ON DELETE SET NULL`,
+		`ALTER TABLE geofence_events ADD COLUMN IF NOT EXISTS details JSONB`,
+		`ALTER TABLE geofence_events ALTER COLUMN event_type TYPE VARCHAR(30)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_geofence_events_vehicle
+		 ON geofence_events(vehicle_id, timestamp DESC)`,
+	}
+}
+
+// Invalidate forces geofences to be reloaded on the next check
+func (gm *GeofenceMonitor) Invalidate() {
+	gm.mu.Lock()
+	gm.loadedAt = time.Time{}
+	gm.mu.Unlock()
+}
+
+// activeGeofences returns the cached active geofences, reloading if stale
+func (gm *GeofenceMonitor) activeGeofences() []*Geofence {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	if time.Since(gm.loadedAt) < gm.reloadInterval {
+		return gm.geofences
+	}
+
+	geofences, err := loadGeofences(true)
+	if err != nil {
+		log.Printf("Failed to load geofences: %v", err)
+		return gm.geofences
+	}
+	gm.geofences = geofences
+	gm.loadedAt = time.Now()
+	return gm.geofences
+}
+
+// loadGeofences reads geofences and their rules from the database
+func loadGeofences(activeOnly bool) ([]*Geofence, error) {
+	query := `
+		SELECT id, name, type, COALESCE(shape, 'circle'),
+		       center_latitude, center_longitude, radius_meters,
+		       points, route_id, corridor_width_meters, COALESCE(active, true)
+		FROM geofences
+	`
+	if activeOnly {
+		query += " WHERE active = true"
+	}
+	query += " ORDER BY name"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var geofences []*Geofence
+	byID := make(map[int]*Geofence)
+	for rows.Next() {
+		g := &Geofence{}
+		var centerLat, centerLng, radius, width sql.NullFloat64
+		var pointsJSON []byte
+		var routeID sql.NullString
+
+		if err := rows.Scan(&g.ID, &g.Name, &g.Type, &g.Shape,
+			&centerLat, &centerLng, &radius,
+			&pointsJSON, &routeID, &width, &g.Active); err != nil {
+			log.Printf("Failed to scan geofence: %v", err)
+			continue
+		}
+
+		g.CenterLatitude = centerLat.Float64
+		g.CenterLongitude = centerLng.Float64
+		g.RadiusMeters = radius.Float64
+		g.CorridorWidth = width.Float64
+		g.RouteID = routeID.String
+		if len(pointsJSON) > 0 {
+			json.Unmarshal(pointsJSON, &g.Points)
+		}
+		g.Rules = []GeofenceRule{}
+
+		geofences = append(geofences, g)
+		byID[g.ID] = g
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rules, err := loadGeofenceRules(0)
+	if err != nil {
+		return geofences, err
+	}
+	for _, rule := range rules {
+		if g, ok := byID[rule.GeofenceID]; ok && rule.Active {
+			g.Rules = append(g.Rules, rule)
+		}
+	}
+
+	return geofences, nil
+}
+
+// loadGeofenceRules returns rules for one geofence, or all when id is 0
+func loadGeofenceRules(geofenceID int) ([]GeofenceRule, error) {
+	query := `
+		SELECT id, geofence_id, rule_type,
+		       COALESCE(max_dwell_minutes, 0), COALESCE(speed_limit_kmh, 0),
+		       COALESCE(allowed_start, ''), COALESCE(allowed_end, ''),
+		       COALESCE(allowed_days, ''), COALESCE(severity, 'medium'),
+		       COALESCE(notify, true), COALESCE(active, true)
+		FROM geofence_rules
+		WHERE ($1 = 0 OR geofence_id = $1)
+		ORDER BY geofence_id, id
+	`
+	rows, err := db.Query(query, geofenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []GeofenceRule
+	for rows.Next() {
+		var rule GeofenceRule
+		if err := rows.Scan(&rule.ID, &rule.GeofenceID, &rule.RuleType,
+			&rule.MaxDwellMinutes, &rule.SpeedLimitKmh,
+			&rule.AllowedStart, &rule.AllowedEnd, &rule.AllowedDays,
+			&rule.Severity, &rule.Notify, &rule.Active); err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// saveGeofence inserts a geofence and its rules
+func saveGeofence(g *Geofence) error {
+	if g.Shape == GeofenceShapeCorridor && len(g.Points) < 2 {
+		path, err := routeCorridorPath(g.RouteID)
+		if err != nil {
+			return fmt.Errorf("failed to build corridor from route: %w", err)
+		}
+		if len(path) < 2 {
+			return fmt.Errorf("route %s needs at least 2 planned stops for a corridor", g.RouteID)
+		}
+		g.Points = path
+	}
+
+	var pointsJSON []byte
+	if len(g.Points) > 0 {
+		pointsJSON, _ = json.Marshal(g.Points)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var centerLat, centerLng, radius, width interface{}
+	if g.Shape == GeofenceShapeCircle {
+		centerLat, centerLng, radius = g.CenterLatitude, g.CenterLongitude, g.RadiusMeters
+	}
+	if g.Shape == GeofenceShapeCorridor {
+		width = g.CorridorWidth
+	}
+	var routeID interface{}
+	if g.RouteID != "" {
+		routeID = g.RouteID
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO geofences (name, type, shape, center_latitude, center_longitude,
+			radius_meters, points, route_id, corridor_width_meters)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`, g.Name, g.Type, g.Shape, centerLat, centerLng, radius, pointsJSON, routeID, width).Scan(&g.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range g.Rules {
+		g.Rules[i].GeofenceID = g.ID
+		if err := insertGeofenceRule(tx, &g.Rules[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	geofenceMonitor.Invalidate()
+	return nil
+}
+
+// insertGeofenceRule stores a single rule
+func insertGeofenceRule(tx *sql.Tx, rule *GeofenceRule) error {
+	if rule.Severity == "" {
+		rule.Severity = "medium"
+	}
+	rule.Active = true
+	return tx.QueryRow(`
+		INSERT INTO geofence_rules (geofence_id, rule_type, max_dwell_minutes,
+			speed_limit_kmh, allowed_start, allowed_end, allowed_days, severity, notify)
+		VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, 0), NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''), $8, $9)
+		RETURNING id
+	`, rule.GeofenceID, rule.RuleType, rule.MaxDwellMinutes, rule.SpeedLimitKmh,
+		rule.AllowedStart, rule.AllowedEnd, rule.AllowedDays, rule.Severity, rule.Notify).Scan(&rule.ID)
+}
+
+// Check evaluates a new position against all zones and their rules
+func (gm *GeofenceMonitor) Check(tracker *GPSTracker, location *GPSLocation) {
+	geofences := gm.activeGeofences()
+	now := location.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var violations []GeofenceViolation
+
+	gm.mu.Lock()
+	visits, ok := gm.presence[location.VehicleID]
+	if !ok {
+		visits = make(map[int]*geofencePresence)
+		gm.presence[location.VehicleID] = visits
+	}
+
+	var entered, exited []int
+	seen := make(map[int]bool)
+
+	for _, g := range geofences {
+		if !g.Contains(location.Latitude, location.Longitude) {
+			continue
+		}
+		seen[g.ID] = true
+
+		visit, inside := visits[g.ID]
+		if !inside {
+			visit = &geofencePresence{EnteredAt: now, ViolatedRules: make(map[int]time.Time)}
+			visits[g.ID] = visit
+			entered = append(entered, g.ID)
+		}
+		visit.LastSeen = now
+		visit.ReceivedAt = time.Now()
+		visit.Location = location
+
+		for _, rule := range g.Rules {
+			if v, broken := gm.evaluateRule(g, rule, visit, location, now); broken {
+				violations = append(violations, v)
+			}
+		}
+	}
+
+	for id := range visits {
+		if !seen[id] {
+			delete(visits, id)
+			exited = append(exited, id)
+		}
+	}
+	gm.mu.Unlock()
+
+	for _, id := range entered {
+		tracker.recordGeofenceEvent(location.VehicleID, id, "enter", location)
+	}
+	for _, id := range exited {
+		tracker.recordGeofenceEvent(location.VehicleID, id, "exit", location)
+	}
+	for _, v := range violations {
+		recordGeofenceViolation(v)
+	}
+}
+
+// CheckDwell evaluates max_dwell rules between fixes, so a vehicle that
+// parks in a zone and goes quiet is still flagged. Dwell stays on the
+// device's clock: the last fix time is moved on by however long ago that
+// fix arrived, so a batch of old fixes uploaded late doesn't look like a
+// long stay. A visit with no fix for presenceTTL is forgotten, since we no
+// longer know where the vehicle is.
+func (gm *GeofenceMonitor) CheckDwell(received time.Time) {
+	byID := make(map[int]*Geofence)
+	for _, g := range gm.activeGeofences() {
+		byID[g.ID] = g
+	}
+
+	var violations []GeofenceViolation
+	gm.mu.Lock()
+	for vehicleID, visits := range gm.presence {
+		for id, visit := range visits {
+			quiet := received.Sub(visit.ReceivedAt)
+			if quiet > gm.presenceTTL {
+				delete(visits, id)
+				continue
+			}
+			g, ok := byID[id]
+			if !ok || visit.Location == nil {
+				continue
+			}
+			if quiet < 0 {
+				quiet = 0
+			}
+			now := visit.LastSeen.Add(quiet)
+			for _, rule := range g.Rules {
+				if rule.RuleType != GeofenceRuleMaxDwell {
+					continue
+				}
+				location := *visit.Location
+				location.Timestamp = now
+				if v, broken := gm.evaluateRule(g, rule, visit, &location, now); broken {
+					violations = append(violations, v)
+				}
+			}
+		}
+		if len(visits) == 0 {
+			delete(gm.presence, vehicleID)
+		}
+	}
+	gm.mu.Unlock()
+
+	for _, v := range violations {
+		recordGeofenceViolation(v)
+	}
+}
+
+// watchDwell runs CheckDwell on a timer
+func (gm *GeofenceMonitor) watchDwell(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		gm.CheckDwell(now)
+	}
+}
+
+// evaluateRule checks a rule for an ongoing visit. Callers must hold gm.mu.
+func (gm *GeofenceMonitor) evaluateRule(g *Geofence, rule GeofenceRule, visit *geofencePresence, location *GPSLocation, now time.Time) (GeofenceViolation, bool) {
+	last, alreadyViolated := visit.ViolatedRules[rule.ID]
+	violation := GeofenceViolation{
+		Geofence:  g,
+		Rule:      rule,
+		VehicleID: location.VehicleID,
+		Location:  location,
+	}
+
+	switch rule.RuleType {
+	case GeofenceRuleMaxDwell:
+		// Once per visit
+		dwell := now.Sub(visit.EnteredAt)
+		if alreadyViolated || dwell <= time.Duration(rule.MaxDwellMinutes)*time.Minute {
+			return violation, false
+		}
+		violation.Message = fmt.Sprintf("Vehicle %s has been in %s for %.0f minutes (limit %d)",
+			location.VehicleID, g.Name, dwell.Minutes(), rule.MaxDwellMinutes)
+		violation.Details = map[string]interface{}{
+			"dwell_minutes": math.Round(dwell.Minutes()),
+			"limit_minutes": rule.MaxDwellMinutes,
+			"entered_at":    visit.EnteredAt,
+		}
+
+	case GeofenceRuleSpeedLimit:
+		// Repeats while the vehicle keeps speeding, at most every repeatInterval
+		if location.Speed <= rule.SpeedLimitKmh {
+			return violation, false
+		}
+		if alreadyViolated && now.Sub(last) < gm.repeatInterval {
+			return violation, false
+		}
+		violation.Message = fmt.Sprintf("Vehicle %s doing %.0f km/h in %s (limit %.0f km/h)",
+			location.VehicleID, location.Speed, g.Name, rule.SpeedLimitKmh)
+		violation.Details = map[string]interface{}{
+			"speed_kmh": location.Speed,
+			"limit_kmh": rule.SpeedLimitKmh,
+		}
+
+	case GeofenceRuleAllowedHours:
+		// Once per visit
+		if alreadyViolated || rule.allows(now) {
+			return violation, false
+		}
+		violation.Message = fmt.Sprintf("Vehicle %s in %s outside allowed hours (%s-%s)",
+			location.VehicleID, g.Name, rule.AllowedStart, rule.AllowedEnd)
+		violation.Details = map[string]interface{}{
+			"allowed_start": rule.AllowedStart,
+			"allowed_end":   rule.AllowedEnd,
+			"allowed_days":  rule.AllowedDays,
+			"at":            now,
+		}
+
+	default:
+		return violation, false
+	}
+
+	visit.ViolatedRules[rule.ID] = now
+	return violation, true
+}
+
+// recordGeofenceViolation stores a violation event and notifies managers
+func recordGeofenceViolation(v GeofenceViolation) {
+	details := v.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["rule_type"] = v.Rule.RuleType
+	details["message"] = v.Message
+	detailsJSON, _ := json.Marshal(details)
+	locationJSON, _ := json.Marshal(map[string]interface{}{
+		"latitude":  v.Location.Latitude,
+		"longitude": v.Location.Longitude,
+		"speed":     v.Location.Speed,
+	})
+
+	timestamp := v.Location.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	if _, err := db.Exec(`
+		INSERT INTO geofence_events (vehicle_id, geofence_id, event_type, timestamp, location, rule_id, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, v.VehicleID, v.Geofence.ID, v.Rule.RuleType+"_violation", timestamp,
+		locationJSON, v.Rule.ID, detailsJSON); err != nil {
+		log.Printf("Failed to record geofence violation: %v", err)
+	}
+
+	log.Printf("Geofence violation: %s", v.Message)
+
+	if !v.Rule.Notify || notificationSystem == nil {
+		return
+	}
+
+	priority := "medium"
+	if v.Rule.Severity == "high" || v.Rule.Severity == "critical" {
+		priority = "high"
+	}
+
+	notification := Notification{
+		Type:     NotifyGeofenceViolation,
+		Priority: priority,
+		Subject:  fmt.Sprintf("Geofence Alert: %s", v.Geofence.Name),
+		Message:  v.Message,
+		Data: map[string]interface{}{
+			"vehicle_id":  v.VehicleID,
+			"geofence_id": v.Geofence.ID,
+			"rule_id":     v.Rule.ID,
+			"rule_type":   v.Rule.RuleType,
+			"latitude":    v.Location.Latitude,
+			"longitude":   v.Location.Longitude,
+		},
+		Channels:   []string{"in-app", "push", "email"},
+		Recipients: getManagerRecipients(),
+	}
+
+	if err := notificationSystem.Send(notification); err != nil {
+		log.Printf("Failed to send geofence violation notification: %v", err)
+	}
+}
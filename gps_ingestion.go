@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolOsmAnd = "osmand"
+	ProtocolNMEA   = "nmea"
+
+	knotsToKmh = 1.852
+)
+
+var (
+	ErrUnknownDevice  = errors.New("device is not registered")
+	ErrDeviceInactive = errors.New("device is not assigned to an active vehicle")
+	ErrBadDeviceKey   = errors.New("device key is missing or wrong")
+)
+
+// unknownDeviceKeyHash stands in for the key hash of a device that isn't
+// registered or has no key; no key hashes to it
+var unknownDeviceKeyHash = strings.Repeat("0", 64)
+
+// GPSDevice maps a hardware tracker (usually by IMEI) to a bus
+type GPSDevice struct {
+	DeviceID    string     `json:"device_id" db:"device_id"`
+	VehicleID   string     `json:"vehicle_id" db:"vehicle_id"`
+	Protocol    string     `json:"protocol" db:"protocol"`
+	Description string     `json:"description" db:"description"`
+	Active      bool       `json:"active" db:"active"`
+	LastSeen    *time.Time `json:"last_seen,omitempty" db:"last_seen"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	HasKey      bool       `json:"has_key" db:"has_key"`
+	keyHash     string
+}
+
+// DevicePosition is a fix as reported by a tracker, before it is mapped to a vehicle
+type DevicePosition struct {
+	DeviceID     string
+	Protocol     string
+	Latitude     float64
+	Longitude    float64
+	Speed        float64 // km/h
+	Heading      float64
+	Altitude     float64
+	Accuracy     float64
+	BatteryLevel int // -1 when not reported
+	Timestamp    time.Time
+}
+
+// deviceBinding is the cached vehicle and current assignment for a device
+type deviceBinding struct {
+	device   GPSDevice
+	driverID string
+	routeID  string
+	err      error // unknown or unassigned devices are cached too
+	loadedAt time.Time
+}
+
+// GPSIngestor normalizes positions from external trackers into GPSLocations
+type GPSIngestor struct {
+	mu       sync.RWMutex
+	bindings map[string]*deviceBinding
+	ttl      time.Duration
+}
+
+var gpsIngestor = &GPSIngestor{
+	bindings: make(map[string]*deviceBinding),
+	ttl:      time.Minute,
+}
+
+// createGPSDeviceTables creates the device registry
+func createGPSDeviceTables() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS gps_devices (
+			device_id VARCHAR(50) PRIMARY KEY,
+			vehicle_id VARCHAR(50) REFERENCES vehicles(vehicle_id),
+			protocol VARCHAR(20) DEFAULT 'osmand',
+			description VARCHAR(255) DEFAULT '',
+			active BOOLEAN DEFAULT false,
+			last_seen TIMESTAMP,
+			key_hash VARCHAR(64) UNIQUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_gps_devices_vehicle ON gps_devices(vehicle_id)`,
+		// Devices registered before keys were issued stay locked out until
+		// a manager gives them one
+		`ALTER TABLE gps_devices ADD COLUMN IF NOT EXISTS key_hash VARCHAR(64) UNIQUE`,
+	}
+}
+
+// InitializeGPSIngestion starts the NMEA TCP listener when GPS_NMEA_ADDR is set
+func InitializeGPSIngestion() error {
+	addr := os.Getenv("GPS_NMEA_ADDR")
+	if addr == "" {
+		return nil
+	}
+	return StartNMEAListener(addr)
+}
+
+// newDeviceKey makes a key for a tracker to report with. Only its hash is
+// stored.
+func newDeviceKey() (key, hash string) {
+	key = "gps_" + generateSecureToken(24)
+	return key, hashSessionToken(key)
+}
+
+// Ingest maps a device position to its vehicle and records it. The key
+// must be the one issued to the device.
+func (gi *GPSIngestor) Ingest(pos *DevicePosition, key string) (*GPSLocation, error) {
+	if gpsTracker == nil {
+		return nil, fmt.Errorf("GPS tracking is not initialized")
+	}
+
+	// An unregistered device fails exactly like a wrong key, after the same
+	// comparison, so callers can't probe for device IDs that exist
+	binding, err := gi.binding(pos.DeviceID)
+	if err != nil && !errors.Is(err, ErrUnknownDevice) {
+		return nil, err
+	}
+	keyHash := unknownDeviceKeyHash
+	if binding != nil && binding.device.keyHash != "" {
+		keyHash = binding.device.keyHash
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSessionToken(key)), []byte(keyHash)) != 1 ||
+		key == "" || binding == nil || binding.device.keyHash == "" {
+		return nil, ErrBadDeviceKey
+	}
+	if binding.err != nil {
+		return nil, binding.err
+	}
+
+	location := &GPSLocation{
+		VehicleID:    binding.device.VehicleID,
+		Latitude:     pos.Latitude,
+		Longitude:    pos.Longitude,
+		Speed:        pos.Speed,
+		Heading:      pos.Heading,
+		Accuracy:     pos.Accuracy,
+		Altitude:     pos.Altitude,
+		Timestamp:    pos.Timestamp,
+		DriverID:     binding.driverID,
+		RouteID:      binding.routeID,
+		Status:       "active",
+		BatteryLevel: pos.BatteryLevel,
+	}
+	if location.Speed < 1 {
+		location.Status = "idle"
+	}
+	if location.BatteryLevel < 0 || location.BatteryLevel > 100 {
+		location.BatteryLevel = 100
+	}
+	// Devices without a fix time, or with a badly wrong clock, get server time
+	if location.Timestamp.IsZero() || location.Timestamp.After(time.Now().Add(5*time.Minute)) {
+		location.Timestamp = time.Now()
+	}
+
+	if err := gpsTracker.UpdateLocation(location); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`UPDATE gps_devices SET last_seen = NOW() WHERE device_id = $1`, pos.DeviceID); err != nil {
+		log.Printf("GPS ingest: failed to update last_seen for %s: %v", pos.DeviceID, err)
+	}
+
+	// Keep the live map fed the same way the JSON endpoint does
+	select {
+	case sseHub.broadcast <- GPSUpdate{
+		VehicleID: location.VehicleID,
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+		Speed:     location.Speed,
+		Heading:   location.Heading,
+		Timestamp: location.Timestamp,
+		DriverID:  location.DriverID,
+		RouteID:   location.RouteID,
+		Status:    location.Status,
+	}:
+	default:
+	}
+
+	return location, nil
+}
+
+// binding returns the cached device mapping, reloading it after the TTL.
+// Devices must be registered by a manager first; unknown IDs are refused
+// rather than recorded. An unassigned device's binding carries its error,
+// so the caller can check the key before saying why it was turned away.
+func (gi *GPSIngestor) binding(deviceID string) (*deviceBinding, error) {
+	if deviceID == "" {
+		return nil, fmt.Errorf("device ID is required")
+	}
+
+	gi.mu.RLock()
+	b, ok := gi.bindings[deviceID]
+	gi.mu.RUnlock()
+	if ok && time.Since(b.loadedAt) < gi.ttl {
+		return b, nil
+	}
+
+	b = &deviceBinding{loadedAt: time.Now()}
+	var keyHash sql.NullString
+	err := db.QueryRow(`
+		SELECT device_id, COALESCE(vehicle_id, ''), COALESCE(protocol, ''), COALESCE(description, ''),
+		       COALESCE(active, false), key_hash
+		FROM gps_devices WHERE device_id = $1
+	`, deviceID).Scan(&b.device.DeviceID, &b.device.VehicleID, &b.device.Protocol,
+		&b.device.Description, &b.device.Active, &keyHash)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownDevice
+	} else if err != nil {
+		return nil, err
+	}
+	b.device.keyHash = keyHash.String
+	b.device.HasKey = keyHash.Valid
+
+	if !b.device.Active || b.device.VehicleID == "" {
+		b.err = ErrDeviceInactive
+		gi.store(deviceID, b)
+		return b, nil
+	}
+
+	// Driver and route come from the bus's current assignment
+	var driver, route sql.NullString
+	err = db.QueryRow(`
+		SELECT driver, route_id FROM route_assignments
+		WHERE bus_id = $1
+		ORDER BY assigned_date DESC
+		LIMIT 1
+	`, b.device.VehicleID).Scan(&driver, &route)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("GPS ingest: failed to look up assignment for vehicle %s: %v", b.device.VehicleID, err)
+	}
+	b.driverID = driver.String
+	b.routeID = route.String
+
+	gi.store(deviceID, b)
+	return b, nil
+}
+
+func (gi *GPSIngestor) store(deviceID string, b *deviceBinding) {
+	gi.mu.Lock()
+	gi.bindings[deviceID] = b
+	gi.mu.Unlock()
+}
+
+// Invalidate drops cached device mappings after registry changes
+func (gi *GPSIngestor) Invalidate() {
+	gi.mu.Lock()
+	gi.bindings = make(map[string]*deviceBinding)
+	gi.mu.Unlock()
+}
+
+// listGPSDevices returns all registered devices, assigned or not
+func listGPSDevices() ([]GPSDevice, error) {
+	devices := []GPSDevice{}
+	err := db.Select(&devices, `
+		SELECT device_id, COALESCE(vehicle_id, '') AS vehicle_id,
+		       COALESCE(protocol, '') AS protocol, COALESCE(description, '') AS description,
+		       COALESCE(active, false) AS active, last_seen, created_at,
+		       key_hash IS NOT NULL AS has_key
+		FROM gps_devices
+		ORDER BY active, device_id
+	`)
+	return devices, err
+}
+
+// saveGPSDevice registers a device or updates its assignment. A new key
+// is issued, and returned, when the device has none yet or rotateKey is
+// set; otherwise the returned key is empty.
+func saveGPSDevice(d *GPSDevice, rotateKey bool) (string, error) {
+	if d.Protocol == "" {
+		d.Protocol = ProtocolOsmAnd
+	}
+	key, hash := newDeviceKey()
+	var stored string
+	err := db.Get(&stored, `
+		INSERT INTO gps_devices (device_id, vehicle_id, protocol, description, active, key_hash)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6)
+		ON CONFLICT (device_id) DO UPDATE
+		SET vehicle_id = EXCLUDED.vehicle_id, protocol = EXCLUDED.protocol,
+		    description = EXCLUDED.description, active = EXCLUDED.active,
+		    key_hash = CASE WHEN $7 OR gps_devices.key_hash IS NULL
+		                    THEN EXCLUDED.key_hash ELSE gps_devices.key_hash END
+		RETURNING key_hash
+	`, d.DeviceID, d.VehicleID, d.Protocol, d.Description, d.Active, hash, rotateKey)
+	if err != nil {
+		return "", err
+	}
+	gpsIngestor.Invalidate()
+	d.HasKey = true
+	if stored != hash {
+		return "", nil
+	}
+	return key, nil
+}
+
+// decodeOsmAnd parses an OsmAnd / Traccar Client query string.
+// Speed is in knots as sent by the Traccar clients.
+func decodeOsmAnd(values url.Values) (*DevicePosition, error) {
+	pos := &DevicePosition{Protocol: ProtocolOsmAnd, BatteryLevel: -1}
+
+	pos.DeviceID = values.Get("id")
+	if pos.DeviceID == "" {
+		pos.DeviceID = values.Get("deviceid")
+	}
+	if pos.DeviceID == "" {
+		return nil, fmt.Errorf("missing device id")
+	}
+
+	latStr, lonStr := values.Get("lat"), values.Get("lon")
+	if loc := values.Get("location"); latStr == "" && loc != "" {
+		parts := strings.SplitN(loc, ",", 2)
+		if len(parts) == 2 {
+			latStr, lonStr = parts[0], parts[1]
+		}
+	}
+	var err error
+	if pos.Latitude, err = strconv.ParseFloat(latStr, 64); err != nil {
+		return nil, fmt.Errorf("invalid latitude %q", latStr)
+	}
+	if pos.Longitude, err = strconv.ParseFloat(lonStr, 64); err != nil {
+		return nil, fmt.Errorf("invalid longitude %q", lonStr)
+	}
+
+	if v, err := strconv.ParseFloat(values.Get("speed"), 64); err == nil {
+		pos.Speed = v * knotsToKmh
+	}
+	heading := values.Get("bearing")
+	if heading == "" {
+		heading = values.Get("heading")
+	}
+	if v, err := strconv.ParseFloat(heading, 64); err == nil {
+		pos.Heading = v
+	}
+	if v, err := strconv.ParseFloat(values.Get("altitude"), 64); err == nil {
+		pos.Altitude = v
+	}
+	if v, err := strconv.ParseFloat(values.Get("accuracy"), 64); err == nil {
+		pos.Accuracy = v
+	}
+	if v, err := strconv.ParseFloat(values.Get("batt"), 64); err == nil {
+		pos.BatteryLevel = int(v)
+	}
+
+	if ts := values.Get("timestamp"); ts != "" {
+		pos.Timestamp, err = parseDeviceTimestamp(ts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pos, nil
+}
+
+// parseDeviceTimestamp accepts unix seconds, unix milliseconds or RFC 3339
+func parseDeviceTimestamp(ts string) (time.Time, error) {
+	if n, err := strconv.ParseInt(ts, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05", ts); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", ts)
+}
+
+// nmeaSession tracks one TCP connection. The device logs in with its ID
+// and key first, then streams sentences; GGA altitude is carried onto the
+// next RMC.
+type nmeaSession struct {
+	deviceID string
+	key      string
+	altitude float64
+	accuracy float64
+}
+
+// handleLine consumes one line and returns a position when an RMC fix completes
+func (s *nmeaSession) handleLine(line string) (*DevicePosition, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("unrecognized line")
+	}
+	if !nmeaChecksumValid(line) {
+		return nil, fmt.Errorf("bad checksum")
+	}
+
+	body := line[1:]
+	if i := strings.IndexByte(body, '*'); i >= 0 {
+		body = body[:i]
+	}
+	fields := strings.Split(body, ",")
+	if len(fields[0]) < 3 {
+		return nil, nil
+	}
+
+	switch {
+	case fields[0] == "PGID":
+		// Login: $PGID,<device id>,<key>
+		if len(fields) < 3 || fields[1] == "" || fields[2] == "" {
+			return nil, fmt.Errorf("login must give the device ID and key")
+		}
+		s.deviceID, s.key = fields[1], fields[2]
+		return nil, nil
+	case strings.HasSuffix(fields[0], "GGA"):
+		// $GPGGA,time,lat,N,lon,E,quality,sats,hdop,altitude,M,...
+		if len(fields) > 9 {
+			if v, err := strconv.ParseFloat(fields[9], 64); err == nil {
+				s.altitude = v
+			}
+			if v, err := strconv.ParseFloat(fields[8], 64); err == nil {
+				s.accuracy = v * 5 // rough meters from HDOP
+			}
+		}
+		return nil, nil
+	case strings.HasSuffix(fields[0], "RMC"):
+		if s.deviceID == "" {
+			return nil, fmt.Errorf("position before device identification")
+		}
+		pos, err := parseNMEARMC(fields)
+		if err != nil || pos == nil {
+			return nil, err
+		}
+		pos.DeviceID = s.deviceID
+		pos.Altitude = s.altitude
+		pos.Accuracy = s.accuracy
+		return pos, nil
+	}
+	return nil, nil
+}
+
+// parseNMEARMC decodes $--RMC,hhmmss.ss,A,llll.ll,a,yyyyy.yy,a,knots,course,ddmmyy,...
+// Void fixes (status V) are skipped.
+func parseNMEARMC(fields []string) (*DevicePosition, error) {
+	if len(fields) < 10 {
+		return nil, fmt.Errorf("short RMC sentence")
+	}
+	if fields[2] != "A" {
+		return nil, nil
+	}
+
+	lat, err := parseNMEACoordinate(fields[3], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	lon, err := parseNMEACoordinate(fields[5], fields[6])
+	if err != nil {
+		return nil, err
+	}
+
+	pos := &DevicePosition{
+		Protocol:     ProtocolNMEA,
+		Latitude:     lat,
+		Longitude:    lon,
+		BatteryLevel: -1,
+	}
+	if v, err := strconv.ParseFloat(fields[7], 64); err == nil {
+		pos.Speed = v * knotsToKmh
+	}
+	if v, err := strconv.ParseFloat(fields[8], 64); err == nil {
+		pos.Heading = v
+	}
+
+	clock := fields[1]
+	if i := strings.IndexByte(clock, '.'); i >= 0 {
+		clock = clock[:i]
+	}
+	if t, err := time.Parse("020106150405", fields[9]+clock); err == nil {
+		pos.Timestamp = t
+	}
+
+	return pos, nil
+}
+
+// parseNMEACoordinate converts ddmm.mmmm / dddmm.mmmm with a hemisphere letter
+func parseNMEACoordinate(value, hemisphere string) (float64, error) {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		dot = len(value)
+	}
+	if dot < 3 {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+	degrees, err := strconv.ParseFloat(value[:dot-2], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+	minutes, err := strconv.ParseFloat(value[dot-2:], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate %q", value)
+	}
+
+	result := degrees + minutes/60
+	switch hemisphere {
+	case "S", "W":
+		result = -result
+	case "N", "E":
+	default:
+		return 0, fmt.Errorf("invalid hemisphere %q", hemisphere)
+	}
+	return result, nil
+}
+
+// nmeaChecksumValid checks the XOR checksum; sentences without one are accepted
+func nmeaChecksumValid(sentence string) bool {
+	star := strings.LastIndexByte(sentence, '*')
+	if star < 0 {
+		return true
+	}
+	expected, err := strconv.ParseUint(sentence[star+1:], 16, 8)
+	if err != nil {
+		return false
+	}
+	var sum byte
+	for i := 1; i < star; i++ {
+		sum ^= sentence[i]
+	}
+	return byte(expected) == sum
+}
+
+// StartNMEAListener accepts tracker connections streaming NMEA sentences
+func StartNMEAListener(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for NMEA devices on %s: %w", addr, err)
+	}
+	log.Printf("Listening for NMEA GPS devices on %s", addr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("NMEA listener: accept failed: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go handleNMEAConnection(conn)
+		}
+	}()
+	return nil
+}
+
+func handleNMEAConnection(conn net.Conn) {
+	defer conn.Close()
+
+	session := &nmeaSession{}
+	scanner := bufio.NewScanner(conn)
+	for {
+		// Trackers report every few seconds; a long silence means the link is dead
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		if !scanner.Scan() {
+			break
+		}
+
+		pos, err := session.handleLine(scanner.Text())
+		if err != nil {
+			log.Printf("NMEA %s (%s): %v", conn.RemoteAddr(), session.deviceID, err)
+			continue
+		}
+		if pos == nil {
+			continue
+		}
+		if _, err := gpsIngestor.Ingest(pos, session.key); err != nil {
+			log.Printf("NMEA device %s: %v", pos.DeviceID, err)
+			if errors.Is(err, ErrBadDeviceKey) {
+				return
+			}
+		}
+	}
+}
@@ -72,8 +72,8 @@ func (h *SSEHub) Run() {
 			log.Printf("SSE Hub: Broadcasting to %d clients", len(h.clients))
 			// Send to all connected clients
 			for clientID, client := range h.clients {
-				// Only send GPS updates to managers or the driver of the vehicle
-				if client.Role == "manager" || client.Username == update.DriverID {
+				// Only send GPS updates to fleet trackers or the driver of the vehicle
+				if roleHasPermission(client.Role, PermGPSView) || client.Username == update.DriverID {
 					log.Printf("SSE Hub: Sending to client %s", clientID)
 					select {
 					case client.Events <- data:
@@ -105,8 +105,8 @@ func gpsSSEHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if GPS is enabled (for managers)
-	if role == "manager" {
+	// Check if GPS is enabled (for fleet-wide viewers)
+	if roleHasPermission(role, PermGPSView) {
 		enabled, err := isGPSEnabled()
 		if err != nil {
 			log.Printf("Error checking GPS status: %v", err)
@@ -228,7 +228,7 @@ func isGPSEnabled() (bool, error) {
 // toggleGPSHandler enables/disables GPS tracking
 func toggleGPSHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := GetSession(r)
-	if err != nil || session == nil || session.Role != "manager" {
+	if err != nil || session == nil || !roleHasPermission(session.Role, PermGPSManage) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
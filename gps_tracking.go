@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"sync"
 	"time"
 	
@@ -73,6 +74,12 @@ func InitializeGPSTracking(database *sqlx.DB) error {
 	// Start cleanup routine for old GPS data
 	go gpsTracker.startCleanupRoutine()
 	
+	// Reconstruct trips from recent history
+	go gpsTracker.startTripBuilderRoutine()
+	
+	// Flag vehicles that overstay a zone between fixes
+	go geofenceMonitor.watchDwell(time.Minute)
+	
 	return nil
 }
 
@@ -151,6 +158,15 @@ func createGPSTrackingTables(db *sqlx.DB) error {
 		)`,
 	}
 	
+	// Polygon/corridor shapes and per-zone rules
+	queries = append(queries, createGeofenceRuleTables()...)
+	
+	// Columns used by the trip builder
+	queries = append(queries, createTripTables()...)
+	
+	// Registry for hardware trackers
+	queries = append(queries, createGPSDeviceTables()...)
+	
 	for _, query := range queries {
 		if _, err := db.Exec(query); err != nil {
 			return fmt.Errorf("failed to execute query: %w", err)
@@ -342,38 +358,9 @@ func (gt *GPSTracker) handleBroadcasts() {
 }
 
 // checkGeofences checks if a location triggers any geofence events
+// (enter/exit plus dwell, speed and allowed-hours rule violations)
 func (gt *GPSTracker) checkGeofences(location *GPSLocation) {
-	query := `
-		SELECT id, name, type, center_latitude, center_longitude, radius_meters
-		FROM geofences
-		WHERE active = true
-	`
-	
-	var geofences []struct {
-		ID              int     `db:"id"`
-		Name            string  `db:"name"`
-		Type            string  `db:"type"`
-		CenterLatitude  float64 `db:"center_latitude"`
-		CenterLongitude float64 `db:"center_longitude"`
-		RadiusMeters    float64 `db:"radius_meters"`
-	}
-	
-	if err := gt.db.Select(&geofences, query); err != nil {
-		log.Printf("Failed to load geofences: %v", err)
-		return
-	}
-	
-	for _, gf := range geofences {
-		distance := calculateDistance(
-			location.Latitude, location.Longitude,
-			gf.CenterLatitude, gf.CenterLongitude,
-		)
-		
-		if distance <= gf.RadiusMeters {
-			// Check if this is a new entry
-			gt.recordGeofenceEvent(location.VehicleID, gf.ID, "enter", location)
-		}
-	}
+	geofenceMonitor.Check(gt, location)
 }
 
 // recordGeofenceEvent records a geofence entry/exit event
@@ -462,62 +449,14 @@ func validateGPSLocation(loc *GPSLocation) error {
 func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	const R = 6371000 // Earth's radius in meters
 	
-	lat1Rad := lat1 * (3.14159265359 / 180)
-	lat2Rad := lat2 * (3.14159265359 / 180)
-	deltaLat := (lat2 - lat1) * (3.14159265359 / 180)
-	deltaLon := (lon2 - lon1) * (3.14159265359 / 180)
-	
-	a := (sin(deltaLat/2) * sin(deltaLat/2)) +
-		(cos(lat1Rad) * cos(lat2Rad) * sin(deltaLon/2) * sin(deltaLon/2))
-	c := 2 * atan2(sqrt(a), sqrt(1-a))
-	
-	return R * c
-}
-
-// Helper math functions
-func sin(x float64) float64 {
-	// Simple sine approximation
-	return x - (x*x*x)/6 + (x*x*x*x*x)/120
-}
+	lat1Rad := lat1 * math.Pi / 180
+	lat2Rad := lat2 * math.Pi / 180
+	deltaLat := (lat2 - lat1) * math.Pi / 180
+	deltaLon := (lon2 - lon1) * math.Pi / 180
 
-func cos(x float64) float64 {
-	// Simple cosine approximation
-	return 1 - (x*x)/2 + (x*x*x*x)/24
-}
-
-func sqrt(x float64) float64 {
-	// Newton's method for square root
-	if x == 0 {
-		return 0
-	}
-	guess := x
-	for i := 0; i < 10; i++ {
-		guess = (guess + x/guess) / 2
-	}
-	return guess
-}
+	a := math.Sin(deltaLat/2)*math.Sin(deltaLat/2) +
+		math.Cos(lat1Rad)*math.Cos(lat2Rad)*math.Sin(deltaLon/2)*math.Sin(deltaLon/2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
 
-func atan2(y, x float64) float64 {
-	// Simple atan2 approximation
-	if x > 0 {
-		return atan(y / x)
-	}
-	if x < 0 && y >= 0 {
-		return atan(y/x) + 3.14159265359
-	}
-	if x < 0 && y < 0 {
-		return atan(y/x) - 3.14159265359
-	}
-	if x == 0 && y > 0 {
-		return 3.14159265359 / 2
-	}
-	if x == 0 && y < 0 {
-		return -3.14159265359 / 2
-	}
-	return 0
+	return R * c
 }
-
-func atan(x float64) float64 {
-	// Simple arctangent approximation
-	return x - (x*x*x)/3 + (x*x*x*x*x)/5
-}
\ No newline at end of file
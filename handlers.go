@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -54,7 +55,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("Authentication failed for %s: %v", username, err)
 			data := map[string]interface{}{
-				"Error": "Invalid username or password",
+				"Error": lockoutMessage(err),
 			}
 			renderTemplate(w, r, "login.html", data)
 			return
@@ -69,35 +70,27 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Hold the session back until the second factor is checked
+		needs2FA, err := needsSecondFactor(user.Username)
+		if err != nil {
+			log.Printf("Failed to load two-factor status for %s: %v", username, err)
+			SendError(w, ErrInternal("Login is temporarily unavailable", err))
+			return
+		}
+		if needs2FA {
+			log.Printf("Password accepted for %s, waiting for second factor", username)
+			setPendingLoginCookie(w, r, startPendingLogin(user.Username))
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
 		// Authentication successful
 		log.Printf("Login successful for user: %s (role: %s)", username, user.Role)
+		startUserSession(w, r, user)
 
-		sessionToken := generateSessionToken()
-		storeSession(sessionToken, user)
-		log.Printf("Session created with token: %s for user: %s", sessionToken[:8]+"...", username)
-
-		// Detect if we're on HTTPS
-		isHTTPS := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     SessionCookieName,
-			Value:    sessionToken,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   isHTTPS, // Set based on protocol
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   86400,
-		})
-
-		log.Printf("Cookie set, redirecting user %s (role: %s)", username, user.Role)
-
-		if user.Role == "manager" {
-			log.Printf("Redirecting to manager dashboard")
-			http.Redirect(w, r, "/manager-dashboard", http.StatusSeeOther)
-		} else {
-			log.Printf("Redirecting to driver dashboard")
-			http.Redirect(w, r, "/driver-dashboard", http.StatusSeeOther)
-		}
+		home := homePath(user)
+		log.Printf("Redirecting %s to %s", username, home)
+		http.Redirect(w, r, home, http.StatusSeeOther)
 	}
 }
 
@@ -138,7 +131,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
 
-		err := createUser(username, password, "driver", "pending")
+		err := createUser(username, password, RoleDriver, "pending")
 		if err != nil {
 			data := map[string]interface{}{
 				"Data": map[string]interface{}{
@@ -167,7 +160,7 @@ func managerDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	if user.Role != "manager" {
+	if !hasPermission(user, PermDashboardView) {
 		log.Printf("User %s has role %s, not manager, redirecting", user.Username, user.Role)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
@@ -232,7 +225,7 @@ func managerDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	// Count actual drivers (users with role="driver")
 	driverCount := 0
 	for _, u := range users {
-		if u.Role == "driver" {
+		if u.Role == RoleDriver {
 			driverCount++
 		}
 	}
@@ -259,7 +252,7 @@ func managerDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	// Count active drivers (status = 'active' and role = 'driver')
 	activeDriverCount := 0
 	for _, u := range users {
-		if u.Role == "driver" && u.Status == "active" {
+		if u.Role == RoleDriver && u.Status == "active" {
 			activeDriverCount++
 		}
 	}
@@ -305,7 +298,7 @@ func managerDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	// Count active drivers and fix naming
 	activeDrivers := 0
 	for _, u := range users {
-		if u.Role == "driver" && u.Status == "active" {
+		if u.Role == RoleDriver && u.Status == "active" {
 			activeDrivers++
 		}
 	}
@@ -370,10 +363,12 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	var bus *Bus
 	var students []Student
 	var recentLogs []DriverLog
+	serviceDay := ServiceDay{Date: time.Now(), Type: DayTypeSchool}
 
 	// If driver has assignments, get the first one
 	if len(assignments) > 0 {
 		assignment := assignments[0]
+		serviceDay = routeServiceDay(assignment.RouteID, time.Now())
 		
 		// Get route details
 		routes, _ := dataCache.getRoutes()
@@ -396,6 +391,7 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		// Get students for this route
 		if studentsForRoute, err := getStudentsByRoute(assignment.RouteID); err == nil {
 			students = studentsForRoute
+			serviceDay.shiftStudentTimes(students)
 		}
 	}
 
@@ -403,7 +399,7 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	if db != nil {
 		query := `
 			SELECT driver, bus_id, route_id, date, period, departure_time, arrival_time, 
-			       begin_mileage, end_mileage, attendance, created_at
+			       begin_mileage, end_mileage, `+driverLogRiders+`, created_at
 			FROM driver_logs
 			WHERE driver = $1
 			ORDER BY date DESC, created_at DESC
@@ -422,7 +418,7 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		// Get today's logs for this driver
 		query := `
 			SELECT driver, bus_id, route_id, date, period, departure_time, arrival_time, 
-			       begin_mileage, end_mileage, attendance, created_at
+			       begin_mileage, end_mileage, `+driverLogRiders+`, created_at
 			FROM driver_logs
 			WHERE driver = $1 AND date = $2
 			ORDER BY created_at DESC
@@ -439,10 +435,7 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			
 			// Count students from attendance
-			if log.Attendance != "" {
-				// Parse attendance JSON if available
-				totalStudents += len(students) / 2 // Rough estimate for now
-			}
+			totalStudents += log.Riders
 		}
 		
 		// Calculate any safety issues (none for now, keep perfect score)
@@ -457,6 +450,9 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	
 	// If no routes today yet, show expected routes
 	expectedRoutes := 2 // Morning and afternoon
+	if !serviceDay.Running() {
+		expectedRoutes = 0
+	}
 	if totalRoutes == 0 && len(assignments) > 0 {
 		// Show as "0/2" if no routes completed yet
 		totalRoutes = 0
@@ -481,6 +477,8 @@ func driverDashboardHandler(w http.ResponseWriter, r *http.Request) {
 			"RecentLogs":         recentLogs,
 			"MaintenanceAlerts":  maintenanceAlerts,
 			"Assignments":        assignments,
+			"ServiceNote":        serviceDay.Note(),
+			"ServiceRunning":     serviceDay.Running(),
 			"Performance": map[string]interface{}{
 				"OnTimeRate":        onTimeRate,
 				"RoutesCompleted":   totalRoutes,
@@ -935,12 +933,22 @@ func updateVehicleStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A vehicle held by a work order comes back into service through the
+	// order's sign-off, not by editing its status
+	if req.FieldName == "status" && req.FieldValue != "out_of_service" {
+		if hold, err := vehicleHold(req.VehicleID); err == nil && hold != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Held out of service until work order #%d is signed off", hold.ID)})
+			return
+		}
+	}
+
 	// Update based on vehicle type
 	var err error
 	if req.VehicleType == "bus" {
-		err = updateBusField(req.VehicleID, req.FieldName, req.FieldValue)
+		err = updateBusField(auditActorFromRequest(r), req.VehicleID, req.FieldName, req.FieldValue)
 	} else {
-		err = updateVehicleField(req.VehicleID, req.FieldName, req.FieldValue)
+		err = updateVehicleField(auditActorFromRequest(r), req.VehicleID, req.FieldName, req.FieldValue)
 	}
 
 	if err != nil {
@@ -1039,31 +1047,48 @@ func saveLogHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build attendance JSON
-	var attendance []map[string]interface{}
-	for key, values := range r.Form {
-		if strings.HasPrefix(key, "present_") {
-			posStr := strings.TrimPrefix(key, "present_")
-			position, _ := strconv.Atoi(posStr)
-			pickupTime := r.FormValue("pickup_time_" + posStr)
-
-			// Checkbox will have value "on" if checked, absent if not checked
-			present := len(values) > 0 && (values[0] == "on" || values[0] == "true")
-			
-			attendanceRecord := map[string]interface{}{
-				"position":    position,
-				"present":     present,
-				"pickup_time": pickupTime,
-			}
-			attendance = append(attendance, attendanceRecord)
-		}
+	logDate, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
 	}
 
-	attendanceJSON, err := json.Marshal(attendance)
+	// Every student listed on the form gets an entry; an unchecked box is
+	// an absence
+	roster, err := getStudentsByRoute(routeID)
 	if err != nil {
-		http.Error(w, "Failed to process attendance", http.StatusInternalServerError)
+		SendError(w, ErrInternal("Failed to load students", err))
 		return
 	}
+	listed := make(map[string]bool)
+	for _, studentID := range r.Form["student"] {
+		listed[studentID] = true
+	}
+	var attendance []AttendanceEntry
+	for _, student := range roster {
+		if !listed[student.StudentID] {
+			continue
+		}
+		entry := AttendanceEntry{
+			StudentID:  student.StudentID,
+			Date:       logDate,
+			Period:     period,
+			RouteID:    sql.NullString{String: routeID, Valid: true},
+			Status:     "absent",
+			Source:     AttendanceSourceWeb,
+			RecordedBy: sql.NullString{String: user.Username, Valid: true},
+		}
+		if r.FormValue("present_"+student.StudentID) != "" {
+			entry.Status = "present"
+			at := clockOn(logDate, r.FormValue("time_"+student.StudentID))
+			if period == "morning" {
+				entry.BoardedAt = at
+			} else {
+				entry.AlightedAt = at
+			}
+		}
+		attendance = append(attendance, entry)
+	}
 
 	// Create driver log
 	driverLog := DriverLog{
@@ -1076,7 +1101,6 @@ func saveLogHandler(w http.ResponseWriter, r *http.Request) {
 		Arrival:      arrival,
 		BeginMileage: beginMileage,
 		EndMileage:   endMileage,
-		Attendance:   string(attendanceJSON),
 	}
 
 	// Save to database using transaction
@@ -1086,18 +1110,26 @@ func saveLogHandler(w http.ResponseWriter, r *http.Request) {
 		totalMileage := driverLog.EndMileage - driverLog.BeginMileage
 		
 		query := `
-			INSERT INTO driver_logs (driver, bus_id, route_id, date, period, departure_time, arrival_time, mileage, attendance)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			INSERT INTO driver_logs (driver, bus_id, route_id, date, period, departure_time, arrival_time, mileage)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING id
 		`
 
-		_, err := tx.Exec(query, driverLog.Driver, driverLog.BusID, driverLog.RouteID,
+		err := tx.QueryRow(query, driverLog.Driver, driverLog.BusID, driverLog.RouteID,
 			driverLog.Date, driverLog.Period, driverLog.Departure, driverLog.Arrival,
-			totalMileage, driverLog.Attendance)
+			totalMileage).Scan(&driverLog.ID)
 
 		if err != nil {
 			return fmt.Errorf("failed to save driver log: %w", err)
 		}
 
+		for _, entry := range attendance {
+			entry.DriverLogID = sql.NullInt64{Int64: int64(driverLog.ID), Valid: true}
+			if err := recordAttendance(tx, entry); err != nil {
+				return fmt.Errorf("failed to record attendance: %w", err)
+			}
+		}
+
 		// Update vehicle mileage
 		if err := updateVehicleMileageInTx(tx, busID, int(endMileage)); err != nil {
 			return fmt.Errorf("failed to update vehicle mileage: %w", err)
@@ -1157,7 +1189,7 @@ func checkMaintenanceDueHandler(w http.ResponseWriter, r *http.Request) {
 // debugMaintenanceRecordsHandler helps debug maintenance records
 func debugMaintenanceRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -1347,7 +1379,7 @@ func getStudentsByRouteIncludingInactive(routeID string) ([]Student, error) {
 }
 
 // Helper functions for updating vehicle fields
-func updateBusField(busID, fieldName, fieldValue string) error {
+func updateBusField(actor AuditActor, busID, fieldName, fieldValue string) error {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
 	}
@@ -1378,6 +1410,7 @@ func updateBusField(busID, fieldName, fieldValue string) error {
 		return fmt.Errorf("invalid field name: %s", fieldName)
 	}
 	
+	before := auditSnapshot("buses", "bus_id", busID)
 	_, err := db.Exec(query, fieldValue, busID)
 	if err != nil {
 		// Fallback to old buses table
@@ -1393,12 +1426,16 @@ func updateBusField(busID, fieldName, fieldValue string) error {
 			oldQuery = "UPDATE buses SET maintenance_notes = $1, updated_at = CURRENT_TIMESTAMP WHERE bus_id = $2"
 		}
 		_, oldErr := db.Exec(oldQuery, fieldValue, busID)
+		if oldErr == nil {
+			recordAudit(actor, AuditUpdate, "bus", busID, before, auditSnapshot("buses", "bus_id", busID))
+		}
 		return oldErr
 	}
+	recordAudit(actor, AuditUpdate, "bus", busID, before, auditSnapshot("buses", "bus_id", busID))
 	return err
 }
 
-func updateVehicleField(vehicleID, fieldName, fieldValue string) error {
+func updateVehicleField(actor AuditActor, vehicleID, fieldName, fieldValue string) error {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
 	}
@@ -1429,6 +1466,7 @@ func updateVehicleField(vehicleID, fieldName, fieldValue string) error {
 		return fmt.Errorf("invalid field name: %s", fieldName)
 	}
 	
+	before := auditSnapshot("vehicles", "vehicle_id", vehicleID)
 	_, err := db.Exec(query, fieldValue, vehicleID)
 	if err != nil {
 		// Fallback to old vehicles table
@@ -1444,8 +1482,12 @@ func updateVehicleField(vehicleID, fieldName, fieldValue string) error {
 			oldQuery = "UPDATE vehicles SET maintenance_notes = $1, updated_at = CURRENT_TIMESTAMP WHERE vehicle_id = $2"
 		}
 		_, oldErr := db.Exec(oldQuery, fieldValue, vehicleID)
+		if oldErr == nil {
+			recordAudit(actor, AuditUpdate, "vehicle", vehicleID, before, auditSnapshot("vehicles", "vehicle_id", vehicleID))
+		}
 		return oldErr
 	}
+	recordAudit(actor, AuditUpdate, "vehicle", vehicleID, before, auditSnapshot("vehicles", "vehicle_id", vehicleID))
 	return err
 }
 
@@ -1962,8 +2004,31 @@ func serviceRecordsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !hasPermission(user, PermMaintenanceEdit) {
+			SendError(w, ErrForbidden("You don't have permission to re-map service records"))
+			return
+		}
+		result, err := normalizeServiceRecords(true)
+		if err != nil {
+			SendError(w, ErrInternal("Failed to normalize service records", err))
+			return
+		}
+		recordAuditChanges(auditActorFromRequest(r), AuditUpdate, "service_record", "all", map[string]AuditChange{
+			"mapped":   {To: result.Mapped},
+			"unmapped": {To: result.Unmapped},
+		})
+		http.Redirect(w, r, fmt.Sprintf("/service-records?remapped=%d&unmapped=%d", result.Mapped, result.Unmapped), http.StatusSeeOther)
+		return
+	}
+
 	// Get filter parameters
 	vehicleFilter := r.URL.Query().Get("vehicle_filter")
+	statusFilter := r.URL.Query().Get("status")
 	startDate := r.URL.Query().Get("start_date")
 	endDate := r.URL.Query().Get("end_date")
 
@@ -1978,9 +2043,9 @@ func serviceRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	var records []ServiceRecord
 	var err error
 
-	if vehicleFilter != "" || startDate != "" || endDate != "" {
-		records, err = loadServiceRecordsByFilters(vehicleFilter, startDate, endDate)
-		log.Printf("DEBUG: Loading service records with filters - vehicle: %s, start: %s, end: %s", vehicleFilter, startDate, endDate)
+	if vehicleFilter != "" || statusFilter != "" || startDate != "" || endDate != "" {
+		records, err = loadServiceRecordsByFilters(vehicleFilter, statusFilter, startDate, endDate)
+		log.Printf("DEBUG: Loading service records with filters - vehicle: %s, status: %s, start: %s, end: %s", vehicleFilter, statusFilter, startDate, endDate)
 	} else {
 		records, err = loadServiceRecordsFromDB()
 		log.Printf("DEBUG: Loading all service records")
@@ -2038,24 +2103,20 @@ func serviceRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Calculate summary statistics
-	recordsWithData := 0
-	recordsWithMaintDate := 0
+	mappedRecords := 0
+	unmappedRecords := 0
+	needsService := 0
 	uniqueVehicles := make(map[string]bool)
 
 	for _, record := range records {
-		// Count records with meaningful data (non-header)
-		fields := record.GetAllFields()
-		if len(fields) > 0 {
-			recordsWithData++
-		}
-
-		if record.GetMaintenanceDate() != "" {
-			recordsWithMaintDate++
+		if record.Mapped() {
+			mappedRecords++
+			uniqueVehicles[record.VehicleID.String] = true
+		} else {
+			unmappedRecords++
 		}
-
-		vehicleInfo := record.GetVehicleInfo()
-		if vehicleInfo != "" && vehicleInfo != fmt.Sprintf("Record #%d", record.ID) {
-			uniqueVehicles[vehicleInfo] = true
+		if record.NeedsService.Bool {
+			needsService++
 		}
 	}
 
@@ -2066,11 +2127,16 @@ func serviceRecordsHandler(w http.ResponseWriter, r *http.Request) {
 		"Pagination":            pagination,
 		"TotalRecords":          totalRecords,
 		"SelectedVehicleFilter": vehicleFilter,
+		"SelectedStatus":        statusFilter,
 		"SelectedStartDate":     startDate,
 		"SelectedEndDate":       endDate,
-		"RecordsWithData":       recordsWithData,
-		"RecordsWithMaintDate":  recordsWithMaintDate,
+		"MappedRecords":         mappedRecords,
+		"UnmappedRecords":       unmappedRecords,
+		"NeedsService":          needsService,
 		"UniqueVehicles":        len(uniqueVehicles),
+		"Remapped":              r.URL.Query().Get("remapped"),
+		"RemapUnmapped":         r.URL.Query().Get("unmapped"),
+		"CanEdit":               hasPermission(user, PermMaintenanceEdit),
 		"Title":                 "Service Records",
 	}
 
@@ -10,7 +10,7 @@ import (
 // alertsAPIHandler handles API requests for alerts management
 func alertsAPIHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermAlertsManage) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -254,7 +254,7 @@ func generateSystemAlerts() {
 // metricsHistoryHandler returns historical metrics data
 func metricsHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -321,7 +321,7 @@ func metricsHistoryHandler(w http.ResponseWriter, r *http.Request) {
 // alertsSummaryHandler returns a summary of alerts by category
 func alertsSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermAlertsManage) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
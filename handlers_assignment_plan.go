@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// assignmentPlanHandler shows the planner's proposed assignments for the
+// whole district next to the current ones, and applies them on POST. The
+// period parameter limits the schedule check to morning or afternoon runs.
+func assignmentPlanHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		applyAssignmentPlanHandler(w, r, user)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if !validPlanPeriod(period) {
+		SendError(w, ErrBadRequest("Period must be morning or afternoon"))
+		return
+	}
+
+	problem, err := loadAssignmentProblem(period)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load assignment data", err))
+		return
+	}
+	plan := solveAssignmentPlan(problem)
+
+	applied, _ := strconv.Atoi(r.URL.Query().Get("applied"))
+	renderTemplate(w, r, "assignment_plan.html", map[string]interface{}{
+		"User":        user,
+		"CSRFToken":   getSessionCSRFToken(r),
+		"Plan":        plan,
+		"Period":      period,
+		"TotalRoutes": len(problem.Routes),
+		"Drivers":     len(problem.Drivers),
+		"Applied":     applied,
+		"Stale":       r.URL.Query().Get("error") == "stale",
+	})
+}
+
+// applyAssignmentPlanHandler solves again and applies the result, but only
+// if it's the plan the manager reviewed
+func applyAssignmentPlanHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	if !validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	period := r.FormValue("period")
+	if !validPlanPeriod(period) {
+		SendError(w, ErrBadRequest("Period must be morning or afternoon"))
+		return
+	}
+	back := func(key, value string) string {
+		q := url.Values{key: {value}}
+		if period != "" {
+			q.Set("period", period)
+		}
+		return "/assignment-plan?" + q.Encode()
+	}
+
+	problem, err := loadAssignmentProblem(period)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load assignment data", err))
+		return
+	}
+	plan := solveAssignmentPlan(problem)
+	if plan.Token != r.FormValue("token") {
+		http.Redirect(w, r, back("error", "stale"), http.StatusSeeOther)
+		return
+	}
+	if !plan.Optimal && r.FormValue("accept_not_optimal") != "1" {
+		SendError(w, ErrBadRequest("This plan may not be optimal; confirm that you want to apply it anyway"))
+		return
+	}
+
+	err = applyAssignmentPlan(plan)
+	if err == errPlanPeriod {
+		SendError(w, ErrBadRequest("Plans for one period are for review only; apply a whole-day plan"))
+		return
+	}
+	if err == errPlanStale {
+		http.Redirect(w, r, back("error", "stale"), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		SendError(w, ErrInternal("Failed to apply the plan", err))
+		return
+	}
+
+	for _, a := range plan.Removed {
+		auditRouteAssignment(r, "unassign", a.RouteID, a.Driver, a.BusID)
+	}
+	for _, a := range plan.Added {
+		auditRouteAssignment(r, "assign", a.RouteID, a.Driver, a.BusID)
+	}
+	log.Printf("%s applied the assignment plan: %d added, %d removed", user.Username, len(plan.Added), len(plan.Removed))
+
+	http.Redirect(w, r, back("applied", strconv.Itoa(len(plan.Added)+len(plan.Removed))), http.StatusSeeOther)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// auditEntityTypes lists the kinds of record that are audited, for the
+// filter dropdown
+var auditEntityTypes = []string{
+	"bus", "vehicle", "student", "user", "role", "route_assignment",
+	"budget", "import", "driver_credential", "route_plan",
+	"rfid_reader", "student_card", "calendar_day", "route", "work_order",
+	"part", "pm_program", "service_record",
+	"fuel_card", "fuel_card_provider", "fuel_card_import", "fuel_card_transaction",
+}
+
+// auditLogHandler is the searchable audit log. With entity_type and
+// entity_id set it doubles as a single record's change history.
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:      strings.TrimSpace(query.Get("actor")),
+		Action:     query.Get("action"),
+		EntityType: query.Get("entity_type"),
+		EntityID:   strings.TrimSpace(query.Get("entity_id")),
+		Search:     strings.TrimSpace(query.Get("q")),
+		From:       query.Get("from"),
+		To:         query.Get("to"),
+	}
+	filter.Page, _ = strconv.Atoi(query.Get("page"))
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	filter.HidePII = !hasPermission(user, PermStudentsViewPII)
+
+	entries, more, err := searchAuditLog(filter)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load audit log", err))
+		return
+	}
+	if filter.HidePII {
+		redactAuditPII(entries)
+	}
+
+	data := map[string]interface{}{
+		"User":        user,
+		"CSRFToken":   getSessionCSRFToken(r),
+		"Filter":      filter,
+		"Entries":     entries,
+		"EntityTypes": auditEntityTypes,
+		"History":     filter.EntityType != "" && filter.EntityID != "",
+	}
+
+	// Pagination links keep the current filters
+	pageURL := func(page int) string {
+		q := url.Values{}
+		for key, values := range query {
+			q[key] = values
+		}
+		q.Set("page", strconv.Itoa(page))
+		return "/audit?" + q.Encode()
+	}
+	if filter.Page > 1 {
+		data["PrevPage"] = pageURL(filter.Page - 1)
+	}
+	if more {
+		data["NextPage"] = pageURL(filter.Page + 1)
+	}
+
+	// Walking the whole chain is slow on a large log, so it's on request
+	if query.Get("verify") == "1" {
+		verification, err := verifyAuditChain()
+		if err != nil {
+			SendError(w, ErrInternal("Failed to verify audit log", err))
+			return
+		}
+		data["Verification"] = verification
+	}
+
+	renderTemplate(w, r, "audit.html", data)
+}
@@ -9,7 +9,7 @@ import (
 // dataStatusHandler returns JSON with current data counts
 func dataStatusHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
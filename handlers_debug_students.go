@@ -24,7 +24,7 @@ func debugStudentsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Test direct query
-	if user.Role == "driver" {
+	if !hasPermission(user, PermStudentsView) {
 		var count int
 		err := db.Get(&count, "SELECT COUNT(*) FROM students WHERE driver = $1 AND active = true", user.Username)
 		result["count_query"] = fmt.Sprintf("count=%d, error=%v", count, err)
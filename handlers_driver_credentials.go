@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// credentialDocumentTypes are the scans accepted as credential documents,
+// by detected content type
+var credentialDocumentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+// CredentialStatus is one credential type's standing for a driver
+type CredentialStatus struct {
+	Type       CredentialType
+	Credential *DriverCredential
+	Status     string
+	DaysLeft   int
+}
+
+// DriverCredentialSummary is one driver's row in the registry
+type DriverCredentialSummary struct {
+	Username    string
+	Credentials []CredentialStatus
+	Attention   bool // something is missing, expired or expiring
+}
+
+// credentialStatuses lists every credential type with the driver's record
+// of it, in registry order
+func credentialStatuses(credentials map[string]*DriverCredential, today time.Time) []CredentialStatus {
+	statuses := make([]CredentialStatus, len(credentialTypes))
+	for i, t := range credentialTypes {
+		c := credentials[t.Name]
+		statuses[i] = CredentialStatus{
+			Type:       t,
+			Credential: c,
+			Status:     c.Status(today),
+			DaysLeft:   c.DaysLeft(today),
+		}
+	}
+	return statuses
+}
+
+// driverCredentialsHandler is the credentials registry. Without a driver
+// it lists every driver's standing; with ?driver= it shows and edits one
+// driver's records. Drivers may view their own.
+func driverCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		saveDriverCredentialHandler(w, r, user)
+		return
+	}
+
+	driver := r.URL.Query().Get("driver")
+	if driver == "" && !hasPermission(user, PermDriversView) {
+		driver = user.Username
+	}
+	if driver != "" {
+		driverCredentialDetail(w, r, user, driver)
+		return
+	}
+
+	var drivers []string
+	err := db.Select(&drivers, `
+		SELECT username FROM users
+		WHERE role = $1 AND status = 'active'
+		ORDER BY username
+	`, RoleDriver)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load drivers", err))
+		return
+	}
+	all, err := getAllDriverCredentials()
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load credentials", err))
+		return
+	}
+
+	attentionOnly := r.URL.Query().Get("filter") == "attention"
+	today := time.Now()
+	var summaries []DriverCredentialSummary
+	attention := 0
+	for _, username := range drivers {
+		summary := DriverCredentialSummary{
+			Username:    username,
+			Credentials: credentialStatuses(all[username], today),
+		}
+		for _, s := range summary.Credentials {
+			if s.Status != CredentialValid {
+				summary.Attention = true
+				break
+			}
+		}
+		if summary.Attention {
+			attention++
+		} else if attentionOnly {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	renderTemplate(w, r, "driver_credentials.html", map[string]interface{}{
+		"User":            user,
+		"CSRFToken":       getSessionCSRFToken(r),
+		"CredentialTypes": credentialTypes,
+		"Drivers":         summaries,
+		"AttentionCount":  attention,
+		"AttentionOnly":   attentionOnly,
+		"WarningDays":     credentialExpiryWarningDays,
+	})
+}
+
+// driverCredentialDetail shows one driver's credentials
+func driverCredentialDetail(w http.ResponseWriter, r *http.Request, user *User, driver string) {
+	if driver != user.Username && !hasPermission(user, PermDriversView) {
+		SendError(w, ErrForbidden("You can only view your own credentials"))
+		return
+	}
+
+	var exists bool
+	if err := db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)`, driver); err != nil {
+		SendError(w, ErrInternal("Failed to load driver", err))
+		return
+	}
+	if !exists {
+		SendError(w, ErrNotFound("Driver"))
+		return
+	}
+
+	credentials, err := getDriverCredentials(driver)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load credentials", err))
+		return
+	}
+
+	renderTemplate(w, r, "driver_credential_detail.html", map[string]interface{}{
+		"User":        user,
+		"CSRFToken":   getSessionCSRFToken(r),
+		"Driver":      driver,
+		"Credentials": credentialStatuses(credentials, time.Now()),
+		"CanEdit":     hasPermission(user, PermDriversCredentials),
+		"Saved":       r.URL.Query().Get("saved"),
+		"WarningDays": credentialExpiryWarningDays,
+	})
+}
+
+// saveDriverCredentialHandler records or removes a driver's credential,
+// with an optional scan of the document
+func saveDriverCredentialHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	if !hasPermission(user, PermDriversCredentials) {
+		SendError(w, ErrForbidden("You don't have permission to edit driver credentials"))
+		return
+	}
+
+	// Leave headroom over the document itself for the other fields
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFileSize+1<<20)
+	if err := r.ParseMultipartForm(MaxFileSize); err != nil {
+		SendError(w, ErrBadRequest(fmt.Sprintf("Upload too large; documents must be under %d MB", MaxFileSize>>20)))
+		return
+	}
+	if !validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	driver := r.FormValue("driver")
+	credentialType := r.FormValue("credential_type")
+	if driver == "" || !isCredentialType(credentialType) {
+		SendError(w, ErrBadRequest("Driver and credential type are required"))
+		return
+	}
+	redirect := "/driver-credentials?driver=" + url.QueryEscape(driver)
+	actor := auditActorFromRequest(r)
+	entityID := driver + "/" + credentialType
+
+	var credentialID int
+	err := db.Get(&credentialID, `
+		SELECT id FROM driver_credentials WHERE username = $1 AND credential_type = $2
+	`, driver, credentialType)
+	if err != nil && err != sql.ErrNoRows {
+		SendError(w, ErrInternal("Failed to load credential", err))
+		return
+	}
+	var before map[string]interface{}
+	if credentialID != 0 {
+		before = auditSnapshot("driver_credentials", "id", credentialID)
+	}
+
+	if r.FormValue("action") == "delete" {
+		if credentialID != 0 {
+			if _, err := db.Exec(`DELETE FROM driver_credentials WHERE id = $1`, credentialID); err != nil {
+				SendError(w, ErrInternal("Failed to remove credential", err))
+				return
+			}
+			recordAudit(actor, AuditDelete, "driver_credential", entityID, before, nil)
+		}
+		http.Redirect(w, r, redirect+"&saved="+credentialType, http.StatusSeeOther)
+		return
+	}
+
+	credential := DriverCredential{
+		Username:       driver,
+		CredentialType: credentialType,
+		Number:         strings.TrimSpace(r.FormValue("credential_number")),
+		Notes:          strings.TrimSpace(r.FormValue("notes")),
+	}
+	if credentialType == CredentialCDL {
+		class := strings.ToUpper(strings.TrimSpace(r.FormValue("cdl_class")))
+		if class != "" && (len(class) != 1 || !strings.Contains("ABC", class)) {
+			SendError(w, ErrBadRequest("CDL class must be A, B or C"))
+			return
+		}
+		credential.CDLClass = sql.NullString{String: class, Valid: class != ""}
+		credential.Endorsements = normalizeEndorsements(strings.Join(r.Form["endorsements"], ""))
+	}
+	for field, target := range map[string]*sql.NullTime{
+		"issued_on":  &credential.IssuedOn,
+		"expires_on": &credential.ExpiresOn,
+	} {
+		value := r.FormValue(field)
+		if value == "" {
+			continue
+		}
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			SendError(w, ErrBadRequest("Dates must be in YYYY-MM-DD format"))
+			return
+		}
+		*target = sql.NullTime{Time: date, Valid: true}
+	}
+	if credential.IssuedOn.Valid && credential.ExpiresOn.Valid && credential.ExpiresOn.Time.Before(credential.IssuedOn.Time) {
+		SendError(w, ErrBadRequest("The expiry date can't be before the issue date"))
+		return
+	}
+
+	// Read the document before saving anything, so a bad upload changes nothing
+	var document []byte
+	var documentName, documentType string
+	file, header, err := r.FormFile("document")
+	if err == nil {
+		defer file.Close()
+		document, err = io.ReadAll(file)
+		if err != nil {
+			SendError(w, ErrBadRequest("Failed to read the uploaded document"))
+			return
+		}
+		documentType = http.DetectContentType(document)
+		if !credentialDocumentTypes[documentType] {
+			SendError(w, ErrBadRequest("Documents must be a PDF, JPEG or PNG"))
+			return
+		}
+		documentName = filepath.Base(header.Filename)
+	} else if err != http.ErrMissingFile {
+		SendError(w, ErrBadRequest("Failed to read the uploaded document"))
+		return
+	}
+
+	credentialID, err = saveDriverCredential(credential, user.Username)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to save credential", err))
+		return
+	}
+	action := AuditUpdate
+	if before == nil {
+		action = AuditCreate
+	}
+	recordAudit(actor, action, "driver_credential", entityID, before, auditSnapshot("driver_credentials", "id", credentialID))
+
+	if document != nil {
+		var previous sql.NullString
+		db.Get(&previous, `SELECT file_name FROM driver_credential_documents WHERE credential_id = $1`, credentialID)
+		if err := saveCredentialDocument(credentialID, documentName, documentType, document, user.Username); err != nil {
+			SendError(w, ErrInternal("Failed to save document", err))
+			return
+		}
+		change := AuditChange{To: documentName}
+		if previous.Valid {
+			change.From = previous.String
+		}
+		recordAuditChanges(actor, "upload", "driver_credential", entityID, map[string]AuditChange{"document": change})
+	}
+
+	log.Printf("%s saved %s credential for %s", user.Username, credentialType, driver)
+	http.Redirect(w, r, redirect+"&saved="+credentialType, http.StatusSeeOther)
+}
+
+// driverCredentialDocumentHandler serves a credential's scanned document
+// to the driver it belongs to and to anyone who can view drivers
+func driverCredentialDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		SendError(w, ErrBadRequest("Invalid document"))
+		return
+	}
+
+	var document struct {
+		Username    string `db:"username"`
+		FileName    string `db:"file_name"`
+		ContentType string `db:"content_type"`
+		Content     []byte `db:"content"`
+	}
+	err = db.Get(&document, `
+		SELECT c.username, d.file_name, d.content_type, d.content
+		FROM driver_credential_documents d
+		JOIN driver_credentials c ON c.id = d.credential_id
+		WHERE d.credential_id = $1
+	`, id)
+	if err == sql.ErrNoRows {
+		SendError(w, ErrNotFound("Document"))
+		return
+	}
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load document", err))
+		return
+	}
+	if document.Username != user.Username && !hasPermission(user, PermDriversView) {
+		SendError(w, ErrForbidden("You can only view your own documents"))
+		return
+	}
+
+	w.Header().Set("Content-Type", document.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", strings.ReplaceAll(document.FileName, `"`, "")))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(document.Content)
+}
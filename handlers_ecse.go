@@ -11,7 +11,7 @@ import (
 // ecseDashboardHandler shows ECSE student overview
 func ecseDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermECSEView) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -110,7 +110,7 @@ func ecseDashboardHandler(w http.ResponseWriter, r *http.Request) {
 // ecseStudentDetailsHandler shows individual ECSE student details
 func ecseStudentDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermECSEView) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -275,7 +275,7 @@ func getECSEStudentAttendance(studentID string) ([]ECSEAttendance, error) {
 // addECSEServiceHandler adds a new service for an ECSE student
 func addECSEServiceHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermECSEEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
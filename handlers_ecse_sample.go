@@ -9,7 +9,7 @@ import (
 // addSampleECSEDataHandler adds sample ECSE data for demonstration
 func addSampleECSEDataHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
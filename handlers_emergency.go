@@ -1060,11 +1060,11 @@ func triggerExternalEmergencySystems(alert *EmergencyAlert) {
 func getEmergencyRecipients(alert *EmergencyAlert) []Recipient {
 	var recipients []Recipient
 	
-	// Always include all managers
+	// Always include everyone who manages alerts
 	rows, _ := db.Query(`
 		SELECT id, username, email FROM users 
-		WHERE role = 'manager' AND approved = true
-	`)
+		WHERE role IN (SELECT role FROM role_permissions WHERE permission = $1) AND approved = true
+	`, PermAlertsManage)
 	defer rows.Close()
 	
 	for rows.Next() {
@@ -1112,11 +1112,11 @@ func getEmergencyRecipients(alert *EmergencyAlert) []Recipient {
 func getAllEmergencyContacts() []Recipient {
 	var recipients []Recipient
 	
-	// Get all managers
+	// Get everyone who manages alerts
 	rows, _ := db.Query(`
 		SELECT id, username, email, phone FROM users 
-		WHERE role = 'manager' AND approved = true
-	`)
+		WHERE role IN (SELECT role FROM role_permissions WHERE permission = $1) AND approved = true
+	`, PermAlertsManage)
 	defer rows.Close()
 	
 	for rows.Next() {
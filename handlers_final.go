@@ -32,7 +32,7 @@ func driverProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only allow viewing own profile unless manager
-	if driverUsername != user.Username && user.Role != "manager" {
+	if driverUsername != user.Username && !hasPermission(user, PermDriversView) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -57,11 +57,12 @@ func studentsHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("STUDENTS HANDLER: Starting for user=%s, role=%s", user.Username, user.Role)
 
-	// Load students based on user role
+	// Users who can't see every student only get the ones on their routes
+	canViewAll := hasPermission(user, PermStudentsView)
 	var students []Student
 	var err error
 	
-	if user.Role == "driver" {
+	if !canViewAll {
 		// Load only students assigned to this driver
 		log.Printf("STUDENTS HANDLER: Loading students for driver %s", user.Username)
 		
@@ -97,6 +98,10 @@ func studentsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("STUDENTS HANDLER: Query result for manager: %d students, error=%v", len(students), err)
 	}
 
+	if canViewAll && !hasPermission(user, PermStudentsViewPII) {
+		redactStudentPII(students)
+	}
+
 	if err != nil {
 		log.Printf("STUDENTS HANDLER ERROR: Loading students for user %s (role=%s): %v", user.Username, user.Role, err)
 		// Ensure we have an empty slice, not nil
@@ -118,7 +123,7 @@ func studentsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get routes for dropdown
 	var routes []Route
-	if user.Role == "driver" {
+	if !canViewAll {
 		// For drivers, get only their assigned routes
 		assignments, err := getDriverAssignments(user.Username)
 		if err == nil {
@@ -200,7 +205,12 @@ func addStudentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Drivers automatically get assigned as the driver for students they add
-	if user.Role == "driver" {
+	canEdit := hasPermission(user, PermStudentsEdit)
+	if !canEdit && !hasPermission(user, PermDriverOperate) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if !canEdit {
 		driver = user.Username
 		log.Printf("Driver %s adding student, setting driver field to %s", user.Username, driver)
 	} else if driver == "" {
@@ -235,6 +245,7 @@ func addStudentHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to add student", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(auditActorFromRequest(r), AuditCreate, "student", studentID, nil, auditSnapshot("students", "student_id", studentID))
 
 	// Clear cache
 	dataCache.clearStudents()
@@ -251,8 +262,9 @@ func addStudentWizardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get routes for dropdown
+	canEdit := hasPermission(user, PermStudentsEdit)
 	var routes []Route
-	if user.Role == "driver" {
+	if !canEdit {
 		// For drivers, get only their assigned routes
 		assignments, err := getDriverAssignments(user.Username)
 		if err == nil {
@@ -276,12 +288,12 @@ func addStudentWizardHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Get drivers for dropdown (managers only)
+	// Get drivers for dropdown (only when students can go on any route)
 	var drivers []User
-	if user.Role == "manager" {
+	if canEdit {
 		allUsers, _ := dataCache.getUsers()
 		for _, u := range allUsers {
-			if u.Role == "driver" && u.Status == "active" {
+			if u.Role == RoleDriver && u.Status == "active" {
 				drivers = append(drivers, u)
 			}
 		}
@@ -330,7 +342,7 @@ func lastMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
 // previewImportHandler previews import data
 func previewImportHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDataImport) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -385,6 +397,7 @@ func editStudentHandler(w http.ResponseWriter, r *http.Request) {
 	routeID := r.FormValue("route_id")
 
 	// Update student
+	before := auditSnapshot("students", "student_id", studentID)
 	_, err := db.Exec(`
 		UPDATE students 
 		SET name = $2, locations = $3, phone_number = $4, guardian = $5, route_id = $6
@@ -396,6 +409,7 @@ func editStudentHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to update student", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(auditActorFromRequest(r), AuditUpdate, "student", studentID, before, auditSnapshot("students", "student_id", studentID))
 
 	// Clear cache
 	dataCache.clearStudents()
@@ -419,12 +433,14 @@ func removeStudentHandler(w http.ResponseWriter, r *http.Request) {
 	studentID := r.FormValue("student_id")
 	
 	// Soft delete - just mark as inactive
+	before := auditSnapshot("students", "student_id", studentID)
 	_, err := db.Exec("UPDATE students SET active = false WHERE student_id = $1", studentID)
 	if err != nil {
 		log.Printf("Error removing student: %v", err)
 		http.Error(w, "Failed to remove student", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(auditActorFromRequest(r), "deactivate", "student", studentID, before, auditSnapshot("students", "student_id", studentID))
 
 	// Clear cache
 	dataCache.clearStudents()
@@ -10,7 +10,7 @@ import (
 // editBusHandler displays the edit bus form
 func editBusHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermFleetEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -27,12 +27,12 @@ func editBusHandler(w http.ResponseWriter, r *http.Request) {
 	err := db.QueryRow(`
 		SELECT bus_id, model, capacity, status, 
 			   current_mileage, last_oil_change, 
-			   last_tire_service, created_at
+			   last_tire_service, created_at, wheelchair_lift
 		FROM buses 
 		WHERE bus_id = $1
 	`, busID).Scan(&bus.BusID, &bus.Model, &bus.Capacity, &bus.Status,
 		&bus.CurrentMileage, &bus.LastOilChange, &bus.LastTireService,
-		&bus.CreatedAt)
+		&bus.CreatedAt, &bus.WheelchairLift)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -68,6 +68,7 @@ func editBusHandler(w http.ResponseWriter, r *http.Request) {
 		currentMileage := r.FormValue("current_mileage")
 		lastOilChange := r.FormValue("last_oil_change_miles")
 		lastTireChange := r.FormValue("last_tire_change_miles")
+		wheelchairLift := r.FormValue("wheelchair_lift") == "on"
 
 		// Validate inputs
 		capacityInt, err := strconv.Atoi(capacity)
@@ -104,6 +105,7 @@ func editBusHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Update bus
+		before := auditSnapshot("buses", "bus_id", busID)
 		_, err = db.Exec(`
 			UPDATE buses 
 			SET model = $1, 
@@ -112,9 +114,10 @@ func editBusHandler(w http.ResponseWriter, r *http.Request) {
 				current_mileage = $4,
 				last_oil_change = $5,
 				last_tire_service = $6,
+				wheelchair_lift = $7,
 				updated_at = NOW()
-			WHERE bus_id = $7
-		`, model, capacityInt, status, currentMileageInt, lastOilChangeInt, lastTireChangeInt, busID)
+			WHERE bus_id = $8
+		`, model, capacityInt, status, currentMileageInt, lastOilChangeInt, lastTireChangeInt, wheelchairLift, busID)
 
 		if err != nil {
 			log.Printf("Error updating bus: %v", err)
@@ -122,13 +125,7 @@ func editBusHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Log activity (if function exists)
-		// logActivity(db, &Activity{
-		// 	UserID:      user.Username,
-		// 	Action:      "update_bus",
-		// 	Description: fmt.Sprintf("Updated bus %s", busID),
-		// 	Timestamp:   time.Now(),
-		// })
+		recordAudit(auditActorFromRequest(r), AuditUpdate, "bus", busID, before, auditSnapshot("buses", "bus_id", busID))
 
 		// Redirect back to fleet page
 		http.Redirect(w, r, "/fleet", http.StatusSeeOther)
@@ -17,7 +17,7 @@ func fleetVehicleEditHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only managers can edit fleet vehicles
-	if user.Role != "manager" {
+	if !hasPermission(user, PermFleetEdit) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
@@ -110,7 +110,7 @@ func fleetVehicleAddHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only managers can add fleet vehicles
-	if user.Role != "manager" {
+	if !hasPermission(user, PermFleetEdit) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
@@ -172,8 +172,8 @@ func fleetVehicleAddHandler(w http.ResponseWriter, r *http.Request) {
 // API endpoint for fleet vehicle operations
 func apiFleetVehicleHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
-		SendError(w, ErrUnauthorized("Manager access required"))
+	if !hasPermission(user, PermFleetEdit) {
+		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
 
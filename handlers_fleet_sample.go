@@ -9,7 +9,7 @@ import (
 // addSampleFleetDataHandler adds sample fleet vehicles for demonstration
 func addSampleFleetDataHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -371,7 +371,7 @@ func getFuelVehicleAnalytics(startDate, endDate time.Time) ([]map[string]interfa
 // addSampleFuelDataHandler creates sample fuel records for demonstration
 func addSampleFuelDataHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
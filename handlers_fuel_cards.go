@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fuelCardVehicle is a vehicle as the fuel card page lists it
+type fuelCardVehicle struct {
+	VehicleID    string          `db:"vehicle_id"`
+	Class        string          `db:"class"`
+	Model        string          `db:"model"`
+	TankCapacity sql.NullFloat64 `db:"tank_capacity"`
+}
+
+// fuelCardsHandler imports fuel card statements and shows how each one
+// reconciled against drivers' fuel entries, along with the cards, tank
+// capacities and provider column mappings that reconciliation relies on
+func fuelCardsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxFileSize+1<<20)
+		if err := r.ParseMultipartForm(MaxFileSize); err != nil && err != http.ErrNotMultipart {
+			SendError(w, ErrBadRequest(fmt.Sprintf("Upload too large; statements must be under %d MB", MaxFileSize>>20)))
+			return
+		}
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !hasPermission(user, PermFuelEdit) {
+			SendError(w, ErrForbidden("You don't have permission to change fuel card records"))
+			return
+		}
+		if r.FormValue("action") == "import" {
+			importFuelCardsHandler(w, r, user)
+			return
+		}
+		updateFuelCardsFromForm(w, r, user)
+		return
+	}
+
+	renderFuelCardsPage(w, r, user, nil)
+}
+
+// renderFuelCardsPage shows one import's transactions, the latest unless
+// another is asked for, along with the result of an import just made
+func renderFuelCardsPage(w http.ResponseWriter, r *http.Request, user *User, imported *FuelCardImportResult) {
+	var providers []FuelCardProvider
+	if err := db.Select(&providers, `SELECT * FROM fuel_card_providers ORDER BY name`); err != nil {
+		SendError(w, ErrInternal("Failed to load card providers", err))
+		return
+	}
+	var imports []FuelCardImport
+	if err := db.Select(&imports, `
+		SELECT i.*, p.name AS provider_name FROM fuel_card_imports i
+		LEFT JOIN fuel_card_providers p ON p.id = i.provider_id
+		ORDER BY i.imported_at DESC LIMIT 20
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load imports", err))
+		return
+	}
+	var cards []FuelCard
+	if err := db.Select(&cards, `SELECT * FROM fuel_cards ORDER BY active DESC, vehicle_id, card_number`); err != nil {
+		SendError(w, ErrInternal("Failed to load fuel cards", err))
+		return
+	}
+	var vehicles []fuelCardVehicle
+	if err := db.Select(&vehicles, `
+		SELECT bus_id AS vehicle_id, 'bus' AS class, COALESCE(model, '') AS model, tank_capacity FROM buses
+		UNION ALL
+		SELECT vehicle_id, 'vehicle', COALESCE(model, ''), tank_capacity FROM vehicles
+		ORDER BY class, vehicle_id
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load vehicles", err))
+		return
+	}
+
+	var selected *FuelCardImport
+	importID, _ := strconv.Atoi(r.URL.Query().Get("import"))
+	if imported != nil {
+		importID = imported.Import.ID
+	}
+	for i := range imports {
+		if imports[i].ID == importID || (importID == 0 && i == 0) {
+			selected = &imports[i]
+			break
+		}
+	}
+
+	flaggedOnly := r.URL.Query().Get("flagged") == "1"
+	var txns []FuelCardTransaction
+	var unmatched []FuelRecord
+	if selected != nil {
+		query := `SELECT ` + fuelCardTransactionColumns + ` FROM fuel_card_transactions WHERE import_id = $1`
+		if flaggedOnly {
+			query += ` AND cardinality(flags) > 0`
+		}
+		if err := db.Select(&txns, query+` ORDER BY transacted_at, id`, selected.ID); err != nil {
+			SendError(w, ErrInternal("Failed to load transactions", err))
+			return
+		}
+		var err error
+		if unmatched, err = unmatchedFuelEntries(*selected); err != nil {
+			log.Printf("Failed to load unmatched fuel entries: %v", err)
+		}
+	}
+
+	var editing *FuelCardProvider
+	if id, err := strconv.Atoi(r.URL.Query().Get("provider")); err == nil {
+		for i := range providers {
+			if providers[i].ID == id {
+				editing = &providers[i]
+			}
+		}
+	}
+
+	renderTemplate(w, r, "fuel_cards.html", map[string]interface{}{
+		"User":         user,
+		"CSRFToken":    getSessionCSRFToken(r),
+		"Providers":    providers,
+		"Imports":      imports,
+		"Selected":     selected,
+		"Transactions": txns,
+		"Unmatched":    unmatched,
+		"FlaggedOnly":  flaggedOnly,
+		"Cards":        cards,
+		"Vehicles":     vehicles,
+		"Editing":      editing,
+		"Imported":     imported,
+		"FlagLabels":   fuelFlagLabels,
+		"Saved":        r.URL.Query().Get("saved") == "1",
+		"CanEdit":      hasPermission(user, PermFuelEdit),
+	})
+}
+
+// importFuelCardsHandler brings in an uploaded statement
+func importFuelCardsHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	var provider FuelCardProvider
+	if err := db.Get(&provider, `SELECT * FROM fuel_card_providers WHERE id = $1`, r.FormValue("provider_id")); err != nil {
+		SendError(w, ErrBadRequest("Choose the card provider the statement is from"))
+		return
+	}
+	file, header, err := r.FormFile("statement")
+	if err != nil {
+		SendError(w, ErrBadRequest("Choose a CSV or XLSX statement to import"))
+		return
+	}
+	defer file.Close()
+
+	rows, err := readStatementRows(file, header.Filename)
+	if err == nil {
+		var result *FuelCardImportResult
+		result, err = importFuelCardStatement(provider, rows, header.Filename, user.Username)
+		if result != nil {
+			recordAuditChanges(auditActorFromRequest(r), "import", "fuel_card_import", strconv.Itoa(result.Import.ID), map[string]AuditChange{
+				"provider": {To: provider.Name},
+				"file":     {To: header.Filename},
+				"imported": {To: result.Import.Imported},
+				"flagged":  {To: result.Import.Flagged},
+			})
+			log.Printf("%s imported %d fuel card transaction(s) from %s", user.Username, result.Import.Imported, header.Filename)
+			if err != nil {
+				log.Printf("Failed to reconcile fuel card import %d: %v", result.Import.ID, err)
+			}
+			renderFuelCardsPage(w, r, user, result)
+			return
+		}
+	}
+
+	var refused fuelCardError
+	if errors.As(err, &refused) {
+		SendError(w, ErrBadRequest(string(refused)))
+		return
+	}
+	SendError(w, ErrInternal("Failed to import statement", err))
+}
+
+// updateFuelCardsFromForm applies one of the page's other actions
+func updateFuelCardsFromForm(w http.ResponseWriter, r *http.Request, user *User) {
+	redirect := "/fuel-cards?saved=1"
+	var err error
+	var entity, entityID string
+	action := AuditUpdate
+	changes := map[string]AuditChange{}
+
+	switch r.FormValue("action") {
+	case "recheck":
+		importID, _ := strconv.Atoi(r.FormValue("import_id"))
+		err = reconcileFuelCardImport(importID)
+		entity, entityID = "fuel_card_import", strconv.Itoa(importID)
+		changes["reconciled"] = AuditChange{To: true}
+		redirect += "&import=" + entityID
+	case "review":
+		id, _ := strconv.Atoi(r.FormValue("transaction_id"))
+		note := strings.TrimSpace(r.FormValue("review_note"))
+		var importID int
+		err = db.Get(&importID, `
+			UPDATE fuel_card_transactions SET reviewed_by = $2, reviewed_at = CURRENT_TIMESTAMP, review_note = $3
+			WHERE id = $1 RETURNING import_id
+		`, id, user.Username, note)
+		entity, entityID = "fuel_card_transaction", strconv.Itoa(id)
+		changes["reviewed"] = AuditChange{To: note}
+		redirect += fmt.Sprintf("&import=%d", importID)
+	case "save_card":
+		providerID, _ := strconv.Atoi(r.FormValue("provider_id"))
+		card := FuelCard{
+			CardNumber: r.FormValue("card_number"),
+			VehicleID:  strings.TrimSpace(r.FormValue("vehicle_id")),
+			ProviderID: sql.NullInt64{Int64: int64(providerID), Valid: providerID != 0},
+			Notes:      strings.TrimSpace(r.FormValue("notes")),
+			Active:     r.FormValue("active") != "off",
+		}
+		var previous sql.NullString
+		_ = db.Get(&previous, `SELECT vehicle_id FROM fuel_cards WHERE card_number = $1`, fuelCardKey(card.CardNumber))
+		entity = "fuel_card"
+		entityID, err = saveFuelCard(card)
+		if !previous.Valid {
+			action = AuditCreate
+		}
+		changes["vehicle_id"] = AuditChange{From: previous.String, To: card.VehicleID}
+		changes["active"] = AuditChange{To: card.Active}
+	case "tank":
+		vehicleID := strings.TrimSpace(r.FormValue("vehicle_id"))
+		gallons, parseErr := strconv.ParseFloat(strings.TrimSpace(r.FormValue("tank_capacity")), 64)
+		if parseErr != nil || gallons < 0 || gallons > 500 {
+			SendError(w, ErrBadRequest("Tank capacity must be a number of gallons, or 0 to clear it"))
+			return
+		}
+		var previous float64
+		previous, entity, err = setTankCapacity(vehicleID, gallons)
+		entityID = vehicleID
+		changes["tank_capacity"] = AuditChange{From: previous, To: gallons}
+	case "save_provider":
+		p := FuelCardProvider{
+			Name:            truncateString(r.FormValue("name"), 100),
+			DateColumn:      truncateString(strings.TrimSpace(r.FormValue("date_column")), 100),
+			TimeColumn:      truncateString(strings.TrimSpace(r.FormValue("time_column")), 100),
+			CardColumn:      truncateString(strings.TrimSpace(r.FormValue("card_column")), 100),
+			VehicleColumn:   truncateString(strings.TrimSpace(r.FormValue("vehicle_column")), 100),
+			GallonsColumn:   truncateString(strings.TrimSpace(r.FormValue("gallons_column")), 100),
+			AmountColumn:    truncateString(strings.TrimSpace(r.FormValue("amount_column")), 100),
+			PriceColumn:     truncateString(strings.TrimSpace(r.FormValue("price_column")), 100),
+			OdometerColumn:  truncateString(strings.TrimSpace(r.FormValue("odometer_column")), 100),
+			LocationColumn:  truncateString(strings.TrimSpace(r.FormValue("location_column")), 200),
+			DriverColumn:    truncateString(strings.TrimSpace(r.FormValue("driver_column")), 100),
+			ReferenceColumn: truncateString(strings.TrimSpace(r.FormValue("reference_column")), 100),
+		}
+		p.ID, _ = strconv.Atoi(r.FormValue("provider_id"))
+		if p.ID == 0 {
+			action = AuditCreate
+		}
+		var id int
+		id, err = saveFuelCardProvider(p)
+		entity, entityID = "fuel_card_provider", strconv.Itoa(id)
+		changes["name"] = AuditChange{To: p.Name}
+		changes["card_column"] = AuditChange{To: p.CardColumn}
+		changes["vehicle_column"] = AuditChange{To: p.VehicleColumn}
+		changes["gallons_column"] = AuditChange{To: p.GallonsColumn}
+	default:
+		SendError(w, ErrBadRequest("Unknown action"))
+		return
+	}
+	if err != nil {
+		var refused fuelCardError
+		switch {
+		case errors.As(err, &refused):
+			SendError(w, ErrConflict(string(refused)))
+		case errors.Is(err, sql.ErrNoRows):
+			SendError(w, ErrNotFound("Record"))
+		default:
+			SendError(w, ErrInternal("Failed to update fuel card records", err))
+		}
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), action, entity, entityID, changes)
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
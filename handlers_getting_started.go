@@ -17,14 +17,7 @@ func gettingStartedHandler(w http.ResponseWriter, r *http.Request) {
 	// Get role from URL parameter or user session
 	role := r.URL.Query().Get("role")
 	if role == "" {
-		// Determine role from user
-		if session.Role == "manager" {
-			role = "manager"
-		} else if session.Role == "driver" {
-			role = "driver"
-		} else {
-			role = "general"
-		}
+		role = guideAudience(session)
 	}
 
 	// Data structure for the guide
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 	
 	"github.com/gorilla/websocket"
@@ -202,40 +204,239 @@ func gpsHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// geofenceHandler manages geofences
-func geofenceHandler(w http.ResponseWriter, r *http.Request) {
+// gpsOsmAndHandler accepts OsmAnd / Traccar Client updates from hardware
+// trackers and phones. Devices can't log in, so each sends the key issued
+// when it was registered in the Authorization header.
+func gpsOsmAndHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		SendError(w, ErrMethodNotAllowed("Method not allowed"))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		SendError(w, ErrBadRequest("Invalid request: "+err.Error()))
+		return
+	}
+	
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if key == "" {
+		SendError(w, ErrUnauthorized("A device key is required"))
+		return
+	}
+	
+	pos, err := decodeOsmAnd(r.Form)
+	if err != nil {
+		SendError(w, ErrBadRequest("Invalid position: "+err.Error()))
+		return
+	}
+	
+	if _, err := gpsIngestor.Ingest(pos, key); err != nil {
+		if err == ErrBadDeviceKey {
+			SendError(w, ErrUnauthorized(err.Error()))
+			return
+		}
+		if err == ErrDeviceInactive {
+			SendError(w, ErrForbidden(err.Error()))
+			return
+		}
+		SendError(w, ErrInternal("Failed to record position", err))
+		return
+	}
+	
+	// Traccar clients only look at the status code
+	w.WriteHeader(http.StatusOK)
+}
+
+// gpsDevicesHandler manages the tracker-to-vehicle registry
+func gpsDevicesHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
-		SendError(w, ErrUnauthorized("Manager access required"))
+	if !hasPermission(user, PermGPSView) {
+		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
 	
 	switch r.Method {
 	case http.MethodGet:
-		// List all geofences
-		query := `
-			SELECT id, name, type, center_latitude, center_longitude, 
-			       radius_meters, metadata, active, created_at
-			FROM geofences
-			ORDER BY name
-		`
+		devices, err := listGPSDevices()
+		if err != nil {
+			SendError(w, ErrDatabase("Failed to load GPS devices", err))
+			return
+		}
+		SendJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"devices": devices,
+		})
 		
-		var geofences []struct {
-			ID              int             `json:"id" db:"id"`
-			Name            string          `json:"name" db:"name"`
-			Type            string          `json:"type" db:"type"`
-			CenterLatitude  float64         `json:"center_latitude" db:"center_latitude"`
-			CenterLongitude float64         `json:"center_longitude" db:"center_longitude"`
-			RadiusMeters    float64         `json:"radius_meters" db:"radius_meters"`
-			Metadata        json.RawMessage `json:"metadata" db:"metadata"`
-			Active          bool            `json:"active" db:"active"`
-			CreatedAt       time.Time       `json:"created_at" db:"created_at"`
+	case http.MethodPost:
+		var req struct {
+			GPSDevice
+			RotateKey bool `json:"rotate_key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			SendError(w, ErrBadRequest("Invalid request data: "+err.Error()))
+			return
+		}
+		device := req.GPSDevice
+		if device.DeviceID == "" {
+			SendError(w, ErrBadRequest("Device ID is required"))
+			return
 		}
+		if device.Active && device.VehicleID == "" {
+			SendError(w, ErrBadRequest("Active devices must be assigned to a vehicle"))
+			return
+		}
+		key, err := saveGPSDevice(&device, req.RotateKey)
+		if err != nil {
+			SendError(w, ErrDatabase("Failed to save GPS device", err))
+			return
+		}
+		response := map[string]interface{}{
+			"success": true,
+			"device":  device,
+		}
+		// The key is only ever shown here, when it is issued
+		if key != "" {
+			response["key"] = key
+		}
+		SendJSON(w, http.StatusOK, response)
+		
+	case http.MethodDelete:
+		deviceID := r.URL.Query().Get("device_id")
+		if deviceID == "" {
+			SendError(w, ErrBadRequest("Device ID is required"))
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM gps_devices WHERE device_id = $1`, deviceID); err != nil {
+			SendError(w, ErrDatabase("Failed to delete GPS device", err))
+			return
+		}
+		gpsIngestor.Invalidate()
+		SendJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+		})
 		
-		if err := db.Select(&geofences, query); err != nil {
+	default:
+		SendError(w, ErrMethodNotAllowed("Method not allowed"))
+	}
+}
+
+// gpsTripsHandler lists reconstructed trips for a vehicle and day.
+// POST rebuilds the day's trips from GPS history first.
+func gpsTripsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermGPSView) {
+		SendError(w, ErrUnauthorized("Access denied"))
+		return
+	}
+	
+	vehicleID := r.URL.Query().Get("vehicle_id")
+	if vehicleID == "" {
+		SendError(w, ErrBadRequest("Vehicle ID required"))
+		return
+	}
+	
+	day := time.Now()
+	if dateStr := r.URL.Query().Get("date"); dateStr != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", dateStr, time.Local)
+		if err != nil {
+			SendError(w, ErrBadRequest("Invalid date: "+err.Error()))
+			return
+		}
+		day = parsed
+	}
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	end := start.Add(24 * time.Hour)
+	
+	var trips []Trip
+	var err error
+	
+	switch r.Method {
+	case http.MethodGet:
+		trips, err = gpsTracker.GetTrips(vehicleID, start, end)
+	case http.MethodPost:
+		trips, err = gpsTracker.BuildTrips(vehicleID, start, end)
+	default:
+		SendError(w, ErrMethodNotAllowed("Method not allowed"))
+		return
+	}
+	if err != nil {
+		SendError(w, ErrDatabase("Failed to load trips", err))
+		return
+	}
+	
+	SendJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"vehicle_id": vehicleID,
+		"date":       start.Format("2006-01-02"),
+		"trips":      trips,
+	})
+}
+
+// gpsTripPlaybackHandler returns a trip as a time-indexed polyline
+// with its stops and harsh-driving markers for replay on a map
+func gpsTripPlaybackHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermGPSView) {
+		SendError(w, ErrUnauthorized("Access denied"))
+		return
+	}
+	
+	tripID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		SendError(w, ErrBadRequest("Valid trip ID required"))
+		return
+	}
+	
+	maxPoints := 2000
+	if mp := r.URL.Query().Get("max_points"); mp != "" {
+		if n, err := strconv.Atoi(mp); err == nil && n > 1 {
+			maxPoints = n
+		}
+	}
+	
+	trip, err := gpsTracker.GetTrip(tripID)
+	if err == sql.ErrNoRows {
+		SendError(w, ErrNotFound("Trip"))
+		return
+	} else if err != nil {
+		SendError(w, ErrDatabase("Failed to load trip", err))
+		return
+	}
+	
+	points, err := gpsTracker.Playback(trip, maxPoints)
+	if err != nil {
+		SendError(w, ErrDatabase("Failed to load trip points", err))
+		return
+	}
+	
+	SendJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"trip":     trip,
+		"duration": trip.EndTime.Sub(trip.StartTime).Seconds(),
+		"points":   points,
+		"stops":    trip.Stops,
+		"events":   trip.Events,
+	})
+}
+
+// geofenceHandler manages geofences
+func geofenceHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermGPSManage) {
+		SendError(w, ErrUnauthorized("Access denied"))
+		return
+	}
+	
+	switch r.Method {
+	case http.MethodGet:
+		// List all geofences with their rules
+		geofences, err := loadGeofences(false)
+		if err != nil {
 			SendError(w, ErrDatabase("Failed to load geofences", err))
 			return
 		}
+		if geofences == nil {
+			geofences = []*Geofence{}
+		}
 		
 		SendJSON(w, http.StatusOK, map[string]interface{}{
 			"success":   true,
@@ -243,54 +444,32 @@ func geofenceHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		
 	case http.MethodPost:
-		// Create new geofence
-		var req struct {
-			Name            string          `json:"name"`
-			Type            string          `json:"type"`
-			CenterLatitude  float64         `json:"center_latitude"`
-			CenterLongitude float64         `json:"center_longitude"`
-			RadiusMeters    float64         `json:"radius_meters"`
-			Metadata        json.RawMessage `json:"metadata"`
-		}
-		
+		// Create new geofence (circle, polygon or route corridor)
+		var req Geofence
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			SendError(w, ErrBadRequest("Invalid request data: "+err.Error()))
 			return
 		}
-		
-		// Validate
-		if req.Name == "" || req.Type == "" {
-			SendError(w, ErrBadRequest("Name and type are required"))
-			return
+		if req.Shape == "" {
+			req.Shape = GeofenceShapeCircle
 		}
 		
-		if req.RadiusMeters <= 0 {
-			SendError(w, ErrBadRequest("Radius must be positive"))
+		// Validate
+		if err := req.Validate(); err != nil {
+			SendError(w, ErrBadRequest(err.Error()))
 			return
 		}
 		
-		// Insert geofence
-		var id int
-		query := `
-			INSERT INTO geofences (name, type, center_latitude, center_longitude, radius_meters, metadata)
-			VALUES ($1, $2, $3, $4, $5, $6)
-			RETURNING id
-		`
-		
-		err := db.QueryRow(
-			query, req.Name, req.Type, req.CenterLatitude,
-			req.CenterLongitude, req.RadiusMeters, req.Metadata,
-		).Scan(&id)
-		
-		if err != nil {
+		if err := saveGeofence(&req); err != nil {
 			SendError(w, ErrDatabase("Failed to create geofence", err))
 			return
 		}
 		
 		SendJSON(w, http.StatusCreated, map[string]interface{}{
-			"success": true,
-			"message": "Geofence created successfully",
-			"id":      id,
+			"success":  true,
+			"message":  "Geofence created successfully",
+			"id":       req.ID,
+			"geofence": req,
 		})
 		
 	case http.MethodDelete:
@@ -302,11 +481,17 @@ func geofenceHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		
+		// Events reference the geofence, so remove them first
+		if _, err := db.Exec("DELETE FROM geofence_events WHERE geofence_id = $1", id); err != nil {
+			SendError(w, ErrDatabase("Failed to delete geofence events", err))
+			return
+		}
 		_, err = db.Exec("DELETE FROM geofences WHERE id = $1", id)
 		if err != nil {
 			SendError(w, ErrDatabase("Failed to delete geofence", err))
 			return
 		}
+		geofenceMonitor.Invalidate()
 		
 		SendJSON(w, http.StatusOK, map[string]interface{}{
 			"success": true,
@@ -318,6 +503,169 @@ func geofenceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// geofenceRulesHandler manages dwell, speed and allowed-hours rules on a geofence
+func geofenceRulesHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermGPSManage) {
+		SendError(w, ErrUnauthorized("Access denied"))
+		return
+	}
+	
+	switch r.Method {
+	case http.MethodGet:
+		geofenceID, err := strconv.Atoi(r.URL.Query().Get("geofence_id"))
+		if err != nil {
+			SendError(w, ErrBadRequest("Invalid geofence ID"))
+			return
+		}
+		rules, err := loadGeofenceRules(geofenceID)
+		if err != nil {
+			SendError(w, ErrDatabase("Failed to load geofence rules", err))
+			return
+		}
+		if rules == nil {
+			rules = []GeofenceRule{}
+		}
+		SendJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"rules":   rules,
+		})
+		
+	case http.MethodPost:
+		var rule GeofenceRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			SendError(w, ErrBadRequest("Invalid request data: "+err.Error()))
+			return
+		}
+		if rule.GeofenceID == 0 {
+			SendError(w, ErrBadRequest("Geofence ID is required"))
+			return
+		}
+		if err := rule.Validate(); err != nil {
+			SendError(w, ErrBadRequest(err.Error()))
+			return
+		}
+		var exists bool
+		if err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM geofences WHERE id = $1)", rule.GeofenceID); err != nil {
+			SendError(w, ErrDatabase("Failed to create geofence rule", err))
+			return
+		}
+		if !exists {
+			SendError(w, ErrNotFound("Geofence"))
+			return
+		}
+		
+		tx, err := db.Begin()
+		if err != nil {
+			SendError(w, ErrDatabase("Failed to create geofence rule", err))
+			return
+		}
+		defer tx.Rollback()
+		if err := insertGeofenceRule(tx, &rule); err != nil {
+			SendError(w, ErrDatabase("Failed to create geofence rule", err))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			SendError(w, ErrDatabase("Failed to create geofence rule", err))
+			return
+		}
+		geofenceMonitor.Invalidate()
+		
+		SendJSON(w, http.StatusCreated, map[string]interface{}{
+			"success": true,
+			"message": "Geofence rule created successfully",
+			"rule":    rule,
+		})
+		
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			SendError(w, ErrBadRequest("Invalid rule ID: "+err.Error()))
+			return
+		}
+		if _, err := db.Exec("UPDATE geofence_rules SET active = false WHERE id = $1", id); err != nil {
+			SendError(w, ErrDatabase("Failed to delete geofence rule", err))
+			return
+		}
+		geofenceMonitor.Invalidate()
+		
+		SendJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"message": "Geofence rule deleted successfully",
+		})
+		
+	default:
+		SendError(w, ErrMethodNotAllowed("Method not allowed"))
+	}
+}
+
+// geofenceEventsHandler lists recent geofence events, optionally only violations
+func geofenceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermGPSView) {
+		SendError(w, ErrUnauthorized("Access denied"))
+		return
+	}
+	
+	hours := 24
+	if h, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && h > 0 {
+		hours = h
+	}
+	vehicleID := r.URL.Query().Get("vehicle_id")
+	violationsOnly := r.URL.Query().Get("violations") == "true"
+	
+	rows, err := db.Query(`
+		SELECT e.id, e.vehicle_id, e.geofence_id, g.name, e.event_type,
+		       e.timestamp, e.location, e.rule_id, e.details
+		FROM geofence_events e
+		JOIN geofences g ON g.id = e.geofence_id
+		WHERE e.timestamp > NOW() - ($1 * INTERVAL '1 hour')
+		  AND ($2 = '' OR e.vehicle_id = $2)
+		  AND (NOT $3 OR e.event_type LIKE '%_violation')
+		ORDER BY e.timestamp DESC
+		LIMIT 500
+	`, hours, vehicleID, violationsOnly)
+	if err != nil {
+		SendError(w, ErrDatabase("Failed to load geofence events", err))
+		return
+	}
+	defer rows.Close()
+	
+	type geofenceEvent struct {
+		ID           int64           `json:"id"`
+		VehicleID    string          `json:"vehicle_id"`
+		GeofenceID   int             `json:"geofence_id"`
+		GeofenceName string          `json:"geofence_name"`
+		EventType    string          `json:"event_type"`
+		Timestamp    time.Time       `json:"timestamp"`
+		Location     json.RawMessage `json:"location,omitempty"`
+		RuleID       *int            `json:"rule_id,omitempty"`
+		Details      json.RawMessage `json:"details,omitempty"`
+	}
+	
+	events := []geofenceEvent{}
+	for rows.Next() {
+		var e geofenceEvent
+		var location, details []byte
+		if err := rows.Scan(&e.ID, &e.VehicleID, &e.GeofenceID, &e.GeofenceName,
+			&e.EventType, &e.Timestamp, &location, &e.RuleID, &details); err != nil {
+			continue
+		}
+		if len(location) > 0 {
+			e.Location = location
+		}
+		if len(details) > 0 {
+			e.Details = details
+		}
+		events = append(events, e)
+	}
+	
+	SendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"events":  events,
+	})
+}
+
 // calculateRouteStats calculates statistics from GPS locations
 func calculateRouteStats(locations []GPSLocation) map[string]interface{} {
 	if len(locations) == 0 {
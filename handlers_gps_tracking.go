@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -188,57 +190,93 @@ func generateSimulatedLocations() []GPSUpdate {
 	return locations
 }
 
-// Calculate ETA for a bus
+// Calculate ETA for a bus along its planned route.
+// Accepts bus_id plus either stop (stop number) or lat/lng of a stop;
+// route_id is optional and defaults to the bus's current route.
 func calculateETAHandler(w http.ResponseWriter, r *http.Request) {
 	busID := r.URL.Query().Get("bus_id")
+	routeID := r.URL.Query().Get("route_id")
+	stopParam := r.URL.Query().Get("stop")
 	stopLat := r.URL.Query().Get("lat")
 	stopLng := r.URL.Query().Get("lng")
-	
-	if busID == "" || stopLat == "" || stopLng == "" {
+
+	if busID == "" {
 		http.Error(w, "Missing parameters", http.StatusBadRequest)
 		return
 	}
-	
-	// Get current bus location
-	var busLat, busLng, speed float64
-	err := db.QueryRow(`
-		SELECT latitude, longitude, speed
-		FROM gps_tracking
-		WHERE vehicle_id = $1
-		ORDER BY timestamp DESC
-		LIMIT 1
-	`, busID).Scan(&busLat, &busLng, &speed)
-	
+	stopNumber, err := strconv.Atoi(stopParam)
+	if stopParam != "" && err != nil {
+		http.Error(w, "Invalid stop number", http.StatusBadRequest)
+		return
+	}
+	lat, latErr := parseFloat(stopLat)
+	lng, lngErr := parseFloat(stopLng)
+	byLocation := stopParam == "" && (stopLat != "" || stopLng != "")
+	if byLocation && (latErr != nil || lngErr != nil) {
+		http.Error(w, "Invalid stop coordinates", http.StatusBadRequest)
+		return
+	}
+
+	routeETA, err := getETAEngine().CalculateVehicleETA(busID, routeID)
 	if err != nil {
-		// Return estimated time for demo
+		log.Printf("ETA unavailable for bus %s: %v", busID, err)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"eta_minutes": 5 + rand.Intn(20),
-			"distance_km": rand.Float64() * 10,
-			"status":      "estimated",
+			"status": "unavailable",
+			"error":  err.Error(),
 		})
 		return
 	}
-	
-	// Calculate distance and ETA
-	// This is a simplified calculation - in production, use a routing API
-	stopLatFloat, _ := parseFloat(stopLat)
-	stopLngFloat, _ := parseFloat(stopLng)
-	distance := calculateDistance(busLat, busLng, stopLatFloat, stopLngFloat)
-	
-	// Assume average speed if current speed is 0
-	if speed < 5 {
-		speed = 25 // 25 mph average
+
+	// Pick the requested stop, defaulting to the next one
+	target := routeETA.NextStop()
+	if stopParam != "" {
+		target = routeETA.FindStop(stopNumber)
+		if target == nil {
+			http.Error(w, "Stop not found on this route", http.StatusNotFound)
+			return
+		}
+	} else if byLocation {
+		target = nearestStopETA(routeETA, lat, lng)
 	}
-	
-	etaMinutes := int(distance / (speed * 1.60934) * 60) // Convert mph to km/h
-	
+
+	response := map[string]interface{}{
+		"status":          "calculated",
+		"route_id":        routeETA.RouteID,
+		"stops_remaining": routeETA.StopsRemaining(),
+		"stops":           routeETA.Stops,
+	}
+	if target != nil {
+		response["stop_number"] = target.StopNumber
+		response["stop_name"] = target.Name
+		response["eta"] = target.ETA
+		response["eta_minutes"] = target.MinutesAway
+		response["earliest_eta"] = target.EarliestETA
+		response["latest_eta"] = target.LatestETA
+		response["distance_km"] = target.DistanceMeters / 1000
+		response["confidence"] = target.Confidence
+		response["source"] = target.Source
+		response["completed"] = target.Completed
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"eta_minutes": etaMinutes,
-		"distance_km": distance,
-		"status":      "calculated",
-	})
+	json.NewEncoder(w).Encode(response)
+}
+
+// nearestStopETA returns the planned stop closest to a coordinate
+func nearestStopETA(routeETA *RouteETA, lat, lng float64) *StopETA {
+	var nearest *StopETA
+	minDistance := math.MaxFloat64
+	for i := range routeETA.Stops {
+		stop := &routeETA.Stops[i]
+		distance := calculateDistance(lat, lng, stop.Latitude, stop.Longitude)
+		if distance < minDistance {
+			minDistance = distance
+			nearest = stop
+		}
+	}
+	return nearest
 }
 
 // calculateDistance is defined in gps_tracking.go
@@ -19,7 +19,7 @@ func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 // AutoRecoveryHandler handles auto-recovery operations
 func AutoRecoveryHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -41,10 +41,5 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Redirect to role-specific dashboard
-	if user.Role == "manager" {
-		http.Redirect(w, r, "/manager-dashboard", http.StatusFound)
-	} else {
-		http.Redirect(w, r, "/driver-dashboard", http.StatusFound)
-	}
+	http.Redirect(w, r, homePath(user), http.StatusFound)
 }
\ No newline at end of file
@@ -500,8 +500,8 @@ func getAvailableContacts(currentUser *User) ([]MessagingUser, error) {
 	var query string
 	var args []interface{}
 
-	if currentUser.Role == "manager" {
-		// Managers can contact all users
+	if hasPermission(currentUser, PermMessagingBroadcast) {
+		// Managers and dispatchers can contact all users
 		query = `
 			SELECT id, username, email, role, phone 
 			FROM users 
@@ -510,12 +510,12 @@ func getAvailableContacts(currentUser *User) ([]MessagingUser, error) {
 		`
 		args = []interface{}{getUserID(currentUser.Username)}
 	} else {
-		// Drivers can contact managers and drivers on same routes
+		// Drivers can contact managers/dispatchers and drivers on same routes
 		query = `
 			SELECT DISTINCT u.id, u.username, u.email, u.role, u.phone
 			FROM users u
 			WHERE u.id != $1 AND u.status = 'active'
-			AND (u.role = 'manager' OR 
+			AND (u.role IN (SELECT role FROM role_permissions WHERE permission = $3) OR 
 			     EXISTS (
 			         SELECT 1 FROM route_assignments ra1
 			         JOIN route_assignments ra2 ON ra1.route_id = ra2.route_id
@@ -523,7 +523,7 @@ func getAvailableContacts(currentUser *User) ([]MessagingUser, error) {
 			     ))
 			ORDER BY u.role, u.username
 		`
-		args = []interface{}{getUserID(currentUser.Username), currentUser.Username}
+		args = []interface{}{getUserID(currentUser.Username), currentUser.Username, PermMessagingBroadcast}
 	}
 
 	rows, err := db.Query(query, args...)
@@ -11,7 +11,7 @@ import (
 // generateMileageReportsFromLogsHandler generates mileage reports from driver logs
 func generateMileageReportsFromLogsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermMileageEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -17,7 +18,7 @@ import (
 // approveUsersHandler shows pending user approvals
 func approveUsersHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermUsersManage) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -135,6 +136,7 @@ func approveUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Execute the action
+	before := auditSnapshot("users", "username", username)
 	result, err := db.Exec(query, username)
 	if err != nil {
 		log.Printf("APPROVE USER: Database error %s user %s: %v", action, username, err)
@@ -149,6 +151,9 @@ func approveUserHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		log.Printf("APPROVE USER: %d rows affected for %s action on user %s", rowsAffected, action, username)
 	}
+	if rowsAffected > 0 {
+		recordAudit(auditActorFromRequest(r), action, "user", username, before, auditSnapshot("users", "username", username))
+	}
 
 	// Clear user cache to force reload
 	if dataCache != nil {
@@ -162,7 +167,7 @@ func approveUserHandler(w http.ResponseWriter, r *http.Request) {
 // manageUsersHandler shows all users for management
 func manageUsersHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermUsersManage) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -187,20 +192,87 @@ func manageUsersHandler(w http.ResponseWriter, r *http.Request) {
 	
 	log.Printf("Loaded %d users for management page", len(users))
 
+	roles, err := getRoles()
+	if err != nil {
+		log.Printf("Error loading roles: %v", err)
+	}
+
+	locked, err := lockedUsers()
+	if err != nil {
+		log.Printf("Error loading locked users: %v", err)
+	}
+	twoFactor, err := twoFactorUsers()
+	if err != nil {
+		log.Printf("Error loading two-factor users: %v", err)
+	}
+
 	// Get CSRF token
 	csrfToken := getSessionCSRFToken(r)
 
 	// Include CSPNonce in the data
 	data := map[string]interface{}{
-		"User":      user,
-		"Users":     users,
-		"CSRFToken": csrfToken,
-		"CSPNonce":  getCSPNonce(r.Context()),  // Get nonce from context, don't generate new
+		"User":             user,
+		"Users":            users,
+		"Roles":            roles,
+		"Locked":           locked,
+		"TwoFactorUsers":   twoFactor,
+		"PermissionGroups": permissionGroups(),
+		"RoleError":        r.URL.Query().Get("role_error"),
+		"CSRFToken":        csrfToken,
+		"CSPNonce":         getCSPNonce(r.Context()),  // Get nonce from context, don't generate new
 	}
 
 	renderTemplate(w, r, "manage_users.html", data)
 }
 
+// manageRolesHandler creates, updates and deletes roles from the role
+// editor on the user management page
+func manageRolesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		SendError(w, ErrMethodNotAllowed("Only POST method allowed"))
+		return
+	}
+
+	if !validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	before := roleAuditSnapshot(name)
+	var err error
+	switch r.FormValue("action") {
+	case "save":
+		err = saveRole(Role{
+			Name:        name,
+			DisplayName: strings.TrimSpace(r.FormValue("display_name")),
+			Description: strings.TrimSpace(r.FormValue("description")),
+			Require2FA:  r.FormValue("require_2fa") == "on",
+			Permissions: r.Form["permissions"],
+		})
+	case "delete":
+		err = deleteRole(name)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error updating role %s: %v", name, err)
+		http.Redirect(w, r, "/manage-users?role_error="+url.QueryEscape(err.Error())+"#roles", http.StatusSeeOther)
+		return
+	}
+	action := AuditUpdate
+	if r.FormValue("action") == "delete" {
+		action = AuditDelete
+	} else if before == nil {
+		action = AuditCreate
+	}
+	recordAudit(auditActorFromRequest(r), action, "role", name, before, roleAuditSnapshot(name))
+
+	http.Redirect(w, r, "/manage-users#roles", http.StatusSeeOther)
+}
+
 // editUserHandler handles user editing
 func editUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Handle GET request to show edit form
@@ -231,11 +303,27 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		
+		roles, err := getRoles()
+		if err != nil {
+			log.Printf("Error loading roles: %v", err)
+		}
+		twoFactor, err := getTwoFactorStatus(username)
+		if err != nil {
+			log.Printf("Error loading two-factor status: %v", err)
+		}
+		sessions, err := userDeviceSessions(username, "")
+		if err != nil {
+			log.Printf("Error loading sessions: %v", err)
+		}
+		
 		data := map[string]interface{}{
 			"Title":     "Edit User",
 			"User":      getUserFromSession(r),
 			"CSRFToken": generateCSRFToken(),
 			"Data":      user,
+			"Roles":     roles,
+			"TwoFactor": twoFactor,
+			"Sessions":  sessions,
 		}
 		
 		renderTemplate(w, r, "edit_user.html", data)
@@ -256,21 +344,86 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := auditSnapshot("users", "username", username)
 	switch action {
 	case "update_role":
 		role := r.FormValue("role")
-		if role != "driver" && role != "manager" {
+		exists, err := roleExists(role)
+		if err != nil || !exists {
 			http.Error(w, "Invalid role", http.StatusBadRequest)
 			return
 		}
 		
-		_, err := db.Exec("UPDATE users SET role = $1 WHERE username = $2", role, username)
+		var currentRole string
+		if err := db.Get(&currentRole, "SELECT role FROM users WHERE username = $1", username); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !canAssignRole(getUserFromSession(r), currentRole, role) {
+			SendError(w, ErrForbidden("You can't assign a role with permissions you don't hold"))
+			return
+		}
+		
+		_, err = db.Exec("UPDATE users SET role = $1 WHERE username = $2", role, username)
 		if err != nil {
 			log.Printf("Error updating user role: %v", err)
 			http.Error(w, "Failed to update role", http.StatusInternalServerError)
 			return
 		}
 		
+	case "unlock":
+		var targetRole string
+		if err := db.Get(&targetRole, "SELECT role FROM users WHERE username = $1", username); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !canAssignRole(getUserFromSession(r), targetRole, targetRole) {
+			SendError(w, ErrForbidden("You can't manage users with permissions you don't hold"))
+			return
+		}
+		if err := userLogins.unlock(username); err != nil {
+			log.Printf("Error unlocking user: %v", err)
+			http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Account %s unlocked by %s", username, getUserFromSession(r).Username)
+		
+	case "reset_2fa":
+		// For users who lost their authenticator; they enroll again at next login
+		// if their role requires it
+		var targetRole string
+		if err := db.Get(&targetRole, "SELECT role FROM users WHERE username = $1", username); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !canAssignRole(getUserFromSession(r), targetRole, targetRole) {
+			SendError(w, ErrForbidden("You can't manage users with permissions you don't hold"))
+			return
+		}
+		if err := disableTOTP(username); err != nil {
+			log.Printf("Error resetting two-factor: %v", err)
+			http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Two-factor authentication for %s reset by %s", username, getUserFromSession(r).Username)
+		
+	case "sign_out":
+		var targetRole string
+		if err := db.Get(&targetRole, "SELECT role FROM users WHERE username = $1", username); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !canAssignRole(getUserFromSession(r), targetRole, targetRole) {
+			SendError(w, ErrForbidden("You can't manage users with permissions you don't hold"))
+			return
+		}
+		if err := sessionManager.DeleteUserSessions(username); err != nil {
+			log.Printf("Error signing out user: %v", err)
+			http.Error(w, "Failed to sign out user", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("All sessions for %s ended by %s", username, getUserFromSession(r).Username)
+		
 	case "reset_password":
 		password := r.FormValue("password")
 		if password == "" || len(password) < 6 {
@@ -291,20 +444,29 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
 			return
 		}
+		// Whoever knew the old password shouldn't stay signed in
+		if err := sessionManager.DeleteUserSessions(username); err != nil {
+			log.Printf("Error ending sessions after password reset: %v", err)
+		}
 		
 	default:
 		http.Error(w, "Invalid action", http.StatusBadRequest)
 		return
 	}
+	recordAudit(auditActorFromRequest(r), action, "user", username, before, auditSnapshot("users", "username", username))
+
+	if dataCache != nil {
+		dataCache.clear()
+	}
 
-	// Redirect back to manager dashboard
-	http.Redirect(w, r, "/manager-dashboard", http.StatusSeeOther)
+	// Redirect back to user management
+	http.Redirect(w, r, "/manage-users", http.StatusSeeOther)
 }
 
 // assignRoutesHandler handles route assignment page
 func assignRoutesHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -319,7 +481,7 @@ func assignRoutesHandler(w http.ResponseWriter, r *http.Request) {
 	// Filter for active drivers
 	var drivers []User
 	for _, u := range allUsers {
-		if u.Role == "driver" && u.Status == "active" {
+		if u.Role == RoleDriver && u.Status == "active" {
 			drivers = append(drivers, u)
 		}
 	}
@@ -453,7 +615,7 @@ func assignRoutesHandler(w http.ResponseWriter, r *http.Request) {
 // importMileageHandler handles mileage import page
 func importMileageHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermMileageEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -626,6 +788,11 @@ func processExcelFile(w http.ResponseWriter, r *http.Request, file multipart.Fil
 		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
 		return
 	}
+	recordAuditChanges(auditActorFromRequest(r), AuditImport, "import", "mileage", map[string]AuditChange{
+		"file":     {To: filename},
+		"imported": {To: imported},
+		"errors":   {To: failed},
+	})
 
 	// Return result
 	data := map[string]interface{}{
@@ -648,7 +815,7 @@ func processExcelFile(w http.ResponseWriter, r *http.Request, file multipart.Fil
 // usersHandler handles user profile edit page
 func usersHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermUsersManage) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -671,10 +838,17 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	roles, err := getRoles()
+	if err != nil {
+		log.Printf("Error loading roles: %v", err)
+	}
+
 	data := map[string]interface{}{
 		"User":      user,
 		"Username":  targetUser.Username,
 		"Role":      targetUser.Role,
+		"Roles":     roles,
+		"IsStaff":   roleHasPermission(targetUser.Role, PermDashboardView),
 		"CSRFToken": getSessionCSRFToken(r),
 	}
 
@@ -692,7 +866,7 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermUsersManage) {
 		log.Printf("DELETE USER: Unauthorized - user=%v", user)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
@@ -744,6 +918,7 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete the user
+	before := auditSnapshot("users", "username", username)
 	result, err := db.Exec("DELETE FROM users WHERE username = $1", username)
 	if err != nil {
 		log.Printf("DELETE USER: Error deleting user %s: %v", username, err)
@@ -753,6 +928,7 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	
 	rowsAffected, _ := result.RowsAffected()
 	log.Printf("DELETE USER: Successfully deleted user %s (rows affected: %d)", username, rowsAffected)
+	recordAudit(auditActorFromRequest(r), AuditDelete, "user", username, before, nil)
 
 	// Clear user cache to force reload
 	if dataCache != nil {
@@ -148,7 +148,7 @@ func apiFleetSummaryHandler(w http.ResponseWriter, r *http.Request) {
 // Missing dashboard handlers
 func budgetDashboardPageHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermBudgetView) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
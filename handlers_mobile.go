@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"html/template"
 	"log"
@@ -8,6 +9,8 @@ import (
 	"strconv"
 	"time"
 	"strings"
+
+	"github.com/jmoiron/sqlx"
 )
 
 // Mobile route handlers
@@ -605,9 +608,38 @@ func saveVehicleCheck(username string, checkData interface{}) (string, error) {
 	return checkID, nil
 }
 
+// saveAttendance records the mobile attendance sheet for today's run.
+// Only students on the route are recorded.
 func saveAttendance(driver, routeID, period string, students map[string]string) error {
-	// Implementation for saving attendance
-	return nil
+	if period != "morning" && period != "afternoon" {
+		period = attendancePeriodAt(time.Now())
+	}
+	var onRoute []string
+	if err := db.Select(&onRoute, `SELECT student_id FROM students WHERE route_id = $1`, routeID); err != nil {
+		return err
+	}
+
+	return withTransaction(func(tx *sqlx.Tx) error {
+		for _, studentID := range onRoute {
+			status, ok := students[studentID]
+			if !ok {
+				continue
+			}
+			err := recordAttendance(tx, AttendanceEntry{
+				StudentID:  studentID,
+				Date:       time.Now(),
+				Period:     period,
+				RouteID:    sql.NullString{String: routeID, Valid: true},
+				Status:     status,
+				Source:     AttendanceSourceMobile,
+				RecordedBy: sql.NullString{String: driver, Valid: true},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func updateDriverLocation(username string, location interface{}) error {
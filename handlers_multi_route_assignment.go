@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -22,7 +23,7 @@ type MultiRouteAssignment struct {
 // Handle multiple route assignments for a single driver
 func handleMultiRouteAssignment(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -182,6 +183,18 @@ func handleAssignRoutesEnhanced(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		blocking, _, err := driverQualificationProblems(driver, busID, cleanRouteIDs...)
+		if err != nil {
+			log.Printf("ERROR: Error checking driver qualifications: %v", err)
+			http.Redirect(w, r, "/assign-routes?error=database", http.StatusSeeOther)
+			return
+		}
+		if len(blocking) > 0 {
+			log.Printf("WARNING: %s is not qualified: %s", driver, describeConflicts(blocking))
+			http.Redirect(w, r, "/assign-routes?error=not_qualified&driver="+url.QueryEscape(driver), http.StatusSeeOther)
+			return
+		}
+
 		// Begin transaction
 		tx, err := db.Begin()
 		if err != nil {
@@ -288,7 +301,7 @@ func handleAssignRoutesEnhanced(w http.ResponseWriter, r *http.Request) {
 	// Get all routes
 	routes := []Route{}
 	routeRows, err := db.Query(`
-		SELECT route_id, route_name, description 
+		SELECT route_id, route_name, description, needs_wheelchair_lift
 		FROM routes 
 		ORDER BY route_name
 	`)
@@ -299,7 +312,7 @@ func handleAssignRoutesEnhanced(w http.ResponseWriter, r *http.Request) {
 		for routeRows.Next() {
 			var route Route
 			var desc sql.NullString
-			err := routeRows.Scan(&route.RouteID, &route.RouteName, &desc)
+			err := routeRows.Scan(&route.RouteID, &route.RouteName, &desc, &route.NeedsWheelchairLift)
 			if err != nil {
 				log.Printf("Error scanning route: %v", err)
 				continue
@@ -372,5 +385,7 @@ func handleAssignRoutesEnhanced(w http.ResponseWriter, r *http.Request) {
 		"Success":      r.URL.Query().Get("success") == "1",
 		"SuccessCount": r.URL.Query().Get("count"),
 		"Error":        r.URL.Query().Get("error"),
+		"Warning":      r.URL.Query().Get("warning"),
+		"Driver":       r.URL.Query().Get("driver"),
 	})
 }
\ No newline at end of file
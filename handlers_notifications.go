@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -22,9 +23,9 @@ func updateVehicleStatusWithNotification(vehicleID, vehicleType, newStatus, chan
 	
 	// Update the status
 	if vehicleType == "bus" {
-		err = updateBusField(vehicleID, "status", newStatus)
+		err = updateBusField(AuditActor{Username: changedBy}, vehicleID, "status", newStatus)
 	} else {
-		err = updateVehicleField(vehicleID, "status", newStatus)
+		err = updateVehicleField(AuditActor{Username: changedBy}, vehicleID, "status", newStatus)
 	}
 	
 	if err != nil {
@@ -98,6 +99,9 @@ func notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
 			NotifyVehicleIssue,
 			NotifyScheduleReminder,
 			NotifyReportReady,
+			NotifyCredentialExpiring,
+			NotifyRidershipAlert,
+			NotifyPartsReorder,
 		} {
 			prefs.Types[notifType] = r.FormValue("type_"+notifType) == "on"
 		}
@@ -171,7 +175,7 @@ func notificationHistoryHandler(w http.ResponseWriter, r *http.Request) {
 // testNotificationHandler sends a test notification
 func testNotificationHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermNotificationsAdmin) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
@@ -216,6 +220,83 @@ func testNotificationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// failedNotificationsHandler lists dead-lettered deliveries for managers
+func failedNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermNotificationsAdmin) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	var deliveries []FailedDelivery
+	var loadErr string
+	if notificationSystem != nil {
+		var err error
+		deliveries, err = notificationSystem.ListFailedDeliveries(200)
+		if err != nil {
+			log.Printf("Error loading failed deliveries: %v", err)
+			loadErr = "Failed to load failed deliveries"
+		}
+	} else {
+		loadErr = "Notification system not initialized"
+	}
+
+	message := ""
+	if r.URL.Query().Get("resent") == "1" {
+		message = "Delivery queued for resend."
+	}
+
+	data := map[string]interface{}{
+		"Title":      "Failed Notifications",
+		"User":       user,
+		"Deliveries": deliveries,
+		"Message":    message,
+		"Error":      loadErr,
+		"CSRFToken":  getSessionCSRFToken(r),
+	}
+
+	renderTemplate(w, r, "notification_failures.html", data)
+}
+
+// resendNotificationHandler requeues a dead-lettered delivery
+func resendNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if !hasPermission(user, PermNotificationsAdmin) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	if notificationSystem == nil {
+		http.Error(w, "Notification system not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := notificationSystem.ResendDelivery(id); err != nil {
+		log.Printf("Failed to resend delivery %d: %v", id, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Delivery %d requeued by %s", id, user.Username)
+	http.Redirect(w, r, "/notification-failures?resent=1", http.StatusSeeOther)
+}
+
 // markNotificationReadHandler marks a notification as read
 func markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
@@ -320,12 +401,18 @@ func assignRouteWithNotification(driver, busID, routeID string) error {
 // Hook into attendance marking
 func markAttendanceWithNotification(studentID string, date time.Time, present bool) error {
 	// Mark attendance
-	_, err := db.Exec(`
-		INSERT INTO student_attendance (student_id, date, present, marked_at, marked_by)
-		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4)
-		ON CONFLICT (student_id, date) 
-		DO UPDATE SET present = $3, marked_at = CURRENT_TIMESTAMP
-	`, studentID, date.Format("2006-01-02"), present, "system")
+	status := "present"
+	if !present {
+		status = "absent"
+	}
+	err := recordAttendance(db, AttendanceEntry{
+		StudentID:  studentID,
+		Date:       date,
+		Period:     attendancePeriodAt(date),
+		Status:     status,
+		Source:     AttendanceSourceWeb,
+		RecordedBy: sql.NullString{String: "system", Valid: true},
+	})
 	
 	if err != nil {
 		return err
@@ -7,6 +7,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -50,6 +51,7 @@ type BusTracking struct {
 	RouteName        string    `json:"route_name"`
 	CurrentLocation  *GPSLocation `json:"current_location"`
 	EstimatedArrival *time.Time   `json:"estimated_arrival"`
+	StopETA          *StopETA     `json:"stop_eta,omitempty"`
 	Status           string    `json:"status"` // not_started, en_route, arrived, departed
 }
 
@@ -75,7 +77,8 @@ func parentLoginHandler(w http.ResponseWriter, r *http.Request) {
 		// Authenticate parent
 		parent, err := authenticateParent(username, password)
 		if err != nil {
-			http.Redirect(w, r, "/parent/login?error=Invalid+credentials", http.StatusSeeOther)
+			log.Printf("Parent login failed for %s: %v", username, err)
+			http.Redirect(w, r, "/parent/login?error="+url.QueryEscape(lockoutMessage(err)), http.StatusSeeOther)
 			return
 		}
 
@@ -209,6 +212,7 @@ func parentStudentDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		Parent        *Parent
 		Student       StudentDetail
 		Attendance    []AttendanceRecord
+		Summary       AttendanceSummary
 		Notifications []ParentNotification
 		CSPNonce      string
 	}{
@@ -216,6 +220,7 @@ func parentStudentDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		Parent:        parent,
 		Student:       student,
 		Attendance:    attendance,
+		Summary:       summarizeAttendance(attendance),
 		Notifications: notifications,
 		CSPNonce:      generateNonce(),
 	}
@@ -440,6 +445,26 @@ type AttendanceRecord struct {
 	Afternoon string    `json:"afternoon"`
 }
 
+// Status is present if the student rode either run that day, otherwise
+// whatever was recorded
+func (a AttendanceRecord) Status() string {
+	for _, s := range []string{a.Morning, a.Afternoon} {
+		if s == "present" || s == "late" {
+			return "present"
+		}
+	}
+	if a.Morning != "" {
+		return a.Morning
+	}
+	return a.Afternoon
+}
+
+type AttendanceSummary struct {
+	Rate        int
+	DaysPresent int
+	DaysAbsent  int
+}
+
 type NotificationSettings struct {
 	BusArrival   bool `json:"bus_arrival"`
 	BusDeparture bool `json:"bus_departure"`
@@ -506,10 +531,18 @@ func authenticateParent(username, password string) (*Parent, error) {
 		return nil, err
 	}
 
+	if err := parentLogins.checkLocked(parent.ID); err != nil {
+		return nil, err
+	}
+
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		if lockErr := parentLogins.recordFailure(parent.ID); lockErr != nil {
+			return nil, lockErr
+		}
 		return nil, fmt.Errorf("invalid password")
 	}
+	parentLogins.recordSuccess(parent.ID)
 
 	// Load students
 	parent.Students = getParentStudents(parent.ID)
@@ -640,9 +673,14 @@ func getParentBusTracking(parentID int) []BusTracking {
 				tracking.CurrentLocation = loc
 				tracking.Status = determineBusStatus2(tracking.StudentID, loc)
 				
-				// Calculate ETA
-				eta := calculateStudentETA(tracking.StudentID, loc)
-				tracking.EstimatedArrival = eta
+				// Calculate ETA at the student's stop
+				if stopETA := calculateStudentStopETA(tracking.StudentID, loc); stopETA != nil {
+					tracking.StopETA = stopETA
+					if !stopETA.Completed {
+						eta := stopETA.ETA
+						tracking.EstimatedArrival = &eta
+					}
+				}
 			}
 		} else {
 			tracking.Status = "not_started"
@@ -763,12 +801,31 @@ func determineBusStatus2(studentID string, location *GPSLocation) string {
 }
 
 func calculateStudentETA(studentID string, currentLocation *GPSLocation) *time.Time {
-	// Calculate estimated arrival time based on current location
-	// This would use route information and current progress
-	eta := time.Now().Add(15 * time.Minute)
+	stop := calculateStudentStopETA(studentID, currentLocation)
+	if stop == nil || stop.Completed {
+		return nil
+	}
+	eta := stop.ETA
 	return &eta
 }
 
+// calculateStudentStopETA predicts the bus's arrival at the student's stop
+func calculateStudentStopETA(studentID string, currentLocation *GPSLocation) *StopETA {
+	var routeID sql.NullString
+	db.QueryRow("SELECT route_id FROM students WHERE student_id = $1", studentID).Scan(&routeID)
+	if !routeID.Valid || routeID.String == "" {
+		return nil
+	}
+
+	routeETA, err := getETAEngine().CalculateRouteETA(routeID.String, currentLocation)
+	if err != nil {
+		log.Printf("Failed to calculate ETA for student %s: %v", studentID, err)
+		return nil
+	}
+
+	return routeETA.StudentStop(studentID)
+}
+
 func validateStudentCode(code string) (string, error) {
 	// Validate the student registration code
 	var studentID string
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"net/http"
 )
@@ -45,12 +46,10 @@ func parentTrackingHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	// Try to get real children from database
-	if user.Role == "parent" {
-		realChildren := getParentChildren(user.Username)
-		if len(realChildren) > 0 {
-			children = realChildren
-		}
+	// Try to get real children from database. Students are matched on the
+	// parent's email or phone, so this only ever finds the user's own.
+	if realChildren := getParentChildren(user.Username); len(realChildren) > 0 {
+		children = realChildren
 	}
 
 	renderTemplate(w, r, "parent_tracking.html", map[string]interface{}{
@@ -207,13 +206,41 @@ func getParentBusETAHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// For demo, return mock ETA
-	// In production, calculate based on real GPS position and route
+	routeETA, err := getETAEngine().CalculateVehicleETA(busID, r.URL.Query().Get("route_id"))
+	if err != nil {
+		log.Printf("Bus ETA unavailable for %s: %v", busID, err)
+		http.Error(w, "ETA unavailable", http.StatusNotFound)
+		return
+	}
+
+	// Report the child's stop when given, otherwise the next stop
+	target := routeETA.NextStop()
+	if studentID := r.URL.Query().Get("student_id"); studentID != "" {
+		target = routeETA.StudentStop(studentID)
+		if target == nil {
+			http.Error(w, "Student's stop not found on this route", http.StatusNotFound)
+			return
+		}
+	}
+
+	response := map[string]interface{}{
+		"route_id":        routeETA.RouteID,
+		"stops_remaining": routeETA.StopsRemaining(),
+		"stops":           routeETA.Stops,
+	}
+	if next := routeETA.NextStop(); next != nil {
+		response["next_stop"] = next.Name
+	}
+	if target != nil {
+		response["stop_name"] = target.Name
+		response["eta"] = target.ETA
+		response["eta_minutes"] = target.MinutesAway
+		response["earliest_eta"] = target.EarliestETA
+		response["latest_eta"] = target.LatestETA
+		response["distance_miles"] = target.DistanceMeters / 1609.34
+		response["confidence"] = target.Confidence
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{
-		"eta_minutes": 15,
-		"distance_miles": 3.2,
-		"next_stop": "Oak Street & Main",
-		"stops_remaining": 4
-	}`))
-}
\ No newline at end of file
+	json.NewEncoder(w).Encode(response)
+}
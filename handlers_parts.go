@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partsHandler is the stockroom: the parts catalog, what each location
+// holds, what needs reordering, and what parts have been used on
+func partsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !hasPermission(user, PermMaintenanceEdit) {
+			SendError(w, ErrForbidden("You don't have permission to change the stockroom"))
+			return
+		}
+		updatePartsFromForm(w, r, user)
+		return
+	}
+
+	renderPartsPage(w, r, user)
+}
+
+func renderPartsPage(w http.ResponseWriter, r *http.Request, user *User) {
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days != 30 && days != 365 {
+		days = 90
+	}
+
+	parts, err := loadParts()
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load parts catalog", err))
+		return
+	}
+	var locations []StockLocation
+	if err := db.Select(&locations, `SELECT * FROM stock_locations ORDER BY name`); err != nil {
+		SendError(w, ErrInternal("Failed to load stock locations", err))
+		return
+	}
+	var levels []StockLevel
+	if err := db.Select(&levels, stockLevelQuery+` ORDER BY p.part_number, l.name`); err != nil {
+		SendError(w, ErrInternal("Failed to load stock levels", err))
+		return
+	}
+	var low []StockLevel
+	for _, level := range levels {
+		if level.Low() {
+			low = append(low, level)
+		}
+	}
+
+	valuation, err := inventoryValuation()
+	if err != nil {
+		SendError(w, ErrInternal("Failed to value inventory", err))
+		return
+	}
+	var totalValue float64
+	for _, v := range valuation {
+		totalValue += v.Value
+	}
+	byPart, byVehicle, err := partsUsage(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load parts usage", err))
+		return
+	}
+
+	// Recent log entries that parts can be charged to after the fact
+	var records []struct {
+		ID          int            `db:"id"`
+		VehicleID   sql.NullString `db:"vehicle_id"`
+		ServiceDate sql.NullTime   `db:"service_date"`
+		Description sql.NullString `db:"work_description"`
+	}
+	if err := db.Select(&records, `
+		SELECT id, vehicle_id, COALESCE(service_date, date) AS service_date, work_description
+		FROM maintenance_records
+		WHERE COALESCE(service_date, date) >= CURRENT_DATE - 60
+		ORDER BY COALESCE(service_date, date) DESC, id DESC
+		LIMIT 200
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load maintenance records", err))
+		return
+	}
+
+	var editing *Part
+	if id, err := strconv.Atoi(r.URL.Query().Get("edit")); err == nil {
+		for i := range parts {
+			if parts[i].ID == id {
+				editing = &parts[i]
+			}
+		}
+	}
+
+	renderTemplate(w, r, "parts.html", map[string]interface{}{
+		"User":       user,
+		"CSRFToken":  getSessionCSRFToken(r),
+		"Parts":      parts,
+		"Locations":  locations,
+		"Levels":     levels,
+		"Low":        low,
+		"Valuation":  valuation,
+		"TotalValue": totalValue,
+		"ByPart":     byPart,
+		"ByVehicle":  byVehicle,
+		"Days":       days,
+		"Records":    records,
+		"Editing":    editing,
+		"Saved":      r.URL.Query().Get("saved") == "1",
+		"CanEdit":    hasPermission(user, PermMaintenanceEdit),
+	})
+}
+
+// updatePartsFromForm applies one of the stockroom page's actions
+func updatePartsFromForm(w http.ResponseWriter, r *http.Request, user *User) {
+	action := r.FormValue("action")
+	notes := truncateString(strings.TrimSpace(r.FormValue("notes")), 500)
+	partID, _ := strconv.Atoi(r.FormValue("part_id"))
+	locationID, _ := strconv.Atoi(r.FormValue("location_id"))
+	quantity, _ := strconv.ParseFloat(r.FormValue("quantity"), 64)
+
+	var err error
+	auditAction := action
+	changes := map[string]AuditChange{}
+	switch action {
+	case "save_part":
+		unitCost, _ := strconv.ParseFloat(r.FormValue("unit_cost"), 64)
+		vendor := truncateString(strings.TrimSpace(r.FormValue("vendor")), 100)
+		part := Part{
+			ID:         partID,
+			PartNumber: truncateString(r.FormValue("part_number"), 100),
+			Name:       truncateString(r.FormValue("name"), 255),
+			Vendor:     sql.NullString{String: vendor, Valid: vendor != ""},
+			UnitCost:   unitCost,
+			Active:     r.FormValue("active") == "on",
+			Fitments:   parseFitments(r.FormValue("fitments")),
+		}
+		partID, err = savePart(part)
+		auditAction = AuditUpdate
+		if part.ID == 0 {
+			auditAction = AuditCreate
+		}
+		changes["part_number"] = AuditChange{To: part.PartNumber}
+		changes["unit_cost"] = AuditChange{To: unitCost}
+		changes["active"] = AuditChange{To: part.Active}
+		changes["fitments"] = AuditChange{To: part.FitmentText()}
+	case "add_location":
+		name := truncateString(strings.TrimSpace(r.FormValue("name")), 100)
+		if name == "" {
+			SendError(w, ErrBadRequest("A location needs a name"))
+			return
+		}
+		if _, err := db.Exec(`INSERT INTO stock_locations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, name); err != nil {
+			SendError(w, ErrInternal("Failed to add location", err))
+			return
+		}
+		http.Redirect(w, r, "/parts?saved=1", http.StatusSeeOther)
+		return
+	case "receive":
+		unitCost, _ := strconv.ParseFloat(r.FormValue("unit_cost"), 64)
+		err = receiveParts(partID, locationID, quantity, unitCost, user.Username, notes)
+		changes["received"] = AuditChange{To: quantity}
+		changes["location_id"] = AuditChange{To: locationID}
+		if unitCost > 0 {
+			changes["unit_cost"] = AuditChange{To: unitCost}
+		}
+	case "count":
+		counted, _ := strconv.ParseFloat(r.FormValue("counted"), 64)
+		err = countStock(partID, locationID, counted, user.Username, notes)
+		changes["counted"] = AuditChange{To: counted}
+		changes["location_id"] = AuditChange{To: locationID}
+	case "transfer":
+		toID, _ := strconv.Atoi(r.FormValue("to_location_id"))
+		err = transferStock(partID, locationID, toID, quantity, user.Username, notes)
+		changes["location_id"] = AuditChange{From: locationID, To: toID}
+		changes["quantity"] = AuditChange{To: quantity}
+	case "reorder":
+		point, _ := strconv.ParseFloat(r.FormValue("reorder_point"), 64)
+		reorderQuantity, _ := strconv.ParseFloat(r.FormValue("reorder_quantity"), 64)
+		bin := truncateString(strings.TrimSpace(r.FormValue("bin")), 50)
+		err = setReorderLevels(partID, locationID, point, reorderQuantity, bin)
+		changes["location_id"] = AuditChange{To: locationID}
+		changes["reorder_point"] = AuditChange{To: point}
+		changes["reorder_quantity"] = AuditChange{To: reorderQuantity}
+	case "consume":
+		recordID, _ := strconv.Atoi(r.FormValue("record_id"))
+		err = consumePartsOnRecord(recordID, partID, locationID, quantity, user.Username)
+		changes["maintenance_record_id"] = AuditChange{To: recordID}
+		changes["used"] = AuditChange{To: quantity}
+		changes["location_id"] = AuditChange{To: locationID}
+	default:
+		SendError(w, ErrBadRequest("Unknown action"))
+		return
+	}
+	if err != nil {
+		var refused inventoryError
+		switch {
+		case errors.As(err, &refused):
+			SendError(w, ErrConflict(string(refused)))
+		case errors.Is(err, sql.ErrNoRows):
+			SendError(w, ErrNotFound("Part"))
+		default:
+			SendError(w, ErrInternal("Failed to update the stockroom", err))
+		}
+		return
+	}
+
+	if notes != "" {
+		changes["notes"] = AuditChange{To: notes}
+	}
+	recordAuditChanges(auditActorFromRequest(r), auditAction, "part", strconv.Itoa(partID), changes)
+	http.Redirect(w, r, "/parts?saved=1", http.StatusSeeOther)
+}
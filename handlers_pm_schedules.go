@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pmSchedulesHandler manages the preventive maintenance programs and shows
+// every vehicle's services worked forward to when they fall due
+func pmSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !hasPermission(user, PermMaintenanceEdit) {
+			SendError(w, ErrForbidden("You don't have permission to change PM schedules"))
+			return
+		}
+		updatePMFromForm(w, r)
+		return
+	}
+
+	programs, err := loadPMPrograms()
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load PM programs", err))
+		return
+	}
+	due, err := loadPMDueList(db)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to work out the due list", err))
+		return
+	}
+
+	// Everything not yet due is on the list too, for planning ahead; the
+	// page shows those only when asked
+	show := r.URL.Query().Get("show")
+	var listed []PMDue
+	counts := map[string]int{}
+	for _, d := range due {
+		counts[d.Status]++
+		if show == "all" || d.Status != PMStatusOK {
+			listed = append(listed, d)
+		}
+	}
+
+	var vehicles []PMVehicle
+	if err := db.Select(&vehicles, pmVehicleQuery+` ORDER BY class, vehicle_id`); err != nil {
+		SendError(w, ErrInternal("Failed to load vehicles", err))
+		return
+	}
+
+	var editing *PMProgram
+	if id, err := strconv.Atoi(r.URL.Query().Get("edit")); err == nil {
+		for i := range programs {
+			if programs[i].ID == id {
+				editing = &programs[i]
+			}
+		}
+	}
+
+	renderTemplate(w, r, "pm_schedules.html", map[string]interface{}{
+		"User":       user,
+		"CSRFToken":  getSessionCSRFToken(r),
+		"Programs":   programs,
+		"Due":        listed,
+		"Counts":     counts,
+		"Show":       show,
+		"Vehicles":   vehicles,
+		"Editing":    editing,
+		"Categories": workOrderCategories,
+		"Today":      time.Now().Format("2006-01-02"),
+		"Saved":      r.URL.Query().Get("saved") == "1",
+		"Opened":     r.URL.Query().Get("opened"),
+		"CanEdit":    hasPermission(user, PermMaintenanceEdit),
+	})
+}
+
+// updatePMFromForm applies one of the PM page's actions
+func updatePMFromForm(w http.ResponseWriter, r *http.Request) {
+	formInt := func(name string) int {
+		n, _ := strconv.Atoi(strings.TrimSpace(r.FormValue(name)))
+		return n
+	}
+	vehicleID := strings.TrimSpace(r.FormValue("vehicle_id"))
+
+	var err error
+	entity, entityID := "pm_program", r.FormValue("program_id")
+	action := AuditUpdate
+	changes := map[string]AuditChange{}
+	switch r.FormValue("action") {
+	case "save_program":
+		p := PMProgram{
+			ID:            formInt("program_id"),
+			Name:          truncateString(r.FormValue("name"), 100),
+			Description:   strings.TrimSpace(r.FormValue("description")),
+			VehicleClass:  r.FormValue("vehicle_class"),
+			ModelMatch:    truncateString(r.FormValue("model_match"), 100),
+			Category:      r.FormValue("category"),
+			IntervalMiles: formInt("interval_miles"),
+			IntervalHours: formInt("interval_hours"),
+			IntervalDays:  formInt("interval_days"),
+			WarnMiles:     formInt("warn_miles"),
+			WarnHours:     formInt("warn_hours"),
+			WarnDays:      formInt("warn_days"),
+			AutoWorkOrder: r.FormValue("auto_work_order") == "on",
+			Active:        r.FormValue("active") == "on",
+		}
+		var id int
+		id, err = savePMProgram(p)
+		entityID = strconv.Itoa(id)
+		if p.ID == 0 {
+			action = AuditCreate
+		}
+		changes["name"] = AuditChange{To: p.Name}
+		changes["interval"] = AuditChange{To: p.IntervalText()}
+		changes["applies_to"] = AuditChange{To: strings.TrimSpace(p.VehicleClass + " " + p.ModelMatch)}
+		changes["auto_work_order"] = AuditChange{To: p.AutoWorkOrder}
+		changes["active"] = AuditChange{To: p.Active}
+	case "mark_done":
+		date := r.FormValue("date")
+		var name string
+		name, err = markPMServiceDone(vehicleID, formInt("program_id"), date, formInt("mileage"))
+		changes["vehicle_id"] = AuditChange{To: vehicleID}
+		changes["done"] = AuditChange{To: name + " on " + date}
+	case "engine_hours":
+		hours := formInt("engine_hours")
+		if hours < 0 {
+			SendError(w, ErrBadRequest("Engine hours can't be negative"))
+			return
+		}
+		var previous int
+		previous, entity, err = setEngineHours(vehicleID, hours)
+		entityID = vehicleID
+		changes["engine_hours"] = AuditChange{From: previous, To: hours}
+	case "generate":
+		opened, err := generatePMWorkOrders()
+		if err != nil {
+			SendError(w, ErrInternal("Failed to open PM work orders", err))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/pm-schedules?opened=%d", opened), http.StatusSeeOther)
+		return
+	default:
+		SendError(w, ErrBadRequest("Unknown action"))
+		return
+	}
+	if err != nil {
+		var refused pmError
+		switch {
+		case errors.As(err, &refused):
+			SendError(w, ErrConflict(string(refused)))
+		case errors.Is(err, sql.ErrNoRows):
+			SendError(w, ErrNotFound("Program or vehicle"))
+		default:
+			SendError(w, ErrInternal("Failed to update PM schedules", err))
+		}
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), action, entity, entityID, changes)
+	http.Redirect(w, r, "/pm-schedules?saved=1", http.StatusSeeOther)
+}
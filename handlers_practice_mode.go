@@ -72,7 +72,7 @@ func practiceModeHandler(w http.ResponseWriter, r *http.Request) {
 		switch action {
 		case "start":
 			// Generate practice data
-			practiceData = generatePracticeData(session.Role)
+			practiceData = generatePracticeData(guideAudience(session))
 			practiceDataStore[sessionID] = practiceData
 
 			// Set a practice mode flag in the session
@@ -87,11 +87,7 @@ func practiceModeHandler(w http.ResponseWriter, r *http.Request) {
 			})
 
 			// Redirect to appropriate dashboard
-			if session.Role == "manager" {
-				http.Redirect(w, r, "/manager-dashboard?practice=1", http.StatusSeeOther)
-			} else {
-				http.Redirect(w, r, "/driver-dashboard?practice=1", http.StatusSeeOther)
-			}
+			http.Redirect(w, r, homePath(session)+"?practice=1", http.StatusSeeOther)
 
 		case "stop":
 			// Clear practice data
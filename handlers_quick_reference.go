@@ -18,14 +18,7 @@ func quickReferenceHandler(w http.ResponseWriter, r *http.Request) {
 	// Get guide type from URL parameter
 	guideType := r.URL.Query().Get("type")
 	if guideType == "" {
-		// Determine type from user role
-		if session.Role == "manager" {
-			guideType = "manager"
-		} else if session.Role == "driver" {
-			guideType = "driver"
-		} else {
-			guideType = "general"
-		}
+		guideType = guideAudience(session)
 	}
 
 	// Data structure for the reference
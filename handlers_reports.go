@@ -13,13 +13,16 @@ func reportsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get driver's recent logs if they're a driver
+	// Users who can run fleet reports get the manager view; everyone else
+	// sees their own recent logs
+	fleetReports := hasPermission(user, PermReportsView)
+
 	var driverLogs []DriverLog
-	if user.Role == "driver" {
+	if !fleetReports {
 		if db != nil {
 			query := `
 				SELECT driver, bus_id, route_id, date, period, departure_time, arrival_time, 
-				       begin_mileage, end_mileage, attendance, created_at
+				       begin_mileage, end_mileage, `+driverLogRiders+`, created_at
 				FROM driver_logs
 				WHERE driver = $1
 				ORDER BY date DESC, created_at DESC
@@ -31,9 +34,9 @@ func reportsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Get statistics for managers
+	// Get fleet statistics
 	var totalBuses, totalDrivers, totalRoutes, totalStudents int
-	if user.Role == "manager" {
+	if fleetReports {
 		// Get counts from cache
 		buses, _ := dataCache.getBuses()
 		totalBuses = len(buses)
@@ -43,7 +46,7 @@ func reportsHandler(w http.ResponseWriter, r *http.Request) {
 		
 		users, _ := dataCache.getUsers()
 		for _, u := range users {
-			if u.Role == "driver" && u.Status == "active" {
+			if u.Role == RoleDriver && u.Status == "active" {
 				totalDrivers++
 			}
 		}
@@ -63,11 +66,10 @@ func reportsHandler(w http.ResponseWriter, r *http.Request) {
 		"TotalStudents": totalStudents,
 	}
 
-	// Use different template based on role
-	if user.Role == "driver" {
-		renderTemplate(w, r, "driver_reports.html", data)
-	} else {
+	if fleetReports {
 		renderTemplate(w, r, "manager_reports.html", data)
+	} else {
+		renderTemplate(w, r, "driver_reports.html", data)
 	}
 }
 
@@ -91,7 +93,7 @@ func mileageReportGeneratorHandler(w http.ResponseWriter, r *http.Request) {
 // importDataWizardHandler shows the import data wizard
 func importDataWizardHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDataImport) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
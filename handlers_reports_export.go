@@ -70,7 +70,7 @@ func maintenanceReportExportHandler(w http.ResponseWriter, r *http.Request) {
 // fleetReportExportHandler handles export of fleet overview reports
 func fleetReportExportHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermReportsExport) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -107,7 +107,7 @@ func fleetReportExportHandler(w http.ResponseWriter, r *http.Request) {
 // analyticsReportExportHandler handles export of analytics reports
 func analyticsReportExportHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermReportsExport) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
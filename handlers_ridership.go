@@ -0,0 +1,369 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ridershipHandler manages card readers and student cards and lists open
+// ridership alerts and today's scans
+func ridershipHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		switch r.FormValue("action") {
+		case "add_reader":
+			addReaderHandler(w, r, user)
+		case "update_reader":
+			updateReaderHandler(w, r)
+		case "rotate_key":
+			rotateReaderKeyHandler(w, r, user)
+		case "assign_card":
+			assignCardHandler(w, r, user)
+		case "retire_card":
+			retireCardHandler(w, r)
+		case "acknowledge":
+			acknowledgeRidershipAlertHandler(w, r, user)
+		default:
+			SendError(w, ErrBadRequest("Unknown action"))
+		}
+		return
+	}
+
+	renderRidershipPage(w, r, user, "", "")
+}
+
+// renderRidershipPage shows the page. A new reader key is shown only on
+// the response that created it.
+func renderRidershipPage(w http.ResponseWriter, r *http.Request, user *User, keyReader, key string) {
+	var readers []RFIDReader
+	if err := db.Select(&readers, `
+		SELECT reader_id, name, bus_id, active, last_seen_at, created_by, created_at
+		FROM rfid_readers ORDER BY active DESC, reader_id
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load readers", err))
+		return
+	}
+
+	var cards []struct {
+		CardUID     string    `db:"card_uid"`
+		StudentID   string    `db:"student_id"`
+		StudentName string    `db:"student_name"`
+		IssuedBy    string    `db:"issued_by"`
+		IssuedAt    time.Time `db:"issued_at"`
+	}
+	if err := db.Select(&cards, `
+		SELECT c.card_uid, c.student_id, s.name AS student_name,
+			COALESCE(c.issued_by, '') AS issued_by, c.issued_at
+		FROM student_cards c
+		JOIN students s ON s.student_id = c.student_id
+		WHERE c.active
+		ORDER BY s.name, c.card_uid
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load cards", err))
+		return
+	}
+
+	// Cards read in the last week that nobody holds, so they can be
+	// issued from here
+	var unknownCards []struct {
+		CardUID  string    `db:"card_uid"`
+		Scans    int       `db:"scans"`
+		LastSeen time.Time `db:"last_seen"`
+		BusID    string    `db:"bus_id"`
+	}
+	if err := db.Select(&unknownCards, `
+		SELECT DISTINCT ON (card_uid) card_uid,
+			COUNT(*) OVER (PARTITION BY card_uid) AS scans,
+			scanned_at AS last_seen, COALESCE(bus_id, '') AS bus_id
+		FROM rfid_scans
+		WHERE result = 'unknown_card' AND scanned_at > CURRENT_DATE - 7
+			AND NOT EXISTS (SELECT 1 FROM student_cards c WHERE c.card_uid = rfid_scans.card_uid AND c.active)
+		ORDER BY card_uid, scanned_at DESC
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load unknown cards", err))
+		return
+	}
+
+	var alerts []RidershipAlert
+	if err := db.Select(&alerts, `
+		SELECT a.*, s.name AS student_name
+		FROM ridership_alerts a
+		JOIN students s ON s.student_id = a.student_id
+		WHERE a.acknowledged_at IS NULL AND a.date > CURRENT_DATE - 14
+		ORDER BY a.created_at DESC
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load alerts", err))
+		return
+	}
+
+	var scans []struct {
+		ScannedAt   time.Time `db:"scanned_at"`
+		ReaderID    string    `db:"reader_id"`
+		BusID       string    `db:"bus_id"`
+		CardUID     string    `db:"card_uid"`
+		StudentName string    `db:"student_name"`
+		Result      string    `db:"result"`
+	}
+	if err := db.Select(&scans, `
+		SELECT rs.scanned_at, rs.reader_id, COALESCE(rs.bus_id, '') AS bus_id, rs.card_uid,
+			COALESCE(s.name, '') AS student_name, rs.result
+		FROM rfid_scans rs
+		LEFT JOIN students s ON s.student_id = rs.student_id
+		WHERE rs.scanned_at >= CURRENT_DATE
+		ORDER BY rs.scanned_at DESC
+		LIMIT 100
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load scans", err))
+		return
+	}
+
+	var buses []string
+	if err := db.Select(&buses, `SELECT bus_id FROM buses ORDER BY bus_id`); err != nil {
+		SendError(w, ErrInternal("Failed to load buses", err))
+		return
+	}
+	var students []struct {
+		StudentID string `db:"student_id"`
+		Name      string `db:"name"`
+	}
+	if err := db.Select(&students, `SELECT student_id, name FROM students WHERE active ORDER BY name`); err != nil {
+		SendError(w, ErrInternal("Failed to load students", err))
+		return
+	}
+
+	renderTemplate(w, r, "ridership.html", map[string]interface{}{
+		"User":         user,
+		"CSRFToken":    getSessionCSRFToken(r),
+		"Readers":      readers,
+		"Cards":        cards,
+		"UnknownCards": unknownCards,
+		"Alerts":       alerts,
+		"Scans":        scans,
+		"Buses":        buses,
+		"Students":     students,
+		"KeyReader":    keyReader,
+		"ReaderKey":    key,
+		"CardUID":      normalizeCardUID(r.URL.Query().Get("card")),
+		"Saved":        r.URL.Query().Get("saved"),
+	})
+}
+
+// addReaderHandler registers a reader and shows its upload key once
+func addReaderHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	readerID := strings.TrimSpace(r.FormValue("reader_id"))
+	name := strings.TrimSpace(r.FormValue("name"))
+	busID := strings.TrimSpace(r.FormValue("bus_id"))
+	if readerID == "" || len(readerID) > 50 {
+		SendError(w, ErrBadRequest("Reader ID is required and must be at most 50 characters"))
+		return
+	}
+
+	key, hash := newReaderKey()
+	result, err := db.Exec(`
+		INSERT INTO rfid_readers (reader_id, name, bus_id, key_hash, created_by)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		ON CONFLICT (reader_id) DO NOTHING
+	`, readerID, name, busID, hash, user.Username)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to add reader", err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		SendError(w, ErrConflict("A reader with that ID already exists"))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "create", "rfid_reader", readerID, map[string]AuditChange{
+		"name":   {To: name},
+		"bus_id": {To: busID},
+	})
+	log.Printf("%s registered card reader %s on bus %q", user.Username, readerID, busID)
+	renderRidershipPage(w, r, user, readerID, key)
+}
+
+// updateReaderHandler moves a reader to another bus, renames it, or
+// switches it off or on
+func updateReaderHandler(w http.ResponseWriter, r *http.Request) {
+	readerID := r.FormValue("reader_id")
+	name := strings.TrimSpace(r.FormValue("name"))
+	busID := strings.TrimSpace(r.FormValue("bus_id"))
+	active := r.FormValue("active") == "on"
+
+	var before RFIDReader
+	err := db.Get(&before, `
+		SELECT reader_id, name, bus_id, active, last_seen_at, created_by, created_at
+		FROM rfid_readers WHERE reader_id = $1
+	`, readerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendError(w, ErrNotFound("Reader"))
+		return
+	}
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load reader", err))
+		return
+	}
+
+	if _, err := db.Exec(`
+		UPDATE rfid_readers SET name = $2, bus_id = NULLIF($3, ''), active = $4
+		WHERE reader_id = $1
+	`, readerID, name, busID, active); err != nil {
+		SendError(w, ErrInternal("Failed to update reader", err))
+		return
+	}
+
+	changes := map[string]AuditChange{}
+	if before.Name != name {
+		changes["name"] = AuditChange{From: before.Name, To: name}
+	}
+	if before.BusID.String != busID {
+		changes["bus_id"] = AuditChange{From: before.BusID.String, To: busID}
+	}
+	if before.Active != active {
+		changes["active"] = AuditChange{From: before.Active, To: active}
+	}
+	recordAuditChanges(auditActorFromRequest(r), "update", "rfid_reader", readerID, changes)
+	http.Redirect(w, r, "/ridership?saved=reader", http.StatusSeeOther)
+}
+
+// rotateReaderKeyHandler replaces a reader's key, for a lost or
+// reinstalled reader
+func rotateReaderKeyHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	readerID := r.FormValue("reader_id")
+	key, hash := newReaderKey()
+	result, err := db.Exec(`UPDATE rfid_readers SET key_hash = $2 WHERE reader_id = $1`, readerID, hash)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to replace reader key", err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		SendError(w, ErrNotFound("Reader"))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "update", "rfid_reader", readerID, map[string]AuditChange{
+		"key": {From: "(previous key)", To: "(new key)"},
+	})
+	log.Printf("%s replaced the key for card reader %s", user.Username, readerID)
+	renderRidershipPage(w, r, user, readerID, key)
+}
+
+// assignCardHandler issues a card to a student. It replaces the student's
+// earlier card, and takes the card back from anyone else holding it.
+func assignCardHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	uid := normalizeCardUID(r.FormValue("card_uid"))
+	studentID := r.FormValue("student_id")
+	if uid == "" {
+		SendError(w, ErrBadRequest("Card UID must be the hex number printed on or read from the card"))
+		return
+	}
+	if studentID == "" {
+		SendError(w, ErrBadRequest("Choose a student"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		SendError(w, ErrInternal("Failed to start transaction", err))
+		return
+	}
+	defer tx.Rollback()
+
+	var previous []string
+	if err := tx.Select(&previous, `
+		UPDATE student_cards SET active = false
+		WHERE student_id = $1 AND active AND card_uid <> $2
+		RETURNING card_uid
+	`, studentID, uid); err != nil {
+		SendError(w, ErrInternal("Failed to retire earlier card", err))
+		return
+	}
+	var heldBy sql.NullString
+	if err := tx.Get(&heldBy, `
+		SELECT student_id FROM student_cards WHERE card_uid = $1 AND active AND student_id <> $2
+	`, uid, studentID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		SendError(w, ErrInternal("Failed to check card", err))
+		return
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO student_cards (card_uid, student_id, active, issued_by, issued_at)
+		VALUES ($1, $2, true, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (card_uid) DO UPDATE SET
+			student_id = EXCLUDED.student_id, active = true,
+			issued_by = EXCLUDED.issued_by, issued_at = EXCLUDED.issued_at
+	`, uid, studentID, user.Username); err != nil {
+		SendError(w, ErrInternal("Failed to issue card", err))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		SendError(w, ErrInternal("Failed to issue card", err))
+		return
+	}
+
+	changes := map[string]AuditChange{"student_id": {From: heldBy.String, To: studentID}}
+	if len(previous) > 0 {
+		changes["replaces"] = AuditChange{To: strings.Join(previous, ", ")}
+	}
+	recordAuditChanges(auditActorFromRequest(r), "update", "student_card", uid, changes)
+	http.Redirect(w, r, "/ridership?saved=card", http.StatusSeeOther)
+}
+
+// retireCardHandler stops a lost or returned card from being accepted
+func retireCardHandler(w http.ResponseWriter, r *http.Request) {
+	uid := normalizeCardUID(r.FormValue("card_uid"))
+	var studentID string
+	err := db.Get(&studentID, `
+		UPDATE student_cards SET active = false
+		WHERE card_uid = $1 AND active
+		RETURNING student_id
+	`, uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendError(w, ErrNotFound("Card"))
+		return
+	}
+	if err != nil {
+		SendError(w, ErrInternal("Failed to retire card", err))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "update", "student_card", uid, map[string]AuditChange{
+		"student_id": {From: studentID},
+		"active":     {From: true, To: false},
+	})
+	http.Redirect(w, r, "/ridership?saved=card", http.StatusSeeOther)
+}
+
+// acknowledgeRidershipAlertHandler marks an alert as dealt with
+func acknowledgeRidershipAlertHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	id, err := strconv.Atoi(r.FormValue("alert_id"))
+	if err != nil {
+		SendError(w, ErrBadRequest("Invalid alert"))
+		return
+	}
+	result, err := db.Exec(`
+		UPDATE ridership_alerts SET acknowledged_by = $2, acknowledged_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND acknowledged_at IS NULL
+	`, id, user.Username)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to acknowledge alert", err))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		SendError(w, ErrNotFound("Open alert"))
+		return
+	}
+	http.Redirect(w, r, "/ridership?saved=alert", http.StatusSeeOther)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"html/template"
 	"log"
@@ -192,6 +193,10 @@ func saveRoutePlanHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to save route plan", http.StatusInternalServerError)
 		return
 	}
+	getETAEngine().InvalidateRoute(req.RouteID)
+	if err := refreshRouteCorridors(req.RouteID); err != nil {
+		log.Printf("Failed to refresh route corridors: %v", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -231,7 +236,7 @@ func getRoutePlanHandler(w http.ResponseWriter, r *http.Request) {
 // updateDeviationSettingsHandler updates deviation monitoring settings
 func updateDeviationSettingsHandler(w http.ResponseWriter, r *http.Request) {
 	session := getUserFromSession(r)
-	if session == nil || session.Role != "manager" {
+	if session == nil || !roleHasPermission(session.Role, PermRoutesEdit) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -507,8 +512,16 @@ func saveRoutePlan(routeID string, stops []RouteStop) error {
 	}
 	defer tx.Rollback()
 
+	if err := replaceRoutePlan(tx, routeID, stops); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRoutePlan swaps a route's stops within the caller's transaction
+func replaceRoutePlan(tx *sql.Tx, routeID string, stops []RouteStop) error {
 	// Delete existing stops
-	_, err = tx.Exec("DELETE FROM route_plans WHERE route_id = $1", routeID)
+	_, err := tx.Exec("DELETE FROM route_plans WHERE route_id = $1", routeID)
 	if err != nil {
 		return err
 	}
@@ -528,7 +541,7 @@ func saveRoutePlan(routeID string, stops []RouteStop) error {
 		}
 	}
 
-	return tx.Commit()
+	return nil
 }
 
 func getAllActiveRoutes() []Route {
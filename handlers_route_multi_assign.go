@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -13,7 +14,7 @@ import (
 // Handle assigning multiple routes to a driver with the same bus
 func handleMultiRouteAssign(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -51,6 +52,18 @@ func handleMultiRouteAssign(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	blocking, _, err := driverQualificationProblems(driver, busID, routeIDs...)
+	if err != nil {
+		log.Printf("Error checking driver qualifications: %v", err)
+		http.Redirect(w, r, "/assign-routes?error=database", http.StatusSeeOther)
+		return
+	}
+	if len(blocking) > 0 {
+		log.Printf("Multi-assign refused, %s is not qualified: %s", driver, describeConflicts(blocking))
+		http.Redirect(w, r, "/assign-routes?error=not_qualified&driver="+url.QueryEscape(driver), http.StatusSeeOther)
+		return
+	}
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -89,6 +102,7 @@ func handleMultiRouteAssign(w http.ResponseWriter, r *http.Request) {
 
 	// Insert new assignments
 	successCount := 0
+	var assigned []string
 	for _, routeID := range routeIDs {
 		routeID = strings.TrimSpace(routeID)
 		if routeID == "" {
@@ -115,9 +129,11 @@ func handleMultiRouteAssign(w http.ResponseWriter, r *http.Request) {
 				log.Printf("Fallback also failed for route %s: %v", routeID, err2)
 			} else {
 				successCount++
+				assigned = append(assigned, routeID)
 			}
 		} else {
 			successCount++
+			assigned = append(assigned, routeID)
 		}
 	}
 
@@ -130,6 +146,9 @@ func handleMultiRouteAssign(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		log.Printf("Successfully assigned %d routes to driver %s with bus %s", successCount, driver, busID)
+		for _, routeID := range assigned {
+			auditRouteAssignment(r, "assign", routeID, driver, busID)
+		}
 		http.Redirect(w, r, fmt.Sprintf("/assign-routes?success=1&count=%d", successCount), http.StatusSeeOther)
 	} else {
 		http.Redirect(w, r, "/assign-routes?error=no_assignments", http.StatusSeeOther)
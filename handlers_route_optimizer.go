@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// routeOptimizerHandler proposes shared stops and a stop order for a route
+// from its riders' addresses. POST either places an address by hand or
+// applies the plan.
+func routeOptimizerHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		params := parseOptimizerParams(r.PostForm)
+		switch r.FormValue("action") {
+		case "locate":
+			locateAddressHandler(w, r, user, params)
+		case "apply":
+			applyRouteOptimizationHandler(w, r, user, params)
+		default:
+			SendError(w, ErrBadRequest("Unknown action"))
+		}
+		return
+	}
+
+	var routes []struct {
+		RouteID   string `db:"route_id"`
+		RouteName string `db:"route_name"`
+	}
+	if err := db.Select(&routes, `SELECT route_id, route_name FROM routes ORDER BY route_name, route_id`); err != nil {
+		SendError(w, ErrInternal("Failed to load routes", err))
+		return
+	}
+	var schools []struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := db.Select(&schools, `
+		SELECT id, name FROM geofences
+		WHERE type = 'school' AND center_latitude IS NOT NULL
+		ORDER BY name
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load schools", err))
+		return
+	}
+
+	params := parseOptimizerParams(r.URL.Query())
+	if params.SchoolID == 0 && len(schools) == 1 {
+		params.SchoolID = schools[0].ID
+	}
+
+	var opt *RouteOptimization
+	if params.RouteID != "" && params.SchoolID != 0 {
+		var err error
+		opt, err = optimizeRoute(params)
+		if errors.Is(err, sql.ErrNoRows) {
+			SendError(w, ErrNotFound("Route or school"))
+			return
+		}
+		if err != nil {
+			SendError(w, ErrInternal("Failed to optimize route", err))
+			return
+		}
+	}
+
+	applied, _ := strconv.Atoi(r.URL.Query().Get("applied"))
+	renderTemplate(w, r, "route_optimizer.html", map[string]interface{}{
+		"User":         user,
+		"CSRFToken":    getSessionCSRFToken(r),
+		"Params":       params,
+		"Routes":       routes,
+		"Schools":      schools,
+		"Optimization": opt,
+		"Applied":      applied,
+		"Located":      r.URL.Query().Get("located") != "",
+	})
+}
+
+// locateAddressHandler records coordinates for an address the geocoders
+// couldn't find
+func locateAddressHandler(w http.ResponseWriter, r *http.Request, user *User, params RouteOptimizerParams) {
+	address := strings.TrimSpace(r.FormValue("address"))
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(r.FormValue("latitude")), 64)
+	lng, lngErr := strconv.ParseFloat(strings.TrimSpace(r.FormValue("longitude")), 64)
+	if normalizeAddress(address) == "" {
+		SendError(w, ErrBadRequest("Address is required"))
+		return
+	}
+	if latErr != nil || lngErr != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		SendError(w, ErrBadRequest("Latitude and longitude must be valid coordinates"))
+		return
+	}
+
+	if err := saveGeocodedAddress(address, GeoPoint{Latitude: lat, Longitude: lng}, "manual", user.Username); err != nil {
+		SendError(w, ErrInternal("Failed to save location", err))
+		return
+	}
+	log.Printf("%s placed %q at %.6f, %.6f", user.Username, address, lat, lng)
+	http.Redirect(w, r, "/route-optimizer?located=1&"+params.Query(), http.StatusSeeOther)
+}
+
+// applyRouteOptimizationHandler optimizes again with the reviewed limits
+// and saves the result as the route's stop plan
+func applyRouteOptimizationHandler(w http.ResponseWriter, r *http.Request, user *User, params RouteOptimizerParams) {
+	opt, err := optimizeRoute(params)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to optimize route", err))
+		return
+	}
+	if !opt.CanApply() {
+		if len(opt.Problems) == 0 {
+			SendError(w, ErrBadRequest("The route has no riders to plan stops for"))
+			return
+		}
+		SendError(w, ErrBadRequest("The plan can't be applied: "+strings.Join(opt.Problems, "; ")))
+		return
+	}
+
+	var before int
+	if err := db.Get(&before, `SELECT COUNT(*) FROM route_plans WHERE route_id = $1`, params.RouteID); err != nil {
+		SendError(w, ErrInternal("Failed to load the current plan", err))
+		return
+	}
+	if err := applyRouteOptimization(opt); err != nil {
+		SendError(w, ErrInternal("Failed to save the route plan", err))
+		return
+	}
+
+	getETAEngine().InvalidateRoute(params.RouteID)
+	if err := refreshRouteCorridors(params.RouteID); err != nil {
+		log.Printf("Failed to refresh route corridors: %v", err)
+	}
+	dataCache.clearStudents()
+
+	recordAuditChanges(auditActorFromRequest(r), "update", "route_plan", params.RouteID, map[string]AuditChange{
+		"stops":          {From: before, To: len(opt.Stops)},
+		"school":         {To: opt.School},
+		"max_walk_m":     {To: params.MaxWalkMeters},
+		"max_ride_min":   {To: params.MaxRideMinutes},
+		"longest_ride":   {To: opt.LongestRideMinutes},
+		"riders_ordered": {To: opt.Riders},
+	})
+	log.Printf("%s applied an optimized plan to route %s: %d stops for %d riders",
+		user.Username, params.RouteID, len(opt.Stops), opt.Riders)
+
+	http.Redirect(w, r, fmt.Sprintf("/route-optimizer?applied=%d&%s", len(opt.Stops), params.Query()), http.StatusSeeOther)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// RoutePreference is one route and how the driver feels about it:
+// 1 preferred, -1 rather not, 0 no preference
+type RoutePreference struct {
+	RouteID    string `db:"route_id"`
+	RouteName  string `db:"route_name"`
+	Preference int    `db:"preference"`
+}
+
+// routePreferencesHandler lets a driver mark routes they'd like or would
+// rather not drive, which the assignment planner takes into account
+func routePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	var preferences []RoutePreference
+	err := db.Select(&preferences, `
+		SELECT r.route_id, r.route_name, COALESCE(p.preference, 0) AS preference
+		FROM routes r
+		LEFT JOIN driver_route_preferences p ON p.route_id = r.route_id AND p.username = $1
+		ORDER BY r.route_name, r.route_id
+	`, user.Username)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load routes", err))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if err := saveRoutePreferences(user.Username, preferences, r); err != nil {
+			SendError(w, ErrInternal("Failed to save preferences", err))
+			return
+		}
+		log.Printf("%s updated their route preferences", user.Username)
+		http.Redirect(w, r, "/route-preferences?saved=1", http.StatusSeeOther)
+		return
+	}
+
+	renderTemplate(w, r, "route_preferences.html", map[string]interface{}{
+		"User":        user,
+		"CSRFToken":   getSessionCSRFToken(r),
+		"Preferences": preferences,
+		"Saved":       r.URL.Query().Get("saved") != "",
+	})
+}
+
+// saveRoutePreferences replaces the driver's preferences with the ones
+// submitted for each known route
+func saveRoutePreferences(username string, routes []RoutePreference, r *http.Request) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM driver_route_preferences WHERE username = $1`, username); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		var preference int
+		switch r.FormValue("preference_" + route.RouteID) {
+		case "1":
+			preference = 1
+		case "-1":
+			preference = -1
+		default:
+			continue
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO driver_route_preferences (username, route_id, preference)
+			VALUES ($1, $2, $3)
+		`, username, route.RouteID, preference); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -16,7 +17,7 @@ func assignRouteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -33,8 +34,29 @@ func assignRouteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A bus held for repairs can't go out on a route
+	if hold, err := vehicleHold(busID); err != nil {
+		log.Printf("Error checking work order holds for %s: %v", busID, err)
+	} else if hold != nil {
+		http.Error(w, fmt.Sprintf("Bus %s is out of service until work order #%d is signed off", busID, hold.ID), http.StatusConflict)
+		return
+	}
+
+	// Drivers without the credentials this bus and route call for can't
+	// be assigned at all
+	blocking, warnings, err := driverQualificationProblems(driver, busID, routeID)
+	if err != nil {
+		log.Printf("Error checking driver qualifications: %v", err)
+		http.Error(w, "Failed to check driver qualifications", http.StatusInternalServerError)
+		return
+	}
+	if len(blocking) > 0 {
+		http.Error(w, "Driver is not qualified for this assignment: "+describeConflicts(blocking), http.StatusConflict)
+		return
+	}
+
 	// Create assignment (removed route_name as it's not in the table)
-	_, err := db.Exec(`
+	_, err = db.Exec(`
 		INSERT INTO route_assignments (driver, bus_id, route_id, assigned_date, created_at)
 		VALUES ($1, $2, $3, CURRENT_DATE, CURRENT_TIMESTAMP)
 		ON CONFLICT ON CONSTRAINT route_assignments_unique_assignment DO UPDATE
@@ -46,10 +68,31 @@ func assignRouteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to assign route", http.StatusInternalServerError)
 		return
 	}
+	auditRouteAssignment(r, "assign", routeID, driver, busID)
 
+	if len(warnings) > 0 {
+		http.Redirect(w, r, "/assign-routes?warning=credentials&driver="+url.QueryEscape(driver), http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/assign-routes", http.StatusSeeOther)
 }
 
+// auditRouteAssignment records a driver and bus being put on or taken off
+// a route, so each route's history shows who drove it when
+func auditRouteAssignment(r *http.Request, action, routeID, driver, busID string) {
+	changes := map[string]AuditChange{
+		"driver": {To: driver},
+		"bus_id": {To: busID},
+	}
+	if action == "unassign" {
+		changes = map[string]AuditChange{
+			"driver": {From: driver},
+			"bus_id": {From: busID},
+		}
+	}
+	recordAuditChanges(auditActorFromRequest(r), action, "route_assignment", routeID, changes)
+}
+
 // unassignRouteHandler removes a route assignment
 func unassignRouteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -58,7 +101,7 @@ func unassignRouteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -78,13 +121,17 @@ func unassignRouteHandler(w http.ResponseWriter, r *http.Request) {
 		args = append(args, routeID)
 	}
 	
-	_, err := db.Exec(query, args...)
+	var removed []string
+	err := db.Select(&removed, query+` RETURNING route_id`, args...)
 
 	if err != nil {
 		log.Printf("Error removing route assignment: %v", err)
 		http.Error(w, "Failed to unassign route", http.StatusInternalServerError)
 		return
 	}
+	for _, id := range removed {
+		auditRouteAssignment(r, "unassign", id, driver, busID)
+	}
 
 	http.Redirect(w, r, "/assign-routes", http.StatusSeeOther)
 }
@@ -97,7 +144,7 @@ func addRouteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesEdit) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -110,15 +157,16 @@ func addRouteHandler(w http.ResponseWriter, r *http.Request) {
 	
 	routeName := r.FormValue("route_name")
 	description := r.FormValue("description")
+	needsLift := r.FormValue("needs_wheelchair_lift") == "on"
 
 	// Generate route ID
 	routeID := fmt.Sprintf("ROUTE-%d", time.Now().Unix())
 
 	// Insert new route
 	_, err := db.Exec(`
-		INSERT INTO routes (route_id, route_name, description, created_at)
-		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
-	`, routeID, routeName, description)
+		INSERT INTO routes (route_id, route_name, description, needs_wheelchair_lift, created_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+	`, routeID, routeName, description, needsLift)
 
 	if err != nil {
 		log.Printf("Error adding route: %v", err)
@@ -140,7 +188,7 @@ func editRouteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesEdit) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -161,13 +209,14 @@ func editRouteHandler(w http.ResponseWriter, r *http.Request) {
 	routeID := r.FormValue("route_id")
 	routeName := r.FormValue("route_name")
 	description := r.FormValue("description")
+	needsLift := r.FormValue("needs_wheelchair_lift") == "on"
 
 	// Update route
 	_, err = db.Exec(`
 		UPDATE routes 
-		SET route_name = $2, description = $3
+		SET route_name = $2, description = $3, needs_wheelchair_lift = $4
 		WHERE route_id = $1
-	`, routeID, routeName, description)
+	`, routeID, routeName, description, needsLift)
 
 	if err != nil {
 		log.Printf("Error updating route: %v", err)
@@ -190,7 +239,7 @@ func deleteRouteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesEdit) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -316,7 +365,7 @@ func viewMileageReportsHandler(w http.ResponseWriter, r *http.Request) {
 // exportMileageHandler exports mileage data
 func exportMileageHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermReportsExport) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
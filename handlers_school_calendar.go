@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCalendarRangeDays caps how many days one entry can cover
+const maxCalendarRangeDays = 120
+
+// calendarSchool is a school geofence that can have its own calendar
+type calendarSchool struct {
+	ID   int    `db:"id"`
+	Name string `db:"name"`
+}
+
+// schoolCalendarHandler lists calendar entries and handles adding and
+// removing them, closures, ICS imports and which school each route serves
+func schoolCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxFileSize+1<<20)
+		if err := r.ParseMultipartForm(MaxFileSize); err != nil && err != http.ErrNotMultipart {
+			SendError(w, ErrBadRequest(fmt.Sprintf("Upload too large; calendars must be under %d MB", MaxFileSize>>20)))
+			return
+		}
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		switch r.FormValue("action") {
+		case "add":
+			addCalendarDaysHandler(w, r, user)
+		case "delete":
+			deleteCalendarDayHandler(w, r)
+		case "closure":
+			announceClosureHandler(w, r, user)
+		case "import":
+			importCalendarHandler(w, r, user)
+		case "route_school":
+			setRouteSchoolHandler(w, r)
+		default:
+			SendError(w, ErrBadRequest("Unknown action"))
+		}
+		return
+	}
+
+	renderSchoolCalendarPage(w, r, user, nil)
+}
+
+// renderSchoolCalendarPage shows entries from today on, optionally for one
+// school, along with the result of an import just made
+func renderSchoolCalendarPage(w http.ResponseWriter, r *http.Request, user *User, imported *CalendarImport) {
+	schools := loadCalendarSchools()
+	school, _ := strconv.Atoi(r.URL.Query().Get("school"))
+
+	query := `
+		SELECT c.id, c.school_id, COALESCE(g.name, '') AS school_name, c.date, c.day_type, c.name,
+			c.shift_minutes, c.source, c.ics_uid, c.created_by, c.created_at
+		FROM calendar_days c
+		LEFT JOIN geofences g ON g.id = c.school_id
+		WHERE c.date >= CURRENT_DATE`
+	args := []interface{}{}
+	if school != 0 {
+		query += ` AND c.school_id IN (0, $1)`
+		args = append(args, school)
+	}
+	query += ` ORDER BY c.date, c.school_id LIMIT 500`
+
+	var days []CalendarDay
+	if err := db.Select(&days, query, args...); err != nil {
+		SendError(w, ErrInternal("Failed to load calendar", err))
+		return
+	}
+
+	var routes []struct {
+		RouteID   string `db:"route_id"`
+		RouteName string `db:"route_name"`
+		SchoolID  int    `db:"school_id"`
+	}
+	if err := db.Select(&routes, `
+		SELECT route_id, route_name, COALESCE(school_id, 0) AS school_id
+		FROM routes ORDER BY route_name
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load routes", err))
+		return
+	}
+
+	// The next two weeks as the district sees them, so gaps are easy to spot
+	today := dateOnly(time.Now())
+	cal := serviceCalendarFor(today, today.AddDate(0, 0, 13))
+	var upcoming []ServiceDay
+	for d := today; len(upcoming) < 14; d = d.AddDate(0, 0, 1) {
+		upcoming = append(upcoming, cal.Day(d, school))
+	}
+
+	renderTemplate(w, r, "school_calendar.html", map[string]interface{}{
+		"User":      user,
+		"CSRFToken": getSessionCSRFToken(r),
+		"Days":      days,
+		"Upcoming":  upcoming,
+		"Schools":   schools,
+		"School":    school,
+		"Routes":    routes,
+		"DayTypes":  calendarDayTypes,
+		"Imported":  imported,
+		"Saved":     r.URL.Query().Get("saved"),
+		"Today":     today.Format("2006-01-02"),
+	})
+}
+
+// loadCalendarSchools lists school geofences. Without GPS tracking set up
+// there are none, and only the district calendar is available.
+func loadCalendarSchools() []calendarSchool {
+	var schools []calendarSchool
+	if err := db.Select(&schools, `
+		SELECT id, name FROM geofences WHERE type = 'school' AND active ORDER BY name
+	`); err != nil {
+		log.Printf("Error loading schools for calendar: %v", err)
+	}
+	return schools
+}
+
+// calendarPlace names the district or a school for messages
+func calendarPlace(schoolID int) (string, error) {
+	if schoolID == 0 {
+		return "The district", nil
+	}
+	var name string
+	if err := db.Get(&name, `SELECT name FROM geofences WHERE id = $1 AND type = 'school'`, schoolID); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// calendarEntryFromForm reads the fields shared by manual entries and
+// closures
+func calendarEntryFromForm(r *http.Request, user *User) (CalendarDay, error) {
+	schoolID, _ := strconv.Atoi(r.FormValue("school_id"))
+	shift, _ := strconv.Atoi(r.FormValue("shift_minutes"))
+	day := CalendarDay{
+		SchoolID:     schoolID,
+		DayType:      r.FormValue("day_type"),
+		Name:         truncateString(strings.TrimSpace(r.FormValue("name")), 255),
+		ShiftMinutes: shift,
+		Source:       "manual",
+	}
+	day.CreatedBy.String, day.CreatedBy.Valid = user.Username, true
+
+	if _, ok := calendarDayTypes[day.DayType]; !ok {
+		return day, fmt.Errorf("choose a day type")
+	}
+	if day.DayType == DayTypeEarlyRelease || day.DayType == DayTypeLateStart {
+		if shift <= 0 || shift > 480 {
+			return day, fmt.Errorf("early release and late start need a shift between 1 and 480 minutes")
+		}
+	} else {
+		day.ShiftMinutes = 0
+	}
+	if schoolID != 0 {
+		if _, err := calendarPlace(schoolID); err != nil {
+			return day, fmt.Errorf("unknown school")
+		}
+	}
+	return day, nil
+}
+
+// addCalendarDaysHandler saves an entry for each day of a range. A range
+// skips weekends; a single date is saved whatever day it falls on.
+func addCalendarDaysHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	day, err := calendarEntryFromForm(r, user)
+	if err != nil {
+		SendError(w, ErrBadRequest(err.Error()))
+		return
+	}
+	from, err := time.ParseInLocation("2006-01-02", r.FormValue("date_from"), time.Local)
+	if err != nil {
+		SendError(w, ErrBadRequest("Invalid start date"))
+		return
+	}
+	to := from
+	if v := r.FormValue("date_to"); v != "" {
+		if to, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil || to.Before(from) {
+			SendError(w, ErrBadRequest("Invalid end date"))
+			return
+		}
+	}
+	if to.Sub(from) > maxCalendarRangeDays*24*time.Hour {
+		SendError(w, ErrBadRequest(fmt.Sprintf("An entry can cover at most %d days", maxCalendarRangeDays)))
+		return
+	}
+
+	saved := 0
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		weekend := d.Weekday() == time.Saturday || d.Weekday() == time.Sunday
+		if weekend && !from.Equal(to) {
+			continue
+		}
+		day.Date = d
+		if _, err := saveCalendarDay(day); err != nil {
+			SendError(w, ErrInternal("Failed to save calendar entry", err))
+			return
+		}
+		saved++
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "create", "calendar_day",
+		fmt.Sprintf("%d:%s", day.SchoolID, from.Format("2006-01-02")), map[string]AuditChange{
+			"day_type":      {To: day.DayType},
+			"name":          {To: day.Name},
+			"shift_minutes": {To: day.ShiftMinutes},
+			"through":       {To: to.Format("2006-01-02")},
+		})
+	log.Printf("%s added %d %s calendar day(s) for school %d from %s", user.Username, saved, day.DayType, day.SchoolID, from.Format("2006-01-02"))
+	http.Redirect(w, r, fmt.Sprintf("/school-calendar?school=%d&saved=%d", day.SchoolID, saved), http.StatusSeeOther)
+}
+
+// deleteCalendarDayHandler removes an entry, returning the date to the
+// district calendar or the usual week
+func deleteCalendarDayHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		SendError(w, ErrBadRequest("Invalid entry"))
+		return
+	}
+	var day CalendarDay
+	if err := db.Get(&day, `
+		DELETE FROM calendar_days WHERE id = $1
+		RETURNING id, school_id, '' AS school_name, date, day_type, name, shift_minutes,
+			source, ics_uid, created_by, created_at
+	`, id); err != nil {
+		SendError(w, ErrNotFound("Calendar entry"))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "delete", "calendar_day",
+		fmt.Sprintf("%d:%s", day.SchoolID, day.Date.Format("2006-01-02")), map[string]AuditChange{
+			"day_type": {From: day.DayType},
+			"name":     {From: day.Name},
+		})
+	http.Redirect(w, r, fmt.Sprintf("/school-calendar?school=%d", day.SchoolID), http.StatusSeeOther)
+}
+
+// announceClosureHandler records an unplanned closure, such as a snow day,
+// and tells everyone it affects
+func announceClosureHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	day, err := calendarEntryFromForm(r, user)
+	if err != nil {
+		SendError(w, ErrBadRequest(err.Error()))
+		return
+	}
+	day.DayType = DayTypeClosure
+	day.Date, err = time.ParseInLocation("2006-01-02", r.FormValue("date"), time.Local)
+	if err != nil || day.Date.Before(dateOnly(time.Now())) {
+		SendError(w, ErrBadRequest("Closures need a date from today on"))
+		return
+	}
+	place, err := calendarPlace(day.SchoolID)
+	if err != nil {
+		SendError(w, ErrBadRequest("Unknown school"))
+		return
+	}
+
+	previous := serviceCalendarFor(day.Date, day.Date).Day(day.Date, day.SchoolID)
+	if _, err := saveCalendarDay(day); err != nil {
+		SendError(w, ErrInternal("Failed to save closure", err))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "closure", "calendar_day",
+		fmt.Sprintf("%d:%s", day.SchoolID, day.Date.Format("2006-01-02")), map[string]AuditChange{
+			"day_type": {From: previous.Type, To: day.DayType},
+			"name":     {From: previous.Name, To: day.Name},
+		})
+	log.Printf("%s announced a closure of %s on %s", user.Username, place, day.Date.Format("2006-01-02"))
+
+	if notificationTriggers != nil {
+		go notificationTriggers.TriggerClosureNotifications(day, place)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/school-calendar?school=%d&saved=1", day.SchoolID), http.StatusSeeOther)
+}
+
+// importCalendarHandler loads an iCalendar file exported from a school or
+// district calendar
+func importCalendarHandler(w http.ResponseWriter, r *http.Request, user *User) {
+	schoolID, _ := strconv.Atoi(r.FormValue("school_id"))
+	if _, err := calendarPlace(schoolID); err != nil {
+		SendError(w, ErrBadRequest("Unknown school"))
+		return
+	}
+	shift, err := strconv.Atoi(r.FormValue("shift_minutes"))
+	if err != nil || shift <= 0 || shift > 480 {
+		shift = 120
+	}
+
+	file, _, err := r.FormFile("calendar")
+	if err != nil {
+		SendError(w, ErrBadRequest("Choose an .ics file to import"))
+		return
+	}
+	defer file.Close()
+
+	result, err := importICSCalendar(file, schoolID, shift, user.Username)
+	if err != nil {
+		SendError(w, ErrBadRequest("Failed to import calendar: "+err.Error()))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "import", "calendar_day", strconv.Itoa(schoolID), map[string]AuditChange{
+		"events": {To: result.Events},
+		"saved":  {To: result.Saved},
+	})
+	log.Printf("%s imported %d calendar day(s) for school %d", user.Username, result.Saved, schoolID)
+	renderSchoolCalendarPage(w, r, user, result)
+}
+
+// setRouteSchoolHandler sets which school's calendar a route follows
+func setRouteSchoolHandler(w http.ResponseWriter, r *http.Request) {
+	routeID := r.FormValue("route_id")
+	schoolID, _ := strconv.Atoi(r.FormValue("school_id"))
+	if schoolID != 0 {
+		if _, err := calendarPlace(schoolID); err != nil {
+			SendError(w, ErrBadRequest("Unknown school"))
+			return
+		}
+	}
+
+	var previous int
+	if err := db.Get(&previous, `SELECT COALESCE(school_id, 0) FROM routes WHERE route_id = $1`, routeID); err != nil {
+		SendError(w, ErrNotFound("Route"))
+		return
+	}
+	if _, err := db.Exec(`UPDATE routes SET school_id = NULLIF($2, 0) WHERE route_id = $1`, routeID, schoolID); err != nil {
+		SendError(w, ErrInternal("Failed to update route", err))
+		return
+	}
+
+	recordAuditChanges(auditActorFromRequest(r), "update", "route", routeID, map[string]AuditChange{
+		"school_id": {From: previous, To: schoolID},
+	})
+	http.Redirect(w, r, "/school-calendar?saved=1", http.StatusSeeOther)
+}
@@ -118,8 +118,8 @@ func performGlobalSearch(query string, role string) map[string]interface{} {
 		results["routes"] = routes
 	}
 
-	// Search drivers (managers only)
-	if role == "manager" {
+	// Search drivers (requires driver visibility)
+	if roleHasPermission(role, PermDriversView) {
 		driverRows, err := db.Query(`
 			SELECT id, username, email
 			FROM users
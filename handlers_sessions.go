@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// DeviceSession is a session as listed on the active sessions page
+type DeviceSession struct {
+	*Session
+	Device  string
+	Current bool
+}
+
+// userDeviceSessions lists a user's sessions, marking the one whose ID is
+// current
+func userDeviceSessions(username, current string) ([]DeviceSession, error) {
+	if sessionManager == nil {
+		return nil, nil
+	}
+	sessions, err := sessionManager.UserSessions(username)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]DeviceSession, len(sessions))
+	for i, s := range sessions {
+		devices[i] = DeviceSession{
+			Session: s,
+			Device:  describeUserAgent(s.UserAgent),
+			Current: s.ID == current,
+		}
+	}
+	return devices, nil
+}
+
+// describeUserAgent turns a User-Agent header into something like
+// "Chrome on Windows". Order matters: Edge and Opera also claim to be
+// Chrome, and Chrome claims to be Safari.
+func describeUserAgent(ua string) string {
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Chrome/", "Chrome"},
+		{"CriOS/", "Chrome"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	platform := ""
+	for _, p := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, p.token) {
+			platform = p.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	default:
+		return "Unknown device"
+	}
+}
+
+// activeSessionsHandler shows the devices the user is signed in on and lets
+// them sign any of the others out
+func activeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	current := ""
+	if cookie, err := r.Cookie(SessionCookieName); err == nil {
+		current = hashSessionToken(cookie.Value)
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		switch r.FormValue("action") {
+		case "revoke":
+			id := r.FormValue("id")
+			if id == current {
+				// Signing out this device is just a logout
+				http.Redirect(w, r, "/logout", http.StatusSeeOther)
+				return
+			}
+			if err := sessionManager.RevokeSession(user.Username, id); err != nil {
+				log.Printf("Failed to revoke session for %s: %v", user.Username, err)
+			}
+		case "revoke_others":
+			sessions, err := sessionManager.UserSessions(user.Username)
+			if err != nil {
+				SendError(w, ErrInternal("Failed to load sessions", err))
+				return
+			}
+			for _, s := range sessions {
+				if s.ID == current {
+					continue
+				}
+				if err := sessionManager.RevokeSession(user.Username, s.ID); err != nil {
+					log.Printf("Failed to revoke session for %s: %v", user.Username, err)
+				}
+			}
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("User %s signed out device(s) via %s", user.Username, r.FormValue("action"))
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+		return
+	}
+
+	sessions, err := userDeviceSessions(user.Username, current)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load sessions", err))
+		return
+	}
+
+	renderTemplate(w, r, "sessions.html", map[string]interface{}{
+		"User":       user,
+		"CSRFToken":  getSessionCSRFToken(r),
+		"Navigation": getNavigation(user, "Profile", ""),
+		"Sessions":   sessions,
+	})
+}
@@ -73,7 +73,7 @@ func troubleshootingHandler(w http.ResponseWriter, r *http.Request) {
 	searchQuery := r.URL.Query().Get("search")
 	
 	// Get all troubleshooting categories
-	categories := getTroubleshootingCategories(session.Role)
+	categories := getTroubleshootingCategories(guideAudience(session))
 	
 	// Filter issues by category or search
 	var filteredIssues []TroubleshootingIssue
@@ -81,7 +81,7 @@ func troubleshootingHandler(w http.ResponseWriter, r *http.Request) {
 	
 	if searchQuery != "" {
 		// Search across all issues
-		filteredIssues = searchTroubleshootingIssues(searchQuery, session.Role)
+		filteredIssues = searchTroubleshootingIssues(searchQuery, guideAudience(session))
 	} else if categoryFilter != "" {
 		// Filter by category
 		for i := range categories {
@@ -94,7 +94,7 @@ func troubleshootingHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get frequently viewed issues
-	frequentIssues := getFrequentIssues(session.Role, 5)
+	frequentIssues := getFrequentIssues(guideAudience(session), 5)
 
 	data := struct {
 		Title              string
@@ -117,7 +117,7 @@ func troubleshootingHandler(w http.ResponseWriter, r *http.Request) {
 		FilteredIssues:   filteredIssues,
 		FrequentIssues:   frequentIssues,
 		SearchQuery:      searchQuery,
-		ShowDiagnostics:  session.Role == "manager",
+		ShowDiagnostics:  hasPermission(session, PermSystemAdmin),
 	}
 
 	tmpl := template.Must(template.ParseFiles("templates/troubleshooting.html"))
@@ -151,7 +151,7 @@ func troubleshootingIssueHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check role permissions
-	if issue.UserRole != "all" && !strings.Contains(session.Role, strings.Title(issue.UserRole)) {
+	if issue.UserRole != "all" && issue.UserRole != guideAudience(session) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
@@ -177,7 +177,7 @@ func troubleshootingIssueHandler(w http.ResponseWriter, r *http.Request) {
 		CSPNonce:       generateNonce(),
 		Issue:          issue,
 		RelatedIssues:  relatedIssues,
-		CanRunDiagnostics: session.Role == "manager",
+		CanRunDiagnostics: hasPermission(session, PermSystemAdmin),
 	}
 
 	tmpl := template.Must(template.ParseFiles("templates/troubleshooting_issue.html"))
@@ -191,7 +191,7 @@ func troubleshootingIssueHandler(w http.ResponseWriter, r *http.Request) {
 // API endpoint for system diagnostics
 func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
 	session := getUserFromSession(r)
-	if session == nil || session.Role != "manager" {
+	if session == nil || !roleHasPermission(session.Role, PermSystemAdmin) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -539,7 +539,7 @@ func filterIssuesByCategory(category string, userType string) []TroubleshootingI
 	
 	for _, issue := range allIssues {
 		if issue.Category == category && 
-		   (issue.UserRole == "all" || strings.Contains(userType, strings.Title(issue.UserRole))) {
+		   (issue.UserRole == "all" || issue.UserRole == userType) {
 			issues = append(issues, issue)
 		}
 	}
@@ -583,7 +583,7 @@ func searchTroubleshootingIssues(query string, userType string) []Troubleshootin
 	
 	for _, issue := range allIssues {
 		// Check role permission
-		if issue.UserRole != "all" && !strings.Contains(userType, strings.Title(issue.UserRole)) {
+		if issue.UserRole != "all" && issue.UserRole != userType {
 			continue
 		}
 		
@@ -622,7 +622,7 @@ func getFrequentIssues(userType string, limit int) []TroubleshootingIssue {
 	
 	for _, issue := range allIssues {
 		if issue.Frequency == "common" && 
-		   (issue.UserRole == "all" || strings.Contains(userType, strings.Title(issue.UserRole))) {
+		   (issue.UserRole == "all" || issue.UserRole == userType) {
 			frequent = append(frequent, issue)
 			if len(frequent) >= limit {
 				break
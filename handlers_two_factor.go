@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// pendingLoginCookie carries a password-verified login to /login/2fa
+const pendingLoginCookie = "pending_login"
+
+// startUserSession signs the user in once every required factor has been
+// checked
+func startUserSession(w http.ResponseWriter, r *http.Request, user *User) {
+	userLogins.recordSuccess(user.Username)
+
+	sessionToken := generateSessionToken()
+	storeSession(sessionToken, user, r)
+	log.Printf("Session created with token: %s for user: %s", sessionToken[:8]+"...", user.Username)
+
+	// Detect if we're on HTTPS
+	isHTTPS := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    sessionToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS, // Set based on protocol
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   86400,
+	})
+}
+
+// needsSecondFactor reports whether the user must pass TOTP before getting
+// a session: either they enrolled, or their role requires it
+func needsSecondFactor(username string) (bool, error) {
+	status, err := getTwoFactorStatus(username)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled || status.Required, nil
+}
+
+// lockoutMessage is shown when a login hits a locked account
+func lockoutMessage(err error) string {
+	var locked *AccountLockedError
+	if errors.As(err, &locked) {
+		return "Too many failed sign-in attempts. Try again after " +
+			locked.Until.Format("3:04 PM") + " or ask an administrator to unlock your account."
+	}
+	return "Invalid username or password"
+}
+
+func setPendingLoginCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookie,
+		Value:    token,
+		Path:     "/login/2fa",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(pendingLoginTTL.Seconds()),
+	})
+}
+
+func clearPendingLogin(w http.ResponseWriter, token string) {
+	finishPendingLogin(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:   pendingLoginCookie,
+		Value:  "",
+		Path:   "/login/2fa",
+		MaxAge: -1,
+	})
+}
+
+// loginTwoFactorHandler is the second step of a web login. Users who have
+// enrolled enter a TOTP or recovery code; users whose role requires 2FA
+// but who haven't enrolled set it up here before they can continue.
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(pendingLoginCookie)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	username, ok := lookupPendingLogin(cookie.Value)
+	if !ok {
+		renderTemplate(w, r, "login.html", map[string]interface{}{
+			"Error": "Your sign-in expired. Please enter your password again.",
+		})
+		return
+	}
+
+	status, err := getTwoFactorStatus(username)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load two-factor settings", err))
+		return
+	}
+
+	data := map[string]interface{}{
+		"TwoFactor": true,
+		"Enroll":    !status.Enabled,
+	}
+	if !status.Enabled {
+		secret, err := pendingTOTPSecret(username)
+		if err == nil && secret == "" {
+			secret, err = beginTOTPEnrollment(username)
+		}
+		if err != nil {
+			SendError(w, ErrInternal("Failed to start two-factor enrollment", err))
+			return
+		}
+		data["TOTPSecret"] = secret
+		data["ProvisioningURI"] = totpProvisioningURI(username, secret)
+	}
+
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "login.html", data)
+		return
+	}
+
+	if err := userLogins.checkLocked(username); err != nil {
+		clearPendingLogin(w, cookie.Value)
+		renderTemplate(w, r, "login.html", map[string]interface{}{"Error": lockoutMessage(err)})
+		return
+	}
+
+	code := r.FormValue("code")
+	if !status.Enabled {
+		codes, err := confirmTOTPEnrollment(username, code)
+		if err != nil {
+			data["Error"] = err.Error()
+			renderTemplate(w, r, "login.html", data)
+			return
+		}
+		user, err := loadLoginUser(username)
+		if err != nil {
+			SendError(w, ErrInternal("Failed to load user", err))
+			return
+		}
+
+		log.Printf("User %s enrolled in two-factor authentication at login", username)
+		clearPendingLogin(w, cookie.Value)
+		startUserSession(w, r, user)
+		renderTemplate(w, r, "login.html", map[string]interface{}{
+			"TwoFactor":     true,
+			"RecoveryCodes": codes,
+			"Continue":      homePath(user),
+		})
+		return
+	}
+
+	valid, err := verifySecondFactor(username, code)
+	if err != nil {
+		log.Printf("Second factor check failed for %s: %v", username, err)
+	}
+	if !valid {
+		if lockErr := userLogins.recordFailure(username); lockErr != nil {
+			clearPendingLogin(w, cookie.Value)
+			renderTemplate(w, r, "login.html", map[string]interface{}{"Error": lockoutMessage(lockErr)})
+			return
+		}
+		data["Error"] = "That code isn't valid"
+		renderTemplate(w, r, "login.html", data)
+		return
+	}
+
+	user, err := loadLoginUser(username)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load user", err))
+		return
+	}
+
+	log.Printf("Two-factor login successful for user: %s", username)
+	clearPendingLogin(w, cookie.Value)
+	startUserSession(w, r, user)
+	http.Redirect(w, r, homePath(user), http.StatusSeeOther)
+}
+
+func loadLoginUser(username string) (*User, error) {
+	var user User
+	err := db.Get(&user, `
+		SELECT username, role, status, registration_date, created_at
+		FROM users WHERE username = $1
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// profileTwoFactorHandler lets users enroll in, manage and turn off TOTP
+// from their profile page
+func profileTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		SendError(w, ErrMethodNotAllowed("Only POST method allowed"))
+		return
+	}
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if !validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	var codes []string
+	var err error
+	switch r.FormValue("action") {
+	case "enroll":
+		_, err = beginTOTPEnrollment(user.Username)
+	case "confirm":
+		codes, err = confirmTOTPEnrollment(user.Username, r.FormValue("code"))
+	case "cancel":
+		if status, _ := getTwoFactorStatus(user.Username); status.Pending {
+			err = disableTOTP(user.Username)
+		}
+	case "disable", "regenerate":
+		if roleRequiresTwoFactor(user.Role) && r.FormValue("action") == "disable" {
+			err = errors.New("your role requires two-factor authentication, so it can't be turned off")
+			break
+		}
+		valid, verr := verifySecondFactor(user.Username, r.FormValue("code"))
+		if verr != nil || !valid {
+			userLogins.recordFailure(user.Username)
+			err = errors.New("that code isn't valid")
+			break
+		}
+		if r.FormValue("action") == "disable" {
+			err = disableTOTP(user.Username)
+		} else {
+			codes, err = regenerateRecoveryCodes(user.Username)
+		}
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Two-factor %s failed for %s: %v", r.FormValue("action"), user.Username, err)
+		data := profilePageData(r, user)
+		data["TwoFactorError"] = err.Error()
+		renderTemplate(w, r, "profile.html", data)
+		return
+	}
+
+	log.Printf("User %s completed two-factor action %s", user.Username, r.FormValue("action"))
+	if codes != nil {
+		// Recovery codes are only ever shown on this response
+		data := profilePageData(r, user)
+		data["RecoveryCodes"] = codes
+		renderTemplate(w, r, "profile.html", data)
+		return
+	}
+	http.Redirect(w, r, "/profile#security", http.StatusSeeOther)
+}
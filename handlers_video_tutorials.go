@@ -45,7 +45,7 @@ func videoTutorialsHandler(w http.ResponseWriter, r *http.Request) {
 	categoryFilter := r.URL.Query().Get("category")
 	
 	// Get all video categories
-	categories := getVideoCategories(session.Role)
+	categories := getVideoCategories(guideAudience(session))
 	
 	// Filter videos by category if specified
 	var selectedCategory *VideoCategory
@@ -74,7 +74,7 @@ func videoTutorialsHandler(w http.ResponseWriter, r *http.Request) {
 		CSPNonce:         generateNonce(),
 		Categories:       categories,
 		SelectedCategory: selectedCategory,
-		AllVideos:        getAllVideos(session.Role),
+		AllVideos:        getAllVideos(guideAudience(session)),
 		SearchEnabled:    true,
 	}
 
@@ -109,7 +109,7 @@ func videoPlayerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check role permissions
-	if video.Role != "all" && !strings.Contains(session.Role, strings.Title(video.Role)) {
+	if video.Role != "all" && video.Role != guideAudience(session) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
@@ -158,7 +158,7 @@ func videoSearchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Search videos
-	results := searchVideos(query, session.Role)
+	results := searchVideos(query, guideAudience(session))
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
@@ -424,7 +424,7 @@ func getAllVideos(userType string) []VideoTutorial {
 	// Filter videos based on user role
 	var filtered []VideoTutorial
 	for _, video := range allVideos {
-		if video.Role == "all" || strings.Contains(userType, strings.Title(video.Role)) {
+		if video.Role == "all" || video.Role == userType {
 			filtered = append(filtered, video)
 		}
 	}
@@ -11,7 +11,7 @@ import (
 // exportECSEHandler handles ECSE data export
 func exportECSEHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermReportsExport) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -64,7 +64,7 @@ func addBusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermFleetEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -100,7 +100,7 @@ func addBusHandler(w http.ResponseWriter, r *http.Request) {
 // addBusWizardHandler shows the add bus wizard
 func addBusWizardHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermFleetEdit) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -187,7 +187,7 @@ func saveMaintenanceWizardHandler(w http.ResponseWriter, r *http.Request) {
 // routeAssignmentWizardHandler shows the route assignment wizard
 func routeAssignmentWizardHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -209,7 +209,7 @@ func routeAssignmentWizardHandler(w http.ResponseWriter, r *http.Request) {
 	// Filter active drivers
 	var activeDrivers []User
 	for _, d := range drivers {
-		if d.Role == "driver" && d.Status == "active" {
+		if d.Role == RoleDriver && d.Status == "active" {
 			activeDrivers = append(activeDrivers, d)
 		}
 	}
@@ -244,7 +244,7 @@ func assignRouteWizardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -281,6 +281,17 @@ func assignRouteWizardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	blocking, warnings, err := driverQualificationProblems(driver, busID, routeID)
+	if err != nil {
+		log.Printf("Error checking driver qualifications: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(blocking) > 0 {
+		http.Error(w, "Driver is not qualified for this assignment: "+describeConflicts(blocking), http.StatusConflict)
+		return
+	}
+
 	// Create assignment
 	_, err = db.Exec(`
 		INSERT INTO route_assignments (driver, bus_id, route_id, route_name, assigned_date, created_at)
@@ -292,11 +303,13 @@ func assignRouteWizardHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create assignment", http.StatusInternalServerError)
 		return
 	}
+	auditRouteAssignment(r, "assign", routeID, driver, busID)
 
 	// Return success
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Route assigned successfully",
+		"success":  true,
+		"message":  "Route assigned successfully",
+		"warnings": warnings,
 	})
 }
\ No newline at end of file
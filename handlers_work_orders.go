@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// workOrderRow is an order in the list, with what its lines add up to
+type workOrderRow struct {
+	WorkOrder
+	Cost float64 `db:"cost"`
+}
+
+// workOrdersHandler lists work orders, driver reports and due services
+// that don't have one yet, and opens new orders
+func workOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !hasPermission(user, PermMaintenanceEdit) {
+			SendError(w, ErrForbidden("You don't have permission to open work orders"))
+			return
+		}
+
+		var id int
+		var err error
+		switch r.FormValue("action") {
+		case "create":
+			if strings.TrimSpace(r.FormValue("title")) == "" {
+				SendError(w, ErrBadRequest("A work order needs a title"))
+				return
+			}
+			id, err = createWorkOrder(WorkOrder{
+				VehicleID:   strings.TrimSpace(r.FormValue("vehicle_id")),
+				Title:       truncateString(strings.TrimSpace(r.FormValue("title")), 255),
+				Description: strings.TrimSpace(r.FormValue("description")),
+				Category:    r.FormValue("category"),
+				Priority:    r.FormValue("priority"),
+				Hold:        r.FormValue("hold") == "on",
+			}, user.Username)
+		case "from_issue":
+			issueID, _ := strconv.Atoi(r.FormValue("issue_id"))
+			id, err = openWorkOrderFromIssue(issueID, user.Username)
+		case "from_alert":
+			id, err = openWorkOrderFromAlert(r.FormValue("vehicle_id"), r.FormValue("item"), user.Username)
+		default:
+			SendError(w, ErrBadRequest("Unknown action"))
+			return
+		}
+		if err != nil {
+			sendWorkOrderError(w, err, "open work order")
+			return
+		}
+
+		recordAuditChanges(auditActorFromRequest(r), AuditCreate, "work_order", strconv.Itoa(id), map[string]AuditChange{
+			"source": {To: r.FormValue("action")},
+		})
+		http.Redirect(w, r, fmt.Sprintf("/work-orders/view?id=%d", id), http.StatusSeeOther)
+		return
+	}
+
+	renderWorkOrdersPage(w, r, user)
+}
+
+func renderWorkOrdersPage(w http.ResponseWriter, r *http.Request, user *User) {
+	show := r.URL.Query().Get("show")
+	vehicle := r.URL.Query().Get("vehicle")
+
+	query := `
+		SELECT w.*, (SELECT COALESCE(SUM(l.quantity * l.unit_cost), 0)
+			FROM work_order_lines l WHERE l.work_order_id = w.id) AS cost
+		FROM work_orders w
+		WHERE `
+	if show == "closed" {
+		query += `w.status IN ('inspected', 'cancelled') AND w.updated_at > CURRENT_DATE - 90`
+	} else {
+		query += `w.status NOT IN ('inspected', 'cancelled')`
+	}
+	args := []interface{}{}
+	if vehicle != "" {
+		query += ` AND w.vehicle_id = $1`
+		args = append(args, vehicle)
+	}
+	query += ` ORDER BY CASE w.priority WHEN 'critical' THEN 0 WHEN 'high' THEN 1 WHEN 'normal' THEN 2 ELSE 3 END, w.created_at`
+
+	var orders []workOrderRow
+	if err := db.Select(&orders, query, args...); err != nil {
+		SendError(w, ErrInternal("Failed to load work orders", err))
+		return
+	}
+
+	// Driver reports about a vehicle that nobody has picked up yet. The
+	// table belongs to the mobile API and may not exist.
+	var issues []struct {
+		IssueID     int          `db:"issue_id"`
+		VehicleID   string       `db:"vehicle_id"`
+		Type        string       `db:"type"`
+		Description string       `db:"description"`
+		Severity    string       `db:"severity"`
+		ReportedBy  string       `db:"reported_by"`
+		CreatedAt   sql.NullTime `db:"created_at"`
+	}
+	if err := db.Select(&issues, `
+		SELECT i.issue_id, i.vehicle_id, i.type, i.description, i.severity, i.reported_by, i.created_at
+		FROM issue_reports i
+		WHERE i.status = 'open' AND COALESCE(i.vehicle_id, '') <> ''
+			AND NOT EXISTS (SELECT 1 FROM work_orders w WHERE w.issue_id = i.issue_id AND w.status <> 'cancelled')
+		ORDER BY CASE i.severity WHEN 'critical' THEN 0 WHEN 'high' THEN 1 WHEN 'medium' THEN 2 ELSE 3 END, i.created_at
+	`); err != nil {
+		log.Printf("Error loading issue reports for work orders: %v", err)
+	}
+
+	due, err := loadDueServices()
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load due services", err))
+		return
+	}
+
+	var vehicles []string
+	if err := db.Select(&vehicles, `
+		SELECT bus_id FROM buses UNION SELECT vehicle_id FROM vehicles ORDER BY 1
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load vehicles", err))
+		return
+	}
+
+	renderTemplate(w, r, "work_orders.html", map[string]interface{}{
+		"User":       user,
+		"CSRFToken":  getSessionCSRFToken(r),
+		"Orders":     orders,
+		"Issues":     issues,
+		"Due":        due,
+		"Vehicles":   vehicles,
+		"Vehicle":    vehicle,
+		"Show":       show,
+		"Categories": workOrderCategories,
+		"Priorities": workOrderPriorities,
+		"CanEdit":    hasPermission(user, PermMaintenanceEdit),
+	})
+}
+
+// loadDueServices finds services due across the fleet that no open work
+// order already covers
+func loadDueServices() ([]MaintenanceAlert, error) {
+	due, err := loadPMDueList(db)
+	if err != nil {
+		return nil, err
+	}
+	var alerts []MaintenanceAlert
+	for _, d := range due {
+		if d.Status != PMStatusOK && d.OpenWorkOrder == 0 {
+			alerts = append(alerts, d.Alert())
+		}
+	}
+	return alerts, nil
+}
+
+// workOrderHandler shows one work order and moves it through its
+// lifecycle
+func workOrderHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		SendError(w, ErrBadRequest("Invalid work order"))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !hasPermission(user, PermMaintenanceEdit) {
+			SendError(w, ErrForbidden("You don't have permission to change work orders"))
+			return
+		}
+		updateWorkOrderFromForm(w, r, user, id)
+		return
+	}
+
+	order, err := loadWorkOrder(id)
+	if err != nil {
+		sendWorkOrderError(w, err, "load work order")
+		return
+	}
+	var lines []WorkOrderLine
+	if err := db.Select(&lines, `SELECT * FROM work_order_lines WHERE work_order_id = $1 ORDER BY line_type, id`, id); err != nil {
+		SendError(w, ErrInternal("Failed to load work order lines", err))
+		return
+	}
+	var events []WorkOrderEvent
+	if err := db.Select(&events, `SELECT * FROM work_order_events WHERE work_order_id = $1 ORDER BY id`, id); err != nil {
+		SendError(w, ErrInternal("Failed to load work order history", err))
+		return
+	}
+
+	var labor, parts float64
+	for _, l := range lines {
+		if l.LineType == "labor" {
+			labor += l.Total()
+		} else {
+			parts += l.Total()
+		}
+	}
+
+	var mechanics, vendors []string
+	if err := db.Select(&mechanics, `
+		SELECT username FROM users
+		WHERE status = 'active' AND role IN (SELECT role FROM role_permissions WHERE permission = $1)
+		ORDER BY username
+	`, PermMaintenanceEdit); err != nil {
+		SendError(w, ErrInternal("Failed to load mechanics", err))
+		return
+	}
+	if err := db.Select(&vendors, `
+		SELECT DISTINCT vendor FROM work_orders WHERE vendor IS NOT NULL ORDER BY vendor LIMIT 50
+	`); err != nil {
+		SendError(w, ErrInternal("Failed to load vendors", err))
+		return
+	}
+
+	stock, err := loadStockForVehicle(order.VehicleID)
+	if err != nil {
+		SendError(w, ErrInternal("Failed to load parts stock", err))
+		return
+	}
+
+	renderTemplate(w, r, "work_order.html", map[string]interface{}{
+		"User":      user,
+		"CSRFToken": getSessionCSRFToken(r),
+		"Order":     order,
+		"Lines":     lines,
+		"Events":    events,
+		"Labor":     labor,
+		"Parts":     parts,
+		"Total":     labor + parts,
+		"Mechanics": mechanics,
+		"Vendors":   vendors,
+		"Stock":     stock,
+		"CanEdit":   hasPermission(user, PermMaintenanceEdit),
+	})
+}
+
+// loadStockForVehicle lists the parts in stock that fit a vehicle, for
+// drawing onto its work orders
+func loadStockForVehicle(vehicleID string) ([]StockLevel, error) {
+	var model string
+	if err := db.Get(&model, `
+		SELECT COALESCE(model, '') FROM buses WHERE bus_id = $1
+		UNION ALL
+		SELECT COALESCE(model, '') FROM vehicles WHERE vehicle_id = $1
+		LIMIT 1
+	`, vehicleID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	var levels []StockLevel
+	if err := db.Select(&levels, stockLevelQuery+` WHERE s.on_hand > 0 AND p.active ORDER BY p.part_number, l.name`); err != nil {
+		return nil, err
+	}
+	fitments, err := loadPartFitments()
+	if err != nil {
+		return nil, err
+	}
+	var fits []StockLevel
+	for _, level := range levels {
+		if fitsModel(fitments[level.PartID], model) {
+			fits = append(fits, level)
+		}
+	}
+	return fits, nil
+}
+
+// updateWorkOrderFromForm applies one of the work order page's actions
+func updateWorkOrderFromForm(w http.ResponseWriter, r *http.Request, user *User, id int) {
+	action := r.FormValue("action")
+	notes := strings.TrimSpace(r.FormValue("notes"))
+	before, err := loadWorkOrder(id)
+	if err != nil {
+		sendWorkOrderError(w, err, "load work order")
+		return
+	}
+
+	var order *WorkOrder
+	changes := map[string]AuditChange{}
+	switch action {
+	case "assign":
+		mechanic := r.FormValue("assigned_to")
+		vendor := truncateString(strings.TrimSpace(r.FormValue("vendor")), 100)
+		order, err = assignWorkOrder(id, mechanic, vendor, user.Username)
+		changes["assigned_to"] = AuditChange{From: before.AssignedTo.String, To: mechanic}
+		changes["vendor"] = AuditChange{From: before.Vendor.String, To: vendor}
+		if err == nil && notificationTriggers != nil && mechanic != "" && mechanic != before.AssignedTo.String {
+			go notificationTriggers.TriggerWorkOrderAssignedNotification(*order)
+		}
+	case "start":
+		order, err = changeWorkOrderStatus(id, WorkOrderInProgress, user.Username, notes)
+	case "await_parts":
+		order, err = changeWorkOrderStatus(id, WorkOrderAwaitingParts, user.Username, notes)
+	case "unassign":
+		order, err = changeWorkOrderStatus(id, WorkOrderOpen, user.Username, notes)
+	case "cancel":
+		order, err = changeWorkOrderStatus(id, WorkOrderCancelled, user.Username, notes)
+	case "complete":
+		mileage, _ := strconv.Atoi(r.FormValue("mileage"))
+		if mileage > 0 {
+			if validation := validateMileageEntry(before.VehicleID, float64(mileage)); !validation.Valid {
+				SendError(w, ErrBadRequest(validation.Error))
+				return
+			}
+		}
+		order, err = completeWorkOrder(id, mileage, notes, user.Username)
+		changes["mileage"] = AuditChange{To: mileage}
+	case "inspect_pass", "inspect_fail":
+		order, err = inspectWorkOrder(id, action == "inspect_pass", notes, user.Username)
+	case "hold", "release_hold":
+		order, err = setWorkOrderHold(id, action == "hold", user.Username)
+		changes["hold"] = AuditChange{From: before.Hold, To: action == "hold"}
+	case "add_line":
+		quantity, _ := strconv.ParseFloat(r.FormValue("quantity"), 64)
+		unitCost, _ := strconv.ParseFloat(r.FormValue("unit_cost"), 64)
+		line := WorkOrderLine{
+			WorkOrderID: id,
+			LineType:    r.FormValue("line_type"),
+			Description: truncateString(strings.TrimSpace(r.FormValue("description")), 255),
+			PartNumber:  truncateString(strings.TrimSpace(r.FormValue("part_number")), 100),
+			Quantity:    quantity,
+			UnitCost:    unitCost,
+			AddedBy:     sql.NullString{String: user.Username, Valid: true},
+		}
+		// A stockroom part comes as "part:location"
+		if partID, locationID, ok := strings.Cut(r.FormValue("stock"), ":"); ok {
+			part, _ := strconv.ParseInt(partID, 10, 64)
+			location, _ := strconv.ParseInt(locationID, 10, 64)
+			line.PartID = sql.NullInt64{Int64: part, Valid: true}
+			line.LocationID = sql.NullInt64{Int64: location, Valid: true}
+		}
+		line, err = addWorkOrderLine(line)
+		changes["line"] = AuditChange{To: fmt.Sprintf("%s: %s x%g @ %.2f", line.LineType, line.Description, line.Quantity, line.UnitCost)}
+	case "remove_line":
+		lineID, _ := strconv.Atoi(r.FormValue("line_id"))
+		err = removeWorkOrderLine(id, lineID, user.Username)
+		changes["line"] = AuditChange{From: lineID}
+	default:
+		SendError(w, ErrBadRequest("Unknown action"))
+		return
+	}
+	if err != nil {
+		sendWorkOrderError(w, err, "update work order")
+		return
+	}
+
+	if order != nil && order.Status != before.Status {
+		changes["status"] = AuditChange{From: before.Status, To: order.Status}
+	}
+	if notes != "" {
+		changes["notes"] = AuditChange{To: notes}
+	}
+	recordAuditChanges(auditActorFromRequest(r), action, "work_order", strconv.Itoa(id), changes)
+	http.Redirect(w, r, fmt.Sprintf("/work-orders/view?id=%d", id), http.StatusSeeOther)
+}
+
+// sendWorkOrderError reports a change the order's state doesn't allow as
+// a conflict, and anything else as a failure
+func sendWorkOrderError(w http.ResponseWriter, err error, what string) {
+	var refused workOrderError
+	var short inventoryError
+	switch {
+	case errors.As(err, &refused):
+		SendError(w, ErrConflict(string(refused)))
+	case errors.As(err, &short):
+		SendError(w, ErrConflict(string(short)))
+	case errors.Is(err, sql.ErrNoRows):
+		SendError(w, ErrNotFound("Work order"))
+	default:
+		SendError(w, ErrInternal("Failed to "+what, err))
+	}
+}
@@ -57,7 +57,7 @@ func enhancedImportAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDataImport) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -180,7 +180,7 @@ func enhancedImportValidateHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDataImport) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -229,7 +229,7 @@ func enhancedImportExecuteHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDataImport) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -265,10 +265,11 @@ func enhancedImportExecuteHandler(w http.ResponseWriter, r *http.Request) {
 	defer xlsx.Close()
 
 	// Execute import based on type
+	actor := auditActorFromRequest(r)
 	var result *ImportResult
 	switch req.Type {
 	case "students":
-		result = importStudentsWithValidation(xlsx, req.Mappings, req.SkipDuplicates, req.UpdateExisting)
+		result = importStudentsWithValidation(actor, xlsx, req.Mappings, req.SkipDuplicates, req.UpdateExisting)
 	case "mileage":
 		result = importMileageWithValidation(xlsx, req.Mappings, req.SkipDuplicates, req.UpdateExisting)
 	case "ecse":
@@ -279,6 +280,12 @@ func enhancedImportExecuteHandler(w http.ResponseWriter, r *http.Request) {
 		SendError(w, ErrValidation("Invalid import type"))
 		return
 	}
+	recordAuditChanges(actor, AuditImport, "import", req.Type, map[string]AuditChange{
+		"file":     {To: fileResult.FileName},
+		"imported": {To: result.Imported},
+		"skipped":  {To: result.Skipped},
+		"errors":   {To: result.Errors},
+	})
 
 	// Clean up temp file
 	go func() {
@@ -620,7 +627,7 @@ func checkExistingStudents(result *ValidationResult) {
 }
 
 // Import functions with validation
-func importStudentsWithValidation(xlsx *excelize.File, mappings map[string]string, skipDuplicates, updateExisting bool) *ImportResult {
+func importStudentsWithValidation(actor AuditActor, xlsx *excelize.File, mappings map[string]string, skipDuplicates, updateExisting bool) *ImportResult {
 	result := &ImportResult{
 		Details: []string{},
 	}
@@ -681,6 +688,7 @@ func importStudentsWithValidation(xlsx *excelize.File, mappings map[string]strin
 
 		if err == nil && updateExisting {
 			// Update existing student
+			before := auditSnapshot("students", "student_id", rowData["student_id"])
 			_, err = db.Exec(`
 				UPDATE students 
 				SET name = $2, phone_number = $3, guardian = $4
@@ -694,6 +702,8 @@ func importStudentsWithValidation(xlsx *excelize.File, mappings map[string]strin
 					fmt.Sprintf("Failed to update student %s: %v", rowData["student_id"], err))
 			} else {
 				result.Imported++
+				recordAudit(actor, AuditImport, "student", rowData["student_id"], before,
+					auditSnapshot("students", "student_id", rowData["student_id"]))
 			}
 		} else {
 			// Insert new student
@@ -709,6 +719,8 @@ func importStudentsWithValidation(xlsx *excelize.File, mappings map[string]strin
 					fmt.Sprintf("Failed to insert student %s: %v", rowData["student_id"], err))
 			} else {
 				result.Imported++
+				recordAudit(actor, AuditImport, "student", rowData["student_id"], nil,
+					auditSnapshot("students", "student_id", rowData["student_id"]))
 			}
 		}
 	}
@@ -395,16 +395,16 @@ func studentsAPIHandler(w http.ResponseWriter, r *http.Request) {
 	args := []interface{}{}
 	argIndex := 1
 
-	// Apply driver filter
+	// Apply driver filter. Users who can't see every student only get
+	// their own, whatever filter they asked for.
+	canViewAll := hasPermission(user, PermStudentsView)
+	if !canViewAll {
+		driverFilter = user.Username
+	}
 	if driverFilter != "" {
 		query += fmt.Sprintf(" AND driver = $%d", argIndex)
 		args = append(args, driverFilter)
 		argIndex++
-	} else if user.Role == "driver" {
-		// Drivers only see their own students
-		query += fmt.Sprintf(" AND driver = $%d", argIndex)
-		args = append(args, user.Username)
-		argIndex++
 	}
 
 	// Apply status filter
@@ -443,6 +443,9 @@ func studentsAPIHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to load students", http.StatusInternalServerError)
 		return
 	}
+	if canViewAll && !hasPermission(user, PermStudentsViewPII) {
+		redactStudentPII(students)
+	}
 
 	// Calculate pagination metadata
 	totalPages := (total + perPage - 1) / perPage
@@ -504,22 +507,20 @@ func driverLogsAPIHandler(w http.ResponseWriter, r *http.Request) {
 	query := `
 		SELECT id, driver, bus_id, route_id, date, period, 
 		       departure_time, arrival_time, begin_mileage, end_mileage, 
-		       mileage, attendance, notes, created_at
+		       mileage, `+driverLogRiders+`, notes, created_at
 		FROM driver_logs WHERE 1=1
 	`
 	args := []interface{}{}
 	argIndex := 1
 
-	// Apply driver filter
+	// Apply driver filter; drivers only see their own logs
+	if !hasPermission(user, PermDriversView) {
+		driverFilter = user.Username
+	}
 	if driverFilter != "" {
 		query += fmt.Sprintf(" AND driver = $%d", argIndex)
 		args = append(args, driverFilter)
 		argIndex++
-	} else if user.Role == "driver" {
-		// Drivers only see their own logs
-		query += fmt.Sprintf(" AND driver = $%d", argIndex)
-		args = append(args, user.Username)
-		argIndex++
 	}
 
 	// Apply bus filter
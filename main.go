@@ -54,6 +54,10 @@ func init() {
 		// JSON marshaling
 		"json": jsonMarshal,
 
+		// can reports whether a user's role grants a permission
+		"can":  templateCan,
+		"home": templateHome,
+
 		// ADDED: seq function for generating number sequences (needed for year dropdowns)
 		"seq": func(start, end int) []int {
 			var result []int
@@ -568,9 +572,11 @@ func main() {
 	LogInfo("🛰️  Initializing GPS tracking system...")
 	InitSSE()
 	
-	// Start GPS simulation for demo purposes
-	LogInfo("🚌 Starting GPS simulation...")
-	startGPSSimulation()
+	// Start GPS simulation for demo purposes; disable once real trackers report
+	if os.Getenv("DISABLE_GPS_SIMULATION") != "true" {
+		LogInfo("🚌 Starting GPS simulation...")
+		startGPSSimulation()
+	}
 	
 	// Check for command line arguments
 	if len(os.Args) > 1 {
@@ -739,6 +745,7 @@ func main() {
 
 	// Start background jobs
 	startScheduledExportsJob()
+	startPMWorkOrderJob()
 
 	// Graceful shutdown
 	go gracefulShutdown(server)
@@ -911,16 +918,17 @@ func setupRoutes() *http.ServeMux {
 		RateLimitMiddleware(loginHandler)(w, r)
 	}))
 	mux.HandleFunc("/register", withRecovery(RateLimitMiddleware(registerHandler)))
+	mux.HandleFunc("/login/2fa", withRecovery(RateLimitMiddleware(requireDatabase(loginTwoFactorHandler))))
 	mux.HandleFunc("/logout", withRecovery(logoutHandler))
 	mux.HandleFunc("/health", withRecovery(HealthCheckHandler))
 	mux.HandleFunc("/status", withRecovery(serverStatusHandler))
-	mux.HandleFunc("/api/recovery", withRecovery(requireAuth(requireRole("manager")(AutoRecoveryHandler))))
+	mux.HandleFunc("/api/recovery", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(AutoRecoveryHandler))))
 	
 	// Test endpoint for ECSE dashboard (temporary - remove in production)
 	mux.HandleFunc("/test-ecse", withRecovery(testECSEHandler))
 	
 	// Debug endpoints are available through /api/debug-* routes in development mode
-	mux.HandleFunc("/api/debug/data", withRecovery(requireAuth(requireRole("manager")(debugDataHandler))))
+	mux.HandleFunc("/api/debug/data", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(debugDataHandler))))
 
 	// Manager-only routes
 	setupManagerRoutes(mux)
@@ -933,7 +941,10 @@ func setupRoutes() *http.ServeMux {
 	
 	// Common protected routes for all authenticated users
 	mux.HandleFunc("/profile", withRecovery(requireAuth(requireDatabase(profileHandler))))
-	mux.HandleFunc("/settings", withRecovery(requireAuth(requireRole("manager")(requireDatabase(settingsHandler)))))
+	mux.HandleFunc("/profile/2fa", withRecovery(requireAuth(requireDatabase(profileTwoFactorHandler))))
+	mux.HandleFunc("/sessions", withRecovery(requireAuth(requireDatabase(activeSessionsHandler))))
+	mux.HandleFunc("/audit", withRecovery(requireAuth(requirePermission(PermAuditView)(requireDatabase(auditLogHandler)))))
+	mux.HandleFunc("/settings", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(settingsHandler)))))
 	mux.HandleFunc("/help-demo", withRecovery(requireAuth(requireDatabase(helpDemoHandler))))
 	
 	// Search routes
@@ -962,6 +973,7 @@ func setupRoutes() *http.ServeMux {
 	}))
 	mux.HandleFunc("/api/gps/stream", withRecovery(requireAuth(gpsStreamHandler)))
 	mux.HandleFunc("/api/gps/update", withRecovery(updateGPSLocationHandler))
+	mux.HandleFunc("/api/rfid/scans", withRecovery(requireDatabase(rfidScansHandler)))
 	mux.HandleFunc("/api/gps/locations", withRecovery(requireAuth(getCurrentBusLocationsHandler)))
 	mux.HandleFunc("/api/gps/eta", withRecovery(requireAuth(calculateETAHandler)))
 	
@@ -982,7 +994,7 @@ func setupRoutes() *http.ServeMux {
 	// Progress Tracking routes
 	mux.HandleFunc("/api/progress", withRecovery(requireAuth(requireDatabase(progressTrackingHandler))))
 	mux.HandleFunc("/progress", withRecovery(requireAuth(requireDatabase(progressDashboardHandler))))
-	mux.HandleFunc("/budget-dashboard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(budgetDashboardPageHandler)))))
+	mux.HandleFunc("/budget-dashboard", withRecovery(requireAuth(requirePermission(PermBudgetView)(requireDatabase(budgetDashboardPageHandler)))))
 	mux.HandleFunc("/progress-dashboard", withRecovery(requireAuth(requireDatabase(progressDashboardPageHandler))))
 	
 	// User Manual routes
@@ -996,7 +1008,7 @@ func setupRoutes() *http.ServeMux {
 	// Troubleshooting routes
 	mux.HandleFunc("/troubleshooting", withRecovery(requireAuth(troubleshootingHandler)))
 	mux.HandleFunc("/troubleshooting/issue/", withRecovery(requireAuth(troubleshootingIssueHandler)))
-	mux.HandleFunc("/api/diagnostics", withRecovery(requireAuth(requireRole("manager")(diagnosticsHandler))))
+	mux.HandleFunc("/api/diagnostics", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(diagnosticsHandler))))
 	
 	// Password management routes
 	mux.HandleFunc("/change-password", withRecovery(requireAuth(requireDatabase(passwordChangeHandler))))
@@ -1006,6 +1018,8 @@ func setupRoutes() *http.ServeMux {
 	// Notification routes
 	mux.HandleFunc("/notification-preferences", withRecovery(requireAuth(requireDatabase(notificationPreferencesHandler))))
 	mux.HandleFunc("/notification-history", withRecovery(requireAuth(requireDatabase(notificationHistoryHandler))))
+	mux.HandleFunc("/notification-failures", withRecovery(requireAuth(requirePermission(PermNotificationsAdmin)(requireDatabase(failedNotificationsHandler)))))
+	mux.HandleFunc("/api/notifications/resend", withRecovery(requireAuth(requirePermission(PermNotificationsAdmin)(requireDatabase(resendNotificationHandler)))))
 	mux.HandleFunc("/api/test-notification", withRecovery(requireAuth(requireDatabase(testNotificationHandler))))
 	mux.HandleFunc("/api/notifications/mark-read", withRecovery(requireAuth(requireDatabase(markNotificationReadHandler))))
 	mux.HandleFunc("/api/notifications/mark-all-read", withRecovery(requireAuth(requireDatabase(markAllNotificationsReadHandler))))
@@ -1026,11 +1040,11 @@ func setupAPIRoutes(mux *http.ServeMux) {
 	// Core API routes
 	mux.HandleFunc("/api/routes", withRecovery(requireAuth(requireDatabase(apiRoutesHandler))))
 	mux.HandleFunc("/api/buses", withRecovery(requireAuth(requireDatabase(apiBusesHandler))))
-	mux.HandleFunc("/api/drivers", withRecovery(requireAuth(requireRole("manager")(requireDatabase(apiDriversHandler)))))
+	mux.HandleFunc("/api/drivers", withRecovery(requireAuth(requirePermission(PermDriversView)(requireDatabase(apiDriversHandler)))))
 	mux.HandleFunc("/api/students", withRecovery(requireAuth(requireDatabase(apiStudentsHandler))))
 	mux.HandleFunc("/api/fleet-vehicles", withRecovery(requireAuth(requireDatabase(apiFleetVehiclesHandler))))
 	mux.HandleFunc("/api/route-assignments", withRecovery(requireAuth(requireDatabase(apiRouteAssignmentsHandler))))
-	mux.HandleFunc("/api/ecse-students", withRecovery(requireAuth(requireRole("manager")(requireDatabase(apiECSEStudentsHandler)))))
+	mux.HandleFunc("/api/ecse-students", withRecovery(requireAuth(requirePermission(PermECSEView)(requireDatabase(apiECSEStudentsHandler)))))
 	mux.HandleFunc("/api/maintenance-records", withRecovery(requireAuth(requireDatabase(apiMaintenanceRecordsHandler))))
 	
 	// Missing API endpoints - now added
@@ -1040,69 +1054,69 @@ func setupAPIRoutes(mux *http.ServeMux) {
 	
 	// Maintenance API routes
 	mux.HandleFunc("/api/check-maintenance", withRecovery(requireAuth(requireDatabase(checkMaintenanceDueHandler))))
-	mux.HandleFunc("/api/debug-maintenance", withRecovery(requireAuth(requireRole("manager")(requireDatabase(debugMaintenanceRecordsHandler)))))
+	mux.HandleFunc("/api/debug-maintenance", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(debugMaintenanceRecordsHandler)))))
 
 	// Dashboard Analytics API routes
-	mux.HandleFunc("/api/dashboard/analytics", withRecovery(requireAuth(requireRole("manager")(requireDatabase(dashboardAnalyticsHandler)))))
+	mux.HandleFunc("/api/dashboard/analytics", withRecovery(requireAuth(requirePermission(PermDashboardView)(requireDatabase(dashboardAnalyticsHandler)))))
 	mux.HandleFunc("/api/dashboard/fleet-status", withRecovery(requireAuth(requireDatabase(fleetStatusWidgetHandler))))
 	mux.HandleFunc("/api/dashboard/maintenance-alerts", withRecovery(requireAuth(requireDatabase(maintenanceAlertsWidgetHandler))))
 	mux.HandleFunc("/api/dashboard/route-efficiency", withRecovery(requireAuth(requireDatabase(routeEfficiencyWidgetHandler))))
 
 	// Report Builder API routes
-	mux.HandleFunc("/api/report-builder", withRecovery(requireAuth(requireRole("manager")(requireDatabase(reportBuilderAPIHandler)))))
-	mux.HandleFunc("/api/report-data-sources", withRecovery(requireAuth(requireRole("manager")(requireDatabase(getReportDataSourcesHandler)))))
-	mux.HandleFunc("/api/report-chart-types", withRecovery(requireAuth(requireRole("manager")(requireDatabase(reportChartTypesHandler)))))
+	mux.HandleFunc("/api/report-builder", withRecovery(requireAuth(requirePermission(PermReportsView)(requireDatabase(reportBuilderAPIHandler)))))
+	mux.HandleFunc("/api/report-data-sources", withRecovery(requireAuth(requirePermission(PermReportsView)(requireDatabase(getReportDataSourcesHandler)))))
+	mux.HandleFunc("/api/report-chart-types", withRecovery(requireAuth(requirePermission(PermReportsView)(requireDatabase(reportChartTypesHandler)))))
 
 	// Database Optimization API routes - removed during cleanup
-	// mux.HandleFunc("/api/database/stats", withRecovery(requireAuth(requireRole("manager")(requireDatabase(databaseStatsHandler)))))
-	// mux.HandleFunc("/api/database/optimize", withRecovery(requireAuth(requireRole("manager")(requireDatabase(optimizeDatabaseHandler)))))
-	// mux.HandleFunc("/api/cache/stats", withRecovery(requireAuth(requireRole("manager")(cacheStatsHandler))))
+	// mux.HandleFunc("/api/database/stats", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(databaseStatsHandler)))))
+	// mux.HandleFunc("/api/database/optimize", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(optimizeDatabaseHandler)))))
+	// mux.HandleFunc("/api/cache/stats", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(cacheStatsHandler))))
 	
 	// Database Connection Pool Monitoring routes
-	mux.HandleFunc("/api/db/stats", withRecovery(requireAuth(requireRole("manager")(dbStatsHandler))))
-	mux.HandleFunc("/api/db/metrics", withRecovery(requireAuth(requireRole("manager")(dbMetricsHandler))))
+	mux.HandleFunc("/api/db/stats", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(dbStatsHandler))))
+	mux.HandleFunc("/api/db/metrics", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(dbMetricsHandler))))
 	mux.HandleFunc("/api/db/health", withRecovery(dbHealthCheckHandler)) // No auth for monitoring tools
-	mux.HandleFunc("/api/db/pool/metrics", withRecovery(requireAuth(requireRole("manager")(dbPoolMetricsHandler))))
-	mux.HandleFunc("/api/db/pool/health", withRecovery(requireAuth(requireRole("manager")(dbPoolHealthHandler))))
-	mux.HandleFunc("/api/db/pool/optimize", withRecovery(requireAuth(requireRole("manager")(dbPoolOptimizeHandler))))
+	mux.HandleFunc("/api/db/pool/metrics", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(dbPoolMetricsHandler))))
+	mux.HandleFunc("/api/db/pool/health", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(dbPoolHealthHandler))))
+	mux.HandleFunc("/api/db/pool/optimize", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(dbPoolOptimizeHandler))))
 	
 	// Database Pool Monitor Page
-	mux.HandleFunc("/db-pool-monitor", withRecovery(requireAuth(requireRole("manager")(requireDatabase(dbPoolMonitorHandler)))))
+	mux.HandleFunc("/db-pool-monitor", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(dbPoolMonitorHandler)))))
 
 	// Chart/Visualization API routes
 	mux.HandleFunc("/api/charts/data", withRecovery(requireAuth(requireDatabase(chartDataHandler))))
 	mux.HandleFunc("/api/charts/available", withRecovery(requireAuth(requireDatabase(availableChartsHandler))))
 
 	// Lazy Loading API routes
-	mux.HandleFunc("/api/lazy/monthly-mileage-reports", withRecovery(requireAuth(requireRole("manager")(requireDatabase(monthlyMileageReportsAPIHandler)))))
-	mux.HandleFunc("/api/lazy/maintenance-records", withRecovery(requireAuth(requireRole("manager")(requireDatabase(maintenanceRecordsAPIHandler)))))
-	mux.HandleFunc("/api/lazy/fleet-vehicles", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fleetVehiclesAPIHandler)))))
+	mux.HandleFunc("/api/lazy/monthly-mileage-reports", withRecovery(requireAuth(requirePermission(PermMileageView)(requireDatabase(monthlyMileageReportsAPIHandler)))))
+	mux.HandleFunc("/api/lazy/maintenance-records", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(maintenanceRecordsAPIHandler)))))
+	mux.HandleFunc("/api/lazy/fleet-vehicles", withRecovery(requireAuth(requirePermission(PermFleetView)(requireDatabase(fleetVehiclesAPIHandler)))))
 	mux.HandleFunc("/api/lazy/students", withRecovery(requireAuth(requireDatabase(studentsAPIHandler))))
 	mux.HandleFunc("/api/lazy/driver-logs", withRecovery(requireAuth(requireDatabase(driverLogsAPIHandler))))
 	mux.HandleFunc("/api/lazy/buses", withRecovery(requireAuth(requireDatabase(busesAPIHandler))))
 
 	// Comparative Analytics API routes
-	mux.HandleFunc("/api/analytics/comparison", withRecovery(requireAuth(requireRole("manager")(requireDatabase(comparativeAnalyticsHandler)))))
-	mux.HandleFunc("/api/analytics/trend", withRecovery(requireAuth(requireRole("manager")(requireDatabase(trendAnalysisHandler)))))
+	mux.HandleFunc("/api/analytics/comparison", withRecovery(requireAuth(requirePermission(PermAnalyticsView)(requireDatabase(comparativeAnalyticsHandler)))))
+	mux.HandleFunc("/api/analytics/trend", withRecovery(requireAuth(requirePermission(PermAnalyticsView)(requireDatabase(trendAnalysisHandler)))))
 
 	// Fuel Efficiency API routes
 	mux.HandleFunc("/api/fuel/record", withRecovery(requireAuth(requireDatabase(saveFuelRecordHandler))))
 	mux.HandleFunc("/api/fuel/efficiency", withRecovery(requireAuth(requireDatabase(vehicleFuelEfficiencyHandler))))
-	mux.HandleFunc("/api/fuel/summary", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fleetFuelSummaryHandler)))))
+	mux.HandleFunc("/api/fuel/summary", withRecovery(requireAuth(requirePermission(PermFuelView)(requireDatabase(fleetFuelSummaryHandler)))))
 	mux.HandleFunc("/api/fuel/trend-chart", withRecovery(requireAuth(requireDatabase(fuelTrendChartHandler))))
 
 	// Driver Scorecard API routes
 	mux.HandleFunc("/api/scorecard/driver", withRecovery(requireAuth(requireDatabase(driverScorecardHandler))))
-	mux.HandleFunc("/api/scorecard/all", withRecovery(requireAuth(requireRole("manager")(requireDatabase(allDriverScorecardsHandler)))))
+	mux.HandleFunc("/api/scorecard/all", withRecovery(requireAuth(requirePermission(PermDriversView)(requireDatabase(allDriverScorecardsHandler)))))
 
 	// Advanced Analytics API routes
-	mux.HandleFunc("/api/analytics/fleet", withRecovery(requireAuth(requireRole("manager")(AnalyticsHandler))))
-	mux.HandleFunc("/api/analytics/export", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportAnalyticsHandler)))))
+	mux.HandleFunc("/api/analytics/fleet", withRecovery(requireAuth(requirePermission(PermAnalyticsView)(AnalyticsHandler))))
+	mux.HandleFunc("/api/analytics/export", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportAnalyticsHandler)))))
 
 	// Server-Sent Events for real-time updates (replaces WebSocket)
 	// SSE doesn't have hijacker issues like WebSockets
 	mux.HandleFunc("/api/gps/status", requireAuth(gpsStatusHandler))
-	mux.HandleFunc("/api/gps/toggle", requireAuth(requireRole("manager")(toggleGPSHandler)))
+	mux.HandleFunc("/api/gps/toggle", requireAuth(requirePermission(PermGPSManage)(toggleGPSHandler)))
 
 	// Emergency Response System
 	mux.HandleFunc("/emergency", withRecovery(requireAuth(requireDatabase(emergencyDashboardHandler))))
@@ -1112,34 +1126,42 @@ func setupAPIRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/emergency/sos", withRecovery(requireAuth(requireDatabase(emergencySOSHandler))))
 
 	// Performance Monitoring API
-	mux.HandleFunc("/api/performance/metrics", withRecovery(requireAuth(requireRole("manager")(performanceMetricsHandler))))
-	mux.HandleFunc("/api/performance/slow-queries", withRecovery(requireAuth(requireRole("manager")(slowQueriesHandler))))
+	mux.HandleFunc("/api/performance/metrics", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(performanceMetricsHandler))))
+	mux.HandleFunc("/api/performance/slow-queries", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(slowQueriesHandler))))
 
 	// System Recovery API
-	mux.HandleFunc("/api/recovery/status", withRecovery(requireAuth(requireRole("manager")(recoveryStatusHandler))))
-	mux.HandleFunc("/api/recovery/trigger", withRecovery(requireAuth(requireRole("manager")(triggerRecoveryHandler))))
+	mux.HandleFunc("/api/recovery/status", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(recoveryStatusHandler))))
+	mux.HandleFunc("/api/recovery/trigger", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(triggerRecoveryHandler))))
 
 	// Backup API
-	mux.HandleFunc("/api/backup/create", withRecovery(requireAuth(requireRole("manager")(createBackupHandler))))
-	mux.HandleFunc("/api/backup/list", withRecovery(requireAuth(requireRole("manager")(listBackupsHandler))))
-	mux.HandleFunc("/api/backup/restore", withRecovery(requireAuth(requireRole("manager")(restoreBackupHandler))))
+	mux.HandleFunc("/api/backup/create", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(createBackupHandler))))
+	mux.HandleFunc("/api/backup/list", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(listBackupsHandler))))
+	mux.HandleFunc("/api/backup/restore", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(restoreBackupHandler))))
+	mux.HandleFunc("/api/backup/verify", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(verifyBackupHandler))))
+	mux.HandleFunc("/api/backup/dry-run", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(dryRunRestoreHandler))))
 	
 	// GPS Tracking API
 	mux.HandleFunc("/api/gps/history", withRecovery(requireAuth(gpsHistoryHandler)))
 	mux.HandleFunc("/api/gps/vehicles", withRecovery(requireAuth(gpsVehiclesHandler)))
-	mux.HandleFunc("/api/geofence", withRecovery(requireAuth(requireRole("manager")(geofenceHandler))))
+	mux.HandleFunc("/api/gps/trips", withRecovery(requireAuth(requirePermission(PermGPSView)(gpsTripsHandler))))
+	mux.HandleFunc("/api/gps/trips/playback", withRecovery(requireAuth(requirePermission(PermGPSView)(gpsTripPlaybackHandler))))
+	mux.HandleFunc("/api/gps/devices", withRecovery(requireAuth(requirePermission(PermGPSView)(gpsDevicesHandler))))
+	mux.HandleFunc("/api/gps/osmand", withRecovery(gpsOsmAndHandler))
+	mux.HandleFunc("/api/geofence", withRecovery(requireAuth(requirePermission(PermGPSManage)(geofenceHandler))))
+	mux.HandleFunc("/api/geofence/rules", withRecovery(requireAuth(requirePermission(PermGPSManage)(geofenceRulesHandler))))
+	mux.HandleFunc("/api/geofence/events", withRecovery(requireAuth(requirePermission(PermGPSView)(geofenceEventsHandler))))
 	// GPS SSE endpoint for real-time updates
 	mux.HandleFunc("/api/gps/update-sse", requireAuth(gpsUpdateSSEHandler))
 	
 	// Route Monitoring & Deviation Alerts
-	mux.HandleFunc("/route-monitoring", withRecovery(requireAuth(requireRole("manager")(requireDatabase(routeMonitoringHandler)))))
-	mux.HandleFunc("/route-planner", withRecovery(requireAuth(requireRole("manager")(requireDatabase(routePlannerHandler)))))
+	mux.HandleFunc("/route-monitoring", withRecovery(requireAuth(requirePermission(PermRoutesView)(requireDatabase(routeMonitoringHandler)))))
+	mux.HandleFunc("/route-planner", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(routePlannerHandler)))))
 	mux.HandleFunc("/api/route-monitoring/start", withRecovery(requireAuth(requireDatabase(startRouteMonitoringHandler))))
 	mux.HandleFunc("/api/route-monitoring/stop", withRecovery(requireAuth(requireDatabase(stopRouteMonitoringHandler))))
 	mux.HandleFunc("/api/route-monitoring/deviations", withRecovery(requireAuth(requireDatabase(getRouteDeviationsHandler))))
-	mux.HandleFunc("/api/route-plan", withRecovery(requireAuth(requireRole("manager")(requireDatabase(getRoutePlanHandler)))))
-	mux.HandleFunc("/api/route-plan/save", withRecovery(requireAuth(requireRole("manager")(requireDatabase(saveRoutePlanHandler)))))
-	mux.HandleFunc("/api/route-monitoring/settings", withRecovery(requireAuth(requireRole("manager")(updateDeviationSettingsHandler))))
+	mux.HandleFunc("/api/route-plan", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(getRoutePlanHandler)))))
+	mux.HandleFunc("/api/route-plan/save", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(saveRoutePlanHandler)))))
+	mux.HandleFunc("/api/route-monitoring/settings", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(updateDeviationSettingsHandler))))
 	
 	// Messaging system
 	mux.HandleFunc("/messaging", withRecovery(requireAuth(requireDatabase(messagingHandler))))
@@ -1149,7 +1171,7 @@ func setupAPIRoutes(mux *http.ServeMux) {
 	
 	// Mobile UI endpoints
 	mux.HandleFunc("/mobile/dashboard", withRecovery(requireAuth(requireDatabase(mobileDriverDashboardHandler))))
-	mux.HandleFunc("/mobile/manager-dashboard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(mobileManagerDashboardHandler)))))
+	mux.HandleFunc("/mobile/manager-dashboard", withRecovery(requireAuth(requirePermission(PermDashboardView)(requireDatabase(mobileManagerDashboardHandler)))))
 	mux.HandleFunc("/mobile/route/", withRecovery(requireAuth(requireDatabase(mobileRouteDetailsHandler))))
 	mux.HandleFunc("/mobile/attendance", withRecovery(requireAuth(requireDatabase(mobileStudentAttendanceHandler))))
 	mux.HandleFunc("/mobile/vehicle-check", withRecovery(requireAuth(requireDatabase(mobileVehicleCheckHandler))))
@@ -1177,7 +1199,7 @@ func setupV1APIRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/health", withRecovery(withAPIVersion(APIVersion1, healthV1Handler)))
 	
 	// Dashboard endpoints for v1
-	mux.HandleFunc("/api/v1/dashboard/stats", withRecovery(requireAuth(requireRole("manager")(withAPIVersion(APIVersion1, dashboardStatsV1Handler)))))
+	mux.HandleFunc("/api/v1/dashboard/stats", withRecovery(requireAuth(requirePermission(PermDashboardView)(withAPIVersion(APIVersion1, dashboardStatsV1Handler)))))
 	
 	// Future v1 endpoints can be added here...
 	
@@ -1188,110 +1210,119 @@ func setupV1APIRoutes(mux *http.ServeMux) {
 // setupManagerRoutes configures manager-specific routes
 func setupManagerRoutes(mux *http.ServeMux) {
 	// User management
-	mux.HandleFunc("/users", withRecovery(requireAuth(requireRole("manager")(requireDatabase(usersHandler)))))
-	mux.HandleFunc("/approve-users", withRecovery(requireAuth(requireRole("manager")(requireDatabase(approveUsersHandler)))))
-	mux.HandleFunc("/approve-user", withRecovery(requireAuth(requireRole("manager")(requireDatabase(approveUserHandler)))))
-	mux.HandleFunc("/manage-users", withRecovery(requireAuth(requireRole("manager")(requireDatabase(manageUsersHandler)))))
-	mux.HandleFunc("/edit-user", withRecovery(requireAuth(requireRole("manager")(requireDatabase(editUserHandler)))))
-	mux.HandleFunc("/delete-user", withRecovery(requireAuth(requireRole("manager")(requireDatabase(deleteUserHandler)))))
+	mux.HandleFunc("/users", withRecovery(requireAuth(requirePermission(PermUsersManage)(requireDatabase(usersHandler)))))
+	mux.HandleFunc("/approve-users", withRecovery(requireAuth(requirePermission(PermUsersManage)(requireDatabase(approveUsersHandler)))))
+	mux.HandleFunc("/approve-user", withRecovery(requireAuth(requirePermission(PermUsersManage)(requireDatabase(approveUserHandler)))))
+	mux.HandleFunc("/manage-users", withRecovery(requireAuth(requirePermission(PermUsersManage)(requireDatabase(manageUsersHandler)))))
+	mux.HandleFunc("/edit-user", withRecovery(requireAuth(requirePermission(PermUsersManage)(requireDatabase(editUserHandler)))))
+	mux.HandleFunc("/manage-roles", withRecovery(requireAuth(requirePermission(PermRolesManage)(requireDatabase(manageRolesHandler)))))
+	mux.HandleFunc("/delete-user", withRecovery(requireAuth(requirePermission(PermUsersManage)(requireDatabase(deleteUserHandler)))))
 
 	// ECSE Management Routes
-	// mux.HandleFunc("/view-ecse-reports", withRecovery(requireAuth(requireRole("manager")(requireDatabase(viewECSEReportsHandler)))))
-	mux.HandleFunc("/ecse-student/", withRecovery(requireAuth(requireRole("manager")(requireDatabase(viewECSEStudentHandler)))))
-	// mux.HandleFunc("/edit-ecse-student", withRecovery(requireAuth(requireRole("manager")(requireDatabase(editECSEStudentHandler)))))
-	mux.HandleFunc("/export-ecse", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportECSEHandler)))))
+	// mux.HandleFunc("/view-ecse-reports", withRecovery(requireAuth(requirePermission(PermECSEView)(requireDatabase(viewECSEReportsHandler)))))
+	mux.HandleFunc("/ecse-student/", withRecovery(requireAuth(requirePermission(PermECSEView)(requireDatabase(viewECSEStudentHandler)))))
+	// mux.HandleFunc("/edit-ecse-student", withRecovery(requireAuth(requirePermission(PermECSEEdit)(requireDatabase(editECSEStudentHandler)))))
+	mux.HandleFunc("/export-ecse", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportECSEHandler)))))
 
 	// Dashboard
-	mux.HandleFunc("/manager-dashboard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(managerDashboardHandler)))))
-	mux.HandleFunc("/analytics-dashboard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(analyticsDashboardHandler)))))
-	mux.HandleFunc("/report-builder", withRecovery(requireAuth(requireRole("manager")(requireDatabase(reportBuilderHandler)))))
+	mux.HandleFunc("/manager-dashboard", withRecovery(requireAuth(requirePermission(PermDashboardView)(requireDatabase(managerDashboardHandler)))))
+	mux.HandleFunc("/analytics-dashboard", withRecovery(requireAuth(requirePermission(PermAnalyticsView)(requireDatabase(analyticsDashboardHandler)))))
+	mux.HandleFunc("/report-builder", withRecovery(requireAuth(requirePermission(PermReportsView)(requireDatabase(reportBuilderHandler)))))
 	
 	// System Monitoring
-	mux.HandleFunc("/monitoring", withRecovery(requireAuth(requireRole("manager")(monitoringDashboardHandler))))
-	mux.HandleFunc("/api/monitoring/metrics", withRecovery(requireAuth(requireRole("manager")(monitoringAPIHandler))))
-	mux.HandleFunc("/api/monitoring/alerts", withRecovery(requireAuth(requireRole("manager")(alertsHandler))))
-	mux.HandleFunc("/api/alerts", withRecovery(requireAuth(requireRole("manager")(alertsAPIHandler))))
-	mux.HandleFunc("/api/alerts/acknowledge", withRecovery(requireAuth(requireRole("manager")(acknowledgeAlertHandler))))
-	mux.HandleFunc("/api/alerts/resolve", withRecovery(requireAuth(requireRole("manager")(resolveAlertHandler))))
-	mux.HandleFunc("/api/alerts/summary", withRecovery(requireAuth(requireRole("manager")(alertsSummaryHandler))))
-	mux.HandleFunc("/api/metrics/history", withRecovery(requireAuth(requireRole("manager")(metricsHistoryHandler))))
+	mux.HandleFunc("/monitoring", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(monitoringDashboardHandler))))
+	mux.HandleFunc("/api/monitoring/metrics", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(monitoringAPIHandler))))
+	mux.HandleFunc("/api/monitoring/alerts", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(alertsHandler))))
+	mux.HandleFunc("/api/alerts", withRecovery(requireAuth(requirePermission(PermAlertsManage)(alertsAPIHandler))))
+	mux.HandleFunc("/api/alerts/acknowledge", withRecovery(requireAuth(requirePermission(PermAlertsManage)(acknowledgeAlertHandler))))
+	mux.HandleFunc("/api/alerts/resolve", withRecovery(requireAuth(requirePermission(PermAlertsManage)(resolveAlertHandler))))
+	mux.HandleFunc("/api/alerts/summary", withRecovery(requireAuth(requirePermission(PermAlertsManage)(alertsSummaryHandler))))
+	mux.HandleFunc("/api/metrics/history", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(metricsHistoryHandler))))
 	
 	// ECSE Management
-	mux.HandleFunc("/ecse-dashboard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(ecseDashboardHandler)))))
-	mux.HandleFunc("/ecse-student", withRecovery(requireAuth(requireRole("manager")(requireDatabase(ecseStudentDetailsHandler)))))
-	mux.HandleFunc("/add-ecse-service", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addECSEServiceHandler)))))
-	// mux.HandleFunc("/import-ecse", withRecovery(requireAuth(requireRole("manager")(requireDatabase(importECSEHandler)))))
-	mux.HandleFunc("/add-sample-ecse-data", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addSampleECSEDataHandler)))))
-	mux.HandleFunc("/add-sample-fleet-data", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addSampleFleetDataHandler)))))
-	mux.HandleFunc("/add-sample-fuel-data", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addSampleFuelDataHandler)))))
-	mux.HandleFunc("/generate-mileage-reports", withRecovery(requireAuth(requireRole("manager")(requireDatabase(generateMileageReportsFromLogsHandler)))))
-	// mux.HandleFunc("/fix-tables", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fixTablesHandler))))) - removed
-	mux.HandleFunc("/data-status", withRecovery(requireAuth(requireRole("manager")(requireDatabase(dataStatusHandler)))))
-	// mux.HandleFunc("/check-db", withRecovery(requireAuth(requireRole("manager")(requireDatabase(checkDatabaseHandler)))))
+	mux.HandleFunc("/ecse-dashboard", withRecovery(requireAuth(requirePermission(PermECSEView)(requireDatabase(ecseDashboardHandler)))))
+	mux.HandleFunc("/ecse-student", withRecovery(requireAuth(requirePermission(PermECSEView)(requireDatabase(ecseStudentDetailsHandler)))))
+	mux.HandleFunc("/add-ecse-service", withRecovery(requireAuth(requirePermission(PermECSEEdit)(requireDatabase(addECSEServiceHandler)))))
+	// mux.HandleFunc("/import-ecse", withRecovery(requireAuth(requirePermission(PermECSEEdit)(requireDatabase(importECSEHandler)))))
+	mux.HandleFunc("/add-sample-ecse-data", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(addSampleECSEDataHandler)))))
+	mux.HandleFunc("/add-sample-fleet-data", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(addSampleFleetDataHandler)))))
+	mux.HandleFunc("/add-sample-fuel-data", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(addSampleFuelDataHandler)))))
+	mux.HandleFunc("/generate-mileage-reports", withRecovery(requireAuth(requirePermission(PermMileageEdit)(requireDatabase(generateMileageReportsFromLogsHandler)))))
+	// mux.HandleFunc("/fix-tables", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(fixTablesHandler))))) - removed
+	mux.HandleFunc("/data-status", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(dataStatusHandler)))))
+	// mux.HandleFunc("/check-db", withRecovery(requireAuth(requirePermission(PermSystemAdmin)(requireDatabase(checkDatabaseHandler)))))
 	
 	// Fuel Management
 	mux.HandleFunc("/fuel-records", withRecovery(requireAuth(requireDatabase(fuelRecordsHandler))))
 	mux.HandleFunc("/fuel-tracking", withRecovery(requireAuth(requireDatabase(fuelRecordsHandler))))
 	mux.HandleFunc("/add-fuel-record", withRecovery(requireAuth(requireDatabase(addFuelRecordHandler))))
-	mux.HandleFunc("/fuel-analytics", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fuelAnalyticsHandler)))))
+	mux.HandleFunc("/fuel-analytics", withRecovery(requireAuth(requirePermission(PermFuelView)(requireDatabase(fuelAnalyticsHandler)))))
+	mux.HandleFunc("/fuel-cards", withRecovery(requireAuth(requirePermission(PermFuelView)(requireDatabase(fuelCardsHandler)))))
 	
 	// Budget Management
-	mux.HandleFunc("/budget", withRecovery(requireAuth(requireRole("manager")(requireDatabase(budgetDashboardHandler)))))
-	mux.HandleFunc("/budget/create", withRecovery(requireAuth(requireRole("manager")(requireDatabase(budgetCreateHandler)))))
-	mux.HandleFunc("/budget/edit/", withRecovery(requireAuth(requireRole("manager")(requireDatabase(budgetEditHandler)))))
-	mux.HandleFunc("/budget/report", withRecovery(requireAuth(requireRole("manager")(requireDatabase(budgetReportHandler)))))
+	mux.HandleFunc("/budget", withRecovery(requireAuth(requirePermission(PermBudgetView)(requireDatabase(budgetDashboardHandler)))))
+	mux.HandleFunc("/budget/create", withRecovery(requireAuth(requirePermission(PermBudgetEdit)(requireDatabase(budgetCreateHandler)))))
+	mux.HandleFunc("/budget/edit/", withRecovery(requireAuth(requirePermission(PermBudgetEdit)(requireDatabase(budgetEditHandler)))))
+	mux.HandleFunc("/budget/report", withRecovery(requireAuth(requirePermission(PermBudgetView)(requireDatabase(budgetReportHandler)))))
 	mux.HandleFunc("/api/budget/expense", withRecovery(requireAuth(requireDatabase(budgetExpenseHandler))))
 	
 	// Predictive Maintenance - TEMPORARILY DISABLED due to Vehicle struct incompatibility
 	// TODO: Fix predictive maintenance to work with current Vehicle struct
-	// mux.HandleFunc("/predictive-maintenance", withRecovery(requireAuth(requireRole("manager")(requireDatabase(predictiveMaintenanceDashboardHandler)))))
-	// mux.HandleFunc("/predictive-maintenance/vehicle", withRecovery(requireAuth(requireRole("manager")(requireDatabase(vehicleHealthHandler)))))
-	// mux.HandleFunc("/predictive-maintenance/schedule", withRecovery(requireAuth(requireRole("manager")(requireDatabase(scheduleMaintenanceFromPredictionHandler)))))
-	// mux.HandleFunc("/predictive-maintenance/export", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportMaintenanceForecastHandler)))))
-	// mux.HandleFunc("/api/predictive-maintenance/fleet-health", withRecovery(requireAuth(requireRole("manager")(apiFleetHealthHandler))))
-	// mux.HandleFunc("/api/predictive-maintenance/vehicle-health", withRecovery(requireAuth(requireRole("manager")(apiVehicleHealthHandler))))
-	// mux.HandleFunc("/api/predictive-maintenance/predictions", withRecovery(requireAuth(requireRole("manager")(apiMaintenancePredictionsHandler))))
+	// mux.HandleFunc("/predictive-maintenance", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(predictiveMaintenanceDashboardHandler)))))
+	// mux.HandleFunc("/predictive-maintenance/vehicle", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(vehicleHealthHandler)))))
+	// mux.HandleFunc("/predictive-maintenance/schedule", withRecovery(requireAuth(requirePermission(PermMaintenanceEdit)(requireDatabase(scheduleMaintenanceFromPredictionHandler)))))
+	// mux.HandleFunc("/predictive-maintenance/export", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportMaintenanceForecastHandler)))))
+	// mux.HandleFunc("/api/predictive-maintenance/fleet-health", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(apiFleetHealthHandler))))
+	// mux.HandleFunc("/api/predictive-maintenance/vehicle-health", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(apiVehicleHealthHandler))))
+	// mux.HandleFunc("/api/predictive-maintenance/predictions", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(apiMaintenancePredictionsHandler))))
 
 	// Fleet management - Available to both managers and drivers with proper permissions
 	mux.HandleFunc("/fleet", withRecovery(requireAuth(requireDatabase(fleetHandler))))
 	mux.HandleFunc("/company-fleet", withRecovery(requireAuth(requireDatabase(companyFleetHandler))))
-	mux.HandleFunc("/fleet-vehicles", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fleetVehiclesHandler)))))
-	mux.HandleFunc("/fleet-vehicle/edit/", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fleetVehicleEditHandler)))))
-	mux.HandleFunc("/fleet-vehicle/add", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fleetVehicleAddHandler)))))
-	mux.HandleFunc("/api/fleet-vehicle", withRecovery(requireAuth(requireRole("manager")(requireDatabase(apiFleetVehicleHandler)))))
+	mux.HandleFunc("/fleet-vehicles", withRecovery(requireAuth(requirePermission(PermFleetView)(requireDatabase(fleetVehiclesHandler)))))
+	mux.HandleFunc("/fleet-vehicle/edit/", withRecovery(requireAuth(requirePermission(PermFleetEdit)(requireDatabase(fleetVehicleEditHandler)))))
+	mux.HandleFunc("/fleet-vehicle/add", withRecovery(requireAuth(requirePermission(PermFleetEdit)(requireDatabase(fleetVehicleAddHandler)))))
+	mux.HandleFunc("/api/fleet-vehicle", withRecovery(requireAuth(requirePermission(PermFleetEdit)(requireDatabase(apiFleetVehicleHandler)))))
 	mux.HandleFunc("/update-vehicle-status", withRecovery(requireAuth(requireDatabase(updateVehicleStatusHandler))))
-	mux.HandleFunc("/add-bus", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addBusHandler)))))
-	mux.HandleFunc("/add-bus-wizard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addBusWizardHandler)))))
-	mux.HandleFunc("/edit-bus", withRecovery(requireAuth(requireRole("manager")(requireDatabase(editBusHandler)))))
+	mux.HandleFunc("/add-bus", withRecovery(requireAuth(requirePermission(PermFleetEdit)(requireDatabase(addBusHandler)))))
+	mux.HandleFunc("/add-bus-wizard", withRecovery(requireAuth(requirePermission(PermFleetEdit)(requireDatabase(addBusWizardHandler)))))
+	mux.HandleFunc("/edit-bus", withRecovery(requireAuth(requirePermission(PermFleetEdit)(requireDatabase(editBusHandler)))))
 
 	// Maintenance - Available to both managers and drivers
 	mux.HandleFunc("/bus-maintenance/", withRecovery(requireAuth(requireDatabase(busMaintenanceHandler))))
 	mux.HandleFunc("/vehicle-maintenance/", withRecovery(requireAuth(requireDatabase(vehicleMaintenanceHandler))))
-	mux.HandleFunc("/maintenance-records", withRecovery(requireAuth(requireRole("manager")(requireDatabase(maintenanceRecordsHandler)))))
-	mux.HandleFunc("/service-records", withRecovery(requireAuth(requireRole("manager")(requireDatabase(serviceRecordsHandler)))))
+	mux.HandleFunc("/maintenance-records", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(maintenanceRecordsHandler)))))
+	mux.HandleFunc("/service-records", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(serviceRecordsHandler)))))
+	mux.HandleFunc("/work-orders", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(workOrdersHandler)))))
+	mux.HandleFunc("/work-orders/view", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(workOrderHandler)))))
+	mux.HandleFunc("/parts", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(partsHandler)))))
+	mux.HandleFunc("/pm-schedules", withRecovery(requireAuth(requirePermission(PermMaintenanceView)(requireDatabase(pmSchedulesHandler)))))
 	mux.HandleFunc("/save-maintenance-record", withRecovery(requireAuth(requireDatabase(saveMaintenanceRecordHandler))))
 	mux.HandleFunc("/maintenance-wizard", withRecovery(requireAuth(requireDatabase(maintenanceWizardHandler))))
 	mux.HandleFunc("/save-maintenance-wizard", withRecovery(requireAuth(requireDatabase(saveMaintenanceWizardHandler))))
 
 	// Route management
-	mux.HandleFunc("/assign-routes", withRecovery(requireAuth(requireRole("manager")(requireDatabase(handleAssignRoutesEnhanced)))))
-	mux.HandleFunc("/multi-route-assign", withRecovery(requireAuth(requireRole("manager")(handleMultiRouteAssign))))
+	mux.HandleFunc("/assign-routes", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(handleAssignRoutesEnhanced)))))
+	mux.HandleFunc("/multi-route-assign", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(handleMultiRouteAssign))))
 	mux.HandleFunc("/api/driver-assignments", withRecovery(requireAuth(getDriverAssignmentsAPI)))
-	mux.HandleFunc("/route-assignment-wizard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(routeAssignmentWizardHandler)))))
-	mux.HandleFunc("/assign-route-wizard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(assignRouteWizardHandler)))))
-	mux.HandleFunc("/assign-route", withRecovery(requireAuth(requireRole("manager")(requireDatabase(assignRouteHandler)))))
-	mux.HandleFunc("/api/route-assignment/check-conflicts", withRecovery(requireAuth(requireRole("manager")(requireDatabase(checkRouteConflictsHandler)))))
-	mux.HandleFunc("/api/route-assignment/suggestions", withRecovery(requireAuth(requireRole("manager")(requireDatabase(getRouteAssignmentSuggestionsHandler)))))
-	mux.HandleFunc("/unassign-route", withRecovery(requireAuth(requireRole("manager")(requireDatabase(unassignRouteHandler)))))
-	mux.HandleFunc("/add-route", withRecovery(requireAuth(requireRole("manager")(requireDatabase(addRouteHandler)))))
-	mux.HandleFunc("/edit-route", withRecovery(requireAuth(requireRole("manager")(requireDatabase(editRouteHandler)))))
-	mux.HandleFunc("/delete-route", withRecovery(requireAuth(requireRole("manager")(requireDatabase(deleteRouteHandler)))))
+	mux.HandleFunc("/route-assignment-wizard", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(routeAssignmentWizardHandler)))))
+	mux.HandleFunc("/assign-route-wizard", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(assignRouteWizardHandler)))))
+	mux.HandleFunc("/assign-route", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(assignRouteHandler)))))
+	mux.HandleFunc("/api/route-assignment/check-conflicts", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(checkRouteConflictsHandler)))))
+	mux.HandleFunc("/api/route-assignment/suggestions", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(getRouteAssignmentSuggestionsHandler)))))
+	mux.HandleFunc("/assignment-plan", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(assignmentPlanHandler)))))
+	mux.HandleFunc("/route-preferences", withRecovery(requireAuth(requirePermission(PermDriverOperate)(requireDatabase(routePreferencesHandler)))))
+	mux.HandleFunc("/route-optimizer", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(routeOptimizerHandler)))))
+	mux.HandleFunc("/unassign-route", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(unassignRouteHandler)))))
+	mux.HandleFunc("/add-route", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(addRouteHandler)))))
+	mux.HandleFunc("/edit-route", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(editRouteHandler)))))
+	mux.HandleFunc("/delete-route", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(deleteRouteHandler)))))
 	
 	// Wizard API endpoints
-	mux.HandleFunc("/api/available-drivers", withRecovery(requireAuth(requireRole("manager")(requireDatabase(availableDriversHandler)))))
-	mux.HandleFunc("/api/available-buses", withRecovery(requireAuth(requireRole("manager")(requireDatabase(availableBusesHandler)))))
-	mux.HandleFunc("/api/available-routes", withRecovery(requireAuth(requireRole("manager")(requireDatabase(availableRoutesHandler)))))
-	mux.HandleFunc("/api/check-assignment-conflicts", withRecovery(requireAuth(requireRole("manager")(requireDatabase(checkAssignmentConflictsHandler)))))
+	mux.HandleFunc("/api/available-drivers", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(availableDriversHandler)))))
+	mux.HandleFunc("/api/available-buses", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(availableBusesHandler)))))
+	mux.HandleFunc("/api/available-routes", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(availableRoutesHandler)))))
+	mux.HandleFunc("/api/check-assignment-conflicts", withRecovery(requireAuth(requirePermission(PermRoutesAssign)(requireDatabase(checkAssignmentConflictsHandler)))))
 	mux.HandleFunc("/api/vehicle-mileage/", withRecovery(requireAuth(requireDatabase(vehicleMileageHandler))))
 	mux.HandleFunc("/api/last-maintenance/", withRecovery(requireAuth(requireDatabase(lastMaintenanceHandler))))
 	mux.HandleFunc("/api/maintenance-vendors", withRecovery(requireAuth(requireDatabase(maintenanceVendorsHandler))))
@@ -1306,39 +1337,41 @@ func setupManagerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/suggest-models", withRecovery(requireAuth(requireDatabase(suggestModelsHandler))))
 
 	// Mileage reports
-	mux.HandleFunc("/view-mileage-reports", withRecovery(requireAuth(requireRole("manager")(requireDatabase(viewMileageReportsHandler)))))
-	mux.HandleFunc("/export-mileage", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportMileageHandler)))))
-	mux.HandleFunc("/mileage-report-generator", withRecovery(requireAuth(requireRole("manager")(requireDatabase(mileageReportGeneratorHandler)))))
-	mux.HandleFunc("/monthly-mileage-reports", withRecovery(requireAuth(requireRole("manager")(requireDatabase(monthlyMileageReportsHandler)))))
+	mux.HandleFunc("/view-mileage-reports", withRecovery(requireAuth(requirePermission(PermMileageView)(requireDatabase(viewMileageReportsHandler)))))
+	mux.HandleFunc("/export-mileage", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportMileageHandler)))))
+	mux.HandleFunc("/mileage-report-generator", withRecovery(requireAuth(requirePermission(PermMileageEdit)(requireDatabase(mileageReportGeneratorHandler)))))
+	mux.HandleFunc("/monthly-mileage-reports", withRecovery(requireAuth(requirePermission(PermMileageView)(requireDatabase(monthlyMileageReportsHandler)))))
 
 	// Enhanced Import System
-	mux.HandleFunc("/import-data-wizard", withRecovery(requireAuth(requireRole("manager")(requireDatabase(importDataWizardHandler)))))
-	mux.HandleFunc("/api/import/analyze", withRecovery(requireAuth(requireRole("manager")(requireDatabase(importAnalyzeHandler)))))
-	mux.HandleFunc("/api/import/validate", withRecovery(requireAuth(requireRole("manager")(requireDatabase(importValidateHandler)))))
-	mux.HandleFunc("/api/import/execute", withRecovery(requireAuth(requireRole("manager")(requireDatabase(importExecuteHandler)))))
+	mux.HandleFunc("/import-data-wizard", withRecovery(requireAuth(requirePermission(PermDataImport)(requireDatabase(importDataWizardHandler)))))
+	mux.HandleFunc("/api/import/analyze", withRecovery(requireAuth(requirePermission(PermDataImport)(requireDatabase(importAnalyzeHandler)))))
+	mux.HandleFunc("/api/import/validate", withRecovery(requireAuth(requirePermission(PermDataImport)(requireDatabase(importValidateHandler)))))
+	mux.HandleFunc("/api/import/execute", withRecovery(requireAuth(requirePermission(PermDataImport)(requireDatabase(importExecuteHandler)))))
 	// Export System
-	mux.HandleFunc("/export/templates", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportTemplateHandler)))))
-	mux.HandleFunc("/export/template", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportTemplateHandler)))))
-	mux.HandleFunc("/export/data", withRecovery(requireAuth(requireRole("manager")(requireDatabase(exportDataHandler)))))
-	mux.HandleFunc("/export/scheduled", withRecovery(requireAuth(requireRole("manager")(requireDatabase(scheduledExportsHandler)))))
-	mux.HandleFunc("/export/scheduled/edit", withRecovery(requireAuth(requireRole("manager")(requireDatabase(scheduledExportEditHandler)))))
-	mux.HandleFunc("/export/scheduled/delete", withRecovery(requireAuth(requireRole("manager")(requireDatabase(scheduledExportDeleteHandler)))))
-	mux.HandleFunc("/export/scheduled/run", withRecovery(requireAuth(requireRole("manager")(requireDatabase(scheduledExportRunHandler)))))
+	mux.HandleFunc("/export/templates", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportTemplateHandler)))))
+	mux.HandleFunc("/export/template", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportTemplateHandler)))))
+	mux.HandleFunc("/export/data", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(exportDataHandler)))))
+	mux.HandleFunc("/export/scheduled", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(scheduledExportsHandler)))))
+	mux.HandleFunc("/export/scheduled/edit", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(scheduledExportEditHandler)))))
+	mux.HandleFunc("/export/scheduled/delete", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(scheduledExportDeleteHandler)))))
+	mux.HandleFunc("/export/scheduled/run", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(scheduledExportRunHandler)))))
 
 	// PDF Reports
 	mux.HandleFunc("/api/reports/pdf", withRecovery(requireAuth(requireDatabase(pdfReportHandler))))
-	mux.HandleFunc("/api/reports/pdf/custom", withRecovery(requireAuth(requireRole("manager")(requireDatabase(pdfCustomReportHandler)))))
+	mux.HandleFunc("/api/reports/pdf/custom", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(pdfCustomReportHandler)))))
 	
 	// Report Export Endpoints
 	mux.HandleFunc("/api/reports/maintenance/export", withRecovery(requireAuth(requireDatabase(maintenanceReportExportHandler))))
-	mux.HandleFunc("/api/reports/fleet/export", withRecovery(requireAuth(requireRole("manager")(requireDatabase(fleetReportExportHandler)))))
-	mux.HandleFunc("/api/reports/analytics/export", withRecovery(requireAuth(requireRole("manager")(requireDatabase(analyticsReportExportHandler)))))
+	mux.HandleFunc("/api/reports/fleet/export", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(fleetReportExportHandler)))))
+	mux.HandleFunc("/api/reports/analytics/export", withRecovery(requireAuth(requirePermission(PermReportsExport)(requireDatabase(analyticsReportExportHandler)))))
 
 	// Driver profile
-	mux.HandleFunc("/driver/", withRecovery(requireAuth(requireRole("manager")(requireDatabase(driverProfileHandler)))))
+	mux.HandleFunc("/driver/", withRecovery(requireAuth(requirePermission(PermDriversView)(requireDatabase(driverProfileHandler)))))
+	mux.HandleFunc("/driver-credentials", withRecovery(requireAuth(requireDatabase(driverCredentialsHandler))))
+	mux.HandleFunc("/driver-credentials/document", withRecovery(requireAuth(requireDatabase(driverCredentialDocumentHandler))))
 
 	// Advanced Features - Real-time Dashboard
-	mux.HandleFunc("/realtime-dashboard", withRecovery(requireAuth(requireRole("manager")(RealtimeDashboardHandler))))
+	mux.HandleFunc("/realtime-dashboard", withRecovery(requireAuth(requirePermission(PermDashboardView)(RealtimeDashboardHandler))))
 	
 	// GPS Tracking
 	mux.HandleFunc("/gps-tracking", withRecovery(requireAuth(gpsTrackingHandler)))
@@ -1353,11 +1386,11 @@ func setupManagerRoutes(mux *http.ServeMux) {
 // setupDriverRoutes configures driver-specific routes
 func setupDriverRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/driver-dashboard", withRecovery(requireAuth(requireDatabase(driverDashboardHandler))))
-	mux.HandleFunc("/save-log", withRecovery(requireAuth(requireRole("driver")(requireDatabase(saveLogHandler)))))
+	mux.HandleFunc("/save-log", withRecovery(requireAuth(requirePermission(PermDriverOperate)(requireDatabase(saveLogHandler)))))
 
 	// Reports page
 	mux.HandleFunc("/reports", withRecovery(requireAuth(requireDatabase(reportsHandler))))
-	mux.HandleFunc("/ecse-reports", withRecovery(requireAuth(requireRole("manager")(requireDatabase(ecseDashboardHandler)))))
+	mux.HandleFunc("/ecse-reports", withRecovery(requireAuth(requirePermission(PermECSEView)(requireDatabase(ecseDashboardHandler)))))
 
 	// Student management - both managers and drivers can manage students
 	mux.HandleFunc("/students", withRecovery(requireAuth(requireDatabase(studentsHandler))))
@@ -1366,6 +1399,8 @@ func setupDriverRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/add-student-wizard", withRecovery(requireAuth(requireDatabase(addStudentWizardHandler))))
 	mux.HandleFunc("/edit-student", withRecovery(requireAuth(requireDatabase(editStudentHandler))))
 	mux.HandleFunc("/remove-student", withRecovery(requireAuth(requireDatabase(removeStudentHandler))))
+	mux.HandleFunc("/ridership", withRecovery(requireAuth(requirePermission(PermStudentsEdit)(requireDatabase(ridershipHandler)))))
+	mux.HandleFunc("/school-calendar", withRecovery(requireAuth(requirePermission(PermRoutesEdit)(requireDatabase(schoolCalendarHandler)))))
 }
 
 // ============= UTILITY HANDLER =============
@@ -1603,6 +1638,10 @@ func initializeAdvancedFeatures() {
 		LogError("Failed to initialize GPS tracking", err)
 		// Continue without GPS tracking
 	}
+	if err := InitializeGPSIngestion(); err != nil {
+		LogError("Failed to start GPS device listener", err)
+		// HTTP device ingestion still works
+	}
 	
 	// Initialize route deviation monitoring
 	LogInfo("🚨 Initializing route deviation monitoring...")
@@ -1610,6 +1649,13 @@ func initializeAdvancedFeatures() {
 		LogError("Failed to initialize route monitoring", err)
 		// Continue without route monitoring
 	}
+
+	// Initialize ETA engine
+	LogInfo("⏱️  Initializing route ETA engine...")
+	if err := InitializeETAEngine(); err != nil {
+		LogError("Failed to initialize ETA engine", err)
+		// Continue with schedule/speed based estimates
+	}
 	
 	// Initialize mobile app tables
 	LogInfo("📱 Initializing mobile app database tables...")
@@ -1705,7 +1751,13 @@ func createBackupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	backupFile, err := backupManager.CreateFullBackup()
+	var backupFile string
+	var err error
+	if r.URL.Query().Get("type") == BackupTypeIncremental {
+		backupFile, err = backupManager.CreateIncrementalBackup()
+	} else {
+		backupFile, err = backupManager.CreateFullBackup()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1723,27 +1775,27 @@ func listBackupsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// List backup files
-	backupPath := backupManager.backupPath
-	files, err := os.ReadDir(backupPath)
+	backups, err := backupManager.ListBackups()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	
-	var backups []map[string]interface{}
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".zip") {
-			info, _ := file.Info()
-			backups = append(backups, map[string]interface{}{
-				"name": file.Name(),
-				"size": info.Size(),
-				"date": info.ModTime(),
-			})
-		}
+	list := make([]map[string]interface{}, 0, len(backups))
+	for _, b := range backups {
+		list = append(list, map[string]interface{}{
+			"name":   b.Name,
+			"size":   b.Size,
+			"date":   b.Metadata.Timestamp,
+			"type":   b.Metadata.Type,
+			"base":   b.Metadata.BaseBackup,
+			"parent": b.Metadata.ParentBackup,
+			"tables": b.Metadata.RecordCount,
+			"encrypted": b.Metadata.Encrypted,
+		})
 	}
 	
-	json.NewEncoder(w).Encode(backups)
+	json.NewEncoder(w).Encode(list)
 }
 
 func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
@@ -1754,6 +1806,7 @@ func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
 	
 	var req struct {
 		BackupFile string `json:"backup_file"`
+		Until      string `json:"until"` // RFC3339; restores the newest chain at or before it
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -1761,8 +1814,27 @@ func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if req.BackupFile == "" && req.Until != "" {
+		until, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil {
+			http.Error(w, "Invalid until timestamp, expected RFC3339", http.StatusBadRequest)
+			return
+		}
+		restored, err := backupManager.RestoreToPointInTime(until)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":      "success",
+			"message":     "Backup restored successfully",
+			"backup_file": restored,
+		})
+		return
+	}
+	
 	// Security check - ensure file is in backup directory
-	if strings.Contains(req.BackupFile, "..") {
+	if req.BackupFile == "" || strings.Contains(req.BackupFile, "..") {
 		http.Error(w, "Invalid backup file", http.StatusBadRequest)
 		return
 	}
@@ -1778,3 +1850,94 @@ func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
 		"message": "Backup restored successfully",
 	})
 }
+
+// backupRequestFile resolves the backup named in a verify or dry-run request,
+// either directly or as the newest backup at or before an RFC3339 time
+func backupRequestFile(r *http.Request) (string, error) {
+	var req struct {
+		BackupFile string `json:"backup_file"`
+		Until      string `json:"until"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", fmt.Errorf("Invalid request")
+	}
+
+	if req.BackupFile == "" && req.Until != "" {
+		until, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil {
+			return "", fmt.Errorf("Invalid until timestamp, expected RFC3339")
+		}
+		backup, err := backupManager.BackupAt(until)
+		if err != nil {
+			return "", err
+		}
+		return backup.Path, nil
+	}
+
+	if req.BackupFile == "" || strings.Contains(req.BackupFile, "..") || strings.ContainsAny(req.BackupFile, `/\`) {
+		return "", fmt.Errorf("Invalid backup file")
+	}
+	return filepath.Join(backupManager.backupPath, req.BackupFile), nil
+}
+
+func verifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if backupManager == nil {
+		http.Error(w, "Backup manager not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	backupFile, err := backupRequestFile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := backupManager.VerifyBackup(backupFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Backup not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// dryRunRestoreHandler restores a backup into a scratch schema and reports
+// what a real restore would do, without touching the live tables
+func dryRunRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if backupManager == nil {
+		http.Error(w, "Backup manager not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	backupFile, err := backupRequestFile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(backupFile); err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+
+	report, err := backupManager.DryRunRestore(backupFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -92,20 +92,6 @@ func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// requireRole ensures the user has the required role
-func requireRole(role string) func(http.HandlerFunc) http.HandlerFunc {
-	return func(next http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			user := getUserFromSession(r)
-			if user == nil || user.Role != role {
-				SendError(w, ErrUnauthorized("Access denied"))
-				return
-			}
-			next(w, r)
-		}
-	}
-}
-
 // requireDatabase ensures database is connected
 func requireDatabase(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -26,6 +27,7 @@ type MobileLoginRequest struct {
 	Password string `json:"password"`
 	DeviceID string `json:"device_id"`
 	Platform string `json:"platform"` // ios, android
+	TOTPCode string `json:"totp_code,omitempty"` // TOTP or recovery code, when 2FA is on
 }
 
 type MobileLoginResponse struct {
@@ -59,6 +61,7 @@ type MobileRouteDetails struct {
 	EstimatedEnd time.Time            `json:"estimated_end"`
 	Students     []MobileStudentInfo  `json:"students"`
 	Stops        []RouteStop          `json:"stops"`
+	ETAs         []StopETA            `json:"etas,omitempty"`
 	Description  string               `json:"description"`
 	TotalStops   int                  `json:"total_stops"`
 	Distance     float64              `json:"distance"`
@@ -82,9 +85,13 @@ type MobileStudentInfo struct {
 type MobileAttendanceRecord struct {
 	StudentID   string    `json:"student_id"`
 	Status      string    `json:"status"` // present, absent, excused
+	Period      string    `json:"period,omitempty"` // morning or afternoon; from the time if omitted
 	BoardedAt   time.Time `json:"boarded_at,omitempty"`
 	DroppedAt   time.Time `json:"dropped_at,omitempty"`
 	Notes       string    `json:"notes,omitempty"`
+	// Where the student got on or, with DroppedAt set, off
+	Stop        string    `json:"stop,omitempty"`
+	Location    *GeoPoint `json:"location,omitempty"`
 }
 
 type LocationUpdate struct {
@@ -149,10 +156,45 @@ func (api *MobileAPI) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	user, err := api.authenticateUser(req.Username, req.Password)
 	if err != nil {
 		log.Printf("Mobile login failed for %s: %v", req.Username, err)
+		var locked *AccountLockedError
+		if errors.As(err, &locked) {
+			http.Error(w, lockoutMessage(err), http.StatusTooManyRequests)
+			return
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
+	// Second factor. Enrollment needs the QR code, so it only happens on
+	// the web; the app just sends the current code.
+	twoFactor, err := getTwoFactorStatus(user.Username)
+	if err != nil {
+		log.Printf("Failed to load two-factor status for %s: %v", user.Username, err)
+		http.Error(w, "Authentication error", http.StatusInternalServerError)
+		return
+	}
+	if twoFactor.Required && !twoFactor.Enabled {
+		http.Error(w, "Two-factor authentication must be set up on the website before using the app", http.StatusForbidden)
+		return
+	}
+	if twoFactor.Enabled {
+		if req.TOTPCode == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "totp_required"})
+			return
+		}
+		if valid, _ := verifySecondFactor(user.Username, req.TOTPCode); !valid {
+			if lockErr := userLogins.recordFailure(user.Username); lockErr != nil {
+				http.Error(w, lockoutMessage(lockErr), http.StatusTooManyRequests)
+				return
+			}
+			http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+			return
+		}
+	}
+	userLogins.recordSuccess(user.Username)
+
 	// Generate tokens
 	token, refreshToken, err := api.generateTokens(user, req.DeviceID)
 	if err != nil {
@@ -258,8 +300,12 @@ func (api *MobileAPI) GetCurrentRouteHandler(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
-	// Get route stops (simulated)
+	// Get route stops with live ETAs for the assigned bus
 	route.Stops = api.getRouteStops(route.RouteID)
+	route.TotalStops = len(route.Stops)
+	if routeETA, err := getETAEngine().CalculateVehicleETA(route.BusID, route.RouteID); err == nil {
+		route.ETAs = routeETA.Stops
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(route)
@@ -338,21 +384,7 @@ func (api *MobileAPI) SubmitAttendanceHandler(w http.ResponseWriter, r *http.Req
 	defer tx.Rollback()
 
 	for _, record := range attendance {
-		_, err := tx.Exec(`
-			INSERT INTO student_attendance 
-			(student_id, attendance_date, status, boarded_at, dropped_at, notes, recorded_by)
-			VALUES ($1, CURRENT_DATE, $2, $3, $4, $5, $6)
-			ON CONFLICT (student_id, attendance_date)
-			DO UPDATE SET 
-				status = $2, 
-				boarded_at = $3, 
-				dropped_at = $4, 
-				notes = $5,
-				recorded_by = $6,
-				updated_at = CURRENT_TIMESTAMP
-		`, record.StudentID, record.Status, record.BoardedAt, record.DroppedAt, 
-		   record.Notes, username)
-		
+		err := recordAttendance(tx, mobileAttendanceEntry(record, username))
 		if err != nil {
 			log.Printf("Failed to record attendance: %v", err)
 		}
@@ -370,6 +402,44 @@ func (api *MobileAPI) SubmitAttendanceHandler(w http.ResponseWriter, r *http.Req
 	})
 }
 
+// mobileAttendanceEntry turns a record from the app into a ledger entry
+// for today
+func mobileAttendanceEntry(record MobileAttendanceRecord, username string) AttendanceEntry {
+	now := time.Now()
+	entry := AttendanceEntry{
+		StudentID:  record.StudentID,
+		Date:       now,
+		Period:     record.Period,
+		Status:     record.Status,
+		Source:     AttendanceSourceMobile,
+		RecordedBy: sql.NullString{String: username, Valid: true},
+		Notes:      record.Notes,
+	}
+	stop := sql.NullString{String: record.Stop, Valid: record.Stop != ""}
+	var lat, lng sql.NullFloat64
+	if record.Location != nil {
+		lat = sql.NullFloat64{Float64: record.Location.Latitude, Valid: true}
+		lng = sql.NullFloat64{Float64: record.Location.Longitude, Valid: true}
+	}
+
+	when := now
+	if !record.BoardedAt.IsZero() {
+		when = record.BoardedAt
+		entry.BoardedAt = sql.NullTime{Time: record.BoardedAt, Valid: true}
+	}
+	if !record.DroppedAt.IsZero() {
+		when = record.DroppedAt
+		entry.AlightedAt = sql.NullTime{Time: record.DroppedAt, Valid: true}
+		entry.AlightedStop, entry.AlightedLatitude, entry.AlightedLongitude = stop, lat, lng
+	} else {
+		entry.BoardedStop, entry.BoardedLatitude, entry.BoardedLongitude = stop, lat, lng
+	}
+	if entry.Period == "" {
+		entry.Period = attendancePeriodAt(when)
+	}
+	return entry
+}
+
 // Update location
 func (api *MobileAPI) UpdateLocationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -491,11 +561,22 @@ func (api *MobileAPI) SubmitInspectionHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	// A failed inspection goes straight to the shop, and an unsafe bus
+	// stays off the road until the repair is signed off
+	response := map[string]interface{}{
 		"status": "success",
 		"inspection_id": inspectionID,
-	})
+	}
+	if !inspection.SafeToDrive || len(inspection.Issues) > 0 {
+		if orderID, err := openWorkOrderFromInspection(inspectionID, inspection, username); err != nil {
+			log.Printf("Failed to open work order for inspection %d: %v", inspectionID, err)
+		} else {
+			response["work_order_id"] = orderID
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
 }
 
 // Get driver schedule
@@ -655,7 +736,14 @@ func (api *MobileAPI) authenticateUser(username, password string) (*User, error)
 		return nil, fmt.Errorf("account disabled")
 	}
 
+	if err := userLogins.checkLocked(username); err != nil {
+		return nil, err
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if lockErr := userLogins.recordFailure(username); lockErr != nil {
+			return nil, lockErr
+		}
 		return nil, fmt.Errorf("invalid password")
 	}
 
@@ -733,53 +821,67 @@ func (api *MobileAPI) storeDeviceInfo(username, deviceID, platform string) {
 }
 
 func (api *MobileAPI) getUserPermissions(role string) []string {
-	permissions := map[string][]string{
-		"driver": {
+	// The mobile app predates named permissions and still expects these
+	// capability strings, so derive them from what the role grants. Staff
+	// roles get the manager set even though they may also hold driver.operate.
+	var permissions []string
+	if roleHasPermission(role, PermDriverOperate) && !roleHasPermission(role, PermDashboardView) {
+		permissions = append(permissions,
 			"view_route",
 			"update_attendance",
 			"submit_inspection",
 			"report_issue",
 			"update_location",
-		},
-		"manager": {
-			"view_all_routes",
-			"view_all_drivers",
-			"view_analytics",
-			"manage_schedule",
-			"approve_issues",
-		},
+		)
+	}
+	if roleHasPermission(role, PermRoutesView) {
+		permissions = append(permissions, "view_all_routes")
+	}
+	if roleHasPermission(role, PermDriversView) {
+		permissions = append(permissions, "view_all_drivers")
+	}
+	if roleHasPermission(role, PermAnalyticsView) {
+		permissions = append(permissions, "view_analytics")
+	}
+	if roleHasPermission(role, PermRoutesAssign) {
+		permissions = append(permissions, "manage_schedule")
+	}
+	if roleHasPermission(role, PermMaintenanceEdit) {
+		permissions = append(permissions, "approve_issues")
 	}
 
-	return permissions[role]
+	return permissions
 }
 
 func (api *MobileAPI) getRouteStops(routeID string) []RouteStop {
-	// This would fetch actual route stops from database
-	// For now, return simulated data
-	return []RouteStop{
-		{
-			ID:           1,
-			StopNumber:   1,
-			Name:         "Main Street & 1st Ave",
-			Latitude:     40.7128,
-			Longitude:    -74.0060,
-			ArrivalTime:  time.Now().Add(15 * time.Minute),
-			DepartureTime: time.Now().Add(17 * time.Minute),
-			StudentCount: 5,
-			StopRadius:   50,
-		},
-		{
-			ID:           2,
-			StopNumber:   2,
-			Name:         "Oak Drive & 2nd Street",
-			Latitude:     40.7180,
-			Longitude:    -74.0100,
-			ArrivalTime:  time.Now().Add(25 * time.Minute),
-			DepartureTime: time.Now().Add(27 * time.Minute),
-			StudentCount: 3,
-			StopRadius:   50,
-		},
+	stops, err := loadRoutePlan(routeID)
+	if err != nil {
+		log.Printf("Failed to load route stops for %s: %v", routeID, err)
+		return []RouteStop{}
+	}
+
+	// Student counts per stop come from position numbers
+	rows, err := api.db.Query(`
+		SELECT position_number, COUNT(*)
+		FROM students
+		WHERE route_id = $1 AND active = true AND position_number IS NOT NULL
+		GROUP BY position_number
+	`, routeID)
+	if err == nil {
+		defer rows.Close()
+		counts := make(map[int]int)
+		for rows.Next() {
+			var position, count int
+			if rows.Scan(&position, &count) == nil {
+				counts[position] = count
+			}
+		}
+		for i := range stops {
+			stops[i].StudentCount = counts[stops[i].StopNumber]
+		}
 	}
+
+	return stops
 }
 
 // Register mobile API routes
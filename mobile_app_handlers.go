@@ -37,7 +37,12 @@ func (api *MobileAPI) GetStudentListHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Get students on the route with today's attendance
+	period := r.URL.Query().Get("period")
+	if period != "morning" && period != "afternoon" {
+		period = attendancePeriodAt(time.Now())
+	}
+
+	// Get students on the route with this run's attendance
 	rows, err := api.db.Query(`
 		SELECT 
 			s.student_id,
@@ -46,16 +51,16 @@ func (api *MobileAPI) GetStudentListHandler(w http.ResponseWriter, r *http.Reque
 			COALESCE(s.locations::text, '') as address,
 			COALESCE(s.guardian, '') as parent_name,
 			COALESCE(s.phone_number, '') as parent_phone,
-			sa.status as attendance_status,
-			sa.boarded_at,
-			sa.dropped_at,
-			sa.notes
+			al.status as attendance_status,
+			al.boarded_at,
+			al.alighted_at,
+			al.notes
 		FROM students s
-		LEFT JOIN student_attendance sa ON s.student_id = sa.student_id 
-			AND sa.attendance_date = CURRENT_DATE
+		LEFT JOIN attendance_ledger al ON s.student_id = al.student_id
+			AND al.date = CURRENT_DATE AND al.period = $2
 		WHERE s.route_id = $1
 		ORDER BY s.name
-	`, routeID)
+	`, routeID, period)
 
 	if err != nil {
 		log.Printf("Failed to get student list: %v", err)
@@ -115,6 +120,7 @@ func (api *MobileAPI) GetStudentListHandler(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"route_id": routeID,
 		"date":     time.Now().Format("2006-01-02"),
+		"period":   period,
 		"students": students,
 	})
 }
@@ -142,17 +148,19 @@ func (api *MobileAPI) GetAttendanceHistoryHandler(w http.ResponseWriter, r *http
 
 	query := `
 		SELECT 
-			attendance_date,
+			date,
+			period,
 			status,
 			boarded_at,
-			dropped_at,
+			alighted_at,
 			notes,
-			recorded_by,
+			source,
+			COALESCE(recorded_by, '') as recorded_by,
 			created_at
-		FROM student_attendance
+		FROM attendance_ledger
 		WHERE student_id = $1 
-		AND attendance_date BETWEEN $2 AND $3
-		ORDER BY attendance_date DESC
+		AND date BETWEEN $2 AND $3
+		ORDER BY date DESC, period DESC
 	`
 
 	rows, err := api.db.Query(query, studentID, startDate, endDate)
@@ -165,25 +173,29 @@ func (api *MobileAPI) GetAttendanceHistoryHandler(w http.ResponseWriter, r *http
 	var history []map[string]interface{}
 	for rows.Next() {
 		var record struct {
-			Date       time.Time      `db:"attendance_date"`
+			Date       time.Time      `db:"date"`
+			Period     string         `db:"period"`
 			Status     string         `db:"status"`
 			BoardedAt  sql.NullTime   `db:"boarded_at"`
-			DroppedAt  sql.NullTime   `db:"dropped_at"`
+			DroppedAt  sql.NullTime   `db:"alighted_at"`
 			Notes      sql.NullString `db:"notes"`
+			Source     string         `db:"source"`
 			RecordedBy string         `db:"recorded_by"`
 			CreatedAt  time.Time      `db:"created_at"`
 		}
 
-		if err := rows.Scan(&record.Date, &record.Status, &record.BoardedAt,
-			&record.DroppedAt, &record.Notes, &record.RecordedBy,
+		if err := rows.Scan(&record.Date, &record.Period, &record.Status, &record.BoardedAt,
+			&record.DroppedAt, &record.Notes, &record.Source, &record.RecordedBy,
 			&record.CreatedAt); err != nil {
 			continue
 		}
 
 		entry := map[string]interface{}{
 			"date":        record.Date.Format("2006-01-02"),
+			"period":      record.Period,
 			"status":      record.Status,
 			"notes":       record.Notes.String,
+			"source":      record.Source,
 			"recorded_by": record.RecordedBy,
 			"created_at":  record.CreatedAt.Format(time.RFC3339),
 		}
@@ -381,7 +393,7 @@ func (api *MobileAPI) GetIssueReportsHandler(w http.ResponseWriter, r *http.Requ
 	})
 }
 
-// Update issue status (for managers via mobile)
+// Update issue status (for maintenance staff via mobile)
 func (api *MobileAPI) UpdateIssueStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "PUT" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -394,11 +406,11 @@ func (api *MobileAPI) UpdateIssueStatusHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// Check if user is a manager
+	// Check that the user may update maintenance issues
 	var role string
 	err := api.db.QueryRow("SELECT role FROM users WHERE username = $1", username).Scan(&role)
-	if err != nil || role != "manager" {
-		http.Error(w, "Manager access required", http.StatusForbidden)
+	if err != nil || !roleHasPermission(role, PermMaintenanceEdit) {
+		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
@@ -461,7 +473,9 @@ func (api *MobileAPI) GetMobileDashboardHandler(w http.ResponseWriter, r *http.R
 
 	stats := make(map[string]interface{})
 
-	if role == "driver" {
+	// Fleet-wide viewers get the manager stats even though they may
+	// also hold driver.operate.
+	if !roleHasPermission(role, PermDashboardView) && roleHasPermission(role, PermDriverOperate) {
 		// Get driver-specific stats
 		var routeStats struct {
 			RouteID      sql.NullString `db:"route_id"`
@@ -509,8 +523,8 @@ func (api *MobileAPI) GetMobileDashboardHandler(w http.ResponseWriter, r *http.R
 			FROM students s
 			JOIN routes r ON s.route_id = r.route_id
 			JOIN route_assignments ra ON r.route_id = ra.route_id
-			LEFT JOIN student_attendance sa ON s.student_id = sa.student_id 
-				AND sa.attendance_date = CURRENT_DATE
+			LEFT JOIN attendance_ledger sa ON s.student_id = sa.student_id
+				AND sa.date = CURRENT_DATE
 			WHERE ra.driver_username = $1 AND ra.status = 'active'
 		`, username).Scan(&attendanceStats.Present, &attendanceStats.Absent, &attendanceStats.Late)
 
@@ -525,7 +539,7 @@ func (api *MobileAPI) GetMobileDashboardHandler(w http.ResponseWriter, r *http.R
 
 		stats["open_issues"] = issueCount
 
-	} else if role == "manager" {
+	} else if roleHasPermission(role, PermDashboardView) {
 		// Get manager-specific stats
 		var fleetStats struct {
 			TotalVehicles   int `db:"total_vehicles"`
@@ -547,7 +561,7 @@ func (api *MobileAPI) GetMobileDashboardHandler(w http.ResponseWriter, r *http.R
 					CASE WHEN COUNT(*) > 0 
 					THEN CAST(COUNT(CASE WHEN status = 'present' THEN 1 END) AS FLOAT) / COUNT(*) * 100
 					ELSE 0 END
-				FROM student_attendance WHERE attendance_date = CURRENT_DATE) as attendance_rate
+				FROM attendance_ledger WHERE date = CURRENT_DATE) as attendance_rate
 		`).Scan(&fleetStats.TotalVehicles, &fleetStats.ActiveVehicles,
 			&fleetStats.TotalDrivers, &fleetStats.TotalStudents,
 			&fleetStats.OpenIssues, &fleetStats.TodayAttendance)
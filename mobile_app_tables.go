@@ -12,26 +12,6 @@ func InitializeMobileAppTables(db *sqlx.DB) error {
 	log.Println("📱 Creating mobile app database tables...")
 
 	queries := []string{
-		// Student attendance table
-		`CREATE TABLE IF NOT EXISTS student_attendance (
-			id SERIAL PRIMARY KEY,
-			student_id VARCHAR(50) NOT NULL REFERENCES students(student_id),
-			attendance_date DATE NOT NULL,
-			status VARCHAR(20) NOT NULL CHECK (status IN ('present', 'absent', 'excused', 'late')),
-			boarded_at TIME,
-			dropped_at TIME,
-			notes TEXT,
-			recorded_by VARCHAR(50) REFERENCES users(username),
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(student_id, attendance_date)
-		)`,
-
-		// Index for attendance queries
-		`CREATE INDEX IF NOT EXISTS idx_attendance_date ON student_attendance(attendance_date)`,
-		`CREATE INDEX IF NOT EXISTS idx_attendance_student ON student_attendance(student_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_attendance_recorded_by ON student_attendance(recorded_by)`,
-
 		// Driver locations table for real-time tracking
 		`CREATE TABLE IF NOT EXISTS driver_locations (
 			driver_username VARCHAR(50) PRIMARY KEY REFERENCES users(username),
@@ -101,12 +81,12 @@ func InitializeMobileAppTables(db *sqlx.DB) error {
 			s.name as student_name,
 			'' as grade,
 			r.route_name,
-			COUNT(CASE WHEN sa.status = 'present' THEN 1 END) as days_present,
-			COUNT(CASE WHEN sa.status = 'absent' THEN 1 END) as days_absent,
-			COUNT(CASE WHEN sa.status = 'late' THEN 1 END) as days_late,
-			COUNT(sa.attendance_date) as total_days_recorded
+			COUNT(DISTINCT CASE WHEN al.status = 'present' THEN al.date END) as days_present,
+			COUNT(DISTINCT CASE WHEN al.status = 'absent' THEN al.date END) as days_absent,
+			COUNT(DISTINCT CASE WHEN al.status = 'late' THEN al.date END) as days_late,
+			COUNT(DISTINCT al.date) as total_days_recorded
 		FROM students s
-		LEFT JOIN student_attendance sa ON s.student_id = sa.student_id
+		LEFT JOIN attendance_ledger al ON s.student_id = al.student_id
 		LEFT JOIN routes r ON s.route_id = r.route_id
 		GROUP BY s.student_id, s.name, r.route_name`,
 
@@ -137,21 +117,6 @@ func InitializeMobileAppTables(db *sqlx.DB) error {
 // CreateMobileAppTriggers creates database triggers for mobile app features
 func CreateMobileAppTriggers(db *sqlx.DB) error {
 	triggers := []string{
-		// Auto-update timestamp trigger for attendance
-		`CREATE OR REPLACE FUNCTION update_attendance_timestamp()
-		RETURNS TRIGGER AS $$
-		BEGIN
-			NEW.updated_at = CURRENT_TIMESTAMP;
-			RETURN NEW;
-		END;
-		$$ LANGUAGE plpgsql`,
-
-		`DROP TRIGGER IF EXISTS update_attendance_timestamp ON student_attendance`,
-		
-		`CREATE TRIGGER update_attendance_timestamp
-		BEFORE UPDATE ON student_attendance
-		FOR EACH ROW EXECUTE FUNCTION update_attendance_timestamp()`,
-
 		// Auto-update timestamp trigger for issues
 		`CREATE OR REPLACE FUNCTION update_issue_timestamp()
 		RETURNS TRIGGER AS $$
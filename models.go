@@ -35,6 +35,9 @@ type Bus struct {
 	LastTireService  sql.NullInt32    `json:"last_tire_service" db:"last_tire_service"`
 	UpdatedAt        sql.NullTime     `json:"updated_at" db:"updated_at"`
 	CreatedAt        sql.NullTime     `json:"created_at" db:"created_at"`
+	WheelchairLift   bool             `json:"wheelchair_lift" db:"wheelchair_lift"`
+	EngineHours      int              `json:"engine_hours" db:"engine_hours"`
+	TankCapacity     sql.NullFloat64  `json:"tank_capacity" db:"tank_capacity"`
 	Assignment       *RouteAssignment `json:"assignment,omitempty" db:"-"` // Current route assignment
 }
 
@@ -77,25 +80,27 @@ func (b Bus) GetMaintenanceNotes() string {
 // Vehicle represents a company vehicle
 type Vehicle struct {
 	// NO ID field in database - vehicle_id is the primary key
-	VehicleID        string         `json:"vehicle_id" db:"vehicle_id"`
-	Model            sql.NullString `json:"model" db:"model"`
-	Description      sql.NullString `json:"description" db:"description"`
-	Year             sql.NullString `json:"year" db:"year"` // VARCHAR in database, not INTEGER
-	TireSize         sql.NullString `json:"tire_size" db:"tire_size"`
-	License          sql.NullString `json:"license" db:"license"`
-	OilStatus        sql.NullString `json:"oil_status" db:"oil_status"`
-	TireStatus       sql.NullString `json:"tire_status" db:"tire_status"`
-	Status           sql.NullString `json:"status" db:"status"`
-	MaintenanceNotes sql.NullString `json:"maintenance_notes" db:"maintenance_notes"`
-	SerialNumber     sql.NullString `json:"serial_number" db:"serial_number"`
-	Base             sql.NullString `json:"base" db:"base"`
-	ServiceInterval  sql.NullInt32  `json:"service_interval" db:"service_interval"`
-	CurrentMileage   sql.NullInt32  `json:"current_mileage" db:"current_mileage"`
-	LastOilChange    sql.NullInt32  `json:"last_oil_change" db:"last_oil_change"`
-	LastTireService  sql.NullInt32  `json:"last_tire_service" db:"last_tire_service"`
-	UpdatedAt        sql.NullTime   `json:"updated_at" db:"updated_at"`
-	CreatedAt        sql.NullTime   `json:"created_at" db:"created_at"`
-	ImportID         sql.NullString `json:"import_id" db:"import_id"`
+	VehicleID        string          `json:"vehicle_id" db:"vehicle_id"`
+	Model            sql.NullString  `json:"model" db:"model"`
+	Description      sql.NullString  `json:"description" db:"description"`
+	Year             sql.NullString  `json:"year" db:"year"` // VARCHAR in database, not INTEGER
+	TireSize         sql.NullString  `json:"tire_size" db:"tire_size"`
+	License          sql.NullString  `json:"license" db:"license"`
+	OilStatus        sql.NullString  `json:"oil_status" db:"oil_status"`
+	TireStatus       sql.NullString  `json:"tire_status" db:"tire_status"`
+	Status           sql.NullString  `json:"status" db:"status"`
+	MaintenanceNotes sql.NullString  `json:"maintenance_notes" db:"maintenance_notes"`
+	SerialNumber     sql.NullString  `json:"serial_number" db:"serial_number"`
+	Base             sql.NullString  `json:"base" db:"base"`
+	ServiceInterval  sql.NullInt32   `json:"service_interval" db:"service_interval"`
+	CurrentMileage   sql.NullInt32   `json:"current_mileage" db:"current_mileage"`
+	LastOilChange    sql.NullInt32   `json:"last_oil_change" db:"last_oil_change"`
+	LastTireService  sql.NullInt32   `json:"last_tire_service" db:"last_tire_service"`
+	UpdatedAt        sql.NullTime    `json:"updated_at" db:"updated_at"`
+	CreatedAt        sql.NullTime    `json:"created_at" db:"created_at"`
+	ImportID         sql.NullString  `json:"import_id" db:"import_id"`
+	EngineHours      int             `json:"engine_hours" db:"engine_hours"`
+	TankCapacity     sql.NullFloat64 `json:"tank_capacity" db:"tank_capacity"`
 }
 
 // Helper methods for Vehicle to handle null values in templates
@@ -213,14 +218,6 @@ type CombinedMaintenanceLog struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
-// MaintenanceSchedule defines when maintenance is due
-type MaintenanceSchedule struct {
-	ItemName      string
-	Interval      int // miles
-	WarningMiles  int // miles before due to show warning
-	CriticalMiles int // miles overdue to show critical
-}
-
 // MaintenanceAlert represents a maintenance alert
 type MaintenanceAlert struct {
 	VehicleID    string `json:"vehicle_id"`
@@ -247,6 +244,8 @@ type Route struct {
 	Description string         `json:"description" db:"description"`
 	Positions   sql.NullString `json:"positions" db:"positions"`
 	CreatedAt   time.Time      `json:"created_at" db:"created_at"`
+	// Set when a rider needs a lift-equipped bus
+	NeedsWheelchairLift bool `json:"needs_wheelchair_lift" db:"needs_wheelchair_lift"`
 }
 
 // RouteAssignment represents a driver-bus-route assignment
@@ -290,7 +289,7 @@ type DriverLog struct {
 	Arrival      string    `json:"arrival_time" db:"arrival_time"`
 	BeginMileage float64   `json:"begin_mileage" db:"start_mileage"`
 	EndMileage   float64   `json:"end_mileage" db:"end_mileage"`
-	Attendance   string    `json:"attendance" db:"attendance"`
+	Riders       int       `json:"riders" db:"riders"` // from the attendance ledger
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 }
 
@@ -787,136 +786,95 @@ type MileageRecord struct {
 	CreatedAt    string `json:"created_at" db:"created_at"`
 }
 
-// ServiceRecord represents a service record from the service_records table
-// This table has generic unnamed columns from imported data
+// ServiceRecord represents a service record from the service_records table.
+// The unnamed_* columns are the spreadsheet row as imported; the typed
+// columns are what the normalizer read from it.
 type ServiceRecord struct {
-	ID              int            `json:"id" db:"id"`
-	Unnamed0        sql.NullString `json:"unnamed_0" db:"unnamed_0"`
-	Unnamed1        sql.NullString `json:"unnamed_1" db:"unnamed_1"`
-	Unnamed2        sql.NullString `json:"unnamed_2" db:"unnamed_2"`
-	Unnamed3        sql.NullString `json:"unnamed_3" db:"unnamed_3"`
-	Unnamed4        sql.NullString `json:"unnamed_4" db:"unnamed_4"`
-	Unnamed5        sql.NullString `json:"unnamed_5" db:"unnamed_5"`
-	Unnamed6        sql.NullString `json:"unnamed_6" db:"unnamed_6"`
-	Unnamed7        sql.NullString `json:"unnamed_7" db:"unnamed_7"`
-	Unnamed8        sql.NullString `json:"unnamed_8" db:"unnamed_8"`
-	Unnamed9        sql.NullString `json:"unnamed_9" db:"unnamed_9"`
-	Unnamed10       sql.NullString `json:"unnamed_10" db:"unnamed_10"`
-	Unnamed11       sql.NullString `json:"unnamed_11" db:"unnamed_11"`
-	Unnamed12       sql.NullString `json:"unnamed_12" db:"unnamed_12"`
-	Unnamed13       sql.NullString `json:"unnamed_13" db:"unnamed_13"`
-	CreatedAt       time.Time      `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time      `json:"updated_at" db:"updated_at"`
-	MaintenanceDate sql.NullTime   `json:"maintenance_date" db:"maintenance_date"`
-}
-
-// Helper methods for ServiceRecord to handle null values and interpret data
-func (sr ServiceRecord) GetField(index int) string {
-	switch index {
-	case 0:
-		if sr.Unnamed0.Valid {
-			return sr.Unnamed0.String
-		}
-	case 1:
-		if sr.Unnamed1.Valid {
-			return sr.Unnamed1.String
-		}
-	case 2:
-		if sr.Unnamed2.Valid {
-			return sr.Unnamed2.String
-		}
-	case 3:
-		if sr.Unnamed3.Valid {
-			return sr.Unnamed3.String
-		}
-	case 4:
-		if sr.Unnamed4.Valid {
-			return sr.Unnamed4.String
-		}
-	case 5:
-		if sr.Unnamed5.Valid {
-			return sr.Unnamed5.String
-		}
-	case 6:
-		if sr.Unnamed6.Valid {
-			return sr.Unnamed6.String
-		}
-	case 7:
-		if sr.Unnamed7.Valid {
-			return sr.Unnamed7.String
-		}
-	case 8:
-		if sr.Unnamed8.Valid {
-			return sr.Unnamed8.String
-		}
-	case 9:
-		if sr.Unnamed9.Valid {
-			return sr.Unnamed9.String
-		}
-	case 10:
-		if sr.Unnamed10.Valid {
-			return sr.Unnamed10.String
-		}
-	case 11:
-		if sr.Unnamed11.Valid {
-			return sr.Unnamed11.String
-		}
-	case 12:
-		if sr.Unnamed12.Valid {
-			return sr.Unnamed12.String
-		}
-	case 13:
-		if sr.Unnamed13.Valid {
-			return sr.Unnamed13.String
+	ID                 int            `json:"id" db:"id"`
+	Unnamed0           sql.NullString `json:"unnamed_0" db:"unnamed_0"`
+	Unnamed1           sql.NullString `json:"unnamed_1" db:"unnamed_1"`
+	Unnamed2           sql.NullString `json:"unnamed_2" db:"unnamed_2"`
+	Unnamed3           sql.NullString `json:"unnamed_3" db:"unnamed_3"`
+	Unnamed4           sql.NullString `json:"unnamed_4" db:"unnamed_4"`
+	Unnamed5           sql.NullString `json:"unnamed_5" db:"unnamed_5"`
+	Unnamed6           sql.NullString `json:"unnamed_6" db:"unnamed_6"`
+	Unnamed7           sql.NullString `json:"unnamed_7" db:"unnamed_7"`
+	Unnamed8           sql.NullString `json:"unnamed_8" db:"unnamed_8"`
+	Unnamed9           sql.NullString `json:"unnamed_9" db:"unnamed_9"`
+	Unnamed10          sql.NullString `json:"unnamed_10" db:"unnamed_10"`
+	Unnamed11          sql.NullString `json:"unnamed_11" db:"unnamed_11"`
+	Unnamed12          sql.NullString `json:"unnamed_12" db:"unnamed_12"`
+	Unnamed13          sql.NullString `json:"unnamed_13" db:"unnamed_13"`
+	CreatedAt          time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at" db:"updated_at"`
+	MaintenanceDate    sql.NullTime   `json:"maintenance_date" db:"maintenance_date"`
+	VehicleID          sql.NullString `json:"vehicle_id" db:"vehicle_id"`
+	VehicleNumber      sql.NullString `json:"vehicle_number" db:"vehicle_number"`
+	VehicleDescription sql.NullString `json:"vehicle_description" db:"vehicle_description"`
+	Location           sql.NullString `json:"location" db:"location"`
+	VehicleYear        sql.NullInt64  `json:"vehicle_year" db:"vehicle_year"`
+	ServicedMileage    sql.NullInt64  `json:"serviced_mileage" db:"serviced_mileage"`
+	CurrentMileage     sql.NullInt64  `json:"current_mileage" db:"current_mileage"`
+	ServiceDueMileage  sql.NullInt64  `json:"service_due_mileage" db:"service_due_mileage"`
+	MilesToService     sql.NullInt64  `json:"miles_to_service" db:"miles_to_service"`
+	ServiceInterval    sql.NullInt64  `json:"service_interval" db:"service_interval"`
+	NeedsService       sql.NullBool   `json:"needs_service" db:"needs_service"`
+	ServiceDate        sql.NullTime   `json:"service_date" db:"service_date"`
+	SheetID            sql.NullInt64  `json:"sheet_id" db:"sheet_id"`
+	Layout             sql.NullString `json:"layout" db:"layout"`
+	NormalizeStatus    string         `json:"normalize_status" db:"normalize_status"`
+	NormalizeNotes     sql.NullString `json:"normalize_notes" db:"normalize_notes"`
+}
+
+// serviceRecordColumns lists every service_records column ServiceRecord scans
+const serviceRecordColumns = `id, unnamed_0, unnamed_1, unnamed_2, unnamed_3, unnamed_4, unnamed_5,
+	unnamed_6, unnamed_7, unnamed_8, unnamed_9, unnamed_10, unnamed_11, unnamed_12, unnamed_13,
+	created_at, updated_at, maintenance_date, vehicle_id, vehicle_number, vehicle_description,
+	location, vehicle_year, serviced_mileage, current_mileage, service_due_mileage, miles_to_service,
+	service_interval, needs_service, service_date, sheet_id, layout, normalize_status, normalize_notes`
+
+// ServiceCell is one non-empty raw cell, kept to show where a typed value
+// came from
+type ServiceCell struct {
+	Column int
+	Value  string
+}
+
+// RawCells returns the imported row's non-empty cells
+func (sr ServiceRecord) RawCells() []ServiceCell {
+	var cells []ServiceCell
+	for i, v := range sr.cells() {
+		if strings.TrimSpace(v) != "" {
+			cells = append(cells, ServiceCell{Column: i, Value: v})
 		}
 	}
-	return ""
+	return cells
 }
 
-// GetVehicleInfo attempts to extract vehicle information from the data
+// GetVehicleInfo names the vehicle the record is about
 func (sr ServiceRecord) GetVehicleInfo() string {
-	vehicleInfo := sr.GetField(0)
-	if vehicleInfo == "" {
-		vehicleInfo = sr.GetField(1)
-	}
-	if vehicleInfo == "" {
-		return fmt.Sprintf("Record #%d", sr.ID)
+	switch {
+	case sr.VehicleDescription.Valid && sr.VehicleNumber.Valid:
+		return fmt.Sprintf("#%s %s", sr.VehicleNumber.String, sr.VehicleDescription.String)
+	case sr.VehicleDescription.Valid:
+		return sr.VehicleDescription.String
+	case sr.VehicleNumber.Valid:
+		return "#" + sr.VehicleNumber.String
 	}
-	return vehicleInfo
+	return fmt.Sprintf("Record #%d", sr.ID)
 }
 
-// GetVehicleNumber attempts to extract vehicle number from the data
-func (sr ServiceRecord) GetVehicleNumber() string {
-	return sr.GetField(2)
+// Mapped reports whether the normalizer could read the row
+func (sr ServiceRecord) Mapped() bool {
+	return sr.NormalizeStatus == ServiceRowMapped
 }
 
-// GetServicedMiles attempts to extract serviced miles
-func (sr ServiceRecord) GetServicedMiles() string {
-	miles := sr.GetField(3)
-	if miles == "" {
-		miles = sr.GetField(4)
+// GetServiceDate returns when the vehicle was serviced, if the sheet said
+func (sr ServiceRecord) GetServiceDate() string {
+	if sr.ServiceDate.Valid {
+		return sr.ServiceDate.Time.Format("Jan 2, 2006")
 	}
-	return miles
-}
-
-// GetLastMileage attempts to extract last mileage
-func (sr ServiceRecord) GetLastMileage() string {
-	return sr.GetField(5)
-}
-
-// GetNeedsService attempts to extract needs service info
-func (sr ServiceRecord) GetNeedsService() string {
-	return sr.GetField(6)
-}
-
-// GetMilesToService attempts to extract miles to service
-func (sr ServiceRecord) GetMilesToService() string {
-	return sr.GetField(8)
-}
-
-// GetServiceAt attempts to extract service at mileage
-func (sr ServiceRecord) GetServiceAt() string {
-	return sr.GetField(9)
+	return ""
 }
 
 // GetMaintenanceDate returns formatted maintenance date
@@ -935,25 +893,6 @@ func (sr ServiceRecord) GetFormattedMaintenanceDate() string {
 	return "Unknown"
 }
 
-// GetAllFields returns all non-empty fields for display
-func (sr ServiceRecord) GetAllFields() []string {
-	var fields []string
-	for i := 0; i <= 13; i++ {
-		field := sr.GetField(i)
-		if field != "" && field != "VEH. NUMBER" && field != "SERVICED" {
-			fields = append(fields, field)
-		}
-	}
-	return fields
-}
-
-// StudentAttendance represents attendance data for students
-type StudentAttendance struct {
-	Position   int    `json:"position"`
-	Present    bool   `json:"present"`
-	PickupTime string `json:"pickup_time"`
-}
-
 // Import-specific structs for mileage reports
 
 // AgencyVehicleRecord represents a record from the Agency Vehicle Report
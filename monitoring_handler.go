@@ -45,7 +45,7 @@ type PerformanceMetrics struct {
 // monitoringDashboardHandler serves the monitoring dashboard page
 func monitoringDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
@@ -63,7 +63,7 @@ func monitoringDashboardHandler(w http.ResponseWriter, r *http.Request) {
 // monitoringAPIHandler provides real-time system metrics
 func monitoringAPIHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -77,7 +77,7 @@ func monitoringAPIHandler(w http.ResponseWriter, r *http.Request) {
 // monitoringWebSocketHandler provides real-time updates via WebSocket
 func monitoringWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
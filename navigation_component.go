@@ -11,7 +11,7 @@ type NavigationItem struct {
 	Icon        string `json:"icon"`
 	Description string `json:"description"`
 	Active      bool   `json:"active"`
-	Role        string `json:"role"`        // "manager", "driver", or "both"
+	Permission  string `json:"permission"`  // required permission; empty for everyone
 	Badge       string `json:"badge"`       // Optional badge text
 	BadgeColor  string `json:"badge_color"` // "primary", "success", "warning", "danger"
 }
@@ -68,12 +68,12 @@ func getNavigationData(user *User, currentPage string) NavigationData {
 		nav.ShowBack = false
 	}
 
-	// Create main navigation based on user role
-	if user.Role == "manager" {
-		nav.MainNav = getManagerNavigation(currentPage)
+	// Create main navigation from what the user is allowed to open
+	if hasPermission(user, PermDashboardView) {
+		nav.MainNav = permittedNavigation(user, getManagerNavigation(currentPage))
 		nav.QuickLinks = convertQuickLinksToNavItems(getManagerQuickLinks())
 	} else {
-		nav.MainNav = getDriverNavigation(currentPage)
+		nav.MainNav = permittedNavigation(user, getDriverNavigation(currentPage))
 		nav.QuickLinks = convertQuickLinksToNavItems(getDriverQuickLinks())
 	}
 	
@@ -180,7 +180,7 @@ func getManagerNavigation(currentPage string) []NavigationItem {
 			Icon:        "truck",
 			Description: "Manage buses and vehicles",
 			Active:      strings.Contains(currentPage, "fleet"),
-			Role:        "manager",
+			Permission:  PermFleetView,
 		},
 		{
 			Title:       "Route Assignment",
@@ -188,7 +188,7 @@ func getManagerNavigation(currentPage string) []NavigationItem {
 			Icon:        "map",
 			Description: "Assign drivers to routes",
 			Active:      currentPage == "assign-routes",
-			Role:        "manager",
+			Permission:  PermRoutesAssign,
 		},
 		{
 			Title:       "Student Management",
@@ -196,7 +196,6 @@ func getManagerNavigation(currentPage string) []NavigationItem {
 			Icon:        "people",
 			Description: "Manage student information",
 			Active:      currentPage == "students",
-			Role:        "both",
 		},
 		{
 			Title:       "ECSE Reports",
@@ -204,7 +203,7 @@ func getManagerNavigation(currentPage string) []NavigationItem {
 			Icon:        "clipboard-data",
 			Description: "Special education reports",
 			Active:      strings.Contains(currentPage, "ecse"),
-			Role:        "manager",
+			Permission:  PermECSEView,
 		},
 		{
 			Title:       "Mileage Reports",
@@ -212,7 +211,7 @@ func getManagerNavigation(currentPage string) []NavigationItem {
 			Icon:        "speedometer2",
 			Description: "View mileage and fuel data",
 			Active:      strings.Contains(currentPage, "mileage"),
-			Role:        "manager",
+			Permission:  PermMileageView,
 		},
 		{
 			Title:       "User Management",
@@ -220,7 +219,7 @@ func getManagerNavigation(currentPage string) []NavigationItem {
 			Icon:        "person-check",
 			Description: "Approve and manage users",
 			Active:      strings.Contains(currentPage, "user"),
-			Role:        "manager",
+			Permission:  PermUsersManage,
 		},
 	}
 
@@ -236,7 +235,7 @@ func getDriverNavigation(currentPage string) []NavigationItem {
 			Icon:        "journal-text",
 			Description: "Record daily trip information",
 			Active:      currentPage == "driver-dashboard",
-			Role:        "driver",
+			Permission:  PermDriverOperate,
 		},
 		{
 			Title:       "Student Management",
@@ -244,7 +243,6 @@ func getDriverNavigation(currentPage string) []NavigationItem {
 			Icon:        "people",
 			Description: "View assigned students",
 			Active:      currentPage == "students",
-			Role:        "both",
 		},
 		{
 			Title:       "Fleet Status",
@@ -252,7 +250,6 @@ func getDriverNavigation(currentPage string) []NavigationItem {
 			Icon:        "truck",
 			Description: "View vehicle information",
 			Active:      strings.Contains(currentPage, "fleet"),
-			Role:        "both",
 		},
 	}
 
@@ -263,12 +260,20 @@ func getDriverNavigation(currentPage string) []NavigationItem {
 
 // getDriverQuickLinks is already defined in handlers_getting_started.go
 
+// permittedNavigation drops the items the user doesn't have permission for
+func permittedNavigation(user *User, items []NavigationItem) []NavigationItem {
+	var allowed []NavigationItem
+	for _, item := range items {
+		if item.Permission == "" || hasPermission(user, item.Permission) {
+			allowed = append(allowed, item)
+		}
+	}
+	return allowed
+}
+
 // getDashboardURL returns the appropriate dashboard URL for the user
 func getDashboardURL(user *User) string {
-	if user.Role == "manager" {
-		return "/manager-dashboard"
-	}
-	return "/driver-dashboard"
+	return homePath(user)
 }
 
 // getPageTitleAndIcon returns the page title and icon for the current page
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Delivery states in notification_deliveries
+const (
+	DeliveryPending   = "pending"
+	DeliverySending   = "sending"
+	DeliveryRetry     = "retry"
+	DeliverySent      = "sent"
+	DeliveryDelivered = "delivered" // in-app
+	DeliveryDead      = "dead"
+)
+
+const (
+	outboxBatchSize    = 10
+	outboxPollInterval = 5 * time.Second
+	outboxLease        = 5 * time.Minute // a "sending" row older than this is reclaimed
+	outboxMaxBackoff   = time.Hour
+)
+
+// outboxDelivery is one notification/recipient/channel row
+type outboxDelivery struct {
+	ID             int
+	NotificationID string
+	UserID         string
+	Channel        string
+	Address        string
+	Recipient      Recipient
+	Attempts       int
+	MaxAttempts    int
+}
+
+// FailedDelivery is a dead-lettered delivery shown to managers
+type FailedDelivery struct {
+	ID             int
+	NotificationID string
+	Type           string
+	Priority       string
+	Subject        string
+	UserID         string
+	Channel        string
+	Recipient      string
+	Attempts       int
+	LastError      string
+	UpdatedAt      time.Time
+}
+
+// ensureOutboxSchema brings the notifications tables in line with what
+// the system writes and adds the outbox columns
+func (ns *NotificationSystem) ensureOutboxSchema() {
+	queries := []string{
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS subject VARCHAR(255)`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS data JSONB`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS recipients JSONB`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS scheduled_at TIMESTAMP`,
+		`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP`,
+		`ALTER TABLE notifications ALTER COLUMN title DROP NOT NULL`,
+		// Callers use medium/critical and alert severities as priority
+		`ALTER TABLE notifications DROP CONSTRAINT IF EXISTS notifications_priority_check`,
+
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS max_attempts INTEGER DEFAULT 6`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS recipient_data JSONB`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_deliveries_due
+		 ON notification_deliveries(next_attempt_at)
+		 WHERE status IN ('pending', 'sending', 'retry')`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_deliveries_dead
+		 ON notification_deliveries(updated_at DESC) WHERE status = 'dead'`,
+	}
+
+	for _, q := range queries {
+		if _, err := ns.db.Exec(q); err != nil {
+			log.Printf("Notification outbox migration failed: %v", err)
+		}
+	}
+}
+
+// isUrgent reports whether a notification bypasses recipient preferences
+// and quiet hours and gets the longer retry budget
+func (n Notification) isUrgent() bool {
+	switch n.Priority {
+	case "critical", "urgent":
+		return true
+	}
+	return n.Type == "sos" || n.Type == NotifyEmergency
+}
+
+// expandDeliveries turns a notification into one delivery per
+// recipient, channel and address (each push token is its own delivery)
+func (ns *NotificationSystem) expandDeliveries(n Notification) []outboxDelivery {
+	urgent := n.isUrgent()
+	maxAttempts := 6
+	if urgent {
+		maxAttempts = 12
+	}
+
+	var deliveries []outboxDelivery
+	for _, r := range n.Recipients {
+		if !urgent {
+			if ns.isQuietHours(r.Preferences.Quiet) && n.Priority != "high" {
+				log.Printf("Skipping notification for %s due to quiet hours", r.Username)
+				continue
+			}
+			if enabled, ok := r.Preferences.Types[n.Type]; ok && !enabled {
+				log.Printf("User %s has disabled %s notifications", r.Username, n.Type)
+				continue
+			}
+		}
+
+		add := func(channel, address string) {
+			deliveries = append(deliveries, outboxDelivery{
+				NotificationID: n.ID,
+				UserID:         r.UserID,
+				Channel:        channel,
+				Address:        address,
+				Recipient:      r,
+				MaxAttempts:    maxAttempts,
+			})
+		}
+
+		for _, channel := range n.Channels {
+			switch channel {
+			case "email":
+				if r.Email != "" && (urgent || r.Preferences.Email) {
+					add(channel, r.Email)
+				}
+			case "sms":
+				if r.Phone != "" && (urgent || r.Preferences.SMS) {
+					add(channel, ns.formatPhoneNumber(r.Phone))
+				}
+			case "push":
+				if urgent || r.Preferences.Push {
+					for _, token := range r.DeviceTokens {
+						add(channel, token)
+					}
+				}
+			case "in-app":
+				if r.Username != "" {
+					add(channel, r.Username)
+				}
+			}
+		}
+	}
+	return deliveries
+}
+
+// persist stores the notification and its deliveries in one transaction
+func (ns *NotificationSystem) persist(n Notification, deliveries []outboxDelivery) error {
+	tx, err := ns.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := storeNotificationTx(tx, n); err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+
+	due := time.Now()
+	if n.ScheduledAt != nil && n.ScheduledAt.After(due) {
+		due = *n.ScheduledAt
+	}
+
+	for _, d := range deliveries {
+		recipientJSON, _ := json.Marshal(d.Recipient)
+		if _, err := tx.Exec(`
+			INSERT INTO notification_deliveries
+			(notification_id, user_id, channel, status, recipient, recipient_data,
+			 attempts, max_attempts, next_attempt_at, updated_at)
+			VALUES ($1, $2, $3, 'pending', $4, $5, 0, $6, $7, CURRENT_TIMESTAMP)
+		`, d.NotificationID, d.UserID, d.Channel, d.Address, recipientJSON,
+			d.MaxAttempts, due); err != nil {
+			return fmt.Errorf("failed to queue delivery: %w", err)
+		}
+	}
+
+	if len(deliveries) == 0 {
+		// Nothing to send (preferences, missing addresses); close it out
+		if _, err := tx.Exec(`UPDATE notifications SET status = 'sent', updated_at = CURRENT_TIMESTAMP WHERE id = $1`, n.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// wakeWorkers nudges an idle worker without blocking
+func (ns *NotificationSystem) wakeWorkers() {
+	select {
+	case ns.wake <- struct{}{}:
+	default:
+	}
+}
+
+// worker drains due deliveries, then sleeps until woken or the next poll
+func (ns *NotificationSystem) worker(id int) {
+	defer ns.wg.Done()
+	log.Printf("Notification worker %d started", id)
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ns.processDueDeliveries() > 0 {
+		}
+
+		select {
+		case <-ns.quit:
+			return
+		case <-ns.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processDueDeliveries claims a batch of due deliveries and attempts them.
+// Claiming moves next_attempt_at forward by a lease so a crashed worker's
+// rows are picked up again later.
+func (ns *NotificationSystem) processDueDeliveries() int {
+	rows, err := ns.db.Query(`
+		UPDATE notification_deliveries
+		SET status = 'sending',
+		    next_attempt_at = CURRENT_TIMESTAMP + $1 * INTERVAL '1 second',
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM notification_deliveries
+			WHERE status IN ('pending', 'sending', 'retry')
+			  AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, notification_id, COALESCE(user_id, ''), channel,
+		          COALESCE(recipient, ''), recipient_data,
+		          COALESCE(attempts, 0), COALESCE(max_attempts, 6)
+	`, int(outboxLease.Seconds()), outboxBatchSize)
+	if err != nil {
+		log.Printf("Failed to claim notification deliveries: %v", err)
+		return 0
+	}
+
+	var batch []outboxDelivery
+	for rows.Next() {
+		var d outboxDelivery
+		var recipientJSON []byte
+		if err := rows.Scan(&d.ID, &d.NotificationID, &d.UserID, &d.Channel,
+			&d.Address, &recipientJSON, &d.Attempts, &d.MaxAttempts); err != nil {
+			log.Printf("Failed to scan notification delivery: %v", err)
+			continue
+		}
+		json.Unmarshal(recipientJSON, &d.Recipient)
+		batch = append(batch, d)
+	}
+	rows.Close()
+
+	for _, d := range batch {
+		ns.attemptDelivery(d)
+	}
+	return len(batch)
+}
+
+// attemptDelivery sends one delivery and records the outcome
+func (ns *NotificationSystem) attemptDelivery(d outboxDelivery) {
+	n, err := ns.loadNotification(d.NotificationID)
+	if err != nil {
+		ns.finishDelivery(d, DeliveryResult{Recipient: d.Address, Err: err}, true)
+		return
+	}
+
+	var result DeliveryResult
+	status := DeliverySent
+	switch d.Channel {
+	case "email":
+		err := ns.sendEmail(n, d.Recipient)
+		result = DeliveryResult{Provider: "smtp", Recipient: d.Address, Err: err}
+	case "sms":
+		result = ns.sendSMS(n, d.Address)
+	case "push":
+		result = ns.sendPush(n, d.Address)
+	case "in-app":
+		err := ns.sendInApp(n, d.Recipient)
+		result = DeliveryResult{Provider: "in-app", Recipient: d.Address, Err: err}
+		status = DeliveryDelivered
+	default:
+		result = DeliveryResult{Recipient: d.Address, Err: fmt.Errorf("unsupported channel %q", d.Channel)}
+	}
+
+	if result.Err == nil {
+		ns.markDelivered(d, result, status)
+		return
+	}
+	ns.finishDelivery(d, result, isRetryable(result.Err))
+}
+
+func (ns *NotificationSystem) markDelivered(d outboxDelivery, result DeliveryResult, status string) {
+	_, err := ns.db.Exec(`
+		UPDATE notification_deliveries
+		SET status = $1, attempts = attempts + 1, delivered_at = CURRENT_TIMESTAMP,
+		    provider = NULLIF($2, ''), provider_message_id = NULLIF($3, ''),
+		    error_message = NULL, next_attempt_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4
+	`, status, result.Provider, result.MessageID, d.ID)
+	if err != nil {
+		log.Printf("Failed to record delivery %d: %v", d.ID, err)
+	}
+	ns.refreshNotificationStatus(d.NotificationID)
+}
+
+// finishDelivery schedules a retry with exponential backoff, or moves the
+// delivery to the dead-letter state once attempts run out
+func (ns *NotificationSystem) finishDelivery(d outboxDelivery, result DeliveryResult, retryable bool) {
+	attempts := d.Attempts + 1
+	errMsg := result.Err.Error()
+
+	if retryable && attempts < d.MaxAttempts {
+		wait := outboxBackoff(attempts)
+		if pe, ok := result.Err.(*ProviderError); ok && pe.RetryAfter > wait {
+			wait = pe.RetryAfter
+		}
+		next := time.Now().Add(wait)
+		_, err := ns.db.Exec(`
+			UPDATE notification_deliveries
+			SET status = 'retry', attempts = $1, next_attempt_at = $2,
+			    provider = NULLIF($3, ''), error_message = $4, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $5
+		`, attempts, next, result.Provider, errMsg, d.ID)
+		if err != nil {
+			log.Printf("Failed to schedule retry for delivery %d: %v", d.ID, err)
+		}
+		log.Printf("Delivery %d (%s to %s) failed, attempt %d/%d, retrying at %s: %s",
+			d.ID, d.Channel, maskAddress(d.Address), attempts, d.MaxAttempts, next.Format("15:04:05"), errMsg)
+		return
+	}
+
+	_, err := ns.db.Exec(`
+		UPDATE notification_deliveries
+		SET status = 'dead', attempts = $1, next_attempt_at = NULL,
+		    provider = NULLIF($2, ''), error_message = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4
+	`, attempts, result.Provider, errMsg, d.ID)
+	if err != nil {
+		log.Printf("Failed to dead-letter delivery %d: %v", d.ID, err)
+	}
+	log.Printf("Delivery %d (%s to %s) moved to dead-letter after %d attempts: %s",
+		d.ID, d.Channel, maskAddress(d.Address), attempts, errMsg)
+	ns.refreshNotificationStatus(d.NotificationID)
+}
+
+// outboxBackoff is 30s doubled per attempt, capped at an hour
+func outboxBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	return delay
+}
+
+// refreshNotificationStatus closes a notification once no deliveries are
+// outstanding: sent if anything got through, failed otherwise
+func (ns *NotificationSystem) refreshNotificationStatus(notificationID string) {
+	_, err := ns.db.Exec(`
+		UPDATE notifications n
+		SET status = CASE WHEN EXISTS (
+				SELECT 1 FROM notification_deliveries
+				WHERE notification_id = n.id AND status IN ('sent', 'delivered')
+			) THEN 'sent' ELSE 'failed' END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE n.id = $1 AND NOT EXISTS (
+			SELECT 1 FROM notification_deliveries
+			WHERE notification_id = n.id AND status IN ('pending', 'sending', 'retry')
+		)
+	`, notificationID)
+	if err != nil {
+		log.Printf("Failed to update notification status: %v", err)
+	}
+}
+
+func (ns *NotificationSystem) loadNotification(id string) (Notification, error) {
+	var n Notification
+	var dataJSON []byte
+	var subject sql.NullString
+	err := ns.db.QueryRow(`
+		SELECT id, type, priority, subject, message, data, created_at
+		FROM notifications WHERE id = $1
+	`, id).Scan(&n.ID, &n.Type, &n.Priority, &subject, &n.Message, &dataJSON, &n.CreatedAt)
+	if err != nil {
+		return n, fmt.Errorf("failed to load notification %s: %w", id, err)
+	}
+	n.Subject = subject.String
+	json.Unmarshal(dataJSON, &n.Data)
+	return n, nil
+}
+
+// deliverDirect is the fallback when the outbox can't be written:
+// one best-effort attempt per delivery, nothing persisted
+func (ns *NotificationSystem) deliverDirect(n Notification) {
+	for _, d := range ns.expandDeliveries(n) {
+		var err error
+		switch d.Channel {
+		case "email":
+			err = ns.sendEmail(n, d.Recipient)
+		case "sms":
+			err = ns.sendSMS(n, d.Address).Err
+		case "push":
+			err = ns.sendPush(n, d.Address).Err
+		case "in-app":
+			err = ns.sendInApp(n, d.Recipient)
+		}
+		if err != nil {
+			log.Printf("Direct %s delivery for notification %s failed: %v", d.Channel, n.ID, err)
+		}
+	}
+}
+
+// ListFailedDeliveries returns dead-lettered deliveries, newest first
+func (ns *NotificationSystem) ListFailedDeliveries(limit int) ([]FailedDelivery, error) {
+	rows, err := ns.db.Query(`
+		SELECT nd.id, nd.notification_id, COALESCE(n.type, ''), COALESCE(n.priority, ''),
+		       COALESCE(n.subject, n.title, ''), COALESCE(nd.user_id, ''), nd.channel,
+		       COALESCE(nd.recipient, ''), COALESCE(nd.attempts, 0),
+		       COALESCE(nd.error_message, ''), COALESCE(nd.updated_at, nd.created_at)
+		FROM notification_deliveries nd
+		LEFT JOIN notifications n ON n.id = nd.notification_id
+		WHERE nd.status IN ('dead', 'failed')
+		ORDER BY COALESCE(nd.updated_at, nd.created_at) DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failed []FailedDelivery
+	for rows.Next() {
+		var f FailedDelivery
+		if err := rows.Scan(&f.ID, &f.NotificationID, &f.Type, &f.Priority, &f.Subject,
+			&f.UserID, &f.Channel, &f.Recipient, &f.Attempts, &f.LastError, &f.UpdatedAt); err != nil {
+			continue
+		}
+		failed = append(failed, f)
+	}
+	return failed, rows.Err()
+}
+
+// ResendDelivery puts a dead-lettered delivery back in the outbox
+// with a fresh attempt budget
+func (ns *NotificationSystem) ResendDelivery(id int) error {
+	var notificationID string
+	err := ns.db.QueryRow(`
+		UPDATE notification_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP,
+		    error_message = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status IN ('dead', 'failed') AND recipient_data IS NOT NULL
+		RETURNING notification_id
+	`, id).Scan(&notificationID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("delivery %d is not in the dead-letter queue", id)
+	} else if err != nil {
+		return err
+	}
+
+	ns.db.Exec(`UPDATE notifications SET status = 'pending', updated_at = CURRENT_TIMESTAMP WHERE id = $1`, notificationID)
+	ns.wakeWorkers()
+	return nil
+}
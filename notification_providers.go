@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ProviderMessage is a single message to one address (phone number or device token)
+type ProviderMessage struct {
+	To       string
+	Title    string
+	Body     string
+	Data     map[string]string
+	Priority string
+}
+
+// NotificationProvider delivers messages over an external channel
+type NotificationProvider interface {
+	Name() string
+	// Send returns the provider's message ID on success
+	Send(ctx context.Context, msg ProviderMessage) (string, error)
+}
+
+// ProviderError is a failed provider call. Retryable errors are
+// rate limits, server errors and network failures.
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Code       string
+	Message    string
+	Retryable  bool
+	RetryAfter time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s: %s (%d %s)", e.Provider, e.Message, e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("%s: %s (%d)", e.Provider, e.Message, e.StatusCode)
+}
+
+// providerHTTPError builds a ProviderError from a non-2xx response
+func providerHTTPError(provider string, resp *http.Response, code, message string) *ProviderError {
+	pe := &ProviderError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		Code:       code,
+		Message:    message,
+		Retryable:  resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+	if pe.Message == "" {
+		pe.Message = http.StatusText(resp.StatusCode)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		pe.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return pe
+}
+
+// errProviderNotConfigured means the channel has no provider set up, which
+// no number of retries will fix
+var errProviderNotConfigured = errors.New("provider not configured")
+
+// isRetryable reports whether a send error is worth another attempt
+func isRetryable(err error) bool {
+	if errors.Is(err, errProviderNotConfigured) {
+		return false
+	}
+	if pe, ok := err.(*ProviderError); ok {
+		return pe.Retryable
+	}
+	// Transport errors (timeouts, resets) are retried
+	return err != nil
+}
+
+// DeliveryResult is the outcome of sending to one address
+type DeliveryResult struct {
+	Provider  string
+	Recipient string
+	MessageID string
+	Err       error
+}
+
+// deliverOnce makes a single send through a provider. Retries and backoff
+// belong to the outbox, which reschedules the delivery.
+func deliverOnce(p NotificationProvider, msg ProviderMessage) DeliveryResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	id, err := p.Send(ctx, msg)
+	return DeliveryResult{Provider: p.Name(), Recipient: msg.To, MessageID: id, Err: err}
+}
+
+// maskAddress keeps phone numbers and tokens out of logs
+func maskAddress(addr string) string {
+	if len(addr) <= 6 {
+		return "***"
+	}
+	return addr[:4] + "..." + addr[len(addr)-2:]
+}
+
+// TwilioSMSProvider sends SMS through a Twilio-compatible Messages API
+type TwilioSMSProvider struct {
+	BaseURL    string
+	AccountSID string
+	AuthToken  string
+	From       string
+	client     *http.Client
+}
+
+func NewTwilioSMSProvider(cfg SMSConfig) *TwilioSMSProvider {
+	base := cfg.BaseURL
+	if base == "" {
+		base = "https://api.twilio.com"
+	}
+	return &TwilioSMSProvider{
+		BaseURL:    strings.TrimRight(base, "/"),
+		AccountSID: cfg.AccountSID,
+		AuthToken:  cfg.AuthToken,
+		From:       cfg.FromNumber,
+		client:     &http.Client{Timeout: 20 * time.Second},
+	}
+}
+
+func (p *TwilioSMSProvider) Name() string { return "twilio" }
+
+func (p *TwilioSMSProvider) Send(ctx context.Context, msg ProviderMessage) (string, error) {
+	form := url.Values{}
+	form.Set("To", msg.To)
+	form.Set("From", p.From)
+	form.Set("Body", msg.Body)
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", p.BaseURL, url.PathEscape(p.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(p.AccountSID, p.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		SID     string `json:"sid"`
+		Status  string `json:"status"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		code := ""
+		if body.Code != 0 {
+			code = strconv.Itoa(body.Code)
+		}
+		return "", providerHTTPError(p.Name(), resp, code, body.Message)
+	}
+	if body.Status == "failed" || body.Status == "undelivered" {
+		return body.SID, &ProviderError{Provider: p.Name(), StatusCode: resp.StatusCode, Message: "message " + body.Status}
+	}
+	return body.SID, nil
+}
+
+// FCMProvider sends Android/web push through the FCM HTTP v1 API.
+// Access tokens come from the service account, or FCM_ACCESS_TOKEN for testing.
+type FCMProvider struct {
+	BaseURL   string
+	ProjectID string
+
+	account     *fcmServiceAccount
+	staticToken string
+	client      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+}
+
+type fcmServiceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func NewFCMProvider(cfg PushConfig) (*FCMProvider, error) {
+	base := cfg.FCMBaseURL
+	if base == "" {
+		base = "https://fcm.googleapis.com"
+	}
+	p := &FCMProvider{
+		BaseURL:     strings.TrimRight(base, "/"),
+		ProjectID:   cfg.FCMProjectID,
+		staticToken: cfg.FCMAccessToken,
+		client:      &http.Client{Timeout: 20 * time.Second},
+	}
+
+	if cfg.FCMCredentialsFile != "" {
+		data, err := os.ReadFile(cfg.FCMCredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FCM credentials: %w", err)
+		}
+		var account fcmServiceAccount
+		if err := json.Unmarshal(data, &account); err != nil {
+			return nil, fmt.Errorf("invalid FCM credentials: %w", err)
+		}
+		if account.TokenURI == "" {
+			account.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+		p.account = &account
+		if p.ProjectID == "" {
+			p.ProjectID = account.ProjectID
+		}
+	}
+
+	if p.ProjectID == "" {
+		return nil, fmt.Errorf("FCM project ID is required")
+	}
+	if p.account == nil && p.staticToken == "" {
+		return nil, fmt.Errorf("FCM credentials file or access token is required")
+	}
+	return p, nil
+}
+
+func (p *FCMProvider) Name() string { return "fcm" }
+
+func (p *FCMProvider) Send(ctx context.Context, msg ProviderMessage) (string, error) {
+	token, err := p.token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	androidPriority := "NORMAL"
+	if msg.Priority == "high" {
+		androidPriority = "HIGH"
+	}
+	payload := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": msg.To,
+			"notification": map[string]string{
+				"title": msg.Title,
+				"body":  msg.Body,
+			},
+			"data":    msg.Data,
+			"android": map[string]string{"priority": androidPriority},
+		},
+	}
+	jsonPayload, _ := json.Marshal(payload)
+
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/messages:send", p.BaseURL, url.PathEscape(p.ProjectID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Name  string `json:"name"`
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if resp.StatusCode == http.StatusUnauthorized {
+			p.mu.Lock()
+			p.accessToken = ""
+			p.mu.Unlock()
+		}
+		return "", providerHTTPError(p.Name(), resp, body.Error.Status, body.Error.Message)
+	}
+	return body.Name, nil
+}
+
+// token returns a cached OAuth2 access token, exchanging a signed
+// service-account JWT when it is missing or about to expire
+func (p *FCMProvider) token(ctx context.Context) (string, error) {
+	if p.account == nil {
+		return p.staticToken, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accessToken != "" && time.Until(p.tokenExpiry) > time.Minute {
+		return p.accessToken, nil
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(p.account.PrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid FCM private key: %w", err)
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   p.account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/firebase.messaging",
+		"aud":   p.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign FCM assertion: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", providerHTTPError(p.Name(), resp, body.Error, "token exchange failed")
+	}
+
+	p.accessToken = body.AccessToken
+	p.tokenExpiry = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+	return p.accessToken, nil
+}
+
+// APNSProvider sends iOS push over HTTP/2 with certificate authentication
+type APNSProvider struct {
+	BaseURL string
+	Topic   string
+	client  *http.Client
+}
+
+func NewAPNSProvider(cfg PushConfig) (*APNSProvider, error) {
+	if cfg.APNSTopic == "" {
+		return nil, fmt.Errorf("APNS topic (bundle ID) is required")
+	}
+	base := cfg.APNSBaseURL
+	if base == "" {
+		base = "https://api.push.apple.com"
+	}
+
+	transport := &http.Transport{ForceAttemptHTTP2: true}
+	if cfg.APNSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.APNSCert, cfg.APNSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load APNS certificate: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return &APNSProvider{
+		BaseURL: strings.TrimRight(base, "/"),
+		Topic:   cfg.APNSTopic,
+		client:  &http.Client{Transport: transport, Timeout: 20 * time.Second},
+	}, nil
+}
+
+func (p *APNSProvider) Name() string { return "apns" }
+
+func (p *APNSProvider) Send(ctx context.Context, msg ProviderMessage) (string, error) {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{
+				"title": msg.Title,
+				"body":  msg.Body,
+			},
+			"sound": "default",
+			"badge": 1,
+		},
+	}
+	for k, v := range msg.Data {
+		if k != "aps" {
+			payload[k] = v
+		}
+	}
+	jsonPayload, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+"/3/device/"+url.PathEscape(msg.To), bytes.NewReader(jsonPayload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("apns-topic", p.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	if msg.Priority == "high" {
+		req.Header.Set("apns-priority", "10")
+	} else {
+		req.Header.Set("apns-priority", "5")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+		return "", providerHTTPError(p.Name(), resp, body.Reason, body.Reason)
+	}
+	return resp.Header.Get("apns-id"), nil
+}
+
+// stringifyData flattens notification data for providers that only accept strings
+func stringifyData(data map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(data))
+	for k, v := range data {
+		switch val := v.(type) {
+		case string:
+			out[k] = val
+		case nil:
+		default:
+			b, _ := json.Marshal(val)
+			out[k] = string(b)
+		}
+	}
+	return out
+}
+
+// configureProviders builds the SMS and push providers from config.
+// Missing configuration leaves a provider nil; deliveries then fail honestly.
+func (ns *NotificationSystem) configureProviders() {
+	if ns.smsConfig.AccountSID != "" && ns.smsConfig.AuthToken != "" {
+		switch strings.ToLower(ns.smsConfig.Provider) {
+		case "", "twilio":
+			ns.smsProvider = NewTwilioSMSProvider(ns.smsConfig)
+		default:
+			log.Printf("Unsupported SMS provider %q", ns.smsConfig.Provider)
+		}
+	}
+
+	if ns.pushConfig.FCMCredentialsFile != "" || ns.pushConfig.FCMAccessToken != "" {
+		if p, err := NewFCMProvider(ns.pushConfig); err != nil {
+			log.Printf("FCM push disabled: %v", err)
+		} else {
+			ns.fcmProvider = p
+		}
+	}
+
+	if ns.pushConfig.APNSTopic != "" {
+		if p, err := NewAPNSProvider(ns.pushConfig); err != nil {
+			log.Printf("APNS push disabled: %v", err)
+		} else {
+			ns.apnsProvider = p
+		}
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"html/template"
 	"log"
-	"net/http"
 	"net/smtp"
 	"os"
 	"strings"
@@ -23,8 +22,12 @@ type NotificationSystem struct {
 	emailConfig     EmailConfig
 	smsConfig       SMSConfig
 	pushConfig      PushConfig
+	smsProvider     NotificationProvider
+	fcmProvider     NotificationProvider
+	apnsProvider    NotificationProvider
 	templates       map[string]*template.Template
-	queue           chan Notification
+	wake            chan struct{}
+	quit            chan struct{}
 	workers         int
 	wg              sync.WaitGroup
 }
@@ -40,16 +43,22 @@ type EmailConfig struct {
 }
 
 type SMSConfig struct {
-	Provider    string // twilio, nexmo, etc.
+	Provider    string // twilio or any Twilio-compatible API
+	BaseURL     string // override to point at a local mock
 	AccountSID  string
 	AuthToken   string
 	FromNumber  string
 }
 
 type PushConfig struct {
-	FCMServerKey string
-	APNSCert     string
-	APNSKey      string
+	FCMBaseURL         string
+	FCMProjectID       string
+	FCMCredentialsFile string // service account JSON
+	FCMAccessToken     string // static bearer token, mainly for mocks
+	APNSBaseURL        string
+	APNSTopic          string // app bundle ID
+	APNSCert           string
+	APNSKey            string
 }
 
 // Notification models
@@ -104,6 +113,10 @@ const (
 	NotifyScheduleReminder   = "schedule_reminder"
 	NotifySystemAlert        = "system_alert"
 	NotifyReportReady        = "report_ready"
+	NotifyCredentialExpiring = "credential_expiring"
+	NotifyRidershipAlert     = "ridership_alert"
+	NotifyStudentRidership   = "student_ridership"
+	NotifyPartsReorder       = "parts_reorder"
 )
 
 // NewNotificationSystem creates a new notification system
@@ -114,19 +127,24 @@ func NewNotificationSystem(db *sql.DB, emailConfig EmailConfig, smsConfig SMSCon
 		smsConfig:   smsConfig,
 		pushConfig:  pushConfig,
 		templates:   make(map[string]*template.Template),
-		queue:       make(chan Notification, 1000),
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
 		workers:     5,
 	}
 
+	// Outbox columns on the notification tables
+	ns.ensureOutboxSchema()
+
+	// Set up SMS and push providers
+	ns.configureProviders()
+
 	// Load notification templates
 	ns.loadTemplates()
 
-	// Start notification workers
+	// Start outbox workers; scheduled notifications are deliveries
+	// whose first attempt is in the future
 	ns.startWorkers()
 
-	// Start scheduled notification checker
-	go ns.processScheduledNotifications()
-
 	return ns
 }
 
@@ -145,77 +163,17 @@ func (ns *NotificationSystem) Send(notification Notification) error {
 	// Set creation time
 	notification.CreatedAt = time.Now()
 
-	// Store in database
-	if err := ns.storeNotification(notification); err != nil {
-		log.Printf("Failed to store notification: %v", err)
-	}
-
-	// Add to queue for processing
-	select {
-	case ns.queue <- notification:
+	// Write the notification and one outbox row per delivery
+	deliveries := ns.expandDeliveries(notification)
+	if err := ns.persist(notification, deliveries); err != nil {
+		// Without the outbox there are no retries, but still try once
+		log.Printf("Failed to queue notification %s, sending directly: %v", notification.ID, err)
+		go ns.deliverDirect(notification)
 		return nil
-	default:
-		return fmt.Errorf("notification queue full")
-	}
-}
-
-// Process notification
-func (ns *NotificationSystem) processNotification(notification Notification) {
-	log.Printf("Processing notification %s: %s", notification.ID, notification.Subject)
-
-	// Check if scheduled for later
-	if notification.ScheduledAt != nil && notification.ScheduledAt.After(time.Now()) {
-		return // Will be processed by scheduled checker
-	}
-
-	// Process each recipient
-	var wg sync.WaitGroup
-	for _, recipient := range notification.Recipients {
-		wg.Add(1)
-		go func(r Recipient) {
-			defer wg.Done()
-			ns.sendToRecipient(notification, r)
-		}(recipient)
 	}
-	wg.Wait()
 
-	// Update notification status
-	ns.updateNotificationStatus(notification.ID, "sent")
-}
-
-// Send to individual recipient
-func (ns *NotificationSystem) sendToRecipient(notification Notification, recipient Recipient) {
-	// Check quiet hours
-	if ns.isQuietHours(recipient.Preferences.Quiet) && notification.Priority != "high" {
-		log.Printf("Skipping notification for %s due to quiet hours", recipient.Username)
-		return
-	}
-
-	// Check notification type preferences
-	if prefs, ok := recipient.Preferences.Types[notification.Type]; ok && !prefs {
-		log.Printf("User %s has disabled %s notifications", recipient.Username, notification.Type)
-		return
-	}
-
-	// Send via requested channels
-	for _, channel := range notification.Channels {
-		switch channel {
-		case "email":
-			if recipient.Preferences.Email && recipient.Email != "" {
-				ns.sendEmail(notification, recipient)
-			}
-		case "sms":
-			if recipient.Preferences.SMS && recipient.Phone != "" {
-				ns.sendSMS(notification, recipient)
-			}
-		case "push":
-			if recipient.Preferences.Push && len(recipient.DeviceTokens) > 0 {
-				ns.sendPush(notification, recipient)
-			}
-		case "in-app":
-			ns.sendInApp(notification, recipient)
-		}
-	}
+	ns.wakeWorkers()
+	return nil
 }
 
 // Send email notification
@@ -260,99 +218,64 @@ func (ns *NotificationSystem) sendEmail(notification Notification, recipient Rec
 	}
 
 	log.Printf("Email sent to %s: %s", to, subject)
-	ns.recordDelivery(notification.ID, recipient.UserID, "email", "sent")
 	return nil
 }
 
-// Send SMS notification
-func (ns *NotificationSystem) sendSMS(notification Notification, recipient Recipient) error {
-	// Format phone number
-	phone := ns.formatPhoneNumber(recipient.Phone)
-	
+// Send SMS notification to a formatted phone number
+func (ns *NotificationSystem) sendSMS(notification Notification, phone string) DeliveryResult {
 	// Prepare SMS content (limit to 160 chars)
 	message := notification.Message
 	if len(message) > 160 {
 		message = message[:157] + "..."
 	}
 
-	// Send via provider (example with Twilio-like API)
-	payload := map[string]string{
-		"From": ns.smsConfig.FromNumber,
-		"To":   phone,
-		"Body": message,
-	}
-
-	// This would actually call the SMS provider's API
-	_ = payload // Avoid unused variable error
-	log.Printf("SMS sent to %s: %s", phone, message)
-	ns.recordDelivery(notification.ID, recipient.UserID, "sms", "sent")
-	return nil
-}
-
-// Send push notification
-func (ns *NotificationSystem) sendPush(notification Notification, recipient Recipient) error {
-	// Prepare push notification payload
-	payload := map[string]interface{}{
-		"notification": map[string]interface{}{
-			"title": notification.Subject,
-			"body":  notification.Message,
-			"sound": "default",
-			"badge": 1,
-		},
-		"data": notification.Data,
-		"priority": notification.Priority,
+	if ns.smsProvider == nil {
+		return DeliveryResult{Recipient: phone, Err: fmt.Errorf("SMS %w", errProviderNotConfigured)}
 	}
 
-	// Send to each device token
-	for _, token := range recipient.DeviceTokens {
-		// Determine platform (iOS/Android) based on token format
-		if strings.HasPrefix(token, "ios:") {
-			ns.sendAPNS(token[4:], payload)
-		} else {
-			ns.sendFCM(token, payload)
-		}
+	result := deliverOnce(ns.smsProvider, ProviderMessage{
+		To:       phone,
+		Body:     message,
+		Priority: notification.Priority,
+	})
+	if result.Err == nil {
+		log.Printf("SMS sent to %s (%s)", maskAddress(phone), result.MessageID)
 	}
-
-	ns.recordDelivery(notification.ID, recipient.UserID, "push", "sent")
-	return nil
+	return result
 }
 
-// Send FCM (Android) push notification
-func (ns *NotificationSystem) sendFCM(token string, payload map[string]interface{}) error {
-	// Prepare FCM request
-	fcmPayload := map[string]interface{}{
-		"to":   token,
-		"data": payload,
+// Send push notification to one device token.
+// Tokens prefixed with "ios:" go to APNS, everything else to FCM.
+func (ns *NotificationSystem) sendPush(notification Notification, token string) DeliveryResult {
+	provider := ns.fcmProvider
+	if strings.HasPrefix(token, "ios:") {
+		token = token[4:]
+		provider = ns.apnsProvider
+	}
+	if provider == nil {
+		return DeliveryResult{Recipient: token, Err: fmt.Errorf("push %w", errProviderNotConfigured)}
 	}
 
-	jsonPayload, _ := json.Marshal(fcmPayload)
-
-	// Send to FCM
-	req, _ := http.NewRequest("POST", "https://fcm.googleapis.com/fcm/send", bytes.NewReader(jsonPayload))
-	req.Header.Set("Authorization", "key="+ns.pushConfig.FCMServerKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	// This would actually send the request
-	log.Printf("FCM notification sent to token: %s", token[:10]+"...")
-	return nil
-}
-
-// Send APNS (iOS) push notification
-func (ns *NotificationSystem) sendAPNS(token string, payload map[string]interface{}) error {
-	// This would use APNS HTTP/2 API
-	log.Printf("APNS notification sent to token: %s", token[:10]+"...")
-	return nil
+	return deliverOnce(provider, ProviderMessage{
+		To:       token,
+		Title:    notification.Subject,
+		Body:     notification.Message,
+		Data:     stringifyData(notification.Data),
+		Priority: notification.Priority,
+	})
 }
 
 // Send in-app notification
 func (ns *NotificationSystem) sendInApp(notification Notification, recipient Recipient) error {
-	// Store in-app notification
+	// Store in-app notification; a retried delivery must not duplicate it
+	dataJSON, _ := json.Marshal(notification.Data)
 	_, err := ns.db.Exec(`
 		INSERT INTO in_app_notifications 
 		(user_id, notification_id, type, subject, message, data, read, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6, false, $7)
-	`, recipient.UserID, notification.ID, notification.Type, notification.Subject,
-	   notification.Message, notification.Data, notification.CreatedAt)
+		ON CONFLICT (user_id, notification_id) DO NOTHING
+	`, recipient.Username, notification.ID, notification.Type, notification.Subject,
+	   notification.Message, dataJSON, notification.CreatedAt)
 
 	if err != nil {
 		log.Printf("Failed to store in-app notification: %v", err)
@@ -378,7 +301,6 @@ func (ns *NotificationSystem) sendInApp(notification Notification, recipient Rec
 		wsHub.mu.RUnlock()
 	}
 
-	ns.recordDelivery(notification.ID, recipient.UserID, "in-app", "delivered")
 	return nil
 }
 
@@ -438,46 +360,22 @@ func (ns *NotificationSystem) formatPhoneNumber(phone string) string {
 
 // Database operations
 
-func (ns *NotificationSystem) storeNotification(n Notification) error {
+func storeNotificationTx(tx *sql.Tx, n Notification) error {
 	dataJSON, _ := json.Marshal(n.Data)
 	recipientsJSON, _ := json.Marshal(n.Recipients)
 	channelsJSON, _ := json.Marshal(n.Channels)
 
-	_, err := ns.db.Exec(`
+	_, err := tx.Exec(`
 		INSERT INTO notifications 
-		(id, type, priority, subject, message, data, recipients, channels, 
+		(id, type, priority, title, subject, message, data, recipients, channels, 
 		 scheduled_at, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'pending', $10)
+		VALUES ($1, $2, $3, $4, $4, $5, $6, $7, $8, $9, 'pending', $10)
 	`, n.ID, n.Type, n.Priority, n.Subject, n.Message, dataJSON, 
 	   recipientsJSON, channelsJSON, n.ScheduledAt, n.CreatedAt)
 
 	return err
 }
 
-func (ns *NotificationSystem) updateNotificationStatus(id, status string) {
-	_, err := ns.db.Exec(`
-		UPDATE notifications 
-		SET status = $1, updated_at = CURRENT_TIMESTAMP 
-		WHERE id = $2
-	`, status, id)
-	
-	if err != nil {
-		log.Printf("Failed to update notification status: %v", err)
-	}
-}
-
-func (ns *NotificationSystem) recordDelivery(notificationID, userID, channel, status string) {
-	_, err := ns.db.Exec(`
-		INSERT INTO notification_deliveries 
-		(notification_id, user_id, channel, status, delivered_at)
-		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
-	`, notificationID, userID, channel, status)
-	
-	if err != nil {
-		log.Printf("Failed to record delivery: %v", err)
-	}
-}
-
 // Worker management
 
 func (ns *NotificationSystem) startWorkers() {
@@ -487,71 +385,11 @@ func (ns *NotificationSystem) startWorkers() {
 	}
 }
 
-func (ns *NotificationSystem) worker(id int) {
-	defer ns.wg.Done()
-	log.Printf("Notification worker %d started", id)
-
-	for notification := range ns.queue {
-		ns.processNotification(notification)
-	}
-}
-
 func (ns *NotificationSystem) Stop() {
-	close(ns.queue)
+	close(ns.quit)
 	ns.wg.Wait()
 }
 
-// Scheduled notifications
-
-func (ns *NotificationSystem) processScheduledNotifications() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			ns.checkScheduledNotifications()
-		}
-	}
-}
-
-func (ns *NotificationSystem) checkScheduledNotifications() {
-	rows, err := ns.db.Query(`
-		SELECT id, type, priority, subject, message, data, recipients, channels
-		FROM notifications
-		WHERE status = 'pending'
-		AND scheduled_at <= CURRENT_TIMESTAMP
-		LIMIT 10
-	`)
-	if err != nil {
-		log.Printf("Failed to check scheduled notifications: %v", err)
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var n Notification
-		var dataJSON, recipientsJSON, channelsJSON []byte
-		
-		err := rows.Scan(&n.ID, &n.Type, &n.Priority, &n.Subject, &n.Message,
-						 &dataJSON, &recipientsJSON, &channelsJSON)
-		if err != nil {
-			continue
-		}
-
-		json.Unmarshal(dataJSON, &n.Data)
-		json.Unmarshal(recipientsJSON, &n.Recipients)
-		json.Unmarshal(channelsJSON, &n.Channels)
-
-		// Add to processing queue
-		select {
-		case ns.queue <- n:
-		default:
-			log.Printf("Queue full, skipping scheduled notification %s", n.ID)
-		}
-	}
-}
-
 // Template management
 
 func (ns *NotificationSystem) loadTemplates() {
@@ -588,17 +426,22 @@ func (ns *NotificationSystem) loadTemplates() {
 
 // Notification builders
 
-func BuildMaintenanceNotification(vehicle Vehicle, dueDate time.Time) Notification {
+func BuildMaintenanceNotification(due PMDue) Notification {
+	priority := "medium"
+	if due.Status == PMStatusOverdue {
+		priority = "high"
+	}
 	return Notification{
 		Type:     NotifyMaintenanceDue,
-		Priority: "medium",
-		Subject:  fmt.Sprintf("Maintenance Due: %s", vehicle.Model),
-		Message: fmt.Sprintf("Vehicle %s (%s) is due for maintenance on %s. Current mileage: %d",
-			vehicle.VehicleID, vehicle.Model, dueDate.Format("Jan 2, 2006"), vehicle.CurrentMileage),
+		Priority: priority,
+		Subject:  fmt.Sprintf("Maintenance Due: %s on %s", due.Program.Name, due.Vehicle.VehicleID),
+		Message: fmt.Sprintf("Vehicle %s: %s. Current mileage: %d",
+			due.Vehicle.VehicleID, due.Message(), due.Vehicle.CurrentMileage),
 		Data: map[string]interface{}{
-			"vehicle_id": vehicle.VehicleID,
-			"due_date":   dueDate,
-			"mileage":    vehicle.CurrentMileage,
+			"vehicle_id": due.Vehicle.VehicleID,
+			"program":    due.Program.Name,
+			"due_by":     due.DueBy,
+			"mileage":    due.Vehicle.CurrentMileage,
 		},
 		Channels: []string{"email", "push", "in-app"},
 	}
@@ -630,27 +473,43 @@ func BuildEmergencyNotification(driver, message string, location *LocationUpdate
 // Initialize notification system
 var notificationSystem *NotificationSystem
 
-func InitializeNotificationSystem() {
-	emailConfig := EmailConfig{
+// emailConfigFromEnv reads the SMTP settings shared by notifications and
+// scheduled exports.
+func emailConfigFromEnv() EmailConfig {
+	fromName := os.Getenv("SMTP_FROM_NAME")
+	if fromName == "" {
+		fromName = "Fleet Management System"
+	}
+	return EmailConfig{
 		SMTPHost:    os.Getenv("SMTP_HOST"),
 		SMTPPort:    os.Getenv("SMTP_PORT"),
 		Username:    os.Getenv("SMTP_USERNAME"),
 		Password:    os.Getenv("SMTP_PASSWORD"),
 		FromAddress: os.Getenv("SMTP_FROM_ADDRESS"),
-		FromName:    "Fleet Management System",
+		FromName:    fromName,
 	}
+}
+
+func InitializeNotificationSystem() {
+	emailConfig := emailConfigFromEnv()
 
 	smsConfig := SMSConfig{
 		Provider:   os.Getenv("SMS_PROVIDER"),
+		BaseURL:    os.Getenv("SMS_BASE_URL"),
 		AccountSID: os.Getenv("SMS_ACCOUNT_SID"),
 		AuthToken:  os.Getenv("SMS_AUTH_TOKEN"),
 		FromNumber: os.Getenv("SMS_FROM_NUMBER"),
 	}
 
 	pushConfig := PushConfig{
-		FCMServerKey: os.Getenv("FCM_SERVER_KEY"),
-		APNSCert:     os.Getenv("APNS_CERT_PATH"),
-		APNSKey:      os.Getenv("APNS_KEY_PATH"),
+		FCMBaseURL:         os.Getenv("FCM_BASE_URL"),
+		FCMProjectID:       os.Getenv("FCM_PROJECT_ID"),
+		FCMCredentialsFile: os.Getenv("FCM_CREDENTIALS_FILE"),
+		FCMAccessToken:     os.Getenv("FCM_ACCESS_TOKEN"),
+		APNSBaseURL:        os.Getenv("APNS_BASE_URL"),
+		APNSTopic:          os.Getenv("APNS_TOPIC"),
+		APNSCert:           os.Getenv("APNS_CERT_PATH"),
+		APNSKey:            os.Getenv("APNS_KEY_PATH"),
 	}
 
 	notificationSystem = NewNotificationSystem(db.DB, emailConfig, smsConfig, pushConfig)
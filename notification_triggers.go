@@ -19,20 +19,21 @@ func NewNotificationTriggers(system *NotificationSystem) *NotificationTriggers {
 	}
 }
 
-// TriggerMaintenanceDueNotifications checks for vehicles due for maintenance
+// TriggerMaintenanceDueNotifications tells managers, and a bus's drivers,
+// about every PM service that has come due
 func (nt *NotificationTriggers) TriggerMaintenanceDueNotifications() {
-	// Check for oil changes due
-	oilDueVehicles, err := getVehiclesDueForOilChange(7) // 7 days notice
+	due, err := loadPMDueList(db)
 	if err != nil {
-		log.Printf("Error checking oil due vehicles: %v", err)
+		log.Printf("Error checking PM due list: %v", err)
 		return
 	}
 
-	for _, vehicle := range oilDueVehicles {
-		notification := BuildMaintenanceNotification(vehicle, time.Now().AddDate(0, 0, 7))
-		notification.Message = fmt.Sprintf("Vehicle %s is due for an oil change. Current mileage: %d, Last oil change: %d miles",
-			vehicle.VehicleID, vehicle.CurrentMileage, vehicle.LastOilChange)
-		
+	for _, d := range due {
+		if d.Status == PMStatusOK {
+			continue
+		}
+		notification := BuildMaintenanceNotification(d)
+
 		// Get managers to notify
 		recipients, err := nt.getManagerRecipients()
 		if err != nil {
@@ -41,7 +42,7 @@ func (nt *NotificationTriggers) TriggerMaintenanceDueNotifications() {
 		}
 		
 		// Also notify assigned drivers for this vehicle
-		drivers, err := nt.getDriversForVehicle(vehicle.VehicleID)
+		drivers, err := nt.getDriversForVehicle(d.Vehicle.VehicleID)
 		if err == nil && len(drivers) > 0 {
 			recipients = append(recipients, drivers...)
 		}
@@ -52,31 +53,6 @@ func (nt *NotificationTriggers) TriggerMaintenanceDueNotifications() {
 			log.Printf("Failed to send maintenance notification: %v", err)
 		}
 	}
-
-	// Check for tire service due
-	tireDueVehicles, err := getVehiclesDueForTireService(14) // 14 days notice
-	if err != nil {
-		log.Printf("Error checking tire due vehicles: %v", err)
-		return
-	}
-
-	for _, vehicle := range tireDueVehicles {
-		notification := BuildMaintenanceNotification(vehicle, time.Now().AddDate(0, 0, 14))
-		notification.Message = fmt.Sprintf("Vehicle %s is due for tire service. Current mileage: %d, Last tire service: %d miles",
-			vehicle.VehicleID, vehicle.CurrentMileage, vehicle.LastTireService)
-		
-		recipients, err := nt.getManagerRecipients()
-		if err != nil {
-			log.Printf("Error getting recipients: %v", err)
-			continue
-		}
-		
-		notification.Recipients = recipients
-		
-		if err := nt.system.Send(notification); err != nil {
-			log.Printf("Failed to send tire service notification: %v", err)
-		}
-	}
 }
 
 // TriggerAttendanceIssueNotifications checks for student attendance issues
@@ -88,7 +64,14 @@ func (nt *NotificationTriggers) TriggerAttendanceIssueNotifications() {
 		return
 	}
 
+	// An absence on a day the route doesn't run isn't an issue
+	today := time.Now()
+	cal := serviceCalendarFor(today, today)
+
 	for _, student := range absentStudents {
+		if !cal.RouteDay(student.RouteID, today).Running() {
+			continue
+		}
 		notification := Notification{
 			Type:     NotifyAttendanceIssue,
 			Priority: "medium",
@@ -223,13 +206,19 @@ func (nt *NotificationTriggers) TriggerDailyReminderNotifications() {
 		return
 	}
 
+	cal := serviceCalendarFor(tomorrow, tomorrow)
+
 	for _, assignment := range driversWithRoutes {
+		message := fmt.Sprintf("Reminder: You are scheduled to drive route %s with bus %s tomorrow",
+			assignment.RouteID, assignment.BusID)
+		if note := cal.RouteDay(assignment.RouteID, tomorrow).Note(); note != "" {
+			message += ". " + note
+		}
 		notification := Notification{
 			Type:     NotifyScheduleReminder,
 			Priority: "low",
 			Subject:  "Tomorrow's Route Reminder",
-			Message: fmt.Sprintf("Reminder: You are scheduled to drive route %s with bus %s tomorrow",
-				assignment.RouteID, assignment.BusID),
+			Message:  message,
 			Data: map[string]interface{}{
 				"date":     tomorrow.Format("2006-01-02"),
 				"route_id": assignment.RouteID,
@@ -304,6 +293,216 @@ func (nt *NotificationTriggers) TriggerEmergencyNotification(driver, message str
 	}
 }
 
+// TriggerCredentialExpiryNotifications reminds drivers and managers about
+// licences and certifications that are about to lapse, weekly until renewed
+func (nt *NotificationTriggers) TriggerCredentialExpiryNotifications() {
+	due, err := getCredentialsDueForReminder()
+	if err != nil {
+		log.Printf("Error checking expiring credentials: %v", err)
+		return
+	}
+
+	managers, err := nt.getManagerRecipients()
+	if err != nil {
+		log.Printf("Error getting recipients: %v", err)
+		return
+	}
+
+	for _, credential := range due {
+		label := credentialLabel(credential.CredentialType)
+		expires := credential.ExpiresOn.Format("Jan 2, 2006")
+
+		priority := "medium"
+		subject := fmt.Sprintf("%s Expiring: %s", label, credential.Username)
+		message := fmt.Sprintf("%s's %s expires on %s. Upload the renewed document before then to keep them assignable.",
+			credential.Username, label, expires)
+		if credential.ExpiresOn.Before(time.Now().Truncate(24 * time.Hour)) {
+			priority = "high"
+			subject = fmt.Sprintf("%s Expired: %s", label, credential.Username)
+			message = fmt.Sprintf("%s's %s expired on %s. They can't be assigned to routes that need it until it's renewed.",
+				credential.Username, label, expires)
+		}
+
+		recipients := append([]Recipient{}, managers...)
+		if driver, err := nt.getUserRecipient(credential.Username); err == nil {
+			recipients = append(recipients, driver)
+		}
+
+		notification := Notification{
+			Type:     NotifyCredentialExpiring,
+			Priority: priority,
+			Subject:  subject,
+			Message:  message,
+			Data: map[string]interface{}{
+				"driver":     credential.Username,
+				"credential": credential.CredentialType,
+				"expires_on": credential.ExpiresOn.Format("2006-01-02"),
+			},
+			Channels:   []string{"email", "in-app"},
+			Recipients: recipients,
+		}
+
+		if err := nt.system.Send(notification); err != nil {
+			log.Printf("Failed to send credential expiry notification: %v", err)
+			continue
+		}
+		if err := markCredentialReminded(credential.ID); err != nil {
+			log.Printf("Error marking credential %d reminded: %v", credential.ID, err)
+		}
+	}
+}
+
+// TriggerClosureNotifications tells the drivers, managers and parents of
+// every route a closure affects that there's no service that day
+func (nt *NotificationTriggers) TriggerClosureNotifications(day CalendarDay, place string) {
+	query := `SELECT DISTINCT ra.driver FROM route_assignments ra JOIN routes r ON r.route_id = ra.route_id`
+	studentQuery := `SELECT s.student_id FROM students s JOIN routes r ON r.route_id = s.route_id WHERE s.active`
+	args := []interface{}{}
+	if day.SchoolID != 0 {
+		query += ` WHERE r.school_id = $1`
+		studentQuery += ` AND r.school_id = $1`
+		args = append(args, day.SchoolID)
+	}
+
+	var drivers, students []string
+	if err := db.Select(&drivers, query, args...); err != nil {
+		log.Printf("Error getting drivers for closure: %v", err)
+		return
+	}
+	if err := db.Select(&students, studentQuery, args...); err != nil {
+		log.Printf("Error getting students for closure: %v", err)
+		return
+	}
+
+	date := day.Date.Format("Monday, January 2")
+	subject := fmt.Sprintf("No bus service %s", date)
+	message := fmt.Sprintf("%s is closed on %s", place, date)
+	if day.Name != "" {
+		message += " (" + day.Name + ")"
+	}
+	message += ". There will be no bus service that day."
+
+	recipients, err := nt.getManagerRecipients()
+	if err != nil {
+		log.Printf("Error getting recipients: %v", err)
+	}
+	for _, driver := range drivers {
+		if recipient, err := nt.getUserRecipient(driver); err == nil {
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(recipients) > 0 {
+		notification := Notification{
+			Type:     NotifyRouteChange,
+			Priority: "high",
+			Subject:  subject,
+			Message:  message,
+			Data: map[string]interface{}{
+				"date":      day.Date.Format("2006-01-02"),
+				"school_id": day.SchoolID,
+				"closure":   day.Name,
+			},
+			Channels:   []string{"email", "sms", "push", "in-app"},
+			Recipients: recipients,
+		}
+		if err := nt.system.Send(notification); err != nil {
+			log.Printf("Failed to send closure notification: %v", err)
+		}
+	}
+
+	notifyParents(parentNotice{
+		StudentIDs: students,
+		Type:       "closure",
+		Title:      subject,
+		Message:    message,
+		Kind:       NotifyRouteChange,
+		Priority:   "high",
+		Wants:      func(s NotificationSettings) bool { return s.Emergency || s.RouteChanges },
+	})
+	log.Printf("Closure on %s announced to %d staff and the parents of %d students",
+		day.Date.Format("2006-01-02"), len(recipients), len(students))
+}
+
+// TriggerWorkOrderAssignedNotification tells a mechanic they've been
+// given a work order
+func (nt *NotificationTriggers) TriggerWorkOrderAssignedNotification(order WorkOrder) {
+	if !order.AssignedTo.Valid {
+		return
+	}
+	recipient, err := nt.getUserRecipient(order.AssignedTo.String)
+	if err != nil {
+		log.Printf("Error getting recipient for work order %d: %v", order.ID, err)
+		return
+	}
+
+	message := fmt.Sprintf("Work order #%d on vehicle %s: %s (%s priority)", order.ID, order.VehicleID, order.Title, order.Priority)
+	if order.Hold {
+		message += ". The vehicle is held out of service until the repair passes inspection."
+	}
+	priority := "medium"
+	switch order.Priority {
+	case "high", "critical":
+		priority = "high"
+	case "low":
+		priority = "low"
+	}
+	notification := Notification{
+		Type:     NotifyVehicleIssue,
+		Priority: priority,
+		Subject:  fmt.Sprintf("Work order #%d assigned to you", order.ID),
+		Message:  message,
+		Data: map[string]interface{}{
+			"work_order_id": order.ID,
+			"vehicle_id":    order.VehicleID,
+		},
+		Channels:   []string{"email", "push", "in-app"},
+		Recipients: []Recipient{recipient},
+	}
+	if err := nt.system.Send(notification); err != nil {
+		log.Printf("Failed to send work order notification: %v", err)
+	}
+}
+
+// TriggerPartReorderNotification tells managers a stock location has run
+// down to a part's reorder point
+func (nt *NotificationTriggers) TriggerPartReorderNotification(level StockLevel) {
+	recipients, err := nt.getManagerRecipients()
+	if err != nil {
+		log.Printf("Error getting recipients for reorder alert: %v", err)
+		return
+	}
+
+	message := fmt.Sprintf("%s (%s) is down to %g at %s; its reorder point is %g.",
+		level.Name, level.PartNumber, level.OnHand, level.Location, level.ReorderPoint)
+	if level.ReorderQuantity > 0 {
+		message += fmt.Sprintf(" Order %g", level.ReorderQuantity)
+		if level.Vendor.Valid {
+			message += " from " + level.Vendor.String
+		}
+		message += "."
+	}
+	priority := "medium"
+	if level.OnHand == 0 {
+		priority = "high"
+	}
+	notification := Notification{
+		Type:     NotifyPartsReorder,
+		Priority: priority,
+		Subject:  fmt.Sprintf("Reorder %s at %s", level.PartNumber, level.Location),
+		Message:  message,
+		Data: map[string]interface{}{
+			"part_id":     level.PartID,
+			"location_id": level.LocationID,
+			"on_hand":     level.OnHand,
+		},
+		Channels:   []string{"email", "in-app"},
+		Recipients: recipients,
+	}
+	if err := nt.system.Send(notification); err != nil {
+		log.Printf("Failed to send reorder notification: %v", err)
+	}
+}
+
 // Helper methods to get recipients
 
 func (nt *NotificationTriggers) getManagerRecipients() ([]Recipient, error) {
@@ -461,76 +660,6 @@ func getVehicleByID(vehicleID string) (*Vehicle, error) {
 	return &vehicle, nil
 }
 
-func getVehiclesDueForOilChange(daysNotice int) ([]Vehicle, error) {
-	var vehicles []Vehicle
-	
-	// Check vehicles where current mileage exceeds last oil change by threshold
-	rows, err := db.Query(`
-		SELECT vehicle_id, COALESCE(model, ''), COALESCE(description, ''), 
-			   COALESCE(current_mileage, 0), COALESCE(last_oil_change, 0)
-		FROM vehicles
-		WHERE status = 'active'
-		AND current_mileage - last_oil_change >= 4500  -- 5000 mile interval with 500 mile buffer
-		UNION
-		SELECT bus_id as vehicle_id, COALESCE(model, ''), '' as description,
-			   COALESCE(current_mileage, 0), COALESCE(last_oil_change, 0)
-		FROM buses
-		WHERE status = 'active'
-		AND current_mileage - last_oil_change >= 4500
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var v Vehicle
-		err := rows.Scan(&v.VehicleID, &v.Model, &v.Description, 
-			&v.CurrentMileage, &v.LastOilChange)
-		if err != nil {
-			continue
-		}
-		vehicles = append(vehicles, v)
-	}
-
-	return vehicles, nil
-}
-
-func getVehiclesDueForTireService(daysNotice int) ([]Vehicle, error) {
-	var vehicles []Vehicle
-	
-	// Check vehicles where current mileage exceeds last tire service by threshold
-	rows, err := db.Query(`
-		SELECT vehicle_id, COALESCE(model, ''), COALESCE(description, ''),
-			   COALESCE(current_mileage, 0), COALESCE(last_tire_service, 0)
-		FROM vehicles
-		WHERE status = 'active'
-		AND current_mileage - last_tire_service >= 19000  -- 20000 mile interval with 1000 mile buffer
-		UNION
-		SELECT bus_id as vehicle_id, COALESCE(model, ''), '' as description,
-			   COALESCE(current_mileage, 0), COALESCE(last_tire_service, 0)
-		FROM buses
-		WHERE status = 'active'
-		AND current_mileage - last_tire_service >= 19000
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var v Vehicle
-		err := rows.Scan(&v.VehicleID, &v.Model, &v.Description,
-			&v.CurrentMileage, &v.LastTireService)
-		if err != nil {
-			continue
-		}
-		vehicles = append(vehicles, v)
-	}
-
-	return vehicles, nil
-}
-
 func getAbsentStudentsToday() ([]Student, error) {
 	var students []Student
 	
@@ -538,10 +667,15 @@ func getAbsentStudentsToday() ([]Student, error) {
 	rows, err := db.Query(`
 		SELECT s.student_id, s.name, COALESCE(s.route_id, '')
 		FROM students s
-		JOIN student_attendance sa ON s.student_id = sa.student_id
-		WHERE sa.date = $1
-		AND sa.present = false
-		AND s.active = true
+		WHERE s.active = true
+		AND EXISTS (
+			SELECT 1 FROM attendance_ledger al
+			WHERE al.student_id = s.student_id AND al.date = $1 AND al.status = 'absent'
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM attendance_ledger al
+			WHERE al.student_id = s.student_id AND al.date = $1 AND al.status IN ('present', 'late')
+		)
 	`, today)
 	if err != nil {
 		return nil, err
@@ -560,8 +694,14 @@ func getAbsentStudentsToday() ([]Student, error) {
 	return students, nil
 }
 
+// getDriversWithRoutesForDate lists the assignments whose routes run on
+// the date, going by the school calendar
 func getDriversWithRoutesForDate(date time.Time) ([]RouteAssignment, error) {
 	var assignments []RouteAssignment
+	cal, err := loadServiceCalendar(date, date)
+	if err != nil {
+		return nil, err
+	}
 	
 	rows, err := db.Query(`
 		SELECT driver, bus_id, route_id
@@ -577,7 +717,7 @@ func getDriversWithRoutesForDate(date time.Time) ([]RouteAssignment, error) {
 	for rows.Next() {
 		var a RouteAssignment
 		err := rows.Scan(&a.Driver, &a.BusID, &a.RouteID)
-		if err != nil {
+		if err != nil || !cal.RouteDay(a.RouteID, date).Running() {
 			continue
 		}
 		assignments = append(assignments, a)
@@ -611,12 +751,21 @@ func runScheduledNotificationTriggers() {
 		notificationTriggers.TriggerMaintenanceDueNotifications()
 	})
 
+	// Daily credential expiry check at 7 AM
+	go scheduleDaily(7, 0, func() {
+		log.Println("Running credential expiry notifications")
+		notificationTriggers.TriggerCredentialExpiryNotifications()
+	})
+
 	// Daily attendance check at 10 AM
 	go scheduleDaily(10, 0, func() {
 		log.Println("Running daily attendance notifications")
 		notificationTriggers.TriggerAttendanceIssueNotifications()
 	})
 
+	// Students expected on a bus with a card reader but not scanned
+	go watchMissedScans()
+
 	// Daily reminders at 6 PM
 	go scheduleDaily(18, 0, func() {
 		log.Println("Running daily reminder notifications")
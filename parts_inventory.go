@@ -0,0 +1,520 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of stock movement. Quantities are signed: receipts and returns
+// add to a location, consumption takes away, and adjustments and
+// transfers go either way.
+const (
+	PartReceive  = "receive"
+	PartConsume  = "consume"
+	PartReturn   = "return"
+	PartAdjust   = "adjust"
+	PartTransfer = "transfer"
+)
+
+// inventoryError is a stock change that can't be made, worded for the
+// person who tried it
+type inventoryError string
+
+func (e inventoryError) Error() string { return string(e) }
+
+// Part is an entry in the parts catalog
+type Part struct {
+	ID         int            `db:"id"`
+	PartNumber string         `db:"part_number"`
+	Name       string         `db:"name"`
+	Vendor     sql.NullString `db:"vendor"`
+	UnitCost   float64        `db:"unit_cost"`
+	Active     bool           `db:"active"`
+	CreatedAt  time.Time      `db:"created_at"`
+	UpdatedAt  time.Time      `db:"updated_at"`
+	Fitments   []PartFitment  `db:"-"`
+}
+
+// FitmentText lists the part's fitments one per line, the way the
+// catalog form takes them
+func (p Part) FitmentText() string {
+	lines := make([]string, len(p.Fitments))
+	for i, f := range p.Fitments {
+		lines[i] = f.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PartFitment is a make, and optionally a model, that a part fits
+type PartFitment struct {
+	PartID int    `db:"part_id"`
+	Make   string `db:"make"`
+	Model  string `db:"model"`
+}
+
+func (f PartFitment) String() string {
+	if f.Model == "" {
+		return f.Make
+	}
+	return f.Make + " / " + f.Model
+}
+
+// parseFitments reads one make per line, optionally followed by a slash
+// and a model
+func parseFitments(text string) []PartFitment {
+	var fitments []PartFitment
+	seen := make(map[PartFitment]bool)
+	for _, line := range strings.Split(text, "\n") {
+		brand, model, _ := strings.Cut(line, "/")
+		f := PartFitment{
+			Make:  truncateString(strings.TrimSpace(brand), 100),
+			Model: truncateString(strings.TrimSpace(model), 100),
+		}
+		if f.Make == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		fitments = append(fitments, f)
+	}
+	return fitments
+}
+
+// fitsModel reports whether a part goes on a vehicle. The fleet only
+// records a model, which usually starts with the make, so both are
+// looked for within it. A part with no fitments fits anything.
+func fitsModel(fitments []PartFitment, vehicleModel string) bool {
+	if len(fitments) == 0 {
+		return true
+	}
+	model := strings.ToLower(vehicleModel)
+	for _, f := range fitments {
+		if strings.Contains(model, strings.ToLower(f.Make)) && strings.Contains(model, strings.ToLower(f.Model)) {
+			return true
+		}
+	}
+	return false
+}
+
+// StockLocation is a stockroom, shop or truck that holds parts
+type StockLocation struct {
+	ID        int       `db:"id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// StockLevel is how much of a part one location holds
+type StockLevel struct {
+	PartID          int            `db:"part_id"`
+	PartNumber      string         `db:"part_number"`
+	Name            string         `db:"name"`
+	Vendor          sql.NullString `db:"vendor"`
+	UnitCost        float64        `db:"unit_cost"`
+	LocationID      int            `db:"location_id"`
+	Location        string         `db:"location"`
+	OnHand          float64        `db:"on_hand"`
+	ReorderPoint    float64        `db:"reorder_point"`
+	ReorderQuantity float64        `db:"reorder_quantity"`
+	Bin             string         `db:"bin"`
+}
+
+// Low reports whether the location is at or below its reorder point
+func (s StockLevel) Low() bool {
+	return s.ReorderPoint > 0 && s.OnHand <= s.ReorderPoint
+}
+
+// Value is what the stock on hand is worth at catalog cost
+func (s StockLevel) Value() float64 {
+	return s.OnHand * s.UnitCost
+}
+
+const stockLevelQuery = `
+	SELECT s.part_id, p.part_number, p.name, p.vendor, p.unit_cost,
+		s.location_id, l.name AS location, s.on_hand, s.reorder_point, s.reorder_quantity, s.bin
+	FROM part_stock s
+	JOIN parts p ON p.id = s.part_id
+	JOIN stock_locations l ON l.id = s.location_id`
+
+// PartMovement is one line in the stock ledger
+type PartMovement struct {
+	ID                  int            `db:"id"`
+	PartID              int            `db:"part_id"`
+	LocationID          int            `db:"location_id"`
+	Movement            string         `db:"movement"`
+	Quantity            float64        `db:"quantity"`
+	UnitCost            float64        `db:"unit_cost"`
+	VehicleID           sql.NullString `db:"vehicle_id"`
+	WorkOrderID         sql.NullInt64  `db:"work_order_id"`
+	WorkOrderLineID     sql.NullInt64  `db:"work_order_line_id"`
+	MaintenanceRecordID sql.NullInt64  `db:"maintenance_record_id"`
+	Notes               string         `db:"notes"`
+	Actor               string         `db:"actor"`
+	CreatedAt           time.Time      `db:"created_at"`
+}
+
+// savePart adds a part to the catalog, or updates it when p.ID is set,
+// and replaces its fitments
+func savePart(p Part) (int, error) {
+	p.PartNumber = strings.TrimSpace(p.PartNumber)
+	p.Name = strings.TrimSpace(p.Name)
+	if p.PartNumber == "" || p.Name == "" {
+		return 0, inventoryError("A part needs a part number and a name")
+	}
+	if p.UnitCost < 0 {
+		return 0, inventoryError("A part's cost can't be negative")
+	}
+
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		var err error
+		if p.ID == 0 {
+			err = tx.Get(&p.ID, `
+				INSERT INTO parts (part_number, name, vendor, unit_cost, active)
+				VALUES ($1, $2, $3, $4, $5)
+				RETURNING id
+			`, p.PartNumber, p.Name, p.Vendor, p.UnitCost, p.Active)
+		} else {
+			var result sql.Result
+			result, err = tx.Exec(`
+				UPDATE parts SET part_number = $2, name = $3, vendor = $4, unit_cost = $5, active = $6,
+					updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1
+			`, p.ID, p.PartNumber, p.Name, p.Vendor, p.UnitCost, p.Active)
+			if err == nil {
+				if n, _ := result.RowsAffected(); n == 0 {
+					return sql.ErrNoRows
+				}
+			}
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
+				return inventoryError("Part number " + p.PartNumber + " is already in the catalog")
+			}
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM part_fitments WHERE part_id = $1`, p.ID); err != nil {
+			return err
+		}
+		for _, f := range p.Fitments {
+			if _, err := tx.Exec(`INSERT INTO part_fitments (part_id, make, model) VALUES ($1, $2, $3)`, p.ID, f.Make, f.Model); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return p.ID, err
+}
+
+// loadParts reads the catalog with each part's fitments
+func loadParts() ([]Part, error) {
+	var parts []Part
+	if err := db.Select(&parts, `SELECT * FROM parts ORDER BY active DESC, part_number`); err != nil {
+		return nil, err
+	}
+	fitments, err := loadPartFitments()
+	if err != nil {
+		return nil, err
+	}
+	for i := range parts {
+		parts[i].Fitments = fitments[parts[i].ID]
+	}
+	return parts, nil
+}
+
+// loadPartFitments maps each part to what it fits
+func loadPartFitments() (map[int][]PartFitment, error) {
+	var fitments []PartFitment
+	if err := db.Select(&fitments, `SELECT * FROM part_fitments ORDER BY part_id, make, model`); err != nil {
+		return nil, err
+	}
+	byPart := make(map[int][]PartFitment)
+	for _, f := range fitments {
+		byPart[f.PartID] = append(byPart[f.PartID], f)
+	}
+	return byPart, nil
+}
+
+// lockStockInTx locks a part's stock row at a location, creating an
+// empty one the first time the part is kept there
+func lockStockInTx(tx *sqlx.Tx, partID, locationID int) (StockLevel, error) {
+	var level StockLevel
+	if _, err := tx.Exec(`
+		INSERT INTO part_stock (part_id, location_id) VALUES ($1, $2)
+		ON CONFLICT (part_id, location_id) DO NOTHING
+	`, partID, locationID); err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			return level, inventoryError("No such part or location")
+		}
+		return level, err
+	}
+	err := tx.Get(&level, stockLevelQuery+` WHERE s.part_id = $1 AND s.location_id = $2 FOR UPDATE OF s`, partID, locationID)
+	return level, err
+}
+
+// moveStockInTx records a movement and applies it to the location's
+// stock. It refuses to take out more than is there. When the movement
+// takes the location down to its reorder point, the new level is
+// returned so the caller can raise the alert once it has committed.
+func moveStockInTx(tx *sqlx.Tx, m PartMovement) (*StockLevel, error) {
+	level, err := lockStockInTx(tx, m.PartID, m.LocationID)
+	if err != nil {
+		return nil, err
+	}
+	after := math.Round((level.OnHand+m.Quantity)*100) / 100
+	if after < 0 {
+		return nil, inventoryError(fmt.Sprintf("Only %g of %s on hand at %s", level.OnHand, level.PartNumber, level.Location))
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE part_stock SET on_hand = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE part_id = $1 AND location_id = $2
+	`, m.PartID, m.LocationID, after); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO part_movements (part_id, location_id, movement, quantity, unit_cost, vehicle_id,
+			work_order_id, work_order_line_id, maintenance_record_id, notes, actor)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, m.PartID, m.LocationID, m.Movement, m.Quantity, m.UnitCost, m.VehicleID,
+		m.WorkOrderID, m.WorkOrderLineID, m.MaintenanceRecordID, m.Notes, m.Actor); err != nil {
+		return nil, err
+	}
+
+	before := level.OnHand
+	level.OnHand = after
+	if m.Quantity < 0 && level.ReorderPoint > 0 && before > level.ReorderPoint && after <= level.ReorderPoint {
+		return &level, nil
+	}
+	return nil, nil
+}
+
+// receiveParts books a delivery into a location. A delivery's cost
+// becomes the part's catalog cost.
+func receiveParts(partID, locationID int, quantity, unitCost float64, actor, notes string) error {
+	if quantity <= 0 {
+		return inventoryError("Enter how many arrived")
+	}
+	return withTransaction(func(tx *sqlx.Tx) error {
+		if unitCost > 0 {
+			if _, err := tx.Exec(`UPDATE parts SET unit_cost = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, partID, unitCost); err != nil {
+				return err
+			}
+		}
+		_, err := moveStockInTx(tx, PartMovement{
+			PartID:     partID,
+			LocationID: locationID,
+			Movement:   PartReceive,
+			Quantity:   quantity,
+			UnitCost:   unitCost,
+			Notes:      notes,
+			Actor:      actor,
+		})
+		return err
+	})
+}
+
+// countStock sets a location's stock to what a physical count found,
+// booking the difference as an adjustment
+func countStock(partID, locationID int, counted float64, actor, notes string) error {
+	if counted < 0 {
+		return inventoryError("A count can't be negative")
+	}
+	var reorder *StockLevel
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		level, err := lockStockInTx(tx, partID, locationID)
+		if err != nil {
+			return err
+		}
+		diff := math.Round((counted-level.OnHand)*100) / 100
+		if diff == 0 {
+			return nil
+		}
+		reorder, err = moveStockInTx(tx, PartMovement{
+			PartID:     partID,
+			LocationID: locationID,
+			Movement:   PartAdjust,
+			Quantity:   diff,
+			UnitCost:   level.UnitCost,
+			Notes:      notes,
+			Actor:      actor,
+		})
+		return err
+	})
+	if err == nil {
+		notifyPartReorder(reorder)
+	}
+	return err
+}
+
+// transferStock moves parts between locations
+func transferStock(partID, fromID, toID int, quantity float64, actor, notes string) error {
+	if quantity <= 0 {
+		return inventoryError("Enter how many to move")
+	}
+	if fromID == toID {
+		return inventoryError("Choose two different locations")
+	}
+	var reorder *StockLevel
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		var err error
+		out := PartMovement{PartID: partID, LocationID: fromID, Movement: PartTransfer, Quantity: -quantity, Notes: notes, Actor: actor}
+		if reorder, err = moveStockInTx(tx, out); err != nil {
+			return err
+		}
+		in := out
+		in.LocationID = toID
+		in.Quantity = quantity
+		_, err = moveStockInTx(tx, in)
+		return err
+	})
+	if err == nil {
+		notifyPartReorder(reorder)
+	}
+	return err
+}
+
+// setReorderLevels sets when a location should reorder a part, how many
+// to order and which bin it lives in
+func setReorderLevels(partID, locationID int, point, quantity float64, bin string) error {
+	if point < 0 || quantity < 0 {
+		return inventoryError("Reorder levels can't be negative")
+	}
+	return withTransaction(func(tx *sqlx.Tx) error {
+		if _, err := lockStockInTx(tx, partID, locationID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE part_stock SET reorder_point = $3, reorder_quantity = $4, bin = $5, updated_at = CURRENT_TIMESTAMP
+			WHERE part_id = $1 AND location_id = $2
+		`, partID, locationID, point, quantity, bin)
+		return err
+	})
+}
+
+// consumePartsOnRecord draws parts from stock for work already in the
+// maintenance log, adding their cost to the record and the budget
+func consumePartsOnRecord(recordID, partID, locationID int, quantity float64, actor string) error {
+	if quantity <= 0 {
+		return inventoryError("Enter how many were used")
+	}
+	var reorder *StockLevel
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		var vehicleID sql.NullString
+		err := tx.Get(&vehicleID, `SELECT vehicle_id FROM maintenance_records WHERE id = $1 FOR UPDATE`, recordID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return inventoryError("No such maintenance record")
+		}
+		if err != nil {
+			return err
+		}
+		var unitCost float64
+		if err := tx.Get(&unitCost, `SELECT unit_cost FROM parts WHERE id = $1`, partID); err != nil {
+			return err
+		}
+
+		reorder, err = moveStockInTx(tx, PartMovement{
+			PartID:              partID,
+			LocationID:          locationID,
+			Movement:            PartConsume,
+			Quantity:            -quantity,
+			UnitCost:            unitCost,
+			VehicleID:           vehicleID,
+			MaintenanceRecordID: sql.NullInt64{Int64: int64(recordID), Valid: true},
+			Actor:               actor,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE maintenance_records SET cost = COALESCE(cost, 0) + $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, recordID, quantity*unitCost)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	notifyPartReorder(reorder)
+	if err := linkMaintenanceExpenseToBudget(recordID); err != nil {
+		log.Printf("Error posting maintenance record %d to the budget: %v", recordID, err)
+	}
+	return nil
+}
+
+// notifyPartReorder tells managers a location has run down to its
+// reorder point
+func notifyPartReorder(level *StockLevel) {
+	if level != nil && notificationTriggers != nil {
+		go notificationTriggers.TriggerPartReorderNotification(*level)
+	}
+}
+
+// StockValuation is what one location's stock is worth
+type StockValuation struct {
+	Location string  `db:"location"`
+	Parts    int     `db:"parts"`
+	Units    float64 `db:"units"`
+	Value    float64 `db:"value"`
+}
+
+// inventoryValuation values each location's stock at catalog cost
+func inventoryValuation() ([]StockValuation, error) {
+	var valuation []StockValuation
+	err := db.Select(&valuation, `
+		SELECT l.name AS location,
+			COUNT(s.part_id) FILTER (WHERE s.on_hand > 0) AS parts,
+			COALESCE(SUM(s.on_hand), 0) AS units,
+			COALESCE(SUM(s.on_hand * p.unit_cost), 0) AS value
+		FROM stock_locations l
+		LEFT JOIN part_stock s ON s.location_id = l.id
+		LEFT JOIN parts p ON p.id = s.part_id
+		GROUP BY l.id, l.name
+		ORDER BY l.name
+	`)
+	return valuation, err
+}
+
+// PartUsage is how much of something was used over a period, net of
+// returns to stock
+type PartUsage struct {
+	Key      string  `db:"key"`
+	Name     string  `db:"name"`
+	Quantity float64 `db:"quantity"`
+	Cost     float64 `db:"cost"`
+	Charged  float64 `db:"charged"`
+}
+
+// partsUsage totals consumption since a date by part and by vehicle.
+// Charged is the part of the cost already on a maintenance record, and
+// so on the maintenance budget; the rest is on orders not yet signed off.
+func partsUsage(since time.Time) (byPart, byVehicle []PartUsage, err error) {
+	const used = `
+		SUM(-m.quantity) AS quantity,
+		SUM(-m.quantity * m.unit_cost) AS cost,
+		COALESCE(SUM(-m.quantity * m.unit_cost) FILTER (WHERE m.maintenance_record_id IS NOT NULL), 0) AS charged
+		FROM part_movements m`
+	if err = db.Select(&byPart, `
+		SELECT p.part_number AS key, p.name, `+used+`
+		JOIN parts p ON p.id = m.part_id
+		WHERE m.movement IN ('consume', 'return') AND m.created_at >= $1
+		GROUP BY p.part_number, p.name
+		HAVING SUM(-m.quantity) <> 0
+		ORDER BY cost DESC
+	`, since); err != nil {
+		return nil, nil, err
+	}
+	err = db.Select(&byVehicle, `
+		SELECT m.vehicle_id AS key, '' AS name, `+used+`
+		WHERE m.movement IN ('consume', 'return') AND m.created_at >= $1 AND m.vehicle_id IS NOT NULL
+		GROUP BY m.vehicle_id
+		HAVING SUM(-m.quantity) <> 0
+		ORDER BY cost DESC
+	`, since)
+	return byPart, byVehicle, err
+}
@@ -681,8 +681,8 @@ func pdfCustomReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.Role != "manager" {
-		http.Error(w, "Manager access required", http.StatusForbidden)
+	if !hasPermission(user, PermReportsExport) {
+		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Permission names. Roles are stored in the database as sets of these;
+// handlers and templates only ever check permissions, never role names.
+const (
+	PermDashboardView      = "dashboard.view"
+	PermFleetView          = "fleet.view"
+	PermFleetEdit          = "fleet.edit"
+	PermMaintenanceView    = "maintenance.view"
+	PermMaintenanceEdit    = "maintenance.edit"
+	PermFuelView           = "fuel.view"
+	PermFuelEdit           = "fuel.edit"
+	PermRoutesView         = "routes.view"
+	PermRoutesEdit         = "routes.edit"
+	PermRoutesAssign       = "routes.assign"
+	PermStudentsView       = "students.view"
+	PermStudentsEdit       = "students.edit"
+	PermStudentsViewPII    = "students.view_pii"
+	PermECSEView           = "ecse.view"
+	PermECSEEdit           = "ecse.edit"
+	PermDriversView        = "drivers.view"
+	PermDriversCredentials = "drivers.credentials"
+	PermMileageView        = "mileage.view"
+	PermMileageEdit        = "mileage.edit"
+	PermGPSView            = "gps.view"
+	PermGPSManage          = "gps.manage"
+	PermReportsView        = "reports.view"
+	PermReportsExport      = "reports.export"
+	PermAnalyticsView      = "analytics.view"
+	PermBudgetView         = "budget.view"
+	PermBudgetEdit         = "budget.edit"
+	PermBudgetApprove      = "budget.approve"
+	PermAlertsManage       = "alerts.manage"
+	PermNotificationsAdmin = "notifications.manage"
+	PermMessagingBroadcast = "messaging.broadcast"
+	PermDataImport         = "data.import"
+	PermUsersManage        = "users.manage"
+	PermRolesManage        = "roles.manage"
+	PermSystemAdmin        = "system.admin"
+	PermAuditView          = "audit.view"
+	PermDriverOperate      = "driver.operate"
+)
+
+// PermissionInfo describes a permission for the role editor
+type PermissionInfo struct {
+	Name        string `json:"name"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+}
+
+// allPermissions is every permission the application checks
+var allPermissions = []PermissionInfo{
+	{PermDashboardView, "General", "Open the management dashboard"},
+	{PermFleetView, "Fleet", "View buses and fleet vehicles"},
+	{PermFleetEdit, "Fleet", "Add and edit buses and fleet vehicles"},
+	{PermMaintenanceView, "Maintenance", "View maintenance and service records"},
+	{PermMaintenanceEdit, "Maintenance", "Record maintenance and schedule service"},
+	{PermFuelView, "Fuel", "View fuel records and efficiency"},
+	{PermFuelEdit, "Fuel", "Add and edit fuel records"},
+	{PermRoutesView, "Routes", "View routes and route monitoring"},
+	{PermRoutesEdit, "Routes", "Create, plan and delete routes"},
+	{PermRoutesAssign, "Routes", "Assign drivers and buses to routes"},
+	{PermStudentsView, "Students", "View student rosters"},
+	{PermStudentsEdit, "Students", "Add and edit students"},
+	{PermStudentsViewPII, "Students", "See student contact details, addresses and guardians"},
+	{PermECSEView, "ECSE", "View ECSE students and reports"},
+	{PermECSEEdit, "ECSE", "Edit and import ECSE records"},
+	{PermDriversView, "Drivers", "View driver profiles, logs and scorecards"},
+	{PermDriversCredentials, "Drivers", "Record driver licences and certifications and upload their documents"},
+	{PermMileageView, "Mileage", "View mileage reports"},
+	{PermMileageEdit, "Mileage", "Generate mileage reports"},
+	{PermGPSView, "GPS", "Track every vehicle and replay trips"},
+	{PermGPSManage, "GPS", "Configure GPS tracking and geofences"},
+	{PermReportsView, "Reports", "Run reports and the report builder"},
+	{PermReportsExport, "Reports", "Export data and manage scheduled exports"},
+	{PermAnalyticsView, "Reports", "View analytics dashboards"},
+	{PermBudgetView, "Budget", "View budgets"},
+	{PermBudgetEdit, "Budget", "Create budgets and edit allocations"},
+	{PermBudgetApprove, "Budget", "Change a budget's status (activate or close)"},
+	{PermAlertsManage, "Operations", "Acknowledge and resolve alerts"},
+	{PermNotificationsAdmin, "Operations", "Review and resend failed notifications"},
+	{PermMessagingBroadcast, "Operations", "Message any user and receive all driver messages"},
+	{PermDataImport, "Administration", "Import data from spreadsheets"},
+	{PermUsersManage, "Administration", "Approve, edit and delete users"},
+	{PermRolesManage, "Administration", "Define roles and assign them to users"},
+	{PermSystemAdmin, "Administration", "Backups, monitoring, diagnostics and database tools"},
+	{PermAuditView, "Administration", "View the audit log and the change history of any record"},
+	{PermDriverOperate, "Driving", "Driver dashboard, trip logs and own route"},
+}
+
+// Role is a named permission set
+type Role struct {
+	Name        string   `json:"name" db:"name"`
+	DisplayName string   `json:"display_name" db:"display_name"`
+	Description string   `json:"description" db:"description"`
+	IsSystem    bool     `json:"is_system" db:"is_system"`
+	Require2FA  bool     `json:"require_2fa" db:"require_2fa"`
+	Permissions []string `json:"permissions" db:"-"`
+	UserCount   int      `json:"user_count" db:"user_count"`
+}
+
+// Has reports whether the role grants perm
+func (r Role) Has(perm string) bool {
+	for _, p := range r.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionGroup is one category of the role editor's checklist
+type PermissionGroup struct {
+	Category    string
+	Permissions []PermissionInfo
+}
+
+// permissionGroups groups allPermissions by category, keeping their order
+func permissionGroups() []PermissionGroup {
+	var groups []PermissionGroup
+	index := make(map[string]int)
+	for _, p := range allPermissions {
+		i, ok := index[p.Category]
+		if !ok {
+			i = len(groups)
+			index[p.Category] = i
+			groups = append(groups, PermissionGroup{Category: p.Category})
+		}
+		groups[i].Permissions = append(groups[i].Permissions, p)
+	}
+	return groups
+}
+
+// defaultRoles are seeded on startup. System roles can't be deleted, and
+// the manager role always holds every permission.
+var defaultRoles = []Role{
+	{Name: RoleManager, DisplayName: "Manager", IsSystem: true,
+		Description: "Full access to every part of the system"},
+	{Name: RoleDriver, DisplayName: "Driver", IsSystem: true,
+		Description: "Drives assigned routes and records trips",
+		Permissions: []string{PermDriverOperate}},
+	{Name: "dispatcher", DisplayName: "Dispatcher",
+		Description: "Runs daily operations: routes, assignments and live tracking",
+		Permissions: []string{PermDashboardView, PermFleetView, PermRoutesView, PermRoutesAssign,
+			PermStudentsView, PermDriversView, PermGPSView, PermAlertsManage, PermMessagingBroadcast,
+			PermMileageView, PermReportsView}},
+	{Name: "mechanic", DisplayName: "Mechanic",
+		Description: "Maintains the fleet",
+		Permissions: []string{PermDashboardView, PermFleetView, PermFleetEdit,
+			PermMaintenanceView, PermMaintenanceEdit, PermFuelView}},
+	{Name: "ecse_coordinator", DisplayName: "ECSE Coordinator",
+		Description: "Manages ECSE students and their services",
+		Permissions: []string{PermDashboardView, PermStudentsView, PermStudentsEdit, PermStudentsViewPII,
+			PermECSEView, PermECSEEdit, PermReportsView, PermReportsExport}},
+	{Name: "finance_clerk", DisplayName: "Finance Clerk",
+		Description: "Tracks budgets, fuel spend and mileage",
+		Permissions: []string{PermDashboardView, PermBudgetView, PermBudgetEdit, PermFuelView, PermFuelEdit,
+			PermMileageView, PermReportsView, PermReportsExport, PermAnalyticsView}},
+	{Name: "auditor", DisplayName: "Auditor (read-only)",
+		Description: "Can view everything except student personal details, and change nothing",
+		Permissions: viewPermissions()},
+}
+
+// viewPermissions lists the read-only permissions
+func viewPermissions() []string {
+	var perms []string
+	for _, p := range allPermissions {
+		if strings.HasSuffix(p.Name, ".view") {
+			perms = append(perms, p.Name)
+		}
+	}
+	return perms
+}
+
+func allPermissionNames() []string {
+	names := make([]string, len(allPermissions))
+	for i, p := range allPermissions {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func isKnownPermission(name string) bool {
+	for _, p := range allPermissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionCache holds each role's permission set. Entries expire so role
+// edits made by another instance are picked up within a minute.
+type permissionCache struct {
+	mu       sync.RWMutex
+	roles    map[string]map[string]bool
+	loadedAt time.Time
+}
+
+const permissionCacheTTL = time.Minute
+
+var rolePermissions = &permissionCache{}
+
+// permissions returns the permission set for a role
+func (c *permissionCache) permissions(role string) map[string]bool {
+	c.mu.RLock()
+	if c.roles != nil && time.Since(c.loadedAt) < permissionCacheTTL {
+		perms := c.roles[role]
+		c.mu.RUnlock()
+		return perms
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.roles == nil || time.Since(c.loadedAt) >= permissionCacheTTL {
+		roles, err := loadRolePermissions()
+		if err != nil {
+			log.Printf("Failed to load role permissions, using defaults: %v", err)
+			roles = defaultRolePermissions()
+		}
+		c.roles = roles
+		c.loadedAt = time.Now()
+	}
+	return c.roles[role]
+}
+
+func (c *permissionCache) invalidate() {
+	c.mu.Lock()
+	c.roles = nil
+	c.mu.Unlock()
+}
+
+func loadRolePermissions() (map[string]map[string]bool, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := db.Query("SELECT role, permission FROM role_permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[string]map[string]bool)
+	for rows.Next() {
+		var role, perm string
+		if err := rows.Scan(&role, &perm); err != nil {
+			return nil, err
+		}
+		if roles[role] == nil {
+			roles[role] = make(map[string]bool)
+		}
+		roles[role][perm] = true
+	}
+	return roles, rows.Err()
+}
+
+// defaultRolePermissions is the built-in role table, used when the database
+// can't be read
+func defaultRolePermissions() map[string]map[string]bool {
+	roles := make(map[string]map[string]bool)
+	for _, role := range defaultRoles {
+		perms := role.Permissions
+		if role.Name == RoleManager {
+			perms = allPermissionNames()
+		}
+		roles[role.Name] = make(map[string]bool)
+		for _, p := range perms {
+			roles[role.Name][p] = true
+		}
+	}
+	return roles
+}
+
+// roleHasPermission reports whether the named role grants perm
+func roleHasPermission(role, perm string) bool {
+	return rolePermissions.permissions(role)[perm]
+}
+
+// hasPermission reports whether the user's role grants perm
+func hasPermission(user *User, perm string) bool {
+	if user == nil || user.Role == "" {
+		return false
+	}
+	return roleHasPermission(user.Role, perm)
+}
+
+// templateCan backs the "can" template function. It takes the page's User,
+// which handlers pass either as *User or User.
+func templateCan(user interface{}, perm string) bool {
+	switch u := user.(type) {
+	case *User:
+		return hasPermission(u, perm)
+	case User:
+		return hasPermission(&u, perm)
+	case *Session:
+		return u != nil && roleHasPermission(u.Role, perm)
+	}
+	return false
+}
+
+// templateHome backs the "home" template function, linking to homePath
+func templateHome(user interface{}) string {
+	switch u := user.(type) {
+	case *User:
+		return homePath(u)
+	case User:
+		return homePath(&u)
+	}
+	return "/"
+}
+
+// requirePermission ensures the user's role grants the permission
+func requirePermission(perm string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			user := getUserFromSession(r)
+			if !hasPermission(user, perm) {
+				SendError(w, ErrForbidden("Access denied"))
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// homePath is where a user lands after login
+func homePath(user *User) string {
+	switch {
+	case hasPermission(user, PermDashboardView):
+		return "/manager-dashboard"
+	case hasPermission(user, PermDriverOperate):
+		return "/driver-dashboard"
+	}
+	return "/"
+}
+
+// guideAudience picks which help content (manager, driver or general) a
+// user is shown, based on what they can do
+func guideAudience(user *User) string {
+	switch {
+	case hasPermission(user, PermDashboardView):
+		return "manager"
+	case hasPermission(user, PermDriverOperate):
+		return "driver"
+	}
+	return "general"
+}
+
+// seedRoles creates the default roles. A role's default permissions are
+// only inserted when the role is first created, so later edits stick; the
+// manager role is topped up with any permission added since.
+func seedRoles() error {
+	for _, role := range defaultRoles {
+		result, err := db.Exec(`
+			INSERT INTO roles (name, display_name, description, is_system)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (name) DO NOTHING
+		`, role.Name, role.DisplayName, role.Description, role.IsSystem)
+		if err != nil {
+			return fmt.Errorf("failed to seed role %s: %w", role.Name, err)
+		}
+
+		created, _ := result.RowsAffected()
+		perms := role.Permissions
+		if role.Name == RoleManager {
+			perms = allPermissionNames()
+		} else if created == 0 {
+			continue
+		}
+
+		for _, perm := range perms {
+			if _, err := db.Exec(`
+				INSERT INTO role_permissions (role, permission) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING
+			`, role.Name, perm); err != nil {
+				return fmt.Errorf("failed to seed permissions for %s: %w", role.Name, err)
+			}
+		}
+	}
+
+	rolePermissions.invalidate()
+	return nil
+}
+
+// getRoles returns every role with its permissions and user count
+func getRoles() ([]Role, error) {
+	var roles []Role
+	err := db.Select(&roles, `
+		SELECT r.name, r.display_name, COALESCE(r.description, '') AS description, r.is_system, r.require_2fa,
+		       (SELECT COUNT(*) FROM users u WHERE u.role = r.name) AS user_count
+		FROM roles r
+		ORDER BY r.is_system DESC, r.display_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	perms, err := loadRolePermissions()
+	if err != nil {
+		return nil, err
+	}
+	for i := range roles {
+		for p := range perms[roles[i].Name] {
+			roles[i].Permissions = append(roles[i].Permissions, p)
+		}
+		sort.Strings(roles[i].Permissions)
+	}
+	return roles, nil
+}
+
+// roleExists reports whether a role with this name is defined
+func roleExists(name string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)", name)
+	return exists, err
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,19}$`)
+
+// saveRole creates or updates a role and replaces its permission set
+func saveRole(role Role) error {
+	if !roleNamePattern.MatchString(role.Name) {
+		return fmt.Errorf("role name must be 1-20 lowercase letters, digits or underscores")
+	}
+	if strings.TrimSpace(role.DisplayName) == "" {
+		role.DisplayName = role.Name
+	}
+	for _, p := range role.Permissions {
+		if !isKnownPermission(p) {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO roles (name, display_name, description, require_2fa)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET display_name = EXCLUDED.display_name,
+			description = EXCLUDED.description, require_2fa = EXCLUDED.require_2fa,
+			updated_at = CURRENT_TIMESTAMP
+	`, role.Name, role.DisplayName, role.Description, role.Require2FA)
+	if err != nil {
+		return err
+	}
+
+	// The manager role keeps every permission so nobody can lock themselves
+	// out of role management
+	if role.Name == RoleManager {
+		role.Permissions = allPermissionNames()
+	}
+
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = $1", role.Name); err != nil {
+		return err
+	}
+	for _, p := range role.Permissions {
+		if _, err := tx.Exec("INSERT INTO role_permissions (role, permission) VALUES ($1, $2)", role.Name, p); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rolePermissions.invalidate()
+	return nil
+}
+
+// deleteRole removes a custom role that no user holds
+func deleteRole(name string) error {
+	var isSystem bool
+	var users int
+	err := db.QueryRow(`
+		SELECT is_system, (SELECT COUNT(*) FROM users WHERE role = $1)
+		FROM roles WHERE name = $1
+	`, name).Scan(&isSystem, &users)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("role %s does not exist", name)
+	}
+	if err != nil {
+		return err
+	}
+	if isSystem {
+		return fmt.Errorf("%s is a built-in role and can't be deleted", name)
+	}
+	if users > 0 {
+		return fmt.Errorf("%d user(s) still have the %s role", users, name)
+	}
+
+	if _, err := db.Exec("DELETE FROM roles WHERE name = $1", name); err != nil {
+		return err
+	}
+	rolePermissions.invalidate()
+	return nil
+}
+
+// roleAuditSnapshot is a role's row plus its permission list, for the
+// audit log
+func roleAuditSnapshot(name string) map[string]interface{} {
+	snapshot := auditSnapshot("roles", "name", name)
+	if snapshot == nil {
+		return nil
+	}
+	var perms []string
+	if err := db.Select(&perms, "SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission", name); err != nil {
+		log.Printf("Audit snapshot of role %s permissions failed: %v", name, err)
+	}
+	snapshot["permissions"] = strings.Join(perms, ", ")
+	return snapshot
+}
+
+// canAssignRole reports whether actor may move a user from one role to
+// another. Without roles.manage, both roles must grant nothing the actor
+// doesn't already hold, so user managers can't escalate anyone (including
+// themselves) or demote someone more privileged.
+func canAssignRole(actor *User, from, to string) bool {
+	if hasPermission(actor, PermRolesManage) {
+		return true
+	}
+	if !hasPermission(actor, PermUsersManage) {
+		return false
+	}
+	for _, role := range []string{from, to} {
+		for perm := range rolePermissions.permissions(role) {
+			if !hasPermission(actor, perm) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// redactStudentPII blanks the contact and address fields of students for
+// users without students.view_pii
+func redactStudentPII(students []Student) {
+	for i := range students {
+		students[i].Locations = "[]"
+		students[i].PhoneNumber = ""
+		students[i].AltPhoneNumber = ""
+		students[i].Guardian = ""
+	}
+}
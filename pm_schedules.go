@@ -0,0 +1,538 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Where a vehicle stands against a PM program
+const (
+	PMStatusOK      = "ok"
+	PMStatusDue     = "due"
+	PMStatusOverdue = "overdue"
+)
+
+var pmStatusRank = map[string]int{PMStatusOK: 0, PMStatusDue: 1, PMStatusOverdue: 2}
+
+// pmError is a PM change that can't be made, worded for whoever tried it
+type pmError string
+
+func (e pmError) Error() string { return string(e) }
+
+// PMProgram is a preventive maintenance program: a service that falls due
+// on whichever of its mileage, engine hours or calendar intervals comes
+// first. An interval of zero isn't tracked.
+type PMProgram struct {
+	ID            int       `db:"id"`
+	Name          string    `db:"name"`
+	Description   string    `db:"description"`
+	VehicleClass  string    `db:"vehicle_class"` // "bus", "vehicle" or "" for both
+	ModelMatch    string    `db:"model_match"`
+	Category      string    `db:"category"`
+	IntervalMiles int       `db:"interval_miles"`
+	IntervalHours int       `db:"interval_hours"`
+	IntervalDays  int       `db:"interval_days"`
+	WarnMiles     int       `db:"warn_miles"`
+	WarnHours     int       `db:"warn_hours"`
+	WarnDays      int       `db:"warn_days"`
+	AutoWorkOrder bool      `db:"auto_work_order"`
+	Active        bool      `db:"active"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+// Applies reports whether the program covers a vehicle of the given class
+// and model. The model match is a case-insensitive substring, so "Blue
+// Bird" covers every Blue Bird.
+func (p PMProgram) Applies(class, model string) bool {
+	if p.VehicleClass != "" && p.VehicleClass != class {
+		return false
+	}
+	return p.ModelMatch == "" || strings.Contains(strings.ToLower(model), strings.ToLower(p.ModelMatch))
+}
+
+// IntervalText reads like "every 6000 mi or 180 days, whichever first"
+func (p PMProgram) IntervalText() string {
+	var parts []string
+	if p.IntervalMiles > 0 {
+		parts = append(parts, fmt.Sprintf("%d mi", p.IntervalMiles))
+	}
+	if p.IntervalHours > 0 {
+		parts = append(parts, fmt.Sprintf("%d engine hours", p.IntervalHours))
+	}
+	switch {
+	case p.IntervalDays == 365:
+		parts = append(parts, "year")
+	case p.IntervalDays > 0 && p.IntervalDays%365 == 0:
+		parts = append(parts, fmt.Sprintf("%d years", p.IntervalDays/365))
+	case p.IntervalDays > 0:
+		parts = append(parts, fmt.Sprintf("%d days", p.IntervalDays))
+	}
+	text := "every " + strings.Join(parts, " or ")
+	if len(parts) > 1 {
+		text += ", whichever first"
+	}
+	return text
+}
+
+// CategoryLabel is the category as people read it
+func (p PMProgram) CategoryLabel() string {
+	if label, ok := workOrderCategories[p.Category]; ok {
+		return label
+	}
+	return p.Category
+}
+
+// PMVehicle is what the due list needs to know about a bus or vehicle
+type PMVehicle struct {
+	VehicleID       string  `db:"vehicle_id"`
+	Class           string  `db:"class"`
+	Model           string  `db:"model"`
+	Status          string  `db:"status"`
+	CurrentMileage  int     `db:"current_mileage"`
+	LastOilChange   int     `db:"last_oil_change"`
+	LastTireService int     `db:"last_tire_service"`
+	EngineHours     int     `db:"engine_hours"`
+	MilesPerDay     float64 `db:"miles_per_day"` // from the last 90 days of driver logs
+}
+
+// pmVehicleQuery covers the whole fleet; buses get a daily mileage from
+// their driver logs so mileage intervals can be projected to a date
+const pmVehicleQuery = `
+	SELECT * FROM (
+		SELECT bus_id AS vehicle_id, 'bus' AS class, COALESCE(model, '') AS model, status,
+			COALESCE(current_mileage, 0) AS current_mileage, COALESCE(last_oil_change, 0) AS last_oil_change,
+			COALESCE(last_tire_service, 0) AS last_tire_service, engine_hours,
+			COALESCE((
+				SELECT SUM(l.end_mileage - l.start_mileage) FROM driver_logs l
+				WHERE l.bus_id = buses.bus_id AND l.date >= CURRENT_DATE - 90 AND l.end_mileage > l.start_mileage
+			), 0) / 90.0 AS miles_per_day
+		FROM buses
+		UNION ALL
+		SELECT vehicle_id, 'vehicle', COALESCE(model, ''), status,
+			COALESCE(current_mileage, 0), COALESCE(last_oil_change, 0),
+			COALESCE(last_tire_service, 0), engine_hours, 0
+		FROM vehicles
+	) fleet`
+
+// PMService is when a vehicle last had a program done
+type PMService struct {
+	VehicleID   string        `db:"vehicle_id"`
+	ProgramID   int           `db:"program_id"`
+	LastMiles   sql.NullInt64 `db:"last_miles"`
+	LastHours   sql.NullInt64 `db:"last_hours"`
+	LastDate    sql.NullTime  `db:"last_date"`
+	WorkOrderID sql.NullInt64 `db:"work_order_id"`
+	UpdatedAt   time.Time     `db:"updated_at"`
+}
+
+// PMDue is one program worked forward for one vehicle: the mileage, hours
+// and date it next falls due at, and how close the nearest of them is
+type PMDue struct {
+	Program PMProgram
+	Vehicle PMVehicle
+	Last    *PMService
+	Status  string
+	Trigger string // "miles", "hours" or "days": the one that set Status
+	Never   bool   // no service on record to count from
+
+	HasMiles  bool
+	DueMiles  int
+	MilesLeft int
+	HasHours  bool
+	DueHours  int
+	HoursLeft int
+	DueDate   time.Time
+	DaysLeft  int
+
+	// DueBy is the earliest date any trigger is expected to come due,
+	// projecting mileage from recent driving. Zero if it can't be told.
+	DueBy time.Time
+
+	OpenWorkOrder int
+}
+
+// evaluatePM works a program forward from a vehicle's last service. A
+// mileage program with no service on record counts from the vehicle's
+// last oil change or tire service when it's one of those; otherwise
+// whatever has no starting point isn't tracked, and a program with
+// nothing to count from at all is due now.
+func evaluatePM(p PMProgram, v PMVehicle, last *PMService, today time.Time) PMDue {
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	d := PMDue{Program: p, Vehicle: v, Last: last, Status: PMStatusOK}
+
+	if p.IntervalMiles > 0 {
+		base, known := 0, false
+		if last != nil && last.LastMiles.Valid {
+			base, known = int(last.LastMiles.Int64), true
+		}
+		fallback := map[string]int{"oil_change": v.LastOilChange, "tire_service": v.LastTireService}
+		if miles, ok := fallback[p.Category]; ok && (!known || miles > base) {
+			base, known = miles, true
+		}
+		if known {
+			d.HasMiles = true
+			d.DueMiles = base + p.IntervalMiles
+			d.MilesLeft = d.DueMiles - v.CurrentMileage
+			d.worsen(pmTriggerStatus(d.MilesLeft, p.WarnMiles), "miles")
+			if v.MilesPerDay > 0 {
+				days := math.Ceil(float64(max(d.MilesLeft, 0)) / v.MilesPerDay)
+				d.project(today.AddDate(0, 0, int(days)))
+			}
+		}
+	}
+
+	if p.IntervalHours > 0 && v.EngineHours > 0 && last != nil && last.LastHours.Valid {
+		d.HasHours = true
+		d.DueHours = int(last.LastHours.Int64) + p.IntervalHours
+		d.HoursLeft = d.DueHours - v.EngineHours
+		d.worsen(pmTriggerStatus(d.HoursLeft, p.WarnHours), "hours")
+	}
+
+	if p.IntervalDays > 0 && last != nil && last.LastDate.Valid {
+		lastDate := last.LastDate.Time
+		d.DueDate = time.Date(lastDate.Year(), lastDate.Month(), lastDate.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, p.IntervalDays)
+		d.DaysLeft = int(d.DueDate.Sub(today).Hours() / 24)
+		d.worsen(pmTriggerStatus(d.DaysLeft, p.WarnDays), "days")
+		d.project(d.DueDate)
+	}
+
+	if d.Trigger == "" {
+		d.Never = true
+		d.Status = PMStatusDue
+		d.DueBy = today
+	}
+	return d
+}
+
+// pmTriggerStatus grades how much of an interval is left against its
+// warning window
+func pmTriggerStatus(left, warn int) string {
+	switch {
+	case left <= 0:
+		return PMStatusOverdue
+	case left <= warn:
+		return PMStatusDue
+	default:
+		return PMStatusOK
+	}
+}
+
+func (d *PMDue) worsen(status, trigger string) {
+	if d.Trigger == "" || pmStatusRank[status] > pmStatusRank[d.Status] {
+		d.Status, d.Trigger = status, trigger
+	}
+}
+
+func (d *PMDue) project(date time.Time) {
+	if d.DueBy.IsZero() || date.Before(d.DueBy) {
+		d.DueBy = date
+	}
+}
+
+// Message says how due the service is, by its most pressing trigger
+func (d PMDue) Message() string {
+	name := d.Program.Name
+	if d.Never {
+		return fmt.Sprintf("%s has no service on record", name)
+	}
+	var amount int
+	var unit string
+	switch d.Trigger {
+	case "miles":
+		amount, unit = d.MilesLeft, "miles"
+	case "hours":
+		amount, unit = d.HoursLeft, "engine hours"
+	default:
+		amount, unit = d.DaysLeft, "days"
+	}
+	switch {
+	case amount < 0:
+		return fmt.Sprintf("%s overdue by %d %s", name, -amount, unit)
+	case amount == 0:
+		return fmt.Sprintf("%s due now", name)
+	default:
+		return fmt.Sprintf("%s due in %d %s", name, amount, unit)
+	}
+}
+
+// Alert puts a due service in the shape the rest of the app shows
+// maintenance alerts in
+func (d PMDue) Alert() MaintenanceAlert {
+	alert := MaintenanceAlert{
+		VehicleID:   d.Vehicle.VehicleID,
+		VehicleType: d.Vehicle.Class,
+		AlertType:   "maintenance",
+		ItemName:    d.Program.Name,
+		Severity:    d.Status,
+		Message:     d.Message(),
+	}
+	if d.HasMiles && d.MilesLeft < 0 {
+		alert.MilesOverdue = -d.MilesLeft
+	}
+	return alert
+}
+
+// loadPMPrograms loads the catalog, active programs first
+func loadPMPrograms() ([]PMProgram, error) {
+	var programs []PMProgram
+	err := db.Select(&programs, `SELECT * FROM pm_programs ORDER BY active DESC, name`)
+	return programs, err
+}
+
+// savePMProgram adds a program, or updates it when p.ID is set
+func savePMProgram(p PMProgram) (int, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	p.ModelMatch = strings.TrimSpace(p.ModelMatch)
+	switch {
+	case p.Name == "":
+		return 0, pmError("A program needs a name")
+	case p.VehicleClass != "" && p.VehicleClass != "bus" && p.VehicleClass != "vehicle":
+		return 0, pmError("Unknown vehicle class")
+	case workOrderCategories[p.Category] == "":
+		return 0, pmError("Unknown category")
+	case p.IntervalMiles < 0 || p.IntervalHours < 0 || p.IntervalDays < 0 || p.WarnMiles < 0 || p.WarnHours < 0 || p.WarnDays < 0:
+		return 0, pmError("Intervals can't be negative")
+	case p.IntervalMiles == 0 && p.IntervalHours == 0 && p.IntervalDays == 0:
+		return 0, pmError("Give the program at least one interval: miles, engine hours or days")
+	}
+
+	var err error
+	if p.ID == 0 {
+		err = db.Get(&p.ID, `
+			INSERT INTO pm_programs (name, description, vehicle_class, model_match, category,
+				interval_miles, interval_hours, interval_days, warn_miles, warn_hours, warn_days, auto_work_order, active)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			RETURNING id
+		`, p.Name, p.Description, p.VehicleClass, p.ModelMatch, p.Category,
+			p.IntervalMiles, p.IntervalHours, p.IntervalDays, p.WarnMiles, p.WarnHours, p.WarnDays, p.AutoWorkOrder, p.Active)
+	} else {
+		var result sql.Result
+		result, err = db.Exec(`
+			UPDATE pm_programs SET name = $2, description = $3, vehicle_class = $4, model_match = $5, category = $6,
+				interval_miles = $7, interval_hours = $8, interval_days = $9, warn_miles = $10, warn_hours = $11, warn_days = $12,
+				auto_work_order = $13, active = $14, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, p.ID, p.Name, p.Description, p.VehicleClass, p.ModelMatch, p.Category,
+			p.IntervalMiles, p.IntervalHours, p.IntervalDays, p.WarnMiles, p.WarnHours, p.WarnDays, p.AutoWorkOrder, p.Active)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				return 0, sql.ErrNoRows
+			}
+		}
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
+			return 0, pmError("There's already a program called " + p.Name)
+		}
+		return 0, err
+	}
+	return p.ID, nil
+}
+
+// markPMServiceDone records a program as done on a given day, which is how
+// a vehicle's history is filled in for services done before it was tracked
+func markPMServiceDone(vehicleID string, programID int, date string, mileage int) (string, error) {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return "", pmError("Give the date the service was done")
+	}
+	var name string
+	if err := db.Get(&name, `SELECT name FROM pm_programs WHERE id = $1`, programID); err != nil {
+		return "", err
+	}
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		if err := recordPMServiceInTx(tx, vehicleID, name, "", date, mileage, 0); err != nil {
+			return err
+		}
+		return updateMaintenanceStatusBasedOnMileageInTx(tx, vehicleID)
+	})
+	if err == nil {
+		invalidateFleetCaches()
+	}
+	return name, err
+}
+
+// setEngineHours records an hour meter reading. It returns the reading it
+// replaces and whether the vehicle is a bus or a vehicle. Hour meters only
+// count up.
+func setEngineHours(vehicleID string, hours int) (int, string, error) {
+	var current struct {
+		Hours int    `db:"engine_hours"`
+		Class string `db:"class"`
+	}
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		err := tx.Get(&current, `
+			SELECT engine_hours, 'bus' AS class FROM buses WHERE bus_id = $1
+			UNION ALL
+			SELECT engine_hours, 'vehicle' FROM vehicles WHERE vehicle_id = $1
+			LIMIT 1
+		`, vehicleID)
+		if err != nil {
+			return err
+		}
+		if hours < current.Hours {
+			return pmError(fmt.Sprintf("%s already reads %d hours; hour meters don't go backwards", vehicleID, current.Hours))
+		}
+		if current.Class == "bus" {
+			_, err = tx.Exec(`UPDATE buses SET engine_hours = $2 WHERE bus_id = $1`, vehicleID, hours)
+		} else {
+			_, err = tx.Exec(`UPDATE vehicles SET engine_hours = $2 WHERE vehicle_id = $1`, vehicleID, hours)
+		}
+		return err
+	})
+	if err == nil {
+		invalidateFleetCaches()
+	}
+	return current.Hours, current.Class, err
+}
+
+// loadPMDueList works every active program forward for the given vehicles,
+// or for everything in service when none are given, most pressing first.
+// It takes a Queryer so a transaction can see services it just recorded.
+func loadPMDueList(q sqlx.Queryer, vehicleIDs ...string) ([]PMDue, error) {
+	var programs []PMProgram
+	if err := sqlx.Select(q, &programs, `SELECT * FROM pm_programs WHERE active ORDER BY name`); err != nil {
+		return nil, fmt.Errorf("failed to load PM programs: %w", err)
+	}
+	if len(programs) == 0 {
+		return nil, nil
+	}
+
+	var vehicles []PMVehicle
+	var services []PMService
+	var err error
+	if len(vehicleIDs) == 0 {
+		err = sqlx.Select(q, &vehicles, pmVehicleQuery+` WHERE status <> 'out_of_service' ORDER BY vehicle_id`)
+		if err == nil {
+			err = sqlx.Select(q, &services, `SELECT * FROM pm_services`)
+		}
+	} else {
+		ids := pq.StringArray(vehicleIDs)
+		err = sqlx.Select(q, &vehicles, pmVehicleQuery+` WHERE vehicle_id = ANY($1) ORDER BY vehicle_id`, ids)
+		if err == nil {
+			err = sqlx.Select(q, &services, `SELECT * FROM pm_services WHERE vehicle_id = ANY($1)`, ids)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PM history: %w", err)
+	}
+
+	var open []struct {
+		VehicleID string `db:"vehicle_id"`
+		AlertItem string `db:"alert_item"`
+		ID        int    `db:"id"`
+	}
+	if err := sqlx.Select(q, &open, `
+		SELECT vehicle_id, alert_item, MIN(id) AS id FROM work_orders
+		WHERE alert_item IS NOT NULL AND status NOT IN ('inspected', 'cancelled')
+		GROUP BY vehicle_id, alert_item
+	`); err != nil {
+		return nil, fmt.Errorf("failed to load open work orders: %w", err)
+	}
+	openOrders := make(map[string]int)
+	for _, o := range open {
+		openOrders[o.VehicleID+"|"+o.AlertItem] = o.ID
+	}
+	history := make(map[string]*PMService)
+	for i := range services {
+		history[fmt.Sprintf("%s|%d", services[i].VehicleID, services[i].ProgramID)] = &services[i]
+	}
+
+	today := time.Now()
+	var due []PMDue
+	for _, v := range vehicles {
+		for _, p := range programs {
+			if !p.Applies(v.Class, v.Model) {
+				continue
+			}
+			d := evaluatePM(p, v, history[fmt.Sprintf("%s|%d", v.VehicleID, p.ID)], today)
+			d.OpenWorkOrder = openOrders[v.VehicleID+"|"+p.Name]
+			due = append(due, d)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		a, b := due[i], due[j]
+		if pmStatusRank[a.Status] != pmStatusRank[b.Status] {
+			return pmStatusRank[a.Status] > pmStatusRank[b.Status]
+		}
+		if a.DueBy.IsZero() != b.DueBy.IsZero() {
+			return !a.DueBy.IsZero()
+		}
+		return a.DueBy.Before(b.DueBy)
+	})
+	return due, nil
+}
+
+// recordPMServiceInTx resets a vehicle's programs after a service: the one
+// named, or, for a service logged by hand, the oil change or tire service
+// programs its category stands for. A backdated entry never moves a
+// program's history backwards.
+func recordPMServiceInTx(tx *sqlx.Tx, vehicleID, program, category, date string, mileage, workOrderID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO pm_services (vehicle_id, program_id, last_miles, last_hours, last_date, work_order_id)
+		SELECT $1, p.id, COALESCE(NULLIF($5, 0), NULLIF(f.current_mileage, 0)), NULLIF(f.engine_hours, 0), $4::date, NULLIF($6, 0)
+		FROM pm_programs p, (
+			SELECT current_mileage, engine_hours FROM buses WHERE bus_id = $1
+			UNION ALL
+			SELECT current_mileage, engine_hours FROM vehicles WHERE vehicle_id = $1
+			LIMIT 1
+		) f
+		WHERE p.name = $2 OR ($2 = '' AND p.category = $3 AND p.category IN ('oil_change', 'tire_service'))
+		ON CONFLICT (vehicle_id, program_id) DO UPDATE SET
+			last_miles = EXCLUDED.last_miles,
+			last_hours = COALESCE(EXCLUDED.last_hours, pm_services.last_hours),
+			last_date = EXCLUDED.last_date,
+			work_order_id = EXCLUDED.work_order_id,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE pm_services.last_date IS NULL OR pm_services.last_date <= EXCLUDED.last_date
+	`, vehicleID, program, category, date, mileage, workOrderID)
+	if err != nil {
+		return fmt.Errorf("failed to record PM service: %w", err)
+	}
+	return nil
+}
+
+// generatePMWorkOrders opens a work order for every due service whose
+// program asks for one and that nothing already covers
+func generatePMWorkOrders() (int, error) {
+	due, err := loadPMDueList(db)
+	if err != nil {
+		return 0, err
+	}
+	opened := 0
+	for _, d := range due {
+		if !d.Program.AutoWorkOrder || d.Status == PMStatusOK || d.OpenWorkOrder != 0 {
+			continue
+		}
+		if _, err := openWorkOrderFromAlert(d.Vehicle.VehicleID, d.Program.Name, "system"); err != nil {
+			log.Printf("Error opening PM work order for %s on %s: %v", d.Program.Name, d.Vehicle.VehicleID, err)
+			continue
+		}
+		opened++
+	}
+	return opened, nil
+}
+
+// startPMWorkOrderJob opens the day's PM work orders before the shop's
+// morning
+func startPMWorkOrderJob() {
+	go scheduleDaily(5, 30, func() {
+		opened, err := generatePMWorkOrders()
+		if err != nil {
+			log.Printf("Error generating PM work orders: %v", err)
+			return
+		}
+		if opened > 0 {
+			log.Printf("Opened %d preventive maintenance work orders", opened)
+		}
+	})
+}
@@ -14,14 +14,8 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
-		data := map[string]interface{}{
-			"User":      user,
-			"CSRFToken": getSessionCSRFToken(r),
-			"Navigation": getNavigation(user, "Profile", ""),
-		}
-		
 		// For now, use a simple profile display
-		renderTemplate(w, r, "profile.html", data)
+		renderTemplate(w, r, "profile.html", profilePageData(r, user))
 	} else if r.Method == "POST" {
 		// Handle profile updates
 		if err := r.ParseForm(); err != nil {
@@ -42,6 +36,30 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// profilePageData builds the profile page, including the two-factor
+// section
+func profilePageData(r *http.Request, user *User) map[string]interface{} {
+	data := map[string]interface{}{
+		"User":      user,
+		"CSRFToken": getSessionCSRFToken(r),
+		"Navigation": getNavigation(user, "Profile", ""),
+	}
+
+	status, err := getTwoFactorStatus(user.Username)
+	if err != nil {
+		log.Printf("Error loading two-factor status for %s: %v", user.Username, err)
+		return data
+	}
+	data["TwoFactorStatus"] = status
+	if status.Pending {
+		if secret, err := pendingTOTPSecret(user.Username); err == nil && secret != "" {
+			data["TOTPSecret"] = secret
+			data["ProvisioningURI"] = totpProvisioningURI(user.Username, secret)
+		}
+	}
+	return data
+}
+
 // settingsHandler handles the settings page
 func settingsHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(r)
@@ -51,7 +69,7 @@ func settingsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only managers can access settings
-	if user.Role != "manager" {
+	if !hasPermission(user, PermSystemAdmin) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
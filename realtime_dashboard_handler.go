@@ -20,8 +20,8 @@ func RealtimeDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only managers can access the real-time dashboard
-	if user.Role != "manager" {
-		http.Error(w, "Unauthorized - Manager access required", http.StatusForbidden)
+	if !hasPermission(user, PermDashboardView) {
+		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
@@ -169,8 +169,8 @@ func reportBuilderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if session.Role != "manager" {
-		SendError(w, ErrForbidden("Manager access required"))
+	if !roleHasPermission(session.Role, PermReportsView) {
+		SendError(w, ErrForbidden("Access denied"))
 		return
 	}
 	
@@ -212,8 +212,8 @@ func reportBuilderAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if session.Role != "manager" {
-		SendError(w, ErrForbidden("Manager access required"))
+	if !roleHasPermission(session.Role, PermReportsView) {
+		SendError(w, ErrForbidden("Access denied"))
 		return
 	}
 
@@ -574,8 +574,8 @@ func getReportDataSourcesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if session.Role != "manager" {
-		SendError(w, ErrForbidden("Manager access required"))
+	if !roleHasPermission(session.Role, PermReportsView) {
+		SendError(w, ErrForbidden("Access denied"))
 		return
 	}
 
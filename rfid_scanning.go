@@ -0,0 +1,673 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// rfidRepeatWindow swallows a second read of a card held to the reader
+	rfidRepeatWindow = time.Minute
+	// rfidLiveWindow is how old a scan can be and still alert anyone;
+	// anything older is a reader catching up after being offline
+	rfidLiveWindow = 30 * time.Minute
+	// rfidStopMatchMeters is how near a planned stop a scan has to be to
+	// be recorded at that stop
+	rfidStopMatchMeters = 150
+	// rfidWrongStopMeters is how far from home a student can get off in
+	// the afternoon before it counts as the wrong stop
+	rfidWrongStopMeters = 500
+	// missedScanGrace is how long after a student's pickup or drop-off
+	// time a missing scan is reported
+	missedScanGrace = 15 * time.Minute
+	// maxScansPerRequest bounds one upload from a reader
+	maxScansPerRequest = 500
+)
+
+// Ridership alert types
+const (
+	RidershipWrongBus   = "wrong_bus"
+	RidershipWrongStop  = "wrong_stop"
+	RidershipMissedScan = "missed_scan"
+)
+
+// RFIDReader is a card reader installed on a bus
+type RFIDReader struct {
+	ReaderID   string         `db:"reader_id"`
+	Name       string         `db:"name"`
+	BusID      sql.NullString `db:"bus_id"`
+	Active     bool           `db:"active"`
+	LastSeenAt sql.NullTime   `db:"last_seen_at"`
+	CreatedBy  sql.NullString `db:"created_by"`
+	CreatedAt  time.Time      `db:"created_at"`
+}
+
+// CardScan is one card read as a reader uploads it. Readers without
+// their own GPS can leave out the coordinates; the bus's last reported
+// position is used for live scans.
+type CardScan struct {
+	CardUID   string    `json:"card_uid"`
+	ReaderID  string    `json:"reader_id,omitempty"`
+	VehicleID string    `json:"vehicle_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Latitude  *float64  `json:"latitude,omitempty"`
+	Longitude *float64  `json:"longitude,omitempty"`
+}
+
+// CardScanResult tells the reader what became of each scan
+type CardScanResult struct {
+	CardUID   string    `json:"card_uid"`
+	Timestamp time.Time `json:"timestamp"`
+	Result    string    `json:"result"` // boarded, alighted, repeat, duplicate, unknown_card, rejected
+	StudentID string    `json:"student_id,omitempty"`
+	Alerts    []string  `json:"alerts,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// RidershipAlert is a student on the wrong bus, off at the wrong stop, or
+// expected but never scanned. There is at most one of each type per
+// student and run.
+type RidershipAlert struct {
+	ID             int             `db:"id"`
+	AlertType      string          `db:"alert_type"`
+	StudentID      string          `db:"student_id"`
+	StudentName    string          `db:"student_name"`
+	Date           time.Time       `db:"date"`
+	Period         string          `db:"period"`
+	BusID          sql.NullString  `db:"bus_id"`
+	RouteID        sql.NullString  `db:"route_id"`
+	ScanID         sql.NullInt64   `db:"scan_id"`
+	Message        string          `db:"message"`
+	Latitude       sql.NullFloat64 `db:"latitude"`
+	Longitude      sql.NullFloat64 `db:"longitude"`
+	AcknowledgedBy sql.NullString  `db:"acknowledged_by"`
+	AcknowledgedAt sql.NullTime    `db:"acknowledged_at"`
+	CreatedAt      time.Time       `db:"created_at"`
+}
+
+// Label is the alert type as staff read it
+func (a RidershipAlert) Label() string {
+	switch a.AlertType {
+	case RidershipWrongBus:
+		return "Wrong bus"
+	case RidershipWrongStop:
+		return "Wrong stop"
+	case RidershipMissedScan:
+		return "Not scanned"
+	}
+	return a.AlertType
+}
+
+// scanRider is the student a card belongs to
+type scanRider struct {
+	StudentID string         `db:"student_id"`
+	Name      string         `db:"name"`
+	RouteID   sql.NullString `db:"route_id"`
+	Locations string         `db:"locations"`
+}
+
+// scanOutcome is what a scan did to the ledger
+type scanOutcome struct {
+	ScanID   int
+	Result   string
+	Rider    *scanRider
+	BusID    string
+	RouteID  string
+	WrongBus bool
+	Period   string
+	At       time.Time
+	Stop     string
+	Point    *GeoPoint
+}
+
+// normalizeCardUID reduces a card UID to upper-case hex, so "04:a2:1f"
+// and "04A21F" are the same card. It returns "" for anything that isn't
+// a plausible UID.
+func normalizeCardUID(uid string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(uid) {
+		switch {
+		case c >= '0' && c <= '9', c >= 'A' && c <= 'F':
+			b.WriteRune(c)
+		case c == ':' || c == '-' || c == ' ':
+		default:
+			return ""
+		}
+	}
+	if b.Len() < 4 || b.Len() > 32 {
+		return ""
+	}
+	return b.String()
+}
+
+// newReaderKey makes a key for a reader to upload with. Only its hash is
+// stored.
+func newReaderKey() (key, hash string) {
+	key = "rdr_" + generateSecureToken(24)
+	return key, hashSessionToken(key)
+}
+
+// readerFromRequest finds the active reader whose key is in the
+// Authorization header
+func readerFromRequest(r *http.Request) (*RFIDReader, error) {
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if key == "" {
+		return nil, sql.ErrNoRows
+	}
+	var reader RFIDReader
+	err := db.Get(&reader, `
+		SELECT reader_id, name, bus_id, active, last_seen_at, created_by, created_at
+		FROM rfid_readers
+		WHERE key_hash = $1 AND active
+	`, hashSessionToken(key))
+	if err != nil {
+		return nil, err
+	}
+	return &reader, nil
+}
+
+// rfidScansHandler takes a batch of card reads from a reader, records
+// each as a boarding or alighting, and raises alerts for live ones
+func rfidScansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		SendError(w, ErrMethodNotAllowed("Method not allowed"))
+		return
+	}
+
+	reader, err := readerFromRequest(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendError(w, ErrUnauthorized("A valid reader key is required"))
+		return
+	}
+	if err != nil {
+		SendError(w, ErrInternal("Failed to check reader key", err))
+		return
+	}
+
+	var req struct {
+		Scans []CardScan `json:"scans"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, ErrBadRequest("Invalid scan upload"))
+		return
+	}
+	if len(req.Scans) > maxScansPerRequest {
+		SendError(w, ErrBadRequest(fmt.Sprintf("Send at most %d scans at a time", maxScansPerRequest)))
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE rfid_readers SET last_seen_at = CURRENT_TIMESTAMP WHERE reader_id = $1`, reader.ReaderID); err != nil {
+		log.Printf("Failed to update reader %s last seen: %v", reader.ReaderID, err)
+	}
+
+	// Taps only make sense in the order they happened
+	sort.SliceStable(req.Scans, func(i, j int) bool {
+		return req.Scans[i].Timestamp.Before(req.Scans[j].Timestamp)
+	})
+
+	results := make([]CardScanResult, 0, len(req.Scans))
+	for _, scan := range req.Scans {
+		results = append(results, processCardScan(reader, scan))
+	}
+
+	SendJSON(w, http.StatusOK, map[string]interface{}{
+		"reader_id": reader.ReaderID,
+		"results":   results,
+	})
+}
+
+// processCardScan validates a scan, records it, and for scans that are
+// still current alerts staff and tells the student's parents
+func processCardScan(reader *RFIDReader, scan CardScan) CardScanResult {
+	result := CardScanResult{CardUID: scan.CardUID, Timestamp: scan.Timestamp}
+	reject := func(message string) CardScanResult {
+		result.Result = "rejected"
+		result.Error = message
+		return result
+	}
+
+	uid := normalizeCardUID(scan.CardUID)
+	if uid == "" {
+		return reject("card_uid must be a hex card UID")
+	}
+	result.CardUID = uid
+	if scan.ReaderID != "" && scan.ReaderID != reader.ReaderID {
+		return reject("reader_id doesn't match the reader key")
+	}
+	// A reader on a bus speaks only for that bus
+	busID := reader.BusID.String
+	if busID != "" && scan.VehicleID != "" && scan.VehicleID != busID {
+		return reject("vehicle_id doesn't match the reader's bus")
+	}
+	if busID == "" {
+		busID = scan.VehicleID
+	}
+	if busID == "" {
+		return reject("the reader isn't assigned to a bus and the scan has no vehicle_id")
+	}
+
+	scannedAt := scan.Timestamp
+	if scannedAt.IsZero() {
+		scannedAt = time.Now()
+	}
+	scannedAt = scannedAt.In(time.Local).Truncate(time.Millisecond)
+	if scannedAt.After(time.Now().Add(5 * time.Minute)) {
+		return reject("timestamp is in the future")
+	}
+	result.Timestamp = scannedAt
+	live := time.Since(scannedAt) <= rfidLiveWindow
+
+	var point *GeoPoint
+	if scan.Latitude != nil && scan.Longitude != nil {
+		if math.Abs(*scan.Latitude) > 90 || math.Abs(*scan.Longitude) > 180 {
+			return reject("latitude and longitude must be valid coordinates")
+		}
+		point = &GeoPoint{Latitude: *scan.Latitude, Longitude: *scan.Longitude}
+	} else if live && gpsTracker != nil {
+		if loc, err := gpsTracker.GetLatestLocation(busID); err == nil && loc != nil &&
+			loc.Timestamp.Sub(scannedAt).Abs() < 2*time.Minute {
+			point = &GeoPoint{Latitude: loc.Latitude, Longitude: loc.Longitude}
+		}
+	}
+
+	outcome, err := recordCardScan(reader.ReaderID, uid, busID, scannedAt, point)
+	if err != nil {
+		log.Printf("Failed to record card scan %s from reader %s: %v", uid, reader.ReaderID, err)
+		return reject("failed to record scan")
+	}
+	result.Result = outcome.Result
+	if outcome.Rider == nil || (outcome.Result != "boarded" && outcome.Result != "alighted") {
+		return result
+	}
+	result.StudentID = outcome.Rider.StudentID
+
+	for _, alert := range scanAlerts(outcome) {
+		if raiseRidershipAlert(alert, live) {
+			result.Alerts = append(result.Alerts, alert.AlertType)
+		}
+	}
+	if live {
+		notifyParentsOfScan(outcome)
+	}
+	return result
+}
+
+// recordCardScan stores the scan and, for a known card, turns it into a
+// boarding or an alighting on the student's ledger entry. A tap while
+// the student is off the bus boards them; a tap while on alights them.
+func recordCardScan(readerID, uid, busID string, scannedAt time.Time, point *GeoPoint) (*scanOutcome, error) {
+	outcome := &scanOutcome{BusID: busID, At: scannedAt, Point: point, Period: attendancePeriodAt(scannedAt)}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var lat, lng sql.NullFloat64
+	if point != nil {
+		lat = sql.NullFloat64{Float64: point.Latitude, Valid: true}
+		lng = sql.NullFloat64{Float64: point.Longitude, Valid: true}
+	}
+	err = tx.Get(&outcome.ScanID, `
+		INSERT INTO rfid_scans (reader_id, card_uid, bus_id, scanned_at, latitude, longitude)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (reader_id, card_uid, scanned_at) DO NOTHING
+		RETURNING id
+	`, readerID, uid, busID, scannedAt, lat, lng)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The reader is resending a batch we already have
+		outcome.Result = "duplicate"
+		return outcome, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rider scanRider
+	err = tx.Get(&rider, `
+		SELECT s.student_id, s.name, s.route_id, COALESCE(s.locations::text, '[]') AS locations
+		FROM student_cards c
+		JOIN students s ON s.student_id = c.student_id
+		WHERE c.card_uid = $1 AND c.active AND s.active
+	`, uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		outcome.Result = "unknown_card"
+		if _, err := tx.Exec(`UPDATE rfid_scans SET result = $1 WHERE id = $2`, outcome.Result, outcome.ScanID); err != nil {
+			return nil, err
+		}
+		return outcome, tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	outcome.Rider = &rider
+
+	var busRoutes []string
+	if err := tx.Select(&busRoutes, `SELECT route_id FROM route_assignments WHERE bus_id = $1 ORDER BY route_id`, busID); err != nil {
+		return nil, err
+	}
+	outcome.RouteID, outcome.WrongBus = scanRoute(rider.RouteID.String, busRoutes)
+
+	var prior struct {
+		BoardedAt  sql.NullTime `db:"boarded_at"`
+		AlightedAt sql.NullTime `db:"alighted_at"`
+	}
+	err = tx.Get(&prior, `
+		SELECT boarded_at, alighted_at FROM attendance_ledger
+		WHERE student_id = $1 AND date = $2 AND period = $3
+		FOR UPDATE
+	`, rider.StudentID, scannedAt.Format("2006-01-02"), outcome.Period)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	onBoard := prior.BoardedAt.Valid && (!prior.AlightedAt.Valid || prior.AlightedAt.Time.Before(prior.BoardedAt.Time))
+	last := prior.BoardedAt
+	if !onBoard {
+		last = prior.AlightedAt
+	}
+	if last.Valid && scannedAt.Sub(last.Time).Abs() < rfidRepeatWindow {
+		outcome.Result = "repeat"
+	} else {
+		outcome.Stop = nearestPlannedStop(tx, outcome.RouteID, point)
+		entry := AttendanceEntry{
+			StudentID: rider.StudentID,
+			Date:      scannedAt,
+			Period:    outcome.Period,
+			Status:    "present",
+			Source:    AttendanceSourceRFID,
+		}
+		if outcome.RouteID != "" {
+			entry.RouteID = sql.NullString{String: outcome.RouteID, Valid: true}
+		}
+		at := sql.NullTime{Time: scannedAt, Valid: true}
+		stop := sql.NullString{String: outcome.Stop, Valid: outcome.Stop != ""}
+		if onBoard {
+			outcome.Result = "alighted"
+			entry.AlightedAt, entry.AlightedStop = at, stop
+			entry.AlightedLatitude, entry.AlightedLongitude = lat, lng
+		} else {
+			outcome.Result = "boarded"
+			entry.BoardedAt, entry.BoardedStop = at, stop
+			entry.BoardedLatitude, entry.BoardedLongitude = lat, lng
+		}
+		if err := recordAttendance(tx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE rfid_scans SET student_id = $1, result = $2 WHERE id = $3`,
+		rider.StudentID, outcome.Result, outcome.ScanID); err != nil {
+		return nil, err
+	}
+	return outcome, tx.Commit()
+}
+
+// scanRoute picks the route a scan belongs to from the routes the bus is
+// assigned. It's the student's own route if the bus runs it; otherwise
+// the student is on the wrong bus and the bus's first route is used.
+func scanRoute(studentRoute string, busRoutes []string) (routeID string, wrongBus bool) {
+	for _, route := range busRoutes {
+		if route == studentRoute {
+			return route, false
+		}
+	}
+	if len(busRoutes) == 0 {
+		// Nothing to compare against on an unassigned bus
+		return studentRoute, false
+	}
+	return busRoutes[0], true
+}
+
+// nearestPlannedStop names the route's planned stop closest to the point,
+// if any is within reach
+func nearestPlannedStop(q sqlx.Queryer, routeID string, point *GeoPoint) string {
+	if routeID == "" || point == nil {
+		return ""
+	}
+	var stops []struct {
+		StopNumber int             `db:"stop_number"`
+		StopName   sql.NullString  `db:"stop_name"`
+		Latitude   float64         `db:"latitude"`
+		Longitude  float64         `db:"longitude"`
+		Radius     sql.NullFloat64 `db:"stop_radius"`
+	}
+	if err := sqlx.Select(q, &stops, `
+		SELECT stop_number, stop_name, latitude, longitude, stop_radius
+		FROM route_plans WHERE route_id = $1
+	`, routeID); err != nil {
+		log.Printf("Failed to load planned stops for route %s: %v", routeID, err)
+		return ""
+	}
+
+	best, bestDistance := "", math.MaxFloat64
+	for _, stop := range stops {
+		distance := calculateDistance(point.Latitude, point.Longitude, stop.Latitude, stop.Longitude)
+		if distance > math.Max(rfidStopMatchMeters, stop.Radius.Float64) || distance >= bestDistance {
+			continue
+		}
+		best, bestDistance = stop.StopName.String, distance
+		if best == "" {
+			best = fmt.Sprintf("Stop %d", stop.StopNumber)
+		}
+	}
+	return best
+}
+
+// scanAlerts works out which alerts a boarding or alighting raises
+func scanAlerts(o *scanOutcome) []RidershipAlert {
+	base := RidershipAlert{
+		StudentID:   o.Rider.StudentID,
+		StudentName: o.Rider.Name,
+		Date:        o.At,
+		Period:      o.Period,
+		BusID:       sql.NullString{String: o.BusID, Valid: true},
+		RouteID:     sql.NullString{String: o.RouteID, Valid: o.RouteID != ""},
+		ScanID:      sql.NullInt64{Int64: int64(o.ScanID), Valid: true},
+	}
+	if o.Point != nil {
+		base.Latitude = sql.NullFloat64{Float64: o.Point.Latitude, Valid: true}
+		base.Longitude = sql.NullFloat64{Float64: o.Point.Longitude, Valid: true}
+	}
+
+	var alerts []RidershipAlert
+	if o.Result == "boarded" && (o.WrongBus || !o.Rider.RouteID.Valid) {
+		alert := base
+		alert.AlertType = RidershipWrongBus
+		if o.Rider.RouteID.Valid {
+			alert.Message = fmt.Sprintf("%s boarded bus %s at %s but rides route %s, which this bus doesn't run.",
+				o.Rider.Name, o.BusID, o.At.Format("3:04 PM"), o.Rider.RouteID.String)
+		} else {
+			alert.Message = fmt.Sprintf("%s boarded bus %s at %s but isn't assigned to any route.",
+				o.Rider.Name, o.BusID, o.At.Format("3:04 PM"))
+		}
+		alerts = append(alerts, alert)
+	}
+
+	// Afternoon drop-offs should be near home; morning ones are at school
+	if o.Result == "alighted" && o.Period == "afternoon" && !o.WrongBus && o.Point != nil {
+		address := locationAddress(o.Rider.Locations, "dropoff")
+		found, err := geocodeAddresses([]string{address})
+		if err != nil {
+			log.Printf("Failed to locate home for %s: %v", o.Rider.StudentID, err)
+		}
+		if home, ok := found[normalizeAddress(address)]; ok {
+			distance := calculateDistance(o.Point.Latitude, o.Point.Longitude, home.Latitude, home.Longitude)
+			if distance > rfidWrongStopMeters {
+				alert := base
+				alert.AlertType = RidershipWrongStop
+				alert.Message = fmt.Sprintf("%s got off bus %s at %s, %.1f km from home at %s.",
+					o.Rider.Name, o.BusID, o.At.Format("3:04 PM"), distance/1000, address)
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	return alerts
+}
+
+// raiseRidershipAlert records an alert and, when notify is set, pushes it
+// to managers and to anyone watching the route. It reports whether the
+// alert is new; repeats for the same student and run are dropped.
+func raiseRidershipAlert(a RidershipAlert, notify bool) bool {
+	err := db.Get(&a.ID, `
+		INSERT INTO ridership_alerts (alert_type, student_id, date, period, bus_id, route_id,
+			scan_id, message, latitude, longitude)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (alert_type, student_id, date, period) DO NOTHING
+		RETURNING id
+	`, a.AlertType, a.StudentID, a.Date.Format("2006-01-02"), a.Period, a.BusID, a.RouteID,
+		a.ScanID, a.Message, a.Latitude, a.Longitude)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to record ridership alert: %v", err)
+		return false
+	}
+
+	log.Printf("Ridership alert: %s", a.Message)
+	if !notify {
+		return true
+	}
+
+	data := map[string]interface{}{
+		"alert_id":   a.ID,
+		"alert_type": a.AlertType,
+		"student_id": a.StudentID,
+		"bus_id":     a.BusID.String,
+		"period":     a.Period,
+		"message":    a.Message,
+	}
+	if a.RouteID.Valid {
+		BroadcastRouteUpdate(a.RouteID.String, "ridership_alert", data)
+	}
+
+	if notificationSystem == nil {
+		return true
+	}
+	notification := Notification{
+		Type:       NotifyRidershipAlert,
+		Priority:   "high",
+		Subject:    fmt.Sprintf("%s: %s", a.Label(), a.StudentName),
+		Message:    a.Message,
+		Data:       data,
+		Channels:   []string{"in-app", "push", "email"},
+		Recipients: getManagerRecipients(),
+	}
+	if err := notificationSystem.Send(notification); err != nil {
+		log.Printf("Failed to send ridership alert notification: %v", err)
+	}
+	return true
+}
+
+// notifyParentsOfScan tells a student's parents they got on or off
+func notifyParentsOfScan(o *scanOutcome) {
+	where := ""
+	if o.Stop != "" {
+		where = " at " + o.Stop
+	}
+	when := o.At.Format("3:04 PM")
+
+	if o.Result == "boarded" {
+		notifyStudentParents(o.Rider.StudentID, "boarded",
+			fmt.Sprintf("%s is on the bus", o.Rider.Name),
+			fmt.Sprintf("%s boarded bus %s%s at %s.", o.Rider.Name, o.BusID, where, when))
+		return
+	}
+	notifyStudentParents(o.Rider.StudentID, "dropped_off",
+		fmt.Sprintf("%s was dropped off", o.Rider.Name),
+		fmt.Sprintf("%s got off bus %s%s at %s.", o.Rider.Name, o.BusID, where, when))
+}
+
+// checkMissedScans alerts on students who ride a bus with a card reader
+// but haven't been scanned by their pickup or drop-off time. Students
+// with any ledger entry for the run, such as a reported absence, are
+// left alone, as are routes the school calendar says aren't running.
+func checkMissedScans(now time.Time) {
+	var missed []struct {
+		StudentID  string    `db:"student_id"`
+		Name       string    `db:"name"`
+		RouteID    string    `db:"route_id"`
+		BusID      string    `db:"bus_id"`
+		Period     string    `db:"period"`
+		ExpectedAt time.Time `db:"expected_at"`
+	}
+	err := db.Select(&missed, `
+		SELECT DISTINCT ON (s.student_id, p.period)
+			s.student_id, s.name, s.route_id, ra.bus_id, p.period,
+			$1::date + p.expected AS expected_at
+		FROM students s
+		JOIN route_assignments ra ON ra.route_id = s.route_id
+		JOIN rfid_readers rr ON rr.bus_id = ra.bus_id AND rr.active
+		CROSS JOIN LATERAL (VALUES ('morning', s.pickup_time), ('afternoon', s.dropoff_time)) AS p(period, expected)
+		WHERE s.active
+			AND p.expected IS NOT NULL
+			AND EXISTS (SELECT 1 FROM student_cards c WHERE c.student_id = s.student_id AND c.active)
+			AND NOT EXISTS (
+				SELECT 1 FROM attendance_ledger al
+				WHERE al.student_id = s.student_id AND al.date = $1::date AND al.period = p.period
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM ridership_alerts ra2
+				WHERE ra2.alert_type = 'missed_scan' AND ra2.student_id = s.student_id
+					AND ra2.date = $1::date AND ra2.period = p.period
+			)
+		ORDER BY s.student_id, p.period, ra.bus_id
+	`, now.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Failed to check for missed scans: %v", err)
+		return
+	}
+
+	cal := serviceCalendarFor(now, now)
+	for _, m := range missed {
+		day := cal.RouteDay(m.RouteID, now)
+		if !day.Running() {
+			continue
+		}
+		// Early release and late start move the expected time
+		expected := time.Date(now.Year(), now.Month(), now.Day(),
+			m.ExpectedAt.Hour(), m.ExpectedAt.Minute(), 0, 0, now.Location()).Add(day.Shift(m.Period))
+		due := expected.Add(missedScanGrace)
+		if due.After(now) || now.Sub(due) > 2*time.Hour {
+			continue
+		}
+
+		when := "pickup"
+		if m.Period == "afternoon" {
+			when = "drop-off"
+		}
+		raiseRidershipAlert(RidershipAlert{
+			AlertType:   RidershipMissedScan,
+			StudentID:   m.StudentID,
+			StudentName: m.Name,
+			Date:        now,
+			Period:      m.Period,
+			BusID:       sql.NullString{String: m.BusID, Valid: true},
+			RouteID:     sql.NullString{String: m.RouteID, Valid: true},
+			Message: fmt.Sprintf("%s hasn't scanned onto bus %s; their %s was due at %s.",
+				m.Name, m.BusID, when, expected.Format("3:04 PM")),
+		}, true)
+	}
+}
+
+// watchMissedScans runs checkMissedScans every few minutes
+func watchMissedScans() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		checkMissedScans(now)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 )
@@ -71,8 +72,18 @@ func checkRouteConflicts(driverID, busID, routeID, period, dateStr string) Route
 	routeConflicts := checkRouteSpecificConflicts(routeID, period)
 	check.Conflicts = append(check.Conflicts, routeConflicts...)
 
-	// Check driver qualifications
-	qualificationWarnings := checkDriverQualifications(driverID, busID, routeID)
+	// Check driver qualifications; lapsed required credentials block
+	qualifications, err := checkDriverQualifications(driverID, busID, routeID)
+	if err != nil {
+		log.Printf("Error checking qualifications for %s: %v", driverID, err)
+		qualifications = []RouteConflict{{
+			Type:        "credentials_unavailable",
+			Description: "Driver qualifications couldn't be checked",
+			Severity:    "error",
+		}}
+	}
+	qualificationErrors, qualificationWarnings := splitConflicts(qualifications)
+	check.Conflicts = append(check.Conflicts, qualificationErrors...)
 	check.Warnings = append(check.Warnings, qualificationWarnings...)
 
 	// Check bus capacity
@@ -234,58 +245,26 @@ func checkRouteSpecificConflicts(routeID, period string) []RouteConflict {
 	return conflicts
 }
 
-// checkDriverQualifications checks if driver is qualified for the route
-func checkDriverQualifications(driverID, busID, routeID string) []RouteConflict {
-	warnings := []RouteConflict{}
-
-	// Check if driver has CDL for large buses
-	var busCapacity int
-	var hasCDL bool
-	capacityQuery := `SELECT capacity FROM buses WHERE bus_id = $1`
-	cdlQuery := `SELECT has_cdl FROM users WHERE username = $1`
-	
-	db.Get(&busCapacity, capacityQuery, busID)
-	db.Get(&hasCDL, cdlQuery, driverID)
-
-	if busCapacity > 15 && !hasCDL {
-		warnings = append(warnings, RouteConflict{
-			Type:        "cdl_required",
-			Description: "This bus requires a CDL-certified driver",
-			Severity:    "warning",
-			Details: map[string]interface{}{
-				"bus_capacity": busCapacity,
-				"has_cdl":     hasCDL,
-			},
-		})
+// checkDriverQualifications checks the driver's credentials against the
+// bus and route. Missing or lapsed credentials the assignment legally
+// needs come back as errors; everything else is a warning. If anything
+// can't be looked up it returns the error rather than guessing, so the
+// caller refuses the assignment.
+func checkDriverQualifications(driverID, busID, routeID string) ([]RouteConflict, error) {
+	credentials, err := getDriverCredentials(driverID)
+	if err != nil {
+		return nil, fmt.Errorf("loading credentials for %s: %w", driverID, err)
 	}
-
-	// Check if driver is trained for special needs routes
-	var hasSpecialNeeds bool
-	var driverSpecialTrained bool
-	specialQuery := `
-		SELECT EXISTS(
-			SELECT 1 FROM students 
-			WHERE route_id = $1 AND special_needs = true
-		)
-	`
-	trainingQuery := `SELECT special_needs_trained FROM users WHERE username = $1`
-	
-	db.Get(&hasSpecialNeeds, specialQuery, routeID)
-	db.Get(&driverSpecialTrained, trainingQuery, driverID)
-
-	if hasSpecialNeeds && !driverSpecialTrained {
-		warnings = append(warnings, RouteConflict{
-			Type:        "special_training_recommended",
-			Description: "This route has special needs students; driver should have special needs training",
-			Severity:    "warning",
-			Details: map[string]interface{}{
-				"has_special_needs_students": hasSpecialNeeds,
-				"driver_trained":            driverSpecialTrained,
-			},
-		})
+	needsCDL, err := busNeedsCDL(busID)
+	if err != nil {
+		return nil, fmt.Errorf("checking CDL requirement for bus %s: %w", busID, err)
+	}
+	specialNeeds, err := routeHasSpecialNeedsStudents(routeID)
+	if err != nil {
+		return nil, fmt.Errorf("checking special needs students on route %s: %w", routeID, err)
 	}
 
-	return warnings
+	return evaluateDriverQualifications(credentials, needsCDL, specialNeeds, time.Now()), nil
 }
 
 // checkBusCapacity checks if bus has sufficient capacity for the route
@@ -383,9 +362,8 @@ func checkMaintenanceSchedule(busID, dateStr string) []RouteConflict {
 // getRouteAssignmentSuggestionsHandler provides smart suggestions for route assignments
 func getRouteAssignmentSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
 	routeID := r.URL.Query().Get("route_id")
-	period := r.URL.Query().Get("period")
 
-	suggestions := getRouteAssignmentSuggestions(routeID, period)
+	suggestions := getRouteAssignmentSuggestions(routeID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(suggestions)
@@ -393,149 +371,94 @@ func getRouteAssignmentSuggestionsHandler(w http.ResponseWriter, r *http.Request
 
 // RouteAssignmentSuggestion represents a suggested driver-bus combination
 type RouteAssignmentSuggestion struct {
-	DriverID     string  `json:"driver_id"`
-	DriverName   string  `json:"driver_name"`
-	BusID        string  `json:"bus_id"`
-	BusNumber    string  `json:"bus_number"`
-	Score        float64 `json:"score"`
+	DriverID     string   `json:"driver_id"`
+	DriverName   string   `json:"driver_name"`
+	BusID        string   `json:"bus_id"`
+	BusNumber    string   `json:"bus_number"`
+	Score        float64  `json:"score"`
 	Reasons      []string `json:"reasons"`
-	HasConflicts bool    `json:"has_conflicts"`
+	HasConflicts bool     `json:"has_conflicts"`
 }
 
-// getRouteAssignmentSuggestions generates smart suggestions for route assignments
-func getRouteAssignmentSuggestions(routeID, period string) []RouteAssignmentSuggestion {
+// getRouteAssignmentSuggestions ranks the crews that could take one route
+// on top of the district's current assignments, using the same rules and
+// scores as the assignment planner. Score is scaled so the best crew for
+// the route is 1 and the worst is 0.
+func getRouteAssignmentSuggestions(routeID string) []RouteAssignmentSuggestion {
 	suggestions := []RouteAssignmentSuggestion{}
 
-	// Get available drivers
-	availableDrivers := getAvailableDrivers(period)
-	
-	// Get available buses
-	availableBuses := getAvailableBuses(period)
-
-	// Score each combination
-	for _, driver := range availableDrivers {
-		for _, bus := range availableBuses {
-			score := calculateAssignmentScore(driver, bus, routeID, period)
-			
-			// Check for conflicts
-			conflicts := checkRouteConflicts(driver.Username, bus.BusID, routeID, period, "")
-			
-			if score > 0.5 { // Only suggest combinations with decent scores
-				suggestion := RouteAssignmentSuggestion{
-					DriverID:     driver.Username,
-					DriverName:   driver.Username,
-					BusID:        bus.BusID,
-					BusNumber:    bus.BusID,
-					Score:        score,
-					Reasons:      generateSuggestionReasons(driver, bus, routeID),
-					HasConflicts: !conflicts.CanAssign,
-				}
-				suggestions = append(suggestions, suggestion)
-			}
-		}
+	problem, err := loadAssignmentProblem("")
+	if err != nil {
+		log.Printf("Error loading assignment data for suggestions: %v", err)
+		return suggestions
 	}
-
-	// Sort by score (highest first)
-	for i := 0; i < len(suggestions)-1; i++ {
-		for j := i + 1; j < len(suggestions); j++ {
-			if suggestions[j].Score > suggestions[i].Score {
-				suggestions[i], suggestions[j] = suggestions[j], suggestions[i]
-			}
+	target := -1
+	for i, route := range problem.Routes {
+		if route.RouteID == routeID {
+			target = i
 		}
 	}
-
-	// Return top 5 suggestions
-	if len(suggestions) > 5 {
-		suggestions = suggestions[:5]
+	if target < 0 {
+		return suggestions
 	}
 
-	return suggestions
-}
-
-// Helper functions for suggestions
-func getAvailableDrivers(period string) []User {
-	var drivers []User
-	query := `
-		SELECT username, name, email, role 
-		FROM users 
-		WHERE role = 'driver' 
-		AND username NOT IN (
-			SELECT driver_id FROM route_assignments 
-			WHERE period = $1 AND active = true
-		)
-	`
-	db.Select(&drivers, query, period)
-	return drivers
-}
-
-func getAvailableBuses(period string) []Bus {
-	var buses []Bus
-	query := `
-		SELECT bus_id, status, capacity 
-		FROM buses 
-		WHERE status = 'active' 
-		AND bus_id NOT IN (
-			SELECT bus_id FROM route_assignments 
-			WHERE period = $1 AND active = true
-		)
-	`
-	db.Select(&buses, query, period)
-	return buses
-}
-
-func calculateAssignmentScore(driver User, bus Bus, routeID, period string) float64 {
-	score := 1.0
-
-	// Factor in driver experience
-	var tripCount int
-	db.Get(&tripCount, "SELECT COUNT(*) FROM driver_logs WHERE driver = $1", driver.Username)
-	if tripCount > 100 {
-		score += 0.2
+	// Crews keep their bus and their other routes
+	state := newCrewState(problem)
+	drivers := make(map[string]int, len(problem.Drivers))
+	for i, d := range problem.Drivers {
+		drivers[d] = i
 	}
-
-	// Factor in previous route familiarity
-	var familiarityCount int
-	db.Get(&familiarityCount, 
-		"SELECT COUNT(*) FROM driver_logs WHERE driver = $1 AND route_id = $2", 
-		driver.Username, routeID)
-	if familiarityCount > 0 {
-		score += 0.3
+	buses := make(map[string]int, len(problem.Buses))
+	for i, b := range problem.Buses {
+		buses[b.BusID] = i
 	}
-
-	// Factor in bus capacity match
-	var studentCount int
-	db.Get(&studentCount, "SELECT COUNT(*) FROM students WHERE route_id = $1 AND active = true", routeID)
-	capacityRatio := float64(studentCount) / float64(bus.Capacity.Int32)
-	if capacityRatio > 0.7 && capacityRatio < 0.9 {
-		score += 0.2 // Good capacity match
+	routes := make(map[string]int, len(problem.Routes))
+	for i, route := range problem.Routes {
+		routes[route.RouteID] = i
 	}
-
-	return score
-}
-
-func generateSuggestionReasons(driver User, bus Bus, routeID string) []string {
-	reasons := []string{}
-
-	// Check experience
-	var tripCount int
-	db.Get(&tripCount, "SELECT COUNT(*) FROM driver_logs WHERE driver = $1", driver.Username)
-	if tripCount > 100 {
-		reasons = append(reasons, fmt.Sprintf("Experienced driver (%d trips)", tripCount))
+	for _, a := range problem.Current {
+		d, okDriver := drivers[a.Driver]
+		b, okBus := buses[a.BusID]
+		route, okRoute := routes[a.RouteID]
+		if a.RouteID == routeID || !okDriver || !okBus || !okRoute {
+			continue
+		}
+		state.place(planCandidate{driver: d, bus: b}, route)
 	}
 
-	// Check route familiarity
-	var familiarityCount int
-	db.Get(&familiarityCount, 
-		"SELECT COUNT(*) FROM driver_logs WHERE driver = $1 AND route_id = $2", 
-		driver.Username, routeID)
-	if familiarityCount > 0 {
-		reasons = append(reasons, fmt.Sprintf("Familiar with route (%d previous trips)", familiarityCount))
+	var fits []planCandidate
+	for _, c := range problem.candidates(target) {
+		if state.fits(c, target) {
+			fits = append(fits, c)
+		}
 	}
+	if len(fits) == 0 {
+		return suggestions
+	}
+	best, worst := fits[0].score, fits[len(fits)-1].score
 
-	// Check capacity match
-	var studentCount int
-	db.Get(&studentCount, "SELECT COUNT(*) FROM students WHERE route_id = $1 AND active = true", routeID)
-	reasons = append(reasons, fmt.Sprintf("Bus capacity: %d, Students: %d", bus.Capacity, studentCount))
+	// Return top 5 suggestions
+	if len(fits) > 5 {
+		fits = fits[:5]
+	}
+	route := problem.Routes[target]
+	for _, c := range fits {
+		driver, bus := problem.Drivers[c.driver], problem.Buses[c.bus]
+		_, driverReasons, _, _ := problem.driverFit(driver, route)
+		_, busReasons, _ := problem.busFit(bus, route)
+		score := 1.0
+		if best > worst {
+			score = float64(c.score-worst) / float64(best-worst)
+		}
+		suggestions = append(suggestions, RouteAssignmentSuggestion{
+			DriverID:   driver,
+			DriverName: driver,
+			BusID:      bus.BusID,
+			BusNumber:  bus.BusID,
+			Score:      score,
+			Reasons:    append(driverReasons, busReasons...),
+		})
+	}
 
-	return reasons
-}
\ No newline at end of file
+	return suggestions
+}
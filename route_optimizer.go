@@ -0,0 +1,564 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	optimizerSpeedKmh      = 40  // the ETA engine's default bus speed
+	optimizerRoadFactor    = 1.3 // streets run longer than a straight line
+	optimizerStopDwell     = 30 * time.Second
+	optimizerBoardingDwell = 5 * time.Second // per rider
+	optimizerStopRadius    = 50              // meters, for arrival detection
+
+	// optimizerExactStops is the most stops ordered by exhaustive search;
+	// longer routes are ordered by local search
+	optimizerExactStops = 10
+
+	defaultMaxWalkMeters  = 400
+	defaultMaxRideMinutes = 60
+	defaultArriveBy       = "08:00"
+)
+
+// RouteOptimizerParams are the limits a manager sets for one route
+type RouteOptimizerParams struct {
+	RouteID        string
+	SchoolID       int
+	MaxWalkMeters  int
+	MaxRideMinutes int
+	ArriveBy       string // HH:MM the bus reaches school
+}
+
+// parseOptimizerParams reads the limits from a form or query string,
+// falling back to defaults for anything missing or out of range
+func parseOptimizerParams(values url.Values) RouteOptimizerParams {
+	params := RouteOptimizerParams{
+		RouteID:        values.Get("route_id"),
+		MaxWalkMeters:  defaultMaxWalkMeters,
+		MaxRideMinutes: defaultMaxRideMinutes,
+		ArriveBy:       defaultArriveBy,
+	}
+	params.SchoolID, _ = strconv.Atoi(values.Get("school_id"))
+	if v, err := strconv.Atoi(values.Get("max_walk")); err == nil && v >= 0 && v <= 1600 {
+		params.MaxWalkMeters = v
+	}
+	if v, err := strconv.Atoi(values.Get("max_ride")); err == nil && v >= 10 && v <= 180 {
+		params.MaxRideMinutes = v
+	}
+	if _, err := time.Parse("15:04", values.Get("arrive_by")); err == nil {
+		params.ArriveBy = values.Get("arrive_by")
+	}
+	return params
+}
+
+// Query encodes the params for links and redirects back to the optimizer
+func (p RouteOptimizerParams) Query() string {
+	return url.Values{
+		"route_id":  {p.RouteID},
+		"school_id": {strconv.Itoa(p.SchoolID)},
+		"max_walk":  {strconv.Itoa(p.MaxWalkMeters)},
+		"max_ride":  {strconv.Itoa(p.MaxRideMinutes)},
+		"arrive_by": {p.ArriveBy},
+	}.Encode()
+}
+
+// OptimizerRider is a student on the route and where they're picked up
+type OptimizerRider struct {
+	StudentID  string         `db:"student_id"`
+	Name       string         `db:"name"`
+	Locations  sql.NullString `db:"locations"`
+	Address    string
+	Point      GeoPoint
+	WalkMeters int
+}
+
+// OptimizedStop is one shared stop in the proposed plan
+type OptimizedStop struct {
+	Number      int
+	Name        string
+	Point       GeoPoint
+	Riders      []OptimizerRider
+	Arrival     time.Time
+	Departure   time.Time
+	RideMinutes int // time on board for riders boarding here
+}
+
+// RouteOptimization is a proposed stop plan for one route
+type RouteOptimization struct {
+	Params             RouteOptimizerParams
+	RouteName          string
+	School             string
+	Stops              []OptimizedStop
+	Unlocated          []OptimizerRider
+	Riders             int
+	Capacity           int // 0 when no bus is assigned
+	TotalRideMinutes   int
+	LongestRideMinutes int
+	// Exact is false when the route had too many stops to search every order
+	Exact bool
+	// Problems keep the plan from being applied
+	Problems []string
+}
+
+func (o *RouteOptimization) CanApply() bool {
+	return len(o.Problems) == 0 && len(o.Stops) > 0
+}
+
+// pickupAddress finds the pickup address in a student's locations, which
+// are stored as [{"type": "pickup", "address": "..."}, ...]
+func pickupAddress(locations string) string {
+	return locationAddress(locations, "pickup")
+}
+
+// locationAddress finds the address of the given type in a student's
+// locations, falling back to the first address listed
+func locationAddress(locations, kind string) string {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal([]byte(locations), &entries); err != nil {
+		return ""
+	}
+	first := ""
+	for _, entry := range entries {
+		address, _ := entry["address"].(string)
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if entry["type"] == kind {
+			return address
+		}
+		if first == "" {
+			first = address
+		}
+	}
+	return first
+}
+
+// travelTime estimates how long the bus takes between two points
+func travelTime(a, b GeoPoint) time.Duration {
+	meters := calculateDistance(a.Latitude, a.Longitude, b.Latitude, b.Longitude) * optimizerRoadFactor
+	seconds := meters / (optimizerSpeedKmh * 1000 / 3600)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func stopDwell(riders int) time.Duration {
+	return optimizerStopDwell + time.Duration(riders)*optimizerBoardingDwell
+}
+
+// clusterStops groups riders into shared stops. Each stop is at one
+// rider's pickup address and serves everyone within walking distance of
+// it; the address serving the most riders still unplaced goes first.
+func clusterStops(riders []OptimizerRider, maxWalkMeters float64) []OptimizedStop {
+	remaining := make([]int, len(riders))
+	for i := range riders {
+		remaining[i] = i
+	}
+
+	var stops []OptimizedStop
+	for len(remaining) > 0 {
+		bestAnchor, bestWalk := -1, 0.0
+		var bestMembers []int
+		for _, a := range remaining {
+			var members []int
+			walk := 0.0
+			for _, m := range remaining {
+				d := calculateDistance(riders[a].Point.Latitude, riders[a].Point.Longitude,
+					riders[m].Point.Latitude, riders[m].Point.Longitude)
+				if d <= maxWalkMeters {
+					members = append(members, m)
+					walk += d
+				}
+			}
+			if len(members) > len(bestMembers) || (len(members) == len(bestMembers) && walk < bestWalk) {
+				bestAnchor, bestMembers, bestWalk = a, members, walk
+			}
+		}
+
+		anchor := riders[bestAnchor]
+		stop := OptimizedStop{Name: anchor.Address, Point: anchor.Point}
+		placed := make(map[int]bool, len(bestMembers))
+		for _, m := range bestMembers {
+			rider := riders[m]
+			rider.WalkMeters = int(math.Round(calculateDistance(anchor.Point.Latitude, anchor.Point.Longitude,
+				rider.Point.Latitude, rider.Point.Longitude)))
+			stop.Riders = append(stop.Riders, rider)
+			placed[m] = true
+		}
+		stops = append(stops, stop)
+
+		kept := remaining[:0]
+		for _, i := range remaining {
+			if !placed[i] {
+				kept = append(kept, i)
+			}
+		}
+		remaining = kept
+	}
+	return stops
+}
+
+// stopOrderer holds the travel times between stops for ordering them.
+// The morning run ends at school, so a rider's time on board is
+// everything from their stop onwards.
+type stopOrderer struct {
+	weight   []float64   // riders per stop
+	dwell    []float64   // seconds
+	toSchool []float64   // seconds from each stop to school
+	travel   [][]float64 // seconds between stops
+	maxRide  float64
+}
+
+func newStopOrderer(stops []OptimizedStop, school GeoPoint, maxRide time.Duration) *stopOrderer {
+	n := len(stops)
+	o := &stopOrderer{
+		weight:   make([]float64, n),
+		dwell:    make([]float64, n),
+		toSchool: make([]float64, n),
+		travel:   make([][]float64, n),
+		maxRide:  maxRide.Seconds(),
+	}
+	for i, s := range stops {
+		o.weight[i] = float64(len(s.Riders))
+		o.dwell[i] = stopDwell(len(s.Riders)).Seconds()
+		o.toSchool[i] = travelTime(s.Point, school).Seconds()
+		o.travel[i] = make([]float64, n)
+		for j, t := range stops {
+			o.travel[i][j] = travelTime(s.Point, t.Point).Seconds()
+		}
+	}
+	return o
+}
+
+// rides returns each stop's ride time to school, in pickup order
+func (o *stopOrderer) rides(order []int) []float64 {
+	rides := make([]float64, len(order))
+	for m := len(order) - 1; m >= 0; m-- {
+		if m == len(order)-1 {
+			rides[m] = o.toSchool[order[m]]
+		} else {
+			next := order[m+1]
+			rides[m] = o.travel[order[m]][next] + o.dwell[next] + rides[m+1]
+		}
+	}
+	return rides
+}
+
+// cost is total rider time on board, plus a steep penalty for running
+// past the longest ride allowed
+func (o *stopOrderer) cost(order []int) float64 {
+	rides := o.rides(order)
+	total, weight := 0.0, 0.0
+	for m, stop := range order {
+		total += o.weight[stop] * rides[m]
+		weight += o.weight[stop]
+	}
+	if len(rides) > 0 && rides[0] > o.maxRide {
+		total += (rides[0] - o.maxRide) * weight * 10
+	}
+	return total
+}
+
+type orderLabel struct {
+	ride, cost float64
+	stop       int
+	prev       *orderLabel
+}
+
+// exact orders the stops by dynamic programming over the set of stops
+// already placed, building the run backwards from school. Each state
+// keeps every label not beaten on both ride time and cost, so the
+// cheapest order within the ride limit is found if there is one; if not,
+// the order with the shortest longest ride.
+func (o *stopOrderer) exact() []int {
+	n := len(o.weight)
+	if n == 0 {
+		return nil
+	}
+	labels := make([][][]*orderLabel, 1<<n)
+	for mask := range labels {
+		labels[mask] = make([][]*orderLabel, n)
+	}
+	for i := 0; i < n; i++ {
+		labels[1<<i][i] = []*orderLabel{{ride: o.toSchool[i], cost: o.weight[i] * o.toSchool[i], stop: i}}
+	}
+
+	for mask := 1; mask < 1<<n; mask++ {
+		for last := 0; last < n; last++ {
+			for _, l := range labels[mask][last] {
+				for j := 0; j < n; j++ {
+					if mask&(1<<j) != 0 {
+						continue
+					}
+					ride := o.travel[j][last] + o.dwell[last] + l.ride
+					next := &orderLabel{ride: ride, cost: l.cost + o.weight[j]*ride, stop: j, prev: l}
+					labels[mask|1<<j][j] = addOrderLabel(labels[mask|1<<j][j], next)
+				}
+			}
+		}
+	}
+
+	var best, shortest *orderLabel
+	for _, frontier := range labels[1<<n-1] {
+		for _, l := range frontier {
+			if l.ride <= o.maxRide && (best == nil || l.cost < best.cost) {
+				best = l
+			}
+			if shortest == nil || l.ride < shortest.ride {
+				shortest = l
+			}
+		}
+	}
+	if best == nil {
+		best = shortest
+	}
+
+	// The last label placed is the first pickup
+	var order []int
+	for l := best; l != nil; l = l.prev {
+		order = append(order, l.stop)
+	}
+	return order
+}
+
+// addOrderLabel adds a label to a frontier unless another is at least as
+// good on both counts, dropping any it beats
+func addOrderLabel(frontier []*orderLabel, l *orderLabel) []*orderLabel {
+	kept := frontier[:0]
+	for _, f := range frontier {
+		if f.ride <= l.ride && f.cost <= l.cost {
+			return frontier
+		}
+		if !(l.ride <= f.ride && l.cost <= f.cost) {
+			kept = append(kept, f)
+		}
+	}
+	return append(kept, l)
+}
+
+// localSearch orders long routes: the stop nearest school goes last, then
+// the nearest remaining stop before it, and so on, after which stops are
+// moved and stretches reversed for as long as that lowers the cost
+func (o *stopOrderer) localSearch() []int {
+	n := len(o.weight)
+	used := make([]bool, n)
+	reversed := make([]int, 0, n)
+	for len(reversed) < n {
+		best := -1
+		for j := 0; j < n; j++ {
+			if used[j] {
+				continue
+			}
+			d := o.toSchool[j]
+			if len(reversed) > 0 {
+				d = o.travel[j][reversed[len(reversed)-1]]
+			}
+			if best == -1 || d < o.distance(best, reversed) {
+				best = j
+			}
+		}
+		used[best] = true
+		reversed = append(reversed, best)
+	}
+	order := make([]int, n)
+	for i, stop := range reversed {
+		order[n-1-i] = stop
+	}
+
+	cost := o.cost(order)
+	for improved := true; improved; {
+		improved = false
+		// Move one stop elsewhere
+		for i := 0; i < n && !improved; i++ {
+			for j := 0; j < n && !improved; j++ {
+				if i == j {
+					continue
+				}
+				candidate := moveStop(order, i, j)
+				if c := o.cost(candidate); c < cost-1e-6 {
+					order, cost, improved = candidate, c, true
+				}
+			}
+		}
+		// Reverse a stretch
+		for i := 0; i < n-1 && !improved; i++ {
+			for j := i + 1; j < n && !improved; j++ {
+				candidate := append([]int(nil), order...)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if c := o.cost(candidate); c < cost-1e-6 {
+					order, cost, improved = candidate, c, true
+				}
+			}
+		}
+	}
+	return order
+}
+
+func (o *stopOrderer) distance(stop int, reversed []int) float64 {
+	if len(reversed) == 0 {
+		return o.toSchool[stop]
+	}
+	return o.travel[stop][reversed[len(reversed)-1]]
+}
+
+// moveStop returns a copy of order with the stop at from moved to to
+func moveStop(order []int, from, to int) []int {
+	stop := order[from]
+	moved := make([]int, 0, len(order))
+	moved = append(moved, order[:from]...)
+	moved = append(moved, order[from+1:]...)
+	moved = append(moved[:to], append([]int{stop}, moved[to:]...)...)
+	return moved
+}
+
+// optimizeRoute proposes shared stops for a route's riders and the order
+// to run them in
+func optimizeRoute(params RouteOptimizerParams) (*RouteOptimization, error) {
+	opt := &RouteOptimization{Params: params}
+
+	if err := db.Get(&opt.RouteName, `SELECT route_name FROM routes WHERE route_id = $1`, params.RouteID); err != nil {
+		return nil, fmt.Errorf("failed to load route: %w", err)
+	}
+	var school struct {
+		Name      string  `db:"name"`
+		Latitude  float64 `db:"center_latitude"`
+		Longitude float64 `db:"center_longitude"`
+	}
+	if err := db.Get(&school, `
+		SELECT name, center_latitude, center_longitude FROM geofences
+		WHERE id = $1 AND type = 'school' AND center_latitude IS NOT NULL
+	`, params.SchoolID); err != nil {
+		return nil, fmt.Errorf("failed to load school: %w", err)
+	}
+	opt.School = school.Name
+	schoolPoint := GeoPoint{Latitude: school.Latitude, Longitude: school.Longitude}
+
+	var riders []OptimizerRider
+	if err := db.Select(&riders, `
+		SELECT student_id, name, locations::text AS locations FROM students
+		WHERE route_id = $1 AND active = true
+		ORDER BY name, student_id
+	`, params.RouteID); err != nil {
+		return nil, fmt.Errorf("failed to load riders: %w", err)
+	}
+	opt.Riders = len(riders)
+
+	var capacity sql.NullInt64
+	if err := db.Get(&capacity, `
+		SELECT MIN(b.capacity) FROM route_assignments ra
+		JOIN buses b ON b.bus_id = ra.bus_id
+		WHERE ra.route_id = $1
+	`, params.RouteID); err != nil {
+		return nil, fmt.Errorf("failed to load bus capacity: %w", err)
+	}
+	opt.Capacity = int(capacity.Int64)
+
+	addresses := make([]string, 0, len(riders))
+	for i := range riders {
+		riders[i].Address = pickupAddress(riders[i].Locations.String)
+		addresses = append(addresses, riders[i].Address)
+	}
+	points, err := geocodeAddresses(addresses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to geocode addresses: %w", err)
+	}
+	var located []OptimizerRider
+	for _, rider := range riders {
+		point, ok := points[normalizeAddress(rider.Address)]
+		if !ok {
+			opt.Unlocated = append(opt.Unlocated, rider)
+			continue
+		}
+		rider.Point = point
+		located = append(located, rider)
+	}
+
+	stops := clusterStops(located, float64(params.MaxWalkMeters))
+	orderer := newStopOrderer(stops, schoolPoint, time.Duration(params.MaxRideMinutes)*time.Minute)
+	var order []int
+	if len(stops) <= optimizerExactStops {
+		order = orderer.exact()
+		opt.Exact = true
+	} else {
+		order = orderer.localSearch()
+	}
+
+	arriveBy, _ := time.Parse("15:04", params.ArriveBy)
+	now := time.Now()
+	atSchool := time.Date(now.Year(), now.Month(), now.Day(), arriveBy.Hour(), arriveBy.Minute(), 0, 0, time.Local)
+	rides := orderer.rides(order)
+	for m, i := range order {
+		stop := stops[i]
+		ride := time.Duration(rides[m] * float64(time.Second))
+		stop.Number = m + 1
+		stop.Departure = atSchool.Add(-ride)
+		stop.Arrival = stop.Departure.Add(-stopDwell(len(stop.Riders)))
+		stop.RideMinutes = int(math.Ceil(ride.Minutes()))
+		opt.TotalRideMinutes += stop.RideMinutes * len(stop.Riders)
+		opt.LongestRideMinutes = max(opt.LongestRideMinutes, stop.RideMinutes)
+		opt.Stops = append(opt.Stops, stop)
+	}
+
+	if len(opt.Unlocated) > 0 {
+		opt.Problems = append(opt.Problems, fmt.Sprintf("%d rider(s) have a pickup address that couldn't be located", len(opt.Unlocated)))
+	}
+	if opt.Capacity > 0 && opt.Riders > opt.Capacity {
+		opt.Problems = append(opt.Problems, fmt.Sprintf("The route has %d riders but its bus seats %d", opt.Riders, opt.Capacity))
+	}
+	if opt.LongestRideMinutes > params.MaxRideMinutes {
+		opt.Problems = append(opt.Problems, fmt.Sprintf("The longest ride is %d minutes, over the %d-minute limit; split the route or allow longer rides",
+			opt.LongestRideMinutes, params.MaxRideMinutes))
+	}
+	return opt, nil
+}
+
+// applyRouteOptimization replaces the route's stops with the optimized
+// ones and renumbers its riders in pickup order, in one transaction
+func applyRouteOptimization(opt *RouteOptimization) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stops := make([]RouteStop, len(opt.Stops))
+	for i, s := range opt.Stops {
+		stops[i] = RouteStop{
+			StopNumber:    s.Number,
+			Name:          s.Name,
+			Latitude:      s.Point.Latitude,
+			Longitude:     s.Point.Longitude,
+			ArrivalTime:   s.Arrival,
+			DepartureTime: s.Departure,
+			StudentCount:  len(s.Riders),
+			StopRadius:    optimizerStopRadius,
+		}
+	}
+	if err := replaceRoutePlan(tx, opt.Params.RouteID, stops); err != nil {
+		return err
+	}
+
+	position := 1
+	for _, s := range opt.Stops {
+		riders := append([]OptimizerRider(nil), s.Riders...)
+		sort.SliceStable(riders, func(i, j int) bool { return riders[i].WalkMeters < riders[j].WalkMeters })
+		for _, rider := range riders {
+			if _, err := tx.Exec(`
+				UPDATE students SET position_number = $1 WHERE student_id = $2 AND route_id = $3
+			`, position, rider.StudentID, opt.Params.RouteID); err != nil {
+				return err
+			}
+			position++
+		}
+	}
+	return tx.Commit()
+}
@@ -13,12 +13,14 @@ type ScheduledExport struct {
 	ID         int        `json:"id" db:"id"`
 	Name       string     `json:"name" db:"name"`
 	ExportType string     `json:"export_type" db:"export_type"`
-	Schedule   string     `json:"schedule" db:"schedule"`         // daily, weekly, monthly
+	Schedule   string     `json:"schedule" db:"schedule"`         // daily, weekly, monthly, cron
 	DayOfWeek  int        `json:"day_of_week" db:"day_of_week"`   // 0-6 for weekly
 	DayOfMonth int        `json:"day_of_month" db:"day_of_month"` // 1-31 for monthly
 	Time       string     `json:"time" db:"time"`                 // HH:MM format
-	Format     string     `json:"format" db:"format"`             // xlsx, csv
-	Recipients string     `json:"recipients" db:"recipients"`     // comma-separated emails
+	CronExpr   string     `json:"cron_expression" db:"cron_expression"`
+	Timezone   string     `json:"timezone" db:"timezone"`     // IANA name, empty for server local
+	Format     string     `json:"format" db:"format"`         // xlsx, csv
+	Recipients string     `json:"recipients" db:"recipients"` // comma-separated emails
 	Enabled    bool       `json:"enabled" db:"enabled"`
 	LastRun    *time.Time `json:"last_run" db:"last_run"`
 	NextRun    time.Time  `json:"next_run" db:"next_run"`
@@ -27,6 +29,33 @@ type ScheduledExport struct {
 	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
 }
 
+// scheduledExportFormats are the file formats a schedule can deliver
+var scheduledExportFormats = []string{"xlsx", "csv"}
+
+func validExportFormat(format string) bool {
+	for _, f := range scheduledExportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledExportRun records one execution of a scheduled export
+type ScheduledExportRun struct {
+	ID         int        `json:"id" db:"id"`
+	ExportID   int        `json:"export_id" db:"export_id"`
+	ExportName string     `json:"export_name" db:"export_name"`
+	Trigger    string     `json:"trigger" db:"trigger"` // scheduled, manual
+	Status     string     `json:"status" db:"status"`   // running, success, failed
+	Filename   string     `json:"filename" db:"filename"`
+	SizeBytes  int64      `json:"size_bytes" db:"size_bytes"`
+	Recipients string     `json:"recipients" db:"recipients"`
+	Error      string     `json:"error" db:"error"`
+	StartedAt  time.Time  `json:"started_at" db:"started_at"`
+	FinishedAt *time.Time `json:"finished_at" db:"finished_at"`
+}
+
 // scheduledExportsHandler manages scheduled exports
 func scheduledExportsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -39,8 +68,14 @@ func scheduledExportsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		runs, err := getScheduledExportRuns(50)
+		if err != nil {
+			LogRequest(r).Error("Failed to get scheduled export runs", err)
+		}
+
 		renderTemplate(w, r, "scheduled_exports.html", map[string]interface{}{
 			"Exports": exports,
+			"Runs":    runs,
 		})
 
 	case "POST":
@@ -61,6 +96,13 @@ func scheduledExportsHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Sscanf(r.FormValue("day_of_week"), "%d", &export.DayOfWeek)
 		} else if export.Schedule == "monthly" {
 			fmt.Sscanf(r.FormValue("day_of_month"), "%d", &export.DayOfMonth)
+		} else if export.Schedule == "cron" {
+			export.CronExpr = strings.TrimSpace(r.FormValue("cron_expression"))
+		}
+		export.Timezone = strings.TrimSpace(r.FormValue("timezone"))
+		if !validExportFormat(export.Format) {
+			SendError(w, ErrBadRequest("Format must be xlsx or csv"))
+			return
 		}
 
 		// Set creator
@@ -69,11 +111,17 @@ func scheduledExportsHandler(w http.ResponseWriter, r *http.Request) {
 			export.CreatedBy = user.Username
 		}
 
-		// Calculate next run time
-		export.NextRun = calculateNextRun(export)
+		// Calculate next run time; this also validates the cron expression
+		// and timezone
+		nextRun, err := calculateNextRun(export, time.Now())
+		if err != nil {
+			SendError(w, ErrBadRequest(err.Error()))
+			return
+		}
+		export.NextRun = nextRun
 
 		// Save to database
-		err := createScheduledExport(&export)
+		err = createScheduledExport(&export)
 		if err != nil {
 			LogRequest(r).Error("Failed to create scheduled export", err)
 			SendError(w, ErrInternal("Failed to create scheduled export", err))
@@ -119,8 +167,8 @@ func scheduledExportEditHandler(w http.ResponseWriter, r *http.Request) {
 			"CSRFToken": getSessionCSRFToken(r),
 			"Export":    export,
 			"ExportTypes": []string{"fleet", "students", "maintenance", "mileage", "ecse"},
-			"Schedules":   []string{"daily", "weekly", "monthly"},
-			"Formats":     []string{"xlsx", "csv", "pdf"},
+			"Schedules":   []string{"daily", "weekly", "monthly", "cron"},
+			"Formats":     scheduledExportFormats,
 		}
 
 		renderTemplate(w, r, "scheduled_export_edit.html", data)
@@ -143,14 +191,26 @@ func scheduledExportEditHandler(w http.ResponseWriter, r *http.Request) {
 		export.Enabled = r.FormValue("enabled") == "on"
 
 		// Update schedule-specific fields
+		export.CronExpr = ""
 		if export.Schedule == "weekly" {
 			fmt.Sscanf(r.FormValue("day_of_week"), "%d", &export.DayOfWeek)
 		} else if export.Schedule == "monthly" {
 			fmt.Sscanf(r.FormValue("day_of_month"), "%d", &export.DayOfMonth)
+		} else if export.Schedule == "cron" {
+			export.CronExpr = strings.TrimSpace(r.FormValue("cron_expression"))
+		}
+		export.Timezone = strings.TrimSpace(r.FormValue("timezone"))
+		if !validExportFormat(export.Format) {
+			SendError(w, ErrBadRequest("Format must be xlsx or csv"))
+			return
 		}
 
 		// Recalculate next run time
-		export.NextRun = calculateNextRun(*export)
+		export.NextRun, err = calculateNextRun(*export, time.Now())
+		if err != nil {
+			SendError(w, ErrBadRequest(err.Error()))
+			return
+		}
 
 		// Save changes
 		err = updateScheduledExport(export)
@@ -207,7 +267,7 @@ func scheduledExportRunHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Run the export
-	err = runScheduledExport(export)
+	err = runScheduledExport(export, "manual")
 	if err != nil {
 		LogRequest(r).Error("Failed to run scheduled export", err)
 		SendError(w, ErrInternal("Failed to run export", err))
@@ -227,8 +287,9 @@ func scheduledExportRunHandler(w http.ResponseWriter, r *http.Request) {
 func getScheduledExports() ([]ScheduledExport, error) {
 	query := `
 		SELECT id, name, export_type, schedule, day_of_week, day_of_month, 
-		       time, format, recipients, enabled, last_run, next_run, 
-		       created_by, created_at, updated_at
+		       time, COALESCE(cron_expression, '') AS cron_expression,
+		       COALESCE(timezone, '') AS timezone, format, recipients, enabled,
+		       last_run, next_run, created_by, created_at, updated_at
 		FROM scheduled_exports
 		ORDER BY name
 	`
@@ -242,8 +303,9 @@ func getScheduledExport(id int) (*ScheduledExport, error) {
 	var export ScheduledExport
 	query := `
 		SELECT id, name, export_type, schedule, day_of_week, day_of_month, 
-		       time, format, recipients, enabled, last_run, next_run, 
-		       created_by, created_at, updated_at
+		       time, COALESCE(cron_expression, '') AS cron_expression,
+		       COALESCE(timezone, '') AS timezone, format, recipients, enabled,
+		       last_run, next_run, created_by, created_at, updated_at
 		FROM scheduled_exports
 		WHERE id = $1
 	`
@@ -256,15 +318,18 @@ func createScheduledExport(export *ScheduledExport) error {
 	query := `
 		INSERT INTO scheduled_exports 
 		(name, export_type, schedule, day_of_week, day_of_month, time, 
-		 format, recipients, enabled, next_run, created_by, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		 format, recipients, enabled, next_run, created_by, cron_expression, timezone,
+		 created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''),
+		        CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 		RETURNING id
 	`
 
 	return db.QueryRow(query,
 		export.Name, export.ExportType, export.Schedule, export.DayOfWeek,
 		export.DayOfMonth, export.Time, export.Format, export.Recipients,
-		export.Enabled, export.NextRun, export.CreatedBy).Scan(&export.ID)
+		export.Enabled, export.NextRun, export.CreatedBy, export.CronExpr,
+		export.Timezone).Scan(&export.ID)
 }
 
 func updateScheduledExport(export *ScheduledExport) error {
@@ -272,14 +337,16 @@ func updateScheduledExport(export *ScheduledExport) error {
 		UPDATE scheduled_exports 
 		SET name = $2, export_type = $3, schedule = $4, day_of_week = $5, 
 		    day_of_month = $6, time = $7, format = $8, recipients = $9, 
-		    enabled = $10, next_run = $11, updated_at = CURRENT_TIMESTAMP
+		    enabled = $10, next_run = $11, cron_expression = NULLIF($12, ''),
+		    timezone = NULLIF($13, ''), updated_at = CURRENT_TIMESTAMP
 		WHERE id = $1
 	`
 
 	_, err := db.Exec(query,
 		export.ID, export.Name, export.ExportType, export.Schedule,
 		export.DayOfWeek, export.DayOfMonth, export.Time, export.Format,
-		export.Recipients, export.Enabled, export.NextRun)
+		export.Recipients, export.Enabled, export.NextRun, export.CronExpr,
+		export.Timezone)
 	return err
 }
 
@@ -288,98 +355,277 @@ func deleteScheduledExport(id int) error {
 	return err
 }
 
-// calculateNextRun calculates the next run time for a scheduled export
-func calculateNextRun(export ScheduledExport) time.Time {
-	now := time.Now()
+func startScheduledExportRun(export *ScheduledExport, trigger string) (int, error) {
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO scheduled_export_runs (export_id, trigger, status, recipients, started_at)
+		VALUES ($1, $2, 'running', $3, CURRENT_TIMESTAMP)
+		RETURNING id
+	`, export.ID, trigger, export.Recipients).Scan(&id)
+	return id, err
+}
+
+func finishScheduledExportRun(id int, filename string, size int, runErr error) error {
+	status, errText := "success", ""
+	if runErr != nil {
+		status, errText = "failed", runErr.Error()
+	}
+
+	_, err := db.Exec(`
+		UPDATE scheduled_export_runs
+		SET status = $2, filename = $3, size_bytes = $4, error = NULLIF($5, ''),
+		    finished_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, status, filename, size, errText)
+	return err
+}
+
+func getScheduledExportRuns(limit int) ([]ScheduledExportRun, error) {
+	query := `
+		SELECT r.id, r.export_id, e.name AS export_name, r.trigger, r.status,
+		       COALESCE(r.filename, '') AS filename, COALESCE(r.size_bytes, 0) AS size_bytes,
+		       COALESCE(r.recipients, '') AS recipients, COALESCE(r.error, '') AS error,
+		       r.started_at, r.finished_at
+		FROM scheduled_export_runs r
+		JOIN scheduled_exports e ON e.id = r.export_id
+		ORDER BY r.started_at DESC
+		LIMIT $1
+	`
+
+	var runs []ScheduledExportRun
+	err := db.Select(&runs, query, limit)
+	return runs, err
+}
+
+// exportLocation resolves the export's timezone, falling back to the
+// server's local zone when none is set
+func exportLocation(export ScheduledExport) (*time.Location, error) {
+	if export.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(export.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", export.Timezone)
+	}
+	return loc, nil
+}
+
+// calculateNextRun returns the first run strictly after the given time,
+// evaluated in the export's timezone
+func calculateNextRun(export ScheduledExport, after time.Time) (time.Time, error) {
+	loc, err := exportLocation(export)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := after.In(loc)
+
+	if export.Schedule == "cron" {
+		sched, err := ParseCron(export.CronExpr)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid cron expression: %v", err)
+		}
+		next := sched.Next(now)
+		if next.IsZero() {
+			return time.Time{}, fmt.Errorf("cron expression %q never matches", export.CronExpr)
+		}
+		return next, nil
+	}
 
 	// Parse the time
-	timeParts := strings.Split(export.Time, ":")
-	hour, minute := 0, 0
-	if len(timeParts) == 2 {
-		fmt.Sscanf(timeParts[0], "%d", &hour)
-		fmt.Sscanf(timeParts[1], "%d", &minute)
+	var hour, minute int
+	if _, err := fmt.Sscanf(export.Time, "%d:%d", &hour, &minute); err != nil ||
+		hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return time.Time{}, fmt.Errorf("invalid time %q (expected HH:MM)", export.Time)
 	}
 
 	switch export.Schedule {
 	case "daily":
-		// Next occurrence of the specified time
-		next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
-		if next.Before(now) {
-			next = next.AddDate(0, 0, 1)
+		next := wallClockTime(now.Year(), now.Month(), now.Day(), hour, minute, loc)
+		if !next.After(now) {
+			next = wallClockTime(now.Year(), now.Month(), now.Day()+1, hour, minute, loc)
 		}
-		return next
+		return next, nil
 
 	case "weekly":
-		// Next occurrence of the specified day and time
+		if export.DayOfWeek < 0 || export.DayOfWeek > 6 {
+			return time.Time{}, fmt.Errorf("invalid day of week %d", export.DayOfWeek)
+		}
 		daysUntil := (export.DayOfWeek - int(now.Weekday()) + 7) % 7
-		if daysUntil == 0 {
-			// Today is the day, check time
-			next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
-			if next.After(now) {
-				return next
-			}
-			daysUntil = 7
+		next := wallClockTime(now.Year(), now.Month(), now.Day()+daysUntil, hour, minute, loc)
+		if !next.After(now) {
+			next = wallClockTime(now.Year(), now.Month(), now.Day()+daysUntil+7, hour, minute, loc)
 		}
-		return time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location()).AddDate(0, 0, daysUntil)
+		return next, nil
 
 	case "monthly":
-		// Next occurrence of the specified day of month and time
-		next := time.Date(now.Year(), now.Month(), export.DayOfMonth, hour, minute, 0, 0, now.Location())
-		if next.Before(now) {
-			next = next.AddDate(0, 1, 0)
+		if export.DayOfMonth < 1 || export.DayOfMonth > 31 {
+			return time.Time{}, fmt.Errorf("invalid day of month %d", export.DayOfMonth)
 		}
-		return next
+		next := monthlyRun(now.Year(), now.Month(), export.DayOfMonth, hour, minute, loc)
+		if !next.After(now) {
+			next = monthlyRun(now.Year(), now.Month()+1, export.DayOfMonth, hour, minute, loc)
+		}
+		return next, nil
 
 	default:
-		return now.AddDate(0, 0, 1) // Default to tomorrow
+		return time.Time{}, fmt.Errorf("unknown schedule %q", export.Schedule)
+	}
+}
+
+// monthlyRun builds the run time for a day of month, clamping to the last
+// day so the 31st means "end of month" rather than spilling into the next one
+func monthlyRun(year int, month time.Month, day, hour, minute int, loc *time.Location) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return wallClockTime(first.Year(), first.Month(), day, hour, minute, loc)
+}
+
+// runScheduledExport executes a scheduled export, emails the file to its
+// recipients and records the outcome in scheduled_export_runs
+func runScheduledExport(export *ScheduledExport, trigger string) error {
+	runID, err := startScheduledExportRun(export, trigger)
+	if err != nil {
+		LogError("Failed to record scheduled export run", err)
+	}
+
+	data, filename, runErr := generateScheduledExport(export)
+	if runErr == nil {
+		runErr = emailScheduledExport(export, filename, data)
+	}
+
+	if runID != 0 {
+		if err := finishScheduledExportRun(runID, filename, len(data), runErr); err != nil {
+			LogError("Failed to update scheduled export run", err)
+		}
+	}
+
+	if runErr == nil {
+		LogInfo("Scheduled export completed: " + export.Name + " (" + filename + ") - " + fmt.Sprintf("%d bytes", len(data)))
 	}
+
+	// next_run is advanced by claimDueScheduledExports, not here
+	_, err = db.Exec("UPDATE scheduled_exports SET last_run = CURRENT_TIMESTAMP WHERE id = $1", export.ID)
+	if err != nil && runErr == nil {
+		return fmt.Errorf("failed to update last run time: %v", err)
+	}
+
+	return runErr
 }
 
-// runScheduledExport executes a scheduled export
-func runScheduledExport(export *ScheduledExport) error {
-	// Generate the export based on type
+// generateScheduledExport builds the export file for a schedule
+func generateScheduledExport(export *ScheduledExport) ([]byte, string, error) {
+	// Schedules saved before formats were checked may name one we can't
+	// build; fail the run rather than send something else
+	format := export.Format
+	if !validExportFormat(format) {
+		return nil, "", fmt.Errorf("export format %q isn't supported", format)
+	}
+
 	var data []byte
 	var filename string
 	var err error
 
 	switch export.ExportType {
 	case "mileage":
-		data, filename, err = generateMileageExport(export.Format)
+		data, filename, err = generateMileageExport(format)
 	case "students":
-		data, filename, err = generateStudentExport(export.Format)
-	case "vehicles":
-		data, filename, err = generateVehicleExport(export.Format)
+		data, filename, err = generateStudentExport(format)
+	case "vehicles", "fleet":
+		data, filename, err = generateVehicleExport(format)
 	case "maintenance":
-		data, filename, err = generateMaintenanceExport(export.Format)
+		data, filename, err = generateMaintenanceExport(format)
 	default:
-		return fmt.Errorf("unknown export type: %s", export.ExportType)
+		return nil, "", fmt.Errorf("unknown export type: %s", export.ExportType)
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to generate export: %v", err)
+		return nil, "", fmt.Errorf("failed to generate export: %v", err)
 	}
+	return data, filename, nil
+}
 
-	// Send email with attachment
-	recipients := strings.Split(export.Recipients, ",")
-	for i, r := range recipients {
-		recipients[i] = strings.TrimSpace(r)
+// emailScheduledExport sends the generated file to the export's recipients
+func emailScheduledExport(export *ScheduledExport, filename string, data []byte) error {
+	recipients, err := parseEmailRecipients(export.Recipients)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		// Blank recipients means the export is generated but not mailed
+		return nil
 	}
 
-	// In a real implementation, send email with attachment
-	// For now, just log it
-	LogInfo("Scheduled export completed: " + export.Name + " (" + filename + ") - " + fmt.Sprintf("%d bytes", len(data)))
+	cfg := emailConfigFromEnv()
+	if notificationSystem != nil {
+		cfg = notificationSystem.emailConfig
+	}
 
-	// Update last run time
-	_, err = db.Exec("UPDATE scheduled_exports SET last_run = CURRENT_TIMESTAMP WHERE id = $1", export.ID)
+	subject := fmt.Sprintf("Scheduled export: %s", export.Name)
+	body := fmt.Sprintf("The %s %s export \"%s\" ran on %s.\n\n"+
+		"The file %s (%d bytes) is attached.\n\n"+
+		"Manage scheduled exports at /export/scheduled.\n",
+		export.Schedule, export.ExportType, export.Name,
+		time.Now().Format("Jan 2, 2006 3:04 PM"), filename, len(data))
+
+	return sendEmailWithAttachments(cfg, recipients, subject, body, []EmailAttachment{
+		{Filename: filename, Data: data},
+	})
+}
+
+// claimDueScheduledExports locks the exports that are due and moves their
+// next_run forward in the same transaction. Rows locked by another instance
+// are skipped, so each slot is dispatched exactly once across the cluster.
+// The schedule advances before the export runs, which also keeps a failing
+// export from being retried every minute.
+func claimDueScheduledExports() ([]ScheduledExport, error) {
+	tx, err := db.Beginx()
 	if err != nil {
-		return fmt.Errorf("failed to update last run time: %v", err)
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	// Calculate and update next run time
-	export.NextRun = calculateNextRun(*export)
-	_, err = db.Exec("UPDATE scheduled_exports SET next_run = $2 WHERE id = $1", export.ID, export.NextRun)
+	var exports []ScheduledExport
+	err = tx.Select(&exports, `
+		SELECT id, name, export_type, schedule, day_of_week, day_of_month,
+		       time, COALESCE(cron_expression, '') AS cron_expression,
+		       COALESCE(timezone, '') AS timezone, format, recipients, enabled,
+		       last_run, next_run, created_by, created_at, updated_at
+		FROM scheduled_exports
+		WHERE enabled = true AND next_run <= CURRENT_TIMESTAMP
+		ORDER BY next_run
+		LIMIT 20
+		FOR UPDATE SKIP LOCKED
+	`)
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	now := time.Now()
+	claimed := exports[:0]
+	for _, export := range exports {
+		next, calcErr := calculateNextRun(export, now)
+		if calcErr != nil {
+			// Bad data (e.g. a timezone missing on this host); check again
+			// in an hour instead of on every tick
+			LogError("Failed to schedule export "+export.Name, calcErr)
+			next = now.Add(time.Hour)
+		}
+		if _, err := tx.Exec("UPDATE scheduled_exports SET next_run = $2 WHERE id = $1", export.ID, next); err != nil {
+			return nil, err
+		}
+		if calcErr == nil {
+			export.NextRun = next
+			claimed = append(claimed, export)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return claimed, nil
 }
 
 // Background job to run scheduled exports
@@ -388,26 +634,16 @@ func runScheduledExportsJob() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		// Get exports due to run
-		query := `
-			SELECT id, name, export_type, schedule, day_of_week, day_of_month, 
-			       time, format, recipients, enabled, last_run, next_run, 
-			       created_by, created_at, updated_at
-			FROM scheduled_exports
-			WHERE enabled = true AND next_run <= CURRENT_TIMESTAMP
-		`
-
-		var exports []ScheduledExport
-		err := db.Select(&exports, query)
+		exports, err := claimDueScheduledExports()
 		if err != nil {
-			LogError("Failed to get due exports", err)
+			LogError("Failed to claim due exports", err)
 			continue
 		}
 
-		// Run each due export
+		// Run each claimed export
 		for _, export := range exports {
 			go func(e ScheduledExport) {
-				if err := runScheduledExport(&e); err != nil {
+				if err := runScheduledExport(&e, "scheduled"); err != nil {
 					LogError("Failed to run scheduled export", err)
 				}
 			}(export)
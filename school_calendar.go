@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Calendar day types
+const (
+	DayTypeSchool       = "school_day"
+	DayTypeNoSchool     = "no_school"
+	DayTypeEarlyRelease = "early_release"
+	DayTypeLateStart    = "late_start"
+	DayTypeClosure      = "closure"
+)
+
+var calendarDayTypes = map[string]string{
+	DayTypeSchool:       "School day",
+	DayTypeNoSchool:     "No school",
+	DayTypeEarlyRelease: "Early release",
+	DayTypeLateStart:    "Late start",
+	DayTypeClosure:      "Closure",
+}
+
+// CalendarDay is an entry on the district calendar (SchoolID 0) or a
+// school's own calendar. Dates without one follow the usual week.
+type CalendarDay struct {
+	ID           int            `db:"id"`
+	SchoolID     int            `db:"school_id"`
+	SchoolName   string         `db:"school_name"`
+	Date         time.Time      `db:"date"`
+	DayType      string         `db:"day_type"`
+	Name         string         `db:"name"`
+	ShiftMinutes int            `db:"shift_minutes"`
+	Source       string         `db:"source"`
+	ICSUID       sql.NullString `db:"ics_uid"`
+	CreatedBy    sql.NullString `db:"created_by"`
+	CreatedAt    time.Time      `db:"created_at"`
+}
+
+// TypeLabel is the day type as people read it
+func (d CalendarDay) TypeLabel() string {
+	return calendarDayTypes[d.DayType]
+}
+
+// ServiceDay is what a date means for the buses serving a school
+type ServiceDay struct {
+	Date         time.Time
+	Type         string
+	Name         string
+	ShiftMinutes int
+}
+
+// Running reports whether buses run at all
+func (d ServiceDay) Running() bool {
+	return d.Type != DayTypeNoSchool && d.Type != DayTypeClosure
+}
+
+// Shift is how far the period's times move: afternoon runs leave early on
+// an early-release day and morning runs late on a late-start day
+func (d ServiceDay) Shift(period string) time.Duration {
+	switch {
+	case d.Type == DayTypeEarlyRelease && period == "afternoon":
+		return -time.Duration(d.ShiftMinutes) * time.Minute
+	case d.Type == DayTypeLateStart && period == "morning":
+		return time.Duration(d.ShiftMinutes) * time.Minute
+	}
+	return 0
+}
+
+// Note describes a day that isn't an ordinary school day, for banners and
+// reminders. It's empty for ordinary days.
+func (d ServiceDay) Note() string {
+	name := ""
+	if d.Name != "" {
+		name = " (" + d.Name + ")"
+	}
+	switch d.Type {
+	case DayTypeNoSchool, DayTypeClosure:
+		return fmt.Sprintf("%s%s: no bus service", calendarDayTypes[d.Type], name)
+	case DayTypeEarlyRelease:
+		return fmt.Sprintf("Early release%s: afternoon runs %d minutes early", name, d.ShiftMinutes)
+	case DayTypeLateStart:
+		return fmt.Sprintf("Late start%s: morning runs %d minutes late", name, d.ShiftMinutes)
+	}
+	return ""
+}
+
+// ServiceCalendar answers what each date means for each route over a span
+// of dates
+type ServiceCalendar struct {
+	days         map[int]map[string]CalendarDay
+	routeSchools map[string]int
+}
+
+// loadServiceCalendar loads the calendar entries between two dates and
+// which school each route serves
+func loadServiceCalendar(from, to time.Time) (*ServiceCalendar, error) {
+	cal := &ServiceCalendar{
+		days:         make(map[int]map[string]CalendarDay),
+		routeSchools: make(map[string]int),
+	}
+
+	var days []CalendarDay
+	if err := db.Select(&days, `
+		SELECT id, school_id, '' AS school_name, date, day_type, name, shift_minutes,
+			source, ics_uid, created_by, created_at
+		FROM calendar_days
+		WHERE date BETWEEN $1 AND $2
+	`, from.Format("2006-01-02"), to.Format("2006-01-02")); err != nil {
+		return nil, err
+	}
+	for _, d := range days {
+		if cal.days[d.SchoolID] == nil {
+			cal.days[d.SchoolID] = make(map[string]CalendarDay)
+		}
+		cal.days[d.SchoolID][d.Date.Format("2006-01-02")] = d
+	}
+
+	var routes []struct {
+		RouteID  string `db:"route_id"`
+		SchoolID int    `db:"school_id"`
+	}
+	if err := db.Select(&routes, `SELECT route_id, COALESCE(school_id, 0) AS school_id FROM routes`); err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		cal.routeSchools[r.RouteID] = r.SchoolID
+	}
+	return cal, nil
+}
+
+// Day resolves a date for a school: the school's own entry, then the
+// district's, then weekdays are school days and weekends aren't
+func (c *ServiceCalendar) Day(date time.Time, schoolID int) ServiceDay {
+	key := date.Format("2006-01-02")
+	entry, ok := c.days[schoolID][key]
+	if !ok {
+		entry, ok = c.days[0][key]
+	}
+	if ok {
+		return ServiceDay{Date: date, Type: entry.DayType, Name: entry.Name, ShiftMinutes: entry.ShiftMinutes}
+	}
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		return ServiceDay{Date: date, Type: DayTypeNoSchool, Name: "Weekend"}
+	}
+	return ServiceDay{Date: date, Type: DayTypeSchool}
+}
+
+// RouteDay resolves a date for the school a route serves
+func (c *ServiceCalendar) RouteDay(routeID string, date time.Time) ServiceDay {
+	return c.Day(date, c.routeSchools[routeID])
+}
+
+// ServiceDays counts the days buses run for a school between two dates,
+// inclusive
+func (c *ServiceCalendar) ServiceDays(from, to time.Time, schoolID int) int {
+	count := 0
+	for d := dateOnly(from); !d.After(dateOnly(to)); d = d.AddDate(0, 0, 1) {
+		if c.Day(d, schoolID).Running() {
+			count++
+		}
+	}
+	return count
+}
+
+// RouteServiceDays counts the days a route runs between two dates
+func (c *ServiceCalendar) RouteServiceDays(routeID string, from, to time.Time) int {
+	return c.ServiceDays(from, to, c.routeSchools[routeID])
+}
+
+// dateOnly drops the time of day
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// serviceCalendarFor loads the calendar for a span, falling back to the
+// usual week if it can't be read so schedules keep working
+func serviceCalendarFor(from, to time.Time) *ServiceCalendar {
+	cal, err := loadServiceCalendar(from, to)
+	if err != nil {
+		log.Printf("Failed to load school calendar: %v", err)
+		return &ServiceCalendar{days: map[int]map[string]CalendarDay{}, routeSchools: map[string]int{}}
+	}
+	return cal
+}
+
+// routeServiceDay is what a date means for one route
+func routeServiceDay(routeID string, date time.Time) ServiceDay {
+	return serviceCalendarFor(date, date).RouteDay(routeID, date)
+}
+
+// shiftClock moves a HH:MM or HH:MM:SS time of day, keeping its layout.
+// Times that can't be read are returned unchanged.
+func shiftClock(clock string, shift time.Duration) string {
+	if shift == 0 {
+		return clock
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, clock); err == nil {
+			return t.Add(shift).Format(layout)
+		}
+	}
+	return clock
+}
+
+// shiftStudentTimes applies the day's early release or late start to the
+// students' pickup and drop-off times
+func (d ServiceDay) shiftStudentTimes(students []Student) {
+	for i := range students {
+		students[i].PickupTime = shiftClock(students[i].PickupTime, d.Shift("morning"))
+		students[i].DropoffTime = shiftClock(students[i].DropoffTime, d.Shift("afternoon"))
+	}
+}
+
+// saveCalendarDay adds or replaces the entry for a school and date. ICS
+// imports only replace what an earlier import wrote, so days entered by
+// hand survive a re-import.
+func saveCalendarDay(d CalendarDay) (bool, error) {
+	if _, ok := calendarDayTypes[d.DayType]; !ok {
+		return false, fmt.Errorf("invalid day type %q", d.DayType)
+	}
+	onlyImports := ""
+	if d.Source == "ics" {
+		onlyImports = "WHERE calendar_days.source = 'ics'"
+	}
+	result, err := db.Exec(`
+		INSERT INTO calendar_days (school_id, date, day_type, name, shift_minutes, source, ics_uid, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (school_id, date) DO UPDATE SET
+			day_type = EXCLUDED.day_type,
+			name = EXCLUDED.name,
+			shift_minutes = EXCLUDED.shift_minutes,
+			source = EXCLUDED.source,
+			ics_uid = EXCLUDED.ics_uid,
+			created_by = EXCLUDED.created_by,
+			created_at = CURRENT_TIMESTAMP
+		`+onlyImports,
+		d.SchoolID, d.Date.Format("2006-01-02"), d.DayType, d.Name, d.ShiftMinutes,
+		d.Source, d.ICSUID, d.CreatedBy)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// icsEvent is a VEVENT from an iCalendar file
+type icsEvent struct {
+	UID       string
+	Summary   string
+	Start     time.Time
+	End       time.Time
+	AllDay    bool
+	Recurring bool
+}
+
+// Dates lists the days the event covers. An all-day DTEND is the day
+// after the last one.
+func (e icsEvent) Dates() []time.Time {
+	first, last := dateOnly(e.Start), dateOnly(e.Start)
+	if !e.End.IsZero() && e.End.After(e.Start) {
+		last = dateOnly(e.End)
+		if e.AllDay || e.End.Equal(last) {
+			last = last.AddDate(0, 0, -1)
+		}
+	}
+	var dates []time.Time
+	for d := first; !d.After(last) && len(dates) <= 366; d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
+	}
+	return dates
+}
+
+// parseICS reads the events from an iCalendar file. Only what a school
+// calendar needs is read: the dates, summary and UID.
+func parseICS(r io.Reader) ([]icsEvent, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	// Long lines are folded onto continuation lines starting with a space
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []icsEvent
+	var current *icsEvent
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		nameAndParams, value := line[:colon], line[colon+1:]
+		parts := strings.Split(nameAndParams, ";")
+		name := strings.ToUpper(parts[0])
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			current = &icsEvent{}
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			if current != nil && !current.Start.IsZero() {
+				events = append(events, *current)
+			}
+			current = nil
+		case current == nil:
+		case name == "UID":
+			current.UID = value
+		case name == "SUMMARY":
+			current.Summary = unescapeICS(value)
+		case name == "RRULE":
+			current.Recurring = true
+		case name == "DTSTART" || name == "DTEND":
+			t, allDay, err := parseICSTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("event %q: %v", current.Summary, err)
+			}
+			if name == "DTSTART" {
+				current.Start, current.AllDay = t, allDay
+			} else {
+				current.End = t
+			}
+		}
+	}
+	return events, nil
+}
+
+// parseICSTime reads a DATE or DATE-TIME value. UTC times are moved to
+// local time; zoned times are taken as local.
+func parseICSTime(value string) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t.In(time.Local), false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, time.Local)
+	return t, false, err
+}
+
+func unescapeICS(value string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+var (
+	icsEarlyRelease = icsPhrases("early release", "early dismissal", "early out", "half day", "half-day", "minimum day")
+	icsLateStart    = icsPhrases("late start", "delayed start", "delayed opening", "late arrival", "two-hour delay", "2 hour delay")
+	icsSchoolDay    = icsPhrases("first day", "last day", "make-up day", "makeup day", "school day", "school resumes",
+		"classes resume", "students return", "back to school")
+	icsNoSchool = icsPhrases("no school", "holiday", "break", "recess", "vacation", "closed", "no students",
+		"teacher work", "professional development", "in-service", "inservice", "staff development", "day off")
+	// Said outright, or "first day of winter break", which is a day off
+	// despite starting like a school-day phrase
+	icsPlainlyOff = regexp.MustCompile(`\bno (?:school|students|classes)\b|\b(?:first|last) day of (?:\w+ )?(?:break|recess|vacation|holidays?)\b`)
+	icsShift      = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*-?\s*(hours?|hrs?|minutes?|mins?)\b`)
+)
+
+// icsPhrases matches any of the phrases as whole words, so "break" finds
+// "winter break" but not "breakfast with the board"
+func icsPhrases(phrases ...string) *regexp.Regexp {
+	quoted := make([]string, len(phrases))
+	for i, p := range phrases {
+		quoted[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile(`\b(?:` + strings.Join(quoted, "|") + `)s?\b`)
+}
+
+// classifyICSEvent decides what kind of day an event's summary describes.
+// Events that aren't about whether or when school runs, like a board
+// meeting, aren't imported. Phrases that put students back in school are
+// checked before the closure words, since "classes resume after winter
+// break" names both.
+func classifyICSEvent(summary string) (string, bool) {
+	s := strings.ToLower(summary)
+	if icsPlainlyOff.MatchString(s) {
+		return DayTypeNoSchool, true
+	}
+	for _, group := range []struct {
+		dayType string
+		pattern *regexp.Regexp
+	}{
+		{DayTypeEarlyRelease, icsEarlyRelease},
+		{DayTypeLateStart, icsLateStart},
+		{DayTypeSchool, icsSchoolDay},
+		{DayTypeNoSchool, icsNoSchool},
+	} {
+		if group.pattern.MatchString(s) {
+			return group.dayType, true
+		}
+	}
+	return "", false
+}
+
+// icsShiftMinutes reads a shift like "2 hour" or "90 min" from a summary,
+// or returns the fallback
+func icsShiftMinutes(summary string, fallback int) int {
+	m := icsShift.FindStringSubmatch(strings.ToLower(summary))
+	if m == nil {
+		return fallback
+	}
+	amount, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || amount <= 0 {
+		return fallback
+	}
+	if strings.HasPrefix(m[2], "h") {
+		amount *= 60
+	}
+	if amount > 480 {
+		return fallback
+	}
+	return int(amount)
+}
+
+// CalendarImport reports what an ICS import did
+type CalendarImport struct {
+	Events    int
+	Saved     int
+	Kept      int
+	Skipped   []string
+	Recurring []string
+}
+
+// importICSCalendar saves the school-day events from an iCalendar file to
+// the district or a school calendar. Ranges are saved a day at a time, and
+// for a range only weekdays, since weekends already have no service.
+func importICSCalendar(r io.Reader, schoolID, defaultShift int, importedBy string) (*CalendarImport, error) {
+	events, err := parseICS(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CalendarImport{Events: len(events)}
+	for _, event := range events {
+		dayType, ok := classifyICSEvent(event.Summary)
+		if !ok {
+			result.Skipped = append(result.Skipped, event.Summary)
+			continue
+		}
+		if event.Recurring {
+			// Repeating events are rare on school calendars; only the
+			// first occurrence is imported
+			result.Recurring = append(result.Recurring, event.Summary)
+		}
+		shift := 0
+		if dayType == DayTypeEarlyRelease || dayType == DayTypeLateStart {
+			shift = icsShiftMinutes(event.Summary, defaultShift)
+		}
+
+		dates := event.Dates()
+		for _, date := range dates {
+			weekend := date.Weekday() == time.Saturday || date.Weekday() == time.Sunday
+			if weekend && len(dates) > 1 {
+				continue
+			}
+			saved, err := saveCalendarDay(CalendarDay{
+				SchoolID:     schoolID,
+				Date:         date,
+				DayType:      dayType,
+				Name:         truncateString(event.Summary, 255),
+				ShiftMinutes: shift,
+				Source:       "ics",
+				ICSUID:       sql.NullString{String: event.UID, Valid: event.UID != ""},
+				CreatedBy:    sql.NullString{String: importedBy, Valid: true},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if saved {
+				result.Saved++
+			} else {
+				result.Kept++
+			}
+		}
+	}
+	return result, nil
+}
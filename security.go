@@ -224,6 +224,12 @@ func authenticateUser(username, password string) (*User, error) {
 		}
 	}
 
+	// Locked accounts are refused before the password is even checked
+	if err := userLogins.checkLocked(username); err != nil {
+		log.Printf("Authentication refused for %s: %v", username, err)
+		return nil, err
+	}
+
 	log.Printf("User %s found, checking password (hashed: %v)", username, strings.HasPrefix(user.Password, "$2"))
 
 	// Check if password is hashed (bcrypt hashes start with $2)
@@ -232,12 +238,18 @@ func authenticateUser(username, password string) (*User, error) {
 		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 		if err != nil {
 			log.Printf("Authentication failed for %s: incorrect password", username)
+			if lockErr := userLogins.recordFailure(username); lockErr != nil {
+				return nil, lockErr
+			}
 			return nil, fmt.Errorf("invalid credentials")
 		}
 	} else {
 		// Legacy plain text password (should be migrated)
 		log.Printf("WARNING: User %s has plain text password, needs migration", username)
 		if user.Password != password {
+			if lockErr := userLogins.recordFailure(username); lockErr != nil {
+				return nil, lockErr
+			}
 			return nil, fmt.Errorf("invalid credentials")
 		}
 		// Optionally hash the password here for migration
@@ -271,8 +283,9 @@ func generateCSRFToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-// storeSession stores a session for a user
-func storeSession(token string, user *User) {
+// storeSession stores a session for a user, noting the device it was
+// created from
+func storeSession(token string, user *User, r *http.Request) {
 	// Initialize session manager if not already done
 	if sessionManager == nil {
 		if err := initializeSessionManager(); err != nil {
@@ -290,6 +303,8 @@ func storeSession(token string, user *User) {
 		LastAccess:  time.Now(),
 		ExpiresAt:   time.Now().Add(24 * time.Hour),
 		ImportFiles: make(map[string]string),
+		IPAddress:   truncateString(getClientIP(r), 45),
+		UserAgent:   strings.ToValidUTF8(truncateString(r.UserAgent(), 512), ""),
 	}
 	
 	if err := sessionManager.store.Set(token, session); err != nil {
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// How far the normalizer got with an imported service row
+const (
+	ServiceRowPending  = "pending"
+	ServiceRowMapped   = "mapped"
+	ServiceRowUnmapped = "unmapped"
+	ServiceRowHeader   = "header"
+	ServiceRowBlank    = "blank"
+)
+
+// serviceSheetColumns is how many raw cells the spreadsheet import kept
+const serviceSheetColumns = 14
+
+// The fields a service sheet column can hold
+const (
+	svcDescription = iota
+	svcVehicleNumber
+	svcLocation
+	svcServicedMiles
+	svcCurrentMiles
+	svcDueMiles
+	svcMilesToService
+	svcInterval
+	svcNeedsService
+	svcServiceDate
+	svcYear
+	svcFieldCount
+)
+
+var serviceFieldNames = [svcFieldCount]string{
+	"description", "vehicle_number", "location", "serviced_mileage", "current_mileage",
+	"service_due_mileage", "miles_to_service", "service_interval", "needs_service",
+	"service_date", "year",
+}
+
+// serviceHeaderAliases maps the labels seen on service sheets, normalized
+// by serviceHeaderKey, to the field they name
+var serviceHeaderAliases = map[string]int{
+	"VEH NUMBER": svcVehicleNumber, "VEHICLE NUMBER": svcVehicleNumber, "VEH NO": svcVehicleNumber,
+	"VEHICLE NO": svcVehicleNumber, "VEH": svcVehicleNumber, "UNIT": svcVehicleNumber,
+	"UNIT NUMBER": svcVehicleNumber, "BUS": svcVehicleNumber, "BUS NUMBER": svcVehicleNumber,
+	"VEHICLE": svcDescription, "DESCRIPTION": svcDescription, "MAKE MODEL": svcDescription,
+	"YEAR MAKE MODEL": svcDescription,
+	"LOCATION":        svcLocation, "BASE": svcLocation, "SITE": svcLocation, "PROGRAM": svcLocation,
+	"SERVICED": svcServicedMiles, "SERVICED MILES": svcServicedMiles, "SERVICED MILEAGE": svcServicedMiles,
+	"LAST SERVICE": svcServicedMiles, "LAST SERVICE MILES": svcServicedMiles,
+	"LAST MILEAGE": svcCurrentMiles, "CURRENT MILEAGE": svcCurrentMiles, "CURRENT MILES": svcCurrentMiles,
+	"ODOMETER": svcCurrentMiles, "MILEAGE": svcCurrentMiles,
+	"SERVICE DUE": svcDueMiles, "NEXT SERVICE": svcDueMiles, "DUE AT": svcDueMiles,
+	"SERVICE DUE MILES": svcDueMiles, "NEXT SERVICE MILES": svcDueMiles,
+	"MILES TO SERVICE": svcMilesToService, "MILES UNTIL SERVICE": svcMilesToService, "MILES LEFT": svcMilesToService,
+	"NEEDS SERVICE": svcNeedsService, "NEEDS SERVICES": svcNeedsService, "NEEDS SERVICING": svcNeedsService,
+	"INTERVAL": svcInterval, "SERVICE INTERVAL": svcInterval,
+	"SERVICE AT": svcServiceDate, "SERVICE DATE": svcServiceDate, "DATE SERVICED": svcServiceDate,
+	"LAST SERVICE DATE": svcServiceDate,
+	"YEAR":              svcYear,
+}
+
+var nonAlnum = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// serviceHeaderKey reduces a header label to the form the aliases use;
+// the sheets have "LAST MILAGE" as often as "LAST MILEAGE"
+func serviceHeaderKey(label string) string {
+	key := strings.TrimSpace(nonAlnum.ReplaceAllString(strings.ToUpper(label), " "))
+	return strings.ReplaceAll(key, "MILAGE", "MILEAGE")
+}
+
+// parseSheetInt reads a spreadsheet number, which may carry thousands
+// separators or a trailing ".0" from the export
+func parseSheetInt(cell string) (int, bool) {
+	s := strings.TrimSpace(strings.ReplaceAll(cell, ",", ""))
+	s = strings.TrimSuffix(s, ".0")
+	if s == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+var sheetDateLayouts = []string{
+	"2006-01-02 15:04:05", "2006-01-02", "1/2/2006", "1/2/06", "01/02/2006", "Jan 2, 2006", "January 2, 2006",
+}
+
+// parseSheetDate reads a date cell in any of the formats the exports use
+func parseSheetDate(cell string) (time.Time, bool) {
+	s := strings.TrimSpace(cell)
+	for _, layout := range sheetDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// sheetFlag reads a needs-service cell. The second result is false when
+// the cell says nothing either way.
+func sheetFlag(cell string) (bool, bool) {
+	switch strings.ToUpper(strings.TrimSpace(cell)) {
+	case "Y", "YES", "X", "TRUE", "1", "*", "!", "DUE", "OVERDUE", "NEEDS SERVICE":
+		return true, true
+	case "N", "NO", "FALSE", "0", "OK":
+		return false, true
+	}
+	return false, false
+}
+
+// isServiceHeaderRow spots the label rows a sheet starts with: two or more
+// known labels and nothing that reads as a mileage
+func isServiceHeaderRow(cells []string) bool {
+	labels := 0
+	for _, cell := range cells {
+		if _, ok := serviceHeaderAliases[serviceHeaderKey(cell)]; ok {
+			labels++
+		}
+		if n, ok := parseSheetInt(cell); ok && n > 100 {
+			return false
+		}
+	}
+	return labels >= 2
+}
+
+func isBlankServiceRow(cells []string) bool {
+	for _, cell := range cells {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceLayout says which raw column holds each field of one sheet; -1
+// means the sheet doesn't have it
+type serviceLayout struct {
+	Columns [svcFieldCount]int
+}
+
+// String describes the layout for the provenance column, e.g.
+// "vehicle_number=1 serviced_mileage=3"
+func (l serviceLayout) String() string {
+	var parts []string
+	for f, c := range l.Columns {
+		if c >= 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", serviceFieldNames[f], c))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l serviceLayout) assigned(col int) bool {
+	for _, c := range l.Columns {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// detectServiceLayout works out a sheet's columns from its rows. Header
+// labels are a starting point only: on the imported sheets they sit over
+// the wrong columns, because the spreadsheet merged cells. What settles
+// the mileage columns is the sheet's own arithmetic, since the due mileage
+// is the serviced mileage plus the interval and the miles to service are
+// the due mileage less the current reading.
+func detectServiceLayout(header []string, rows [][]string) serviceLayout {
+	var l serviceLayout
+	for f := range l.Columns {
+		l.Columns[f] = -1
+	}
+	for c, label := range header {
+		if f, ok := serviceHeaderAliases[serviceHeaderKey(label)]; ok && l.Columns[f] < 0 {
+			l.Columns[f] = c
+		}
+	}
+
+	cell := func(row []string, c int) string {
+		if c < len(row) {
+			return strings.TrimSpace(row[c])
+		}
+		return ""
+	}
+	num := func(row []string, c int) (int, bool) { return parseSheetInt(cell(row, c)) }
+
+	// due = serviced + interval. That sum is symmetric, so the interval is
+	// whichever addend has the fewest distinct values.
+	distinct := func(c int) int {
+		seen := map[string]bool{}
+		for _, row := range rows {
+			if v := cell(row, c); v != "" {
+				seen[v] = true
+			}
+		}
+		return len(seen)
+	}
+	bestS, bestD, bestI, bestCount := -1, -1, -1, 0
+	for d := 0; d < serviceSheetColumns; d++ {
+		for s := 0; s < serviceSheetColumns; s++ {
+			for i := 0; i < serviceSheetColumns; i++ {
+				if s == d || i == d || s == i {
+					continue
+				}
+				count := 0
+				for _, row := range rows {
+					sv, ok1 := num(row, s)
+					dv, ok2 := num(row, d)
+					iv, ok3 := num(row, i)
+					if ok1 && ok2 && ok3 && iv > 0 && sv > 0 && dv == sv+iv {
+						count++
+					}
+				}
+				if count > bestCount || (count == bestCount && count > 0 && distinct(i) < distinct(bestI)) {
+					bestS, bestD, bestI, bestCount = s, d, i, count
+				}
+			}
+		}
+	}
+	if bestCount > 0 && bestCount*2 >= len(rows) {
+		l.unassign(bestS, bestD, bestI)
+		l.Columns[svcServicedMiles], l.Columns[svcDueMiles], l.Columns[svcInterval] = bestS, bestD, bestI
+	}
+
+	// to service = due - current, where the current reading is the one that
+	// looks like an odometer next to the serviced mileage
+	if due := l.Columns[svcDueMiles]; due >= 0 {
+		bestC, bestR, bestCount := -1, -1, 0
+		for c := 0; c < serviceSheetColumns; c++ {
+			for r := 0; r < serviceSheetColumns; r++ {
+				if c == r || c == due || r == due || c == l.Columns[svcServicedMiles] || c == l.Columns[svcInterval] ||
+					r == l.Columns[svcServicedMiles] || r == l.Columns[svcInterval] {
+					continue
+				}
+				count, larger := 0, 0
+				for _, row := range rows {
+					cv, ok1 := num(row, c)
+					dv, ok2 := num(row, due)
+					rv, ok3 := num(row, r)
+					if ok1 && ok2 && ok3 && rv == dv-cv {
+						count++
+						if cv > rv {
+							larger++
+						}
+					}
+				}
+				if larger*2 < count {
+					continue
+				}
+				if count > bestCount {
+					bestC, bestR, bestCount = c, r, count
+				}
+			}
+		}
+		if bestCount > 0 && bestCount*2 >= len(rows) {
+			l.unassign(bestC, bestR)
+			l.Columns[svcCurrentMiles], l.Columns[svcMilesToService] = bestC, bestR
+		}
+	}
+
+	// What's left goes by what the columns hold, most particular first.
+	// A header label that doesn't fit its column's contents is dropped.
+	share := func(c int, test func(string) bool) (int, int) {
+		hits, filled := 0, 0
+		for _, row := range rows {
+			if v := cell(row, c); v != "" {
+				filled++
+				if test(v) {
+					hits++
+				}
+			}
+		}
+		return hits, filled
+	}
+	mostly := func(c int, test func(string) bool) bool {
+		hits, filled := share(c, test)
+		return filled > 0 && hits*5 >= filled*4
+	}
+	claim := func(f int, test func(string) bool) {
+		if l.Columns[f] >= 0 {
+			return
+		}
+		for c := 0; c < serviceSheetColumns; c++ {
+			if !l.assigned(c) && mostly(c, test) {
+				l.Columns[f] = c
+				return
+			}
+		}
+	}
+	hasLetter := func(v string) bool {
+		return strings.IndexFunc(v, func(r rune) bool { return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' }) >= 0
+	}
+	isNumber := func(v string) bool { _, ok := parseSheetInt(v); return ok }
+	isDate := func(v string) bool { _, ok := parseSheetDate(v); return ok }
+	isYear := func(v string) bool { n, ok := parseSheetInt(v); return ok && n >= 1950 && n <= 2100 }
+	isFlag := func(v string) bool { _, ok := sheetFlag(v); return ok }
+	unitLike := func(v string) bool {
+		return len(v) <= 12 && !strings.ContainsAny(v, " ") && strings.ContainsAny(v, "0123456789")
+	}
+	startsWithYear := regexp.MustCompile(`^(19|20)\d\d\s`)
+
+	fits := map[int]func(string) bool{
+		svcServicedMiles: isNumber, svcCurrentMiles: isNumber, svcDueMiles: isNumber,
+		svcMilesToService: isNumber, svcInterval: isNumber, svcYear: isYear,
+		svcServiceDate: isDate, svcNeedsService: isFlag, svcVehicleNumber: unitLike,
+	}
+	for f, test := range fits {
+		if c := l.Columns[f]; c >= 0 {
+			if hits, filled := share(c, test); filled > 0 && hits*5 < filled*4 {
+				l.Columns[f] = -1
+			}
+		}
+	}
+
+	claim(svcServiceDate, isDate)
+	claim(svcYear, isYear)
+	claim(svcNeedsService, isFlag)
+	if l.Columns[svcVehicleNumber] < 0 {
+		for c := 0; c < serviceSheetColumns; c++ {
+			if hits, _ := share(c, unitLike); !l.assigned(c) && mostly(c, unitLike) && distinct(c)*5 >= hits*4 {
+				l.Columns[svcVehicleNumber] = c
+				break
+			}
+		}
+	}
+	claim(svcDescription, func(v string) bool { return startsWithYear.MatchString(v) })
+	claim(svcDescription, hasLetter)
+	claim(svcLocation, hasLetter)
+	return l
+}
+
+// unassign clears any field the given columns were given by the header
+func (l *serviceLayout) unassign(cols ...int) {
+	for f, c := range l.Columns {
+		for _, col := range cols {
+			if c == col {
+				l.Columns[f] = -1
+			}
+		}
+	}
+}
+
+// normalizedService is one sheet row read through its layout
+type normalizedService struct {
+	VehicleNumber  string
+	Description    string
+	Location       string
+	ServicedMiles  sql.NullInt64
+	CurrentMiles   sql.NullInt64
+	DueMiles       sql.NullInt64
+	MilesToService sql.NullInt64
+	Interval       sql.NullInt64
+	NeedsService   sql.NullBool
+	ServiceDate    sql.NullTime
+	Year           sql.NullInt64
+
+	// Problems are why the row can't be used; Notes are worth knowing but
+	// don't stop it mapping
+	Problems []string
+	Notes    []string
+}
+
+// mapServiceRow reads one row through the layout, filling in whatever the
+// sheet's arithmetic implies but the row left blank
+func (l serviceLayout) mapServiceRow(cells []string) normalizedService {
+	var n normalizedService
+	get := func(f int) string {
+		if c := l.Columns[f]; c >= 0 && c < len(cells) {
+			return strings.TrimSpace(cells[c])
+		}
+		return ""
+	}
+	readInt := func(f int) sql.NullInt64 {
+		v := get(f)
+		if v == "" {
+			return sql.NullInt64{}
+		}
+		if i, ok := parseSheetInt(v); ok {
+			return sql.NullInt64{Int64: int64(i), Valid: true}
+		}
+		n.Notes = append(n.Notes, fmt.Sprintf("couldn't read %s %q", serviceFieldNames[f], v))
+		return sql.NullInt64{}
+	}
+
+	n.VehicleNumber = strings.TrimPrefix(get(svcVehicleNumber), "#")
+	n.Description = get(svcDescription)
+	n.Location = get(svcLocation)
+	n.ServicedMiles = readInt(svcServicedMiles)
+	n.CurrentMiles = readInt(svcCurrentMiles)
+	n.DueMiles = readInt(svcDueMiles)
+	n.MilesToService = readInt(svcMilesToService)
+	n.Interval = readInt(svcInterval)
+	n.Year = readInt(svcYear)
+	if v := get(svcServiceDate); v != "" {
+		if t, ok := parseSheetDate(v); ok {
+			n.ServiceDate = sql.NullTime{Time: t, Valid: true}
+		} else {
+			n.Notes = append(n.Notes, fmt.Sprintf("couldn't read service_date %q", v))
+		}
+	}
+
+	if !n.DueMiles.Valid && n.ServicedMiles.Valid && n.Interval.Valid {
+		n.DueMiles = sql.NullInt64{Int64: n.ServicedMiles.Int64 + n.Interval.Int64, Valid: true}
+	}
+	if !n.MilesToService.Valid && n.DueMiles.Valid && n.CurrentMiles.Valid {
+		n.MilesToService = sql.NullInt64{Int64: n.DueMiles.Int64 - n.CurrentMiles.Int64, Valid: true}
+	}
+	if flag, ok := sheetFlag(get(svcNeedsService)); ok {
+		n.NeedsService = sql.NullBool{Bool: flag, Valid: true}
+	} else if n.MilesToService.Valid {
+		n.NeedsService = sql.NullBool{Bool: n.MilesToService.Int64 <= 0, Valid: true}
+	}
+
+	if n.VehicleNumber == "" {
+		n.Problems = append(n.Problems, "no vehicle number")
+	}
+	if !n.ServicedMiles.Valid && !n.CurrentMiles.Valid && !n.DueMiles.Valid {
+		n.Problems = append(n.Problems, "no mileage")
+	}
+	if n.ServicedMiles.Valid && n.CurrentMiles.Valid && n.CurrentMiles.Int64 < n.ServicedMiles.Int64 {
+		n.Notes = append(n.Notes, "odometer is below the serviced mileage")
+	}
+	return n
+}
+
+// cells returns the record's raw spreadsheet row
+func (sr ServiceRecord) cells() []string {
+	raw := []sql.NullString{
+		sr.Unnamed0, sr.Unnamed1, sr.Unnamed2, sr.Unnamed3, sr.Unnamed4, sr.Unnamed5, sr.Unnamed6,
+		sr.Unnamed7, sr.Unnamed8, sr.Unnamed9, sr.Unnamed10, sr.Unnamed11, sr.Unnamed12, sr.Unnamed13,
+	}
+	cells := make([]string, len(raw))
+	for i, c := range raw {
+		cells[i] = c.String
+	}
+	return cells
+}
+
+// fleetUnitKey reduces a vehicle number to what the sheets and the fleet
+// tables agree on: "#006", "6" and " 6 " are all the same unit
+func fleetUnitKey(id string) string {
+	key := nonAlnum.ReplaceAllString(strings.ToUpper(id), "")
+	if trimmed := strings.TrimLeft(key, "0"); trimmed != "" {
+		if _, err := strconv.Atoi(key); err == nil {
+			return trimmed
+		}
+	}
+	return key
+}
+
+type fleetUnit struct {
+	VehicleID string `db:"vehicle_id"`
+	Model     string `db:"model"`
+}
+
+// loadFleetUnits indexes every bus and vehicle by fleetUnitKey
+func loadFleetUnits() (map[string][]fleetUnit, error) {
+	var fleet []fleetUnit
+	err := db.Select(&fleet, `
+		SELECT bus_id AS vehicle_id, COALESCE(model, '') AS model FROM buses
+		UNION ALL
+		SELECT vehicle_id, COALESCE(model, '') || ' ' || COALESCE(description, '') FROM vehicles`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fleet: %w", err)
+	}
+	units := map[string][]fleetUnit{}
+	for _, u := range fleet {
+		key := fleetUnitKey(u.VehicleID)
+		units[key] = append(units[key], u)
+	}
+	return units, nil
+}
+
+// matchFleetUnit finds the bus or vehicle a unit number is about. A number
+// shared by a bus and a vehicle is settled by the description, if any.
+func matchFleetUnit(units map[string][]fleetUnit, number, description string) (string, string) {
+	candidates := units[fleetUnitKey(number)]
+	if len(candidates) > 1 && description != "" {
+		var byModel []fleetUnit
+		for _, u := range candidates {
+			for _, word := range strings.Fields(strings.ToUpper(description)) {
+				if len(word) >= 3 && strings.Contains(strings.ToUpper(u.Model), word) {
+					byModel = append(byModel, u)
+					break
+				}
+			}
+		}
+		if len(byModel) > 0 {
+			candidates = byModel
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Sprintf("vehicle %s isn't in the fleet", number)
+	case 1:
+		return candidates[0].VehicleID, ""
+	}
+	var ids []string
+	for _, u := range candidates {
+		ids = append(ids, u.VehicleID)
+	}
+	return "", fmt.Sprintf("vehicle %s could be any of %s", number, strings.Join(ids, ", "))
+}
+
+// ServiceNormalizeResult counts what one normalizer pass did
+type ServiceNormalizeResult struct {
+	Sheets   int
+	Mapped   int
+	Unmapped int
+	Skipped  int
+}
+
+// normalizeServiceRecords maps the imported service rows onto their typed
+// columns. Sheets are read whole, since a layout can only be seen across
+// rows, but only rows still pending are written unless all is set.
+func normalizeServiceRecords(all bool) (ServiceNormalizeResult, error) {
+	var result ServiceNormalizeResult
+	if db == nil {
+		return result, fmt.Errorf("database not initialized")
+	}
+
+	var records []ServiceRecord
+	if err := db.Select(&records, `SELECT `+serviceRecordColumns+` FROM service_records ORDER BY id`); err != nil {
+		return result, fmt.Errorf("failed to load service records: %w", err)
+	}
+	if !all {
+		pending := false
+		for _, rec := range records {
+			pending = pending || rec.NormalizeStatus == ServiceRowPending
+		}
+		if !pending {
+			return result, nil
+		}
+	}
+
+	units, err := loadFleetUnits()
+	if err != nil {
+		return result, err
+	}
+
+	// A sheet starts at a header row, or where a later import begins
+	var sheets [][]ServiceRecord
+	for i, rec := range records {
+		newImport := i > 0 && rec.CreatedAt.Sub(records[i-1].CreatedAt) > time.Minute
+		if i == 0 || newImport || isServiceHeaderRow(rec.cells()) {
+			sheets = append(sheets, nil)
+		}
+		sheets[len(sheets)-1] = append(sheets[len(sheets)-1], rec)
+	}
+
+	err = withTransaction(func(tx *sqlx.Tx) error {
+		for _, sheet := range sheets {
+			var header []string
+			var data [][]string
+			for _, rec := range sheet {
+				cells := rec.cells()
+				switch {
+				case isServiceHeaderRow(cells):
+					if header == nil {
+						header = cells
+					}
+				case !isBlankServiceRow(cells):
+					data = append(data, cells)
+				}
+			}
+			layout := detectServiceLayout(header, data)
+			result.Sheets++
+
+			for _, rec := range sheet {
+				if !all && rec.NormalizeStatus != ServiceRowPending {
+					result.Skipped++
+					continue
+				}
+				status, err := saveNormalizedServiceRow(tx, rec, sheet[0].ID, layout, units)
+				if err != nil {
+					return err
+				}
+				switch status {
+				case ServiceRowMapped:
+					result.Mapped++
+				case ServiceRowUnmapped:
+					result.Unmapped++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	if result.Mapped > 0 || result.Unmapped > 0 {
+		log.Printf("Service records normalized: %d sheet(s), %d mapped, %d unmapped", result.Sheets, result.Mapped, result.Unmapped)
+	}
+	return result, nil
+}
+
+// saveNormalizedServiceRow writes one row's typed columns, or the reason
+// it couldn't be mapped, and returns the status it gave the row
+func saveNormalizedServiceRow(tx *sqlx.Tx, rec ServiceRecord, sheetID int, layout serviceLayout, units map[string][]fleetUnit) (string, error) {
+	cells := rec.cells()
+	status := ServiceRowMapped
+	var n normalizedService
+	var vehicleID sql.NullString
+	switch {
+	case isServiceHeaderRow(cells):
+		status = ServiceRowHeader
+	case isBlankServiceRow(cells):
+		status = ServiceRowBlank
+	default:
+		n = layout.mapServiceRow(cells)
+		if n.VehicleNumber != "" {
+			id, problem := matchFleetUnit(units, n.VehicleNumber, n.Description)
+			if problem != "" {
+				n.Problems = append(n.Problems, problem)
+			}
+			vehicleID = sql.NullString{String: id, Valid: id != ""}
+		}
+		if len(n.Problems) > 0 {
+			status = ServiceRowUnmapped
+		}
+	}
+
+	notes := append(append([]string{}, n.Problems...), n.Notes...)
+	nullText := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+
+	_, err := tx.Exec(`
+		UPDATE service_records SET
+			vehicle_id = $2, vehicle_number = $3, vehicle_description = $4, location = $5,
+			serviced_mileage = $6, current_mileage = $7, service_due_mileage = $8,
+			miles_to_service = $9, service_interval = $10, needs_service = $11,
+			service_date = $12, vehicle_year = $13, sheet_id = $14, layout = $15,
+			normalize_status = $16, normalize_notes = $17, normalized_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		rec.ID, vehicleID, nullText(n.VehicleNumber), nullText(n.Description), nullText(n.Location),
+		n.ServicedMiles, n.CurrentMiles, n.DueMiles, n.MilesToService, n.Interval, n.NeedsService,
+		n.ServiceDate, n.Year, sheetID, layout.String(), status, nullText(strings.Join(notes, "; ")))
+	if err != nil {
+		return "", fmt.Errorf("failed to save service record %d: %w", rec.ID, err)
+	}
+	return status, nil
+}
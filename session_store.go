@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -19,6 +22,8 @@ type SessionStore interface {
 	DeleteByUsername(username string) error
 	Cleanup() error
 	GetAll() (map[string]*Session, error)
+	ListByUsername(username string) ([]*Session, error)
+	DeleteUserSession(username, id string) error
 }
 
 // Session represents a user session
@@ -30,6 +35,47 @@ type Session struct {
 	LastAccess  time.Time         `json:"last_access"`
 	ExpiresAt   time.Time         `json:"expires_at"`
 	ImportFiles map[string]string `json:"import_files,omitempty"` // Temporary storage for import file paths
+	IPAddress   string            `json:"ip_address,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+
+	// ID identifies the session in device lists without exposing the token.
+	// It's the token's hash, filled in by ListByUsername.
+	ID string `json:"-"`
+}
+
+// hashSessionToken is what gets stored or shown in place of a session token
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionsForUser collects a user's live sessions from a token-keyed map,
+// newest activity first
+func sessionsForUser(sessions map[string]*Session, username string) []*Session {
+	now := time.Now()
+	var result []*Session
+	for token, session := range sessions {
+		if session.Username != username || now.After(session.ExpiresAt) {
+			continue
+		}
+		s := *session
+		s.ID = hashSessionToken(token)
+		result = append(result, &s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastAccess.After(result[j].LastAccess)
+	})
+	return result
+}
+
+// tokenForSessionID finds the token of a user's session by its ID
+func tokenForSessionID(sessions map[string]*Session, username, id string) (string, bool) {
+	for token, session := range sessions {
+		if session.Username == username && hashSessionToken(token) == id {
+			return token, true
+		}
+	}
+	return "", false
 }
 
 // MemorySessionStore is the in-memory implementation
@@ -119,6 +165,25 @@ func (m *MemorySessionStore) GetAll() (map[string]*Session, error) {
 	return result, nil
 }
 
+func (m *MemorySessionStore) ListByUsername(username string) ([]*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	return sessionsForUser(m.sessions, username), nil
+}
+
+func (m *MemorySessionStore) DeleteUserSession(username, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	token, ok := tokenForSessionID(m.sessions, username, id)
+	if !ok {
+		return fmt.Errorf("session not found")
+	}
+	delete(m.sessions, token)
+	return nil
+}
+
 // FileSessionStore implements file-based persistent session storage
 type FileSessionStore struct {
 	mu       sync.RWMutex
@@ -260,6 +325,25 @@ func (f *FileSessionStore) GetAll() (map[string]*Session, error) {
 	return result, nil
 }
 
+func (f *FileSessionStore) ListByUsername(username string) ([]*Session, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	
+	return sessionsForUser(f.sessions, username), nil
+}
+
+func (f *FileSessionStore) DeleteUserSession(username, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	token, ok := tokenForSessionID(f.sessions, username, id)
+	if !ok {
+		return fmt.Errorf("session not found")
+	}
+	delete(f.sessions, token)
+	return f.save()
+}
+
 func (f *FileSessionStore) cleanupRoutine() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
@@ -338,18 +422,41 @@ func (sm *SessionManager) GetActiveSessions() (map[string]*Session, error) {
 	return sm.store.GetAll()
 }
 
+// UserSessions lists a user's signed-in devices
+func (sm *SessionManager) UserSessions(username string) ([]*Session, error) {
+	return sm.store.ListByUsername(username)
+}
+
+// RevokeSession signs out one of a user's devices by session ID
+func (sm *SessionManager) RevokeSession(username, id string) error {
+	return sm.store.DeleteUserSession(username, id)
+}
+
 // Global session manager instance
 var sessionManager *SessionManager
 
 // InitializeSessionManager sets up the session management system
 func initializeSessionManager() error {
-	// Check if we should use file-based storage
-	sessionFile := getEnvWithDefault("SESSION_STORE_FILE", "sessions.json")
+	// SESSION_STORE picks the backend; sessions live in the database when
+	// one is connected, so they survive restarts and are shared between
+	// instances
+	backend := getEnvWithDefault("SESSION_STORE", "postgres")
+	if backend == "postgres" && db == nil {
+		log.Println("No database connection, falling back to file-based session storage")
+		backend = "file"
+	}
+	sessionFile := ""
+	if backend == "file" {
+		sessionFile = getEnvWithDefault("SESSION_STORE_FILE", "sessions.json")
+	}
 	
 	var store SessionStore
 	var err error
 	
-	if sessionFile != "" {
+	if backend == "postgres" {
+		log.Println("Using PostgreSQL session storage")
+		store = NewPostgresSessionStore(db)
+	} else if sessionFile != "" {
 		log.Printf("Using file-based session storage: %s", sessionFile)
 		store, err = NewFileSessionStore(sessionFile)
 		if err != nil {
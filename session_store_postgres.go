@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sessionTouchInterval limits how often an active session's last_seen and
+// expiry are written back, so a page that fires a dozen requests doesn't
+// cost a dozen UPDATEs
+const sessionTouchInterval = time.Minute
+
+// PostgresSessionStore keeps sessions in the sessions table. Tokens are
+// stored as SHA-256 hashes, so a leaked table can't be replayed as
+// cookies.
+type PostgresSessionStore struct {
+	db *sqlx.DB
+}
+
+// NewPostgresSessionStore creates a session store backed by the database
+func NewPostgresSessionStore(database *sqlx.DB) *PostgresSessionStore {
+	return &PostgresSessionStore{db: database}
+}
+
+type sessionRow struct {
+	Token     string         `db:"token"`
+	Username  string         `db:"username"`
+	Role      string         `db:"role"`
+	CSRFToken string         `db:"csrf_token"`
+	IPAddress sql.NullString `db:"ip_address"`
+	UserAgent sql.NullString `db:"user_agent"`
+	CreatedAt time.Time      `db:"created_at"`
+	LastSeen  time.Time      `db:"last_seen"`
+	ExpiresAt time.Time      `db:"expires_at"`
+}
+
+const sessionColumns = `token, username, role, csrf_token, ip_address, user_agent,
+	COALESCE(created_at, CURRENT_TIMESTAMP) AS created_at,
+	COALESCE(last_seen, created_at, CURRENT_TIMESTAMP) AS last_seen, expires_at`
+
+func (row sessionRow) session() *Session {
+	return &Session{
+		ID:          row.Token,
+		Username:    row.Username,
+		Role:        row.Role,
+		CSRFToken:   row.CSRFToken,
+		CreatedAt:   row.CreatedAt,
+		LastAccess:  row.LastSeen,
+		ExpiresAt:   row.ExpiresAt,
+		IPAddress:   row.IPAddress.String,
+		UserAgent:   row.UserAgent.String,
+		ImportFiles: make(map[string]string),
+	}
+}
+
+func (p *PostgresSessionStore) Get(token string) (*Session, error) {
+	var row struct {
+		sessionRow
+		Stale bool `db:"stale"`
+	}
+	err := p.db.Get(&row, `
+		SELECT `+sessionColumns+`,
+			COALESCE(last_seen, created_at) < CURRENT_TIMESTAMP - make_interval(secs => $2) AS stale
+		FROM sessions
+		WHERE token = $1 AND expires_at > CURRENT_TIMESTAMP
+	`, hashSessionToken(token), sessionTouchInterval.Seconds())
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("session not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := row.session()
+	if row.Stale {
+		// Sliding expiry, as with the other stores
+		session.LastAccess = time.Now()
+		session.ExpiresAt = time.Now().Add(24 * time.Hour)
+		if _, err := p.db.Exec(`
+			UPDATE sessions
+			SET last_seen = CURRENT_TIMESTAMP, expires_at = CURRENT_TIMESTAMP + INTERVAL '24 hours'
+			WHERE token = $1
+		`, row.Token); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+func (p *PostgresSessionStore) Set(token string, session *Session) error {
+	_, err := p.db.Exec(`
+		INSERT INTO sessions (token, username, role, csrf_token, ip_address, user_agent,
+			created_at, last_seen, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9)
+		ON CONFLICT (token) DO UPDATE SET
+			role = EXCLUDED.role,
+			csrf_token = EXCLUDED.csrf_token,
+			last_seen = EXCLUDED.last_seen,
+			expires_at = EXCLUDED.expires_at
+	`, hashSessionToken(token), session.Username, session.Role, session.CSRFToken,
+		session.IPAddress, session.UserAgent, session.CreatedAt, session.LastAccess, session.ExpiresAt)
+	return err
+}
+
+func (p *PostgresSessionStore) Delete(token string) error {
+	_, err := p.db.Exec("DELETE FROM sessions WHERE token = $1", hashSessionToken(token))
+	return err
+}
+
+func (p *PostgresSessionStore) DeleteByUsername(username string) error {
+	_, err := p.db.Exec("DELETE FROM sessions WHERE username = $1", username)
+	return err
+}
+
+func (p *PostgresSessionStore) Cleanup() error {
+	_, err := p.db.Exec("DELETE FROM sessions WHERE expires_at <= CURRENT_TIMESTAMP")
+	return err
+}
+
+// GetAll returns every live session. The raw tokens aren't stored, so the
+// map is keyed by session ID instead.
+func (p *PostgresSessionStore) GetAll() (map[string]*Session, error) {
+	var rows []sessionRow
+	if err := p.db.Select(&rows, `
+		SELECT `+sessionColumns+` FROM sessions WHERE expires_at > CURRENT_TIMESTAMP
+	`); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*Session, len(rows))
+	for _, row := range rows {
+		result[row.Token] = row.session()
+	}
+	return result, nil
+}
+
+func (p *PostgresSessionStore) ListByUsername(username string) ([]*Session, error) {
+	var rows []sessionRow
+	if err := p.db.Select(&rows, `
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE username = $1 AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_seen DESC NULLS LAST
+	`, username); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, len(rows))
+	for i, row := range rows {
+		sessions[i] = row.session()
+	}
+	return sessions, nil
+}
+
+func (p *PostgresSessionStore) DeleteUserSession(username, id string) error {
+	result, err := p.db.Exec("DELETE FROM sessions WHERE token = $1 AND username = $2", id, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
@@ -64,6 +64,7 @@ func (tc *TemplateCache) LoadTemplates(templateDir string) error {
 		"components/pagination.html",
 		"components/dashboard_shortcuts.html",
 		"components/progress_indicator.html",
+		"components/two_factor.html",
 	}
 	
 	// List of template files to load
@@ -290,6 +291,8 @@ func (tc *TemplateCache) StartCacheCleaner(interval time.Duration) {
 // getTemplateFuncs returns common template functions
 func getTemplateFuncs() template.FuncMap {
 	return template.FuncMap{
+		"can":  templateCan,
+		"home": templateHome,
 		"formatDate": func(date string) string {
 			t, err := time.Parse("2006-01-02", date)
 			if err != nil {
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Trip event types
+const (
+	TripEventHarshBrake = "harsh_brake"
+	TripEventHarshAccel = "harsh_acceleration"
+	TripEventHarshTurn  = "harsh_turn"
+	TripEventSpeeding   = "speeding"
+)
+
+// TripBuilderConfig controls how a point stream is split and scored
+type TripBuilderConfig struct {
+	MaxGap            time.Duration // no data for this long ends a trip (ignition off)
+	MaxIdle           time.Duration // stationary for this long ends a trip
+	StopSpeed         float64       // km/h at or below which the bus counts as stopped
+	MinStopDuration   time.Duration // shorter pauses are not reported as stops
+	MinTripDistance   float64       // meters
+	MinTripDuration   time.Duration
+	MaxPlausibleSpeed float64 // km/h, larger jumps between points are GPS noise
+	HarshBrakeMS2     float64 // deceleration threshold, m/s^2
+	HarshAccelMS2     float64 // acceleration threshold, m/s^2
+	HarshTurnDegPerS  float64
+	SpeedingKmh       float64
+}
+
+// DefaultTripBuilderConfig returns thresholds tuned for school buses
+func DefaultTripBuilderConfig() TripBuilderConfig {
+	return TripBuilderConfig{
+		MaxGap:            10 * time.Minute,
+		MaxIdle:           10 * time.Minute,
+		StopSpeed:         3,
+		MinStopDuration:   30 * time.Second,
+		MinTripDistance:   200,
+		MinTripDuration:   2 * time.Minute,
+		MaxPlausibleSpeed: 160,
+		HarshBrakeMS2:     3.5,
+		HarshAccelMS2:     3.0,
+		HarshTurnDegPerS:  30,
+		SpeedingKmh:       90,
+	}
+}
+
+// TripStop is a pause within a trip
+type TripStop struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	DwellSeconds int       `json:"dwell_seconds"`
+	Latitude     float64   `json:"latitude"`
+	Longitude    float64   `json:"longitude"`
+	PlannedStop  string    `json:"planned_stop,omitempty"`
+}
+
+// TripEvent marks a harsh driving event on a trip
+type TripEvent struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Speed     float64   `json:"speed"`
+	Value     float64   `json:"value"` // m/s^2, deg/s or km/h depending on type
+}
+
+// Trip is a reconstructed journey stored in gps_tracking_sessions
+type Trip struct {
+	ID            int         `json:"id"`
+	VehicleID     string      `json:"vehicle_id"`
+	DriverID      string      `json:"driver_id,omitempty"`
+	RouteID       string      `json:"route_id,omitempty"`
+	StartTime     time.Time   `json:"start_time"`
+	EndTime       time.Time   `json:"end_time"`
+	StartLocation GeoPoint    `json:"start_location"`
+	EndLocation   GeoPoint    `json:"end_location"`
+	TotalDistance float64     `json:"total_distance"` // km
+	AverageSpeed  float64     `json:"average_speed"`  // km/h
+	MaxSpeed      float64     `json:"max_speed"`      // km/h
+	TotalStops    int         `json:"total_stops"`
+	IdleSeconds   int         `json:"idle_seconds"`
+	PointCount    int         `json:"point_count"`
+	Stops         []TripStop  `json:"stops"`
+	Events        []TripEvent `json:"events"`
+	Status        string      `json:"status"`
+}
+
+// PlaybackPoint is one time-indexed sample of a trip replay
+type PlaybackPoint struct {
+	Offset    float64   `json:"t"` // seconds since trip start
+	Timestamp time.Time `json:"timestamp"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lng"`
+	Speed     float64   `json:"speed"`
+	Heading   float64   `json:"heading"`
+}
+
+// createTripTables adds trip-builder columns to gps_tracking_sessions
+func createTripTables() []string {
+	return []string{
+		`ALTER TABLE gps_tracking_sessions ALTER COLUMN driver_id DROP NOT NULL`,
+		`ALTER TABLE gps_tracking_sessions ADD COLUMN IF NOT EXISTS idle_seconds INTEGER DEFAULT 0`,
+		`ALTER TABLE gps_tracking_sessions ADD COLUMN IF NOT EXISTS point_count INTEGER DEFAULT 0`,
+		`ALTER TABLE gps_tracking_sessions ADD COLUMN IF NOT EXISTS stops JSONB`,
+		`ALTER TABLE gps_tracking_sessions ADD COLUMN IF NOT EXISTS harsh_events JSONB`,
+		`ALTER TABLE gps_tracking_sessions ADD COLUMN IF NOT EXISTS source VARCHAR(20) DEFAULT 'live'`,
+		`CREATE INDEX IF NOT EXISTS idx_gps_sessions_vehicle_start
+		 ON gps_tracking_sessions(vehicle_id, start_time DESC)`,
+	}
+}
+
+// splitTrips turns an ordered point stream into trips
+func splitTrips(points []GPSLocation, cfg TripBuilderConfig) []Trip {
+	var trips []Trip
+	var current []GPSLocation
+	var idleSince time.Time
+
+	flush := func() {
+		if trip, ok := summarizeTrip(current, cfg); ok {
+			trips = append(trips, trip)
+		}
+		current = nil
+		idleSince = time.Time{}
+	}
+
+	for _, p := range points {
+		if len(current) > 0 {
+			prev := current[len(current)-1]
+
+			// Ignition off / lost signal, or a new route started
+			if p.Timestamp.Sub(prev.Timestamp) > cfg.MaxGap ||
+				(p.RouteID != "" && prev.RouteID != "" && p.RouteID != prev.RouteID) {
+				flush()
+			}
+		}
+
+		if p.Speed <= cfg.StopSpeed {
+			if idleSince.IsZero() {
+				idleSince = p.Timestamp
+			}
+			// Long idle ends the trip; keep the idle points out of it
+			if len(current) > 0 && p.Timestamp.Sub(idleSince) > cfg.MaxIdle {
+				trimmed := current[:0:0]
+				for _, c := range current {
+					if c.Timestamp.After(idleSince) {
+						break
+					}
+					trimmed = append(trimmed, c)
+				}
+				current = trimmed
+				flush()
+				idleSince = p.Timestamp
+				continue
+			}
+			if len(current) == 0 {
+				// Not moving yet: don't start a trip on an idle point
+				continue
+			}
+		} else {
+			idleSince = time.Time{}
+		}
+
+		current = append(current, p)
+	}
+	flush()
+
+	return trips
+}
+
+// summarizeTrip computes distance, speed, stops and harsh events for a trip
+func summarizeTrip(points []GPSLocation, cfg TripBuilderConfig) (Trip, bool) {
+	if len(points) < 2 {
+		return Trip{}, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+	trip := Trip{
+		VehicleID:     first.VehicleID,
+		StartTime:     first.Timestamp,
+		EndTime:       last.Timestamp,
+		StartLocation: GeoPoint{Latitude: first.Latitude, Longitude: first.Longitude},
+		EndLocation:   GeoPoint{Latitude: last.Latitude, Longitude: last.Longitude},
+		PointCount:    len(points),
+		Stops:         []TripStop{},
+		Events:        []TripEvent{},
+		Status:        "completed",
+	}
+
+	var distance float64
+	var stopStart *GPSLocation
+	speedingActive := false
+
+	for i, p := range points {
+		if trip.DriverID == "" && p.DriverID != "" {
+			trip.DriverID = p.DriverID
+		}
+		if trip.RouteID == "" && p.RouteID != "" {
+			trip.RouteID = p.RouteID
+		}
+		if p.Speed > trip.MaxSpeed {
+			trip.MaxSpeed = p.Speed
+		}
+
+		// Speeding is marked once per continuous episode
+		if p.Speed > cfg.SpeedingKmh {
+			if !speedingActive {
+				trip.Events = append(trip.Events, TripEvent{
+					Type: TripEventSpeeding, Timestamp: p.Timestamp,
+					Latitude: p.Latitude, Longitude: p.Longitude, Speed: p.Speed, Value: p.Speed,
+				})
+			}
+			speedingActive = true
+		} else {
+			speedingActive = false
+		}
+
+		// Stops: runs of points at or below stop speed
+		if p.Speed <= cfg.StopSpeed {
+			if stopStart == nil {
+				start := p
+				stopStart = &start
+			}
+		} else if stopStart != nil {
+			trip.addStop(*stopStart, points[i-1], cfg)
+			stopStart = nil
+		}
+
+		if i == 0 {
+			continue
+		}
+		prev := points[i-1]
+		dt := p.Timestamp.Sub(prev.Timestamp).Seconds()
+		if dt <= 0 {
+			continue
+		}
+
+		step := calculateDistance(prev.Latitude, prev.Longitude, p.Latitude, p.Longitude)
+		if step/dt*3.6 <= cfg.MaxPlausibleSpeed {
+			distance += step
+		}
+
+		// Harsh events only make sense between closely spaced samples
+		if dt > 15 {
+			continue
+		}
+		accel := (p.Speed - prev.Speed) / 3.6 / dt
+		if accel <= -cfg.HarshBrakeMS2 {
+			trip.Events = append(trip.Events, TripEvent{
+				Type: TripEventHarshBrake, Timestamp: p.Timestamp,
+				Latitude: p.Latitude, Longitude: p.Longitude, Speed: p.Speed, Value: math.Abs(accel),
+			})
+		} else if accel >= cfg.HarshAccelMS2 {
+			trip.Events = append(trip.Events, TripEvent{
+				Type: TripEventHarshAccel, Timestamp: p.Timestamp,
+				Latitude: p.Latitude, Longitude: p.Longitude, Speed: p.Speed, Value: accel,
+			})
+		}
+
+		turn := math.Abs(p.Heading - prev.Heading)
+		if turn > 180 {
+			turn = 360 - turn
+		}
+		if p.Speed > 20 && turn/dt >= cfg.HarshTurnDegPerS {
+			trip.Events = append(trip.Events, TripEvent{
+				Type: TripEventHarshTurn, Timestamp: p.Timestamp,
+				Latitude: p.Latitude, Longitude: p.Longitude, Speed: p.Speed, Value: turn / dt,
+			})
+		}
+	}
+	if stopStart != nil {
+		trip.addStop(*stopStart, last, cfg)
+	}
+
+	duration := trip.EndTime.Sub(trip.StartTime)
+	if distance < cfg.MinTripDistance && duration < cfg.MinTripDuration {
+		return Trip{}, false
+	}
+
+	trip.TotalDistance = distance / 1000
+	if duration > 0 {
+		trip.AverageSpeed = trip.TotalDistance / duration.Hours()
+	}
+	trip.TotalStops = len(trip.Stops)
+
+	return trip, true
+}
+
+// addStop records a pause if it lasted long enough
+func (t *Trip) addStop(start, end GPSLocation, cfg TripBuilderConfig) {
+	dwell := end.Timestamp.Sub(start.Timestamp)
+	if dwell < cfg.MinStopDuration {
+		return
+	}
+	t.IdleSeconds += int(dwell.Seconds())
+	t.Stops = append(t.Stops, TripStop{
+		Start:        start.Timestamp,
+		End:          end.Timestamp,
+		DwellSeconds: int(dwell.Seconds()),
+		Latitude:     start.Latitude,
+		Longitude:    start.Longitude,
+	})
+}
+
+// matchPlannedStops labels trip stops with the nearest planned stop
+func (t *Trip) matchPlannedStops() {
+	if t.RouteID == "" || len(t.Stops) == 0 {
+		return
+	}
+	planned, err := loadRoutePlan(t.RouteID)
+	if err != nil || len(planned) == 0 {
+		return
+	}
+	for i := range t.Stops {
+		for _, ps := range planned {
+			radius := ps.StopRadius
+			if radius <= 0 {
+				radius = 50
+			}
+			if calculateDistance(t.Stops[i].Latitude, t.Stops[i].Longitude, ps.Latitude, ps.Longitude) <= radius {
+				t.Stops[i].PlannedStop = ps.Name
+				break
+			}
+		}
+	}
+}
+
+// BuildTrips reconstructs and stores trips for a vehicle over a window.
+// Previously built trips starting in the window are replaced.
+func (gt *GPSTracker) BuildTrips(vehicleID string, start, end time.Time) ([]Trip, error) {
+	// Reach back to the start of any built trip still running at the window
+	// start, otherwise it would be rebuilt as a second, truncated trip
+	var straddling sql.NullTime
+	if err := gt.db.Get(&straddling, `
+		SELECT MIN(start_time) FROM gps_tracking_sessions
+		WHERE vehicle_id = $1 AND source = 'builder'
+		  AND start_time < $2 AND end_time >= $2
+	`, vehicleID, start); err == nil && straddling.Valid {
+		start = straddling.Time
+	}
+
+	points, err := gt.GetLocationHistory(vehicleID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GPS history: %w", err)
+	}
+
+	trips := splitTrips(points, DefaultTripBuilderConfig())
+	for i := range trips {
+		trips[i].matchPlannedStops()
+	}
+
+	tx, err := gt.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM gps_tracking_sessions
+		WHERE vehicle_id = $1 AND source = 'builder'
+		  AND start_time >= $2 AND start_time < $3
+	`, vehicleID, start, end); err != nil {
+		return nil, fmt.Errorf("failed to clear old trips: %w", err)
+	}
+
+	for i := range trips {
+		t := &trips[i]
+		startJSON, _ := json.Marshal(t.StartLocation)
+		endJSON, _ := json.Marshal(t.EndLocation)
+		stopsJSON, _ := json.Marshal(t.Stops)
+		eventsJSON, _ := json.Marshal(t.Events)
+
+		err := tx.QueryRow(`
+			INSERT INTO gps_tracking_sessions (
+				vehicle_id, driver_id, route_id, start_time, end_time,
+				start_location, end_location, total_distance, average_speed,
+				max_speed, total_stops, idle_seconds, point_count,
+				stops, harsh_events, status, source
+			) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, $7, $8, $9,
+				$10, $11, $12, $13, $14, $15, $16, 'builder')
+			RETURNING id
+		`, t.VehicleID, t.DriverID, t.RouteID, t.StartTime, t.EndTime,
+			startJSON, endJSON, t.TotalDistance, t.AverageSpeed,
+			t.MaxSpeed, t.TotalStops, t.IdleSeconds, t.PointCount,
+			stopsJSON, eventsJSON, t.Status).Scan(&t.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store trip: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return trips, nil
+}
+
+// GetTrips returns stored trips for a vehicle that start within a window
+func (gt *GPSTracker) GetTrips(vehicleID string, start, end time.Time) ([]Trip, error) {
+	rows, err := gt.db.Query(tripSelectQuery+`
+		WHERE vehicle_id = $1 AND start_time >= $2 AND start_time < $3
+		ORDER BY start_time
+	`, vehicleID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trips := []Trip{}
+	for rows.Next() {
+		trip, err := scanTrip(rows)
+		if err != nil {
+			log.Printf("Failed to scan trip: %v", err)
+			continue
+		}
+		trips = append(trips, trip)
+	}
+	return trips, rows.Err()
+}
+
+// GetTrip returns a single stored trip
+func (gt *GPSTracker) GetTrip(id int) (*Trip, error) {
+	rows, err := gt.db.Query(tripSelectQuery+` WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, sql.ErrNoRows
+	}
+	trip, err := scanTrip(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &trip, nil
+}
+
+// Playback returns the trip's points as a time-indexed polyline.
+// maxPoints > 0 downsamples evenly, always keeping the first and last point.
+func (gt *GPSTracker) Playback(trip *Trip, maxPoints int) ([]PlaybackPoint, error) {
+	points, err := gt.GetLocationHistory(trip.VehicleID, trip.StartTime, trip.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	stride := 1
+	if maxPoints > 1 && len(points) > maxPoints {
+		stride = int(math.Ceil(float64(len(points)) / float64(maxPoints-1)))
+	}
+
+	playback := make([]PlaybackPoint, 0, len(points)/stride+1)
+	for i, p := range points {
+		if i%stride != 0 && i != len(points)-1 {
+			continue
+		}
+		playback = append(playback, PlaybackPoint{
+			Offset:    p.Timestamp.Sub(trip.StartTime).Seconds(),
+			Timestamp: p.Timestamp,
+			Latitude:  p.Latitude,
+			Longitude: p.Longitude,
+			Speed:     p.Speed,
+			Heading:   p.Heading,
+		})
+	}
+	return playback, nil
+}
+
+const tripSelectQuery = `
+	SELECT id, vehicle_id, COALESCE(driver_id, ''), COALESCE(route_id, ''),
+	       start_time, end_time, start_location, end_location,
+	       COALESCE(total_distance, 0), COALESCE(average_speed, 0),
+	       COALESCE(max_speed, 0), COALESCE(total_stops, 0),
+	       COALESCE(idle_seconds, 0), COALESCE(point_count, 0),
+	       stops, harsh_events, COALESCE(status, '')
+	FROM gps_tracking_sessions
+`
+
+func scanTrip(rows *sql.Rows) (Trip, error) {
+	var t Trip
+	var endTime sql.NullTime
+	var startJSON, endJSON, stopsJSON, eventsJSON []byte
+
+	err := rows.Scan(&t.ID, &t.VehicleID, &t.DriverID, &t.RouteID,
+		&t.StartTime, &endTime, &startJSON, &endJSON,
+		&t.TotalDistance, &t.AverageSpeed, &t.MaxSpeed, &t.TotalStops,
+		&t.IdleSeconds, &t.PointCount, &stopsJSON, &eventsJSON, &t.Status)
+	if err != nil {
+		return t, err
+	}
+
+	if endTime.Valid {
+		t.EndTime = endTime.Time
+	}
+	json.Unmarshal(startJSON, &t.StartLocation)
+	json.Unmarshal(endJSON, &t.EndLocation)
+	t.Stops = []TripStop{}
+	t.Events = []TripEvent{}
+	if len(stopsJSON) > 0 {
+		json.Unmarshal(stopsJSON, &t.Stops)
+	}
+	if len(eventsJSON) > 0 {
+		json.Unmarshal(eventsJSON, &t.Events)
+	}
+	return t, nil
+}
+
+// startTripBuilderRoutine rebuilds recent trips for every active vehicle
+func (gt *GPSTracker) startTripBuilderRoutine() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Stop short of "now" so trips still in progress aren't cut off
+		end := time.Now().Add(-DefaultTripBuilderConfig().MaxGap)
+		start := end.Add(-24 * time.Hour)
+
+		var vehicles []string
+		if err := gt.db.Select(&vehicles, `
+			SELECT DISTINCT vehicle_id FROM gps_locations
+			WHERE timestamp BETWEEN $1 AND $2
+		`, start, end); err != nil {
+			log.Printf("Trip builder: failed to list vehicles: %v", err)
+			continue
+		}
+
+		for _, vehicleID := range vehicles {
+			trips, err := gt.BuildTrips(vehicleID, start, end)
+			if err != nil {
+				log.Printf("Trip builder: vehicle %s: %v", vehicleID, err)
+				continue
+			}
+			if len(trips) > 0 {
+				log.Printf("Trip builder: rebuilt %d trips for vehicle %s", len(trips), vehicleID)
+			}
+		}
+	}
+}
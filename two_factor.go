@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports)
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted either side of now, for clock drift
+	totpIssuer        = "Fleet Management"
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random 160-bit secret, base32 encoded
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode computes the code for one time step (RFC 4226 HOTP with the
+// step as counter)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// verifyTOTP checks code against the steps around now. Steps at or before
+// lastStep are refused so an observed code can't be replayed. It returns
+// the matching step.
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI is the otpauth:// URI authenticator apps scan
+func totpProvisioningURI(username, secret string) string {
+	// Spaces must be %20 rather than +, which some apps show literally
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?secret=" + secret + "&issuer=" + url.PathEscape(totpIssuer)
+}
+
+// generateRecoveryCodes returns single-use codes formatted xxxx-xxxx
+func generateRecoveryCodes() ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	codes := make([]string, recoveryCodeCount)
+	buf := make([]byte, 8)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		for j, b := range buf {
+			buf[j] = alphabet[int(b)%len(alphabet)]
+		}
+		codes[i] = string(buf[:4]) + "-" + string(buf[4:])
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode normalises case and separators before hashing, so
+// codes can be typed however the user likes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// looksLikeRecoveryCode tells recovery codes (8 characters) apart from
+// TOTP codes (6 digits)
+func looksLikeRecoveryCode(code string) bool {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code))
+	return len(code) == 8
+}
+
+// TwoFactorStatus summarises a user's second-factor setup
+type TwoFactorStatus struct {
+	Enabled           bool
+	Pending           bool // a secret has been issued but not confirmed
+	Required          bool // the user's role requires a second factor
+	RecoveryCodesLeft int
+}
+
+func getTwoFactorStatus(username string) (TwoFactorStatus, error) {
+	var status TwoFactorStatus
+	var secret sql.NullString
+	var role string
+	err := db.QueryRow(`
+		SELECT totp_secret, COALESCE(totp_enabled, FALSE), role
+		FROM users WHERE username = $1
+	`, username).Scan(&secret, &status.Enabled, &role)
+	if err != nil {
+		return status, err
+	}
+	status.Pending = !status.Enabled && secret.Valid && secret.String != ""
+	status.Required = roleRequiresTwoFactor(role)
+
+	err = db.Get(&status.RecoveryCodesLeft, `
+		SELECT COUNT(*) FROM user_recovery_codes WHERE username = $1 AND used_at IS NULL
+	`, username)
+	return status, err
+}
+
+// twoFactorUsers returns the usernames with TOTP turned on
+func twoFactorUsers() (map[string]bool, error) {
+	var usernames []string
+	if err := db.Select(&usernames, "SELECT username FROM users WHERE totp_enabled"); err != nil {
+		return nil, err
+	}
+	enabled := make(map[string]bool, len(usernames))
+	for _, u := range usernames {
+		enabled[u] = true
+	}
+	return enabled, nil
+}
+
+// roleRequiresTwoFactor reports whether users with this role must use TOTP
+func roleRequiresTwoFactor(role string) bool {
+	var required bool
+	if err := db.Get(&required, "SELECT COALESCE(require_2fa, FALSE) FROM roles WHERE name = $1", role); err != nil {
+		return false
+	}
+	return required
+}
+
+// beginTOTPEnrollment issues a fresh secret. It only becomes active once
+// confirmTOTPEnrollment sees a valid code from it.
+func beginTOTPEnrollment(username string) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	result, err := db.Exec(`
+		UPDATE users SET totp_secret = $2, totp_last_step = 0
+		WHERE username = $1 AND NOT COALESCE(totp_enabled, FALSE)
+	`, username, secret)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", fmt.Errorf("two-factor authentication is already enabled")
+	}
+	return secret, nil
+}
+
+// pendingTOTPSecret returns the unconfirmed secret, if any
+func pendingTOTPSecret(username string) (string, error) {
+	var secret sql.NullString
+	err := db.Get(&secret, `
+		SELECT totp_secret FROM users
+		WHERE username = $1 AND NOT COALESCE(totp_enabled, FALSE)
+	`, username)
+	return secret.String, err
+}
+
+// confirmTOTPEnrollment enables TOTP once the user proves their app
+// produces valid codes, and returns a new set of recovery codes
+func confirmTOTPEnrollment(username, code string) ([]string, error) {
+	secret, err := pendingTOTPSecret(username)
+	if err != nil || secret == "" {
+		return nil, fmt.Errorf("no enrollment in progress")
+	}
+	step, ok := verifyTOTP(secret, code, 0, time.Now())
+	if !ok {
+		return nil, fmt.Errorf("that code isn't valid; check your device's clock and try again")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE users SET totp_enabled = TRUE, totp_last_step = $2
+		WHERE username = $1
+	`, username, step); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// regenerateRecoveryCodes invalidates the old codes and issues new ones
+func regenerateRecoveryCodes(username string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, username string) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE username = $1", username); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`
+			INSERT INTO user_recovery_codes (username, code_hash) VALUES ($1, $2)
+		`, username, hashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// disableTOTP removes the user's secret and recovery codes
+func disableTOTP(username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0
+		WHERE username = $1
+	`, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE username = $1", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, consuming the recovery code on success
+func verifySecondFactor(username, code string) (bool, error) {
+	if looksLikeRecoveryCode(code) {
+		result, err := db.Exec(`
+			UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP
+			WHERE username = $1 AND code_hash = $2 AND used_at IS NULL
+		`, username, hashRecoveryCode(code))
+		if err != nil {
+			return false, err
+		}
+		n, _ := result.RowsAffected()
+		return n == 1, nil
+	}
+
+	var secret string
+	var lastStep int64
+	err := db.QueryRow(`
+		SELECT totp_secret, COALESCE(totp_last_step, 0) FROM users
+		WHERE username = $1 AND totp_enabled
+	`, username).Scan(&secret, &lastStep)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := verifyTOTP(secret, code, lastStep, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	// Record the step conditionally so two concurrent logins can't both
+	// use the same code
+	result, err := db.Exec(`
+		UPDATE users SET totp_last_step = $2
+		WHERE username = $1 AND COALESCE(totp_last_step, 0) < $2
+	`, username, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// pendingLogin is a password-verified login waiting on its second factor
+type pendingLogin struct {
+	username string
+	expires  time.Time
+}
+
+const pendingLoginTTL = 5 * time.Minute
+
+var pendingLogins = struct {
+	sync.Mutex
+	logins map[string]pendingLogin
+}{logins: make(map[string]pendingLogin)}
+
+func startPendingLogin(username string) string {
+	token := generateSessionToken()
+
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	now := time.Now()
+	for t, p := range pendingLogins.logins {
+		if now.After(p.expires) {
+			delete(pendingLogins.logins, t)
+		}
+	}
+	pendingLogins.logins[token] = pendingLogin{username: username, expires: now.Add(pendingLoginTTL)}
+	return token
+}
+
+func lookupPendingLogin(token string) (string, bool) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	p, ok := pendingLogins.logins[token]
+	if !ok || time.Now().After(p.expires) {
+		delete(pendingLogins.logins, token)
+		return "", false
+	}
+	return p.username, true
+}
+
+func finishPendingLogin(token string) {
+	pendingLogins.Lock()
+	delete(pendingLogins.logins, token)
+	pendingLogins.Unlock()
+}
@@ -214,13 +214,13 @@ func (c *Client) processMessage(message []byte) {
 		
 	case "location_update":
 		// Handle real-time location updates from drivers
-		if c.user.Role == "driver" {
+		if hasPermission(c.user, PermDriverOperate) {
 			c.handleLocationUpdate(msg.Data)
 		}
 		
 	case "status_update":
 		// Handle status updates
-		if c.user.Role == "manager" || c.user.Role == "driver" {
+		if hasPermission(c.user, PermRoutesEdit) || hasPermission(c.user, PermDriverOperate) {
 			c.handleStatusUpdate(msg.Data)
 		}
 		
@@ -301,12 +301,12 @@ func BroadcastSystemMetrics(metrics map[string]interface{}) {
 	
 	metricsJSON, _ := json.Marshal(metricsMsg)
 	
-	// Send only to managers
+	// Send only to system administrators
 	wsHub.mu.RLock()
 	defer wsHub.mu.RUnlock()
 	
 	for client := range wsHub.clients {
-		if client.user.Role == "manager" {
+		if hasPermission(client.user, PermSystemAdmin) {
 			select {
 			case client.send <- metricsJSON:
 			default:
@@ -475,13 +475,13 @@ func (c *Client) handleChatMessage(data map[string]interface{}) {
 }
 
 func shouldReceiveRouteUpdate(client *Client, routeID string) bool {
-	// Managers receive all updates
-	if client.user.Role == "manager" {
+	// Anyone who can view routes receives all updates
+	if hasPermission(client.user, PermRoutesView) {
 		return true
 	}
 	
 	// Drivers receive updates for their assigned routes
-	if client.user.Role == "driver" {
+	if hasPermission(client.user, PermDriverOperate) {
 		var assigned bool
 		db.QueryRow(`
 			SELECT EXISTS(
@@ -496,8 +496,8 @@ func shouldReceiveRouteUpdate(client *Client, routeID string) bool {
 }
 
 func shouldReceiveChat(recipient *Client, sender *Client) bool {
-	// Managers can chat with everyone
-	if recipient.user.Role == "manager" || sender.user.Role == "manager" {
+	// Broadcasters (managers, dispatchers) can chat with everyone
+	if hasPermission(recipient.user, PermMessagingBroadcast) || hasPermission(sender.user, PermMessagingBroadcast) {
 		return true
 	}
 	
@@ -529,12 +529,12 @@ func BroadcastDriverLocation(driver string, lat, lng float64) {
 	
 	locationJSON, _ := json.Marshal(location)
 	
-	// Send to managers only
+	// Send only to users with live GPS access
 	wsHub.mu.RLock()
 	defer wsHub.mu.RUnlock()
 	
 	for client := range wsHub.clients {
-		if client.user.Role == "manager" {
+		if hasPermission(client.user, PermGPSView) {
 			select {
 			case client.send <- locationJSON:
 			default:
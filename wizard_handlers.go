@@ -22,7 +22,7 @@ func availableDriversHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -67,7 +67,7 @@ func availableBusesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -113,7 +113,7 @@ func availableRoutesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -162,7 +162,7 @@ func checkAssignmentConflictsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermRoutesAssign) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -328,7 +328,7 @@ func analyzeImportFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authentication
 	user := getUserFromSession(r)
-	if user == nil || user.Role != "manager" {
+	if !hasPermission(user, PermDataImport) {
 		SendError(w, ErrUnauthorized("Access denied"))
 		return
 	}
@@ -0,0 +1,837 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Work order statuses, in the order a repair usually moves through them
+const (
+	WorkOrderOpen          = "open"
+	WorkOrderAssigned      = "assigned"
+	WorkOrderInProgress    = "in_progress"
+	WorkOrderAwaitingParts = "awaiting_parts"
+	WorkOrderCompleted     = "completed"
+	WorkOrderInspected     = "inspected"
+	WorkOrderCancelled     = "cancelled"
+)
+
+// Where a work order came from
+const (
+	WorkOrderSourceManual     = "manual"
+	WorkOrderSourceIssue      = "issue"
+	WorkOrderSourceAlert      = "alert"
+	WorkOrderSourceInspection = "inspection"
+)
+
+var workOrderStatusLabels = map[string]string{
+	WorkOrderOpen:          "Open",
+	WorkOrderAssigned:      "Assigned",
+	WorkOrderInProgress:    "In progress",
+	WorkOrderAwaitingParts: "Awaiting parts",
+	WorkOrderCompleted:     "Completed",
+	WorkOrderInspected:     "Inspected",
+	WorkOrderCancelled:     "Cancelled",
+}
+
+// workOrderTransitions is where each status can go next. Inspected and
+// cancelled orders are closed for good.
+var workOrderTransitions = map[string][]string{
+	WorkOrderOpen:          {WorkOrderAssigned, WorkOrderCancelled},
+	WorkOrderAssigned:      {WorkOrderOpen, WorkOrderInProgress, WorkOrderAwaitingParts, WorkOrderCompleted, WorkOrderCancelled},
+	WorkOrderInProgress:    {WorkOrderAwaitingParts, WorkOrderCompleted, WorkOrderCancelled},
+	WorkOrderAwaitingParts: {WorkOrderInProgress, WorkOrderCancelled},
+	WorkOrderCompleted:     {WorkOrderInspected, WorkOrderInProgress},
+}
+
+var workOrderPriorities = []string{"low", "normal", "high", "critical"}
+
+// workOrderCategories match the maintenance log's categories, so a
+// completed order's record reads like one entered by hand
+var workOrderCategories = map[string]string{
+	"oil_change":   "Oil Change",
+	"tire_service": "Tire Service",
+	"inspection":   "Inspection",
+	"repair":       "Repair",
+	"other":        "Other",
+}
+
+// workOrderError is a change a work order's state doesn't allow. Its
+// message is written for the person who tried it.
+type workOrderError string
+
+func (e workOrderError) Error() string { return string(e) }
+
+// WorkOrder is a repair job on one vehicle, from report to inspection
+type WorkOrder struct {
+	ID                  int            `db:"id"`
+	VehicleID           string         `db:"vehicle_id"`
+	Title               string         `db:"title"`
+	Description         string         `db:"description"`
+	Category            string         `db:"category"`
+	Priority            string         `db:"priority"`
+	Status              string         `db:"status"`
+	Source              string         `db:"source"`
+	IssueID             sql.NullInt64  `db:"issue_id"`
+	InspectionID        sql.NullInt64  `db:"inspection_id"`
+	AlertItem           sql.NullString `db:"alert_item"`
+	AssignedTo          sql.NullString `db:"assigned_to"`
+	Vendor              sql.NullString `db:"vendor"`
+	Hold                bool           `db:"hold"`
+	HeldStatus          sql.NullString `db:"held_status"`
+	Mileage             sql.NullInt64  `db:"mileage"`
+	MaintenanceRecordID sql.NullInt64  `db:"maintenance_record_id"`
+	CreatedBy           sql.NullString `db:"created_by"`
+	CreatedAt           time.Time      `db:"created_at"`
+	UpdatedAt           time.Time      `db:"updated_at"`
+	CompletedBy         sql.NullString `db:"completed_by"`
+	CompletedAt         sql.NullTime   `db:"completed_at"`
+	InspectedBy         sql.NullString `db:"inspected_by"`
+	InspectedAt         sql.NullTime   `db:"inspected_at"`
+}
+
+// StatusLabel is the status as people read it
+func (o WorkOrder) StatusLabel() string {
+	return workOrderStatusLabels[o.Status]
+}
+
+// CategoryLabel is the category as people read it
+func (o WorkOrder) CategoryLabel() string {
+	if label, ok := workOrderCategories[o.Category]; ok {
+		return label
+	}
+	return o.Category
+}
+
+// Closed reports whether the order has been inspected or cancelled
+func (o WorkOrder) Closed() bool {
+	return o.Status == WorkOrderInspected || o.Status == WorkOrderCancelled
+}
+
+// Editable reports whether labor and parts can still be changed
+func (o WorkOrder) Editable() bool {
+	return !o.Closed() && o.Status != WorkOrderCompleted
+}
+
+// Assignee names the mechanic, the vendor, or both
+func (o WorkOrder) Assignee() string {
+	switch {
+	case o.AssignedTo.Valid && o.Vendor.Valid:
+		return o.AssignedTo.String + " with " + o.Vendor.String
+	case o.AssignedTo.Valid:
+		return o.AssignedTo.String
+	case o.Vendor.Valid:
+		return o.Vendor.String
+	}
+	return ""
+}
+
+// CanMoveTo reports whether the order can go to a status from where it is
+func (o WorkOrder) CanMoveTo(status string) bool {
+	for _, next := range workOrderTransitions[o.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkOrderLine is labor or a part charged to a work order
+type WorkOrderLine struct {
+	ID          int            `db:"id"`
+	WorkOrderID int            `db:"work_order_id"`
+	LineType    string         `db:"line_type"`
+	Description string         `db:"description"`
+	PartNumber  string         `db:"part_number"`
+	Quantity    float64        `db:"quantity"`
+	UnitCost    float64        `db:"unit_cost"`
+	AddedBy     sql.NullString `db:"added_by"`
+	CreatedAt   time.Time      `db:"created_at"`
+	PartID      sql.NullInt64  `db:"part_id"`
+	LocationID  sql.NullInt64  `db:"location_id"`
+}
+
+// Total is quantity times unit cost
+func (l WorkOrderLine) Total() float64 {
+	return l.Quantity * l.UnitCost
+}
+
+// WorkOrderEvent is one step in a work order's history
+type WorkOrderEvent struct {
+	ID          int            `db:"id"`
+	WorkOrderID int            `db:"work_order_id"`
+	FromStatus  sql.NullString `db:"from_status"`
+	ToStatus    string         `db:"to_status"`
+	Actor       string         `db:"actor"`
+	Notes       string         `db:"notes"`
+	CreatedAt   time.Time      `db:"created_at"`
+}
+
+// StatusLabel is the status the order moved to
+func (e WorkOrderEvent) StatusLabel() string {
+	return workOrderStatusLabels[e.ToStatus]
+}
+
+// createWorkOrder opens an order, holding the vehicle out of service if
+// asked, and marks a linked driver report as being worked on
+func createWorkOrder(o WorkOrder, actor string) (int, error) {
+	if o.Priority == "" {
+		o.Priority = "normal"
+	}
+	if o.Category == "" {
+		o.Category = "repair"
+	}
+	if _, ok := workOrderCategories[o.Category]; !ok {
+		return 0, workOrderError("Unknown category " + o.Category)
+	}
+	if !isWorkOrderPriority(o.Priority) {
+		return 0, workOrderError("Unknown priority " + o.Priority)
+	}
+	if o.Source == "" {
+		o.Source = WorkOrderSourceManual
+	}
+
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		if _, err := vehicleStatusInTx(tx, o.VehicleID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return workOrderError("Unknown vehicle " + o.VehicleID)
+			}
+			return err
+		}
+
+		err := tx.QueryRow(`
+			INSERT INTO work_orders (vehicle_id, title, description, category, priority, source,
+				issue_id, inspection_id, alert_item, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id
+		`, o.VehicleID, o.Title, o.Description, o.Category, o.Priority, o.Source,
+			o.IssueID, o.InspectionID, o.AlertItem, actor).Scan(&o.ID)
+		if err != nil {
+			return err
+		}
+		o.Status = WorkOrderOpen
+		if err := logWorkOrderEventInTx(tx, o.ID, "", WorkOrderOpen, actor, ""); err != nil {
+			return err
+		}
+
+		if o.Hold {
+			o.Hold = false
+			if err := placeHoldInTx(tx, &o); err != nil {
+				return err
+			}
+		}
+		if o.IssueID.Valid {
+			if _, err := tx.Exec(`UPDATE issue_reports SET status = 'in_progress' WHERE issue_id = $1 AND status = 'open'`, o.IssueID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	invalidateFleetCaches()
+	return o.ID, nil
+}
+
+func isWorkOrderPriority(priority string) bool {
+	for _, p := range workOrderPriorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// openWorkOrderFromIssue turns a driver's issue report into a work order.
+// Critical reports hold the vehicle.
+func openWorkOrderFromIssue(issueID int, actor string) (int, error) {
+	var issue struct {
+		VehicleID   sql.NullString `db:"vehicle_id"`
+		Type        string         `db:"type"`
+		Description string         `db:"description"`
+		Severity    string         `db:"severity"`
+		ReportedBy  string         `db:"reported_by"`
+	}
+	if err := db.Get(&issue, `
+		SELECT vehicle_id, type, description, severity, reported_by
+		FROM issue_reports WHERE issue_id = $1
+	`, issueID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, workOrderError("No such driver report")
+		}
+		return 0, err
+	}
+	if issue.VehicleID.String == "" {
+		return 0, workOrderError("That report doesn't name a vehicle")
+	}
+	if existing, err := openWorkOrderFor(`issue_id = $1`, issueID); err != nil || existing != 0 {
+		if err == nil {
+			err = workOrderError(fmt.Sprintf("Work order #%d already covers that report", existing))
+		}
+		return 0, err
+	}
+
+	priority := map[string]string{"low": "low", "medium": "normal", "high": "high", "critical": "critical"}[issue.Severity]
+	return createWorkOrder(WorkOrder{
+		VehicleID:   issue.VehicleID.String,
+		Title:       truncateString(fmt.Sprintf("Driver report (%s) from %s", strings.ReplaceAll(issue.Type, "_", " "), issue.ReportedBy), 255),
+		Description: issue.Description,
+		Category:    "repair",
+		Priority:    priority,
+		Source:      WorkOrderSourceIssue,
+		IssueID:     sql.NullInt64{Int64: int64(issueID), Valid: true},
+		Hold:        issue.Severity == "critical",
+	}, actor)
+}
+
+// openWorkOrderFromAlert schedules a service a PM program says is due,
+// such as an oil change
+func openWorkOrderFromAlert(vehicleID, item, actor string) (int, error) {
+	due, err := loadPMDueList(db, vehicleID)
+	if err != nil {
+		return 0, err
+	}
+	var pm *PMDue
+	for i := range due {
+		if due[i].Program.Name == item && due[i].Status != PMStatusOK {
+			pm = &due[i]
+		}
+	}
+	if pm == nil {
+		return 0, workOrderError(fmt.Sprintf("%s isn't due on %s", item, vehicleID))
+	}
+	if existing, err := openWorkOrderFor(`vehicle_id = $1 AND alert_item = $2`, vehicleID, item); err != nil || existing != 0 {
+		if err == nil {
+			err = workOrderError(fmt.Sprintf("Work order #%d is already open for that", existing))
+		}
+		return 0, err
+	}
+
+	description := pm.Message()
+	if pm.Program.Description != "" {
+		description += "\n\n" + pm.Program.Description
+	}
+	priority := "normal"
+	if pm.Status == PMStatusOverdue {
+		priority = "high"
+	}
+	return createWorkOrder(WorkOrder{
+		VehicleID:   vehicleID,
+		Title:       item,
+		Description: description,
+		Category:    pm.Program.Category,
+		Priority:    priority,
+		Source:      WorkOrderSourceAlert,
+		AlertItem:   sql.NullString{String: item, Valid: true},
+	}, actor)
+}
+
+// openWorkOrderFromInspection opens an order for a failed pre-trip
+// inspection. A bus the driver found unsafe is held out of service.
+func openWorkOrderFromInspection(inspectionID int, inspection PreTripInspection, driver string) (int, error) {
+	var problems []string
+	problems = append(problems, inspection.Issues...)
+	for _, item := range inspection.Items {
+		if item.Status == "pass" {
+			continue
+		}
+		problem := fmt.Sprintf("%s / %s: %s", item.Category, item.Item, strings.ReplaceAll(item.Status, "_", " "))
+		if item.Notes != "" {
+			problem += " (" + item.Notes + ")"
+		}
+		problems = append(problems, problem)
+	}
+
+	priority := "high"
+	if !inspection.SafeToDrive {
+		priority = "critical"
+	}
+	return createWorkOrder(WorkOrder{
+		VehicleID:    inspection.BusID,
+		Title:        "Pre-trip inspection failed",
+		Description:  fmt.Sprintf("Reported by %s:\n%s", driver, strings.Join(problems, "\n")),
+		Category:     "repair",
+		Priority:     priority,
+		Source:       WorkOrderSourceInspection,
+		InspectionID: sql.NullInt64{Int64: int64(inspectionID), Valid: inspectionID > 0},
+		Hold:         !inspection.SafeToDrive,
+	}, driver)
+}
+
+// openWorkOrderFor finds an order that isn't closed matching a condition,
+// returning 0 when there isn't one
+func openWorkOrderFor(condition string, args ...interface{}) (int, error) {
+	var id int
+	err := db.Get(&id, `
+		SELECT id FROM work_orders
+		WHERE `+condition+` AND status NOT IN ('inspected', 'cancelled')
+		ORDER BY id LIMIT 1
+	`, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// loadWorkOrder reads one order
+func loadWorkOrder(id int) (*WorkOrder, error) {
+	var o WorkOrder
+	if err := db.Get(&o, `SELECT * FROM work_orders WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// updateWorkOrder locks an order, lets fn change it, and commits
+func updateWorkOrder(id int, fn func(tx *sqlx.Tx, o *WorkOrder) error) (*WorkOrder, error) {
+	var o WorkOrder
+	err := withTransaction(func(tx *sqlx.Tx) error {
+		if err := tx.Get(&o, `SELECT * FROM work_orders WHERE id = $1 FOR UPDATE`, id); err != nil {
+			return err
+		}
+		return fn(tx, &o)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// moveWorkOrderInTx changes an order's status and records the move
+func moveWorkOrderInTx(tx *sqlx.Tx, o *WorkOrder, to, actor, notes string) error {
+	if !o.CanMoveTo(to) {
+		return workOrderError(fmt.Sprintf("A work order that is %s can't be moved to %s",
+			strings.ToLower(o.StatusLabel()), strings.ToLower(workOrderStatusLabels[to])))
+	}
+	if _, err := tx.Exec(`UPDATE work_orders SET status = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, o.ID, to); err != nil {
+		return err
+	}
+	if err := logWorkOrderEventInTx(tx, o.ID, o.Status, to, actor, notes); err != nil {
+		return err
+	}
+	o.Status = to
+	return nil
+}
+
+func logWorkOrderEventInTx(tx *sqlx.Tx, orderID int, from, to, actor, notes string) error {
+	_, err := tx.Exec(`
+		INSERT INTO work_order_events (work_order_id, from_status, to_status, actor, notes)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+	`, orderID, from, to, actor, notes)
+	return err
+}
+
+// assignWorkOrder gives an order to a mechanic, an outside vendor, or
+// both. Reassigning a job already under way leaves its status alone.
+func assignWorkOrder(id int, mechanic, vendor, actor string) (*WorkOrder, error) {
+	if mechanic == "" && vendor == "" {
+		return nil, workOrderError("Choose a mechanic or enter a vendor")
+	}
+	return updateWorkOrder(id, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if mechanic != "" {
+			var ok bool
+			if err := tx.Get(&ok, `
+				SELECT EXISTS (SELECT 1 FROM users WHERE username = $1 AND status = 'active'
+					AND role IN (SELECT role FROM role_permissions WHERE permission = $2))
+			`, mechanic, PermMaintenanceEdit); err != nil {
+				return err
+			}
+			if !ok {
+				return workOrderError(mechanic + " can't be assigned maintenance work")
+			}
+		}
+		if _, err := tx.Exec(`
+			UPDATE work_orders SET assigned_to = NULLIF($2, ''), vendor = NULLIF($3, ''), updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, o.ID, mechanic, vendor); err != nil {
+			return err
+		}
+		o.AssignedTo = sql.NullString{String: mechanic, Valid: mechanic != ""}
+		o.Vendor = sql.NullString{String: vendor, Valid: vendor != ""}
+
+		if o.Status == WorkOrderOpen {
+			return moveWorkOrderInTx(tx, o, WorkOrderAssigned, actor, "Assigned to "+o.Assignee())
+		}
+		if o.Closed() || o.Status == WorkOrderCompleted {
+			return workOrderError("Only work that isn't finished can be reassigned")
+		}
+		return logWorkOrderEventInTx(tx, o.ID, o.Status, o.Status, actor, "Reassigned to "+o.Assignee())
+	})
+}
+
+// changeWorkOrderStatus starts, pauses for parts, unassigns or cancels
+// an order. Completion and inspection have sign-offs of their own.
+func changeWorkOrderStatus(id int, to, actor, notes string) (*WorkOrder, error) {
+	switch to {
+	case WorkOrderOpen, WorkOrderInProgress, WorkOrderAwaitingParts, WorkOrderCancelled:
+	default:
+		return nil, workOrderError("Use the sign-off to complete or inspect a work order")
+	}
+	if to == WorkOrderCancelled && notes == "" {
+		return nil, workOrderError("Give a reason for cancelling")
+	}
+
+	o, err := updateWorkOrder(id, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if err := moveWorkOrderInTx(tx, o, to, actor, notes); err != nil {
+			return err
+		}
+		switch to {
+		case WorkOrderOpen:
+			_, err := tx.Exec(`UPDATE work_orders SET assigned_to = NULL, vendor = NULL WHERE id = $1`, o.ID)
+			return err
+		case WorkOrderCancelled:
+			if err := releaseHoldInTx(tx, o); err != nil {
+				return err
+			}
+			// The problem the driver reported still needs looking at
+			if o.IssueID.Valid {
+				_, err := tx.Exec(`UPDATE issue_reports SET status = 'open' WHERE issue_id = $1 AND status = 'in_progress'`, o.IssueID)
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && to == WorkOrderCancelled {
+		invalidateFleetCaches()
+	}
+	return o, err
+}
+
+// completeWorkOrder is the mechanic's sign-off. It writes the maintenance
+// record, costed from the order's lines, and brings the vehicle's mileage
+// and service history up to date. An order sent back by inspection
+// updates the record it wrote the first time.
+func completeWorkOrder(id, mileage int, notes, actor string) (*WorkOrder, error) {
+	o, err := updateWorkOrder(id, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if err := moveWorkOrderInTx(tx, o, WorkOrderCompleted, actor, notes); err != nil {
+			return err
+		}
+
+		var cost float64
+		if err := tx.Get(&cost, `SELECT COALESCE(SUM(quantity * unit_cost), 0) FROM work_order_lines WHERE work_order_id = $1`, o.ID); err != nil {
+			return err
+		}
+		summary := fmt.Sprintf("%s (work order #%d)", o.Title, o.ID)
+		if notes != "" {
+			summary += " - " + notes
+		}
+		today := time.Now().Format("2006-01-02")
+
+		recordID := int(o.MaintenanceRecordID.Int64)
+		if o.MaintenanceRecordID.Valid {
+			if _, err := tx.Exec(`
+				UPDATE maintenance_records
+				SET service_date = $2, work_description = $3, mileage = $4, cost = $5, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1
+			`, recordID, today, o.Category+": "+summary, mileage, cost); err != nil {
+				return fmt.Errorf("failed to update maintenance record: %w", err)
+			}
+		} else {
+			var err error
+			if recordID, err = insertMaintenanceRecordInTx(tx, o.VehicleID, today, o.Category, summary, mileage, cost); err != nil {
+				return fmt.Errorf("failed to save maintenance record: %w", err)
+			}
+		}
+		if err := recordPMServiceInTx(tx, o.VehicleID, o.AlertItem.String, o.Category, today, mileage, o.ID); err != nil {
+			return err
+		}
+		if err := applyServiceMileageInTx(tx, o.VehicleID, o.Category, mileage); err != nil {
+			return err
+		}
+
+		// The parts it drew from stock are now consumption against the record
+		if _, err := tx.Exec(`
+			UPDATE part_movements SET maintenance_record_id = $2 WHERE work_order_id = $1
+		`, o.ID, recordID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			UPDATE work_orders
+			SET mileage = NULLIF($2, 0), maintenance_record_id = $3, completed_by = $4, completed_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, o.ID, mileage, recordID, actor)
+		o.MaintenanceRecordID = sql.NullInt64{Int64: int64(recordID), Valid: true}
+		o.CompletedBy = sql.NullString{String: actor, Valid: true}
+		return err
+	})
+	if err == nil {
+		invalidateFleetCaches()
+		if err := linkMaintenanceExpenseToBudget(int(o.MaintenanceRecordID.Int64)); err != nil {
+			log.Printf("Error posting work order %d to the budget: %v", o.ID, err)
+		}
+	}
+	return o, err
+}
+
+// inspectWorkOrder is the final sign-off, by someone other than whoever
+// completed the repair. A pass closes the order, lifts its hold and
+// resolves the driver's report; a failure sends it back to the mechanic.
+func inspectWorkOrder(id int, passed bool, notes, actor string) (*WorkOrder, error) {
+	if !passed && notes == "" {
+		return nil, workOrderError("Say what failed inspection")
+	}
+	o, err := updateWorkOrder(id, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if o.Status != WorkOrderCompleted {
+			return workOrderError("Only completed work can be inspected")
+		}
+		if o.CompletedBy.String == actor {
+			return workOrderError("The repair has to be inspected by someone other than who completed it")
+		}
+		if !passed {
+			return moveWorkOrderInTx(tx, o, WorkOrderInProgress, actor, "Failed inspection: "+notes)
+		}
+
+		if err := moveWorkOrderInTx(tx, o, WorkOrderInspected, actor, notes); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			UPDATE work_orders SET inspected_by = $2, inspected_at = CURRENT_TIMESTAMP WHERE id = $1
+		`, o.ID, actor); err != nil {
+			return err
+		}
+		if err := releaseHoldInTx(tx, o); err != nil {
+			return err
+		}
+		if o.IssueID.Valid {
+			if _, err := tx.Exec(`
+				UPDATE issue_reports
+				SET status = 'resolved', resolved_by = $2, resolved_at = CURRENT_TIMESTAMP, resolution_notes = $3
+				WHERE issue_id = $1
+			`, o.IssueID, actor, fmt.Sprintf("Repaired under work order #%d", o.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && passed {
+		invalidateFleetCaches()
+	}
+	return o, err
+}
+
+// setWorkOrderHold puts a hold on the vehicle or lifts it, for when the
+// mechanic finds it more or less drivable than first thought
+func setWorkOrderHold(id int, hold bool, actor string) (*WorkOrder, error) {
+	o, err := updateWorkOrder(id, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if o.Closed() {
+			return workOrderError("This work order is closed")
+		}
+		if hold == o.Hold {
+			return nil
+		}
+		note := "Hold lifted; vehicle can be used"
+		if hold {
+			note = "Vehicle held out of service"
+			if err := placeHoldInTx(tx, o); err != nil {
+				return err
+			}
+		} else if err := releaseHoldInTx(tx, o); err != nil {
+			return err
+		}
+		return logWorkOrderEventInTx(tx, o.ID, o.Status, o.Status, actor, note)
+	})
+	if err == nil {
+		invalidateFleetCaches()
+	}
+	return o, err
+}
+
+// placeHoldInTx takes the order's vehicle out of service. When another
+// order already holds it, this one restores the same status as that one.
+func placeHoldInTx(tx *sqlx.Tx, o *WorkOrder) error {
+	var previous string
+	err := tx.Get(&previous, `
+		SELECT held_status FROM work_orders
+		WHERE vehicle_id = $1 AND hold AND id <> $2 AND held_status IS NOT NULL
+		LIMIT 1
+	`, o.VehicleID, o.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		previous, err = vehicleStatusInTx(tx, o.VehicleID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE work_orders SET hold = true, held_status = $2 WHERE id = $1`, o.ID, previous); err != nil {
+		return err
+	}
+	if err := setVehicleStatusInTx(tx, o.VehicleID, "out_of_service"); err != nil {
+		return err
+	}
+	o.Hold = true
+	o.HeldStatus = sql.NullString{String: previous, Valid: true}
+	return nil
+}
+
+// releaseHoldInTx lifts the order's hold. The vehicle goes back to its
+// earlier status once no other order holds it, unless someone has
+// changed its status by hand in the meantime.
+func releaseHoldInTx(tx *sqlx.Tx, o *WorkOrder) error {
+	if !o.Hold {
+		return nil
+	}
+	if _, err := tx.Exec(`UPDATE work_orders SET hold = false WHERE id = $1`, o.ID); err != nil {
+		return err
+	}
+	o.Hold = false
+
+	var others int
+	if err := tx.Get(&others, `SELECT COUNT(*) FROM work_orders WHERE vehicle_id = $1 AND hold`, o.VehicleID); err != nil {
+		return err
+	}
+	if others > 0 || !o.HeldStatus.Valid {
+		return nil
+	}
+	if _, err := tx.Exec(`UPDATE buses SET status = $2, updated_at = CURRENT_TIMESTAMP WHERE bus_id = $1 AND status = 'out_of_service'`,
+		o.VehicleID, o.HeldStatus.String); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE vehicles SET status = $2, updated_at = CURRENT_TIMESTAMP WHERE vehicle_id = $1 AND status = 'out_of_service'`,
+		o.VehicleID, o.HeldStatus.String)
+	return err
+}
+
+// vehicleHold returns the order holding a vehicle out of service, or nil
+func vehicleHold(vehicleID string) (*WorkOrder, error) {
+	var o WorkOrder
+	err := db.Get(&o, `SELECT * FROM work_orders WHERE vehicle_id = $1 AND hold ORDER BY id LIMIT 1`, vehicleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// addWorkOrderLine charges labor or a part to an order still being worked,
+// returning the line as saved. A part drawn from the stockroom is
+// described and costed from the catalog and taken out of stock.
+func addWorkOrderLine(line WorkOrderLine) (WorkOrderLine, error) {
+	if line.PartID.Valid {
+		line.LineType = "part"
+	}
+	if line.LineType != "labor" && line.LineType != "part" {
+		return line, workOrderError("A line is labor or a part")
+	}
+	var reorder *StockLevel
+	_, err := updateWorkOrder(line.WorkOrderID, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if !o.Editable() {
+			return workOrderError("Labor and parts can't be changed once the work is completed")
+		}
+		if line.PartID.Valid {
+			var part Part
+			if err := tx.Get(&part, `SELECT * FROM parts WHERE id = $1`, line.PartID.Int64); err != nil {
+				return err
+			}
+			line.Description, line.PartNumber, line.UnitCost = part.Name, part.PartNumber, part.UnitCost
+		}
+		if line.Description == "" || line.Quantity <= 0 || line.UnitCost < 0 {
+			return workOrderError("A line needs a description, a quantity above zero and a cost that isn't negative")
+		}
+
+		if err := tx.Get(&line.ID, `
+			INSERT INTO work_order_lines (work_order_id, line_type, description, part_number, quantity, unit_cost, added_by, part_id, location_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING id
+		`, line.WorkOrderID, line.LineType, line.Description, line.PartNumber, line.Quantity, line.UnitCost, line.AddedBy,
+			line.PartID, line.LocationID); err != nil {
+			return err
+		}
+		if !line.PartID.Valid {
+			return nil
+		}
+		var err error
+		reorder, err = moveStockInTx(tx, PartMovement{
+			PartID:          int(line.PartID.Int64),
+			LocationID:      int(line.LocationID.Int64),
+			Movement:        PartConsume,
+			Quantity:        -line.Quantity,
+			UnitCost:        line.UnitCost,
+			VehicleID:       sql.NullString{String: o.VehicleID, Valid: true},
+			WorkOrderID:     sql.NullInt64{Int64: int64(o.ID), Valid: true},
+			WorkOrderLineID: sql.NullInt64{Int64: int64(line.ID), Valid: true},
+			Actor:           line.AddedBy.String,
+		})
+		if refused, ok := err.(inventoryError); ok {
+			return workOrderError(refused)
+		}
+		return err
+	})
+	if err == nil {
+		notifyPartReorder(reorder)
+	}
+	return line, err
+}
+
+// removeWorkOrderLine takes a line off an order still being worked,
+// putting a stockroom part back where it came from
+func removeWorkOrderLine(orderID, lineID int, actor string) error {
+	_, err := updateWorkOrder(orderID, func(tx *sqlx.Tx, o *WorkOrder) error {
+		if !o.Editable() {
+			return workOrderError("Labor and parts can't be changed once the work is completed")
+		}
+		var line WorkOrderLine
+		if err := tx.Get(&line, `
+			DELETE FROM work_order_lines WHERE id = $1 AND work_order_id = $2 RETURNING *
+		`, lineID, orderID); err != nil {
+			return err
+		}
+		if !line.PartID.Valid || !line.LocationID.Valid {
+			return nil
+		}
+		_, err := moveStockInTx(tx, PartMovement{
+			PartID:          int(line.PartID.Int64),
+			LocationID:      int(line.LocationID.Int64),
+			Movement:        PartReturn,
+			Quantity:        line.Quantity,
+			UnitCost:        line.UnitCost,
+			VehicleID:       sql.NullString{String: o.VehicleID, Valid: true},
+			WorkOrderID:     sql.NullInt64{Int64: int64(o.ID), Valid: true},
+			WorkOrderLineID: sql.NullInt64{Int64: int64(line.ID), Valid: true},
+			Actor:           actor,
+		})
+		return err
+	})
+	return err
+}
+
+// vehicleStatusInTx reads a bus's or fleet vehicle's status
+func vehicleStatusInTx(tx *sqlx.Tx, vehicleID string) (string, error) {
+	var status string
+	err := tx.Get(&status, `
+		SELECT status FROM buses WHERE bus_id = $1
+		UNION ALL
+		SELECT COALESCE(status, 'active') FROM vehicles WHERE vehicle_id = $1
+		LIMIT 1
+	`, vehicleID)
+	return status, err
+}
+
+// setVehicleStatusInTx sets a bus's status, or a fleet vehicle's when
+// there's no bus by that id
+func setVehicleStatusInTx(tx *sqlx.Tx, vehicleID, status string) error {
+	result, err := tx.Exec(`UPDATE buses SET status = $2, updated_at = CURRENT_TIMESTAMP WHERE bus_id = $1`, vehicleID, status)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err = tx.Exec(`UPDATE vehicles SET status = $2, updated_at = CURRENT_TIMESTAMP WHERE vehicle_id = $1`, vehicleID, status)
+	}
+	return err
+}
+
+// invalidateFleetCaches drops cached buses and vehicles after a work
+// order changes a status or mileage
+func invalidateFleetCaches() {
+	dataCache.invalidateBuses()
+	dataCache.invalidateVehicles()
+}